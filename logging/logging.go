@@ -0,0 +1,107 @@
+/**
+ * Package logging sets up the leveled, structured logging (log/slog)
+ * shared by the peer and tracker: the level, text or JSON output, and an
+ * optional log file that is rotated once it grows too big.
+ */
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// size in MB a log file grows to before it is rotated
+	DEFAULT_MAX_SIZE_MB = 10
+	// rotated log files kept around
+	DEFAULT_MAX_BACKUPS = 3
+)
+
+/**
+ * How and where to log, usually set from the command line
+ */
+type Options struct {
+	// debug, info, warn or error
+	Level string
+	// log file, "" for stderr
+	File string
+	// JSON lines instead of key=value text
+	JSON       bool
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+/**
+ * Registers the --log-* flags
+ * @param flags the flag set to add them to
+ * @param opts filled in when the flags are parsed
+ */
+func AddFlags(flags *flag.FlagSet, opts *Options) {
+	if opts.Level == "" {
+		opts.Level = "info"
+	}
+	if opts.MaxSizeMB == 0 {
+		opts.MaxSizeMB = DEFAULT_MAX_SIZE_MB
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = DEFAULT_MAX_BACKUPS
+	}
+	flags.StringVar(&opts.Level, "log-level", opts.Level, "least severe messages logged: debug, info, warn or error")
+	flags.StringVar(&opts.File, "log-file", opts.File, "file to log to, rotated as it grows (default stderr)")
+	flags.BoolVar(&opts.JSON, "log-json", opts.JSON, "log JSON lines instead of text")
+	flags.IntVar(&opts.MaxSizeMB, "log-max-size", opts.MaxSizeMB, "MB a log file grows to before it is rotated")
+	flags.IntVar(&opts.MaxBackups, "log-max-backups", opts.MaxBackups, "rotated log files to keep")
+}
+
+/**
+ * Makes a logger built from opts the default slog logger
+ * @param opts how and where to log
+ * @return an error if the level is unknown
+ */
+func Setup(opts Options) error {
+	return SetupOutput(opts, os.Stderr)
+}
+
+/**
+ * Like Setup, but logs not going to a file go to out instead of stderr,
+ * e.g. while a full-screen UI owns the terminal
+ * @param opts how and where to log
+ * @param out where to log without a log file
+ * @return an error if the level is unknown
+ */
+func SetupOutput(opts Options, out io.Writer) error {
+	var level slog.Level
+	switch strings.ToLower(opts.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return fmt.Errorf("unknown log level %q", opts.Level)
+	}
+
+	if opts.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+		}
+	}
+	handler_opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(out, handler_opts)
+	if opts.JSON {
+		handler = slog.NewJSONHandler(out, handler_opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
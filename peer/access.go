@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Access control: a song, or a whole directory of them, can be made
+ * friends-only or private with `peer access`, and single peers let in by
+ * their identity key. The rules are kept in the library, and the most
+ * specific one for a file wins; files without one are public. A restricted
+ * song is announced with the keys allowed to see it, and the tracker only
+ * lists it to requests signed with one of them. This peer only lists it,
+ * and only serves the file, to requests signed the same way; anyone else
+ * is told there is no such song
+ */
+
+const (
+	// who may see a song: anyone, the peers followed, or only the peers
+	// let in one by one
+	ACCESS_PUBLIC  = "public"
+	ACCESS_FRIENDS = "friends"
+	ACCESS_PRIVATE = "private"
+	// how often a serving peer rereads the rules
+	ACCESS_POLL = 30 * time.Second
+)
+
+/**
+ * A rule for a file or directory, as kept in the library
+ */
+type AccessRule struct {
+	// absolute, with symlinks resolved
+	Path  string
+	Level string
+	// the identity keys let in, in hex
+	Allow []string
+}
+
+var (
+	// the rules by path, and the keys of the peers followed, as last read
+	// from the library, guarded by master_mutex
+	access_rules = make(map[string]AccessRule)
+	friend_keys  [][]byte
+)
+
+/**
+ * @return the rules, by path, and the keys of the peers followed; none
+ * without the library
+ */
+func load_access() (map[string]AccessRule, [][]byte, error) {
+	rules := make(map[string]AccessRule)
+	if library == nil {
+		return rules, nil, nil
+	}
+	rows, err := library.Query("SELECT path, level FROM access")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var rule AccessRule
+		if err = rows.Scan(&rule.Path, &rule.Level); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		rules[rule.Path] = rule
+	}
+	rows.Close()
+	rows, err = library.Query("SELECT path, key FROM access_grants ORDER BY key")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var path, key string
+		if err = rows.Scan(&path, &key); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if rule, ok := rules[path]; ok {
+			rule.Allow = append(rule.Allow, key)
+			rules[path] = rule
+		}
+	}
+	rows.Close()
+	friends, err := friends_list()
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys [][]byte
+	for _, friend := range friends {
+		if key, err := parse_key(friend.Key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return rules, keys, nil
+}
+
+/**
+ * Called with master_mutex held
+ * @param song_path a file's absolute path, with symlinks resolved
+ * @return whether the file is restricted, and if so the identity keys of
+ * the peers that may see it: this peer's own, the ones let in, and with
+ * ACCESS_FRIENDS the peers followed
+ */
+func song_access(song_path string) (bool, [][]byte) {
+	best := ""
+	for path := range access_rules {
+		if song_path != path && !strings.HasPrefix(song_path, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if len(path) > len(best) {
+			best = path
+		}
+	}
+	rule, ok := access_rules[best]
+	if !ok || rule.Level == ACCESS_PUBLIC {
+		return false, nil
+	}
+	allow := [][]byte{identity_key()}
+	for _, arg := range rule.Allow {
+		if key, err := parse_key(arg); err == nil {
+			allow = append(allow, key)
+		}
+	}
+	if rule.Level == ACCESS_FRIENDS {
+		allow = append(allow, friend_keys...)
+	}
+	return true, allow
+}
+
+// signatures on requests served lately, so a recorded one can't be sent again
+var request_guard = tsp.NewReplayGuard()
+
+/**
+ * @param in_msg a request from a peer
+ * @return the identity key the request is signed with, nil if it isn't
+ * signed, the signature is bad, or it carries no signing time (a peer
+ * older than version 24, whose signature could be a replay)
+ */
+func requester_key(in_msg *tsp.Msg) []byte {
+	if len(in_msg.Header.Signature) == 0 || in_msg.Header.Signed == 0 ||
+		!tsp.Verify(in_msg, nil) {
+		return nil
+	}
+	return in_msg.Header.Key
+}
+
+/**
+ * Checks, once per request, that a signed request is fresh and hasn't been
+ * served before. Requests that requester_key takes as unsigned pass
+ * @param in_msg a request from a peer
+ * @return false if the request is signed but stale or replayed
+ */
+func fresh_request(in_msg *tsp.Msg) bool {
+	if requester_key(in_msg) == nil {
+		return true
+	}
+	return request_guard.Take(in_msg)
+}
+
+/**
+ * @param a identity keys
+ * @param b identity keys
+ * @return whether they are the same keys, in the same order
+ */
+func same_keys(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Rereads the rules, and applies them to the songs this peer serves,
+ * telling the tracker about every song whose access changed
+ */
+func refresh_access() {
+	rules, keys, err := load_access()
+	if err != nil {
+		slog.Error("can't read who may see which songs", "err", err)
+		return
+	}
+	var changed []tsp.SongEntry
+	master_mutex.Lock()
+	access_rules, friend_keys = rules, keys
+	for i, song := range local_songs {
+		source := &local_songs[i].Sources[0]
+		restricted, allow := song_access(catalog[source.FileID])
+		if restricted == source.Restricted && same_keys(allow, source.Allow) {
+			continue
+		}
+		source.Restricted, source.Allow = restricted, allow
+		set_catalog_access(source.FileID, restricted, allow)
+		changed = append(changed, local_songs[i])
+		slog.Info("song access changed", "title", song.Title, "restricted", restricted, "peers", len(allow))
+	}
+	master_mutex.Unlock()
+	update_tracker(tsp.ADD_SONG, changed)
+}
+
+/**
+ * Rereads the rules every ACCESS_POLL, so changes made with `peer access`
+ * take effect, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func watch_access(ctx context.Context) {
+	if library == nil {
+		return
+	}
+	ticker := time.NewTicker(ACCESS_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh_access()
+		}
+	}
+}
+
+/**
+ * @param arg a file or directory, as typed
+ * @return its absolute path with symlinks resolved, or an error if it
+ * doesn't exist
+ */
+func access_path(arg string) (string, error) {
+	path, err := filepath.Abs(arg)
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	return path, err
+}
+
+/**
+ * Sets who may see the songs at a path
+ * @param path a file or directory, see access_path
+ * @param level ACCESS_PUBLIC, ACCESS_FRIENDS or ACCESS_PRIVATE
+ */
+func set_access(path string, level string) error {
+	_, err := library.Exec(`INSERT INTO access (path, level) VALUES (?, ?)
+		ON CONFLICT (path) DO UPDATE SET level = excluded.level`, path, level)
+	return err
+}
+
+/**
+ * Lets a peer in to the songs at a path, or stops letting it in. A path
+ * without a rule yet is made private first
+ * @param path a file or directory, see access_path
+ * @param key the peer's identity key, in hex
+ * @param allow whether to let it in
+ */
+func grant_access(path string, key string, allow bool) error {
+	if !allow {
+		_, err := library.Exec("DELETE FROM access_grants WHERE path = ? AND key = ?", path, key)
+		return err
+	}
+	if _, err := library.Exec("INSERT OR IGNORE INTO access (path, level) VALUES (?, ?)", path, ACCESS_PRIVATE); err != nil {
+		return err
+	}
+	_, err := library.Exec("INSERT OR IGNORE INTO access_grants (path, key) VALUES (?, ?)", path, key)
+	return err
+}
+
+/**
+ * Writes the rules, one per line, with the peers each lets in
+ * @param w where the rules are written
+ * @param rules the rules, by path
+ */
+func write_access(w io.Writer, rules map[string]AccessRule) {
+	if len(rules) == 0 {
+		fmt.Fprintln(w, "Every song is public.")
+	}
+	paths := make([]string, 0, len(rules))
+	for path := range rules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		rule := rules[path]
+		line := fmt.Sprintf("%-8s %s", rule.Level, path)
+		if len(rule.Allow) > 0 {
+			keys := make([]string, len(rule.Allow))
+			for i, key := range rule.Allow {
+				keys[i] = short_key(key)
+			}
+			line += ", also " + strings.Join(keys, ", ")
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * @param arg a friend, as friends takes one, or an identity key
+ * @return the identity key, in hex
+ */
+func access_key(arg string) (string, error) {
+	friends, err := friends_list()
+	if err != nil {
+		return "", err
+	}
+	if friend, err := find_friend(friends, arg); err == nil {
+		return friend.Key, nil
+	}
+	key, err := parse_key(arg)
+	if err != nil {
+		return "", err
+	}
+	return format_key(key), nil
+}
+
+/**
+ * access [<file|dir> public|friends|private | <file|dir> allow|deny
+ * <key|friend>]: lists who may see which songs, sets who may see the songs
+ * at a path, or lets a peer in to them or stops letting it in
+ */
+func run_access(args []string) int {
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	if len(args) == 0 {
+		rules, _, err := load_access()
+		if err != nil {
+			fmt.Println("can't read who may see which songs: ", err)
+			return 1
+		}
+		write_access(os.Stdout, rules)
+		return 0
+	}
+	if len(args) < 2 {
+		fmt.Println("Usage: ", os.Args[0], "access [<file|dir> public|friends|private | <file|dir> allow|deny <key|friend>]")
+		return 2
+	}
+	path, err := access_path(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	switch {
+	case len(args) == 2 && (args[1] == ACCESS_PUBLIC || args[1] == ACCESS_FRIENDS || args[1] == ACCESS_PRIVATE):
+		err = set_access(path, args[1])
+	case len(args) == 3 && (args[1] == "allow" || args[1] == "deny"):
+		var key string
+		if key, err = access_key(args[2]); err == nil {
+			err = grant_access(path, key, args[1] == "allow")
+		}
+	default:
+		fmt.Println("Usage: ", os.Args[0], "access [<file|dir> public|friends|private | <file|dir> allow|deny <key|friend>]")
+		return 2
+	}
+	if err != nil {
+		fmt.Println("can't change who may see the songs: ", err)
+		return 1
+	}
+	fmt.Printf("A serving peer takes the change within %s.\n", ACCESS_POLL)
+	return 0
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+/*
+ * Cover art. The peer serving a song reads the picture embedded in its
+ * tags (an ID3v2 APIC frame, or a FLAC PICTURE block) and sends it back
+ * for an ART request. The client keeps what it gets under ~/.torero/art
+ * and draws it above the now playing line with the kitty graphics
+ * protocol or sixel, in terminals that take one, or else just says which
+ * file it saved it to
+ */
+
+// how cover art is shown, config.Art
+const (
+	ART_AUTO  = "auto"
+	ART_KITTY = "kitty"
+	ART_SIXEL = "sixel"
+	ART_FILE  = "file"
+	ART_OFF   = "off"
+)
+
+const (
+	// terminal columns the art is drawn across, keeping its shape, and the
+	// pixels it is scaled to for sixel, about as many as those cover
+	ART_COLUMNS = 24
+	ART_PIXELS  = 240
+	// base64 bytes per kitty graphics escape, the most it takes
+	KITTY_CHUNK = 4096
+	// the ID3v2 and FLAC picture type of the front cover
+	FRONT_COVER = 3
+)
+
+var art_modes = []string{ART_AUTO, ART_KITTY, ART_SIXEL, ART_FILE, ART_OFF}
+
+// the MIME types of art kept, and the extensions they are kept under
+var (
+	art_mimes = []string{"image/jpeg", "image/png", "image/gif"}
+	art_exts  = map[string]string{"image/jpeg": "jpg", "image/png": "png", "image/gif": "gif"}
+)
+
+/**
+ * Reads the cover art embedded in a song file
+ * @param file_path path of the song file
+ * @return the front cover, or the first picture if none is marked as the
+ * front cover; an error if there is none
+ */
+func read_song_art(file_path string) (tsp.SongArt, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return tsp.SongArt{}, err
+	}
+	defer file.Close()
+
+	var art tsp.SongArt
+	front := false
+	keep := func(mime string, kind int, data []byte) {
+		if len(data) == 0 || front {
+			return
+		}
+		if art.Data == nil || kind == FRONT_COVER {
+			art = tsp.SongArt{MIME: mime, Data: data}
+			front = kind == FRONT_COVER
+		}
+	}
+	switch song_format(file_path) {
+	case tsp.FORMAT_FLAC:
+		stream, err := flac.Parse(file)
+		if err != nil {
+			return tsp.SongArt{}, err
+		}
+		for _, block := range stream.Blocks {
+			if picture, ok := block.Body.(*meta.Picture); ok {
+				keep(picture.MIME, int(picture.Type), picture.Data)
+			}
+		}
+	case tsp.FORMAT_MP3:
+		each_id3v2_frame(file, func(id string, body []byte) {
+			switch id {
+			case "APIC":
+				keep(decode_apic(body))
+			case "PIC":
+				keep(decode_pic(body))
+			}
+		})
+	}
+	if art.Data == nil {
+		return tsp.SongArt{}, errors.New("no cover art in " + filepath.Base(file_path))
+	}
+	if !strings.HasPrefix(art.MIME, "image/") {
+		// some taggers write "JPG" or nothing at all
+		art.MIME = http.DetectContentType(art.Data)
+	}
+	return art, nil
+}
+
+/**
+ * Decodes an ID3v2.3/2.4 APIC frame: an encoding byte, a MIME type ended
+ * by a NUL, the picture type, a description and the image
+ * @param body the frame body
+ * @return the MIME type, the picture type and the image
+ */
+func decode_apic(body []byte) (string, int, []byte) {
+	if len(body) < 2 {
+		return "", 0, nil
+	}
+	end := bytes.IndexByte(body[1:], 0)
+	if end < 0 || 1+end+2 > len(body) {
+		return "", 0, nil
+	}
+	mime := string(body[1 : 1+end])
+	rest := body[1+end+1:]
+	return mime, int(rest[0]), skip_description(body[0], rest[1:])
+}
+
+/**
+ * Decodes an ID3v2.2 PIC frame: an encoding byte, a three letter image
+ * format, the picture type, a description and the image
+ * @param body the frame body
+ * @return the MIME type, the picture type and the image
+ */
+func decode_pic(body []byte) (string, int, []byte) {
+	if len(body) < 5 {
+		return "", 0, nil
+	}
+	mime := "image/" + strings.ToLower(string(body[1:4]))
+	if mime == "image/jpg" {
+		mime = "image/jpeg"
+	}
+	return mime, int(body[4]), skip_description(body[0], body[5:])
+}
+
+/**
+ * @param enc the frame's text encoding
+ * @param b a description in that encoding, ended by a NUL, then the image
+ * @return the image
+ */
+func skip_description(enc byte, b []byte) []byte {
+	if enc != 1 && enc != 2 {
+		if end := bytes.IndexByte(b, 0); end >= 0 {
+			return b[end+1:]
+		}
+		return nil
+	}
+	// UTF-16 ends with two NULs, on a code unit boundary
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			return b[i+2:]
+		}
+	}
+	return nil
+}
+
+/**
+ * Answers an ART with the cover art embedded in the requested song
+ * @param in_msg the request, carrying a FileID
+ * @param client the requesting peer
+ */
+func send_song_art(in_msg *tsp.Msg, client io.Writer) {
+	song_file := requested_file(in_msg)
+	if song_file == "" {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+		return
+	}
+	art, err := read_song_art(song_file)
+	if os.IsNotExist(err) {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+		return
+	}
+	if err != nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, err.Error())
+		return
+	}
+	content, err := tsp.EncodeArt(art)
+	if err != nil {
+		slog.Error("can't encode cover art", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.ART, in_msg.Header.Song_id, content)); err != nil {
+		slog.Warn("can't send cover art", "err", err)
+	}
+}
+
+/**
+ * Asks the song's sources in turn for its cover art
+ * @param song the song
+ * @return the art from the first source to have it
+ */
+func fetch_song_art(song tsp.SongEntry) (tsp.SongArt, error) {
+	err := errors.New("no sources")
+	for _, source := range song.Sources {
+		var conn net.Conn
+		conn, _, err = send_to_peer(*tsp.NewMsg(tsp.ART, song.ID, nil), source)
+		if err != nil {
+			continue
+		}
+		var reply *tsp.Msg
+		reply, err = tsp.Decode(conn)
+		conn.Close()
+		if err == nil {
+			err = reply.Err()
+		}
+		if err == nil {
+			return tsp.DecodeArt(reply.Msg)
+		}
+	}
+	return tsp.SongArt{}, err
+}
+
+/**
+ * @param song a song
+ * @param mime the MIME type of its art
+ * @return where its art is kept, by the hash of its file, "" if the art
+ * isn't one of art_mimes
+ */
+func art_path(song tsp.SongEntry, mime string) string {
+	ext, ok := art_exts[mime]
+	if !ok {
+		return ""
+	}
+	name := strconv.Itoa(song.ID)
+	if len(song.Sources) > 0 && tsp.ValidHash(song.Sources[0].Hash) {
+		name = song.Sources[0].Hash
+	}
+	return filepath.Join(torero_dir(), "art", name+"."+ext)
+}
+
+/**
+ * Gets a song's cover art, from ~/.torero/art if it was fetched before,
+ * keeping it there if not
+ * @param song the song
+ * @return the art, the file it is kept in, and an error if no source has
+ * any, or only an image type that isn't one of art_mimes
+ */
+func song_art(song tsp.SongEntry) (tsp.SongArt, string, error) {
+	for _, mime := range art_mimes {
+		path := art_path(song, mime)
+		if data, err := os.ReadFile(path); err == nil {
+			return tsp.SongArt{MIME: mime, Data: data}, path, nil
+		}
+	}
+	art, err := fetch_song_art(song)
+	if err != nil {
+		return art, "", err
+	}
+	path := art_path(song, art.MIME)
+	if path == "" {
+		return tsp.SongArt{}, "", fmt.Errorf("cover art of unknown type %q", art.MIME)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		err = os.WriteFile(path, art.Data, 0644)
+	}
+	if err != nil {
+		return art, "", err
+	}
+	return art, path, nil
+}
+
+/**
+ * @param mode one of art_modes, as typed
+ * @return an error if it isn't one
+ */
+func check_art_mode(mode string) error {
+	for _, m := range art_modes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("cover art must be one of %s", strings.Join(art_modes, ", "))
+}
+
+/**
+ * @return how to show cover art: config.Art, or with "auto" the graphics
+ * protocol the terminal is known to take, ART_FILE if none
+ */
+func art_protocol() string {
+	if config.Art != ART_AUTO {
+		return config.Art
+	}
+	if !is_terminal() {
+		return ART_FILE
+	}
+	term, program := os.Getenv("TERM"), os.Getenv("TERM_PROGRAM")
+	switch {
+	case os.Getenv("KITTY_WINDOW_ID") != "" || term == "xterm-kitty" || term == "xterm-ghostty" ||
+		program == "WezTerm" || program == "ghostty":
+		return ART_KITTY
+	case strings.Contains(term, "sixel") || strings.HasPrefix(term, "foot") || strings.HasPrefix(term, "mlterm") ||
+		program == "iTerm.app":
+		return ART_SIXEL
+	}
+	return ART_FILE
+}
+
+/**
+ * Shows a song's cover art as art_protocol says
+ * @param w the terminal, or where the file it is saved to is written
+ * @param art the art
+ * @param path the file it is kept in
+ * @return an error if it couldn't be drawn
+ */
+func show_art(w io.Writer, art tsp.SongArt, path string) error {
+	protocol := art_protocol()
+	if protocol == ART_OFF {
+		return nil
+	}
+	if protocol == ART_FILE {
+		fmt.Fprintln(w, "Cover art: "+path)
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(art.Data))
+	if err != nil {
+		return err
+	}
+	if protocol == ART_KITTY {
+		return write_kitty(w, img)
+	}
+	return write_sixel(w, scale_image(img, ART_PIXELS, ART_PIXELS))
+}
+
+/**
+ * Draws an image with the kitty graphics protocol, scaled by the terminal
+ * to ART_COLUMNS wide, leaving the cursor on the line under it
+ * @param w the terminal
+ * @param img the image
+ */
+func write_kitty(w io.Writer, img image.Image) error {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(encoded.Bytes())
+	var out bytes.Buffer
+	for first := true; len(data) > 0; first = false {
+		chunk := data
+		if len(chunk) > KITTY_CHUNK {
+			chunk = chunk[:KITTY_CHUNK]
+		}
+		data = data[len(chunk):]
+		more := 0
+		if len(data) > 0 {
+			more = 1
+		}
+		if first {
+			fmt.Fprintf(&out, "\033_Ga=T,f=100,c=%d,m=%d;%s\033\\", ART_COLUMNS, more, chunk)
+		} else {
+			fmt.Fprintf(&out, "\033_Gm=%d;%s\033\\", more, chunk)
+		}
+	}
+	out.WriteString("\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+/**
+ * Draws an image as sixel graphics, in the 256 colors of the Plan 9
+ * palette, leaving the cursor on the line under it
+ * @param w the terminal
+ * @param img the image
+ */
+func write_sixel(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	paletted := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, bounds.Min)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "\033Pq\"1;1;%d;%d", width, height)
+	used := make([]bool, len(paletted.Palette))
+	for _, index := range paletted.Pix {
+		used[index] = true
+	}
+	for i, c := range paletted.Palette {
+		if used[i] {
+			r, g, b, _ := c.RGBA()
+			fmt.Fprintf(&out, "#%d;2;%d;%d;%d", i, r*100/0xFFFF, g*100/0xFFFF, b*100/0xFFFF)
+		}
+	}
+	// each band is six rows of pixels, drawn a color at a time
+	for top := 0; top < height; top += 6 {
+		in_band := make([]bool, len(paletted.Palette))
+		for y := top; y < top+6 && y < height; y++ {
+			for x := 0; x < width; x++ {
+				in_band[paletted.ColorIndexAt(x, y)] = true
+			}
+		}
+		for i := range in_band {
+			if !in_band[i] {
+				continue
+			}
+			fmt.Fprintf(&out, "#%d", i)
+			run, last := 0, byte(0)
+			for x := 0; x <= width; x++ {
+				var sixel byte
+				if x < width {
+					for dy := 0; dy < 6 && top+dy < height; dy++ {
+						if int(paletted.ColorIndexAt(x, top+dy)) == i {
+							sixel |= 1 << uint(dy)
+						}
+					}
+					sixel += 63
+				}
+				if run > 0 && (x == width || sixel != last) {
+					write_sixel_run(&out, last, run)
+					run = 0
+				}
+				last = sixel
+				run++
+			}
+			out.WriteByte('$')
+		}
+		out.WriteByte('-')
+	}
+	out.WriteString("\033\\\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+/**
+ * @param out where the run is written
+ * @param sixel the sixel repeated
+ * @param run how many times
+ */
+func write_sixel_run(out *bytes.Buffer, sixel byte, run int) {
+	if run > 3 {
+		fmt.Fprintf(out, "!%d%c", run, sixel)
+		return
+	}
+	for ; run > 0; run-- {
+		out.WriteByte(sixel)
+	}
+}
+
+/**
+ * Shrinks an image to fit a box, keeping its shape, averaging the pixels
+ * each new pixel covers
+ * @param img the image
+ * @param max_width the width of the box, in pixels
+ * @param max_height its height
+ * @return the image scaled down, or img if it already fits
+ */
+func scale_image(img image.Image, max_width int, max_height int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= max_width && height <= max_height || width == 0 || height == 0 {
+		return img
+	}
+	scale := float64(max_width) / float64(width)
+	if s := float64(max_height) / float64(height); s < scale {
+		scale = s
+	}
+	out_width, out_height := int(float64(width)*scale), int(float64(height)*scale)
+	if out_width < 1 {
+		out_width = 1
+	}
+	if out_height < 1 {
+		out_height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, out_width, out_height))
+	for y := 0; y < out_height; y++ {
+		y0, y1 := y*height/out_height, (y+1)*height/out_height
+		for x := 0; x < out_width; x++ {
+			x0, x1 := x*width/out_width, (x+1)*width/out_width
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			scaled.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return scaled
+}
+
+/**
+ * Shows the cover art of the song playing, above the now playing line
+ */
+func show_playing_art() {
+	if art_protocol() == ART_OFF {
+		return
+	}
+	song, _, playing := playback.Current()
+	if !playing {
+		return
+	}
+	art, path, err := song_art(song)
+	if err == nil {
+		err = show_art(os.Stdout, art, path)
+	}
+	if err != nil {
+		slog.Debug("no cover art", "song", song.ID, "err", err)
+	}
+}
+
+/**
+ * Shows a song's cover art, or saves it to a file
+ * @param args the song's id, and optionally the file to save the art to
+ * @return the exit status
+ */
+func run_art(args []string) int {
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Println("Usage: ", os.Args[0], "art <song id> [file]")
+		return 2
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, args[0])
+	if !ok {
+		return 1
+	}
+	art, path, err := song_art(song)
+	if err != nil {
+		fmt.Println("no cover art: ", err)
+		return 1
+	}
+	if len(args) > 1 {
+		if err = os.WriteFile(args[1], art.Data, 0644); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("Saved the cover art to " + args[1] + ".")
+		return 0
+	}
+	if err = show_art(os.Stdout, art, path); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Blocking and reporting peers. `peer block` adds a peer's identity key to
+ * the blocklist kept in the library: songs are never fetched from a source
+ * announced with a blocked key, and requests signed with one are turned
+ * away with ERR_DENIED. A peer that doesn't sign its requests can't be
+ * told apart, so it is still served what everyone is. `peer report` tells
+ * the tracker a song's file is corrupted or mislabeled, for its operator
+ * to review and ban the peers sharing it
+ */
+
+/**
+ * A peer on the blocklist
+ */
+type BlockedPeer struct {
+	// its identity key, in hex
+	Key     string
+	Reason  string
+	Blocked time.Time
+}
+
+var (
+	// the blocked identity keys in hex, as last read from the library
+	blocked_keys  = make(map[string]bool)
+	blocked_mutex sync.RWMutex
+)
+
+/**
+ * @return the blocked peers, the latest blocked last; none without the
+ * library
+ */
+func blocked_list() ([]BlockedPeer, error) {
+	if library == nil {
+		return nil, nil
+	}
+	rows, err := library.Query("SELECT key, reason, blocked_at FROM blocked ORDER BY blocked_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []BlockedPeer
+	for rows.Next() {
+		var peer BlockedPeer
+		var blocked int64
+		if err = rows.Scan(&peer.Key, &peer.Reason, &blocked); err != nil {
+			return nil, err
+		}
+		peer.Blocked = time.Unix(blocked, 0)
+		list = append(list, peer)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * Rereads the blocklist from the library
+ * @return an error if it can't be read, in which case the blocklist is
+ * left as it was
+ */
+func load_blocked() error {
+	list, err := blocked_list()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool)
+	for _, peer := range list {
+		keys[peer.Key] = true
+	}
+	blocked_mutex.Lock()
+	blocked_keys = keys
+	blocked_mutex.Unlock()
+	return nil
+}
+
+/**
+ * @param key an identity key, nil if unknown
+ * @return whether the peer with the key is blocked
+ */
+func is_blocked(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	blocked_mutex.RLock()
+	defer blocked_mutex.RUnlock()
+	return blocked_keys[format_key(key)]
+}
+
+/**
+ * @param arg a friend, as friends takes one, an identity key, or the first
+ * digits of the key of a peer online
+ * @return the identity key, in hex
+ */
+func block_key(arg string) (string, error) {
+	if key, err := access_key(arg); err == nil {
+		return key, nil
+	}
+	key, err := online_key(arg)
+	if err != nil {
+		return "", err
+	}
+	return format_key(key), nil
+}
+
+/**
+ * Blocks a peer, or updates why it is blocked
+ * @param key its identity key, in hex
+ * @param reason why, for the list
+ */
+func block_peer(key string, reason string) error {
+	_, err := library.Exec(`INSERT INTO blocked (key, reason, blocked_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET reason = excluded.reason`, key, reason, time.Now().Unix())
+	return err
+}
+
+/**
+ * @param key a blocked peer's identity key, in hex
+ * @return whether the peer was blocked
+ */
+func unblock_peer(key string) (bool, error) {
+	result, err := library.Exec("DELETE FROM blocked WHERE key = ?", key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+/**
+ * block [<key|friend> [reason]] and unblock <key|friend>, from the command
+ * line or a control connection
+ * @param args what followed the command
+ * @param block whether it is block or unblock
+ * @param w where output is written
+ * @return the exit status
+ */
+func handle_block(args []string, block bool, w io.Writer) int {
+	done, err := use_library()
+	if err != nil {
+		fmt.Fprintln(w, "can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	if block && len(args) == 0 {
+		list, err := blocked_list()
+		if err != nil {
+			fmt.Fprintln(w, "can't read the blocklist: ", err)
+			return 1
+		}
+		if len(list) == 0 {
+			fmt.Fprintln(w, "No peer is blocked.")
+		}
+		for _, peer := range list {
+			fmt.Fprintf(w, "%s  blocked %s  %s\n", short_key(peer.Key), peer.Blocked.Format("2006-01-02"), peer.Reason)
+		}
+		return 0
+	}
+	if len(args) == 0 || (!block && len(args) != 1) {
+		if block {
+			fmt.Fprintln(w, "Usage: ", os.Args[0], "block [<key|friend> [reason]]")
+		} else {
+			fmt.Fprintln(w, "Usage: ", os.Args[0], "unblock <key|friend>")
+		}
+		return 2
+	}
+	key, err := block_key(args[0])
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if block {
+		if err = block_peer(key, strings.Join(args[1:], " ")); err != nil {
+			fmt.Fprintln(w, "can't block the peer: ", err)
+			return 1
+		}
+		fmt.Fprintf(w, "Blocked %s.\n", short_key(key))
+	} else {
+		found, err := unblock_peer(key)
+		if err != nil {
+			fmt.Fprintln(w, "can't unblock the peer: ", err)
+			return 1
+		}
+		if !found {
+			fmt.Fprintf(w, "%s isn't blocked.\n", short_key(key))
+			return 1
+		}
+		fmt.Fprintf(w, "Unblocked %s.\n", short_key(key))
+	}
+	if err = load_blocked(); err != nil {
+		fmt.Fprintln(w, "can't read the blocklist: ", err)
+		return 1
+	}
+	return 0
+}
+
+/**
+ * block [<key|friend> [reason]]: lists the blocked peers, or blocks one
+ */
+func run_block(args []string) int {
+	return handle_block(args, true, os.Stdout)
+}
+
+/**
+ * unblock <key|friend>: takes a peer off the blocklist
+ */
+func run_unblock(args []string) int {
+	return handle_block(args, false, os.Stdout)
+}
+
+/**
+ * Tells the tracker a song's file is corrupted or mislabeled, signed so
+ * the report counts once however often it is sent
+ * @param report the song and why
+ * @return an error if the tracker couldn't be reached or turned the
+ * report down
+ */
+func send_report(report tsp.Report) (err error) {
+	if tracker_addr == "" {
+		return fmt.Errorf("reports take a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	content, err := tsp.EncodeReport(report)
+	if err != nil {
+		return err
+	}
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return err
+	}
+	defer tracker.Close()
+	msg := tsp.NewMsg(tsp.REPORT, 0, content)
+	sign_msg(msg, nil)
+	if err = tsp.Encode(tracker, msg); err != nil {
+		return err
+	}
+	reply, err := tsp.Decode(tracker)
+	if err == nil {
+		err = reply.Err()
+	}
+	return err
+}
+
+/**
+ * report <song id> corrupt|mislabeled [note]: reports a song to the
+ * tracker's operator
+ */
+func run_report(args []string) int {
+	if len(args) < 2 || (args[1] != tsp.REPORT_CORRUPT && args[1] != tsp.REPORT_MISLABELED) {
+		fmt.Println("Usage: ", os.Args[0], "report <song id> corrupt|mislabeled [note]")
+		return 2
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, args[0])
+	if !ok {
+		return 1
+	}
+	report := tsp.Report{Song: song.ID, Reason: args[1], Note: strings.Join(args[2:], " ")}
+	if err := send_report(report); err != nil {
+		fmt.Println("can't report the song: ", err)
+		return 1
+	}
+	fmt.Printf("Reported %q as %s. To stop fetching it from the peers serving it, block them.\n", song.Title, args[1])
+	return 0
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Bookmarks. Where playback got to in a long mp3 (a podcast, lecture or
+ * audiobook) is kept in the library by the file's hash, every
+ * BOOKMARK_INTERVAL while it plays and when it stops. Playing the song
+ * again offers to resume from there, which SEEKs the serving peer to the
+ * bookmarked byte. A song played to the end loses its bookmark
+ */
+
+const (
+	// songs at least this long are bookmarked
+	BOOKMARK_MIN_DURATION = 20 * time.Minute
+	// how often the position of a song playing is saved
+	BOOKMARK_INTERVAL = 30 * time.Second
+	// stopping this close to either end of a song leaves no bookmark
+	BOOKMARK_MARGIN = 30 * time.Second
+)
+
+/**
+ * Where playback of a song's file got to: the byte of the file to SEEK
+ * to, and how far into the song that is
+ */
+type Bookmark struct {
+	Hash     string
+	Offset   int64
+	Position time.Duration
+}
+
+/**
+ * @param song the song playing
+ * @param source the file it plays from
+ * @return whether the song is long enough, and its file able to seek, to
+ * bookmark
+ */
+func bookmarkable(song tsp.SongEntry, source tsp.SongSource) bool {
+	return song.Duration >= BOOKMARK_MIN_DURATION && source.Hash != "" &&
+		(source.Format == "" || source.Format == tsp.FORMAT_MP3)
+}
+
+/**
+ * Saves where playback got to, or drops the bookmark if it is too close
+ * to either end to be worth keeping
+ * @param song the song playing
+ * @param mark where it got to
+ */
+func save_bookmark(song tsp.SongEntry, mark Bookmark) {
+	if library == nil {
+		return
+	}
+	if mark.Position < BOOKMARK_MARGIN || mark.Position > song.Duration-BOOKMARK_MARGIN {
+		clear_bookmark(mark.Hash)
+		return
+	}
+	_, err := library.Exec(`INSERT INTO bookmarks (hash, song_id, title, artist, byte_offset, position, saved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET song_id = excluded.song_id, title = excluded.title,
+		artist = excluded.artist, byte_offset = excluded.byte_offset, position = excluded.position, saved_at = excluded.saved_at`,
+		mark.Hash, song.ID, song.Title, song.Artist, mark.Offset, int64(mark.Position), time.Now().Unix())
+	if err != nil {
+		slog.Error("can't save bookmark", "song", song.Title, "err", err)
+	}
+}
+
+/**
+ * Drops the bookmark of a file, e.g. once it has played to the end
+ * @param hash the file's hash
+ */
+func clear_bookmark(hash string) {
+	if library == nil {
+		return
+	}
+	if _, err := library.Exec("DELETE FROM bookmarks WHERE hash = ?", hash); err != nil {
+		slog.Error("can't clear bookmark", "err", err)
+	}
+}
+
+/**
+ * Looks for a bookmark in any of a song's files
+ * @param song the master list entry of the song
+ * @return the most recently saved bookmark, and false if there is none
+ */
+func find_bookmark(song tsp.SongEntry) (Bookmark, bool) {
+	var best Bookmark
+	var best_saved int64
+	if library == nil {
+		return best, false
+	}
+	for _, source := range song.Sources {
+		if !bookmarkable(song, source) {
+			continue
+		}
+		var mark Bookmark
+		var position, saved int64
+		err := library.QueryRow("SELECT hash, byte_offset, position, saved_at FROM bookmarks WHERE hash = ?",
+			source.Hash).Scan(&mark.Hash, &mark.Offset, &position, &saved)
+		if err == nil && saved > best_saved {
+			mark.Position = time.Duration(position)
+			best, best_saved = mark, saved
+		}
+	}
+	return best, best_saved > 0
+}
+
+/**
+ * Starts a song from its bookmark, streaming only from the peers serving
+ * the bookmarked file so the offset lines up
+ * @param ctx cancelled when the peer shuts down
+ * @param song the master list entry of the song
+ * @param mark its bookmark, from find_bookmark
+ * @return an error if no peer serving the file could be reached
+ */
+func resume_bookmark(ctx context.Context, song tsp.SongEntry, mark Bookmark) error {
+	var sources []tsp.SongSource
+	for _, source := range song.Sources {
+		if source.Hash == mark.Hash {
+			sources = append(sources, source)
+		}
+	}
+	song.Sources = sources
+	return start_song(ctx, song, mark.Offset, queue.Playing(song.ID))
+}
+
+/**
+ * Plays a song, from its bookmark if it has one and restart is false
+ * @param ctx cancelled when the peer shuts down
+ * @param song the master list entry of the song
+ * @param restart whether to ignore the bookmark and start from the
+ * beginning
+ * @return where it resumed from, 0 if it started from the beginning, and
+ * an error if no peer serving it could be reached
+ */
+func play_song(ctx context.Context, song tsp.SongEntry, restart bool) (time.Duration, error) {
+	if mark, ok := find_bookmark(song); ok && !restart {
+		if err := resume_bookmark(ctx, song, mark); err == nil {
+			return mark.Position, nil
+		}
+		slog.Warn("can't resume from the bookmark, starting over", "song", song.Title)
+	}
+	return 0, start_song(ctx, song, 0, false)
+}
+
+/**
+ * Tells the user a song resumed from its bookmark, and how to start it
+ * over instead
+ * @param w where it is written
+ * @param song the song
+ * @param from where it resumed, 0 if it didn't
+ */
+func write_resumed(w io.Writer, song tsp.SongEntry, from time.Duration) {
+	if from > 0 {
+		fmt.Fprintf(w, "Resumed from %s, \"play %d restart\" starts it over.\n", format_duration(from), song.ID)
+	}
+}
+
+/**
+ * Asks whether to resume a song from its bookmark, if it has one
+ * @param song the song about to play
+ * @return whether to resume it; true if it has no bookmark
+ */
+func ask_resume(song tsp.SongEntry) bool {
+	mark, ok := find_bookmark(song)
+	if !ok {
+		return true
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	answer, _ := ui.Ask("Resume from "+format_duration(mark.Position)+"? (y/n)", &input.Options{
+		Default:     "y",
+		HideDefault: true,
+	})
+	return !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "n")
+}
+
+/**
+ * Saves the position of a bookmarkable song every BOOKMARK_INTERVAL
+ * while it plays
+ * @param s the song's stream
+ */
+func (p *Playback) keep_bookmark(s *Stream) {
+	ticker := time.NewTicker(BOOKMARK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		p.mutex.Lock()
+		song, mark, ok := p.bookmark(s)
+		paused := p.paused
+		p.mutex.Unlock()
+		if ok && !paused {
+			save_bookmark(song, mark)
+		}
+	}
+}
+
+/**
+ * Works out where playback of a stream has got to. Call with the mutex
+ * held, while the stream is still the one playing
+ * @param s the stream
+ * @return the song, where it got to, and false if it isn't bookmarkable
+ */
+func (p *Playback) bookmark(s *Stream) (tsp.SongEntry, Bookmark, bool) {
+	if p.stream != s || !bookmarkable(p.song, p.source) {
+		return p.song, Bookmark{}, false
+	}
+	return p.song, Bookmark{
+		Hash:     p.source.Hash,
+		Offset:   p.offset + p.heard(s),
+		Position: p.elapsed(s),
+	}, true
+}
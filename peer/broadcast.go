@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Broadcasting what this peer plays as live radio. The PCM that plays,
+ * after ReplayGain and the equalizer but before the volume, is encoded to
+ * MP3 by ffmpeg and sent to every outlet on the air: an Icecast (or
+ * Shoutcast 2) mount, so anyone with a media player can listen, and other
+ * peers tuned in to this one, see radio.go. While nothing plays, e.g.
+ * paused or between songs, silence is sent so listeners stay connected.
+ * Outlets are told the song playing. The encoder runs while any outlet is
+ * on the air. The Icecast server and mount are set under [broadcast] in
+ * the config file
+ */
+
+const (
+	BROADCAST_ENCODER = "ffmpeg"
+	// the rate the mount is encoded at, whatever the songs' rates
+	BROADCAST_RATE            = 44100
+	DEFAULT_BROADCAST_BITRATE = 128
+	DEFAULT_BROADCAST_USER    = "source"
+	// how long nothing may play before silence is sent, and how much is
+	// sent at a time
+	BROADCAST_GAP     = 500 * time.Millisecond
+	BROADCAST_SILENCE = 100 * time.Millisecond
+	// PCM chunks held for the encoder; more are dropped rather than
+	// holding up playback
+	BROADCAST_BACKLOG = 64
+
+	// the outlets the broadcast goes out through
+	ICECAST_OUTLET = "icecast"
+	RADIO_OUTLET   = "radio"
+)
+
+/**
+ * The Icecast mount broadcast to, under [broadcast] in the config file
+ */
+type BroadcastConfig struct {
+	// the mount's URL, e.g. http://radio.example.com:8000/torero.mp3
+	URL      string `toml:"url"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	// what listeners' players show for the station
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	Genre       string `toml:"genre"`
+	// kbit/s of the MP3 stream
+	Bitrate int `toml:"bitrate"`
+}
+
+/**
+ * PCM that played, at its sample rate
+ */
+type BroadcastChunk struct {
+	pcm  []byte
+	rate int
+}
+
+/**
+ * Somewhere the broadcast goes out through, taking the MP3 stream as it
+ * is encoded. An outlet whose Write fails is taken off the air
+ */
+type Outlet interface {
+	io.Writer
+	// tells listeners what is playing, e.g. "Artist - Title"
+	SetTitle(title string)
+	Close() error
+}
+
+/**
+ * An Icecast mount on the air: the source connection to it
+ */
+type IcecastMount struct {
+	mount   *url.URL
+	conn    net.Conn
+	started time.Time
+}
+
+/**
+ * A broadcast going on: the encoder, and the outlets it feeds
+ */
+type Broadcast struct {
+	pcm  chan BroadcastChunk
+	done chan struct{}
+	once sync.Once
+	// the outlets on the air by name, and what they were last told is
+	// playing. Guarded by broadcast_mutex
+	outlets map[string]Outlet
+	title   string
+
+	// the encoder and the sample rate it takes
+	encoder *exec.Cmd
+	stdin   io.WriteCloser
+	copied  chan error
+	rate    int
+}
+
+var (
+	// 1 while broadcasting, so playback only copies PCM when it is
+	broadcasting int32
+	// guards active_broadcast and its outlets
+	broadcast_mutex  sync.Mutex
+	active_broadcast *Broadcast
+)
+
+/**
+ * Connects to the Icecast mount as its source and puts it on the air
+ * @param ctx cancelled when the peer shuts down
+ * @return an error if the mount isn't set up, ffmpeg isn't installed or
+ * the server refused
+ */
+func start_broadcast(ctx context.Context) error {
+	if icecast_mount() != nil {
+		return nil
+	}
+	if config.Broadcast.URL == "" {
+		return errors.New("no mount to broadcast to, set url under [broadcast] in " + config_path())
+	}
+	if err := check_encoder(); err != nil {
+		return err
+	}
+	mount, err := url.Parse(config.Broadcast.URL)
+	if err != nil || (mount.Scheme != "http" && mount.Scheme != "https") || mount.Path == "" {
+		return fmt.Errorf("bad broadcast url %q, e.g. http://host:8000/torero.mp3", config.Broadcast.URL)
+	}
+	conn, err := connect_mount(mount)
+	if err != nil {
+		return fmt.Errorf("can't broadcast to %s: %w", mount.Redacted(), err)
+	}
+	attach_outlet(ctx, ICECAST_OUTLET, &IcecastMount{mount, conn, time.Now()})
+	slog.Info("broadcasting", "mount", mount.Redacted())
+	return nil
+}
+
+/**
+ * Takes the Icecast mount off the air, if it is on it
+ */
+func stop_broadcast() {
+	detach_outlet(ICECAST_OUTLET)
+}
+
+/**
+ * @return the Icecast mount on the air, nil if there is none
+ */
+func icecast_mount() *IcecastMount {
+	mount, _ := find_outlet(ICECAST_OUTLET).(*IcecastMount)
+	return mount
+}
+
+/**
+ * @return an error if the encoder broadcasts are encoded with isn't
+ * installed
+ */
+func check_encoder() error {
+	if _, err := exec.LookPath(BROADCAST_ENCODER); err != nil {
+		return errors.New("broadcasting encodes with " + BROADCAST_ENCODER + ", which isn't installed")
+	}
+	return nil
+}
+
+/**
+ * Puts an outlet on the air, starting the broadcast if it isn't going on
+ * @param ctx cancelled when the peer shuts down
+ * @param name the outlet's name, one of the _OUTLET constants
+ * @param outlet the outlet, closed once it is taken off the air
+ */
+func attach_outlet(ctx context.Context, name string, outlet Outlet) {
+	broadcast_mutex.Lock()
+	defer broadcast_mutex.Unlock()
+	b := active_broadcast
+	if b == nil {
+		b = &Broadcast{
+			pcm:     make(chan BroadcastChunk, BROADCAST_BACKLOG),
+			done:    make(chan struct{}),
+			outlets: make(map[string]Outlet),
+		}
+		active_broadcast = b
+		atomic.StoreInt32(&broadcasting, 1)
+		go b.run(ctx)
+	}
+	if old, ok := b.outlets[name]; ok {
+		old.Close()
+	}
+	b.outlets[name] = outlet
+	if b.title != "" {
+		outlet.SetTitle(b.title)
+	}
+}
+
+/**
+ * Takes an outlet off the air and closes it, ending the broadcast if it
+ * was the last one
+ * @param name the outlet's name
+ */
+func detach_outlet(name string) {
+	broadcast_mutex.Lock()
+	b := active_broadcast
+	var outlet Outlet
+	last := false
+	if b != nil {
+		outlet = b.outlets[name]
+		delete(b.outlets, name)
+		last = len(b.outlets) == 0
+	}
+	broadcast_mutex.Unlock()
+	if outlet != nil {
+		outlet.Close()
+	}
+	if b != nil && last {
+		b.Stop()
+	}
+}
+
+/**
+ * @param name an outlet's name
+ * @return the outlet, nil if it isn't on the air
+ */
+func find_outlet(name string) Outlet {
+	broadcast_mutex.Lock()
+	defer broadcast_mutex.Unlock()
+	if active_broadcast == nil {
+		return nil
+	}
+	return active_broadcast.outlets[name]
+}
+
+/**
+ * @return the mount's user, the one Icecast sources log in as by default
+ * if none is set
+ */
+func broadcast_user() string {
+	if config.Broadcast.User != "" {
+		return config.Broadcast.User
+	}
+	return DEFAULT_BROADCAST_USER
+}
+
+/**
+ * @return the kbit/s the mount is encoded at
+ */
+func broadcast_bitrate() int {
+	if config.Broadcast.Bitrate > 0 {
+		return config.Broadcast.Bitrate
+	}
+	return DEFAULT_BROADCAST_BITRATE
+}
+
+/**
+ * Logs in to a mount as its source, the way libshout does for servers
+ * that predate PUT
+ * @param mount the mount's URL
+ * @return the connection the stream is written to
+ */
+func connect_mount(mount *url.URL) (net.Conn, error) {
+	host := mount.Host
+	if mount.Port() == "" {
+		host = net.JoinHostPort(mount.Hostname(), "8000")
+	}
+	var conn net.Conn
+	var err error
+	if mount.Scheme == "https" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dial_timeout()}, "tcp", host,
+			&tls.Config{ServerName: mount.Hostname()})
+	} else {
+		conn, err = net.DialTimeout("tcp", host, dial_timeout())
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := config.Broadcast.Name
+	if name == "" {
+		name = "Torero"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(broadcast_user() + ":" + config.Broadcast.Password))
+	conn.SetDeadline(time.Now().Add(io_timeout()))
+	fmt.Fprintf(conn, "SOURCE %s HTTP/1.0\r\n"+
+		"Authorization: Basic %s\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: Torero/1.0\r\n"+
+		"Content-Type: audio/mpeg\r\n"+
+		"Ice-Name: %s\r\n"+
+		"Ice-Description: %s\r\n"+
+		"Ice-Genre: %s\r\n"+
+		"Ice-Public: 0\r\n"+
+		"Ice-Audio-Info: ice-bitrate=%d;ice-channels=2;ice-samplerate=%d\r\n\r\n",
+		mount.EscapedPath(), auth, mount.Host, name, config.Broadcast.Description, config.Broadcast.Genre,
+		broadcast_bitrate(), BROADCAST_RATE)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, errors.New("wrong user or password")
+		}
+		return nil, errors.New(resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+/**
+ * Hands PCM that played to the broadcast, if there is one. Never blocks:
+ * if the encoder falls behind, the chunk is dropped
+ * @param pcm stereo 16 bit PCM, before the volume is applied
+ * @param rate its sample rate
+ */
+func broadcast_pcm(pcm []byte, rate int) {
+	if atomic.LoadInt32(&broadcasting) == 0 {
+		return
+	}
+	broadcast_mutex.Lock()
+	b := active_broadcast
+	broadcast_mutex.Unlock()
+	if b == nil {
+		return
+	}
+	select {
+	case b.pcm <- BroadcastChunk{append([]byte(nil), pcm...), rate}:
+	default:
+	}
+}
+
+/**
+ * Encodes what plays, or silence, and sends it to the outlets until the
+ * broadcast is stopped, ctx is cancelled or the encoder fails. Tells the
+ * outlets whenever another song plays
+ * @param ctx cancelled when the peer shuts down
+ */
+func (b *Broadcast) run(ctx context.Context) {
+	defer b.close_encoder()
+	defer b.Stop()
+	ticker := time.NewTicker(BROADCAST_SILENCE)
+	defer ticker.Stop()
+	last := time.Time{}
+	title := ""
+	for {
+		var chunk BroadcastChunk
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.done:
+			return
+		case err := <-b.copied:
+			// the encoder exits only when told to
+			slog.Error("broadcast encoder exited", "err", err)
+			b.copied = nil
+			return
+		case chunk = <-b.pcm:
+			last = time.Now()
+		case <-ticker.C:
+			if song, _, ok := playback.Current(); ok && song.Title+song.Artist != title {
+				title = song.Title + song.Artist
+				b.set_title(song.Artist + " - " + song.Title)
+			}
+			if time.Since(last) < BROADCAST_GAP {
+				continue
+			}
+			rate := b.rate
+			if rate == 0 {
+				rate = BROADCAST_RATE
+			}
+			chunk = BroadcastChunk{make([]byte, int(BROADCAST_SILENCE.Seconds()*float64(rate))*4), rate}
+		}
+		if err := b.encode(chunk); err != nil {
+			slog.Error("can't encode the broadcast", "err", err)
+			return
+		}
+	}
+}
+
+/**
+ * Feeds PCM to the encoder, starting it again if the PCM's sample rate
+ * isn't the one it takes
+ * @param chunk the PCM
+ * @return an error if the encoder can't be started or has exited
+ */
+func (b *Broadcast) encode(chunk BroadcastChunk) error {
+	if b.encoder == nil || b.rate != chunk.rate {
+		b.close_encoder()
+		if err := b.open_encoder(chunk.rate); err != nil {
+			return err
+		}
+	}
+	_, err := b.stdin.Write(chunk.pcm)
+	return err
+}
+
+/**
+ * Starts ffmpeg encoding PCM at a sample rate to MP3 at BROADCAST_RATE,
+ * its output sent to the outlets. The MP3 frames of one run follow on
+ * from the last's, so listeners don't notice the change. Frames are
+ * written bare, with no tags and no bit reservoir, so a listener can
+ * start decoding from any of them
+ * @param rate the sample rate of the PCM it takes
+ * @return an error if it can't be started
+ */
+func (b *Broadcast) open_encoder(rate int) error {
+	cmd := exec.Command(BROADCAST_ENCODER, "-hide_banner", "-loglevel", "error",
+		"-f", "s16le", "-ar", strconv.Itoa(rate), "-ac", "2", "-i", "pipe:0",
+		"-ar", strconv.Itoa(BROADCAST_RATE), "-c:a", "libmp3lame", "-b:a", strconv.Itoa(broadcast_bitrate())+"k",
+		"-reservoir", "0", "-write_xing", "0", "-id3v2_version", "0", "-f", "mp3", "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	copied := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				b.send(buf[:n])
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				copied <- err
+				return
+			}
+		}
+	}()
+	b.encoder, b.stdin, b.copied, b.rate = cmd, stdin, copied, rate
+	return nil
+}
+
+/**
+ * Sends encoded MP3 to every outlet on the air, taking off the air any
+ * that can't take it
+ * @param mp3 the MP3 frames
+ */
+func (b *Broadcast) send(mp3 []byte) {
+	broadcast_mutex.Lock()
+	outlets := make(map[string]Outlet, len(b.outlets))
+	for name, outlet := range b.outlets {
+		outlets[name] = outlet
+	}
+	broadcast_mutex.Unlock()
+	for name, outlet := range outlets {
+		if _, err := outlet.Write(mp3); err != nil {
+			slog.Error("broadcast dropped", "outlet", name, "err", err)
+			detach_outlet(name)
+		}
+	}
+}
+
+/**
+ * Closes the encoder's input and waits for what it still has to reach
+ * the outlets
+ */
+func (b *Broadcast) close_encoder() {
+	if b.encoder == nil {
+		return
+	}
+	b.stdin.Close()
+	if b.copied != nil {
+		<-b.copied
+	}
+	b.encoder.Wait()
+	b.encoder, b.stdin, b.copied = nil, nil, nil
+}
+
+/**
+ * Tells the outlets what is playing
+ * @param title e.g. "Artist - Title"
+ */
+func (b *Broadcast) set_title(title string) {
+	broadcast_mutex.Lock()
+	defer broadcast_mutex.Unlock()
+	b.title = title
+	for _, outlet := range b.outlets {
+		outlet.SetTitle(title)
+	}
+}
+
+/**
+ * Writes MP3 frames to the mount
+ * @param mp3 the frames
+ * @return the bytes written, and an error if the server is gone
+ */
+func (m *IcecastMount) Write(mp3 []byte) (int, error) {
+	return m.conn.Write(mp3)
+}
+
+/**
+ * Sets the title listeners' players show, in the background
+ * @param title e.g. "Artist - Title"
+ */
+func (m *IcecastMount) SetTitle(title string) {
+	go m.set_title(title)
+}
+
+/**
+ * Sets the title through the server's admin interface. Failing is only
+ * logged: the stream carries on without it
+ * @param title e.g. "Artist - Title"
+ */
+func (m *IcecastMount) set_title(title string) {
+	admin := *m.mount
+	admin.Path = "/admin/metadata"
+	admin.RawQuery = url.Values{"mount": {m.mount.Path}, "mode": {"updinfo"}, "song": {title}}.Encode()
+	if admin.Port() == "" {
+		admin.Host = net.JoinHostPort(admin.Hostname(), "8000")
+	}
+	req, err := http.NewRequest(http.MethodGet, admin.String(), nil)
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(broadcast_user(), config.Broadcast.Password)
+	client := &http.Client{Timeout: io_timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Debug("can't set the broadcast's title", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Debug("can't set the broadcast's title", "status", resp.Status)
+	}
+}
+
+/**
+ * Disconnects from the mount
+ */
+func (m *IcecastMount) Close() error {
+	slog.Info("broadcast ended", "mount", m.mount.Redacted())
+	return m.conn.Close()
+}
+
+/**
+ * Ends the broadcast, taking every outlet off the air
+ */
+func (b *Broadcast) Stop() {
+	b.once.Do(func() {
+		broadcast_mutex.Lock()
+		if active_broadcast == b {
+			active_broadcast = nil
+			atomic.StoreInt32(&broadcasting, 0)
+		}
+		outlets := b.outlets
+		b.outlets = nil
+		broadcast_mutex.Unlock()
+		close(b.done)
+		for _, outlet := range outlets {
+			outlet.Close()
+		}
+	})
+}
+
+/**
+ * @return the Icecast broadcast's status line, e.g. "Broadcasting to ...
+ * for 5m0s."
+ */
+func format_broadcast() string {
+	m := icecast_mount()
+	if m == nil {
+		return "Not broadcasting."
+	}
+	return fmt.Sprintf("Broadcasting to %s for %s.", m.mount.Redacted(), time.Since(m.started).Round(time.Second))
+}
+
+/**
+ * Handles BROADCAST: turns broadcasting on or off, or starts it with a
+ * playlist playing
+ * @param ctx cancelled when the peer shuts down
+ * @param arg "on", "off", a playlist's name, or "" for the status
+ * @return the broadcast's status, or an error if it couldn't be started
+ * or there is no such playlist
+ */
+func handle_broadcast(ctx context.Context, arg string) (string, error) {
+	switch arg {
+	case "":
+		return format_broadcast(), nil
+	case "off":
+		stop_broadcast()
+		return format_broadcast(), nil
+	case "on":
+		if err := start_broadcast(ctx); err != nil {
+			return "", err
+		}
+		return format_broadcast(), nil
+	}
+	list, err := load_playlist(arg)
+	if err != nil {
+		return "", err
+	}
+	if err = list.refresh(); err != nil {
+		return "", fmt.Errorf("error picking the playlist's songs: %w", err)
+	}
+	if err = start_broadcast(ctx); err != nil {
+		return "", err
+	}
+	list.Play(ctx)
+	return format_broadcast() + "\n" + now_playing_line(), nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Browsing. The master list is grouped by artist, then album, then track,
+ * or first by genre, the way a music player lays out a library. Artists,
+ * albums and genres are matched ignoring case
+ */
+
+/**
+ * Songs sharing an artist, album or genre
+ */
+type SongGroup struct {
+	// as the first song in the group spells it
+	Name  string
+	Songs []tsp.SongEntry
+}
+
+func artist_name(song tsp.SongEntry) string {
+	return song.Artist
+}
+
+func album_name(song tsp.SongEntry) string {
+	if song.Album == "" {
+		return "(no album)"
+	}
+	return song.Album
+}
+
+func genre_name(song tsp.SongEntry) string {
+	if song.Genre == "" {
+		return "(no genre)"
+	}
+	return song.Genre
+}
+
+/**
+ * @param list the songs to group
+ * @param name what the songs are grouped by, e.g. artist_name
+ * @return the groups, sorted by name
+ */
+func group_songs(list []tsp.SongEntry, name func(tsp.SongEntry) string) []SongGroup {
+	index := make(map[string]int)
+	var groups []SongGroup
+	for _, song := range list {
+		key := strings.ToLower(name(song))
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, SongGroup{Name: name(song)})
+		}
+		groups[i].Songs = append(groups[i].Songs, song)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return strings.ToLower(groups[i].Name) < strings.ToLower(groups[j].Name)
+	})
+	return groups
+}
+
+/**
+ * @param groups songs grouped by name
+ * @param name the name wanted, matched ignoring case
+ * @return the songs in the group, and false if there is no such group
+ */
+func find_group(groups []SongGroup, name string) ([]tsp.SongEntry, bool) {
+	for _, group := range groups {
+		if strings.EqualFold(group.Name, name) {
+			return group.Songs, true
+		}
+	}
+	return nil, false
+}
+
+/**
+ * Writes each group's name and how many songs are in it
+ * @param w where the groups are written
+ * @param groups the groups to write
+ */
+func write_groups(w io.Writer, groups []SongGroup) {
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s (%d songs)\n", group.Name, len(group.Songs))
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * browse [artist [album]]: prints the artists, an artist's albums, or an
+ * album's tracks
+ */
+func run_browse(args []string) int {
+	if len(args) > 2 {
+		fmt.Println("Usage: ", os.Args[0], "browse [artist [album]]")
+		return 2
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	songs, _, ok := load_list_for_command(ctx)
+	if !ok {
+		return 1
+	}
+	return browse_path(os.Stdout, songs, args)
+}
+
+/**
+ * genres [genre]: prints the genres, or the artists in a genre
+ */
+func run_genres(args []string) int {
+	if len(args) > 1 {
+		fmt.Println("Usage: ", os.Args[0], "genres [genre]")
+		return 2
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	songs, _, ok := load_list_for_command(ctx)
+	if !ok {
+		return 1
+	}
+	genres := group_songs(songs, genre_name)
+	if len(args) == 0 {
+		write_groups(os.Stdout, genres)
+		return 0
+	}
+	in_genre, ok := find_group(genres, args[0])
+	if !ok {
+		fmt.Println("No genre " + args[0] + ".")
+		return 1
+	}
+	write_groups(os.Stdout, group_songs(in_genre, artist_name))
+	return 0
+}
+
+/**
+ * Writes one level of the artist, album, track hierarchy
+ * @param w where it is written
+ * @param songs the songs to browse
+ * @param path nothing for the artists, an artist for its albums, or an
+ * artist and album for the album's tracks
+ * @return the exit status
+ */
+func browse_path(w io.Writer, songs []tsp.SongEntry, path []string) int {
+	artists := group_songs(songs, artist_name)
+	if len(path) == 0 {
+		write_groups(w, artists)
+		return 0
+	}
+	by_artist, ok := find_group(artists, path[0])
+	if !ok {
+		fmt.Fprintln(w, "No artist "+path[0]+".")
+		return 1
+	}
+	albums := group_songs(by_artist, album_name)
+	if len(path) == 1 {
+		write_groups(w, albums)
+		return 0
+	}
+	tracks, ok := find_group(albums, path[1])
+	if !ok {
+		fmt.Fprintln(w, "No album "+path[1]+" by "+path[0]+".")
+		return 1
+	}
+	write_master_list(w, sort_tracks(tracks))
+	return 0
+}
+
+/**
+ * Puts an album's songs in the order they are on it: by disc and track
+ * number, songs without one after those with, by title
+ * @param songs the album's songs
+ * @return them sorted
+ */
+func sort_tracks(songs []tsp.SongEntry) []tsp.SongEntry {
+	sorted := sort_songs(songs, SORT_TITLE)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.Track == 0) != (b.Track == 0) {
+			return b.Track == 0
+		}
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		return a.Track < b.Track
+	})
+	return sorted
+}
+
+/**
+ * Finds every track of an album, whichever peers serve them, one encode
+ * of each
+ * @param songs the master list
+ * @param album the album's name, matched ignoring case
+ * @return its tracks in order, and false if there is no such album
+ */
+func album_tracks(songs []tsp.SongEntry, album string) ([]tsp.SongEntry, bool) {
+	songs, _ = hide_duplicates(songs)
+	tracks, ok := find_group(group_songs(songs, album_name), album)
+	if !ok {
+		return nil, false
+	}
+	return sort_tracks(tracks), true
+}
+
+/**
+ * Replaces the queue with an album's tracks, in order, and starts playing
+ * it. Shuffle is turned off, so the album plays through as it was meant
+ * to
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param album the album's name
+ * @return an error if there is no master list or no such album
+ */
+func play_album(ctx context.Context, args []string, album string) error {
+	songs, _, err := current_list(ctx, args)
+	if err != nil {
+		return err
+	}
+	tracks, ok := album_tracks(songs, album)
+	if !ok {
+		return fmt.Errorf("no album %s", album)
+	}
+	queue.SetShuffle(false)
+	queue.Replace(tracks)
+	play_next(ctx, 1)
+	return nil
+}
+
+/**
+ * playalbum <album>: plays every track of an album in order. Without a
+ * daemon they play here, one after another, until the last ends
+ */
+func run_playalbum(args []string) int {
+	album := strings.Join(args, " ")
+	ctx, cancel := signal_context()
+	defer cancel()
+	songs, _, ok := load_list_for_command(ctx)
+	if !ok {
+		return 1
+	}
+	tracks, ok := album_tracks(songs, album)
+	if !ok {
+		fmt.Println("No album " + album + ".")
+		return 1
+	}
+	if done, err := use_library(); err != nil {
+		fmt.Println("can't open the library, the plays won't be in the history: ", err)
+	} else {
+		defer done()
+	}
+	status := 0
+	for _, song := range tracks {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := start_song(ctx, song, 0, false); err != nil {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		fmt.Println("Now playing: " + song.Title + ", " + song.Artist)
+		playback.Wait()
+	}
+	playback.End()
+	output.Close()
+	return status
+}
+
+/**
+ * PLAYALBUM from the interactive menu: asks for an album and plays it
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func handle_play_album(ctx context.Context, args []string) {
+	songs, _, err := current_list(ctx, args)
+	if err != nil {
+		fmt.Println("error receiving list: ", err)
+		return
+	}
+	songs, _ = hide_duplicates(songs)
+	if len(songs) == 0 {
+		fmt.Println("No songs.")
+		return
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	tracks := choose_group(ui, "Album", group_songs(songs, album_name))
+	if len(tracks) == 0 {
+		return
+	}
+	if err = play_album(ctx, args, album_name(tracks[0])); err != nil {
+		fmt.Println(err)
+	}
+}
+
+/**
+ * Asks which group to go into
+ * @param ui the menu
+ * @param query the question
+ * @param groups the groups to pick from
+ * @return the songs in the chosen group
+ */
+func choose_group(ui *input.UI, query string, groups []SongGroup) []tsp.SongEntry {
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = fmt.Sprintf("%s (%d songs)", group.Name, len(group.Songs))
+	}
+	choice, _ := ui.Select(query, names, &input.Options{Loop: true})
+	for i, name := range names {
+		if name == choice {
+			return groups[i].Songs
+		}
+	}
+	return nil
+}
+
+/**
+ * BROWSE from the interactive menu: goes down from the artists, or from
+ * the genres, to an album's tracks and offers to play one
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func handle_browse(ctx context.Context, args []string) {
+	songs, _, err := current_list(ctx, args)
+	if err != nil {
+		fmt.Println("error receiving list: ", err)
+		return
+	}
+	if len(songs) == 0 {
+		fmt.Println("No songs.")
+		return
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	by, _ := ui.Select("Browse by", []string{"artist", "genre"}, &input.Options{Loop: true})
+	if by == "genre" {
+		songs = choose_group(ui, "Genre", group_songs(songs, genre_name))
+	}
+	songs = choose_group(ui, "Artist", group_songs(songs, artist_name))
+	songs = choose_group(ui, "Album", group_songs(songs, album_name))
+	pick_and_play(ctx, sort_tracks(songs))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const STREAM_CHUNK = 32 * 1024
+
+/**
+ * Buffers an incoming song stream in memory. A goroutine keeps reading
+ * from the source connection while the reader side (the mp3 decoder) is
+ * free to stall, e.g. while playback is paused. If the source drops, the
+ * buffer asks for a new one carrying on from the byte it got to
+ */
+type StreamBuffer struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	src    io.ReadCloser
+	resume func(received int64) (io.ReadCloser, error)
+	// while prefetching: most bytes to hold unread, and bytes/s to fetch
+	// at. 0 for no limit
+	limit    int
+	rate     int
+	data     []byte
+	consumed int64
+	received int64
+	hash     hash.Hash
+	// where the stream is being cached, nil if it isn't
+	cache *CacheEntry
+	// where it is being recorded to, see record.go, nil if it isn't
+	record *Recording
+	err    error
+	closed bool
+}
+
+/**
+ * @param src the connection to buffer
+ * @param cache where to cache the stream as it arrives, nil not to
+ * @param limit the most unread bytes to hold, 0 for no limit
+ * @param rate bytes per second to read at, 0 for no limit
+ * @return a StreamBuffer that has already started filling from src
+ */
+func NewStreamBuffer(src io.ReadCloser, cache *CacheEntry, limit int, rate int) *StreamBuffer {
+	b := &StreamBuffer{src: src, cache: cache, limit: limit, rate: rate, hash: sha256.New()}
+	b.cond = sync.NewCond(&b.mutex)
+	go b.fill()
+	return b
+}
+
+/**
+ * Sets how to resume the stream if its source drops
+ * @param resume called with the number of bytes received so far when src
+ * ends, returns a connection carrying on from there, or an error if the
+ * stream is complete or can't be resumed
+ */
+func (b *StreamBuffer) SetResume(resume func(int64) (io.ReadCloser, error)) {
+	b.mutex.Lock()
+	b.resume = resume
+	b.mutex.Unlock()
+}
+
+/**
+ * Lifts the size and rate limits of a prefetched stream, once it is the
+ * one playing
+ */
+func (b *StreamBuffer) Unthrottle() {
+	b.mutex.Lock()
+	b.limit = 0
+	b.rate = 0
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+/**
+ * Copies from the source into the buffer until the source is exhausted
+ * and can't be resumed
+ */
+func (b *StreamBuffer) fill() {
+	chunk := make([]byte, STREAM_CHUNK)
+	src := b.src
+	resumes := 0
+	for b.wait_for_room() {
+		n, err := src.Read(chunk)
+		b.mutex.Lock()
+		b.data = append(b.data, chunk[:n]...)
+		b.received += int64(n)
+		b.hash.Write(chunk[:n])
+		if b.cache != nil {
+			if _, werr := b.cache.Write(chunk[:n]); werr != nil {
+				b.cache.Finish(false)
+				b.cache = nil
+			}
+		}
+		if b.record != nil {
+			if _, werr := b.record.Write(chunk[:n]); werr != nil {
+				b.record.Finish(false)
+				b.record = nil
+			}
+		}
+		received := b.received
+		resume := b.resume
+		rate := b.rate
+		b.cond.Broadcast()
+		b.mutex.Unlock()
+		if err == nil {
+			if rate > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(rate))
+			}
+			continue
+		}
+
+		if resumes < MAX_RESUMES && resume != nil && !b.is_closed() {
+			if next, rerr := resume(received); rerr == nil {
+				src.Close()
+				resumes++
+				if src = b.swap_src(next); src != nil {
+					continue
+				}
+			}
+		}
+
+		b.mutex.Lock()
+		b.err = err
+		b.cond.Broadcast()
+		b.mutex.Unlock()
+		return
+	}
+}
+
+/**
+ * Blocks while the buffer holds as many unread bytes as its limit allows
+ * @return false if the buffer was closed
+ */
+func (b *StreamBuffer) wait_for_room() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.limit > 0 && len(b.data) >= b.limit && !b.closed {
+		b.cond.Wait()
+	}
+	return !b.closed
+}
+
+/**
+ * Replaces the source with a resumed connection, unless the buffer was
+ * closed while it was being opened
+ * @return the new source, or nil if the buffer is closed
+ */
+func (b *StreamBuffer) swap_src(next io.ReadCloser) io.ReadCloser {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		next.Close()
+		return nil
+	}
+	b.src = next
+	return next
+}
+
+func (b *StreamBuffer) is_closed() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.closed
+}
+
+/**
+ * Reads buffered bytes, blocking until some arrive or the source ends
+ */
+func (b *StreamBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for len(b.data) == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	b.consumed += int64(n)
+	// makes room for a prefetch waiting on its limit
+	b.cond.Broadcast()
+	return n, nil
+}
+
+/**
+ * @return the number of bytes handed to the reader so far
+ */
+func (b *StreamBuffer) Consumed() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.consumed
+}
+
+/**
+ * @return the number of bytes received but not yet read
+ */
+func (b *StreamBuffer) Buffered() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.data)
+}
+
+/**
+ * Checks everything received against the size and hash the serving peer
+ * advertised. Only meaningful once the source has ended, for a stream that
+ * started at byte zero
+ * @param source the advertised source of the stream
+ * @return an error describing a truncated or corrupted stream
+ */
+func (b *StreamBuffer) Verify(source tsp.SongSource) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if source.Size > 0 && b.received != source.Size {
+		return fmt.Errorf("stream from %s was truncated: received %d of %d bytes",
+			source.PeerAddr, b.received, source.Size)
+	}
+	if source.Hash != "" && hex.EncodeToString(b.hash.Sum(nil)) != source.Hash {
+		return fmt.Errorf("stream from %s was corrupted (hash mismatch)", source.PeerAddr)
+	}
+	return nil
+}
+
+/**
+ * Finishes caching the stream, if it was being cached
+ * @param keep whether the stream arrived whole and verified
+ */
+func (b *StreamBuffer) FinishCache(keep bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cache != nil {
+		b.cache.Finish(keep)
+		b.cache = nil
+	}
+}
+
+/**
+ * Starts recording the stream, along with what it has received so far.
+ * Only a stream that started at byte zero and hasn't been read from yet
+ * can be recorded whole
+ * @param record where to record it, nil not to
+ */
+func (b *StreamBuffer) Record(record *Recording) {
+	if record == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.consumed > 0 || b.record != nil {
+		record.Finish(false)
+		return
+	}
+	if _, err := record.Write(b.data); err != nil {
+		record.Finish(false)
+		return
+	}
+	b.record = record
+}
+
+/**
+ * Finishes recording the stream, if it was being recorded
+ * @param keep whether the stream arrived whole and verified
+ */
+func (b *StreamBuffer) FinishRecording(keep bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.record != nil {
+		b.record.Finish(keep)
+		b.record = nil
+	}
+}
+
+/**
+ * Closes a stream that is never going to be played, throwing away
+ * anything cached or recorded of it
+ */
+func (b *StreamBuffer) Discard() {
+	b.Close()
+	b.FinishCache(false)
+	b.FinishRecording(false)
+}
+
+/**
+ * Closes the source and wakes up any blocked reader. Safe to call more
+ * than once
+ */
+func (b *StreamBuffer) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.cond.Broadcast()
+	src := b.src
+	b.mutex.Unlock()
+	return src.Close()
+}
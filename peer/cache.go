@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	DEFAULT_CACHE_MB = 512
+	// PeerAddr of the source a song plays from when it comes out of the cache
+	CACHE_PEER = "cache"
+)
+
+/**
+ * A song being written to the cache as it streams in. It only takes its
+ * final name, and counts towards the cache size, once the whole song has
+ * arrived and matched its hash
+ */
+type CacheEntry struct {
+	file *os.File
+	path string
+	// where the song is written through, encrypting it with
+	// encrypt_cache on
+	out io.Writer
+}
+
+/**
+ * @return the directory cached songs are kept in
+ */
+func cache_dir() string {
+	return filepath.Join(torero_dir(), "cache")
+}
+
+/**
+ * @param source a source of the song
+ * @return where the song is cached, by hash, "" if it has no hash, or a
+ * hash or format no file may be named after
+ */
+func cache_path(source tsp.SongSource) string {
+	if !tsp.ValidHash(source.Hash) || !tsp.ValidFormat(source.Format) {
+		return ""
+	}
+	format := source.Format
+	if format == "" {
+		format = tsp.FORMAT_MP3
+	}
+	path := filepath.Join(cache_dir(), source.Hash+"."+format)
+	if config.EncryptCache {
+		path += CACHE_ENC_SUFFIX
+	}
+	return path
+}
+
+/**
+ * @param source a source of the song
+ * @return the size of the song's file in the cache
+ */
+func cache_size(source tsp.SongSource) int64 {
+	if cache_block != nil {
+		return source.Size + CACHE_HEADER
+	}
+	return source.Size
+}
+
+/**
+ * @param source the cached source, from find_cached
+ * @return the cached song, decrypted as it is read
+ */
+func open_cache_file(source tsp.SongSource) (io.ReadSeekCloser, error) {
+	if cache_block != nil {
+		return open_crypt_file(cache_path(source))
+	}
+	return os.Open(cache_path(source))
+}
+
+/**
+ * Looks for a cached copy of any of a song's sources, marking it as just
+ * used
+ * @param song the song to look for
+ * @return the cached source, with PeerAddr CACHE_PEER, and false if the
+ * song isn't cached
+ */
+func find_cached(song tsp.SongEntry) (tsp.SongSource, bool) {
+	if !unlock_cache() {
+		return tsp.SongSource{}, false
+	}
+	for _, source := range song.Sources {
+		path := cache_path(source)
+		if path == "" {
+			continue
+		}
+		if stat, err := os.Stat(path); err == nil && stat.Size() == cache_size(source) {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			source.PeerAddr = CACHE_PEER
+			atomic.AddInt64(&metrics.CacheHits, 1)
+			return source, true
+		}
+	}
+	atomic.AddInt64(&metrics.CacheMisses, 1)
+	return tsp.SongSource{}, false
+}
+
+/**
+ * Opens a cached song for playing
+ * @param source the cached source, from find_cached
+ * @param offset byte offset to start from; a non-zero offset starts at
+ * the first frame at or after it, like a SEEK
+ * @return the song's bytes from offset on
+ */
+func open_cached(source tsp.SongSource, offset int64) (io.ReadCloser, error) {
+	file, err := open_cache_file(source)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		return file, nil
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	skip_to_frame(reader)
+	return BufferedStream{reader, file}, nil
+}
+
+/**
+ * Starts caching a song streamed from byte zero
+ * @param source the peer it streams from
+ * @return the entry to write the stream to, nil if caching is off, the
+ * song has no hash or the cache can't be written
+ */
+func new_cache_entry(source tsp.SongSource) *CacheEntry {
+	path := cache_path(source)
+	if !unlock_cache() || path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cache_dir(), 0755); err != nil {
+		return nil
+	}
+	file, err := ioutil.TempFile(cache_dir(), source.Hash+".*.part")
+	if err != nil {
+		return nil
+	}
+	entry := &CacheEntry{file: file, path: path, out: file}
+	if cache_block != nil {
+		if entry.out, err = NewCryptWriter(file); err != nil {
+			slog.Error("can't cache song", "err", err)
+			entry.Finish(false)
+			return nil
+		}
+	}
+	return entry
+}
+
+func (c *CacheEntry) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+/**
+ * Finishes writing a cached song
+ * @param keep whether the song arrived whole; if not it is thrown away
+ */
+func (c *CacheEntry) Finish(keep bool) {
+	err := c.file.Close()
+	if keep && err == nil {
+		err = os.Rename(c.file.Name(), c.path)
+		if err == nil {
+			evict_cache()
+			return
+		}
+		slog.Error("can't cache song", "err", err)
+	}
+	os.Remove(c.file.Name())
+}
+
+/**
+ * Removes the least recently used songs until the cache fits in
+ * config.CacheMB
+ */
+func evict_cache() {
+	files, err := ioutil.ReadDir(cache_dir())
+	if err != nil {
+		return
+	}
+	var cached []os.FileInfo
+	var total int64
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasSuffix(f.Name(), ".part") {
+			cached = append(cached, f)
+			total += f.Size()
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+	limit := int64(config.CacheMB) << 20
+	for _, f := range cached {
+		if total <= limit {
+			return
+		}
+		if os.Remove(filepath.Join(cache_dir(), f.Name())) == nil {
+			total -= f.Size()
+		}
+	}
+}
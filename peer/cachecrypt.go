@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+ * The encrypted cache, for shared machines. With encrypt_cache on, every
+ * song written to the cache, streamed or prefetched, is encrypted with
+ * AES-256 in CTR mode under a key derived from a passphrase with scrypt,
+ * and decrypted as it is read back, so nothing cached is on disk in the
+ * clear. CTR lets playback and the gateway seek anywhere in a file.
+ * Songs are only cached once they match their hash, so the files carry no
+ * MAC of their own. The passphrase comes from TORERO_CACHE_PASSPHRASE, or
+ * is asked for when the peer starts on a terminal; without it, or with
+ * the wrong one, nothing is cached. The scrypt salt, and a check that
+ * tells a wrong passphrase apart, are kept in ~/.torero/cache.salt
+ */
+
+const (
+	// the environment variable the cache passphrase is read from
+	CACHE_PASSPHRASE_ENV = "TORERO_CACHE_PASSPHRASE"
+	// scrypt's cost parameters, as recommended for interactive logins
+	CACHE_SCRYPT_N = 1 << 15
+	CACHE_SCRYPT_R = 8
+	CACHE_SCRYPT_P = 1
+	// size in bytes of the scrypt salt, and of the check derived from the
+	// key
+	CACHE_SALT_LEN  = 16
+	CACHE_CHECK_LEN = 16
+	// an encrypted file starts with its random IV
+	CACHE_HEADER = aes.BlockSize
+	// encrypted files end in it, so switching encryption on or off leaves
+	// the other kind to be evicted instead of misread
+	CACHE_ENC_SUFFIX = ".enc"
+)
+
+var (
+	// the cipher cached songs are encrypted with, nil if they aren't, and
+	// whether the cache may be used at all
+	cache_once   sync.Once
+	cache_block  cipher.Block
+	cache_usable bool
+)
+
+/**
+ * Unlocks the cache, asking for the passphrase if it needs one and isn't
+ * in the environment. Called when a serving peer starts, so the shell
+ * doesn't ask in the middle of playback; anything else unlocks it the
+ * first time it is used
+ * @return whether the cache may be used
+ */
+func unlock_cache() bool {
+	cache_once.Do(func() {
+		if config.CacheMB <= 0 {
+			return
+		}
+		if !config.EncryptCache {
+			cache_usable = true
+			return
+		}
+		block, err := cache_cipher()
+		if err != nil {
+			slog.Error("not caching songs", "err", err)
+			fmt.Println("not caching songs: ", err)
+			return
+		}
+		cache_block, cache_usable = block, true
+	})
+	return cache_usable
+}
+
+/**
+ * @return the cipher made from the passphrase, or an error if there is no
+ * passphrase or it is the wrong one
+ */
+func cache_cipher() (cipher.Block, error) {
+	passphrase := os.Getenv(CACHE_PASSPHRASE_ENV)
+	if passphrase == "" && is_terminal() {
+		var err error
+		if passphrase, err = ask_password("Passphrase for the song cache"); err != nil {
+			return nil, err
+		}
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("the encrypted cache takes a passphrase, in %s", CACHE_PASSPHRASE_ENV)
+	}
+	salt, check, err := load_cache_salt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, CACHE_SCRYPT_N, CACHE_SCRYPT_R, CACHE_SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	if check == nil {
+		if err = save_cache_salt(salt, cache_check(key)); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal(check, cache_check(key)) {
+		return nil, fmt.Errorf("wrong passphrase for the song cache; to start over with another, delete %s and %s",
+			cache_dir(), cache_salt_path())
+	}
+	return aes.NewCipher(key)
+}
+
+/**
+ * @return the path of the file the scrypt salt and the key check are kept
+ * in
+ */
+func cache_salt_path() string {
+	return filepath.Join(torero_dir(), "cache.salt")
+}
+
+/**
+ * @return the salt, made if there is none yet, and the check the key made
+ * from the passphrase must match, nil if the salt is new
+ */
+func load_cache_salt() ([]byte, []byte, error) {
+	content, err := os.ReadFile(cache_salt_path())
+	if os.IsNotExist(err) {
+		salt := make([]byte, CACHE_SALT_LEN)
+		_, err = rand.Read(salt)
+		return salt, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 2 {
+		salt, salt_err := hex.DecodeString(fields[0])
+		check, check_err := hex.DecodeString(fields[1])
+		if salt_err == nil && check_err == nil {
+			return salt, check, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s isn't a cache salt", cache_salt_path())
+}
+
+/**
+ * @param salt the scrypt salt
+ * @param check the check derived from the key, see cache_check
+ */
+func save_cache_salt(salt []byte, check []byte) error {
+	if err := os.MkdirAll(torero_dir(), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(cache_salt_path(), []byte(hex.EncodeToString(salt)+" "+hex.EncodeToString(check)+"\n"), 0600)
+}
+
+/**
+ * @param key the key made from the passphrase
+ * @return what the key is checked against, which doesn't give it away
+ */
+func cache_check(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, "torero cache")
+	return mac.Sum(nil)[:CACHE_CHECK_LEN]
+}
+
+/**
+ * @param iv a file's IV
+ * @param blocks how many blocks into the file
+ * @return the counter CTR mode is at that many blocks in
+ */
+func counter_at(iv []byte, blocks int64) []byte {
+	counter := append([]byte(nil), iv...)
+	carry := uint64(blocks)
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return counter
+}
+
+/**
+ * A cached song encrypted on disk, read and seeked as if it weren't
+ */
+type CryptFile struct {
+	file   *os.File
+	iv     []byte
+	stream cipher.Stream
+	// where in the song, not counting the header, the next read starts
+	pos int64
+}
+
+/**
+ * Opens an encrypted cached song
+ * @param path the file
+ * @return the song, positioned at its first byte
+ */
+func open_crypt_file(path string) (*CryptFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptFile{file: file, iv: make([]byte, CACHE_HEADER)}
+	if _, err = io.ReadFull(file, c.iv); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.reset()
+	return c, nil
+}
+
+/**
+ * Restarts the key stream at pos
+ */
+func (c *CryptFile) reset() {
+	c.stream = cipher.NewCTR(cache_block, counter_at(c.iv, c.pos/aes.BlockSize))
+	skip := make([]byte, c.pos%aes.BlockSize)
+	c.stream.XORKeyStream(skip, skip)
+}
+
+func (c *CryptFile) Read(b []byte) (int, error) {
+	n, err := c.file.Read(b)
+	c.stream.XORKeyStream(b[:n], b[:n])
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *CryptFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		stat, err := c.file.Stat()
+		if err != nil {
+			return c.pos, err
+		}
+		offset += stat.Size() - CACHE_HEADER
+	}
+	if offset < 0 {
+		return c.pos, fmt.Errorf("seek to %d, before the start", offset)
+	}
+	if _, err := c.file.Seek(CACHE_HEADER+offset, io.SeekStart); err != nil {
+		return c.pos, err
+	}
+	c.pos = offset
+	c.reset()
+	return offset, nil
+}
+
+func (c *CryptFile) Close() error {
+	return c.file.Close()
+}
+
+/**
+ * Encrypts what is written through it into a file
+ */
+type CryptWriter struct {
+	file   *os.File
+	stream cipher.Stream
+	buf    []byte
+}
+
+/**
+ * Starts an encrypted file, writing its IV
+ * @param file the file, empty
+ */
+func NewCryptWriter(file *os.File) (*CryptWriter, error) {
+	iv := make([]byte, CACHE_HEADER)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(iv); err != nil {
+		return nil, err
+	}
+	return &CryptWriter{file: file, stream: cipher.NewCTR(cache_block, iv)}, nil
+}
+
+func (w *CryptWriter) Write(b []byte) (int, error) {
+	if cap(w.buf) < len(b) {
+		w.buf = make([]byte, len(b))
+	}
+	out := w.buf[:len(b)]
+	w.stream.XORKeyStream(out, b)
+	return w.file.Write(out)
+}
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Casting to Chromecasts and other Google Cast devices. They are found over
+ * mDNS, and talked to over TLS in the Cast protocol: protobuf CastMessages,
+ * each after its length in 4 bytes, carrying JSON on a namespace. Casting a
+ * song launches the Default Media Receiver on the device and has it load
+ * the song from this peer's HTTP gateway, so the device streams it over
+ * the LAN while local playback stops; pause, play, volume and stop are
+ * then relayed to it. There is one cast at a time, kept by the daemon or
+ * the shell, which serve the gateway
+ */
+
+const (
+	// mDNS service Cast devices announce themselves under
+	CAST_SERVICE = "_googlecast._tcp"
+	// the Default Media Receiver, the app that plays a URL it is given
+	CAST_MEDIA_RECEIVER = "CC1AD845"
+	// how long the device has to answer a request, and how often it is
+	// pinged so it keeps the connection open
+	CAST_TIMEOUT   = 10 * time.Second
+	CAST_HEARTBEAT = 5 * time.Second
+	// the largest CastMessage taken from a device
+	CAST_MAX_MESSAGE = 64 << 10
+)
+
+// Cast protocol namespaces
+const (
+	CAST_NS_CONNECTION = "urn:x-cast:com.google.cast.tp.connection"
+	CAST_NS_HEARTBEAT  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	CAST_NS_RECEIVER   = "urn:x-cast:com.google.cast.receiver"
+	CAST_NS_MEDIA      = "urn:x-cast:com.google.cast.media"
+)
+
+// the ends of a Cast connection: us, and the device itself before an app
+// is launched
+const (
+	CAST_SENDER   = "sender-0"
+	CAST_RECEIVER = "receiver-0"
+)
+
+/**
+ * A Cast device found on the LAN
+ */
+type CastDevice struct {
+	// what it is called, e.g. "Living Room TV"
+	Name string
+	// e.g. "Chromecast Audio"
+	Model string
+	// host:port to connect to
+	Addr string
+}
+
+/**
+ * A message of the Cast protocol, the fields of the CastMessage protobuf
+ * used. Payloads are always JSON text
+ */
+type CastMessage struct {
+	Source      string
+	Destination string
+	Namespace   string
+	Payload     string
+}
+
+/**
+ * The parts of a JSON payload from a device that are looked at
+ */
+type CastReply struct {
+	Type      string `json:"type"`
+	RequestID int    `json:"requestId"`
+	// an object in RECEIVER_STATUS, an array in MEDIA_STATUS
+	Status json.RawMessage `json:"status"`
+	Reason string          `json:"reason"`
+}
+
+/**
+ * The status of a device, in RECEIVER_STATUS
+ */
+type CastReceiverStatus struct {
+	Applications []struct {
+		AppID       string `json:"appId"`
+		SessionID   string `json:"sessionId"`
+		TransportID string `json:"transportId"`
+	} `json:"applications"`
+	Volume struct {
+		Level float64 `json:"level"`
+	} `json:"volume"`
+}
+
+/**
+ * The status of the media loaded, in MEDIA_STATUS
+ */
+type CastMediaStatus struct {
+	MediaSessionID int     `json:"mediaSessionId"`
+	PlayerState    string  `json:"playerState"`
+	IdleReason     string  `json:"idleReason"`
+	CurrentTime    float64 `json:"currentTime"`
+}
+
+/**
+ * A connection to a Cast device with the Default Media Receiver running
+ * on it, and the song it was given
+ */
+type CastSession struct {
+	Device CastDevice
+	Song   tsp.SongEntry
+
+	conn        net.Conn
+	write_mutex sync.Mutex
+	mutex       sync.Mutex
+	// requests waiting on an answer, by requestId
+	next_request int
+	waiting      map[int]chan CastReply
+	// the app's end of the connection, its session, and the song's, and
+	// the player's state as the device last told it
+	transport     string
+	app_session   string
+	media_session int
+	state         string
+	closed        chan struct{}
+}
+
+var (
+	cast_mutex sync.Mutex
+	// the cast going on, nil if there is none
+	cast_session *CastSession
+)
+
+/**
+ * Browses the LAN for Cast devices
+ * @param ctx cancelled when the peer shuts down
+ * @return the devices that answered, by name
+ */
+func discover_cast_devices(ctx context.Context) ([]CastDevice, error) {
+	resolver, err := zeroconf.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, MDNS_BROWSE_TIMEOUT)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err = resolver.Browse(ctx, CAST_SERVICE, MDNS_DOMAIN, entries); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var devices []CastDevice
+	for {
+		var entry *zeroconf.ServiceEntry
+		var ok bool
+		select {
+		case <-ctx.Done():
+		case entry, ok = <-entries:
+		}
+		if !ok {
+			sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+			return devices, nil
+		}
+		ip := entry_ip(entry)
+		if ip == nil {
+			continue
+		}
+		device := CastDevice{
+			Name: entry.Instance,
+			Addr: net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port)),
+		}
+		for _, text := range entry.Text {
+			if name, ok := strings.CutPrefix(text, "fn="); ok {
+				device.Name = name
+			} else if model, ok := strings.CutPrefix(text, "md="); ok {
+				device.Model = model
+			}
+		}
+		if !seen[device.Addr] {
+			seen[device.Addr] = true
+			devices = append(devices, device)
+		}
+	}
+}
+
+/**
+ * @param devices the devices found on the LAN
+ * @param name a device's number in the list, its name, or host:port
+ * @return the device, false if none of them is it
+ */
+func find_cast_device(devices []CastDevice, name string) (CastDevice, bool) {
+	if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(devices) {
+		return devices[n-1], true
+	}
+	for _, device := range devices {
+		if strings.EqualFold(device.Name, name) || device.Addr == name {
+			return device, true
+		}
+	}
+	if _, _, err := net.SplitHostPort(name); err == nil {
+		return CastDevice{Name: name, Addr: name}, true
+	}
+	return CastDevice{}, false
+}
+
+/**
+ * Encodes a CastMessage, after its length
+ * @param msg the message
+ * @return the bytes to send
+ */
+func encode_cast_message(msg CastMessage) []byte {
+	body := []byte{0x08, 0} // protocol_version CASTV2_1_0
+	field := func(tag byte, value string) {
+		body = append(body, tag)
+		body = binary.AppendUvarint(body, uint64(len(value)))
+		body = append(body, value...)
+	}
+	field(0x12, msg.Source)
+	field(0x1a, msg.Destination)
+	field(0x22, msg.Namespace)
+	body = append(body, 0x28, 0) // payload_type STRING
+	field(0x32, msg.Payload)
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	return append(frame, body...)
+}
+
+/**
+ * Decodes the body of a CastMessage
+ * @param body the message, less its length
+ * @return the message, or an error if it isn't one
+ */
+func decode_cast_message(body []byte) (CastMessage, error) {
+	var msg CastMessage
+	for len(body) > 0 {
+		key, n := binary.Uvarint(body)
+		if n <= 0 {
+			return msg, errors.New("bad cast message")
+		}
+		body = body[n:]
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(body); n <= 0 {
+				return msg, errors.New("bad cast message")
+			}
+			body = body[n:]
+		case 2:
+			size, n := binary.Uvarint(body)
+			if n <= 0 || uint64(len(body)-n) < size {
+				return msg, errors.New("bad cast message")
+			}
+			value := string(body[n : n+int(size)])
+			body = body[n+int(size):]
+			switch key >> 3 {
+			case 2:
+				msg.Source = value
+			case 3:
+				msg.Destination = value
+			case 4:
+				msg.Namespace = value
+			case 6:
+				msg.Payload = value
+			}
+		default:
+			return msg, fmt.Errorf("bad cast message: wire type %d", key&7)
+		}
+	}
+	return msg, nil
+}
+
+/**
+ * Connects to a Cast device and launches the Default Media Receiver on it
+ * @param ctx cancelled when the peer shuts down
+ * @param device the device
+ * @return the session, with the app's end of it connected
+ */
+func cast_connect(ctx context.Context, device CastDevice) (*CastSession, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dial_timeout()},
+		// devices present certificates signed by Google's own CA, for
+		// senders that check them against the device's key
+		Config: &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", device.Addr)
+	if err != nil {
+		return nil, err
+	}
+	session := &CastSession{
+		Device:  device,
+		conn:    conn,
+		waiting: make(map[int]chan CastReply),
+		closed:  make(chan struct{}),
+	}
+	go session.read()
+	go session.heartbeat()
+
+	session.send(CAST_RECEIVER, CAST_NS_CONNECTION, map[string]any{"type": "CONNECT"})
+	reply, err := session.request(CAST_RECEIVER, CAST_NS_RECEIVER, map[string]any{
+		"type":  "LAUNCH",
+		"appId": CAST_MEDIA_RECEIVER,
+	})
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	var status CastReceiverStatus
+	json.Unmarshal(reply.Status, &status)
+	for _, app := range status.Applications {
+		if app.AppID == CAST_MEDIA_RECEIVER {
+			session.transport, session.app_session = app.TransportID, app.SessionID
+		}
+	}
+	if session.transport == "" {
+		session.Close()
+		return nil, errors.New(device.Name + " didn't launch the media receiver")
+	}
+	session.send(session.transport, CAST_NS_CONNECTION, map[string]any{"type": "CONNECT"})
+	return session, nil
+}
+
+/**
+ * Sends a message, without waiting for an answer
+ * @param destination CAST_RECEIVER or the app's transport
+ * @param namespace one of the CAST_NS_ constants
+ * @param payload what is sent, as JSON
+ * @return an error if it couldn't be sent
+ */
+func (s *CastSession) send(destination string, namespace string, payload map[string]any) error {
+	text, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	frame := encode_cast_message(CastMessage{CAST_SENDER, destination, namespace, string(text)})
+	s.write_mutex.Lock()
+	defer s.write_mutex.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(io_timeout()))
+	_, err = s.conn.Write(frame)
+	return err
+}
+
+/**
+ * Sends a message and waits for the answer to it
+ * @param destination CAST_RECEIVER or the app's transport
+ * @param namespace one of the CAST_NS_ constants
+ * @param payload what is sent, as JSON, given a requestId here
+ * @return the answer, or an error if the device refused or didn't answer
+ */
+func (s *CastSession) request(destination string, namespace string, payload map[string]any) (CastReply, error) {
+	answer := make(chan CastReply, 1)
+	s.mutex.Lock()
+	s.next_request++
+	id := s.next_request
+	s.waiting[id] = answer
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.waiting, id)
+		s.mutex.Unlock()
+	}()
+
+	payload["requestId"] = id
+	if err := s.send(destination, namespace, payload); err != nil {
+		return CastReply{}, err
+	}
+	select {
+	case reply := <-answer:
+		switch reply.Type {
+		case "LAUNCH_ERROR", "LOAD_FAILED", "LOAD_CANCELLED", "INVALID_REQUEST", "INVALID_PLAYER_STATE":
+			if reply.Reason != "" {
+				return reply, errors.New(s.Device.Name + ": " + strings.ToLower(reply.Type) + ", " + reply.Reason)
+			}
+			return reply, errors.New(s.Device.Name + ": " + strings.ToLower(reply.Type))
+		}
+		return reply, nil
+	case <-s.closed:
+		return CastReply{}, errors.New(s.Device.Name + " closed the connection")
+	case <-time.After(CAST_TIMEOUT):
+		return CastReply{}, errors.New(s.Device.Name + " didn't answer")
+	}
+}
+
+/**
+ * Takes messages from the device until the connection closes: answers
+ * pings, keeps the player's state, and hands answers to the requests
+ * waiting on them
+ */
+func (s *CastSession) read() {
+	defer s.ended()
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(s.conn, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > CAST_MAX_MESSAGE {
+			slog.Warn("cast message too large", "device", s.Device.Name, "size", n)
+			return
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, body); err != nil {
+			return
+		}
+		msg, err := decode_cast_message(body)
+		if err != nil {
+			slog.Debug("bad cast message", "device", s.Device.Name, "err", err)
+			continue
+		}
+		var reply CastReply
+		if err = json.Unmarshal([]byte(msg.Payload), &reply); err != nil {
+			continue
+		}
+		switch {
+		case msg.Namespace == CAST_NS_HEARTBEAT && reply.Type == "PING":
+			s.send(msg.Source, CAST_NS_HEARTBEAT, map[string]any{"type": "PONG"})
+		case msg.Namespace == CAST_NS_CONNECTION && reply.Type == "CLOSE" && msg.Source == s.transport:
+			// the app was stopped, from the device or another sender
+			return
+		case reply.Type == "MEDIA_STATUS":
+			var statuses []CastMediaStatus
+			json.Unmarshal(reply.Status, &statuses)
+			if len(statuses) > 0 {
+				s.mutex.Lock()
+				s.media_session = statuses[0].MediaSessionID
+				s.state = statuses[0].PlayerState
+				if s.state == "IDLE" && statuses[0].IdleReason != "" {
+					s.state += ", " + strings.ToLower(statuses[0].IdleReason)
+				}
+				s.mutex.Unlock()
+			}
+		}
+		s.mutex.Lock()
+		answer := s.waiting[reply.RequestID]
+		s.mutex.Unlock()
+		if reply.RequestID != 0 && answer != nil {
+			select {
+			case answer <- reply:
+			default:
+			}
+		}
+	}
+}
+
+/**
+ * Pings the device until the connection closes, so it keeps it open
+ */
+func (s *CastSession) heartbeat() {
+	ticker := time.NewTicker(CAST_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if err := s.send(CAST_RECEIVER, CAST_NS_HEARTBEAT, map[string]any{"type": "PING"}); err != nil {
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+/**
+ * Marks the session over once the connection is gone, ending the cast if
+ * it was the one going on
+ */
+func (s *CastSession) ended() {
+	s.conn.Close()
+	close(s.closed)
+	cast_mutex.Lock()
+	if cast_session == s {
+		cast_session = nil
+		slog.Info("cast ended", "device", s.Device.Name)
+	}
+	cast_mutex.Unlock()
+}
+
+/**
+ * Closes the connection, leaving whatever the device plays playing
+ */
+func (s *CastSession) Close() {
+	s.conn.Close()
+	<-s.closed
+}
+
+/**
+ * Has the device load a song and play it
+ * @param song the song
+ * @param url where the device streams it from
+ * @param art_url where the device gets its cover art from
+ * @return an error if the device refused it
+ */
+func (s *CastSession) Load(song tsp.SongEntry, url string, art_url string) error {
+	format := tsp.FORMAT_MP3
+	if len(song.Sources) > 0 && song.Sources[0].Format != "" {
+		format = song.Sources[0].Format
+	}
+	metadata := map[string]any{
+		"metadataType": 3, // MusicTrackMediaMetadata
+		"title":        song.Title,
+		"artist":       song.Artist,
+		"images":       []map[string]any{{"url": art_url}},
+	}
+	if song.Album != "" {
+		metadata["albumName"] = song.Album
+	}
+	if song.Track > 0 {
+		metadata["trackNumber"] = song.Track
+	}
+	_, err := s.request(s.transport, CAST_NS_MEDIA, map[string]any{
+		"type":     "LOAD",
+		"autoplay": true,
+		"media": map[string]any{
+			"contentId":   url,
+			"contentType": mime_type(format),
+			"streamType":  "BUFFERED",
+			"duration":    song.Duration.Seconds(),
+			"metadata":    metadata,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.Song = song
+	s.mutex.Unlock()
+	return nil
+}
+
+/**
+ * Relays PAUSE, PLAY or STOP to the song loaded
+ * @param command the media command
+ * @return an error if the device refused it
+ */
+func (s *CastSession) Media(command string) error {
+	s.mutex.Lock()
+	media_session := s.media_session
+	s.mutex.Unlock()
+	_, err := s.request(s.transport, CAST_NS_MEDIA, map[string]any{
+		"type":           command,
+		"mediaSessionId": media_session,
+	})
+	return err
+}
+
+/**
+ * Sets the device's volume
+ * @param v the volume, 0 to 100
+ * @return an error if the device refused it
+ */
+func (s *CastSession) SetVolume(v int) error {
+	_, err := s.request(CAST_RECEIVER, CAST_NS_RECEIVER, map[string]any{
+		"type":   "SET_VOLUME",
+		"volume": map[string]any{"level": float64(v) / 100},
+	})
+	return err
+}
+
+/**
+ * Stops the media receiver on the device and closes the connection
+ */
+func (s *CastSession) Stop() {
+	s.request(CAST_RECEIVER, CAST_NS_RECEIVER, map[string]any{
+		"type":      "STOP",
+		"sessionId": s.app_session,
+	})
+	s.Close()
+}
+
+/**
+ * @return what the device is playing, as the status line shows it
+ */
+func (s *CastSession) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := strings.ToLower(s.state)
+	if state == "" {
+		state = "loading"
+	}
+	return fmt.Sprintf("Casting %s, %s to %s (%s).", s.Song.Title, s.Song.Artist, s.Device.Name, state)
+}
+
+/**
+ * @param device the device the song is cast to
+ * @param song the song
+ * @return the URLs the device gets the song and its cover art from: this
+ * peer's HTTP gateway, at the address facing the device
+ */
+func cast_urls(device CastDevice, song tsp.SongEntry) (string, string, error) {
+	if http_flag == "" {
+		return "", "", errors.New("casting streams from the HTTP gateway, start the peer with --http")
+	}
+	_, port, err := net.SplitHostPort(http_flag)
+	if err != nil {
+		return "", "", err
+	}
+	ip := GetLocalIP()
+	if addr, err := net.ResolveUDPAddr("udp4", device.Addr); err == nil {
+		ip = local_ip_for(addr)
+	}
+	format := tsp.FORMAT_MP3
+	if len(song.Sources) > 0 && song.Sources[0].Format != "" {
+		format = song.Sources[0].Format
+	}
+	base := "http://" + net.JoinHostPort(ip, port)
+	return base + stream_path(song.ID, format), fmt.Sprintf("%s/dlna/art/%d", base, song.ID), nil
+}
+
+/**
+ * Casts a song to a device, ending any cast to another one and stopping
+ * local playback
+ * @param ctx cancelled when the peer shuts down
+ * @param device the device
+ * @param song the song
+ * @return an error if the device couldn't be reached or refused the song
+ */
+func cast_song(ctx context.Context, device CastDevice, song tsp.SongEntry) error {
+	url, art_url, err := cast_urls(device, song)
+	if err != nil {
+		return err
+	}
+	cast_mutex.Lock()
+	session := cast_session
+	cast_mutex.Unlock()
+	if session != nil && session.Device.Addr != device.Addr {
+		session.Stop()
+		session = nil
+	}
+	if session == nil {
+		if session, err = cast_connect(ctx, device); err != nil {
+			return fmt.Errorf("can't cast to %s: %w", device.Name, err)
+		}
+		cast_mutex.Lock()
+		cast_session = session
+		cast_mutex.Unlock()
+	}
+	if err = session.Load(song, url, art_url); err != nil {
+		return err
+	}
+	playback.End()
+	slog.Info("casting", "device", device.Name, "song", song.ID, "url", url)
+	return nil
+}
+
+/**
+ * Handles CAST: lists the devices on the LAN, casts a song to one, or
+ * relays pause, play, volume and stop to the cast going on
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param cmd what follows "cast"
+ * @param w where the outcome is written
+ * @return the exit status
+ */
+func handle_cast(ctx context.Context, args []string, cmd []string, w io.Writer) int {
+	cast_mutex.Lock()
+	session := cast_session
+	cast_mutex.Unlock()
+
+	if len(cmd) == 0 {
+		if session != nil {
+			fmt.Fprintln(w, session)
+		}
+		devices, err := discover_cast_devices(ctx)
+		if err != nil {
+			fmt.Fprintln(w, "can't browse the LAN: ", err)
+			return 1
+		}
+		write_cast_devices(w, devices)
+		return 0
+	}
+
+	switch cmd[0] {
+	case "pause", "play", "stop", "volume":
+		if session == nil {
+			fmt.Fprintln(w, "Not casting.")
+			return 1
+		}
+	}
+	var err error
+	switch cmd[0] {
+	case "pause":
+		err = session.Media("PAUSE")
+	case "play":
+		err = session.Media("PLAY")
+	case "stop":
+		session.Stop()
+		fmt.Fprintln(w, "Stopped casting.")
+		return 0
+	case "volume":
+		if len(cmd) != 2 {
+			fmt.Fprintln(w, "usage: cast volume <0-100>")
+			return 2
+		}
+		v, err := strconv.Atoi(cmd[1])
+		if err != nil || v < 0 || v > 100 {
+			fmt.Fprintln(w, "volume must be 0-100")
+			return 2
+		}
+		if err = session.SetVolume(v); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintf(w, "Cast volume %d.\n", v)
+		return 0
+	default:
+		if len(cmd) < 2 {
+			fmt.Fprintln(w, "usage: cast [<song id> <device> | pause | play | volume <0-100> | stop]")
+			return 2
+		}
+		return control_cast(ctx, args, cmd[0], strings.Join(cmd[1:], " "), w)
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	// the device answers with the new state before the request returns
+	fmt.Fprintln(w, session)
+	return 0
+}
+
+/**
+ * Casts a song to a device, fetching the master list again if the song
+ * isn't known
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param arg the song id as typed
+ * @param name the device's number, name or host:port
+ * @param w where the outcome is written
+ * @return the exit status
+ */
+func control_cast(ctx context.Context, args []string, arg string, name string, w io.Writer) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Fprintln(w, "song id must be a number")
+		return 2
+	}
+	song, ok := find_song(id)
+	if !ok {
+		if _, err = load_master_list(ctx, args); err != nil {
+			fmt.Fprintln(w, "error receiving list: ", err)
+			return 1
+		}
+		if song, ok = find_song(id); !ok {
+			fmt.Fprintln(w, "Song not found.")
+			return 1
+		}
+	}
+	devices, err := discover_cast_devices(ctx)
+	if err != nil {
+		fmt.Fprintln(w, "can't browse the LAN: ", err)
+		return 1
+	}
+	device, ok := find_cast_device(devices, name)
+	if !ok {
+		fmt.Fprintln(w, "No cast device "+name+".")
+		return 1
+	}
+	if err = cast_song(ctx, device, song); err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	fmt.Fprintln(w, "Casting "+song.Title+", "+song.Artist+" to "+device.Name+".")
+	return 0
+}
+
+/**
+ * Prints the Cast devices found, numbered for "cast <song id> <n>"
+ * @param w where they are printed
+ * @param devices the devices
+ */
+func write_cast_devices(w io.Writer, devices []CastDevice) {
+	if len(devices) == 0 {
+		fmt.Fprintln(w, "No cast devices found.")
+		return
+	}
+	for i, device := range devices {
+		if device.Model != "" {
+			fmt.Fprintf(w, "%2d. %s (%s, %s)\n", i+1, device.Name, device.Model, device.Addr)
+		} else {
+			fmt.Fprintf(w, "%2d. %s (%s)\n", i+1, device.Name, device.Addr)
+		}
+	}
+}
+
+/**
+ * CAST from the interactive menu: picks a device, then a song to cast to
+ * it, or what to do with the cast going on
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func handle_cast_menu(ctx context.Context, args []string) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	cast_mutex.Lock()
+	session := cast_session
+	cast_mutex.Unlock()
+	if session != nil {
+		fmt.Println(session)
+		action, _ := ui.Select("Cast", []string{"PAUSE", "PLAY", "VOLUME", "STOP", "CAST ANOTHER SONG"}, &input.Options{
+			Loop: true,
+		})
+		switch action {
+		case "VOLUME":
+			arg, _ := ui.Ask("Cast volume (0-100)", &input.Options{
+				Loop: true,
+				ValidateFunc: func(arg string) error {
+					if v, err := strconv.Atoi(arg); err != nil || v < 0 || v > 100 {
+						return errors.New("volume must be 0-100")
+					}
+					return nil
+				},
+			})
+			handle_cast(ctx, args, []string{"volume", arg}, os.Stdout)
+			return
+		case "CAST ANOTHER SONG":
+		default:
+			handle_cast(ctx, args, []string{strings.ToLower(action)}, os.Stdout)
+			return
+		}
+	}
+
+	fmt.Println("Looking for cast devices...")
+	devices, err := discover_cast_devices(ctx)
+	if err != nil {
+		fmt.Println("can't browse the LAN: ", err)
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Println("No cast devices found.")
+		return
+	}
+	names := make([]string, len(devices))
+	for i, device := range devices {
+		names[i] = device.Name
+	}
+	name, _ := ui.Select("Cast to", names, &input.Options{
+		Loop: true,
+	})
+	device, _ := find_cast_device(devices, name)
+	song := get_song_selection()
+	if err := cast_song(ctx, device, song); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Casting " + song.Title + ", " + song.Artist + " to " + device.Name + ".")
+}
+
+/**
+ * cast [<song id> <device> | pause | play | volume <0-100> | stop]: lists
+ * the Cast devices on the LAN; casting takes a daemon serving the HTTP
+ * gateway, which streams the song to the device
+ */
+func run_cast(args []string) int {
+	if len(args) > 0 {
+		fmt.Println("casting takes a daemon serving the HTTP gateway, start one with: ", os.Args[0], "serve <port> <filedir> --http :8000")
+		return 1
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	return handle_cast(ctx, nil, nil, os.Stdout)
+}
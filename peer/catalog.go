@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+var (
+	// the files this peer serves, by the FileID announced with each, guarded
+	// by master_mutex. Requests are only ever served from here
+	catalog = make(map[int]string)
+	// the FileID of each file in the catalog, kept across rescans so IDs
+	// other peers already know stay valid
+	catalog_ids  = make(map[string]int)
+	next_file_id = 1
+	// the identity keys allowed to fetch each restricted file in the
+	// catalog, by FileID, see access.go
+	catalog_allow = make(map[int][][]byte)
+)
+
+/**
+ * Resolves a scanned song to the file it is served from, making sure it
+ * is a regular file that, symlinks and all, lives inside the songs
+ * directory
+ * @param dir_name the directory with songs
+ * @param name the song's name within it
+ * @return the song's absolute path
+ */
+func vet_song_path(dir_name string, name string) (string, error) {
+	if name != filepath.Base(name) {
+		return "", errors.New("not a plain file name: " + name)
+	}
+	dir, err := filepath.Abs(dir_name)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	song_path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, song_path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(name + " points outside " + dir_name)
+	}
+	stat, err := os.Stat(song_path)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", errors.New(name + " is not a regular file")
+	}
+	return song_path, nil
+}
+
+/**
+ * Rebuilds the catalog from freshly scanned songs. Files already in the
+ * catalog keep their FileID, new ones get the next free one. Songs whose
+ * file doesn't pass vet_song_path are left out. The caller must hold
+ * master_mutex
+ * @param dir_name the directory the songs were scanned from
+ * @param songs the scanned songs, each with its single local source
+ * @return the songs that made it into the catalog, with FileID set
+ */
+func build_catalog(dir_name string, songs []tsp.SongEntry) []tsp.SongEntry {
+	old_ids := catalog_ids
+	catalog = make(map[int]string)
+	catalog_ids = make(map[string]int)
+	catalog_allow = make(map[int][][]byte)
+	vetted := make([]tsp.SongEntry, 0, len(songs))
+	for _, song := range songs {
+		song_path, err := vet_song_path(dir_name, song.Sources[0].Filename)
+		if err != nil {
+			slog.Warn("not serving a song", "err", err)
+			continue
+		}
+		if id := old_ids[song_path]; id != 0 {
+			catalog_ids[song_path] = id
+		}
+		vetted = append(vetted, catalog_file(song, song_path))
+	}
+	return vetted
+}
+
+/**
+ * Adds one song to the catalog. The caller must hold master_mutex
+ * @param dir_name the directory with songs
+ * @param song the scanned song, with its single local source
+ * @return the song with FileID set, or an error if its file doesn't pass
+ * vet_song_path
+ */
+func add_to_catalog(dir_name string, song tsp.SongEntry) (tsp.SongEntry, error) {
+	song_path, err := vet_song_path(dir_name, song.Sources[0].Filename)
+	if err != nil {
+		return song, err
+	}
+	return catalog_file(song, song_path), nil
+}
+
+/**
+ * Stops serving a file. The caller must hold master_mutex
+ * @param id the file's FileID
+ */
+func remove_from_catalog(id int) {
+	delete(catalog_ids, catalog[id])
+	delete(catalog, id)
+	delete(catalog_allow, id)
+}
+
+/**
+ * Adds a vetted file to the catalog, marking its source restricted if
+ * the access rules say so. The caller must hold master_mutex
+ * @param song the scanned song, with its single local source
+ * @param song_path the file's absolute path
+ * @return the song with FileID set
+ */
+func catalog_file(song tsp.SongEntry, song_path string) tsp.SongEntry {
+	id := catalog_ids[song_path]
+	if id == 0 {
+		id = next_file_id
+		next_file_id++
+	}
+	catalog[id] = song_path
+	catalog_ids[song_path] = id
+	song.Sources[0].FileID = id
+	song.Sources[0].Restricted, song.Sources[0].Allow = song_access(song_path)
+	set_catalog_access(id, song.Sources[0].Restricted, song.Sources[0].Allow)
+	return song
+}
+
+/**
+ * Sets who may fetch a file in the catalog. The caller must hold
+ * master_mutex
+ * @param id the file's FileID
+ * @param restricted whether only some peers may
+ * @param allow the identity keys of those peers
+ */
+func set_catalog_access(id int, restricted bool, allow [][]byte) {
+	if restricted {
+		catalog_allow[id] = allow
+	} else {
+		delete(catalog_allow, id)
+	}
+}
+
+/**
+ * @param file_id a FileID from a PLAY or SEEK
+ * @return the song this peer serves under it, empty if it isn't one
+ * scanned from the song directory
+ */
+func served_song(file_id int) tsp.SongEntry {
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	for _, local := range local_songs {
+		for _, source := range local.Sources {
+			if source.FileID == file_id {
+				return local
+			}
+		}
+	}
+	return tsp.SongEntry{}
+}
+
+/**
+ * @param id a FileID from a PLAY or SEEK
+ * @param key the identity key the request is signed with, nil if unsigned
+ * @return the absolute path of the file served under it, "" if none is
+ * or the peer asking may not fetch it
+ */
+func catalog_path(id int, key []byte) string {
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	if allow, restricted := catalog_allow[id]; restricted &&
+		!tsp.MaySee(tsp.SongSource{Restricted: true, Allow: allow}, key) {
+		return ""
+	}
+	return catalog[id]
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/**
+ * Asks the tracker for the songs played most over a period
+ * @param period tsp.CHART_DAY or tsp.CHART_WEEK
+ * @return the songs, most played first
+ */
+func fetch_charts(period string) (chart []tsp.ChartEntry, err error) {
+	if tracker_addr == "" {
+		return nil, fmt.Errorf("the charts need a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	request := tsp.NewMsg(tsp.CHARTS, 0, []byte(period))
+	sign_msg(request, nil)
+	if err = tsp.Encode(tracker, request); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodeCharts(in_msg.Msg)
+}
+
+/**
+ * Writes a chart, one song per line, most played first
+ * @param w where the chart is written
+ * @param chart the songs and their plays
+ */
+func write_chart(w io.Writer, chart []tsp.ChartEntry) {
+	if len(chart) == 0 {
+		fmt.Fprintln(w, "Nothing played yet.")
+	}
+	for i, entry := range chart {
+		song := entry.Song
+		fmt.Fprintf(w, "%3d. %s, %s (%s) [id %d] %d plays\n", i+1, song.Title, song.Artist,
+			format_duration(song.Duration), song.ID, entry.Plays)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * charts <day|week>: prints the songs played most across the swarm
+ */
+func run_charts(args []string) int {
+	if args[0] != tsp.CHART_DAY && args[0] != tsp.CHART_WEEK {
+		fmt.Println("Usage: ", os.Args[0], "charts <day|week>")
+		return 2
+	}
+	chart, err := fetch_charts(args[0])
+	if err != nil {
+		fmt.Println("can't get the charts: ", err)
+		return 1
+	}
+	write_chart(os.Stdout, chart)
+	return 0
+}
+
+/**
+ * CHARTS from the interactive menu: asks for the period and prints the
+ * songs played most over it
+ */
+func handle_charts() {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	period, _ := ui.Select("Most played over the last", []string{tsp.CHART_DAY, tsp.CHART_WEEK}, &input.Options{
+		Loop: true,
+	})
+	chart, err := fetch_charts(period)
+	if err != nil {
+		fmt.Println("can't get the charts: ", err)
+		return
+	}
+	write_chart(os.Stdout, chart)
+}
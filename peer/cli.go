@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/logging"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/**
+ * A subcommand of the peer, run as "peer <name> <args>"
+ */
+type Command struct {
+	// how its arguments are written in the usage
+	Args  string
+	Short string
+	// how many arguments it takes, -1 for one or more, ANY_ARGS for any
+	// number
+	NArgs int
+	// handed to the daemon when one is running, see control.go
+	Control bool
+	// returns the exit status
+	Run func(args []string) int
+}
+
+var commands map[string]Command
+
+// the NArgs of a command taking any number of arguments
+const ANY_ARGS = -2
+
+var (
+	tracker_flag         string
+	max_upload_flag      int
+	max_conn_upload_flag int
+	http_flag            string
+	port_mapping_flag    bool
+	quic_flag            bool
+	mtls_flag            bool
+	dlna_flag            bool
+	mirror_flag          int
+	dht_flag             bool
+	sort_flag            string
+	page_flag            = 1
+	page_size_flag       = -1
+	output_flag          string
+	audio_flag           string
+	plain_flag           bool
+	json_flag            bool
+	log_options          logging.Options
+)
+
+func init() {
+	commands = map[string]Command{
+		"serve":      {"<port> <filedir>", "run as a daemon: serve songs and take commands from the others", 2, false, run_serve},
+		"shell":      {"<port> <filedir>", "serve songs and take commands from the full-screen shell, or the menu", 2, false, run_shell},
+		"list":       {"", "print the master list", 0, true, run_list},
+		"search":     {"<query>", "print the songs matching a query, best first", -1, true, run_search},
+		"play":       {"<song id> [restart]", "play a song, from its bookmark unless restarted (through to the end, without a daemon)", ANY_ARGS, true, run_play},
+		"playalbum":  {"<album>", "play every track of an album, in order (through to the end, without a daemon)", -1, true, run_playalbum},
+		"download":   {"<song id>", "save a song to the downloads directory", 1, true, run_download},
+		"streamurl":  {"<song id>", "print a URL the daemon's HTTP gateway streams a song from, for a while", 1, true, run_streamurl},
+		"info":       {"<song id>", "print a song's details, from a peer serving it", 1, false, run_info},
+		"art":        {"<song id> [file]", "show a song's cover art, or save it to a file", ANY_ARGS, false, run_art},
+		"charts":     {"<day|week>", "print the songs played most across the swarm", 1, false, run_charts},
+		"who":        {"", "print the peers online and what they're listening to", 0, false, run_who},
+		"access":     {"[<file|dir> public|friends|private | <file|dir> allow|deny <key|friend>]", "print who may see which songs, or set who may see the songs at a path", ANY_ARGS, false, run_access},
+		"block":      {"[<key|friend> [reason]]", "print the blocked peers, or block one: never fetch from it or serve it", ANY_ARGS, true, run_block},
+		"unblock":    {"<key|friend>", "take a peer off the blocklist", 1, true, run_unblock},
+		"report":     {"<song id> corrupt|mislabeled [note]", "report a song's file to the tracker's operator", ANY_ARGS, false, run_report},
+		"friends":    {"[follow <key|address> [name] | unfollow <friend> | <friend>]", "print the peers followed and whether they're online, follow or unfollow one, or print a friend's library", ANY_ARGS, false, run_friends},
+		"browse":     {"[artist [album]]", "print the artists, an artist's albums or an album's tracks", ANY_ARGS, false, run_browse},
+		"genres":     {"[genre]", "print the genres, or the artists in a genre", ANY_ARGS, false, run_genres},
+		"history":    {"[n]", "print the latest plays", ANY_ARGS, false, run_history},
+		"top":        {"[n]", "print the songs played most", ANY_ARGS, false, run_top},
+		"stats":      {"[n] | peer <address|key> [n]", "print what was uploaded and downloaded, or the latest transfers with a peer", ANY_ARGS, true, run_stats},
+		"register":   {"<user> [invite]", "make an account on the tracker and log in to it", ANY_ARGS, false, run_register},
+		"login":      {"[user]", "log in to an account on the tracker, or print who is logged in", ANY_ARGS, false, run_login},
+		"logout":     {"", "log out of the tracker", 0, false, run_logout},
+		"lastfm":     {"<username>", "log in to last.fm, to scrobble plays there", 1, false, run_lastfm},
+		"rate":       {"<song id> <0-5>", "rate a song, 0 clears its rating", 2, false, run_rate},
+		"favorite":   {"<song id>", "add a song to the favorites", 1, false, run_favorite},
+		"unfavorite": {"<song id>", "take a song out of the favorites", 1, false, run_unfavorite},
+		"favorites":  {"[play]", "print the favorites, or replace the daemon's queue with them", ANY_ARGS, true, run_favorites},
+		"queue":      {"<song id>", "add a song to the daemon's queue", 1, true, run_daemon_only},
+		"next":       {"", "play the next song in the daemon's queue", 0, true, run_daemon_only},
+		"prev":       {"", "play the previous song in the daemon's queue", 0, true, run_daemon_only},
+		"pause":      {"", "pause the daemon's playback", 0, true, run_daemon_only},
+		"resume":     {"", "resume the daemon's playback", 0, true, run_daemon_only},
+		"stop":       {"", "stop the daemon's playback", 0, true, run_daemon_only},
+		"shuffle":    {"[on|off|all]", "shuffle the daemon's queue, or play the whole master list shuffled", ANY_ARGS, true, run_daemon_only},
+		"repeat":     {"[off|one|all]", "repeat the daemon's song or queue", ANY_ARGS, true, run_daemon_only},
+		"crossfade":  {"[0-10]", "set the seconds the daemon's queued songs fade into each other over", ANY_ARGS, true, run_daemon_only},
+		"eq":         {"[preset|<band> <dB>]", "set the daemon's equalizer to a preset, or one band's gain", ANY_ARGS, true, run_daemon_only},
+		"sleep":      {"[minutes|off]", "fade out and stop the daemon's playback after a while", ANY_ARGS, true, run_daemon_only},
+		"record":     {"[on|off]", "record the songs the daemon plays into its songs directory", ANY_ARGS, true, run_daemon_only},
+		"broadcast":  {"[on|off|<playlist>]", "broadcast what the daemon plays to an Icecast mount, or a playlist", ANY_ARGS, true, run_daemon_only},
+		"radio":      {"[on [name]|off|tune <n|address>]", "list the live broadcasts between peers, put the daemon on the air, or tune it in to one", ANY_ARGS, true, run_radio},
+		"party":      {"[host [name]|end|join <n|address>|leave|skip]", "list the listening parties, host one on the daemon, join it to one, or vote to skip", ANY_ARGS, true, run_party},
+		"shared":     {"[create <name>|add <name> <song id>|subscribe <name>|unsubscribe <name>|play <name>|stop|<name>]", "list the shared playlists, make one, add a song to one, subscribe to one, play one on the daemon, or print one", ANY_ARGS, true, run_shared},
+		"output":     {"[device]", "list the audio output devices, or choose one to play through", ANY_ARGS, true, run_output},
+		"cast":       {"[<song id> <device>|pause|play|volume <0-100>|stop]", "list the cast devices on the LAN, or cast a song to one (the daemon, with --http)", ANY_ARGS, true, run_cast},
+		"status":     {"", "print what the daemon is playing", 0, true, run_daemon_only},
+		"lyrics":     {"", "print the lyrics of the song the daemon is playing", 0, true, run_daemon_only},
+		"volume":     {"<0-100|+|->", "set the daemon's volume", 1, true, run_daemon_only},
+		"shutdown":   {"", "shut the daemon down", 0, true, run_daemon_only},
+	}
+}
+
+/**
+ * Registers the flags every command takes. They can go before or after
+ * the command name
+ * @param flags the flag set to add them to
+ */
+func add_common_flags(flags *flag.FlagSet) {
+	flags.StringVar(&tracker_flag, "tracker", tracker_flag, "tracker address as host:port or [ipv6]:port (overrides "+config_path()+")")
+	flags.IntVar(&max_upload_flag, "max-upload-rate", max_upload_flag, "KB/s to upload at in total, 0 for no limit")
+	flags.IntVar(&max_conn_upload_flag, "max-conn-upload-rate", max_conn_upload_flag, "KB/s to upload at to any one peer, 0 for no limit")
+	flags.StringVar(&http_flag, "http", http_flag, "address to serve the HTTP gateway on, e.g. :8000 (serve and shell only)")
+	flags.BoolVar(&quic_flag, "quic", quic_flag, "serve and stream songs over QUIC where peers support it")
+	flags.BoolVar(&mtls_flag, "mtls", mtls_flag, "only talk to peers over mutual TLS, with a certificate from the tracker's CA")
+	flags.BoolVar(&dlna_flag, "dlna", dlna_flag, "advertise the library to TVs and apps as a UPnP media server (serve and shell only, with --http)")
+	flags.BoolVar(&dht_flag, "dht", dht_flag, "find songs through the DHT, using the tracker only to join it")
+	flags.IntVar(&mirror_flag, "mirror", mirror_flag, "keep copies of the n most popular songs in the songs directory (serve and shell only)")
+	flags.BoolVar(&port_mapping_flag, "port-mapping", port_mapping_flag, "forward the serving port on the router over UPnP or NAT-PMP (serve and shell only)")
+	flags.StringVar(&sort_flag, "sort", sort_flag, "order list prints songs in: "+strings.Join(sort_orders, ", "))
+	flags.IntVar(&page_flag, "page", page_flag, "page of the list to print")
+	flags.StringVar(&audio_flag, "audio", audio_flag, "audio backend to play through: "+strings.Join(backend_names(), ", "))
+	flags.StringVar(&output_flag, "output", output_flag, "audio output device to play through, see the output command")
+	flags.BoolVar(&json_flag, "json", json_flag, "print list, search, info, status, history and top as JSON")
+	flags.BoolVar(&plain_flag, "plain", plain_flag, "use the line-by-line menu instead of the full-screen shell (shell only)")
+	flags.IntVar(&page_size_flag, "page-size", page_size_flag, "songs per page of the list, 0 for all of them")
+	logging.AddFlags(flags, &log_options)
+}
+
+func usage() {
+	fmt.Println("Usage: ", os.Args[0], "[flags] <command> [args]")
+	fmt.Println()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Printf("  %-28s %s\n", name+" "+cmd.Args, cmd.Short)
+	}
+	fmt.Println()
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
+
+/**
+ * Runs the command named by the first argument. The old form,
+ * "peer <port> <filedir>", still starts the interactive shell
+ * @param args the arguments left after the global flags
+ * @return the exit status
+ */
+func run_command(args []string) int {
+	if len(args) == 2 {
+		if _, err := strconv.Atoi(args[0]); err == nil {
+			if err = apply_flags(); err != nil {
+				fmt.Println(err)
+				return 2
+			}
+			load_list_cache()
+			return run_shell(args)
+		}
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Println("unknown command " + args[0])
+		usage()
+		return 2
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	add_common_flags(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	rest := flags.Args()
+	if (cmd.NArgs >= 0 && len(rest) != cmd.NArgs) || (cmd.NArgs == -1 && len(rest) == 0) {
+		fmt.Println("Usage: ", os.Args[0], args[0], cmd.Args)
+		return 2
+	}
+	if cmd.Control {
+		control := []string{args[0]}
+		if json_flag {
+			// the daemon doesn't see the flags, so -json goes along
+			control = append(control, "-json")
+		}
+		control = append(control, rest...)
+		if args[0] == "list" {
+			// the daemon doesn't see the flags, so the list options go along
+			control = append(control, list_options()...)
+		}
+		if status, ok := send_control(control); ok {
+			return status
+		}
+	}
+	if err := apply_flags(); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	load_list_cache()
+	return cmd.Run(rest)
+}
+
+/**
+ * Applies the config file and flags to the peer's settings, flags winning,
+ * and sets up logging
+ * @return an error if the logging flags are invalid
+ */
+func apply_flags() error {
+	atomic.StoreInt32(&volume, int32(config.Volume))
+	atomic.StoreInt32(&crossfade, int32(config.CrossfadeSecs))
+	load_eq()
+	load_visualizer()
+	load_output_device()
+	upload_bucket = NewTokenBucket(max_upload_flag << 10)
+	conn_upload_rate = max_conn_upload_flag << 10
+	tracker_addr = config.Tracker
+	if tracker_flag != "" {
+		tracker_addr = tracker_flag
+	}
+	if port_mapping_flag {
+		config.PortMapping = true
+	}
+	if quic_flag {
+		config.QUIC = true
+	}
+	if mtls_flag {
+		config.MTLS = true
+	}
+	if dlna_flag {
+		config.DLNA = true
+	}
+	if mirror_flag > 0 {
+		config.Mirror = mirror_flag
+	}
+	if dht_flag {
+		config.DHT = true
+	}
+	if sort_flag != "" {
+		if err := check_sort(sort_flag); err != nil {
+			return err
+		}
+		config.ListSort = sort_flag
+	}
+	if audio_flag != "" {
+		config.AudioBackend = audio_flag
+	}
+	if err := check_backend(config.AudioBackend); err != nil {
+		return err
+	}
+	if page_size_flag >= 0 {
+		config.PageSize = page_size_flag
+	}
+	if config.DHT {
+		// the tracker only hands out nodes to join the DHT through
+		dht_tracker = tracker_addr
+		tracker_addr = ""
+	}
+	return logging.Setup(log_options)
+}
+
+/**
+ * @return the arguments the serving code expects, in the order the old
+ * "peer <port> <filedir>" command line had them
+ */
+func peer_args(port string, dir string) []string {
+	return []string{os.Args[0], port, dir}
+}
+
+/**
+ * @return a context cancelled on SIGINT or SIGTERM
+ */
+func signal_context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+/**
+ * serve <port> <filedir>: runs as a daemon, serving songs and taking
+ * commands on the control socket, until interrupted or told to shut down
+ */
+func run_serve(args []string) int {
+	ln, err := listen_control()
+	if err != nil {
+		fmt.Println("can't open the control socket: ", err)
+		return 1
+	}
+	if err = load_queue(); err != nil {
+		fmt.Println("error reading "+queue_path()+": ", err)
+	}
+	if config.MTLS {
+		if _, _, err = mtls_certs(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	unlock_cache()
+	peer := peer_args(args[0], args[1])
+	ctx, cancel, server_done := start_peer(peer)
+	stopped, stop := signal_context()
+	defer stop()
+	go serve_control(ctx, ln, peer, stop)
+	go serve_mpris(ctx, stop)
+
+	<-stopped.Done()
+	fmt.Println("shutting down")
+	ln.Close()
+	shutdown(cancel, server_done)
+	os.Remove(control_path())
+	return 0
+}
+
+/**
+ * shell <port> <filedir>: serves songs and runs the interactive menu
+ */
+func run_shell(args []string) int {
+	if err := load_queue(); err != nil {
+		fmt.Println("error reading "+queue_path()+": ", err)
+	}
+	if config.MTLS {
+		if _, _, err := mtls_certs(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	unlock_cache()
+	peer := peer_args(args[0], args[1])
+	ctx, cancel, server_done := start_peer(peer)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go serve_mpris(ctx, func() { signals <- syscall.SIGTERM })
+
+	if !plain_flag && is_terminal() {
+		tui := NewTUI(ctx, peer)
+		go func() {
+			select {
+			case <-signals:
+				tui.Stop()
+			case <-tui.done:
+			}
+		}()
+		err := tui.Run()
+		if err == nil {
+			shutdown(cancel, server_done)
+			return 0
+		}
+		fmt.Println("can't start the full-screen shell, using the menu: ", err)
+	}
+
+	go func() {
+		<-signals
+		fmt.Println("\nshutting down")
+		shutdown(cancel, server_done)
+		os.Exit(0)
+	}()
+	for {
+		if handle_command(ctx, peer) < 0 {
+			break
+		}
+	}
+	shutdown(cancel, server_done)
+	return 0
+}
+
+/**
+ * Gets the master list for a command that doesn't serve songs itself,
+ * fetching it unless the cached one is fresh
+ * @param ctx cancelled on SIGINT or SIGTERM
+ * @return the list and how old it is, and false if there is none
+ */
+func load_list_for_command(ctx context.Context) ([]tsp.SongEntry, time.Duration, bool) {
+	// not serving, so there is no port to leave out of LAN discovery
+	songs, age, err := current_list(ctx, peer_args("", ""))
+	if err != nil {
+		fmt.Println("error receiving list: ", err)
+		return nil, 0, false
+	}
+	return songs, age, true
+}
+
+/**
+ * list: prints a page of the master list, sorted, and how old it is
+ */
+func run_list(args []string) int {
+	ctx, cancel := signal_context()
+	defer cancel()
+	songs, age, ok := load_list_for_command(ctx)
+	if !ok {
+		return 1
+	}
+	if done, err := use_library(); err == nil {
+		defer done()
+	}
+	var err error
+	if json_flag {
+		err = write_json_list(os.Stdout, songs, age, config.ListSort, page_flag, config.PageSize)
+	} else {
+		write_list_age(os.Stdout, age)
+		err = write_list_page(os.Stdout, songs, config.ListSort, page_flag, config.PageSize)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	return 0
+}
+
+/**
+ * search <query>: prints the songs matching the query, best first
+ */
+func run_search(args []string) int {
+	ctx, cancel := signal_context()
+	defer cancel()
+	if _, _, ok := load_list_for_command(ctx); !ok {
+		return 1
+	}
+	results := search_songs(strings.Join(args, " "))
+	if done, err := use_library(); err == nil {
+		defer done()
+	}
+	if json_flag {
+		write_json_songs(os.Stdout, results)
+	} else if len(results) > 0 {
+		print_master_list(results)
+	} else {
+		fmt.Println("No matches.")
+	}
+	if len(results) == 0 {
+		return 1
+	}
+	return 0
+}
+
+/**
+ * info <song id>: prints the song's details, from a peer serving it, or
+ * its master list entry if none of them answers
+ */
+func run_info(args []string) int {
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, args[0])
+	if !ok {
+		return 1
+	}
+	if done, err := use_library(); err == nil {
+		defer done()
+	}
+	details, err := fetch_song_details(song)
+	if json_flag {
+		write_json_info(os.Stdout, song, details, err == nil)
+	} else {
+		write_song_info(os.Stdout, song, details, err)
+	}
+	return 0
+}
+
+/**
+ * @param ctx cancelled on SIGINT or SIGTERM
+ * @param arg the song id as typed
+ * @return the song from the cached master list, refreshed in the
+ * background if it is stale, or from a freshly fetched one if the cached
+ * one doesn't have it; false if there is no such song
+ */
+func song_for_command(ctx context.Context, arg string) (tsp.SongEntry, bool) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Println("song id must be a number")
+		return tsp.SongEntry{}, false
+	}
+	if song, ok := find_song(id); ok {
+		refresh_list(ctx, peer_args("", ""))
+		return song, true
+	}
+	if _, err = load_master_list(ctx, peer_args("", "")); err != nil {
+		fmt.Println("error receiving list: ", err)
+		return tsp.SongEntry{}, false
+	}
+	song, ok := find_song(id)
+	if !ok {
+		fmt.Println("Song not found.")
+	}
+	return song, ok
+}
+
+/**
+ * play <song id>: plays the song through to the end, or until interrupted
+ */
+func run_play(args []string) int {
+	if len(args) != 1 && (len(args) != 2 || args[1] != "restart") {
+		fmt.Println("Usage: ", os.Args[0], "play <song id> [restart]")
+		return 2
+	}
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, args[0])
+	if !ok {
+		return 1
+	}
+	if done, err := use_library(); err != nil {
+		fmt.Println("can't open the library, the play won't be in the history: ", err)
+	} else {
+		defer done()
+	}
+	from, err := play_song(ctx, song, len(args) == 2)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("Now playing: " + song.Title + ", " + song.Artist)
+	write_resumed(os.Stdout, song, from)
+	playback.Wait()
+	playback.End()
+	output.Close()
+	return 0
+}
+
+/**
+ * download <song id>: saves the song to the downloads directory
+ */
+func run_download(args []string) int {
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, args[0])
+	if !ok {
+		return 1
+	}
+	if err := download_song(song); err != nil {
+		fmt.Println("download failed: ", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+/**
+ * Settings read from ~/.torero/config.toml at startup. Command line flags
+ * override anything set here
+ */
+type Config struct {
+	Tracker   string `toml:"tracker"`
+	Downloads string `toml:"downloads"`
+	Volume    int    `toml:"volume"`
+	// seconds queued songs fade into each other over, 0 for none
+	CrossfadeSecs int `toml:"crossfade_secs"`
+	// scale songs by their track gain so they play at about the same
+	// loudness
+	ReplayGain bool `toml:"replay_gain"`
+	// the equalizer preset, or "custom" for the gain of each band, in dB,
+	// in EQBands
+	EQPreset string    `toml:"eq_preset"`
+	EQBands  []float64 `toml:"eq_bands"`
+	// the audio output device to play through, see device.go
+	OutputDevice string `toml:"output_device"`
+	// the audio backend to play through, see sink.go: one of them that
+	// works if empty; and the file the wav backend records to
+	AudioBackend string `toml:"audio_backend"`
+	WavPath      string `toml:"wav_path"`
+	// the visualizer shown in the now playing view: off, spectrum or
+	// waveform
+	Visualizer string `toml:"visualizer"`
+	// how cover art is shown: auto, kitty, sixel, file or off, see art.go
+	Art string `toml:"art"`
+	// how much of the next queued song to fetch ahead (0 turns prefetching
+	// off), and how fast, so it doesn't crowd out the song playing
+	PrefetchMB   int `toml:"prefetch_mb"`
+	PrefetchKBps int `toml:"prefetch_kbps"`
+	// size limit of the cache of streamed songs, 0 turns caching off
+	CacheMB int `toml:"cache_mb"`
+	// encrypt the cache with a key made from a passphrase, see
+	// cachecrypt.go
+	EncryptCache bool `toml:"encrypt_cache"`
+	// songs streamed to other peers at once, 0 for no limit
+	MaxUploads int `toml:"max_uploads"`
+	// how long to wait for the tracker or a peer to accept a connection,
+	// and how often and how soon to try again when it doesn't
+	DialTimeoutMS int `toml:"dial_timeout_ms"`
+	DialRetries   int `toml:"dial_retries"`
+	DialBackoffMS int `toml:"dial_backoff_ms"`
+	// how long a read or write on any connection may block
+	IOTimeoutMS int `toml:"io_timeout_ms"`
+	// ask the router to forward the serving port, over UPnP or NAT-PMP
+	PortMapping bool `toml:"port_mapping"`
+	// serve songs over QUIC too, and stream over it from peers that do
+	QUIC bool `toml:"quic"`
+	// only talk to other peers over mutual TLS, with certificates from
+	// the tracker's CA, see mtls.go
+	MTLS bool `toml:"mtls"`
+	// advertise the library on the LAN as a UPnP media server, served by
+	// the HTTP gateway, see dlna.go
+	DLNA bool `toml:"dlna"`
+	// how many of the most popular songs to keep copies of, 0 for none
+	Mirror int `toml:"mirror"`
+	// find songs through the DHT instead of the tracker, joining it
+	// through these nodes (host:port) besides any the tracker hands out
+	DHT          bool     `toml:"dht"`
+	DHTBootstrap []string `toml:"dht_bootstrap"`
+	// how long the master list is used before it is fetched again
+	ListTTLSecs int `toml:"list_ttl_secs"`
+	// how LIST sorts the master list, and how many songs it shows per
+	// page, 0 for all of them
+	ListSort string `toml:"list_sort"`
+	PageSize int    `toml:"page_size"`
+	// the percentage of a party's members whose votes skip the song its
+	// host plays, see party.go
+	PartySkipPercent int `toml:"party_skip_percent"`
+	// tell the tracker what this peer is listening to, under a nickname,
+	// for who, see presence.go
+	Presence bool   `toml:"presence"`
+	Nickname string `toml:"nickname"`
+	// where plays are scrobbled to, under [scrobble], see scrobble.go
+	Scrobble ScrobbleConfig `toml:"scrobble"`
+	// the login the Subsonic API takes, under [subsonic], see subsonic.go
+	Subsonic SubsonicConfig `toml:"subsonic"`
+	// the Icecast mount broadcast to, under [broadcast], see broadcast.go
+	Broadcast BroadcastConfig `toml:"broadcast"`
+	// shell commands run on events, under [hooks], see hooks.go
+	Hooks Hooks `toml:"hooks"`
+}
+
+var config Config
+
+/**
+ * @return the directory holding the peer's config and local state
+ */
+func torero_dir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".torero"
+	}
+	return filepath.Join(home, ".torero")
+}
+
+/**
+ * @return the path of the peer's config file
+ */
+func config_path() string {
+	return filepath.Join(torero_dir(), "config.toml")
+}
+
+/**
+ * Loads the config file into config. A missing file is not an error, the
+ * peer just runs with defaults and whatever flags were given
+ * @return an error if the file exists but could not be parsed
+ */
+func load_config() error {
+	config.Downloads = filepath.Join(torero_dir(), "downloads")
+	config.Volume = MAX_VOLUME
+	config.ReplayGain = true
+	config.PrefetchMB = DEFAULT_PREFETCH_MB
+	config.PrefetchKBps = DEFAULT_PREFETCH_KBPS
+	config.CacheMB = DEFAULT_CACHE_MB
+	config.MaxUploads = DEFAULT_MAX_UPLOADS
+	config.DialTimeoutMS = int(DIAL_TIMEOUT / time.Millisecond)
+	config.DialRetries = DEFAULT_DIAL_RETRIES
+	config.DialBackoffMS = int(DEFAULT_DIAL_BACKOFF / time.Millisecond)
+	config.IOTimeoutMS = int(IO_TIMEOUT / time.Millisecond)
+	config.ListTTLSecs = int(DEFAULT_LIST_TTL / time.Second)
+	config.ListSort = SORT_ID
+	config.PageSize = DEFAULT_PAGE_SIZE
+	config.Art = ART_AUTO
+	config.PartySkipPercent = DEFAULT_PARTY_SKIP_PERCENT
+	_, err := toml.DecodeFile(config_path(), &config)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if config.Volume < 0 || config.Volume > MAX_VOLUME {
+		config.Volume = MAX_VOLUME
+	}
+	if config.CrossfadeSecs < 0 || config.CrossfadeSecs > MAX_CROSSFADE {
+		config.CrossfadeSecs = 0
+	}
+	if check_sort(config.ListSort) != nil {
+		config.ListSort = SORT_ID
+	}
+	if check_art_mode(config.Art) != nil {
+		config.Art = ART_AUTO
+	}
+	if config.PartySkipPercent < 1 || config.PartySkipPercent > 100 {
+		config.PartySkipPercent = DEFAULT_PARTY_SKIP_PERCENT
+	}
+	return err
+}
+
+/**
+ * Writes the current config back to the config file, e.g. to remember
+ * the last volume
+ * @return an error if the file could not be written
+ */
+func save_config() error {
+	if err := os.MkdirAll(torero_dir(), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(config_path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return toml.NewEncoder(file).Encode(config)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The control socket. A peer running "serve" owns the player and queue,
+ * and takes commands from thin CLI clients over a unix socket, so playback
+ * outlives the terminal that started it and any number of sessions can
+ * control it. A client sends one line, the command and its arguments
+ * separated by spaces, with -json after the command for JSON output (see
+ * jsonout.go); the daemon answers with the command's output and a
+ * last line "exit <status>", then closes the connection
+ */
+
+// how long a client waits for the daemon to accept a command
+const CONTROL_DIAL_TIMEOUT = time.Second
+
+/**
+ * @return the path of the daemon's control socket
+ */
+func control_path() string {
+	return filepath.Join(torero_dir(), "control.sock")
+}
+
+/**
+ * Opens the control socket, clearing one left behind by a daemon that
+ * didn't exit cleanly
+ * @return the listener, or an error if another daemon is already running
+ */
+func listen_control() (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", control_path(), CONTROL_DIAL_TIMEOUT); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", control_path())
+	}
+	os.Remove(control_path())
+	if err := os.MkdirAll(torero_dir(), 0755); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", control_path())
+}
+
+/**
+ * Takes commands from control clients until the listener is closed
+ * @param ctx cancelled when the peer shuts down
+ * @param ln the control socket
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @param quit called when a client asks the daemon to shut down
+ */
+func serve_control(ctx context.Context, ln net.Listener, args []string, quit func()) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(io_timeout()))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			status := run_control(ctx, args, strings.Fields(line), conn, quit)
+			fmt.Fprintf(conn, "exit %d\n", status)
+		}()
+	}
+}
+
+/**
+ * Runs one control command in the daemon
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @param cmd the command and its arguments
+ * @param w where the command's output goes
+ * @param quit shuts the daemon down
+ * @return the exit status for the client
+ */
+func run_control(ctx context.Context, args []string, cmd []string, w io.Writer, quit func()) int {
+	if len(cmd) == 0 {
+		fmt.Fprintln(w, "empty command")
+		return 2
+	}
+	as_json := len(cmd) > 1 && cmd[1] == "-json"
+	if as_json {
+		cmd = append([]string{cmd[0]}, cmd[2:]...)
+	}
+	switch cmd[0] {
+	case "list":
+		order, page, size, err := parse_list_options(cmd[1:])
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+		songs, age, err := current_list(ctx, args)
+		if err != nil {
+			fmt.Fprintln(w, "error receiving list: ", err)
+			return 1
+		}
+		if as_json {
+			err = write_json_list(w, songs, age, order, page, size)
+		} else {
+			write_list_age(w, age)
+			err = write_list_page(w, songs, order, page, size)
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+	case "search":
+		if _, _, err := current_list(ctx, args); err != nil {
+			fmt.Fprintln(w, "error receiving list: ", err)
+			return 1
+		}
+		results := search_songs(strings.Join(cmd[1:], " "))
+		if as_json {
+			write_json_songs(w, results)
+		} else if len(results) > 0 {
+			write_master_list(w, results)
+		} else {
+			fmt.Fprintln(w, "No matches.")
+		}
+		if len(results) == 0 {
+			return 1
+		}
+	case "play":
+		if len(cmd) != 2 && (len(cmd) != 3 || cmd[2] != "restart") {
+			fmt.Fprintln(w, "usage: play <song id> [restart]")
+			return 2
+		}
+		return control_song(ctx, args, cmd[0], cmd[1], len(cmd) == 3, w)
+	case "queue", "download", "streamurl":
+		if len(cmd) != 2 {
+			fmt.Fprintln(w, "usage: "+cmd[0]+" <song id>")
+			return 2
+		}
+		return control_song(ctx, args, cmd[0], cmd[1], false, w)
+	case "playalbum":
+		if len(cmd) < 2 {
+			fmt.Fprintln(w, "usage: playalbum <album>")
+			return 2
+		}
+		if err := play_album(ctx, args, strings.Join(cmd[1:], " ")); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintln(w, now_playing_line())
+	case "favorites":
+		if len(cmd) == 1 {
+			if err := write_favorites(w); err != nil {
+				fmt.Fprintln(w, "can't read the favorites: ", err)
+				return 1
+			}
+			break
+		}
+		if len(cmd) != 2 || cmd[1] != "play" {
+			fmt.Fprintln(w, "usage: favorites [play]")
+			return 2
+		}
+		if err := play_favorites(ctx); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintln(w, now_playing_line())
+	case "shuffle", "repeat":
+		if len(cmd) > 2 {
+			fmt.Fprintln(w, "usage: shuffle [on|off|all], repeat [off|one|all]")
+			return 2
+		}
+		return control_modes(ctx, args, cmd, w)
+	case "next":
+		play_next(ctx, 1)
+		fmt.Fprintln(w, now_playing_line())
+	case "prev":
+		play_next(ctx, -1)
+		fmt.Fprintln(w, now_playing_line())
+	case "pause":
+		playback.Pause()
+		fmt.Fprintln(w, "Paused.")
+	case "resume":
+		playback.Resume()
+		fmt.Fprintln(w, "Resumed.")
+	case "stop":
+		playback.End()
+	case "status":
+		if as_json {
+			write_json_status(w)
+			break
+		}
+		fmt.Fprintln(w, now_playing_line())
+	case "lyrics":
+		_, lyrics, err := current_lyrics()
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		_, elapsed, _, _ := playback.Position()
+		write_lyrics(w, lyrics, elapsed)
+	case "volume":
+		if len(cmd) != 2 {
+			fmt.Fprintf(w, "Volume %d.\n", get_volume())
+			break
+		}
+		v, err := parse_volume(cmd[1])
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+		fmt.Fprintf(w, "Volume %d.\n", set_volume(v))
+	case "crossfade":
+		if len(cmd) != 2 {
+			fmt.Fprintf(w, "Crossfade %ds.\n", get_crossfade())
+			break
+		}
+		secs, err := parse_crossfade(cmd[1])
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+		fmt.Fprintf(w, "Crossfade %ds.\n", set_crossfade(secs))
+	case "eq":
+		if err := set_eq(cmd[1:]); err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+		fmt.Fprintln(w, format_eq()+".")
+	case "sleep":
+		if len(cmd) == 2 {
+			minutes, err := parse_sleep(cmd[1])
+			if err != nil {
+				fmt.Fprintln(w, err)
+				return 2
+			}
+			set_sleep(minutes)
+		}
+		fmt.Fprintln(w, format_sleep())
+	case "record":
+		arg := ""
+		if len(cmd) == 2 {
+			arg = cmd[1]
+		}
+		status, err := toggle_recording(arg)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+		fmt.Fprintln(w, status)
+	case "broadcast":
+		status, err := handle_broadcast(ctx, strings.Join(cmd[1:], " "))
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintln(w, status)
+	case "radio":
+		return handle_radio(ctx, cmd[1:], w)
+	case "party":
+		return handle_party(ctx, cmd[1:], w)
+	case "shared":
+		return handle_shared(ctx, cmd[1:], true, w)
+	case "output":
+		return handle_output(cmd[1:], true, w)
+	case "block", "unblock":
+		return handle_block(cmd[1:], cmd[0] == "block", w)
+	case "stats":
+		return handle_stats(cmd[1:], true, w)
+	case "cast":
+		return handle_cast(ctx, args, cmd[1:], w)
+	case "shutdown":
+		fmt.Fprintln(w, "shutting down")
+		quit()
+	default:
+		fmt.Fprintln(w, "unknown command "+cmd[0])
+		return 2
+	}
+	return 0
+}
+
+/**
+ * Plays, queues or downloads a song in the daemon, or prints a URL it
+ * streams from, fetching the master list again if the daemon doesn't know
+ * the id
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param action "play", "queue", "download" or "streamurl"
+ * @param arg the song id as typed
+ * @param restart whether to play from the beginning rather than the
+ * song's bookmark
+ * @param w where the outcome is written
+ * @return the exit status for the client
+ */
+func control_song(ctx context.Context, args []string, action string, arg string, restart bool, w io.Writer) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Fprintln(w, "song id must be a number")
+		return 2
+	}
+	song, ok := find_song(id)
+	if !ok {
+		if _, err = load_master_list(ctx, args); err != nil {
+			fmt.Fprintln(w, "error receiving list: ", err)
+			return 1
+		}
+		if song, ok = find_song(id); !ok {
+			fmt.Fprintln(w, "Song not found.")
+			return 1
+		}
+	}
+
+	switch action {
+	case "play":
+		from, err := play_song(ctx, song, restart)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintln(w, "Now playing: "+song.Title+", "+song.Artist)
+		write_resumed(w, song, from)
+	case "queue":
+		fmt.Fprintf(w, "Queued at position %d.\n", queue.Add(song))
+	case "download":
+		if err = download_song(song); err != nil {
+			fmt.Fprintln(w, "download failed: ", err)
+			return 1
+		}
+		fmt.Fprintln(w, "Downloaded "+song.Title+".")
+	case "streamurl":
+		base := gateway_base()
+		if base == "" {
+			fmt.Fprintln(w, "the HTTP gateway is off, start the daemon with --http")
+			return 1
+		}
+		format := tsp.FORMAT_MP3
+		if len(song.Sources) > 0 && song.Sources[0].Format != "" {
+			format = song.Sources[0].Format
+		}
+		fmt.Fprintln(w, base+stream_path(song.ID, format))
+		fmt.Fprintf(w, "Works until %s.\n", time.Now().Add(STREAM_TOKEN_TTL).Format("2006-01-02 15:04"))
+	}
+	return 0
+}
+
+/**
+ * Hands a command to the daemon, if one is running, copying its output
+ * to stdout
+ * @param cmd the command and its arguments
+ * @return the command's exit status, and false if no daemon is running
+ */
+func send_control(cmd []string) (int, bool) {
+	conn, err := net.DialTimeout("unix", control_path(), CONTROL_DIAL_TIMEOUT)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+	if _, err = fmt.Fprintln(conn, strings.Join(cmd, " ")); err != nil {
+		fmt.Println("error talking to the daemon: ", err)
+		return 1, true
+	}
+
+	status := 1
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "exit ") {
+			status, _ = strconv.Atoi(strings.TrimPrefix(line, "exit "))
+			break
+		}
+		fmt.Println(line)
+	}
+	return status, true
+}
+
+/**
+ * Changes the queue's modes: shuffle on, off or over the whole master
+ * list, toggled without an argument; repeat off, one or all, going
+ * through them in turn without an argument
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @param cmd shuffle or repeat, and the mode if given
+ * @param w where the modes now in force are written
+ * @return the exit status for the client
+ */
+func control_modes(ctx context.Context, args []string, cmd []string, w io.Writer) int {
+	shuffle, repeat := queue.Modes()
+	arg := ""
+	if len(cmd) == 2 {
+		arg = cmd[1]
+	}
+	if cmd[0] == "shuffle" {
+		switch arg {
+		case "":
+			queue.SetShuffle(!shuffle)
+		case "on", "off":
+			queue.SetShuffle(arg == "on")
+		case "all":
+			if err := shuffle_all(ctx, args); err != nil {
+				fmt.Fprintln(w, err)
+				return 1
+			}
+		default:
+			fmt.Fprintln(w, "usage: shuffle [on|off|all]")
+			return 2
+		}
+	} else {
+		if arg == "" {
+			arg = next_repeat(repeat)
+		}
+		if err := queue.SetRepeat(arg); err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+	}
+	fmt.Fprintln(w, "Queue "+format_modes(queue.Modes())+".")
+	return 0
+}
+
+/**
+ * Runs a command that only makes sense against a running daemon
+ */
+func run_daemon_only(args []string) int {
+	fmt.Println("no daemon running, start one with: ", os.Args[0], "serve <port> <filedir>")
+	return 1
+}
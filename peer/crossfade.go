@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * Crossfading. With a crossfade of n seconds, a song playing from the
+ * queue is decoded n seconds ahead of what is heard. When the decoder
+ * reaches the end, those last n seconds are handed to the audio output as
+ * a tail, and the next song starts: the output fades the tail out while
+ * the next song fades in over it. If the next song is slow to start, the
+ * tail carries on fading out on its own. Songs played on their own, and
+ * the last song in the queue, end as they are
+ */
+
+// longest crossfade, in seconds
+const MAX_CROSSFADE = 10
+
+// current crossfade in seconds, 0 for none, read as each song starts
+var crossfade int32
+
+/**
+ * Sets the crossfade, clamped to 0..MAX_CROSSFADE, and remembers it in
+ * the config file. It takes effect from the next song
+ * @param secs the new crossfade
+ * @return the crossfade actually set
+ */
+func set_crossfade(secs int) int {
+	if secs < 0 {
+		secs = 0
+	}
+	if secs > MAX_CROSSFADE {
+		secs = MAX_CROSSFADE
+	}
+	atomic.StoreInt32(&crossfade, int32(secs))
+	config.CrossfadeSecs = secs
+	if err := save_config(); err != nil {
+		slog.Error("can't save crossfade", "err", err)
+	}
+	return secs
+}
+
+/**
+ * @return the current crossfade in seconds
+ */
+func get_crossfade() int {
+	return int(atomic.LoadInt32(&crossfade))
+}
+
+/**
+ * Parses a CROSSFADE argument
+ * @param arg what the user typed
+ * @return the crossfade in seconds, or an error if it isn't 0 to
+ * MAX_CROSSFADE
+ */
+func parse_crossfade(arg string) (int, error) {
+	secs, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || secs < 0 || secs > MAX_CROSSFADE {
+		return 0, fmt.Errorf("crossfade must be 0-%d seconds", MAX_CROSSFADE)
+	}
+	return secs, nil
+}
+
+/**
+ * Mixes the tail of the song before into 16 bit little-endian PCM of the
+ * next one, in place: the tail fades out linearly over its length and
+ * the next song fades in as it does
+ * @param pcm the next song's audio, or silence to fade the tail out alone
+ * @param tail what is left of the tail
+ * @param done bytes of the tail already played
+ * @param total bytes the tail started with
+ */
+func mix_pcm(pcm []byte, tail []byte, done int, total int) {
+	for i := 0; i+1 < len(pcm) && i+1 < len(tail); i += 2 {
+		in := int(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		out := int(int16(binary.LittleEndian.Uint16(tail[i:])))
+		// in thousandths, so the gains sum to unity at every sample
+		fade := (done + i) * 1000 / total
+		sample := (in*fade + out*(1000-fade)) / 1000
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(sample)))
+	}
+}
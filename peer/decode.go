@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// the first bytes of every FLAC stream
+	FLAC_MAGIC = "fLaC"
+	// bytes peeked at to tell formats apart, enough for the first Ogg page
+	SNIFF_LEN = 512
+)
+
+/**
+ * Turns a song stream into 16 bit stereo PCM for the player
+ */
+type Decoder interface {
+	io.Reader
+	SampleRate() int
+	Close() error
+}
+
+/**
+ * A buffered reader that still closes the stream underneath it
+ */
+type BufferedStream struct {
+	*bufio.Reader
+	io.Closer
+}
+
+/**
+ * Picks a decoder for a song stream, going by the format the serving peer
+ * announced, or by sniffing the stream's first bytes if it didn't
+ * @param format the format from the PLAY reply, "" if unknown
+ * @param src the song stream, closed along with the decoder
+ * @return a decoder producing 16 bit stereo PCM
+ */
+func new_decoder(format string, src io.ReadCloser) (Decoder, error) {
+	stream := BufferedStream{bufio.NewReaderSize(src, SNIFF_LEN), src}
+	first, _ := stream.Peek(SNIFF_LEN)
+	if format == "" {
+		format = sniff_format(first)
+	}
+	switch format {
+	case tsp.FORMAT_FLAC:
+		return NewFlacDecoder(stream, stream)
+	case tsp.FORMAT_VORBIS:
+		return NewVorbisDecoder(stream, stream)
+	case tsp.FORMAT_OPUS:
+		return NewOpusDecoder(stream, opus_channels(first), stream)
+	}
+	return mp3.NewDecoder(stream)
+}
+
+/**
+ * @param first the first bytes of a song stream
+ * @return the format the bytes look like, mp3 if nothing else matches
+ */
+func sniff_format(first []byte) string {
+	if strings.HasPrefix(string(first), FLAC_MAGIC) {
+		return tsp.FORMAT_FLAC
+	}
+	if format := ogg_format(first); format != "" {
+		return format
+	}
+	return tsp.FORMAT_MP3
+}
+
+/**
+ * @param name a song filename
+ * @return the format of the song going by its extension, "" if it isn't
+ * a format we can play
+ */
+func song_format(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mp3":
+		return tsp.FORMAT_MP3
+	case ".flac":
+		return tsp.FORMAT_FLAC
+	case ".ogg", ".oga":
+		return tsp.FORMAT_VORBIS
+	case ".opus":
+		return tsp.FORMAT_OPUS
+	}
+	return ""
+}
+
+/**
+ * @param format one of the tsp.FORMAT_ constants
+ * @return the name of the codec songs in that format are encoded with
+ */
+func codec_name(format string) string {
+	switch format {
+	case tsp.FORMAT_FLAC:
+		return "FLAC"
+	case tsp.FORMAT_VORBIS:
+		return "Vorbis"
+	case tsp.FORMAT_OPUS:
+		return "Opus"
+	}
+	return "MPEG-1 Layer III"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The copy of the tracker's master list kept between LIST_SINCE requests,
+ * so each one only fetches what changed since the last
+ */
+
+var (
+	list_cache_mutex sync.Mutex
+	// the registry and version the cached list is of, empty before the
+	// first LIST_SINCE
+	list_epoch   string
+	list_version int64
+	// the cached list, by song ID
+	list_cache = make(map[int]tsp.SongEntry)
+)
+
+/**
+ * Asks the tracker for the changes to the master list since the cached
+ * copy, and applies them
+ * @return the whole master list, by ID
+ */
+func fetch_list_delta() ([]tsp.SongEntry, error) {
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	list_cache_mutex.Lock()
+	defer list_cache_mutex.Unlock()
+	request := tsp.NewMsg(tsp.LIST_SINCE, 0, []byte(list_epoch))
+	request.Header.Offset = list_version
+	sign_msg(request, nil)
+	if err = tsp.Encode(tracker, request); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	delta, err := tsp.DecodeDelta(in_msg.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if delta.Full {
+		list_cache = make(map[int]tsp.SongEntry, len(delta.Songs))
+	}
+	for _, song := range delta.Songs {
+		list_cache[song.ID] = song
+	}
+	for _, id := range delta.Removed {
+		delete(list_cache, id)
+	}
+	list_epoch, list_version = delta.Epoch, delta.Version
+
+	songs := make([]tsp.SongEntry, 0, len(list_cache))
+	for _, song := range list_cache {
+		songs = append(songs, song)
+	}
+	sort.Slice(songs, func(i, j int) bool {
+		return songs[i].ID < songs[j].ID
+	})
+	return songs, nil
+}
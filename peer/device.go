@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Choosing the audio output device. oto always plays through the system's
+ * default device, so a device is chosen by pointing the default at it for
+ * this process before the player opens (see device_linux.go), and the
+ * player is reopened to move playback over. The chosen device is watched:
+ * if it goes away, e.g. headphones are unplugged, playback moves to the
+ * default device, and back once it returns
+ */
+
+const (
+	// the system's default device
+	DEFAULT_DEVICE = "default"
+	// how often the chosen device is checked for
+	DEVICE_POLL = 3 * time.Second
+)
+
+/**
+ * An audio output device: what it is chosen by, and a description of it
+ * for the user
+ */
+type OutputDevice struct {
+	Name        string
+	Description string
+}
+
+var (
+	device_mutex sync.Mutex
+	// the device the user chose, and the one playing now, which is the
+	// default while the chosen one is missing
+	chosen_device  = DEFAULT_DEVICE
+	current_device = DEFAULT_DEVICE
+)
+
+/**
+ * Chooses the device from the config file or -output flag at startup,
+ * playing through the default until it turns up if it is missing
+ */
+func load_output_device() {
+	name := config.OutputDevice
+	if output_flag != "" {
+		name = output_flag
+	}
+	if name == "" {
+		name = DEFAULT_DEVICE
+	}
+	chosen_device = name
+	if _, ok := find_device(name); ok && select_device(name) == nil {
+		current_device = name
+	}
+}
+
+/**
+ * Chooses the device to play through, moving playback over to it now
+ * @param name the device's name, from output_devices, or DEFAULT_DEVICE
+ * @param save whether to remember it in the config file
+ * @return an error if there is no such device
+ */
+func set_output_device(name string, save bool) error {
+	if name != DEFAULT_DEVICE {
+		if _, ok := find_device(name); !ok {
+			return fmt.Errorf("no output device %q", name)
+		}
+	}
+	device_mutex.Lock()
+	chosen_device = name
+	device_mutex.Unlock()
+	if err := switch_device(name); err != nil {
+		return err
+	}
+	if save {
+		config.OutputDevice = name
+		if err := save_config(); err != nil {
+			slog.Error("can't save output device", "err", err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Points the player at a device and reopens it there, if it isn't there
+ * already
+ * @param name the device, or DEFAULT_DEVICE
+ * @return an error if the device can't be selected
+ */
+func switch_device(name string) error {
+	device_mutex.Lock()
+	defer device_mutex.Unlock()
+	if name == current_device {
+		return nil
+	}
+	if err := select_device(name); err != nil {
+		return err
+	}
+	current_device = name
+	output.Reopen()
+	return nil
+}
+
+/**
+ * @param name a device name, or its number in the list output_devices
+ * returns, counting from 1
+ * @return the device, and false if there is none by that name
+ */
+func find_device(name string) (OutputDevice, bool) {
+	devices, err := output_devices()
+	if err != nil {
+		return OutputDevice{}, false
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(devices) {
+		return devices[n-1], true
+	}
+	for _, device := range devices {
+		if device.Name == name {
+			return device, true
+		}
+	}
+	return OutputDevice{}, false
+}
+
+/**
+ * Moves playback to the default device while the chosen one is missing,
+ * and back once it returns, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func watch_output_device(ctx context.Context) {
+	ticker := time.NewTicker(DEVICE_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		device_mutex.Lock()
+		chosen, current := chosen_device, current_device
+		device_mutex.Unlock()
+		if chosen == DEFAULT_DEVICE {
+			continue
+		}
+		_, present := find_device(chosen)
+		if !present && current == chosen {
+			slog.Warn("output device gone, playing through the default", "device", chosen)
+			switch_device(DEFAULT_DEVICE)
+		} else if present && current != chosen {
+			slog.Info("output device back", "device", chosen)
+			if err := switch_device(chosen); err != nil {
+				slog.Error("can't switch back to the output device", "device", chosen, "err", err)
+			}
+		}
+	}
+}
+
+/**
+ * Writes the output devices, marking the chosen one
+ * @param w where they are written
+ * @return an error if they can't be listed
+ */
+func write_output_devices(w io.Writer) error {
+	devices, err := output_devices()
+	if err != nil {
+		return err
+	}
+	device_mutex.Lock()
+	chosen, current := chosen_device, current_device
+	device_mutex.Unlock()
+	mark := func(name string) string {
+		switch {
+		case name == current:
+			return "*"
+		case name == chosen:
+			return "!"
+		}
+		return " "
+	}
+	fmt.Fprintf(w, "%s %2d. %s\n", mark(DEFAULT_DEVICE), 0, DEFAULT_DEVICE)
+	for i, device := range devices {
+		fmt.Fprintf(w, "%s %2d. %s (%s)\n", mark(device.Name), i+1, device.Description, device.Name)
+	}
+	if chosen != current {
+		fmt.Fprintln(w, "! marks the chosen device, which is missing")
+	}
+	return nil
+}
+
+/**
+ * Handles OUTPUT: lists the devices, or chooses one
+ * @param args the device's name or number, or none to list them
+ * @param save whether to remember the choice in the config file
+ * @param w where the outcome is written
+ * @return the exit status
+ */
+func handle_output(args []string, save bool, w io.Writer) int {
+	if len(args) == 0 {
+		if err := write_output_devices(w); err != nil {
+			fmt.Fprintln(w, "can't list output devices: ", err)
+			return 1
+		}
+		return 0
+	}
+	name := strings.Join(args, " ")
+	if name == "0" {
+		name = DEFAULT_DEVICE
+	}
+	if device, ok := find_device(name); ok {
+		name = device.Name
+	}
+	if err := set_output_device(name, save); err != nil {
+		fmt.Fprintln(w, err)
+		return 2
+	}
+	fmt.Fprintln(w, "Playing through "+name+".")
+	return 0
+}
+
+/**
+ * output [device]: lists the output devices or chooses one for next time;
+ * a running daemon switches to it straight away instead
+ */
+func run_output(args []string) int {
+	return handle_output(args, true, os.Stdout)
+}
+
+/**
+ * OUTPUT from the interactive menu: picks a device from the list
+ */
+func handle_output_menu() {
+	devices, err := output_devices()
+	if err != nil {
+		fmt.Println("can't list output devices: ", err)
+		return
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	options := []string{DEFAULT_DEVICE}
+	for _, device := range devices {
+		options = append(options, device.Name)
+	}
+	device_mutex.Lock()
+	query := "Output device (now " + current_device + ")"
+	device_mutex.Unlock()
+	name, _ := ui.Select(query, options, &input.Options{
+		Loop: true,
+	})
+	handle_output([]string{name}, true, os.Stdout)
+}
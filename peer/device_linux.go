@@ -0,0 +1,113 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+ * Output devices on Linux. With PulseAudio or PipeWire running, its sinks
+ * are the devices and PULSE_SINK points ALSA's default device at one;
+ * otherwise the ALSA sound cards are, and ALSA_CARD does
+ */
+
+// what kind of output a sink is, by what its name contains
+var sink_kinds = [][2]string{
+	{"hdmi", "HDMI"}, {"headphones", "headphones"}, {"headset", "headset"}, {"bluez", "Bluetooth"},
+	{"usb", "USB"}, {"iec958", "S/PDIF"}, {"analog", "analog"},
+}
+
+/**
+ * @return the output devices, not counting the default
+ */
+func output_devices() ([]OutputDevice, error) {
+	if devices, err := pulse_sinks(); err == nil {
+		return devices, nil
+	}
+	return alsa_cards()
+}
+
+/**
+ * @return the PulseAudio or PipeWire sinks, from pactl, or an error if
+ * neither is running
+ */
+func pulse_sinks() ([]OutputDevice, error) {
+	out, err := exec.Command("pactl", "list", "short", "sinks").Output()
+	if err != nil {
+		return nil, err
+	}
+	var devices []OutputDevice
+	for _, line := range strings.Split(string(out), "\n") {
+		// index, name, module, sample format, state
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		devices = append(devices, OutputDevice{Name: fields[1], Description: describe_sink(fields[1])})
+	}
+	return devices, nil
+}
+
+/**
+ * @param name a sink name, e.g. alsa_output.pci-0000_00_1f.3.hdmi-stereo
+ * @return what kind of output it is, going by its name
+ */
+func describe_sink(name string) string {
+	lower := strings.ToLower(name)
+	for _, kind := range sink_kinds {
+		if strings.Contains(lower, kind[0]) {
+			return kind[1]
+		}
+	}
+	return "sink"
+}
+
+/**
+ * @return the ALSA sound cards, from /proc/asound/cards
+ */
+func alsa_cards() ([]OutputDevice, error) {
+	file, err := os.Open("/proc/asound/cards")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var devices []OutputDevice
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// " 0 [PCH            ]: HDA-Intel - HDA Intel PCH"
+		line := scanner.Text()
+		start, end := strings.Index(line, "["), strings.Index(line, "]")
+		if start < 0 || end < start {
+			continue
+		}
+		description := line[end+1:]
+		if dash := strings.Index(description, " - "); dash >= 0 {
+			description = description[dash+3:]
+		}
+		devices = append(devices, OutputDevice{
+			Name:        strings.TrimSpace(line[start+1 : end]),
+			Description: strings.TrimSpace(description),
+		})
+	}
+	return devices, scanner.Err()
+}
+
+/**
+ * Points the default device at another for the players opened from now on
+ * @param name the device, or DEFAULT_DEVICE to go back to the system's
+ * @return an error if the environment can't be changed
+ */
+func select_device(name string) error {
+	if name == DEFAULT_DEVICE {
+		os.Unsetenv("PULSE_SINK")
+		return os.Unsetenv("ALSA_CARD")
+	}
+	if _, err := pulse_sinks(); err == nil {
+		return os.Setenv("PULSE_SINK", name)
+	}
+	return os.Setenv("ALSA_CARD", name)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * Output devices elsewhere: oto plays through the system's default device
+ * and there is no way to point it at another, so that is the only one
+ */
+
+/**
+ * @return the output devices, not counting the default: none
+ */
+func output_devices() ([]OutputDevice, error) {
+	return nil, nil
+}
+
+/**
+ * @return an error for any device but the default
+ */
+func select_device(name string) error {
+	if name != DEFAULT_DEVICE {
+		return fmt.Errorf("only the default output device can be used here")
+	}
+	return nil
+}
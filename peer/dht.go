@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The DHT. With dht on, peers find each other's songs without a tracker
+ * through a Kademlia-style distributed hash table keyed by the SHA-256 of
+ * song files. Every serving peer is a node with a random 256 bit ID, and
+ * stores the sources of the songs whose hash is closest (by XOR) to its
+ * ID; each peer stores its own songs on the DHT_K nodes closest to their
+ * hashes, and again every DHT_REPUBLISH. Before a song is played or
+ * downloaded, its hash is looked up to find every peer serving it. The
+ * master list is built from the songs of the nodes in the routing table
+ * and on the LAN. A tracker, if one is configured, is only asked for
+ * nodes to join through
+ */
+
+const (
+	// bits in a node ID, and so buckets in the routing table
+	DHT_ID_BITS = 256
+	// nodes per bucket, and how many nodes a song is stored on
+	DHT_K = 8
+	// requests a lookup keeps in flight at once
+	DHT_ALPHA = 3
+	// how long a stored song is kept without being stored again, and how
+	// often a peer stores its own
+	DHT_TTL       = time.Hour
+	DHT_REPUBLISH = 30 * time.Minute
+	// how often the routing table is refreshed by looking up this node
+	DHT_REFRESH = 15 * time.Minute
+	// most hashes, and sources of each, stored for other peers
+	MAX_DHT_KEYS    = 10000
+	MAX_DHT_SOURCES = 32
+)
+
+/**
+ * A song stored for another peer, and when it is dropped unless stored
+ * again
+ */
+type DHTValue struct {
+	song    tsp.SongEntry
+	expires time.Time
+}
+
+var (
+	// this node's ID, picked at random for every run
+	dht_id = make([]byte, DHT_ID_BITS/8)
+	// the tracker asked for nodes to join the DHT through, "" if there is
+	// none. With dht on, tracker_addr is left empty
+	dht_tracker string
+
+	dht_mutex sync.Mutex
+	// the routing table: bucket i holds the nodes whose distance from this
+	// one has its highest set bit at i, least recently seen first
+	dht_buckets [DHT_ID_BITS][]tsp.DHTNode
+	// songs stored here, by hex hash, then by the address of their source
+	dht_store = make(map[string]map[string]DHTValue)
+)
+
+func init() {
+	if _, err := rand.Read(dht_id); err != nil {
+		panic(err)
+	}
+}
+
+/**
+ * @param a a node ID or key
+ * @param b another
+ * @return their distance, a XOR b
+ */
+func dht_distance(a []byte, b []byte) []byte {
+	d := make([]byte, len(a))
+	for i := range a {
+		if i < len(b) {
+			d[i] = a[i] ^ b[i]
+		}
+	}
+	return d
+}
+
+/**
+ * @param id a node ID
+ * @return the routing table bucket the node goes in, -1 for this node
+ */
+func dht_bucket(id []byte) int {
+	d := dht_distance(id, dht_id)
+	for i, b := range d {
+		if b != 0 {
+			return (len(d)-1-i)*8 + bits.Len8(b) - 1
+		}
+	}
+	return -1
+}
+
+/**
+ * Sorts nodes by their distance from a key, closest first
+ * @param nodes the nodes
+ * @param key a node ID or song hash
+ */
+func sort_by_distance(nodes []tsp.DHTNode, key []byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(dht_distance(nodes[i].ID, key), dht_distance(nodes[j].ID, key)) < 0
+	})
+}
+
+/**
+ * @return this node as other nodes should add it: with no address if this
+ * process doesn't serve songs
+ */
+func dht_self() tsp.DHTNode {
+	node := tsp.DHTNode{ID: dht_id}
+	if serve_args != nil {
+		node.Addr = announced_addr(serve_args)
+	}
+	return node
+}
+
+/**
+ * Adds a node that was just heard from to the routing table, or moves it
+ * to the end of its bucket. If the bucket is full, its least recently
+ * seen node is pinged and only replaced if it doesn't answer
+ * @param node the node
+ */
+func dht_seen(node tsp.DHTNode) {
+	if len(node.ID) != len(dht_id) || node.Addr == "" {
+		return
+	}
+	index := dht_bucket(node.ID)
+	if index < 0 {
+		return
+	}
+	dht_mutex.Lock()
+	defer dht_mutex.Unlock()
+	bucket := dht_buckets[index]
+	for i, known := range bucket {
+		if bytes.Equal(known.ID, node.ID) {
+			dht_buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return
+		}
+	}
+	if len(bucket) < DHT_K {
+		dht_buckets[index] = append(bucket, node)
+		return
+	}
+	oldest := bucket[0]
+	go func() {
+		if dht_ping(oldest) {
+			return
+		}
+		dht_forget(oldest)
+		dht_mutex.Lock()
+		if len(dht_buckets[index]) < DHT_K {
+			dht_buckets[index] = append(dht_buckets[index], node)
+		}
+		dht_mutex.Unlock()
+	}()
+}
+
+/**
+ * Drops a node that didn't answer from the routing table
+ * @param node the node
+ */
+func dht_forget(node tsp.DHTNode) {
+	index := dht_bucket(node.ID)
+	if index < 0 {
+		return
+	}
+	dht_mutex.Lock()
+	defer dht_mutex.Unlock()
+	bucket := dht_buckets[index]
+	for i, known := range bucket {
+		if bytes.Equal(known.ID, node.ID) {
+			dht_buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+/**
+ * @param key a node ID or song hash
+ * @param n how many nodes to return
+ * @return the n nodes in the routing table closest to key, closest first
+ */
+func dht_closest(key []byte, n int) []tsp.DHTNode {
+	dht_mutex.Lock()
+	var nodes []tsp.DHTNode
+	for _, bucket := range dht_buckets {
+		nodes = append(nodes, bucket...)
+	}
+	dht_mutex.Unlock()
+	sort_by_distance(nodes, key)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+/**
+ * Sends a DHT request to a node and reads its reply, adding the node to
+ * the routing table if it answers
+ * @param t the request type, one of the tsp.DHT_ types
+ * @param addr the node's address
+ * @param request the request
+ * @return the reply
+ */
+func dht_call(t byte, addr string, request tsp.DHTMsg) (tsp.DHTMsg, error) {
+	request.From = dht_self()
+	content, err := tsp.EncodeDHT(request)
+	if err != nil {
+		return tsp.DHTMsg{}, err
+	}
+	conn, err := dial_peer(context.Background(), addr, nil)
+	if err != nil {
+		return tsp.DHTMsg{}, err
+	}
+	defer conn.Close()
+	if err = tsp.Encode(conn, tsp.NewMsg(t, 0, content)); err != nil {
+		return tsp.DHTMsg{}, err
+	}
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		return tsp.DHTMsg{}, err
+	}
+	answer, err := tsp.DecodeDHT(reply.Msg)
+	if err != nil {
+		return tsp.DHTMsg{}, err
+	}
+	if answer.From.Addr == addr {
+		dht_seen(answer.From)
+	}
+	return answer, nil
+}
+
+/**
+ * @param node a node in the routing table
+ * @return whether it still answers
+ */
+func dht_ping(node tsp.DHTNode) bool {
+	_, err := dht_call(tsp.DHT_FIND_NODE, node.Addr, tsp.DHTMsg{Key: dht_id})
+	return err == nil
+}
+
+/**
+ * Finds the nodes closest to a key by asking the closest nodes known for
+ * closer ones, DHT_ALPHA at a time, until the DHT_K closest have all
+ * answered
+ * @param key a node ID or song hash
+ * @param find_value whether to ask for the songs stored under key too
+ * @return the DHT_K closest nodes that answered, and the songs stored
+ * under key on any node asked
+ */
+func dht_lookup(key []byte, find_value bool) ([]tsp.DHTNode, []tsp.SongEntry) {
+	t := byte(tsp.DHT_FIND_NODE)
+	if find_value {
+		t = tsp.DHT_FIND_VALUE
+	}
+	shortlist := dht_closest(key, DHT_K)
+	seen := make(map[string]bool)
+	for _, node := range shortlist {
+		seen[node.Addr] = true
+	}
+	asked := make(map[string]bool)
+	failed := make(map[string]bool)
+	var songs []tsp.SongEntry
+	for {
+		var batch []tsp.DHTNode
+		for _, node := range shortlist {
+			if !asked[node.Addr] && len(batch) < DHT_ALPHA {
+				batch = append(batch, node)
+				asked[node.Addr] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make([]tsp.DHTMsg, len(batch))
+		errs := make([]error, len(batch))
+		var calls sync.WaitGroup
+		for i, node := range batch {
+			calls.Add(1)
+			go func(i int, node tsp.DHTNode) {
+				defer calls.Done()
+				replies[i], errs[i] = dht_call(t, node.Addr, tsp.DHTMsg{Key: key})
+			}(i, node)
+		}
+		calls.Wait()
+
+		for i, reply := range replies {
+			if errs[i] != nil {
+				failed[batch[i].Addr] = true
+				dht_forget(batch[i])
+				continue
+			}
+			songs = append(songs, reply.Songs...)
+			for _, node := range reply.Nodes {
+				if len(node.ID) == len(dht_id) && node.Addr != "" && !seen[node.Addr] && !bytes.Equal(node.ID, dht_id) {
+					seen[node.Addr] = true
+					shortlist = append(shortlist, node)
+				}
+			}
+		}
+		kept := shortlist[:0]
+		for _, node := range shortlist {
+			if !failed[node.Addr] {
+				kept = append(kept, node)
+			}
+		}
+		shortlist = kept
+		sort_by_distance(shortlist, key)
+		if len(shortlist) > DHT_K {
+			shortlist = shortlist[:DHT_K]
+		}
+	}
+	return shortlist, songs
+}
+
+/**
+ * Joins the DHT through the nodes the tracker hands out, the bootstrap
+ * nodes in the config and any peers found on the LAN, then fills the
+ * routing table by looking this node up
+ * @param lan the serving addresses of peers found on the LAN
+ * @return an error if none of them answered
+ */
+func dht_join(lan []string) error {
+	seeds := append(append([]string{}, config.DHTBootstrap...), lan...)
+	if dht_tracker != "" {
+		if nodes, err := dht_tracker_nodes(); err != nil {
+			slog.Warn("can't get DHT nodes from the tracker", "tracker", dht_tracker, "err", err)
+		} else {
+			for _, node := range nodes {
+				seeds = append(seeds, node.Addr)
+			}
+		}
+	}
+	self := dht_self().Addr
+	var calls sync.WaitGroup
+	for _, addr := range seeds {
+		if addr == self {
+			continue
+		}
+		calls.Add(1)
+		go func(addr string) {
+			defer calls.Done()
+			// seeds may announce a different address than they were
+			// found under, so whatever answers is added as it says
+			if reply, err := dht_call(tsp.DHT_FIND_NODE, addr, tsp.DHTMsg{Key: dht_id}); err == nil {
+				dht_seen(reply.From)
+			}
+		}(addr)
+	}
+	calls.Wait()
+	if len(dht_closest(dht_id, 1)) == 0 {
+		return errors.New("no DHT node answered")
+	}
+	dht_lookup(dht_id, false)
+	return nil
+}
+
+/**
+ * Asks the tracker for nodes to join the DHT through, and tells it about
+ * this one
+ * @return the nodes
+ */
+func dht_tracker_nodes() ([]tsp.DHTNode, error) {
+	content, err := tsp.EncodeDHT(tsp.DHTMsg{From: dht_self()})
+	if err != nil {
+		return nil, err
+	}
+	tracker, err := dial_tracker(context.Background(), dht_tracker)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.DHT_BOOTSTRAP, 0, content)); err != nil {
+		return nil, err
+	}
+	reply, err := tsp.Decode(tracker)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	answer, err := tsp.DecodeDHT(reply.Msg)
+	return answer.Nodes, err
+}
+
+/**
+ * Joins the DHT if the routing table is empty
+ * @param lan the serving addresses of peers found on the LAN
+ */
+func dht_ready(lan []string) {
+	if len(dht_closest(dht_id, 1)) > 0 {
+		return
+	}
+	if err := dht_join(lan); err != nil {
+		slog.Warn("can't join the DHT", "err", err)
+	}
+}
+
+/**
+ * Keeps a serving peer in the DHT: joins it, stores this peer's songs,
+ * refreshes the routing table every DHT_REFRESH and stores the songs again
+ * every DHT_REPUBLISH
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func dht_maintain(ctx context.Context, args []string) {
+	dht_ready(discover_peers(ctx, local_addr(args)))
+	dht_publish_local()
+	refresh := time.NewTicker(DHT_REFRESH)
+	defer refresh.Stop()
+	republish := time.NewTicker(DHT_REPUBLISH)
+	defer republish.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			dht_ready(discover_peers(ctx, local_addr(args)))
+			dht_lookup(dht_id, false)
+		case <-republish.C:
+			dht_publish_local()
+		}
+	}
+}
+
+/**
+ * Stores every song this peer serves, or is seeding, in the DHT
+ */
+func dht_publish_local() {
+	master_mutex.Lock()
+	songs := append(seeding_songs(serve_args), local_songs...)
+	master_mutex.Unlock()
+	dht_publish(songs)
+}
+
+/**
+ * Stores songs this peer serves on the DHT_K nodes closest to their hashes.
+ * Restricted songs aren't stored, the DHT lists them to anyone
+ * @param songs the songs, each with this peer as its single source
+ */
+func dht_publish(songs []tsp.SongEntry) {
+	stored := 0
+	for _, song := range songs {
+		if song.Sources[0].Restricted {
+			continue
+		}
+		key, err := hex.DecodeString(song.Sources[0].Hash)
+		if err != nil || len(key) != len(dht_id) {
+			continue
+		}
+		nodes, _ := dht_lookup(key, false)
+		for _, node := range nodes {
+			if _, err = dht_call(tsp.DHT_STORE, node.Addr, tsp.DHTMsg{Key: key, Songs: []tsp.SongEntry{song}}); err == nil {
+				stored++
+			}
+		}
+	}
+	slog.Debug("stored songs in the DHT", "songs", len(songs), "stores", stored)
+}
+
+/**
+ * Looks a song up in the DHT, adding every peer found serving an
+ * identical file to its sources
+ * @param song the master list entry of the song
+ * @return the song with the sources found added
+ */
+func dht_sources(song tsp.SongEntry) tsp.SongEntry {
+	if !config.DHT {
+		return song
+	}
+	dht_ready(nil)
+	self := dht_self().Addr
+	looked_up := make(map[string]bool)
+	for _, source := range song.Sources {
+		key, err := hex.DecodeString(source.Hash)
+		if err != nil || len(key) != len(dht_id) || looked_up[source.Hash] {
+			continue
+		}
+		looked_up[source.Hash] = true
+		_, found := dht_lookup(key, true)
+		for _, entry := range found {
+			for _, s := range entry.Sources {
+				if s.Hash == source.Hash && s.PeerAddr != self && !has_source(song, s.PeerAddr) {
+					song.Sources = append(song.Sources, s)
+				}
+			}
+		}
+	}
+	return song
+}
+
+/**
+ * Joins the DHT if need be, for building the master list
+ * @param lan the serving addresses of peers found on the LAN
+ * @return the addresses of every node in the routing table
+ */
+func dht_contacts(lan []string) []string {
+	dht_ready(lan)
+	var addrs []string
+	for _, node := range dht_closest(dht_id, DHT_ID_BITS*DHT_K) {
+		addrs = append(addrs, node.Addr)
+	}
+	return addrs
+}
+
+/**
+ * Keeps the songs another node stores here. Each must list the storing
+ * node as its single source, serving a file with the key as its hash
+ * @param request the DHT_STORE
+ */
+func dht_put(request tsp.DHTMsg) {
+	key := hex.EncodeToString(request.Key)
+	dht_mutex.Lock()
+	defer dht_mutex.Unlock()
+	for _, song := range request.Songs {
+		if len(song.Sources) != 1 || song.Sources[0].Hash != key || song.Sources[0].PeerAddr != request.From.Addr {
+			continue
+		}
+		values, ok := dht_store[key]
+		if !ok {
+			if len(dht_store) >= MAX_DHT_KEYS {
+				return
+			}
+			values = make(map[string]DHTValue)
+			dht_store[key] = values
+		}
+		if _, ok = values[request.From.Addr]; !ok && len(values) >= MAX_DHT_SOURCES {
+			continue
+		}
+		values[request.From.Addr] = DHTValue{song, time.Now().Add(DHT_TTL)}
+	}
+}
+
+/**
+ * @param key a song hash
+ * @return the songs stored here under it, dropping any that expired
+ */
+func dht_values(key []byte) []tsp.SongEntry {
+	hash := hex.EncodeToString(key)
+	dht_mutex.Lock()
+	defer dht_mutex.Unlock()
+	var songs []tsp.SongEntry
+	for addr, value := range dht_store[hash] {
+		if time.Now().After(value.expires) {
+			delete(dht_store[hash], addr)
+			continue
+		}
+		songs = append(songs, value.song)
+	}
+	if len(dht_store[hash]) == 0 {
+		delete(dht_store, hash)
+	}
+	return songs
+}
+
+/**
+ * Answers a DHT request with the closest nodes to its key this node
+ * knows, and for a DHT_FIND_VALUE the songs stored here under it. A
+ * DHT_STORE is kept first. Peers not in the DHT turn every request away
+ * @param in_msg the request
+ * @param client the requesting node
+ */
+func serve_dht(in_msg *tsp.Msg, client io.Writer) {
+	if !config.DHT {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, "not in the DHT")
+		return
+	}
+	request, err := tsp.DecodeDHT(in_msg.Msg)
+	if err != nil {
+		slog.Warn("bad DHT request", "err", err)
+		return
+	}
+	dht_seen(request.From)
+	reply := tsp.DHTMsg{From: dht_self(), Key: request.Key, Nodes: dht_closest(request.Key, DHT_K)}
+	switch in_msg.Header.Type {
+	case tsp.DHT_FIND_VALUE:
+		reply.Songs = dht_values(request.Key)
+	case tsp.DHT_STORE:
+		dht_put(request)
+	}
+	content, err := tsp.EncodeDHT(reply)
+	if err != nil {
+		slog.Error("can't encode DHT reply", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(in_msg.Header.Type, 0, content)); err != nil {
+		slog.Warn("can't send DHT reply", "err", err)
+	}
+}
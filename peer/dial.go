@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// times a failed dial is tried again before giving up
+	DEFAULT_DIAL_RETRIES = 3
+	// wait before the first retry, doubled for each one after it
+	DEFAULT_DIAL_BACKOFF = 250 * time.Millisecond
+	// longest wait between two tries
+	MAX_DIAL_BACKOFF = 5 * time.Second
+	// how long a read or write on a connection may block, unless
+	// io_timeout_ms is set
+	IO_TIMEOUT = 30 * time.Second
+)
+
+/**
+ * @return how long to wait for a host to accept a connection
+ */
+func dial_timeout() time.Duration {
+	if config.DialTimeoutMS > 0 {
+		return time.Duration(config.DialTimeoutMS) * time.Millisecond
+	}
+	return DIAL_TIMEOUT
+}
+
+/**
+ * @return how long a read or write on a connection may block before the
+ * host on the other end is given up on
+ */
+func io_timeout() time.Duration {
+	if config.IOTimeoutMS > 0 {
+		return time.Duration(config.IOTimeoutMS) * time.Millisecond
+	}
+	return IO_TIMEOUT
+}
+
+/**
+ * A connection whose every read and write fails with a timeout once it
+ * has blocked for longer than its timeout, so a hung host can't stall
+ * the peer forever. Long transfers are fine as long as data keeps moving
+ */
+type DeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func NewDeadlineConn(conn net.Conn, timeout time.Duration) *DeadlineConn {
+	return &DeadlineConn{Conn: conn, timeout: timeout}
+}
+
+func (c *DeadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *DeadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+/**
+ * An error from a host that stopped answering. Trying again may well work
+ */
+type TimeoutError struct {
+	// who stopped answering, e.g. "the tracker"
+	Who string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Who + " didn't answer in time, try again"
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+/**
+ * @return whether err comes from a connection or dial that timed out
+ */
+func is_timeout(err error) bool {
+	var net_err net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &net_err) && net_err.Timeout())
+}
+
+/**
+ * @param who who was being waited on, e.g. "the tracker"
+ * @param err an error talking to them
+ * @return a *TimeoutError if err is a timeout, otherwise err
+ */
+func retryable(who string, err error) error {
+	if err != nil && is_timeout(err) {
+		return &TimeoutError{Who: who, Err: err}
+	}
+	return err
+}
+
+/**
+ * Connects to the tracker or a peer, retrying with exponential backoff
+ * and jitter, so a host that blips or restarts doesn't fail the request
+ * @param ctx cancelling it gives up on the retries
+ * @param addr the host:port to connect to
+ * @return the connection, each read and write on it limited to
+ * io_timeout(), or the last dial error
+ */
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dial_timeout()}
+	backoff := time.Duration(config.DialBackoffMS) * time.Millisecond
+	for try := 0; ; try++ {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return NewDeadlineConn(conn, io_timeout()), nil
+		}
+		if try >= config.DialRetries {
+			return nil, err
+		}
+
+		// wait somewhere between half and all of the backoff, so peers
+		// that lost the tracker together don't all come back at once
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.Debug("dial failed, retrying", "addr", addr, "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > MAX_DIAL_BACKOFF {
+			backoff = MAX_DIAL_BACKOFF
+		}
+	}
+}
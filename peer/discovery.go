@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// mDNS service peers announce themselves under on the LAN
+	MDNS_SERVICE = "_torero._tcp"
+	MDNS_DOMAIN  = "local."
+	// how long LIST waits for peers to answer an mDNS browse
+	MDNS_BROWSE_TIMEOUT = 3 * time.Second
+)
+
+// the mDNS registration of this peer, shut down on exit
+var mdns_server *zeroconf.Server
+
+/**
+ * Announces this peer as a _torero._tcp service on the LAN, so peers
+ * without a tracker can find it. Failing to announce is not fatal
+ * @param args cl arguments which contain the port
+ */
+func announce_mdns(args []string) {
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = GetLocalIP()
+	}
+	text := []string{"version=" + strconv.Itoa(tsp.VERSION)}
+	server, err := zeroconf.Register(host+"-"+args[1], MDNS_SERVICE, MDNS_DOMAIN, port, text, nil)
+	if err != nil {
+		slog.Warn("can't announce on the LAN", "err", err)
+		return
+	}
+	mdns_server = server
+}
+
+/**
+ * Withdraws the mDNS announcement, if there is one
+ */
+func stop_announcing() {
+	if mdns_server != nil {
+		mdns_server.Shutdown()
+	}
+}
+
+/**
+ * Browses the LAN for other peers announcing the _torero._tcp service
+ * @param ctx cancelled when the peer shuts down
+ * @param self this peer's own serving address, left out of the results
+ * @return the serving address of every peer that answered
+ */
+func discover_peers(ctx context.Context, self string) []string {
+	resolver, err := zeroconf.NewResolver()
+	if err != nil {
+		slog.Error("can't browse the LAN", "err", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, MDNS_BROWSE_TIMEOUT)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err = resolver.Browse(ctx, MDNS_SERVICE, MDNS_DOMAIN, entries); err != nil {
+		slog.Error("can't browse the LAN", "err", err)
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var peers []string
+	for {
+		select {
+		case <-ctx.Done():
+			return peers
+		case entry, ok := <-entries:
+			if !ok {
+				return peers
+			}
+			ip := entry_ip(entry)
+			if ip == nil {
+				continue
+			}
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port))
+			if addr != self && !seen[addr] {
+				seen[addr] = true
+				peers = append(peers, addr)
+			}
+		}
+	}
+}
+
+/**
+ * @param entry a peer found on the LAN
+ * @return the address to reach it on: IPv4 if it announced one, otherwise
+ * a routable IPv6 address, nil if it has neither
+ */
+func entry_ip(entry *zeroconf.ServiceEntry) net.IP {
+	if len(entry.AddrIPv4) > 0 {
+		return entry.AddrIPv4[0]
+	}
+	for _, ip := range entry.AddrIPv6 {
+		// link-local addresses need a zone, which mDNS doesn't carry
+		if ip.IsGlobalUnicast() {
+			return ip
+		}
+	}
+	return nil
+}
+
+/**
+ * Asks a peer directly for the songs it serves
+ * @param addr the peer's serving address
+ * @return the peer's songs, each listing only that peer as its source
+ */
+func query_peer(addr string) ([]tsp.SongEntry, error) {
+	conn, err := dial_peer(context.Background(), addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := tsp.NewMsg(tsp.LIST, 0, nil)
+	sign_msg(request, nil)
+	if err = tsp.Encode(conn, request); err != nil {
+		return nil, err
+	}
+	reply, err := tsp.Decode(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err = reply.Err(); err != nil {
+		return nil, err
+	}
+	return tsp.DecodeSongs(reply.Msg)
+}
+
+/**
+ * Builds the master list without a tracker: finds peers over mDNS, in the
+ * DHT's routing table if it is on, and through peer exchange, and asks
+ * each for its songs
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @return the merged song list
+ */
+func discover_master_list(ctx context.Context, args []string) []tsp.SongEntry {
+	peers := discover_peers(ctx, local_addr(args))
+	if config.DHT {
+		peers = append(peers, dht_contacts(peers)...)
+	}
+	peers = append(peers, pex_peers(MAX_PEX_PEERS)...)
+	return query_master_list(peers, local_addr(args))
+}
+
+/**
+ * Asks peers for their songs, all at once, and merges them with this
+ * peer's own the way the tracker would, under the same IDs
+ * @param peers the serving addresses of the peers, duplicates and all
+ * @param self this peer's own serving address, left out
+ * @return the merged song list
+ */
+func query_master_list(peers []string, self string) []tsp.SongEntry {
+	master_mutex.Lock()
+	lists := [][]tsp.SongEntry{local_songs}
+	master_mutex.Unlock()
+
+	asked := map[string]bool{self: true}
+	var mutex sync.Mutex
+	var queries sync.WaitGroup
+	for _, addr := range peers {
+		if asked[addr] {
+			continue
+		}
+		asked[addr] = true
+		queries.Add(1)
+		go func(addr string) {
+			defer queries.Done()
+			songs, err := query_peer(addr)
+			if err != nil {
+				slog.Warn("peer didn't answer", "peer", addr, "err", err)
+				pex_forget(addr)
+				return
+			}
+			pex_learn([]string{addr})
+			mutex.Lock()
+			lists = append(lists, songs)
+			mutex.Unlock()
+		}(addr)
+	}
+	queries.Wait()
+	return merge_song_lists(lists)
+}
+
+/**
+ * Merges song lists from several peers, giving peers serving the same file
+ * one entry with a source per peer, under the ID the tracker would give
+ * it, and flags near-duplicates like the tracker does
+ * @param lists the song list of each peer
+ * @return the merged list, sorted by artist and title
+ */
+func merge_song_lists(lists [][]tsp.SongEntry) []tsp.SongEntry {
+	var merged []tsp.SongEntry
+	for _, songs := range lists {
+		for _, song := range songs {
+			merged = merge_song(merged, song)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Artist != merged[j].Artist {
+			return merged[i].Artist < merged[j].Artist
+		}
+		return merged[i].Title < merged[j].Title
+	})
+	tsp.MarkDuplicates(merged)
+	return merged
+}
+
+func merge_song(merged []tsp.SongEntry, song tsp.SongEntry) []tsp.SongEntry {
+	if len(song.Sources) == 0 {
+		return merged
+	}
+	song.ID = tsp.SongID(song, song.Sources[0])
+	for i := range merged {
+		if merged[i].ID != song.ID {
+			continue
+		}
+		for _, source := range song.Sources {
+			if !has_source(merged[i], source.PeerAddr) {
+				merged[i].Sources = append(merged[i].Sources, source)
+			}
+		}
+		return merged
+	}
+	return append(merged, song)
+}
+
+/**
+ * @return whether the peer at addr is already a source of the song
+ */
+func has_source(song tsp.SongEntry, addr string) bool {
+	for _, s := range song.Sources {
+		if s.PeerAddr == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The library as a UPnP AV MediaServer, for smart TVs, receivers and apps
+ * like BubbleUPnP, served by the HTTP gateway under /dlna and found
+ * through SSDP (see ssdp.go). Its ContentDirectory lays the master list
+ * out as
+ *   Artists / <artist> / <album> / <track>
+ *   Albums / <album> / <track>
+ *   All songs / <track>
+ * and the tracks play from the gateway's /stream. Objects are named like
+ * the Subsonic API's directories (see subsonic.go), songs "song-<id>".
+ * Events aren't sent: subscriptions are taken, and nothing changes under
+ * them but the master list, whose age is the SystemUpdateID
+ */
+
+const (
+	DLNA_DEVICE_TYPE        = "urn:schemas-upnp-org:device:MediaServer:1"
+	DLNA_CONTENT_DIRECTORY  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	DLNA_CONNECTION_MANAGER = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	// how long an event subscription lasts, in seconds
+	DLNA_SUBSCRIPTION = 1800
+)
+
+// the containers above the artists, albums and songs
+const (
+	DLNA_ROOT    = "0"
+	DLNA_ARTISTS = "artists"
+	DLNA_ALBUMS  = "albums"
+	DLNA_SONGS   = "songs"
+)
+
+// UPnP error codes, in a SOAP fault
+const (
+	UPNP_ERR_INVALID_ACTION = 401
+	UPNP_ERR_INVALID_ARGS   = 402
+	UPNP_ERR_NO_SUCH_OBJECT = 701
+)
+
+/**
+ * An argument of an action in a service description
+ */
+type ScpdArgument struct {
+	Name      string `xml:"name"`
+	Direction string `xml:"direction"`
+	Variable  string `xml:"relatedStateVariable"`
+}
+
+/**
+ * An action in a service description
+ */
+type ScpdAction struct {
+	Name      string         `xml:"name"`
+	Arguments []ScpdArgument `xml:"argumentList>argument"`
+}
+
+/**
+ * A state variable in a service description
+ */
+type ScpdVariable struct {
+	SendEvents string   `xml:"sendEvents,attr"`
+	Name       string   `xml:"name"`
+	Type       string   `xml:"dataType"`
+	Allowed    []string `xml:"allowedValueList>allowedValue,omitempty"`
+}
+
+/**
+ * A service description, what a control point reads to know the actions
+ * a service takes
+ */
+type Scpd struct {
+	XMLName   xml.Name       `xml:"urn:schemas-upnp-org:service-1-0 scpd"`
+	Major     int            `xml:"specVersion>major"`
+	Minor     int            `xml:"specVersion>minor"`
+	Actions   []ScpdAction   `xml:"actionList>action"`
+	Variables []ScpdVariable `xml:"serviceStateTable>stateVariable"`
+}
+
+/**
+ * @param name the argument's name
+ * @param variable the state variable it is of the type of
+ * @return an argument passed to the action
+ */
+func arg_in(name string, variable string) ScpdArgument {
+	return ScpdArgument{name, "in", variable}
+}
+
+/**
+ * @param name the argument's name
+ * @param variable the state variable it is of the type of
+ * @return an argument returned by the action
+ */
+func arg_out(name string, variable string) ScpdArgument {
+	return ScpdArgument{name, "out", variable}
+}
+
+var content_directory_scpd = Scpd{
+	Major: 1,
+	Actions: []ScpdAction{
+		{"Browse", []ScpdArgument{
+			arg_in("ObjectID", "A_ARG_TYPE_ObjectID"),
+			arg_in("BrowseFlag", "A_ARG_TYPE_BrowseFlag"),
+			arg_in("Filter", "A_ARG_TYPE_Filter"),
+			arg_in("StartingIndex", "A_ARG_TYPE_Index"),
+			arg_in("RequestedCount", "A_ARG_TYPE_Count"),
+			arg_in("SortCriteria", "A_ARG_TYPE_SortCriteria"),
+			arg_out("Result", "A_ARG_TYPE_Result"),
+			arg_out("NumberReturned", "A_ARG_TYPE_Count"),
+			arg_out("TotalMatches", "A_ARG_TYPE_Count"),
+			arg_out("UpdateID", "A_ARG_TYPE_UpdateID"),
+		}},
+		{"GetSearchCapabilities", []ScpdArgument{arg_out("SearchCaps", "SearchCapabilities")}},
+		{"GetSortCapabilities", []ScpdArgument{arg_out("SortCaps", "SortCapabilities")}},
+		{"GetSystemUpdateID", []ScpdArgument{arg_out("Id", "SystemUpdateID")}},
+	},
+	Variables: []ScpdVariable{
+		{"no", "A_ARG_TYPE_ObjectID", "string", nil},
+		{"no", "A_ARG_TYPE_BrowseFlag", "string", []string{"BrowseMetadata", "BrowseDirectChildren"}},
+		{"no", "A_ARG_TYPE_Filter", "string", nil},
+		{"no", "A_ARG_TYPE_Index", "ui4", nil},
+		{"no", "A_ARG_TYPE_Count", "ui4", nil},
+		{"no", "A_ARG_TYPE_SortCriteria", "string", nil},
+		{"no", "A_ARG_TYPE_Result", "string", nil},
+		{"no", "A_ARG_TYPE_UpdateID", "ui4", nil},
+		{"no", "SearchCapabilities", "string", nil},
+		{"no", "SortCapabilities", "string", nil},
+		{"yes", "SystemUpdateID", "ui4", nil},
+	},
+}
+
+var connection_manager_scpd = Scpd{
+	Major: 1,
+	Actions: []ScpdAction{
+		{"GetProtocolInfo", []ScpdArgument{
+			arg_out("Source", "SourceProtocolInfo"),
+			arg_out("Sink", "SinkProtocolInfo"),
+		}},
+		{"GetCurrentConnectionIDs", []ScpdArgument{arg_out("ConnectionIDs", "CurrentConnectionIDs")}},
+		{"GetCurrentConnectionInfo", []ScpdArgument{
+			arg_in("ConnectionID", "A_ARG_TYPE_ConnectionID"),
+			arg_out("RcsID", "A_ARG_TYPE_RcsID"),
+			arg_out("AVTransportID", "A_ARG_TYPE_AVTransportID"),
+			arg_out("ProtocolInfo", "A_ARG_TYPE_ProtocolInfo"),
+			arg_out("PeerConnectionManager", "A_ARG_TYPE_ConnectionManager"),
+			arg_out("PeerConnectionID", "A_ARG_TYPE_ConnectionID"),
+			arg_out("Direction", "A_ARG_TYPE_Direction"),
+			arg_out("Status", "A_ARG_TYPE_ConnectionStatus"),
+		}},
+	},
+	Variables: []ScpdVariable{
+		{"yes", "SourceProtocolInfo", "string", nil},
+		{"yes", "SinkProtocolInfo", "string", nil},
+		{"yes", "CurrentConnectionIDs", "string", nil},
+		{"no", "A_ARG_TYPE_ConnectionStatus", "string", []string{"OK", "ContentFormatMismatch", "InsufficientBandwidth", "UnreliableChannel", "Unknown"}},
+		{"no", "A_ARG_TYPE_ConnectionManager", "string", nil},
+		{"no", "A_ARG_TYPE_Direction", "string", []string{"Input", "Output"}},
+		{"no", "A_ARG_TYPE_ProtocolInfo", "string", nil},
+		{"no", "A_ARG_TYPE_ConnectionID", "i4", nil},
+		{"no", "A_ARG_TYPE_AVTransportID", "i4", nil},
+		{"no", "A_ARG_TYPE_RcsID", "i4", nil},
+	},
+}
+
+/**
+ * @return the media server's UUID, the same every time this host serves
+ * the gateway on the same address
+ */
+func dlna_uuid() string {
+	host, _ := os.Hostname()
+	sum := md5.Sum([]byte("torero media server " + host + " " + http_flag))
+	id := hex.EncodeToString(sum[:])
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
+}
+
+/**
+ * @return what the media server is called on TVs and in apps
+ */
+func dlna_name() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "Torero"
+	}
+	return "Torero on " + host
+}
+
+/**
+ * Answers a request to /dlna: the device and service descriptions, the
+ * services' control URLs, event subscriptions and album art
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func serve_dlna(ctx context.Context, args []string, w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/dlna/device.xml":
+		write_device_description(w)
+	case "/dlna/ContentDirectory.xml":
+		write_scpd(w, content_directory_scpd)
+	case "/dlna/ConnectionManager.xml":
+		write_scpd(w, connection_manager_scpd)
+	case "/dlna/ContentDirectory/control":
+		content_directory_control(ctx, args, w, r)
+	case "/dlna/ConnectionManager/control":
+		connection_manager_control(w, r)
+	case "/dlna/ContentDirectory/event", "/dlna/ConnectionManager/event":
+		// subscriptions are taken, though no event is ever sent
+		if r.Method == "SUBSCRIBE" {
+			w.Header().Set("SID", "uuid:"+dlna_uuid())
+			w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(DLNA_SUBSCRIPTION))
+		}
+	default:
+		if !strings.HasPrefix(r.URL.Path, "/dlna/art/") {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		song, ok := find_song(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		art, _, err := song_art(song)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", art.MIME)
+		w.Write(art.Data)
+	}
+}
+
+/**
+ * Answers with the device description, the root of everything a control
+ * point learns about the media server
+ * @param w the response
+ */
+func write_device_description(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>%s</deviceType>
+<friendlyName>%s</friendlyName>
+<manufacturer>Torero</manufacturer>
+<manufacturerURL>https://github.com/jamesponwith/Torero-Streaming-Service</manufacturerURL>
+<modelName>Torero peer</modelName>
+<modelNumber>1</modelNumber>
+<UDN>uuid:%s</UDN>
+<serviceList>
+<service>
+<serviceType>%s</serviceType>
+<serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+<SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+<controlURL>/dlna/ContentDirectory/control</controlURL>
+<eventSubURL>/dlna/ContentDirectory/event</eventSubURL>
+</service>
+<service>
+<serviceType>%s</serviceType>
+<serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+<SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+<controlURL>/dlna/ConnectionManager/control</controlURL>
+<eventSubURL>/dlna/ConnectionManager/event</eventSubURL>
+</service>
+</serviceList>
+</device>
+</root>
+`, DLNA_DEVICE_TYPE, xml_escape(dlna_name()), dlna_uuid(), DLNA_CONTENT_DIRECTORY, DLNA_CONNECTION_MANAGER)
+}
+
+/**
+ * Answers with a service description
+ * @param w the response
+ * @param scpd the service's actions and state variables
+ */
+func write_scpd(w http.ResponseWriter, scpd Scpd) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(scpd)
+}
+
+/**
+ * @param s text
+ * @return it escaped for XML
+ */
+func xml_escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+/**
+ * Reads a SOAP action call
+ * @param r the request
+ * @return the action's name and its arguments, and false if it isn't one
+ */
+func read_soap(r *http.Request) (string, map[string]string, bool) {
+	decoder := xml.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	action := ""
+	soap_args := make(map[string]string)
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			// Envelope, Body, the action, then its arguments
+			if depth == 3 {
+				action = t.Name.Local
+			} else if depth == 4 {
+				var value string
+				if decoder.DecodeElement(&value, &t) == nil {
+					soap_args[t.Name.Local] = value
+				}
+				depth--
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return action, soap_args, action != ""
+}
+
+/**
+ * Answers a SOAP action call
+ * @param w the response
+ * @param service the service's type
+ * @param action the action called
+ * @param results the action's results, names and values in turn
+ */
+func write_soap(w http.ResponseWriter, service string, action string, results ...string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for i := 0; i+1 < len(results); i += 2 {
+		fmt.Fprintf(&b, "<%s>%s</%s>", results[i], xml_escape(results[i+1]), results[i])
+	}
+	fmt.Fprintf(&b, "</u:%sResponse></s:Body></s:Envelope>", action)
+	io.WriteString(w, b.String())
+}
+
+/**
+ * Answers a SOAP action call with a UPnP error
+ * @param w the response
+ * @param code one of the UPNP_ERR_ codes
+ * @param description what went wrong
+ */
+func write_soap_fault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, code, xml_escape(description))
+}
+
+/**
+ * Answers a call to the ConnectionManager: the formats songs are served
+ * in, and the one connection there always is
+ * @param w the response
+ * @param r the request
+ */
+func connection_manager_control(w http.ResponseWriter, r *http.Request) {
+	action, _, ok := read_soap(r)
+	if !ok {
+		write_soap_fault(w, UPNP_ERR_INVALID_ACTION, "not a SOAP action")
+		return
+	}
+	switch action {
+	case "GetProtocolInfo":
+		var formats []string
+		for _, format := range []string{tsp.FORMAT_MP3, tsp.FORMAT_FLAC, tsp.FORMAT_VORBIS, tsp.FORMAT_OPUS} {
+			formats = append(formats, dlna_protocol_info(format))
+		}
+		write_soap(w, DLNA_CONNECTION_MANAGER, action, "Source", strings.Join(formats, ","), "Sink", "")
+	case "GetCurrentConnectionIDs":
+		write_soap(w, DLNA_CONNECTION_MANAGER, action, "ConnectionIDs", "0")
+	case "GetCurrentConnectionInfo":
+		write_soap(w, DLNA_CONNECTION_MANAGER, action, "RcsID", "-1", "AVTransportID", "-1",
+			"ProtocolInfo", "", "PeerConnectionManager", "", "PeerConnectionID", "-1",
+			"Direction", "Output", "Status", "OK")
+	default:
+		write_soap_fault(w, UPNP_ERR_INVALID_ACTION, "no action "+action)
+	}
+}
+
+/**
+ * @param format one of the tsp.FORMAT_ constants
+ * @return the protocolInfo songs in that format are served with
+ */
+func dlna_protocol_info(format string) string {
+	info := "http-get:*:" + mime_type(format) + ":"
+	if format == tsp.FORMAT_MP3 {
+		info += "DLNA.ORG_PN=MP3;"
+	}
+	// byte seeks are taken
+	return info + "DLNA.ORG_OP=01"
+}
+
+/**
+ * Answers a call to the ContentDirectory
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param w the response
+ * @param r the request
+ */
+func content_directory_control(ctx context.Context, args []string, w http.ResponseWriter, r *http.Request) {
+	action, soap_args, ok := read_soap(r)
+	if !ok {
+		write_soap_fault(w, UPNP_ERR_INVALID_ACTION, "not a SOAP action")
+		return
+	}
+	switch action {
+	case "GetSearchCapabilities":
+		write_soap(w, DLNA_CONTENT_DIRECTORY, action, "SearchCaps", "")
+		return
+	case "GetSortCapabilities":
+		write_soap(w, DLNA_CONTENT_DIRECTORY, action, "SortCaps", "")
+		return
+	case "GetSystemUpdateID", "Browse":
+	default:
+		write_soap_fault(w, UPNP_ERR_INVALID_ACTION, "no action "+action)
+		return
+	}
+
+	songs, age, err := current_list(ctx, args)
+	if err != nil {
+		write_soap_fault(w, UPNP_ERR_NO_SUCH_OBJECT, "can't get the song list: "+err.Error())
+		return
+	}
+	// changes whenever the master list is fetched again
+	update_id := strconv.FormatInt(time.Now().Add(-age).Unix()&0xFFFFFFFF, 10)
+	if action == "GetSystemUpdateID" {
+		write_soap(w, DLNA_CONTENT_DIRECTORY, action, "Id", update_id)
+		return
+	}
+
+	start, err := strconv.Atoi(soap_args["StartingIndex"])
+	if err != nil || start < 0 {
+		start = 0
+	}
+	count, err := strconv.Atoi(soap_args["RequestedCount"])
+	if err != nil || count < 0 {
+		count = 0
+	}
+	songs, _ = hide_duplicates(songs)
+	base := "http://" + r.Host
+	var didl DIDL
+	var total int
+	switch soap_args["BrowseFlag"] {
+	case "BrowseMetadata":
+		ok = dlna_metadata(&didl, songs, soap_args["ObjectID"], base)
+		total = 1
+	case "BrowseDirectChildren":
+		total, ok = dlna_children(&didl, songs, soap_args["ObjectID"], base, start, count)
+	default:
+		write_soap_fault(w, UPNP_ERR_INVALID_ARGS, "BrowseFlag must be BrowseMetadata or BrowseDirectChildren")
+		return
+	}
+	if !ok {
+		write_soap_fault(w, UPNP_ERR_NO_SUCH_OBJECT, "no object "+soap_args["ObjectID"])
+		return
+	}
+	write_soap(w, DLNA_CONTENT_DIRECTORY, action, "Result", didl.String(),
+		"NumberReturned", strconv.Itoa(didl.count), "TotalMatches", strconv.Itoa(total),
+		"UpdateID", update_id)
+}
+
+/**
+ * A DIDL-Lite document being written, the Result of a Browse
+ */
+type DIDL struct {
+	body  strings.Builder
+	count int
+}
+
+/**
+ * Adds a container
+ * @param id its object ID
+ * @param parent its parent's
+ * @param title what it is called
+ * @param children how many objects are in it
+ * @param class its upnp:class
+ */
+func (d *DIDL) Container(id string, parent string, title string, children int, class string) {
+	fmt.Fprintf(&d.body, `<container id="%s" parentID="%s" restricted="1" childCount="%d">`+
+		`<dc:title>%s</dc:title><upnp:class>%s</upnp:class></container>`,
+		xml_escape(id), xml_escape(parent), children, xml_escape(title), class)
+	d.count++
+}
+
+/**
+ * Adds a song
+ * @param song the song
+ * @param parent the container it is listed in
+ * @param base the gateway's URL, as the control point reached it
+ */
+func (d *DIDL) Song(song tsp.SongEntry, parent string, base string) {
+	format := tsp.FORMAT_MP3
+	var size int64
+	if len(song.Sources) > 0 {
+		size = song.Sources[0].Size
+		if song.Sources[0].Format != "" {
+			format = song.Sources[0].Format
+		}
+	}
+	fmt.Fprintf(&d.body, `<item id="song-%d" parentID="%s" restricted="1">`, song.ID, xml_escape(parent))
+	fmt.Fprintf(&d.body, "<dc:title>%s</dc:title><dc:creator>%s</dc:creator><upnp:artist>%s</upnp:artist>",
+		xml_escape(song.Title), xml_escape(song.Artist), xml_escape(song.Artist))
+	if song.Album != "" {
+		fmt.Fprintf(&d.body, "<upnp:album>%s</upnp:album>", xml_escape(song.Album))
+	}
+	if song.Genre != "" {
+		fmt.Fprintf(&d.body, "<upnp:genre>%s</upnp:genre>", xml_escape(song.Genre))
+	}
+	if song.Track > 0 {
+		fmt.Fprintf(&d.body, "<upnp:originalTrackNumber>%d</upnp:originalTrackNumber>", song.Track)
+	}
+	fmt.Fprintf(&d.body, "<upnp:albumArtURI>%s/dlna/art/%d</upnp:albumArtURI>", base, song.ID)
+	d.body.WriteString("<upnp:class>object.item.audioItem.musicTrack</upnp:class>")
+	fmt.Fprintf(&d.body, `<res protocolInfo="%s"`, dlna_protocol_info(format))
+	if size > 0 {
+		fmt.Fprintf(&d.body, ` size="%d"`, size)
+	}
+	if song.Duration > 0 {
+		fmt.Fprintf(&d.body, ` duration="%s"`, dlna_duration(song.Duration))
+	}
+	fmt.Fprintf(&d.body, ">%s%s</res></item>", base, stream_path(song.ID, format))
+	d.count++
+}
+
+/**
+ * @return the DIDL-Lite document
+ */
+func (d *DIDL) String() string {
+	return `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"` +
+		` xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		d.body.String() + "</DIDL-Lite>"
+}
+
+/**
+ * @param d a song's length
+ * @return it as DIDL-Lite writes durations, H:MM:SS.mmm
+ */
+func dlna_duration(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+/**
+ * Adds the object itself, for BrowseMetadata
+ * @param didl where it is added
+ * @param songs the master list, less near-duplicates
+ * @param id the object's ID
+ * @param base the gateway's URL
+ * @return false if there is no such object
+ */
+func dlna_metadata(didl *DIDL, songs []tsp.SongEntry, id string, base string) bool {
+	switch id {
+	case DLNA_ROOT:
+		didl.Container(DLNA_ROOT, "-1", dlna_name(), 3, "object.container")
+		return true
+	case DLNA_ARTISTS:
+		didl.Container(id, DLNA_ROOT, "Artists", len(group_songs(songs, artist_name)), "object.container")
+		return true
+	case DLNA_ALBUMS:
+		didl.Container(id, DLNA_ROOT, "Albums", len(subsonic_albums(songs)), "object.container")
+		return true
+	case DLNA_SONGS:
+		didl.Container(id, DLNA_ROOT, "All songs", len(songs), "object.container")
+		return true
+	}
+	if strings.HasPrefix(id, "song-") {
+		song_id, err := strconv.Atoi(strings.TrimPrefix(id, "song-"))
+		if err != nil {
+			return false
+		}
+		for _, song := range songs {
+			if song.ID == song_id {
+				didl.Song(song, subsonic_id("al", song.Artist, album_name(song)), base)
+				return true
+			}
+		}
+		return false
+	}
+	for _, artist := range group_songs(songs, artist_name) {
+		if subsonic_id("ar", artist.Name) == id {
+			didl.Container(id, DLNA_ARTISTS, artist.Name, len(group_songs(artist.Songs, album_name)),
+				"object.container.person.musicArtist")
+			return true
+		}
+	}
+	for _, album := range subsonic_albums(songs) {
+		if album.ID == id {
+			didl.Container(id, subsonic_id("ar", album.Artist.Name), album.Name, len(album.Songs),
+				"object.container.album.musicAlbum")
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Adds a page of the objects in a container, for BrowseDirectChildren
+ * @param didl where they are added
+ * @param songs the master list, less near-duplicates
+ * @param id the container's ID
+ * @param base the gateway's URL
+ * @param start the first object wanted
+ * @param count how many are wanted, 0 for all of them
+ * @return how many objects are in the container, and false if there is
+ * no such container
+ */
+func dlna_children(didl *DIDL, songs []tsp.SongEntry, id string, base string, start int, count int) (int, bool) {
+	// whether the object at index i is on the page asked for
+	wanted := func(i int) bool {
+		return i >= start && (count == 0 || i < start+count)
+	}
+	switch id {
+	case DLNA_ROOT:
+		containers := []struct {
+			id    string
+			title string
+			n     int
+		}{
+			{DLNA_ARTISTS, "Artists", len(group_songs(songs, artist_name))},
+			{DLNA_ALBUMS, "Albums", len(subsonic_albums(songs))},
+			{DLNA_SONGS, "All songs", len(songs)},
+		}
+		for i, c := range containers {
+			if wanted(i) {
+				didl.Container(c.id, DLNA_ROOT, c.title, c.n, "object.container")
+			}
+		}
+		return len(containers), true
+	case DLNA_ARTISTS:
+		artists := group_songs(songs, artist_name)
+		for i, artist := range artists {
+			if wanted(i) {
+				didl.Container(subsonic_id("ar", artist.Name), id, artist.Name,
+					len(group_songs(artist.Songs, album_name)), "object.container.person.musicArtist")
+			}
+		}
+		return len(artists), true
+	case DLNA_ALBUMS:
+		albums := subsonic_albums(songs)
+		for i, album := range albums {
+			if wanted(i) {
+				didl.Container(album.ID, id, album.Name, len(album.Songs), "object.container.album.musicAlbum")
+			}
+		}
+		return len(albums), true
+	case DLNA_SONGS:
+		sorted := sort_songs(songs, SORT_TITLE)
+		for i, song := range sorted {
+			if wanted(i) {
+				didl.Song(song, id, base)
+			}
+		}
+		return len(sorted), true
+	}
+	for _, artist := range group_songs(songs, artist_name) {
+		if subsonic_id("ar", artist.Name) != id {
+			continue
+		}
+		albums := subsonic_albums(artist.Songs)
+		for i, album := range albums {
+			if wanted(i) {
+				didl.Container(album.ID, id, album.Name, len(album.Songs), "object.container.album.musicAlbum")
+			}
+		}
+		return len(albums), true
+	}
+	for _, album := range subsonic_albums(songs) {
+		if album.ID != id {
+			continue
+		}
+		for i, song := range album.Songs {
+			if wanted(i) {
+				didl.Song(song, id, base)
+			}
+		}
+		return len(album.Songs), true
+	}
+	slog.Debug("browse of an unknown object", "id", id)
+	return 0, false
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+// how often the download progress line is redrawn
+const PROGRESS_INTERVAL = 200 * time.Millisecond
+
+/**
+ * Counts bytes written through it and redraws a progress line
+ */
+type Progress struct {
+	label   string
+	total   int64
+	written int64
+	drawn   time.Time
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.drawn) >= PROGRESS_INTERVAL {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+func (p *Progress) draw() {
+	p.drawn = time.Now()
+	if p.total > 0 {
+		fmt.Printf("\r%s: %3d%% (%.1f / %.1f MB)", p.label, p.written*100/p.total,
+			float64(p.written)/1e6, float64(p.total)/1e6)
+	} else {
+		fmt.Printf("\r%s: %.1f MB", p.label, float64(p.written)/1e6)
+	}
+}
+
+/**
+ * Downloads a song into the downloads directory, and tells the tracker it
+ * was downloaded
+ * @param song the master list entry of the song
+ * @return an error if no peer could be reached, or the file is incomplete
+ * or corrupted
+ */
+func download_song(song tsp.SongEntry) error {
+	report_play(song)
+	path, err := download_to(dht_sources(song), config.Downloads)
+	if err == nil {
+		run_hook(HOOK_DOWNLOAD_COMPLETE, append(song_env(song, ""), "TORERO_FILE="+path))
+	}
+	return err
+}
+
+/**
+ * Downloads a song into a directory, under the filename from the master
+ * list (see download_name), never overwriting a file: in pieces from
+ * several peers at once if more than one serves an identical file (see
+ * swarm.go), otherwise from the first reachable peer serving it. The file
+ * is written to a .part file and only renamed into place once every byte
+ * the peer advertised has arrived and matches the advertised hash. A
+ * transfer that drops is resumed from the same peer or another serving an
+ * identical file, and a .part file left by an earlier attempt is continued
+ * rather than started again
+ * @param song the master list entry of the song
+ * @param dir the directory to save it in
+ * @return the saved file; an error if no peer could be reached, or the
+ * file is incomplete or corrupted
+ */
+func download_to(song tsp.SongEntry, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if sources := swarm_sources(song); sources != nil {
+		hashes, err := fetch_piece_hashes(song, sources)
+		if err == nil {
+			return download_swarm(song, sources, hashes, dir)
+		}
+		slog.Info("can't get piece hashes, downloading from one peer", "err", err)
+	}
+	part, written := partial_download(song, dir)
+
+	msg := tsp.NewMsg(tsp.PLAY, song.ID, nil)
+	msg.Header.Offset = written
+	peer, source, err := send_to_source(*msg, song)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, download_name(song, source))
+	if part == "" {
+		part = dest + ".part"
+	}
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		peer.Close()
+		return "", err
+	}
+
+	// hash what an earlier attempt left, leaving the file positioned at its end
+	hash := sha256.New()
+	if _, err = io.CopyN(hash, file, written); err != nil {
+		peer.Close()
+		file.Close()
+		return "", err
+	}
+
+	progress := &Progress{label: "Downloading " + song.Title, total: source.Size, written: written}
+	out := io.MultiWriter(file, hash, progress)
+	for resumes := 0; ; resumes++ {
+		var n int64
+		n, err = io.Copy(out, peer)
+		peer.Close()
+		written += n
+		if source.Size <= 0 || written >= source.Size || resumes == MAX_RESUMES {
+			break
+		}
+
+		fmt.Println("\ntransfer from " + source.PeerAddr + " dropped, resuming")
+		msg.Header.Offset = written
+		var next tsp.SongSource
+		peer, next, err = send_to_source(*msg, resume_sources(song, source))
+		if err != nil {
+			break
+		}
+		source = next
+	}
+	progress.draw()
+	fmt.Println()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if source.Size > 0 && written > source.Size {
+		// a stale .part from a different file
+		os.Remove(part)
+	}
+	if err == nil && source.Size > 0 && written != source.Size {
+		err = fmt.Errorf("received %d of %d bytes from %s", written, source.Size, source.PeerAddr)
+	}
+	if err == nil && written == 0 {
+		err = fmt.Errorf("%s sent no data", source.PeerAddr)
+	}
+	if err != nil {
+		// keep what arrived so the next attempt can carry on from it
+		return "", err
+	}
+	if source.Hash != "" && hex.EncodeToString(hash.Sum(nil)) != source.Hash {
+		os.Remove(part)
+		return "", fmt.Errorf("%s sent a corrupted file (hash mismatch)", source.PeerAddr)
+	}
+	dest = free_path(dest)
+	if err = os.Rename(part, dest); err != nil {
+		return "", err
+	}
+	fmt.Println("Saved to " + dest)
+	return dest, nil
+}
+
+/**
+ * @param song the master list entry of the song
+ * @param source a peer serving it
+ * @return the name to save the song under: the last part of the peer's
+ * filename, or if that names no file, the file's hash (or the song's ID
+ * without one) and its format
+ */
+func download_name(song tsp.SongEntry, source tsp.SongSource) string {
+	name := source.Filename[strings.LastIndexAny(source.Filename, `/\`)+1:]
+	if name != "" && name != "." && name != ".." {
+		return name
+	}
+	format := source.Format
+	if format == "" || !tsp.ValidFormat(format) {
+		format = tsp.FORMAT_MP3
+	}
+	if tsp.ValidHash(source.Hash) {
+		return source.Hash + "." + format
+	}
+	return strconv.Itoa(song.ID) + "." + format
+}
+
+/**
+ * @param dest where a download is to be saved
+ * @return dest, or if a file is already there, the first of
+ * "name (2).ext", "name (3).ext", ... that is free, so a download never
+ * overwrites a file
+ */
+func free_path(dest string) string {
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			return dest
+		}
+		dest = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+/**
+ * Looks for a .part file left by an interrupted download of the song
+ * @param song the master list entry of the song
+ * @param dir the directory the song is being saved in
+ * @return the .part file and its size, or "" and 0 if there is none
+ */
+func partial_download(song tsp.SongEntry, dir string) (string, int64) {
+	for _, source := range song.Sources {
+		part := filepath.Join(dir, download_name(song, source)) + ".part"
+		stat, err := os.Stat(part)
+		if err == nil && stat.Mode().IsRegular() && stat.Size() > 0 {
+			return part, stat.Size()
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * The equalizer, a DSP stage between the decoder and the audio output.
+ * Each of its ten bands is a peaking filter that raises or lowers the
+ * frequencies around its center by up to MAX_EQ_GAIN dB. The bands are
+ * set from a preset or one at a time, and every song playing picks up a
+ * change from its next chunk, so the sound changes without playback
+ * stopping
+ */
+
+const (
+	EQ_BANDS = 10
+	// most a band can raise or lower its frequencies, in dB
+	MAX_EQ_GAIN = 12.0
+	// how wide each band is: about an octave
+	EQ_Q = 1.41
+	// the bands of a user's own settings, not a preset
+	EQ_CUSTOM = "custom"
+)
+
+// the center frequency of each band, in Hz, and how it is typed
+var eq_freqs = [EQ_BANDS]float64{31, 62, 125, 250, 500, 1000, 2000, 4000, 8000, 16000}
+var eq_labels = [EQ_BANDS]string{"31", "62", "125", "250", "500", "1k", "2k", "4k", "8k", "16k"}
+
+// the gain of each band, in dB, of each preset
+var eq_presets = map[string][EQ_BANDS]float64{
+	"flat":       {},
+	"rock":       {5, 4, 3, 1, -1, -1, 1, 3, 4, 5},
+	"classical":  {4, 3, 2, 1, 0, 0, 0, 1, 2, 3},
+	"bass boost": {8, 7, 5, 3, 1, 0, 0, 0, 0, 0},
+}
+
+/**
+ * The equalizer's settings, shared by every song playing. Version goes up
+ * with every change so filters know to pick it up
+ */
+type Equalizer struct {
+	mutex   sync.Mutex
+	gains   [EQ_BANDS]float64
+	preset  string
+	version uint64
+}
+
+var equalizer = &Equalizer{preset: "flat"}
+
+/**
+ * @return the names of the presets, sorted
+ */
+func eq_preset_names() []string {
+	names := make([]string, 0, len(eq_presets))
+	for name := range eq_presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+ * Sets every band from a preset
+ * @param name the preset, e.g. "rock"
+ * @return an error if there is no such preset
+ */
+func (eq *Equalizer) SetPreset(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	gains, ok := eq_presets[name]
+	if !ok {
+		return fmt.Errorf("no preset %q, try %s", name, strings.Join(eq_preset_names(), ", "))
+	}
+	eq.mutex.Lock()
+	eq.gains, eq.preset = gains, name
+	eq.version++
+	eq.mutex.Unlock()
+	return nil
+}
+
+/**
+ * Sets one band, leaving the others as they are
+ * @param band which band, 0 to EQ_BANDS-1
+ * @param gain its gain in dB, clamped to +-MAX_EQ_GAIN
+ */
+func (eq *Equalizer) SetBand(band int, gain float64) {
+	gain = math.Max(-MAX_EQ_GAIN, math.Min(MAX_EQ_GAIN, gain))
+	eq.mutex.Lock()
+	eq.gains[band] = gain
+	eq.preset = EQ_CUSTOM
+	eq.version++
+	eq.mutex.Unlock()
+}
+
+/**
+ * @return the gain of each band, the preset they are from (or
+ * EQ_CUSTOM), and the version of the settings
+ */
+func (eq *Equalizer) Settings() ([EQ_BANDS]float64, string, uint64) {
+	eq.mutex.Lock()
+	defer eq.mutex.Unlock()
+	return eq.gains, eq.preset, eq.version
+}
+
+/**
+ * Sets the equalizer from the config file: a preset, or bands of the
+ * user's own
+ */
+func load_eq() {
+	if config.EQPreset == EQ_CUSTOM && len(config.EQBands) == EQ_BANDS {
+		for band, gain := range config.EQBands {
+			equalizer.SetBand(band, gain)
+		}
+		return
+	}
+	if config.EQPreset != "" && equalizer.SetPreset(config.EQPreset) != nil {
+		slog.Warn("unknown equalizer preset in the config file", "preset", config.EQPreset)
+	}
+}
+
+/**
+ * Remembers the equalizer's settings in the config file
+ */
+func save_eq() {
+	gains, preset, _ := equalizer.Settings()
+	config.EQPreset = preset
+	config.EQBands = nil
+	if preset == EQ_CUSTOM {
+		config.EQBands = gains[:]
+	}
+	if err := save_config(); err != nil {
+		slog.Error("can't save equalizer", "err", err)
+	}
+}
+
+/**
+ * @return the equalizer's settings as shown to the user, e.g.
+ * "EQ rock: 31Hz +5 62Hz +4 ..."
+ */
+func format_eq() string {
+	gains, preset, _ := equalizer.Settings()
+	bands := make([]string, EQ_BANDS)
+	for band, gain := range gains {
+		bands[band] = fmt.Sprintf("%sHz %+g", eq_labels[band], gain)
+	}
+	return "EQ " + preset + ": " + strings.Join(bands, " ")
+}
+
+/**
+ * @param arg a band as typed: its label, e.g. "1k", or its frequency in Hz
+ * @return the band, or an error if there is none at that frequency
+ */
+func parse_band(arg string) (int, error) {
+	arg = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(arg)), "hz")
+	for band, label := range eq_labels {
+		if arg == label || arg == strconv.Itoa(int(eq_freqs[band])) {
+			return band, nil
+		}
+	}
+	return 0, fmt.Errorf("bands are %s Hz", strings.Join(eq_labels[:], ", "))
+}
+
+/**
+ * @param arg a band's gain as typed, in dB
+ * @return the gain, or an error if it isn't within +-MAX_EQ_GAIN
+ */
+func parse_eq_gain(arg string) (float64, error) {
+	gain, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(arg), "dB"), 64)
+	if err != nil || math.Abs(gain) > MAX_EQ_GAIN {
+		return 0, fmt.Errorf("a band's gain must be -%g to %g dB", MAX_EQ_GAIN, MAX_EQ_GAIN)
+	}
+	return gain, nil
+}
+
+/**
+ * Changes the equalizer as an EQ command asks and remembers it in the
+ * config file
+ * @param args a preset name, possibly several words, or a band and its
+ * gain; none leaves it as it is
+ * @return an error if args are neither
+ */
+func set_eq(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if band, err := parse_band(args[0]); err == nil && len(args) == 2 {
+		gain, err := parse_eq_gain(args[1])
+		if err != nil {
+			return err
+		}
+		equalizer.SetBand(band, gain)
+	} else if err := equalizer.SetPreset(strings.Join(args, " ")); err != nil {
+		return err
+	}
+	save_eq()
+	return nil
+}
+
+/**
+ * One band's filter coefficients, normalized so a0 is 1
+ */
+type Biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+/**
+ * What a band's filter remembers of one channel: its last two inputs and
+ * outputs
+ */
+type BiquadState struct {
+	x1, x2, y1, y2 float64
+}
+
+/**
+ * The equalizer as applied to one song: the filters for its sample rate,
+ * and their state, which carries across chunks
+ */
+type EQFilter struct {
+	sample_rate int
+	version     uint64
+	flat        bool
+	bands       [EQ_BANDS]Biquad
+	// by band, then channel
+	state [EQ_BANDS][2]BiquadState
+}
+
+/**
+ * @param sample_rate the song's sample rate, of stereo 16 bit PCM
+ * @return a filter set up from the equalizer's current settings
+ */
+func NewEQFilter(sample_rate int) *EQFilter {
+	f := &EQFilter{sample_rate: sample_rate}
+	gains, _, version := equalizer.Settings()
+	f.update(gains, version)
+	return f
+}
+
+/**
+ * Works out the filters for new settings, keeping their state so the
+ * change doesn't click
+ * @param gains the gain of each band, in dB
+ * @param version the version of the settings
+ */
+func (f *EQFilter) update(gains [EQ_BANDS]float64, version uint64) {
+	f.version = version
+	f.flat = true
+	for band, gain := range gains {
+		freq := eq_freqs[band]
+		if gain == 0 || freq >= float64(f.sample_rate)/2 {
+			// passes everything through as it is
+			f.bands[band] = Biquad{b0: 1}
+			continue
+		}
+		f.flat = false
+		// a peaking filter, from the Audio EQ Cookbook
+		a := math.Pow(10, gain/40)
+		w0 := 2 * math.Pi * freq / float64(f.sample_rate)
+		alpha := math.Sin(w0) / (2 * EQ_Q)
+		a0 := 1 + alpha/a
+		f.bands[band] = Biquad{
+			b0: (1 + alpha*a) / a0,
+			b1: -2 * math.Cos(w0) / a0,
+			b2: (1 - alpha*a) / a0,
+			a1: -2 * math.Cos(w0) / a0,
+			a2: (1 - alpha/a) / a0,
+		}
+	}
+	if f.flat {
+		f.state = [EQ_BANDS][2]BiquadState{}
+	}
+}
+
+/**
+ * Equalizes 16 bit little-endian stereo PCM in place, picking up any
+ * change to the equalizer first, and clipping samples that overflow
+ * @param pcm the decoded audio, following on from the last call
+ */
+func (f *EQFilter) Process(pcm []byte) {
+	if gains, _, version := equalizer.Settings(); version != f.version {
+		f.update(gains, version)
+	}
+	if f.flat {
+		return
+	}
+	for i := 0; i+1 < len(pcm); i += 2 {
+		channel := (i / 2) % 2
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		for band := range f.bands {
+			b, s := &f.bands[band], &f.state[band][channel]
+			out := b.b0*sample + b.b1*s.x1 + b.b2*s.x2 - b.a1*s.y1 - b.a2*s.y2
+			s.x2, s.x1 = s.x1, sample
+			s.y2, s.y1 = s.y1, out
+			sample = out
+		}
+		sample = math.Max(math.MinInt16, math.Min(math.MaxInt16, sample))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(sample)))
+	}
+}
+
+/**
+ * EQ from the interactive menu: picks a preset, or a band and its gain
+ */
+func handle_eq() {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	fmt.Println(format_eq())
+	choice, _ := ui.Select("Preset", append(eq_preset_names(), "one band"), &input.Options{
+		Loop: true,
+	})
+	if choice != "one band" {
+		set_eq(strings.Fields(choice))
+		fmt.Println(format_eq())
+		return
+	}
+	label, _ := ui.Select("Band (Hz)", eq_labels[:], &input.Options{
+		Loop: true,
+	})
+	band, _ := parse_band(label)
+	gains, _, _ := equalizer.Settings()
+	arg, _ := ui.Ask(fmt.Sprintf("Gain (-%g to %g dB, now %+g)", MAX_EQ_GAIN, MAX_EQ_GAIN, gains[band]), &input.Options{
+		Loop: true,
+		ValidateFunc: func(arg string) error {
+			_, err := parse_eq_gain(arg)
+			return err
+		},
+	})
+	set_eq([]string{label, arg})
+	fmt.Println(format_eq())
+}
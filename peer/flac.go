@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+/**
+ * Reads the STREAMINFO and Vorbis comment blocks of a FLAC file
+ * @param file the FLAC file, positioned at its start
+ * @param info filled in with the title, artist, album, year and duration
+ * @return an error if the file isn't valid FLAC
+ */
+func read_flac_info(file io.Reader, info *SongInfo) error {
+	stream, err := flac.Parse(file)
+	if err != nil {
+		return err
+	}
+	if stream.Info.SampleRate > 0 {
+		info.Duration = time.Duration(stream.Info.NSamples) * time.Second / time.Duration(stream.Info.SampleRate)
+	}
+	for _, block := range stream.Blocks {
+		comment, ok := block.Body.(*meta.VorbisComment)
+		if !ok {
+			continue
+		}
+		for _, tag := range comment.Tags {
+			switch strings.ToUpper(tag[0]) {
+			case "TITLE":
+				info.Title = tag[1]
+			case "ARTIST":
+				info.Artist = tag[1]
+			case "ALBUM":
+				info.Album = tag[1]
+			case "GENRE":
+				info.Genre = tag[1]
+			case "DATE":
+				info.Year = tag[1]
+			case "TRACKNUMBER":
+				info.Track = parse_track_number(tag[1])
+			case "DISCNUMBER":
+				info.Disc = parse_track_number(tag[1])
+			case "REPLAYGAIN_TRACK_GAIN":
+				if gain, ok := parse_replaygain(tag[1]); ok {
+					info.Gain = gain
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * Decodes a FLAC stream into the same 16 bit stereo PCM the mp3 decoder
+ * produces. Mono is duplicated to both channels, channels past the first
+ * two are dropped, and other sample sizes are scaled to 16 bits
+ */
+type FlacDecoder struct {
+	stream *flac.Stream
+	src    io.Closer
+	pcm    []byte
+}
+
+/**
+ * @param src the FLAC stream, starting with its "fLaC" marker
+ * @param closer closed along with the decoder
+ * @return a decoder that has read the stream's STREAMINFO
+ */
+func NewFlacDecoder(src io.Reader, closer io.Closer) (*FlacDecoder, error) {
+	stream, err := flac.New(src)
+	if err != nil {
+		return nil, err
+	}
+	return &FlacDecoder{stream: stream, src: closer}, nil
+}
+
+func (d *FlacDecoder) SampleRate() int {
+	return int(d.stream.Info.SampleRate)
+}
+
+/**
+ * Reads PCM, decoding another FLAC frame whenever the last is used up
+ */
+func (d *FlacDecoder) Read(p []byte) (int, error) {
+	for len(d.pcm) == 0 {
+		frame, err := d.stream.ParseNext()
+		if err != nil {
+			return 0, err
+		}
+		d.pcm = append(d.pcm[:0], flac_pcm(frame.Subframes, d.stream.Info.BitsPerSample)...)
+	}
+	n := copy(p, d.pcm)
+	d.pcm = d.pcm[n:]
+	return n, nil
+}
+
+func (d *FlacDecoder) Close() error {
+	d.stream.Close()
+	return d.src.Close()
+}
+
+/**
+ * Interleaves the first two channels of a frame as 16 bit little endian
+ * stereo samples
+ * @param subframes the decoded channels of one frame
+ * @param bits the stream's bits per sample
+ * @return the frame's PCM
+ */
+func flac_pcm(subframes []*frame.Subframe, bits uint8) []byte {
+	if len(subframes) == 0 {
+		return nil
+	}
+	left, right := subframes[0].Samples, subframes[0].Samples
+	if len(subframes) > 1 {
+		right = subframes[1].Samples
+	}
+	pcm := make([]byte, 0, len(left)*4)
+	for i := range left {
+		for _, sample := range [2]int32{left[i], right[i]} {
+			if bits > 16 {
+				sample >>= bits - 16
+			} else {
+				sample <<= 16 - bits
+			}
+			pcm = append(pcm, byte(sample), byte(sample>>8))
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Friends: peers followed by their identity key, see identity.go, kept in
+ * the library with the songs each was last seen to have. friends shows
+ * whether each is online, found through the tracker's who is online by
+ * its key or at the address it was last reached on, and browses its whole
+ * library, asked of the peer itself with a LIBRARY it must sign. A serving
+ * peer checks on its friends every FRIENDS_POLL and tells of the songs
+ * they added since; those stay marked new until their library is browsed
+ */
+
+const (
+	// how often a serving peer checks its friends for new songs
+	FRIENDS_POLL = 5 * time.Minute
+	// size in bytes of the challenge sent with a LIBRARY
+	CHALLENGE_LEN = 32
+)
+
+/**
+ * A followed peer, as kept in the library
+ */
+type Friend struct {
+	// its identity key, in hex
+	Key  string
+	Name string
+	// the address it was last reached on, empty if it never was
+	Addr     string
+	Followed time.Time
+	// when its library was last fetched, zero if it never was
+	Checked time.Time
+}
+
+/**
+ * A followed peer as found just now
+ */
+type FriendStatus struct {
+	Friend Friend
+	// whether it could be reached, and if so its library
+	Online  bool
+	Library tsp.PeerLibrary
+	// how many of its songs are still marked new
+	New int
+}
+
+/**
+ * Answers a LIBRARY with every song this peer serves that the requester
+ * may see, the challenge in the request signed with its identity
+ * @param in_msg the request, carrying the challenge
+ * @param client the asking peer
+ */
+func serve_library(in_msg *tsp.Msg, client io.Writer) {
+	if len(in_msg.Msg) == 0 || len(in_msg.Msg) > CHALLENGE_LEN {
+		send_error(in_msg, client, tsp.ERR_DENIED, "a library request needs a challenge")
+		return
+	}
+	key, err := peer_identity()
+	if err != nil {
+		slog.Error("can't read the identity", "err", err)
+		send_error(in_msg, client, tsp.ERR_INTERNAL, "no identity")
+		return
+	}
+	master_mutex.Lock()
+	songs := append(seeding_songs(serve_args), local_songs...)
+	master_mutex.Unlock()
+	content, err := tsp.EncodeLibrary(tsp.PeerLibrary{
+		Key:       key.Public().(ed25519.PublicKey),
+		Name:      config.Nickname,
+		Signature: ed25519.Sign(key, in_msg.Msg),
+		Songs:     tsp.VisibleSongs(songs, requester_key(in_msg)),
+	})
+	if err != nil {
+		slog.Error("can't encode the library", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.LIBRARY, 0, content)); err != nil {
+		slog.Warn("can't send the library", "err", err)
+	}
+}
+
+/**
+ * Asks a peer for its library, and makes sure it holds the identity it
+ * claims
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @param key the identity key the peer must have, nil to take any
+ * @return the peer's library, or an error if it can't be reached or
+ * isn't the peer wanted
+ */
+func fetch_library(ctx context.Context, addr string, key []byte) (tsp.PeerLibrary, error) {
+	challenge := make([]byte, CHALLENGE_LEN)
+	if _, err := rand.Read(challenge); err != nil {
+		return tsp.PeerLibrary{}, err
+	}
+	conn, err := dial_peer(ctx, addr, key)
+	if err != nil {
+		return tsp.PeerLibrary{}, err
+	}
+	defer conn.Close()
+	request := tsp.NewMsg(tsp.LIBRARY, 0, challenge)
+	// signed, so the peer lists the songs it only lets some peers see
+	sign_msg(request, nil)
+	if err = tsp.Encode(conn, request); err != nil {
+		return tsp.PeerLibrary{}, err
+	}
+	in_msg, err := tsp.Decode(conn)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return tsp.PeerLibrary{}, err
+	}
+	library, err := tsp.DecodeLibrary(in_msg.Msg)
+	if err != nil {
+		return tsp.PeerLibrary{}, err
+	}
+	if len(library.Key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(ed25519.PublicKey(library.Key), challenge, library.Signature) {
+		return tsp.PeerLibrary{}, fmt.Errorf("%s didn't prove its identity", addr)
+	}
+	if key != nil && !bytes.Equal(library.Key, key) {
+		return tsp.PeerLibrary{}, fmt.Errorf("%s is another peer now", addr)
+	}
+	return library, nil
+}
+
+/**
+ * @return the followed peers, in the order they were followed
+ */
+func friends_list() ([]Friend, error) {
+	if library == nil {
+		return nil, fmt.Errorf("friends need the library")
+	}
+	rows, err := library.Query("SELECT key, name, addr, followed_at, checked_at FROM friends ORDER BY followed_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var friends []Friend
+	for rows.Next() {
+		var friend Friend
+		var followed, checked int64
+		if err = rows.Scan(&friend.Key, &friend.Name, &friend.Addr, &followed, &checked); err != nil {
+			return nil, err
+		}
+		friend.Followed = time.Unix(followed, 0)
+		if checked > 0 {
+			friend.Checked = time.Unix(checked, 0)
+		}
+		friends = append(friends, friend)
+	}
+	return friends, rows.Err()
+}
+
+/**
+ * Follows a peer, or renames one already followed
+ * @param key its identity key, in hex
+ * @param name what to call it, empty to keep the name it has
+ * @param addr where it can be reached, empty if unknown
+ */
+func follow_friend(key string, name string, addr string) error {
+	if library == nil {
+		return fmt.Errorf("friends need the library")
+	}
+	_, err := library.Exec(`INSERT INTO friends (key, name, addr, followed_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET name = CASE excluded.name WHEN '' THEN name ELSE excluded.name END,
+		addr = CASE excluded.addr WHEN '' THEN addr ELSE excluded.addr END`,
+		key, name, addr, time.Now().Unix())
+	return err
+}
+
+/**
+ * Stops following a peer, and forgets its songs
+ * @param key its identity key, in hex
+ */
+func unfollow_friend(key string) error {
+	if library == nil {
+		return fmt.Errorf("friends need the library")
+	}
+	if _, err := library.Exec("DELETE FROM friend_songs WHERE key = ?", key); err != nil {
+		return err
+	}
+	_, err := library.Exec("DELETE FROM friends WHERE key = ?", key)
+	return err
+}
+
+/**
+ * Records a friend's library as fetched just now. The first time, every
+ * song is taken as known; after that, songs not seen before are marked
+ * new
+ * @param friend the friend
+ * @param addr where it was reached
+ * @param peer_library its library
+ * @return the songs it added since it was last checked
+ */
+func note_friend_library(friend Friend, addr string, peer_library tsp.PeerLibrary) ([]tsp.SongEntry, error) {
+	tx, err := library.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	known := make(map[string]bool)
+	rows, err := tx.Query("SELECT hash FROM friend_songs WHERE key = ?", friend.Key)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		known[hash] = true
+	}
+	rows.Close()
+	first := friend.Checked.IsZero()
+	var added []tsp.SongEntry
+	now := time.Now().Unix()
+	for _, song := range peer_library.Songs {
+		if len(song.Sources) == 0 || song.Sources[0].Partial {
+			continue
+		}
+		hash := song.Sources[0].Hash
+		if known[hash] {
+			continue
+		}
+		known[hash] = true
+		if _, err = tx.Exec(`INSERT INTO friend_songs (key, hash, title, artist, added_at, new)
+			VALUES (?, ?, ?, ?, ?, ?)`, friend.Key, hash, song.Title, song.Artist, now, !first); err != nil {
+			return nil, err
+		}
+		if !first {
+			added = append(added, song)
+		}
+	}
+	name := friend.Name
+	if name == "" {
+		name = peer_library.Name
+	}
+	if _, err = tx.Exec("UPDATE friends SET name = ?, addr = ?, checked_at = ? WHERE key = ?",
+		name, addr, now, friend.Key); err != nil {
+		return nil, err
+	}
+	return added, tx.Commit()
+}
+
+/**
+ * @param key a friend's identity key, in hex
+ * @return the hashes of its songs marked new
+ */
+func new_friend_songs(key string) (map[string]bool, error) {
+	rows, err := library.Query("SELECT hash FROM friend_songs WHERE key = ? AND new", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fresh := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		fresh[hash] = true
+	}
+	return fresh, rows.Err()
+}
+
+/**
+ * @param key a friend's identity key, in hex
+ * @return an error if the library can't be written
+ */
+func mark_friend_songs_seen(key string) error {
+	_, err := library.Exec("UPDATE friend_songs SET new = 0 WHERE key = ?", key)
+	return err
+}
+
+/**
+ * Looks a friend up by its number in the list, its name or the start of
+ * its identity key
+ * @param friends the followed peers
+ * @param arg what was typed
+ * @return the friend, or an error if none or several match
+ */
+func find_friend(friends []Friend, arg string) (Friend, error) {
+	if n, err := strconv.Atoi(arg); err == nil && n >= 1 && n <= len(friends) {
+		return friends[n-1], nil
+	}
+	var found []Friend
+	for _, friend := range friends {
+		if strings.EqualFold(friend.Name, arg) || strings.HasPrefix(friend.Key, strings.ToLower(arg)) {
+			found = append(found, friend)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Friend{}, fmt.Errorf("not following %q", arg)
+	case 1:
+		return found[0], nil
+	}
+	return Friend{}, fmt.Errorf("%q could be any of %d friends", arg, len(found))
+}
+
+/**
+ * @return where the peers online serve, by identity key in hex, as the
+ * tracker knows them; empty without a tracker
+ */
+func online_addrs() map[string]string {
+	addrs := make(map[string]string)
+	if tracker_addr == "" {
+		return addrs
+	}
+	online, err := fetch_who()
+	if err != nil {
+		slog.Debug("can't ask who is online", "err", err)
+		return addrs
+	}
+	for _, presence := range online {
+		if len(presence.Key) > 0 {
+			addrs[format_key(presence.Key)] = presence.Addr
+		}
+	}
+	return addrs
+}
+
+/**
+ * Looks up the identity key of a peer online by how it starts, as who
+ * shows it
+ * @param prefix the start of the key, in hex
+ * @return the key, or an error if no peer online or several have one
+ * starting that way
+ */
+func online_key(prefix string) ([]byte, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 8 {
+		return parse_key(prefix)
+	}
+	var found []byte
+	for key := range online_addrs() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("several peers online have a key starting %s", prefix)
+		}
+		found, _ = parse_key(key)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no peer online has a key starting %s", prefix)
+	}
+	return found, nil
+}
+
+/**
+ * Finds out whether a friend is online, where the tracker says it is or
+ * at the address it was last reached on, and records what songs it added
+ * @param ctx cancelled to give up
+ * @param friend the friend
+ * @param addrs where the peers online serve, by key, see online_addrs
+ * @return the friend as found, and the songs it added since it was last
+ * checked
+ */
+func check_friend(ctx context.Context, friend Friend, addrs map[string]string) (FriendStatus, []tsp.SongEntry) {
+	status := FriendStatus{Friend: friend}
+	key, err := parse_key(friend.Key)
+	if err != nil {
+		return status, nil
+	}
+	addr, ok := addrs[friend.Key]
+	if !ok {
+		addr = friend.Addr
+	}
+	if addr != "" {
+		status.Library, err = fetch_library(ctx, addr, key)
+		if err != nil {
+			slog.Debug("friend unreachable", "key", friend.Key, "addr", addr, "err", err)
+		}
+		status.Online = err == nil
+	}
+	var added []tsp.SongEntry
+	if status.Online {
+		added, err = note_friend_library(friend, addr, status.Library)
+		if err != nil {
+			slog.Error("can't record a friend's library", "key", friend.Key, "err", err)
+		}
+		status.Friend.Addr, status.Friend.Checked = addr, time.Now()
+		if status.Friend.Name == "" {
+			status.Friend.Name = status.Library.Name
+		}
+	}
+	if fresh, err := new_friend_songs(friend.Key); err == nil {
+		status.New = len(fresh)
+	}
+	return status, added
+}
+
+/**
+ * Checks on every friend
+ * @param ctx cancelled to give up
+ * @return each friend as found, in the order they were followed
+ */
+func check_friends(ctx context.Context) ([]FriendStatus, error) {
+	friends, err := friends_list()
+	if err != nil {
+		return nil, err
+	}
+	addrs := online_addrs()
+	statuses := make([]FriendStatus, len(friends))
+	for i, friend := range friends {
+		statuses[i], _ = check_friend(ctx, friend, addrs)
+	}
+	return statuses, nil
+}
+
+/**
+ * Checks on the friends every FRIENDS_POLL, telling of the songs they
+ * added, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func watch_friends(ctx context.Context) {
+	if library == nil {
+		return
+	}
+	ticker := time.NewTicker(FRIENDS_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		friends, err := friends_list()
+		if err != nil {
+			slog.Error("can't read the friends", "err", err)
+			continue
+		}
+		if len(friends) == 0 {
+			continue
+		}
+		addrs := online_addrs()
+		for _, friend := range friends {
+			status, added := check_friend(ctx, friend, addrs)
+			for _, song := range added {
+				slog.Info("friend added a song", "friend", status.Friend.Name,
+					"title", song.Title, "artist", song.Artist)
+				fmt.Println(friend_name(status.Friend) + " added: " + song.Title + ", " + song.Artist)
+			}
+		}
+	}
+}
+
+/**
+ * @param friend a followed peer
+ * @return what to call it: its name and the start of its key
+ */
+func friend_name(friend Friend) string {
+	if friend.Name == "" {
+		return short_key(friend.Key)
+	}
+	return friend.Name + " (" + short_key(friend.Key) + ")"
+}
+
+/**
+ * Writes the friends, one per line, with whether they are online
+ * @param w where the list is written
+ * @param statuses the friends as found, numbered from 1
+ */
+func write_friends(w io.Writer, statuses []FriendStatus) {
+	fmt.Fprintln(w, "Your identity key: "+format_key(identity_key()))
+	if len(statuses) == 0 {
+		fmt.Fprintln(w, "Not following anyone.")
+	}
+	for i, status := range statuses {
+		line := fmt.Sprintf("%3d. %s: ", i+1, friend_name(status.Friend))
+		if status.Online {
+			line += fmt.Sprintf("online at %s, %d songs", status.Friend.Addr, len(status.Library.Songs))
+		} else if !status.Friend.Checked.IsZero() {
+			line += "offline, last reached " + status.Friend.Checked.Format("2006-01-02 15:04")
+		} else {
+			line += "offline"
+		}
+		if status.New > 0 {
+			line += fmt.Sprintf(", %d new", status.New)
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * Writes a friend's library, the songs it added since it was last
+ * browsed first, and marks them seen
+ * @param w where the library is written
+ * @param status the friend, found online
+ */
+func write_friend_library(w io.Writer, status FriendStatus) error {
+	fresh, err := new_friend_songs(status.Friend.Key)
+	if err != nil {
+		return err
+	}
+	var added []tsp.SongEntry
+	for _, song := range status.Library.Songs {
+		if len(song.Sources) > 0 && fresh[song.Sources[0].Hash] {
+			added = append(added, song)
+		}
+	}
+	fmt.Fprintln(w, friend_name(status.Friend)+"'s library:")
+	if len(added) > 0 {
+		fmt.Fprintln(w, "New:")
+		write_master_list(w, added)
+		fmt.Fprintln(w, "All:")
+	}
+	write_master_list(w, status.Library.Songs)
+	return mark_friend_songs_seen(status.Friend.Key)
+}
+
+/**
+ * Follows a peer by its identity key, or by the address it serves on
+ * @param ctx cancelled to give up
+ * @param arg the key or address
+ * @param name what to call it, empty for the name it goes by
+ * @return the friend as found, or an error if it can't be followed
+ */
+func follow_peer(ctx context.Context, arg string, name string) (FriendStatus, error) {
+	if library == nil {
+		return FriendStatus{}, fmt.Errorf("friends need the library")
+	}
+	addr := ""
+	key, err := parse_key(arg)
+	if _, _, split_err := net.SplitHostPort(arg); split_err == nil {
+		// an address: follow whoever serves there now
+		peer_library, err := fetch_library(ctx, arg, nil)
+		if err != nil {
+			return FriendStatus{}, err
+		}
+		addr, key = arg, peer_library.Key
+	} else if err != nil {
+		if key, err = online_key(arg); err != nil {
+			return FriendStatus{}, err
+		}
+	}
+	if bytes.Equal(key, identity_key()) {
+		return FriendStatus{}, errors.New("that's this peer")
+	}
+	if err = follow_friend(format_key(key), name, addr); err != nil {
+		return FriendStatus{}, err
+	}
+	friends, err := friends_list()
+	if err != nil {
+		return FriendStatus{}, err
+	}
+	friend, err := find_friend(friends, format_key(key))
+	if err != nil {
+		return FriendStatus{}, err
+	}
+	status, _ := check_friend(ctx, friend, online_addrs())
+	return status, nil
+}
+
+/**
+ * friends [follow <key|address> [name] | unfollow <friend> | <friend>]:
+ * lists the followed peers and whether they are online, follows or
+ * unfollows one, or prints a friend's library
+ */
+func run_friends(args []string) int {
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	ctx, cancel := signal_context()
+	defer cancel()
+	switch {
+	case len(args) == 0:
+		statuses, err := check_friends(ctx)
+		if err != nil {
+			fmt.Println("can't check on the friends: ", err)
+			return 1
+		}
+		write_friends(os.Stdout, statuses)
+		return 0
+	case args[0] == "follow" && (len(args) == 2 || len(args) == 3):
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		status, err := follow_peer(ctx, args[1], name)
+		if err != nil {
+			fmt.Println("can't follow: ", err)
+			return 1
+		}
+		write_friends(os.Stdout, []FriendStatus{status})
+		return 0
+	case args[0] == "unfollow" && len(args) == 2:
+		friends, err := friends_list()
+		if err == nil {
+			var friend Friend
+			if friend, err = find_friend(friends, args[1]); err == nil {
+				err = unfollow_friend(friend.Key)
+			}
+		}
+		if err != nil {
+			fmt.Println("can't unfollow: ", err)
+			return 1
+		}
+		return 0
+	case len(args) == 1:
+		friends, err := friends_list()
+		if err != nil {
+			fmt.Println("can't read the friends: ", err)
+			return 1
+		}
+		friend, err := find_friend(friends, args[0])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		status, _ := check_friend(ctx, friend, online_addrs())
+		if !status.Online {
+			fmt.Println(friend_name(friend) + " is offline.")
+			return 1
+		}
+		if err = write_friend_library(os.Stdout, status); err != nil {
+			fmt.Println("can't read the friend's songs: ", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Println("Usage: ", os.Args[0], "friends [follow <key|address> [name] | unfollow <friend> | <friend>]")
+	return 2
+}
+
+/**
+ * FRIENDS from the interactive menu: lists the followed peers and whether
+ * they are online, then browses a friend's library, or follows or
+ * unfollows a peer
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_friends(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	statuses, err := check_friends(ctx)
+	if err != nil {
+		fmt.Println("can't check on the friends: ", err)
+		return
+	}
+	write_friends(os.Stdout, statuses)
+	actions := []string{"FOLLOW", "BACK"}
+	if len(statuses) > 0 {
+		actions = []string{"BROWSE", "FOLLOW", "UNFOLLOW", "BACK"}
+	}
+	action, _ := ui.Select("Friends", actions, &input.Options{
+		Loop: true,
+	})
+	pick := func() FriendStatus {
+		arg, _ := ui.Ask(fmt.Sprintf("Friend (1-%d)", len(statuses)), &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				if n, err := strconv.Atoi(arg); err != nil || n < 1 || n > len(statuses) {
+					return fmt.Errorf("pick a friend from 1 to %d", len(statuses))
+				}
+				return nil
+			},
+		})
+		n, _ := strconv.Atoi(arg)
+		return statuses[n-1]
+	}
+	switch action {
+	case "BROWSE":
+		status := pick()
+		if !status.Online {
+			fmt.Println(friend_name(status.Friend) + " is offline.")
+			return
+		}
+		if err := write_friend_library(os.Stdout, status); err != nil {
+			fmt.Println("can't read the friend's songs: ", err)
+		}
+	case "FOLLOW":
+		arg, _ := ui.Ask("Identity key or address to follow", &input.Options{
+			Required: true,
+			Loop:     true,
+		})
+		name, _ := ui.Ask("Call them (blank for the name they go by)", &input.Options{})
+		status, err := follow_peer(ctx, arg, name)
+		if err != nil {
+			fmt.Println("can't follow: ", err)
+			return
+		}
+		write_friends(os.Stdout, []FriendStatus{status})
+	case "UNFOLLOW":
+		status := pick()
+		if err := unfollow_friend(status.Friend.Key); err != nil {
+			fmt.Println("can't unfollow: ", err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+// the web UI, a single page served at /
+//
+//go:embed web
+var web_files embed.FS
+
+/**
+ * A song as listed by the HTTP gateway's /songs
+ */
+type GatewaySong struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Genre  string `json:"genre"`
+	// in seconds, 0 if unknown
+	Duration float64 `json:"duration"`
+	Format   string  `json:"format"`
+	Peers    int     `json:"peers"`
+	Stream   string  `json:"stream"`
+}
+
+/**
+ * A song in the charts, as listed by the HTTP gateway's /charts
+ */
+type GatewayChartEntry struct {
+	GatewaySong
+	// plays over the period asked for
+	Plays int `json:"plays"`
+}
+
+/**
+ * Serves the HTTP gateway, so browsers and curl on the LAN can list and
+ * listen to songs without the client:
+ *   GET /             the web UI
+ *   GET /songs        the master list as JSON
+ *   GET /search?q=    the songs matching a query, best first, as JSON
+ *   GET /charts?period=day|week
+ *                     the songs played most across the swarm, as JSON
+ *   GET /streamurl/{id}
+ *                     a stream URL for the song, as JSON
+ *   GET /stream/{id}?token=
+ *                     the song's audio, proxied from a peer serving it
+ *   GET /metrics      counters and gauges in the Prometheus text format
+ *   GET /rest/...     a subset of the Subsonic API, see subsonic.go
+ *   /dlna/...         the UPnP media server, see dlna.go
+ * Everything that hands out stream tokens, the web UI, the lists and the
+ * media server, and /metrics, is only open to the local network, as is
+ * the Subsonic API without a login set, see streamtoken.go
+ * Returns once ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ * @param addr the address to listen on, e.g. ":8000"
+ * @param args cl arguments which contain the port
+ */
+func serve_gateway(ctx context.Context, addr string, args []string) {
+	mux := http.NewServeMux()
+	web, _ := fs.Sub(web_files, "web")
+	files := http.FileServer(http.FS(web))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if allow_local(w, r) {
+			files.ServeHTTP(w, r)
+		}
+	})
+	mux.HandleFunc("/songs", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_local(w, r) {
+			return
+		}
+		songs, _, err := current_list(ctx, args)
+		if err != nil {
+			http.Error(w, "can't get the song list: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		write_gateway_songs(w, songs)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if allow_local(w, r) {
+			write_metrics(w, r)
+		}
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_local(w, r) {
+			return
+		}
+		write_gateway_songs(w, search_songs(r.URL.Query().Get("q")))
+	})
+	mux.HandleFunc("/charts", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_local(w, r) {
+			return
+		}
+		period := r.URL.Query().Get("period")
+		if period != tsp.CHART_DAY && period != tsp.CHART_WEEK {
+			http.Error(w, "period must be day or week", http.StatusBadRequest)
+			return
+		}
+		chart, err := fetch_charts(period)
+		if err != nil {
+			http.Error(w, "can't get the charts: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		list := make([]GatewayChartEntry, 0, len(chart))
+		for _, entry := range chart {
+			list = append(list, GatewayChartEntry{gateway_song(entry.Song), entry.Plays})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("/streamurl/", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_local(w, r) {
+			return
+		}
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"stream": stream_path(id, "")})
+	})
+	mux.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
+		gateway_stream(ctx, args, w, r)
+	})
+	mux.HandleFunc("/rest/", func(w http.ResponseWriter, r *http.Request) {
+		// without a login to check, the Subsonic API is as open as the web UI
+		if config.Subsonic.User != "" || allow_local(w, r) {
+			serve_subsonic(ctx, args, w, r)
+		}
+	})
+	mux.HandleFunc("/dlna/", func(w http.ResponseWriter, r *http.Request) {
+		if allow_local(w, r) {
+			serve_dlna(ctx, args, w, r)
+		}
+	})
+	// no write timeout, streams take as long as the song
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: io_timeout()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("can't serve the HTTP gateway", "addr", addr, "err", err)
+	}
+}
+
+/**
+ * Answers with a list of songs as JSON
+ * @param w the response
+ * @param songs the songs to list
+ */
+func write_gateway_songs(w http.ResponseWriter, songs []tsp.SongEntry) {
+	list := make([]GatewaySong, 0, len(songs))
+	for _, song := range songs {
+		list = append(list, gateway_song(song))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+/**
+ * @param song a master list entry
+ * @return the song as the gateway lists it
+ */
+func gateway_song(song tsp.SongEntry) GatewaySong {
+	entry := GatewaySong{
+		ID:       song.ID,
+		Title:    song.Title,
+		Artist:   song.Artist,
+		Album:    song.Album,
+		Genre:    song.Genre,
+		Duration: song.Duration.Seconds(),
+		Format:   tsp.FORMAT_MP3,
+		Peers:    len(song.Sources),
+		Stream:   stream_path(song.ID, ""),
+	}
+	if len(song.Sources) > 0 && song.Sources[0].Format != "" {
+		entry.Format = song.Sources[0].Format
+	}
+	return entry
+}
+
+/**
+ * Answers /stream/{id} with the song's bytes, if the URL carries a token
+ * for the song
+ */
+func gateway_stream(ctx context.Context, args []string, w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	id, err := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !valid_stream_token(id, r.URL.Query().Get("token")) {
+		http.Error(w, "the stream URL is wrong or has expired", http.StatusForbidden)
+		return
+	}
+	stream_song(ctx, args, id, w, r)
+}
+
+/**
+ * Answers with a song's bytes, from the cache or the first peer that will
+ * send it. "Range: bytes=N-" is passed on as the offset of the PLAY, so
+ * browsers can seek
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @param id the song's master list ID
+ */
+func stream_song(ctx context.Context, args []string, id int, w http.ResponseWriter, r *http.Request) {
+	var err error
+	song, ok := find_song(id)
+	if !ok {
+		if _, err = load_master_list(ctx, args); err == nil {
+			song, ok = find_song(id)
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	offset, ranged := parse_range(r.Header.Get("Range"))
+	if ranged && len(song.Sources) > 0 && offset >= song.Sources[0].Size {
+		http.Error(w, "range past the end of the song", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	var src io.ReadCloser
+	source, cached := find_cached(song)
+	if cached {
+		src, err = open_cached_exact(source, offset)
+	}
+	if !cached || err != nil {
+		msg := tsp.NewMsg(tsp.PLAY, song.ID, nil)
+		msg.Header.Offset = offset
+		src, source, err = send_to_source(*msg, song)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer src.Close()
+
+	w.Header().Set("Content-Type", mime_type(source.Format))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if source.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(source.Size-offset, 10))
+	}
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, source.Size-1, source.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method != http.MethodHead {
+		copy_ctx(r.Context(), w, src)
+	}
+}
+
+/**
+ * @param header the request's Range header
+ * @return the offset of an open ended "bytes=N-" range, and false for no
+ * range or any other kind, which is answered with the whole song
+ */
+func parse_range(header string) (int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"), 10, 64)
+	if err != nil || offset <= 0 {
+		return 0, false
+	}
+	return offset, true
+}
+
+/**
+ * Opens a cached song at exactly the given byte, unlike open_cached which
+ * skips ahead to a frame boundary
+ */
+func open_cached_exact(source tsp.SongSource, offset int64) (io.ReadCloser, error) {
+	file, err := open_cache_file(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+/**
+ * @param format one of the tsp.FORMAT_ constants
+ * @return the MIME type to serve a song in that format as
+ */
+func mime_type(format string) string {
+	switch format {
+	case tsp.FORMAT_FLAC:
+		return "audio/flac"
+	case tsp.FORMAT_VORBIS:
+		return "audio/ogg"
+	case tsp.FORMAT_OPUS:
+		return "audio/ogg; codecs=opus"
+	}
+	return "audio/mpeg"
+}
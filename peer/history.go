@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Play history. Every play of a song is recorded in the library database
+ * once it ends: the song, the peer it was streamed from, when it started
+ * and how long was listened to, seeks included. Plays stopped before
+ * MIN_LISTEN aren't recorded. `history` lists the latest plays and `top`
+ * the songs played most
+ */
+
+const (
+	// how long a play stopped before the end must have lasted to count
+	MIN_LISTEN = 30 * time.Second
+	// plays or songs listed, unless told otherwise
+	DEFAULT_HISTORY = 20
+)
+
+/**
+ * One play of a song
+ */
+type HistoryEntry struct {
+	// the master list entry as it was when played
+	Song tsp.SongEntry
+	// the serving address of the peer streamed from, empty if cached
+	Peer      string
+	PlayedAt  time.Time
+	Listened  time.Duration
+	Completed bool
+}
+
+/**
+ * A song and how often it was played
+ */
+type PlayCount struct {
+	Song     tsp.SongEntry
+	Plays    int
+	Listened time.Duration
+}
+
+/**
+ * Saves a play to the history. Without a library nothing is saved
+ * @param entry the play
+ */
+func record_history(entry HistoryEntry) {
+	// live radio isn't a song of the master list
+	if library == nil || entry.Song.ID == 0 {
+		return
+	}
+	song := entry.Song
+	hash := ""
+	for _, source := range song.Sources {
+		if source.Hash != "" {
+			hash = source.Hash
+			break
+		}
+	}
+	_, err := library.Exec(`INSERT INTO history
+		(played_at, song_id, title, artist, album, duration, hash, peer, listened, completed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.PlayedAt.Unix(), song.ID, song.Title, song.Artist, song.Album, int64(song.Duration),
+		hash, entry.Peer, int64(entry.Listened), entry.Completed)
+	if err != nil {
+		slog.Error("can't save a play to the history", "song", song.ID, "err", err)
+	}
+	queue_scrobble(entry)
+}
+
+/**
+ * @param n how many plays to return
+ * @return the latest n plays, newest first
+ */
+func recent_plays(n int) ([]HistoryEntry, error) {
+	rows, err := library.Query(`SELECT played_at, song_id, title, artist, album, duration, peer, listened, completed
+		FROM history ORDER BY played_at DESC, rowid DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var played_at, duration, listened int64
+		song := &entry.Song
+		if err = rows.Scan(&played_at, &song.ID, &song.Title, &song.Artist, &song.Album, &duration,
+			&entry.Peer, &listened, &entry.Completed); err != nil {
+			return nil, err
+		}
+		entry.PlayedAt = time.Unix(played_at, 0)
+		song.Duration = time.Duration(duration)
+		entry.Listened = time.Duration(listened)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+/**
+ * @param n how many songs to return
+ * @return the n songs played most, then listened to longest
+ */
+func most_played(n int) ([]PlayCount, error) {
+	rows, err := library.Query(`SELECT song_id, MAX(title), MAX(artist), MAX(album), MAX(duration),
+		COUNT(*) AS plays, SUM(listened) AS total
+		FROM history GROUP BY song_id ORDER BY plays DESC, total DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []PlayCount
+	for rows.Next() {
+		var count PlayCount
+		var duration, listened int64
+		song := &count.Song
+		if err = rows.Scan(&song.ID, &song.Title, &song.Artist, &song.Album, &duration,
+			&count.Plays, &listened); err != nil {
+			return nil, err
+		}
+		song.Duration = time.Duration(duration)
+		count.Listened = time.Duration(listened)
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+/**
+ * Writes plays, one per line
+ * @param w where they are written
+ * @param entries the plays, newest first
+ */
+func write_history(w io.Writer, entries []HistoryEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "Nothing played yet.")
+	}
+	for _, entry := range entries {
+		song := entry.Song
+		fmt.Fprintf(w, "%s  %d: %s, %s (%s of %s)", entry.PlayedAt.Format("2006-01-02 15:04"), song.ID,
+			song.Title, song.Artist, format_duration(entry.Listened), format_duration(song.Duration))
+		if entry.Peer != "" {
+			fmt.Fprintf(w, " from %s", entry.Peer)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * Writes the songs played most, one per line
+ * @param w where they are written
+ * @param counts the songs, most played first
+ */
+func write_most_played(w io.Writer, counts []PlayCount) {
+	if len(counts) == 0 {
+		fmt.Fprintln(w, "Nothing played yet.")
+	}
+	for i, count := range counts {
+		song := count.Song
+		fmt.Fprintf(w, "%3d. %s, %s (%s) [id %d] %d plays, %s listened\n", i+1, song.Title, song.Artist,
+			format_duration(song.Duration), song.ID, count.Plays, count.Listened.Round(time.Second))
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * Opens the library for a command run without a serving peer
+ * @return a function closing it again, or an error if it can't be opened
+ */
+func use_library() (func(), error) {
+	if library != nil {
+		return func() {}, nil
+	}
+	if err := open_library(); err != nil {
+		return nil, err
+	}
+	return close_library, nil
+}
+
+/**
+ * @param args what followed the command: nothing, or how many to list
+ * @return how many to list, or an error if it isn't a positive number
+ */
+func history_count(args []string) (int, error) {
+	if len(args) == 0 {
+		return DEFAULT_HISTORY, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 || len(args) > 1 {
+		return 0, fmt.Errorf("expected how many to list, got %v", args)
+	}
+	return n, nil
+}
+
+/**
+ * history [n]: prints the latest plays
+ */
+func run_history(args []string) int {
+	n, err := history_count(args)
+	if err != nil {
+		fmt.Println("Usage: ", os.Args[0], "history [n]")
+		return 2
+	}
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	entries, err := recent_plays(n)
+	if err != nil {
+		fmt.Println("can't read the history: ", err)
+		return 1
+	}
+	if json_flag {
+		write_json_history(os.Stdout, entries)
+	} else {
+		write_history(os.Stdout, entries)
+	}
+	return 0
+}
+
+/**
+ * top [n]: prints the songs played most
+ */
+func run_top(args []string) int {
+	n, err := history_count(args)
+	if err != nil {
+		fmt.Println("Usage: ", os.Args[0], "top [n]")
+		return 2
+	}
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	counts, err := most_played(n)
+	if err != nil {
+		fmt.Println("can't read the history: ", err)
+		return 1
+	}
+	if json_flag {
+		write_json_most_played(os.Stdout, counts)
+	} else {
+		write_most_played(os.Stdout, counts)
+	}
+	return 0
+}
+
+/**
+ * HISTORY and MOST PLAYED from the interactive menu
+ * @param top whether to print the songs played most rather than the
+ * latest plays
+ */
+func handle_history(top bool) {
+	if library == nil {
+		fmt.Println("no library, so no history")
+		return
+	}
+	if top {
+		counts, err := most_played(DEFAULT_HISTORY)
+		if err != nil {
+			fmt.Println("can't read the history: ", err)
+			return
+		}
+		write_most_played(os.Stdout, counts)
+		return
+	}
+	entries, err := recent_plays(DEFAULT_HISTORY)
+	if err != nil {
+		fmt.Println("can't read the history: ", err)
+		return
+	}
+	write_history(os.Stdout, entries)
+}
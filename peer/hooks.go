@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Event hooks. Shell commands set under [hooks] in the config file are
+ * run when a song starts or stops playing, a download finishes, or a peer
+ * starts streaming a song from this one:
+ *
+ *   [hooks]
+ *   on_track_end = "~/bin/scrobble"
+ *   on_download_complete = "notify-send \"Downloaded $TORERO_TITLE\""
+ *
+ * They run in the background, through sh (cmd on Windows), with what
+ * happened in TORERO_ environment variables: TORERO_EVENT, the song's
+ * TORERO_SONG_ID, TORERO_TITLE, TORERO_ARTIST, TORERO_ALBUM, TORERO_GENRE
+ * and TORERO_DURATION (seconds), and the TORERO_PEER it came from or went
+ * to. on_track_end adds TORERO_LISTENED (seconds) and TORERO_COMPLETED
+ * (1 or 0), on_download_complete and on_peer_connect TORERO_FILE. A hook still running after
+ * HOOK_TIMEOUT is killed, and one that fails is logged
+ */
+
+const (
+	HOOK_TRACK_START       = "on_track_start"
+	HOOK_TRACK_END         = "on_track_end"
+	HOOK_DOWNLOAD_COMPLETE = "on_download_complete"
+	HOOK_PEER_CONNECT      = "on_peer_connect"
+	HOOK_TIMEOUT           = time.Minute
+	// bytes of a failed hook's output logged
+	HOOK_OUTPUT_LIMIT = 512
+)
+
+/**
+ * The shell command run on each event, empty for none
+ */
+type Hooks struct {
+	TrackStart       string `toml:"on_track_start"`
+	TrackEnd         string `toml:"on_track_end"`
+	DownloadComplete string `toml:"on_download_complete"`
+	PeerConnect      string `toml:"on_peer_connect"`
+}
+
+/**
+ * @param event one of the HOOK_ events
+ * @return the command set for it, empty if none is
+ */
+func hook_command(event string) string {
+	switch event {
+	case HOOK_TRACK_START:
+		return config.Hooks.TrackStart
+	case HOOK_TRACK_END:
+		return config.Hooks.TrackEnd
+	case HOOK_DOWNLOAD_COMPLETE:
+		return config.Hooks.DownloadComplete
+	case HOOK_PEER_CONNECT:
+		return config.Hooks.PeerConnect
+	}
+	return ""
+}
+
+/**
+ * @param song the song the event is about
+ * @param peer the address of the peer it came from or went to
+ * @return the environment variables describing it to a hook
+ */
+func song_env(song tsp.SongEntry, peer string) []string {
+	return []string{
+		"TORERO_SONG_ID=" + strconv.Itoa(song.ID),
+		"TORERO_TITLE=" + song.Title,
+		"TORERO_ARTIST=" + song.Artist,
+		"TORERO_ALBUM=" + song.Album,
+		"TORERO_GENRE=" + song.Genre,
+		fmt.Sprintf("TORERO_DURATION=%d", int(song.Duration.Seconds())),
+		"TORERO_PEER=" + peer,
+	}
+}
+
+/**
+ * Runs the on_peer_connect hook for a peer starting to stream a song
+ * @param file_id the FileID the song was asked for by
+ * @param file the file it is served from
+ * @param client the connection to the peer
+ */
+func hook_peer_connect(file_id int, file string, client io.Writer) {
+	if config.Hooks.PeerConnect == "" {
+		return
+	}
+	peer := ""
+	if conn, ok := client.(interface{ RemoteAddr() net.Addr }); ok {
+		peer = conn.RemoteAddr().String()
+	}
+	run_hook(HOOK_PEER_CONNECT, append(song_env(served_song(file_id), peer), "TORERO_FILE="+file))
+}
+
+/**
+ * Runs the hook set for an event, if any, in the background
+ * @param event one of the HOOK_ events
+ * @param env what happened, as TORERO_ variables
+ */
+func run_hook(event string, env []string) {
+	command := hook_command(event)
+	if command == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT)
+		defer cancel()
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+		cmd.Env = append(os.Environ(), "TORERO_EVENT="+event)
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if len(out) > HOOK_OUTPUT_LIMIT {
+				out = out[:HOOK_OUTPUT_LIMIT]
+			}
+			slog.Warn("hook failed", "event", event, "err", err, "output", strings.TrimSpace(string(out)))
+		}
+	}()
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/**
+ * Metadata for a local song, read from its tags and audio frames
+ */
+type SongInfo struct {
+	Title    string
+	Artist   string
+	Album    string
+	Genre    string
+	Year     string
+	Duration time.Duration
+	// average, in kbps
+	Bitrate  int
+	Filename string
+	Size     int64
+	Hash     string
+	Format   string
+	// track gain in dB (see replaygain.go), 0 if unknown
+	Gain float64
+	// the song's place on its album, 0 if unknown
+	Track int
+	Disc  int
+}
+
+// the genres ID3v1 tags, and ID3v2 tags written as numbers, refer to
+var id3_genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"Alternative Rock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// kbps, indexed by [mpeg1?0:1][bitrate index], layer III only
+var mp3_bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// Hz, indexed by [version bits][sample rate index]
+var mp3_sample_rates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG 2.5
+	{0, 0, 0},             // reserved
+	{22050, 24000, 16000}, // MPEG 2
+	{44100, 48000, 32000}, // MPEG 1
+}
+
+/**
+ * Reads the metadata of a song file and hashes its contents
+ * @param file_path path of the song file
+ * @return the song's metadata; fields missing from the tags are left empty
+ */
+func read_song_info(file_path string) (*SongInfo, error) {
+	info, err := read_song_tags(file_path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	info.Hash = hex.EncodeToString(hash.Sum(nil))
+	if info.Gain == 0 {
+		// no ReplayGain tag
+		if gain, err := measure_gain(file_path, info.Format); err == nil {
+			info.Gain = gain
+		}
+	}
+	return info, nil
+}
+
+/**
+ * Reads the tags (ID3v2 falling back to ID3v1 for mp3, Vorbis comments for
+ * FLAC, Ogg Vorbis and Opus) of a song file and works out its duration and
+ * average bitrate
+ * @param file_path path of the song file
+ * @return the song's metadata, without its hash
+ */
+func read_song_tags(file_path string) (*SongInfo, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SongInfo{Size: stat.Size(), Format: song_format(file_path)}
+	switch info.Format {
+	case tsp.FORMAT_FLAC:
+		if err = read_flac_info(file, info); err != nil {
+			return nil, err
+		}
+	case tsp.FORMAT_VORBIS, tsp.FORMAT_OPUS:
+		if err = read_ogg_info(file, stat.Size(), info); err != nil {
+			return nil, err
+		}
+	default:
+		tag_len := read_id3v2(file, info)
+		if info.Title == "" || info.Artist == "" {
+			read_id3v1(file, stat.Size(), info)
+		}
+		info.Duration = mp3_duration(file, tag_len, stat.Size())
+	}
+	if info.Duration > 0 {
+		info.Bitrate = int(info.Size * 8 * int64(time.Second) / int64(info.Duration) / 1000)
+	}
+	return info, nil
+}
+
+/**
+ * Parses an ID3v2.2/2.3/2.4 tag at the start of the file
+ * @return the length of the tag in bytes, 0 if there is none
+ */
+func read_id3v2(file io.ReaderAt, info *SongInfo) int64 {
+	return each_id3v2_frame(file, func(id string, body []byte) {
+		switch id {
+		case "TIT2", "TT2":
+			info.Title = decode_text_frame(body)
+		case "TPE1", "TP1":
+			info.Artist = decode_text_frame(body)
+		case "TALB", "TAL":
+			info.Album = decode_text_frame(body)
+		case "TCON", "TCO":
+			info.Genre = id3_genre(decode_text_frame(body))
+		case "TYER", "TYE", "TDRC":
+			info.Year = decode_text_frame(body)
+		case "TRCK", "TRK":
+			info.Track = parse_track_number(decode_text_frame(body))
+		case "TPOS", "TPA":
+			info.Disc = parse_track_number(decode_text_frame(body))
+		case "TXXX", "TXX":
+			desc, value := decode_user_text_frame(body)
+			if strings.EqualFold(desc, "REPLAYGAIN_TRACK_GAIN") {
+				if gain, ok := parse_replaygain(value); ok {
+					info.Gain = gain
+				}
+			}
+		case "TLEN", "TLE":
+			ms := 0
+			for _, c := range decode_text_frame(body) {
+				if c < '0' || c > '9' {
+					break
+				}
+				ms = ms*10 + int(c-'0')
+			}
+			info.Duration = time.Duration(ms) * time.Millisecond
+		}
+	})
+}
+
+/**
+ * Walks the frames of an ID3v2.2/2.3/2.4 tag at the start of the file
+ * @param fn called with the ID and body of each frame, in order
+ * @return the length of the tag in bytes, 0 if there is none
+ */
+func each_id3v2_frame(file io.ReaderAt, fn func(id string, body []byte)) int64 {
+	header := make([]byte, 10)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:3]) != "ID3" {
+		return 0
+	}
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	tag := make([]byte, size)
+	if _, err := file.ReadAt(tag, 10); err != nil {
+		return 0
+	}
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.Replace(tag, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+
+	pos := 0
+	if flags&0x40 != 0 && len(tag) >= 4 {
+		if version == 4 {
+			pos = int(syncsafe(tag[:4]))
+		} else {
+			pos = int(binary.BigEndian.Uint32(tag[:4])) + 4
+		}
+	}
+
+	id_len, hdr_len := 4, 10
+	if version == 2 {
+		id_len, hdr_len = 3, 6
+	}
+	for pos+hdr_len <= len(tag) {
+		id := string(tag[pos : pos+id_len])
+		if id[0] == 0 {
+			break
+		}
+		var frame_len int
+		switch version {
+		case 2:
+			frame_len = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 3:
+			frame_len = int(binary.BigEndian.Uint32(tag[pos+4 : pos+8]))
+		default:
+			frame_len = int(syncsafe(tag[pos+4 : pos+8]))
+		}
+		pos += hdr_len
+		if frame_len < 0 || pos+frame_len > len(tag) {
+			break
+		}
+		fn(id, tag[pos:pos+frame_len])
+		pos += frame_len
+	}
+	return int64(size) + 10
+}
+
+/**
+ * Parses the fixed 128 byte ID3v1 tag at the end of the file, only filling
+ * in fields the ID3v2 tag left empty
+ */
+func read_id3v1(file io.ReaderAt, size int64, info *SongInfo) {
+	if size < 128 {
+		return
+	}
+	tag := make([]byte, 128)
+	if _, err := file.ReadAt(tag, size-128); err != nil || string(tag[:3]) != "TAG" {
+		return
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(string(bytes.TrimRight(b, "\x00")))
+	}
+	if info.Title == "" {
+		info.Title = field(tag[3:33])
+	}
+	if info.Artist == "" {
+		info.Artist = field(tag[33:63])
+	}
+	if info.Album == "" {
+		info.Album = field(tag[63:93])
+	}
+	if info.Year == "" {
+		info.Year = field(tag[93:97])
+	}
+	if info.Genre == "" && int(tag[127]) < len(id3_genres) {
+		info.Genre = id3_genres[tag[127]]
+	}
+	// ID3v1.1 keeps the track in the last byte of the comment
+	if info.Track == 0 && tag[125] == 0 {
+		info.Track = int(tag[126])
+	}
+}
+
+/**
+ * @param number a track or disc number tag, e.g. "3" or "3/12"
+ * @return the number, 0 if there is none
+ */
+func parse_track_number(number string) int {
+	if slash := strings.Index(number, "/"); slash >= 0 {
+		number = number[:slash]
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+/**
+ * @param genre a TCON frame: a genre name, or an ID3v1 genre number
+ * written as "17" or "(17)", optionally followed by a refinement
+ * @return the genre's name
+ */
+func id3_genre(genre string) string {
+	genre = strings.TrimSpace(genre)
+	number := strings.TrimSuffix(strings.TrimPrefix(genre, "("), ")")
+	if strings.HasPrefix(genre, "(") {
+		end := strings.Index(genre, ")")
+		if rest := strings.TrimSpace(genre[end+1:]); rest != "" {
+			return rest
+		}
+		number = genre[1:end]
+	}
+	if n, err := strconv.Atoi(number); err == nil {
+		if n >= 0 && n < len(id3_genres) {
+			return id3_genres[n]
+		}
+		return ""
+	}
+	return genre
+}
+
+/**
+ * Works out the duration from the first mp3 frame: the Xing/Info frame
+ * count for VBR files, otherwise the bitrate and the size of the audio
+ * @param tag_len length of the ID3v2 tag in front of the audio
+ * @param size size of the whole file
+ */
+func mp3_duration(file io.ReaderAt, tag_len int64, size int64) time.Duration {
+	buf := make([]byte, 64*1024)
+	n, _ := file.ReadAt(buf, tag_len)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version := (buf[i+1] >> 3) & 0x03
+		layer := (buf[i+1] >> 1) & 0x03
+		bitrate_idx := buf[i+2] >> 4
+		rate_idx := (buf[i+2] >> 2) & 0x03
+		if version == 1 || layer != 1 || bitrate_idx == 0 || bitrate_idx == 15 || rate_idx == 3 {
+			continue
+		}
+		mpeg1 := version == 3
+		table := 1
+		if mpeg1 {
+			table = 0
+		}
+		bitrate := mp3_bitrates[table][bitrate_idx] * 1000
+		sample_rate := mp3_sample_rates[version][rate_idx]
+		mono := buf[i+3]>>6 == 3
+
+		samples_per_frame := 576
+		side_info := 17
+		if mpeg1 {
+			samples_per_frame = 1152
+			side_info = 32
+		}
+		if mono {
+			side_info /= 2
+			if !mpeg1 {
+				side_info = 9
+			}
+		}
+
+		xing := i + 4 + side_info
+		if xing+12 <= len(buf) {
+			marker := string(buf[xing : xing+4])
+			xing_flags := binary.BigEndian.Uint32(buf[xing+4 : xing+8])
+			if (marker == "Xing" || marker == "Info") && xing_flags&1 != 0 {
+				frames := int64(binary.BigEndian.Uint32(buf[xing+8 : xing+12]))
+				return time.Duration(frames*int64(samples_per_frame)) * time.Second / time.Duration(sample_rate)
+			}
+		}
+		audio_len := size - tag_len - int64(i)
+		return time.Duration(audio_len*8) * time.Second / time.Duration(bitrate)
+	}
+	return 0
+}
+
+/**
+ * @return the value of a 4 byte syncsafe integer (7 bits per byte)
+ */
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+/**
+ * Decodes the body of an ID3v2 text frame according to its encoding byte
+ */
+func decode_text_frame(body []byte) string {
+	s := decode_text(body)
+	if end := strings.IndexRune(s, 0); end >= 0 {
+		s = s[:end]
+	}
+	return strings.TrimSpace(s)
+}
+
+/**
+ * Decodes a TXXX frame: a description and a value
+ * @param body the frame body, starting with its encoding byte
+ * @return the description and the value
+ */
+func decode_user_text_frame(body []byte) (string, string) {
+	s := decode_text(body)
+	end := strings.IndexRune(s, 0)
+	if end < 0 {
+		return strings.TrimSpace(s), ""
+	}
+	// in UTF-16 the value has its own byte order mark
+	value := strings.TrimPrefix(s[end+1:], "\uFEFF")
+	if next := strings.IndexRune(value, 0); next >= 0 {
+		value = value[:next]
+	}
+	return strings.TrimSpace(s[:end]), strings.TrimSpace(value)
+}
+
+/**
+ * @param body a text frame body, starting with its encoding byte
+ * @return the text, every string in it, each ended by a NUL
+ */
+func decode_text(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	enc, text := body[0], body[1:]
+	var s string
+	switch enc {
+	case 1, 2:
+		big_endian := enc == 2
+		if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+			big_endian, text = true, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xFF && text[1] == 0xFE {
+			big_endian, text = false, text[2:]
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			if big_endian {
+				units = append(units, uint16(text[i])<<8|uint16(text[i+1]))
+			} else {
+				units = append(units, uint16(text[i+1])<<8|uint16(text[i]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s = string(text)
+	default:
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	}
+	return s
+}
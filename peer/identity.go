@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The peer's identity: an ed25519 key pair made the first time it is
+ * needed and kept in ~/.torero, so the peer can be known, and followed,
+ * whatever address it serves on. Its identity key is the public half, in
+ * hex; the peer proves it holds the private half by signing the challenge
+ * in a LIBRARY or a PLAY, and signs its announcements to the tracker with
+ * it, so no other peer can announce songs as this one
+ */
+
+var (
+	identity_once sync.Once
+	identity      ed25519.PrivateKey
+	identity_err  error
+)
+
+/**
+ * @return the path of the file the identity's private key is kept in
+ */
+func identity_path() string {
+	return filepath.Join(torero_dir(), "identity.key")
+}
+
+/**
+ * @return the peer's identity, made and saved the first time, or an
+ * error if it can't be read or saved
+ */
+func peer_identity() (ed25519.PrivateKey, error) {
+	identity_once.Do(func() {
+		identity, identity_err = load_identity(identity_path())
+	})
+	return identity, identity_err
+}
+
+/**
+ * Reads the identity kept in a file, making one and saving it there if
+ * there is none yet
+ * @param path the file, holding the private key's seed in hex
+ * @return the identity
+ */
+func load_identity(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s isn't an identity key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// only the owner may read it: whoever has it can pass for this peer
+	if err = os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/**
+ * @return the peer's identity key, or nil if it has no identity
+ */
+func identity_key() []byte {
+	key, err := peer_identity()
+	if err != nil {
+		return nil
+	}
+	return key.Public().(ed25519.PublicKey)
+}
+
+/**
+ * @param key an identity key
+ * @return the key as typed and shown, in hex
+ */
+func format_key(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+/**
+ * Signs a message with the peer's identity, leaving it unsigned if the
+ * peer has none
+ * @param msg the message, as it will be sent
+ * @param challenge what the receiver asked to have signed along with it,
+ * nil for none
+ */
+func sign_msg(msg *tsp.Msg, challenge []byte) {
+	key, err := peer_identity()
+	if err != nil {
+		return
+	}
+	tsp.Sign(msg, key, challenge)
+}
+
+/**
+ * @param key an identity key
+ * @return the fingerprint a peer is shown by in lists: the first digits
+ * of its key, which `friends follow` takes as well
+ */
+func fingerprint(key []byte) string {
+	return short_key(format_key(key))
+}
+
+/**
+ * @param key an identity key in hex
+ * @return its first few digits, enough to tell peers apart in a list
+ */
+func short_key(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
+
+/**
+ * @param arg an identity key as typed
+ * @return the key, or an error if it isn't one
+ */
+func parse_key(arg string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(arg))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected an identity key of %d hex digits, got %q",
+			2*ed25519.PublicKeySize, arg)
+	}
+	return key, nil
+}
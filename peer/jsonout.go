@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * JSON output. With --json, list, search, info, status, history and top
+ * print one JSON document instead of their text, for scripts and other
+ * tools to read. Durations are in seconds and times in RFC 3339. Errors
+ * are still printed as text, with the usual exit status
+ */
+
+/**
+ * A song as the commands print it with --json
+ */
+type JSONSong struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album,omitempty"`
+	Genre  string `json:"genre,omitempty"`
+	// in seconds, 0 if unknown
+	Duration float64 `json:"duration"`
+	Format   string  `json:"format"`
+	Peers    int     `json:"peers"`
+	// other encodes of the song the list hides behind this one
+	Encodes  int  `json:"encodes,omitempty"`
+	Stars    int  `json:"stars,omitempty"`
+	Favorite bool `json:"favorite,omitempty"`
+}
+
+/**
+ * A page of the master list, as list prints it with --json
+ */
+type JSONList struct {
+	// seconds since the list was fetched from the tracker
+	Age   float64    `json:"age"`
+	Page  int        `json:"page"`
+	Pages int        `json:"pages"`
+	Total int        `json:"total"`
+	Songs []JSONSong `json:"songs"`
+}
+
+/**
+ * A peer serving a song, and the file it serves it from
+ */
+type JSONSource struct {
+	Peer     string `json:"peer"`
+	Filename string `json:"filename"`
+}
+
+/**
+ * A song's details, as info prints them with --json. The details come
+ * from the file, from a peer serving it, unless none answered
+ */
+type JSONSongInfo struct {
+	JSONSong
+	Year    string       `json:"year,omitempty"`
+	Codec   string       `json:"codec,omitempty"`
+	Bitrate int          `json:"bitrate,omitempty"`
+	Size    int64        `json:"size,omitempty"`
+	Details bool         `json:"details"`
+	Sources []JSONSource `json:"sources"`
+}
+
+/**
+ * What is playing, as status prints it with --json
+ */
+type JSONStatus struct {
+	Playing bool      `json:"playing"`
+	Song    *JSONSong `json:"song,omitempty"`
+	// seconds into the song
+	Elapsed   float64 `json:"elapsed"`
+	Paused    bool    `json:"paused"`
+	Volume    int     `json:"volume"`
+	Shuffle   bool    `json:"shuffle"`
+	Repeat    string  `json:"repeat"`
+	Recording bool    `json:"recording"`
+	// seconds until the sleep timer stops playback, absent with none set
+	Sleep *float64 `json:"sleep,omitempty"`
+}
+
+/**
+ * A play, as history prints it with --json
+ */
+type JSONPlay struct {
+	Song     JSONSong  `json:"song"`
+	PlayedAt time.Time `json:"played_at"`
+	// seconds of it heard
+	Listened  float64 `json:"listened"`
+	Completed bool    `json:"completed"`
+	Peer      string  `json:"peer,omitempty"`
+}
+
+/**
+ * A song played often, as top prints it with --json
+ */
+type JSONPlayCount struct {
+	Song     JSONSong `json:"song"`
+	Plays    int      `json:"plays"`
+	Listened float64  `json:"listened"`
+}
+
+/**
+ * Writes a value as indented JSON
+ * @param w where it is written
+ * @param v the value
+ */
+func write_json(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+/**
+ * @param song a master list entry
+ * @param ratings the ratings of the songs, by ID
+ * @return the song as printed with --json
+ */
+func json_song(song tsp.SongEntry, ratings map[int]Rating) JSONSong {
+	entry := JSONSong{
+		ID:       song.ID,
+		Title:    song.Title,
+		Artist:   song.Artist,
+		Album:    song.Album,
+		Genre:    song.Genre,
+		Duration: song.Duration.Seconds(),
+		Format:   tsp.FORMAT_MP3,
+		Peers:    len(song.Sources),
+		Stars:    ratings[song.ID].Stars,
+		Favorite: ratings[song.ID].Favorite,
+	}
+	if len(song.Sources) > 0 && song.Sources[0].Format != "" {
+		entry.Format = song.Sources[0].Format
+	}
+	return entry
+}
+
+/**
+ * @param list songs
+ * @param encodes how many near-duplicates each song stands for, by ID
+ * @return the songs as printed with --json
+ */
+func json_songs(list []tsp.SongEntry, encodes map[int]int) []JSONSong {
+	ratings := song_ratings()
+	songs := make([]JSONSong, 0, len(list))
+	for _, song := range list {
+		entry := json_song(song, ratings)
+		entry.Encodes = encodes[song.ID]
+		songs = append(songs, entry)
+	}
+	return songs
+}
+
+/**
+ * Writes songs as a JSON array, e.g. search results
+ * @param w where they are written
+ * @param list the songs
+ */
+func write_json_songs(w io.Writer, list []tsp.SongEntry) {
+	write_json(w, json_songs(list, nil))
+}
+
+/**
+ * Writes one page of the master list as JSON, like write_list_page
+ * @param w where the page is written
+ * @param list the master list
+ * @param age how long ago it was fetched
+ * @param order one of the SORT_ orders
+ * @param page the page wanted, from 1
+ * @param size songs per page, 0 for every song
+ * @return an error if there is no such page
+ */
+func write_json_list(w io.Writer, list []tsp.SongEntry, age time.Duration, order string, page int, size int) error {
+	list, encodes := hide_duplicates(list)
+	songs, pages := page_of(sort_songs(list, order), page, size)
+	if page < 1 || page > pages {
+		return fmt.Errorf("no page %d, there are %d", page, pages)
+	}
+	write_json(w, JSONList{
+		Age:   age.Seconds(),
+		Page:  page,
+		Pages: pages,
+		Total: len(list),
+		Songs: json_songs(songs, encodes),
+	})
+	return nil
+}
+
+/**
+ * Writes a song's details as JSON, like write_song_info
+ * @param w where they are written
+ * @param song the master list entry of the song
+ * @param details what a peer serving it read from the file
+ * @param ok false if no peer answered, leaving details empty
+ */
+func write_json_info(w io.Writer, song tsp.SongEntry, details tsp.SongDetails, ok bool) {
+	info := JSONSongInfo{
+		JSONSong: json_song(song, song_ratings()),
+		Details:  ok,
+		Sources:  make([]JSONSource, 0, len(song.Sources)),
+	}
+	if ok {
+		info.Title, info.Artist, info.Album = details.Title, details.Artist, details.Album
+		info.Duration = details.Duration.Seconds()
+		info.Year, info.Codec, info.Bitrate, info.Size = details.Year, details.Codec, details.Bitrate, details.Size
+	}
+	for _, source := range song.Sources {
+		info.Sources = append(info.Sources, JSONSource{source.PeerAddr, source.Filename})
+	}
+	write_json(w, info)
+}
+
+/**
+ * Writes what is playing as JSON, like now_playing_line
+ * @param w where it is written
+ */
+func write_json_status(w io.Writer) {
+	status := JSONStatus{
+		Paused:    playback.Paused(),
+		Volume:    get_volume(),
+		Recording: is_recording(),
+	}
+	status.Shuffle, status.Repeat = queue.Modes()
+	if song, elapsed, _, ok := playback.Position(); ok {
+		entry := json_song(song, song_ratings())
+		status.Playing, status.Song, status.Elapsed = true, &entry, elapsed.Seconds()
+	}
+	if left, ok := sleep_left(); ok {
+		secs := left.Seconds()
+		status.Sleep = &secs
+	}
+	write_json(w, status)
+}
+
+/**
+ * Writes plays as JSON, like write_history
+ * @param w where they are written
+ * @param entries the plays, newest first
+ */
+func write_json_history(w io.Writer, entries []HistoryEntry) {
+	ratings := song_ratings()
+	plays := make([]JSONPlay, 0, len(entries))
+	for _, entry := range entries {
+		plays = append(plays, JSONPlay{
+			Song:      json_song(entry.Song, ratings),
+			PlayedAt:  entry.PlayedAt,
+			Listened:  entry.Listened.Seconds(),
+			Completed: entry.Completed,
+			Peer:      entry.Peer,
+		})
+	}
+	write_json(w, plays)
+}
+
+/**
+ * Writes the songs played most as JSON, like write_most_played
+ * @param w where they are written
+ * @param counts the songs, most played first
+ */
+func write_json_most_played(w io.Writer, counts []PlayCount) {
+	ratings := song_ratings()
+	list := make([]JSONPlayCount, 0, len(counts))
+	for _, count := range counts {
+		list = append(list, JSONPlayCount{json_song(count.Song, ratings), count.Plays, count.Listened.Seconds()})
+	}
+	write_json(w, list)
+}
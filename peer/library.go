@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const LIBRARY_SCHEMA = `CREATE TABLE IF NOT EXISTS songs (
+	path       TEXT PRIMARY KEY,
+	dir        TEXT NOT NULL,
+	filename   TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	artist     TEXT NOT NULL,
+	album      TEXT NOT NULL,
+	genre      TEXT NOT NULL DEFAULT '',
+	year       TEXT NOT NULL,
+	duration   INTEGER NOT NULL,
+	bitrate    INTEGER NOT NULL,
+	size       INTEGER NOT NULL,
+	mtime      INTEGER NOT NULL,
+	hash       TEXT NOT NULL,
+	format     TEXT NOT NULL,
+	gain       REAL NOT NULL DEFAULT 0,
+	play_count INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS songs_dir ON songs (dir);
+CREATE TABLE IF NOT EXISTS history (
+	played_at INTEGER NOT NULL,
+	song_id   INTEGER NOT NULL,
+	title     TEXT NOT NULL,
+	artist    TEXT NOT NULL,
+	album     TEXT NOT NULL,
+	duration  INTEGER NOT NULL,
+	hash      TEXT NOT NULL,
+	peer      TEXT NOT NULL,
+	listened  INTEGER NOT NULL,
+	completed INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS history_song ON history (song_id);
+CREATE TABLE IF NOT EXISTS ratings (
+	song_id  INTEGER PRIMARY KEY,
+	title    TEXT NOT NULL,
+	artist   TEXT NOT NULL,
+	stars    INTEGER NOT NULL DEFAULT 0,
+	favorite INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS bookmarks (
+	hash     TEXT PRIMARY KEY,
+	song_id  INTEGER NOT NULL,
+	title    TEXT NOT NULL,
+	artist   TEXT NOT NULL,
+	byte_offset INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	saved_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scrobbles (
+	id        INTEGER PRIMARY KEY,
+	service   TEXT NOT NULL,
+	played_at INTEGER NOT NULL,
+	title     TEXT NOT NULL,
+	artist    TEXT NOT NULL,
+	album     TEXT NOT NULL,
+	duration  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS friends (
+	key         TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	addr        TEXT NOT NULL,
+	followed_at INTEGER NOT NULL,
+	checked_at  INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS friend_songs (
+	key      TEXT NOT NULL,
+	hash     TEXT NOT NULL,
+	title    TEXT NOT NULL,
+	artist   TEXT NOT NULL,
+	added_at INTEGER NOT NULL,
+	new      INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (key, hash)
+);
+CREATE TABLE IF NOT EXISTS access (
+	path  TEXT PRIMARY KEY,
+	level TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS access_grants (
+	path TEXT NOT NULL,
+	key  TEXT NOT NULL,
+	PRIMARY KEY (path, key)
+);
+CREATE TABLE IF NOT EXISTS blocked (
+	key        TEXT PRIMARY KEY,
+	reason     TEXT NOT NULL,
+	blocked_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS transfers (
+	started_at INTEGER NOT NULL,
+	upload     INTEGER NOT NULL,
+	title      TEXT NOT NULL,
+	artist     TEXT NOT NULL,
+	hash       TEXT NOT NULL,
+	peer       TEXT NOT NULL,
+	key        TEXT NOT NULL,
+	bytes      INTEGER NOT NULL,
+	took       INTEGER NOT NULL,
+	from_start INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transfers_peer ON transfers (key, peer);`
+
+// the local music library, nil if it couldn't be opened, in which case
+// every scan reads every song
+var library *sql.DB
+
+/**
+ * @return the path of the library database
+ */
+func library_path() string {
+	return filepath.Join(torero_dir(), "library.db")
+}
+
+/**
+ * Opens the library database, creating it if it doesn't exist yet
+ * @return an error if it can't be opened
+ */
+func open_library() error {
+	if err := os.MkdirAll(torero_dir(), 0755); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", library_path())
+	if err != nil {
+		return err
+	}
+	if _, err = db.Exec(LIBRARY_SCHEMA); err != nil {
+		db.Close()
+		return err
+	}
+	// libraries from before genres: add the column, and have every song
+	// read again to fill it in
+	if _, err = db.Exec("ALTER TABLE songs ADD COLUMN genre TEXT NOT NULL DEFAULT ''"); err == nil {
+		db.Exec("UPDATE songs SET mtime = 0")
+	}
+	// and from before track gains
+	if _, err = db.Exec("ALTER TABLE songs ADD COLUMN gain REAL NOT NULL DEFAULT 0"); err == nil {
+		db.Exec("UPDATE songs SET mtime = 0")
+	}
+	library = db
+	return nil
+}
+
+func close_library() {
+	if library != nil {
+		library.Close()
+	}
+}
+
+/**
+ * Looks a local song up in the library, reading it (and storing what was
+ * read) only if it is new or it or its .info file changed since it was
+ * stored. A song that no longer exists is dropped from the library
+ * @param dir_name directory of the local songs
+ * @param name the song's filename within it
+ * @return the song's entry, without ID or PeerAddr; an error satisfying
+ * os.IsNotExist if the file is gone
+ */
+func library_song(dir_name string, name string) (tsp.SongEntry, error) {
+	song_path, err := filepath.Abs(filepath.Join(dir_name, name))
+	if err != nil {
+		return tsp.SongEntry{}, err
+	}
+	stat, err := os.Stat(song_path)
+	if err != nil {
+		if library != nil && os.IsNotExist(err) {
+			library.Exec("DELETE FROM songs WHERE path = ?", song_path)
+		}
+		return tsp.SongEntry{}, err
+	}
+	mtime := stat.ModTime()
+	if info_stat, err := os.Stat(song_path + ".info"); err == nil && info_stat.ModTime().After(mtime) {
+		mtime = info_stat.ModTime()
+	}
+
+	if library == nil {
+		info, err := read_local_info(dir_name, name)
+		if err != nil {
+			return tsp.SongEntry{}, err
+		}
+		return new_song_entry(info), nil
+	}
+	if info, ok := stored_song(song_path, stat.Size(), mtime); ok {
+		return new_song_entry(info), nil
+	}
+	info, err := read_local_info(dir_name, name)
+	if err != nil {
+		return tsp.SongEntry{}, err
+	}
+	store_song(song_path, info, mtime)
+	return new_song_entry(info), nil
+}
+
+/**
+ * @param song_path absolute path of the song
+ * @param size the song's size now
+ * @param mtime when the song or its .info file last changed
+ * @return the stored metadata, and false if there is none or the file
+ * changed since it was stored
+ */
+func stored_song(song_path string, size int64, mtime time.Time) (*SongInfo, bool) {
+	info := &SongInfo{}
+	var duration, stored_mtime int64
+	err := library.QueryRow(`SELECT filename, title, artist, album, genre, year, duration, bitrate, size, mtime, hash, format, gain
+		FROM songs WHERE path = ?`, song_path).Scan(&info.Filename, &info.Title, &info.Artist, &info.Album,
+		&info.Genre, &info.Year, &duration, &info.Bitrate, &info.Size, &stored_mtime, &info.Hash, &info.Format,
+		&info.Gain)
+	if err != nil || info.Size != size || stored_mtime != mtime.UnixNano() {
+		return nil, false
+	}
+	info.Duration = time.Duration(duration)
+	return info, true
+}
+
+/**
+ * Saves a song's metadata to the library, replacing what was stored for
+ * it before but keeping its play count
+ * @param song_path absolute path of the song
+ * @param info the metadata read from the song
+ * @param mtime when the song or its .info file last changed
+ */
+func store_song(song_path string, info *SongInfo, mtime time.Time) {
+	_, err := library.Exec(`INSERT INTO songs
+		(path, dir, filename, title, artist, album, genre, year, duration, bitrate, size, mtime, hash, format, gain)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET filename = excluded.filename, title = excluded.title,
+		artist = excluded.artist, album = excluded.album, genre = excluded.genre, year = excluded.year,
+		duration = excluded.duration, bitrate = excluded.bitrate, size = excluded.size,
+		mtime = excluded.mtime, hash = excluded.hash, format = excluded.format,
+		gain = excluded.gain`,
+		song_path, filepath.Dir(song_path), info.Filename, info.Title, info.Artist, info.Album, info.Genre, info.Year,
+		int64(info.Duration), info.Bitrate, info.Size, mtime.UnixNano(), info.Hash, info.Format,
+		info.Gain)
+	if err != nil {
+		slog.Error("can't save song to the library", "file", info.Filename, "err", err)
+	}
+}
+
+/**
+ * Drops songs that have left a directory from the library
+ * @param dir_name directory of the local songs
+ * @param names the filenames of every song still in it
+ */
+func prune_library(dir_name string, names map[string]bool) {
+	if library == nil {
+		return
+	}
+	dir, err := filepath.Abs(dir_name)
+	if err != nil {
+		return
+	}
+	rows, err := library.Query("SELECT path, filename FROM songs WHERE dir = ?", dir)
+	if err != nil {
+		slog.Error("can't read the library", "err", err)
+		return
+	}
+	var gone []string
+	for rows.Next() {
+		var song_path, name string
+		if rows.Scan(&song_path, &name) == nil && !names[name] {
+			gone = append(gone, song_path)
+		}
+	}
+	rows.Close()
+	for _, song_path := range gone {
+		library.Exec("DELETE FROM songs WHERE path = ?", song_path)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The master list is kept on disk between runs, so PLAY and INFO work as
+ * soon as the peer starts. A list younger than list_ttl_secs is used as
+ * is; an older one is still used, but fetched again in the background,
+ * or in the foreground when it is asked for by LIST
+ */
+
+// how long a master list is used before it is fetched again, unless
+// list_ttl_secs is set
+const DEFAULT_LIST_TTL = 5 * time.Minute
+
+/**
+ * The master list as kept on disk
+ */
+type ListCacheFile struct {
+	Fetched time.Time
+	// the tracker it came from, empty if it was put together from peers
+	Tracker string
+	// the registry and version it is of, for LIST_SINCE; empty if it didn't
+	// come from a LIST_SINCE
+	Epoch   string
+	Version int64
+	Songs   []tsp.SongEntry
+}
+
+// when the master list was fetched, zero if it never was; guarded by
+// master_mutex
+var master_list_time time.Time
+
+/**
+ * @return the path of the master list kept between runs
+ */
+func list_cache_path() string {
+	return filepath.Join(torero_dir(), "master_list.json")
+}
+
+/**
+ * @return how long a master list is used before it is fetched again
+ */
+func list_ttl() time.Duration {
+	return time.Duration(config.ListTTLSecs) * time.Second
+}
+
+/**
+ * Takes the master list kept from the last run, if it came from the
+ * tracker this run uses
+ */
+func load_list_cache() {
+	data, err := ioutil.ReadFile(list_cache_path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("can't read the cached master list", "path", list_cache_path(), "err", err)
+		}
+		return
+	}
+	var cached ListCacheFile
+	if err = json.Unmarshal(data, &cached); err != nil {
+		slog.Warn("can't read the cached master list", "path", list_cache_path(), "err", err)
+		return
+	}
+	if cached.Tracker != tracker_addr {
+		return
+	}
+	master_mutex.Lock()
+	master_list = cached.Songs
+	master_list_time = cached.Fetched
+	master_mutex.Unlock()
+	if cached.Epoch != "" {
+		list_cache_mutex.Lock()
+		list_epoch, list_version = cached.Epoch, cached.Version
+		list_cache = make(map[int]tsp.SongEntry, len(cached.Songs))
+		for _, song := range cached.Songs {
+			list_cache[song.ID] = song
+		}
+		list_cache_mutex.Unlock()
+	}
+}
+
+/**
+ * Keeps a freshly fetched master list on disk for the next run
+ * @param songs the master list
+ * @param from_tracker whether it is the tracker's list, rather than one put
+ * together from peers
+ */
+func save_list_cache(songs []tsp.SongEntry, from_tracker bool) {
+	cached := ListCacheFile{Fetched: time.Now(), Tracker: tracker_addr, Songs: songs}
+	if from_tracker {
+		list_cache_mutex.Lock()
+		cached.Epoch, cached.Version = list_epoch, list_version
+		list_cache_mutex.Unlock()
+	}
+	data, err := json.Marshal(cached)
+	if err == nil {
+		err = os.MkdirAll(torero_dir(), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(list_cache_path(), data, 0644)
+	}
+	if err != nil {
+		slog.Warn("can't cache the master list", "path", list_cache_path(), "err", err)
+	}
+}
+
+/**
+ * @return how long ago the master list was fetched, and false if it never
+ * was
+ */
+func list_age() (time.Duration, bool) {
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	if master_list_time.IsZero() {
+		return 0, false
+	}
+	return time.Since(master_list_time), true
+}
+
+/**
+ * @return whether the master list is missing or older than list_ttl()
+ */
+func list_stale() bool {
+	age, ok := list_age()
+	return !ok || age > list_ttl()
+}
+
+/**
+ * Fetches the master list again in the background if it is stale
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func refresh_list(ctx context.Context, args []string) {
+	if !list_stale() {
+		return
+	}
+	go func() {
+		if _, err := load_master_list(ctx, args); err != nil {
+			slog.Debug("can't refresh the master list", "err", err)
+		}
+	}()
+}
+
+/**
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @return the master list, fetched again if it is stale, and how old it
+ * is. If it can't be fetched, the stale list is returned as long as there
+ * is one
+ */
+func current_list(ctx context.Context, args []string) ([]tsp.SongEntry, time.Duration, error) {
+	if !list_stale() {
+		age, _ := list_age()
+		master_mutex.Lock()
+		defer master_mutex.Unlock()
+		return master_list, age, nil
+	}
+	songs, err := load_master_list(ctx, args)
+	if err == nil {
+		return songs, 0, nil
+	}
+	age, ok := list_age()
+	if !ok {
+		return nil, 0, err
+	}
+	slog.Warn("can't refresh the master list, using the cached one", "age", age.Round(time.Second), "err", err)
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	return master_list, age, nil
+}
+
+/**
+ * Writes how old the master list is, above it
+ * @param w where the list is written
+ * @param age how long ago it was fetched
+ */
+func write_list_age(w io.Writer, age time.Duration) {
+	if age < time.Second {
+		fmt.Fprintln(w, "Master list, just fetched:")
+		return
+	}
+	fmt.Fprintf(w, "Master list, fetched %s ago:\n", age.Round(time.Second))
+}
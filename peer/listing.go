@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+// Orders the master list can be listed in
+const (
+	// by ID, the order the tracker lists songs in
+	SORT_ID     = "id"
+	SORT_TITLE  = "title"
+	SORT_ARTIST = "artist"
+	// most recently added first
+	SORT_ADDED = "added"
+	// by the address of the first peer serving each song
+	SORT_PEER = "peer"
+)
+
+// songs listed per page, unless page_size is set
+const DEFAULT_PAGE_SIZE = 20
+
+var sort_orders = []string{SORT_ID, SORT_TITLE, SORT_ARTIST, SORT_ADDED, SORT_PEER}
+
+/**
+ * @param order one of the SORT_ orders
+ * @return an error if it isn't one
+ */
+func check_sort(order string) error {
+	for _, known := range sort_orders {
+		if order == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("sort must be one of %s", strings.Join(sort_orders, ", "))
+}
+
+/**
+ * @param list the songs to sort, left as they are
+ * @param order one of the SORT_ orders
+ * @return a sorted copy of the list
+ */
+func sort_songs(list []tsp.SongEntry, order string) []tsp.SongEntry {
+	sorted := make([]tsp.SongEntry, len(list))
+	copy(sorted, list)
+	var less func(a, b tsp.SongEntry) bool
+	switch order {
+	case SORT_TITLE:
+		less = func(a, b tsp.SongEntry) bool {
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+	case SORT_ARTIST:
+		less = func(a, b tsp.SongEntry) bool {
+			if !strings.EqualFold(a.Artist, b.Artist) {
+				return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+			}
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+	case SORT_ADDED:
+		less = func(a, b tsp.SongEntry) bool {
+			return a.ID > b.ID
+		}
+	case SORT_PEER:
+		less = func(a, b tsp.SongEntry) bool {
+			if first_peer(a) != first_peer(b) {
+				return first_peer(a) < first_peer(b)
+			}
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+	default:
+		less = func(a, b tsp.SongEntry) bool {
+			return a.ID < b.ID
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+/**
+ * @return the serving address of the song's first source, empty if it has
+ * none
+ */
+func first_peer(song tsp.SongEntry) string {
+	if len(song.Sources) == 0 {
+		return ""
+	}
+	return song.Sources[0].PeerAddr
+}
+
+/**
+ * @param list the songs to page through
+ * @param page the page wanted, from 1
+ * @param size songs per page, 0 for a single page with every song
+ * @return the songs on the page, and how many pages there are
+ */
+func page_of(list []tsp.SongEntry, page int, size int) ([]tsp.SongEntry, int) {
+	if size <= 0 {
+		return list, 1
+	}
+	pages := (len(list) + size - 1) / size
+	if pages == 0 {
+		pages = 1
+	}
+	start := (page - 1) * size
+	if start < 0 || start >= len(list) {
+		return nil, pages
+	}
+	end := start + size
+	if end > len(list) {
+		end = len(list)
+	}
+	return list[start:end], pages
+}
+
+/**
+ * Writes one page of the master list, sorted, with a line saying which
+ * page it is if there is more than one
+ * @param w where the page is written
+ * @param list the master list
+ * @param order one of the SORT_ orders
+ * @param page the page wanted, from 1
+ * @param size songs per page, 0 for every song
+ * @return an error if there is no such page
+ */
+func write_list_page(w io.Writer, list []tsp.SongEntry, order string, page int, size int) error {
+	list, encodes := hide_duplicates(list)
+	songs, pages := page_of(sort_songs(list, order), page, size)
+	if page < 1 || page > pages {
+		return fmt.Errorf("no page %d, there are %d", page, pages)
+	}
+	write_songs(w, songs, encodes)
+	if pages > 1 {
+		fmt.Fprintf(w, "Page %d of %d (%d songs)\n", page, pages, len(list))
+	}
+	return nil
+}
+
+/**
+ * @return the list options given on the command line, or else in the
+ * config file, as the daemon takes them after "list": the sort order, page
+ * and page size
+ */
+func list_options() []string {
+	order, size := config.ListSort, config.PageSize
+	if sort_flag != "" {
+		order = sort_flag
+	}
+	if page_size_flag >= 0 {
+		size = page_size_flag
+	}
+	return []string{order, strconv.Itoa(page_flag), strconv.Itoa(size)}
+}
+
+/**
+ * @param args what followed "list" in a control command, see list_options
+ * @return the sort order, page and page size they ask for, the defaults
+ * for any left out
+ */
+func parse_list_options(args []string) (string, int, int, error) {
+	order, page, size := config.ListSort, 1, config.PageSize
+	var err error
+	if len(args) > 0 {
+		order = args[0]
+		err = check_sort(order)
+	}
+	if len(args) > 1 && err == nil {
+		page, err = strconv.Atoi(args[1])
+	}
+	if len(args) > 2 && err == nil {
+		size, err = strconv.Atoi(args[2])
+	}
+	return order, page, size, err
+}
+
+/**
+ * Drops the near-duplicates the tracker flagged from a list (see
+ * tsp.MarkDuplicates), so a song uploaded in several encodes is listed
+ * once. They can still be played by ID, and browse lists them all
+ * @param list the master list
+ * @return the songs to list, and how many encodes each one hides, by ID
+ */
+func hide_duplicates(list []tsp.SongEntry) ([]tsp.SongEntry, map[int]int) {
+	shown := make(map[int]bool, len(list))
+	for _, song := range list {
+		shown[song.ID] = true
+	}
+	kept := make([]tsp.SongEntry, 0, len(list))
+	encodes := make(map[int]int)
+	for _, song := range list {
+		// a song whose stand-in isn't in the list is listed itself
+		if song.DuplicateOf != 0 && shown[song.DuplicateOf] {
+			encodes[song.DuplicateOf]++
+			continue
+		}
+		kept = append(kept, song)
+	}
+	return kept, encodes
+}
+
+/**
+ * LIST from the interactive menu: asks for the order, then pages through
+ * the list until told to stop
+ * @param list the master list
+ */
+func page_through(list []tsp.SongEntry) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	order, _ := ui.Select("Sort by", sort_orders, &input.Options{
+		Default: config.ListSort,
+		Loop:    true,
+	})
+	list, encodes := hide_duplicates(list)
+	sorted := sort_songs(list, order)
+	page := 1
+	for {
+		songs, pages := page_of(sorted, page, config.PageSize)
+		write_songs(os.Stdout, songs, encodes)
+		if pages <= 1 {
+			return
+		}
+		fmt.Printf("Page %d of %d (%d songs)\n", page, pages, len(list))
+		answer, _ := ui.Ask("Enter for the next page, p for the previous, q to stop", &input.Options{})
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "q":
+			return
+		case "p":
+			if page > 1 {
+				page--
+			}
+		default:
+			if page == pages {
+				return
+			}
+			page++
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Lyrics for the song playing. They come from an LRC file beside the
+ * song in the songs or downloads directory, named like the song's file or
+ * "<artist> - <title>.lrc"; failing that from lrclib.net, whose lyrics are
+ * kept under ~/.torero/lyrics so they are only fetched once. LRC lyrics
+ * are time-synced: LYRICS shows the line being sung, and the lines around
+ * it, as the song plays
+ */
+
+const (
+	LYRICS_API = "https://lrclib.net/api/search"
+	// how long lrclib.net has to answer
+	LYRICS_TIMEOUT = 10 * time.Second
+	// lines of synced lyrics shown at once, and how often they are redrawn
+	LYRICS_WINDOW   = 9
+	LYRICS_INTERVAL = 250 * time.Millisecond
+)
+
+// a timestamp starting a line of an LRC file, [mm:ss.xx]
+var lrc_time = regexp.MustCompile(`^\[(\d+):(\d{1,2}(?:[.:]\d{1,3})?)\]`)
+
+// an LRC tag with the offset in ms to move every line by, [offset:+500]
+var lrc_offset = regexp.MustCompile(`^\[offset:\s*([+-]?\d+)\]`)
+
+var lyrics_client = &http.Client{Timeout: LYRICS_TIMEOUT}
+
+/**
+ * One line of lyrics, and when it is sung if they are synced
+ */
+type LyricLine struct {
+	At   time.Duration
+	Text string
+}
+
+/**
+ * A song's lyrics
+ */
+type Lyrics struct {
+	Lines []LyricLine
+	// whether the lines have times
+	Synced bool
+	// where they came from, a file or lrclib.net
+	From string
+}
+
+/**
+ * Parses lyrics, in LRC or plain text
+ * @param text the lyrics
+ * @return the lines, synced if any had a timestamp
+ */
+func parse_lyrics(text string) Lyrics {
+	var lyrics Lyrics
+	var offset time.Duration
+	var plain []LyricLine
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if m := lrc_offset.FindStringSubmatch(line); m != nil {
+			ms, _ := strconv.Atoi(m[1])
+			offset = time.Duration(ms) * time.Millisecond
+			continue
+		}
+		var times []time.Duration
+		for {
+			m := lrc_time.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			minutes, _ := strconv.Atoi(m[1])
+			seconds, _ := strconv.ParseFloat(strings.Replace(m[2], ":", ".", 1), 64)
+			times = append(times, time.Duration(minutes)*time.Minute+time.Duration(seconds*float64(time.Second)))
+			line = line[len(m[0]):]
+		}
+		line = strings.TrimSpace(line)
+		if len(times) == 0 {
+			// other tags, [ar:...], [ti:...], are only metadata
+			if !strings.HasPrefix(line, "[") {
+				plain = append(plain, LyricLine{Text: line})
+			}
+			continue
+		}
+		for _, at := range times {
+			lyrics.Lines = append(lyrics.Lines, LyricLine{At: at, Text: line})
+		}
+	}
+	if len(lyrics.Lines) == 0 {
+		// leading and trailing blank lines aren't worth showing
+		for len(plain) > 0 && plain[0].Text == "" {
+			plain = plain[1:]
+		}
+		for len(plain) > 0 && plain[len(plain)-1].Text == "" {
+			plain = plain[:len(plain)-1]
+		}
+		lyrics.Lines = plain
+		return lyrics
+	}
+	lyrics.Synced = true
+	for i := range lyrics.Lines {
+		// a positive offset shows the lines sooner
+		lyrics.Lines[i].At -= offset
+	}
+	sort.SliceStable(lyrics.Lines, func(i, j int) bool {
+		return lyrics.Lines[i].At < lyrics.Lines[j].At
+	})
+	return lyrics
+}
+
+/**
+ * @return the directory lyrics fetched from lrclib.net are kept in
+ */
+func lyrics_dir() string {
+	return filepath.Join(torero_dir(), "lyrics")
+}
+
+/**
+ * Looks for a song's lyrics: in an LRC file beside it, then among those
+ * fetched before, then on lrclib.net
+ * @param song the song
+ * @param source the file it plays from
+ * @return its lyrics, or an error if there are none
+ */
+func find_lyrics(song tsp.SongEntry, source tsp.SongSource) (Lyrics, error) {
+	var dirs []string
+	if serve_args != nil {
+		dirs = append(dirs, serve_args[2])
+	}
+	dirs = append(dirs, config.Downloads)
+	names := []string{song_file_name(song) + ".lrc"}
+	if source.Filename != "" {
+		base := filepath.Base(source.Filename)
+		names = append([]string{strings.TrimSuffix(base, filepath.Ext(base)) + ".lrc"}, names...)
+	}
+	for _, dir := range dirs {
+		for _, name := range names {
+			if lyrics, err := read_lyrics(filepath.Join(dir, name)); err == nil {
+				return lyrics, nil
+			}
+		}
+	}
+
+	cached := filepath.Join(lyrics_dir(), song_file_name(song))
+	for _, ext := range []string{".lrc", ".txt"} {
+		if lyrics, err := read_lyrics(cached + ext); err == nil {
+			return lyrics, nil
+		}
+	}
+	text, synced, err := fetch_lyrics(song)
+	if err != nil {
+		return Lyrics{}, err
+	}
+	ext := ".txt"
+	if synced {
+		ext = ".lrc"
+	}
+	if err = os.MkdirAll(lyrics_dir(), 0755); err == nil {
+		err = os.WriteFile(cached+ext, []byte(text), 0644)
+	}
+	if err != nil {
+		fmt.Println("can't keep the lyrics: ", err)
+	}
+	lyrics := parse_lyrics(text)
+	lyrics.From = "lrclib.net"
+	return lyrics, nil
+}
+
+/**
+ * @param path an LRC or text file
+ * @return the lyrics in it, or an error if it can't be read or is empty
+ */
+func read_lyrics(path string) (Lyrics, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Lyrics{}, err
+	}
+	lyrics := parse_lyrics(string(content))
+	if len(lyrics.Lines) == 0 {
+		return Lyrics{}, errors.New(path + " is empty")
+	}
+	lyrics.From = path
+	return lyrics, nil
+}
+
+/**
+ * Searches lrclib.net for a song's lyrics, preferring the match closest
+ * in length to the song, and synced lyrics to plain ones
+ * @param song the song
+ * @return the lyrics, in LRC if synced, or an error if there are none
+ */
+func fetch_lyrics(song tsp.SongEntry) (string, bool, error) {
+	query := url.Values{"track_name": {song.Title}, "artist_name": {song.Artist}}
+	req, err := http.NewRequest(http.MethodGet, LYRICS_API+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("User-Agent", "Torero (https://github.com/jamesponwith/Torero-Streaming-Service)")
+	resp, err := lyrics_client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("lrclib.net answered %s", resp.Status)
+	}
+	var results []struct {
+		Duration float64 `json:"duration"`
+		Plain    string  `json:"plainLyrics"`
+		Synced   string  `json:"syncedLyrics"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&results); err != nil {
+		return "", false, err
+	}
+	best, best_score := -1, math.Inf(1)
+	for i, r := range results {
+		if r.Plain == "" && r.Synced == "" {
+			continue
+		}
+		score := math.Abs(r.Duration - song.Duration.Seconds())
+		if r.Synced == "" {
+			// synced lyrics win unless they are for a different cut
+			score += 5
+		}
+		if score < best_score {
+			best, best_score = i, score
+		}
+	}
+	if best < 0 {
+		return "", false, errors.New("no lyrics found for " + song.Title)
+	}
+	if results[best].Synced != "" {
+		return results[best].Synced, true, nil
+	}
+	return results[best].Plain, false, nil
+}
+
+/**
+ * @param lyrics synced lyrics
+ * @param elapsed how far into the song playback is
+ * @return the index of the line being sung, -1 before the first
+ */
+func lyric_index(lyrics Lyrics, elapsed time.Duration) int {
+	return sort.Search(len(lyrics.Lines), func(i int) bool {
+		return lyrics.Lines[i].At > elapsed
+	}) - 1
+}
+
+/**
+ * @param lyrics synced lyrics
+ * @param elapsed how far into the song playback is
+ * @param size how many lines to show
+ * @return the lines around the one being sung, which is marked with "> "
+ */
+func lyric_window(lyrics Lyrics, elapsed time.Duration, size int) []string {
+	current := lyric_index(lyrics, elapsed)
+	start := current - size/2
+	if start > len(lyrics.Lines)-size {
+		start = len(lyrics.Lines) - size
+	}
+	if start < 0 {
+		start = 0
+	}
+	var lines []string
+	for i := start; i < len(lyrics.Lines) && i < start+size; i++ {
+		mark := "  "
+		if i == current {
+			mark = "> "
+		}
+		lines = append(lines, mark+lyrics.Lines[i].Text)
+	}
+	return lines
+}
+
+/**
+ * Writes a song's lyrics, marking the line being sung if they are synced
+ * @param w where they are written
+ * @param lyrics the lyrics
+ * @param elapsed how far into the song playback is
+ */
+func write_lyrics(w io.Writer, lyrics Lyrics, elapsed time.Duration) {
+	if !lyrics.Synced {
+		for _, line := range lyrics.Lines {
+			fmt.Fprintln(w, line.Text)
+		}
+		return
+	}
+	for _, line := range lyric_window(lyrics, elapsed, len(lyrics.Lines)) {
+		fmt.Fprintln(w, line)
+	}
+}
+
+/**
+ * Looks up the lyrics of the song playing
+ * @return the song, its lyrics, and an error if nothing is playing or it
+ * has no lyrics
+ */
+func current_lyrics() (tsp.SongEntry, Lyrics, error) {
+	song, source, playing := playback.Current()
+	if !playing {
+		return song, Lyrics{}, errors.New("Nothing playing.")
+	}
+	lyrics, err := find_lyrics(song, source)
+	return song, lyrics, err
+}
+
+/**
+ * LYRICS from the interactive menu: shows the lyrics of the song playing,
+ * following along as it plays if they are synced, until the user presses
+ * enter
+ */
+func show_lyrics() {
+	song, lyrics, err := current_lyrics()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("%s - %s (lyrics from %s)\n", song.Title, song.Artist, lyrics.From)
+	if !lyrics.Synced {
+		write_lyrics(os.Stdout, lyrics, 0)
+		fmt.Println()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		read_line()
+		close(done)
+	}()
+	fmt.Println("(press enter to return to the menu)")
+	ticker := time.NewTicker(LYRICS_INTERVAL)
+	defer ticker.Stop()
+	// lines the cursor is below the top of the lyrics
+	below := 0
+	for {
+		playing, elapsed, _, ok := playback.Position()
+		if !ok || playing.ID != song.ID {
+			fmt.Println()
+			return
+		}
+		if below > 0 {
+			fmt.Printf("\033[%dA", below)
+		}
+		fmt.Print("\r\033[J" + strings.Join(lyric_window(lyrics, elapsed, LYRICS_WINDOW), "\n"))
+		below = LYRICS_WINDOW - 1
+		select {
+		case <-done:
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Counters and gauges exported on the HTTP gateway's /metrics in the
+ * Prometheus text format. Every field is updated atomically
+ */
+type Metrics struct {
+	ActiveUploads      int64
+	BytesServed        int64
+	BytesReceived      int64
+	TrackerRoundTrips  int64
+	TrackerErrors      int64
+	TrackerNanoseconds int64
+	PlaybackErrors     int64
+	CacheHits          int64
+	CacheMisses        int64
+}
+
+var metrics Metrics
+
+/**
+ * Records one request to the tracker
+ * @param start when the request was sent
+ * @param err what it failed with, if it did
+ */
+func tracker_round_trip(start time.Time, err error) {
+	atomic.AddInt64(&metrics.TrackerRoundTrips, 1)
+	atomic.AddInt64(&metrics.TrackerNanoseconds, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddInt64(&metrics.TrackerErrors, 1)
+	}
+}
+
+/**
+ * A connection to a peer that counts the song data read from it, and
+ * records the transfer once it is closed
+ */
+type CountingConn struct {
+	net.Conn
+	transfer Transfer
+	// bytes read so far, updated atomically
+	read int64
+	once sync.Once
+}
+
+/**
+ * @param conn the connection, the reply header already read
+ * @param transfer the song being fetched, and from whom
+ */
+func NewCountingConn(conn net.Conn, transfer Transfer) *CountingConn {
+	return &CountingConn{Conn: conn, transfer: transfer}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&metrics.BytesReceived, int64(n))
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.transfer.Bytes = atomic.LoadInt64(&c.read)
+		c.transfer.Took = time.Since(c.transfer.Started)
+		record_transfer(c.transfer)
+	})
+	return err
+}
+
+/**
+ * Answers /metrics
+ */
+func write_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric(w, "torero_active_uploads", "gauge", "Songs being streamed to other peers right now.",
+		atomic.LoadInt64(&metrics.ActiveUploads))
+	metric(w, "torero_bytes_served_total", "counter", "Bytes of song data sent to other peers.",
+		atomic.LoadInt64(&metrics.BytesServed))
+	metric(w, "torero_bytes_received_total", "counter", "Bytes of song data received from other peers.",
+		atomic.LoadInt64(&metrics.BytesReceived))
+	metric(w, "torero_tracker_round_trips_total", "counter", "Requests sent to the tracker.",
+		atomic.LoadInt64(&metrics.TrackerRoundTrips))
+	metric(w, "torero_tracker_errors_total", "counter", "Requests to the tracker that failed.",
+		atomic.LoadInt64(&metrics.TrackerErrors))
+	fmt.Fprintf(w, "# HELP torero_tracker_round_trip_seconds_total Time spent on requests to the tracker.\n")
+	fmt.Fprintf(w, "# TYPE torero_tracker_round_trip_seconds_total counter\n")
+	fmt.Fprintf(w, "torero_tracker_round_trip_seconds_total %g\n",
+		time.Duration(atomic.LoadInt64(&metrics.TrackerNanoseconds)).Seconds())
+	metric(w, "torero_playback_errors_total", "counter", "Songs that failed to start or stopped on an error.",
+		atomic.LoadInt64(&metrics.PlaybackErrors))
+	metric(w, "torero_cache_hits_total", "counter", "Songs played from the cache.",
+		atomic.LoadInt64(&metrics.CacheHits))
+	metric(w, "torero_cache_misses_total", "counter", "Songs looked for in the cache and not found.",
+		atomic.LoadInt64(&metrics.CacheMisses))
+	metric(w, "torero_upload_rate_bytes", "gauge", "Bytes of song data sent a second, over the last 10 seconds.",
+		atomic.LoadInt64(&upload_rate))
+	metric(w, "torero_download_rate_bytes", "gauge", "Bytes of song data received a second, over the last 10 seconds.",
+		atomic.LoadInt64(&download_rate))
+	metric(w, "torero_lifetime_bytes_uploaded_total", "counter", "Bytes of songs sent to other peers, across runs.",
+		atomic.LoadInt64(&lifetime.Uploaded))
+	metric(w, "torero_lifetime_bytes_downloaded_total", "counter", "Bytes of songs fetched from other peers, across runs.",
+		atomic.LoadInt64(&lifetime.Downloaded))
+	metric(w, "torero_lifetime_uploads_total", "counter", "Songs sent to other peers from their start, across runs.",
+		atomic.LoadInt64(&lifetime.Uploads))
+	metric(w, "torero_lifetime_downloads_total", "counter", "Songs fetched from other peers from their start, across runs.",
+		atomic.LoadInt64(&lifetime.Downloads))
+}
+
+func metric(w io.Writer, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
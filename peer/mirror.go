@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Mirroring. A peer with mirror set to N keeps copies of the N songs the
+ * tracker says are played or downloaded most, downloading any it doesn't
+ * serve into its songs directory, where the watcher announces them like
+ * any other song. Songs it mirrored that fall out of the top N are
+ * deleted again. Songs it serves itself are never touched
+ */
+
+// how often the mirrored songs are checked against the popular ones
+const MIRROR_INTERVAL = 10 * time.Minute
+
+/**
+ * @return the path of the list of songs this peer mirrored
+ */
+func mirror_path() string {
+	return filepath.Join(torero_dir(), "mirror.json")
+}
+
+/**
+ * Tells the tracker, if there is one, that a song was played or
+ * downloaded, so it counts towards the popular songs and the charts.
+ * Doesn't wait for the tracker
+ * @param song the master list entry of the song
+ */
+func report_play(song tsp.SongEntry) {
+	if tracker_addr == "" {
+		return
+	}
+	var hash []byte
+	for _, source := range song.Sources {
+		if source.Hash != "" {
+			hash = []byte(source.Hash)
+			break
+		}
+	}
+	go func() {
+		if err := send_to_tracker(tsp.NewMsg(tsp.PLAYED, song.ID, hash)); err != nil {
+			slog.Debug("can't report a play to the tracker", "err", err)
+		}
+	}()
+}
+
+/**
+ * Asks the tracker for the songs played or downloaded most
+ * @return the songs, most popular first
+ */
+func fetch_popular() (songs []tsp.SongEntry, err error) {
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	request := tsp.NewMsg(tsp.POPULAR, 0, nil)
+	sign_msg(request, nil)
+	if err = tsp.Encode(tracker, request); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodeSongs(in_msg.Msg)
+}
+
+/**
+ * Keeps the config.Mirror most popular songs mirrored, checking every
+ * MIRROR_INTERVAL
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ */
+func mirror_popular(ctx context.Context, args []string) {
+	ticker := time.NewTicker(MIRROR_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := update_mirror(ctx, args[2]); err != nil {
+			slog.Warn("can't mirror popular songs", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+ * Downloads the popular songs this peer doesn't serve yet, and deletes
+ * mirrored songs that are no longer popular
+ * @param ctx cancelled when the peer shuts down
+ * @param dir_name the songs directory
+ * @return an error if the tracker couldn't be asked
+ */
+func update_mirror(ctx context.Context, dir_name string) error {
+	popular, err := fetch_popular()
+	if err != nil {
+		return retryable("the tracker", err)
+	}
+	if len(popular) > config.Mirror {
+		popular = popular[:config.Mirror]
+	}
+	mirrored := load_mirrored()
+	master_mutex.Lock()
+	own := local_songs
+	master_mutex.Unlock()
+
+	keep := make(map[string]bool)
+	for _, song := range popular {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if local, ok := local_song(own, song); ok {
+			keep[local.Sources[0].Filename] = true
+			continue
+		}
+		if name, taken := file_taken(dir_name, song); taken {
+			slog.Info("not mirroring a song, a different file has its name", "song", song.Title, "file", name)
+			continue
+		}
+		slog.Info("mirroring a popular song", "song", song.Title, "artist", song.Artist)
+		dest, err := download_to(song, dir_name)
+		if err != nil {
+			slog.Warn("can't mirror a song", "song", song.Title, "err", err)
+			continue
+		}
+		name := filepath.Base(dest)
+		mirrored[name] = true
+		keep[name] = true
+		save_mirrored(mirrored)
+	}
+
+	for name := range mirrored {
+		if keep[name] {
+			continue
+		}
+		slog.Info("no longer popular, removing the mirrored song", "file", name)
+		if err := os.Remove(filepath.Join(dir_name, name)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("can't remove a mirrored song", "file", name, "err", err)
+			continue
+		}
+		delete(mirrored, name)
+	}
+	save_mirrored(mirrored)
+	return nil
+}
+
+/**
+ * @param own this peer's songs
+ * @param song a master list entry
+ * @return the entry of the song among own, if this peer serves it
+ */
+func local_song(own []tsp.SongEntry, song tsp.SongEntry) (tsp.SongEntry, bool) {
+	for _, local := range own {
+		if tsp.SameSong(local, song) {
+			return local, true
+		}
+	}
+	return tsp.SongEntry{}, false
+}
+
+/**
+ * Makes sure mirroring a song can't overwrite a file already in the songs
+ * directory
+ * @param dir_name the songs directory
+ * @param song the song to mirror
+ * @return the name of a file in the way, and whether there is one
+ */
+func file_taken(dir_name string, song tsp.SongEntry) (string, bool) {
+	for _, source := range song.Sources {
+		name := download_name(song, source)
+		if _, err := os.Lstat(filepath.Join(dir_name, name)); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+/**
+ * @return the names of the files in the songs directory this peer
+ * mirrored; none if the list can't be read
+ */
+func load_mirrored() map[string]bool {
+	mirrored := make(map[string]bool)
+	content, err := ioutil.ReadFile(mirror_path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("can't read the mirrored songs", "path", mirror_path(), "err", err)
+		}
+		return mirrored
+	}
+	var names []string
+	if err = json.Unmarshal(content, &names); err != nil {
+		slog.Warn("can't read the mirrored songs", "path", mirror_path(), "err", err)
+	}
+	for _, name := range names {
+		mirrored[name] = true
+	}
+	return mirrored
+}
+
+/**
+ * Writes the names of the mirrored files to disk
+ * @param mirrored the names
+ */
+func save_mirrored(mirrored map[string]bool) {
+	names := make([]string, 0, len(mirrored))
+	for name := range mirrored {
+		names = append(names, name)
+	}
+	content, err := json.MarshalIndent(names, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(torero_dir(), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(mirror_path(), content, 0644)
+	}
+	if err != nil {
+		slog.Warn("can't save the mirrored songs", "path", mirror_path(), "err", err)
+	}
+}
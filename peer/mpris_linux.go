@@ -0,0 +1,300 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+/*
+ * MPRIS, the D-Bus interface Linux desktops drive media players through.
+ * The peer takes the name org.mpris.MediaPlayer2.torero on the session
+ * bus, so media keys, the GNOME and KDE media widgets and playerctl can
+ * play, pause, skip and seek it, and show what it is playing. What it
+ * shows is refreshed every MPRIS_POLL
+ */
+
+const (
+	MPRIS_NAME   = "org.mpris.MediaPlayer2.torero"
+	MPRIS_PATH   = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	MPRIS_ROOT   = "org.mpris.MediaPlayer2"
+	MPRIS_PLAYER = "org.mpris.MediaPlayer2.Player"
+	// the track ID MPRIS expects with nothing playing
+	MPRIS_NO_TRACK = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
+	MPRIS_POLL     = time.Second
+)
+
+// MPRIS loop statuses, by repeat mode
+var mpris_loops = map[string]string{REPEAT_OFF: "None", REPEAT_ONE: "Track", REPEAT_ALL: "Playlist"}
+
+/**
+ * The org.mpris.MediaPlayer2 interface: the application
+ */
+type MprisRoot struct {
+	quit func()
+}
+
+func (r *MprisRoot) Raise() *dbus.Error {
+	return nil
+}
+
+func (r *MprisRoot) Quit() *dbus.Error {
+	r.quit()
+	return nil
+}
+
+/**
+ * The org.mpris.MediaPlayer2.Player interface: playback
+ */
+type MprisPlayer struct {
+	ctx  context.Context
+	conn *dbus.Conn
+}
+
+func (m *MprisPlayer) Next() *dbus.Error {
+	play_next(m.ctx, 1)
+	return nil
+}
+
+func (m *MprisPlayer) Previous() *dbus.Error {
+	play_next(m.ctx, -1)
+	return nil
+}
+
+func (m *MprisPlayer) Pause() *dbus.Error {
+	playback.Pause()
+	return nil
+}
+
+func (m *MprisPlayer) PlayPause() *dbus.Error {
+	if _, _, playing := playback.Current(); playing && !playback.Paused() {
+		playback.Pause()
+		return nil
+	}
+	return m.Play()
+}
+
+func (m *MprisPlayer) Stop() *dbus.Error {
+	playback.End()
+	return nil
+}
+
+/**
+ * Resumes a paused song, or with nothing playing, plays the queue's song
+ */
+func (m *MprisPlayer) Play() *dbus.Error {
+	if _, _, playing := playback.Current(); playing {
+		playback.Resume()
+		return nil
+	}
+	song, ok := queue.Current()
+	if !ok {
+		play_next(m.ctx, 1)
+		return nil
+	}
+	if err := start_song(m.ctx, song, 0, true); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+/**
+ * Seek over D-Bus, renamed where it's exported: go vet takes any Go
+ * method named Seek for io.Seeker's
+ * @param offset microseconds to move, negative to go back
+ */
+func (m *MprisPlayer) SeekBy(offset int64) *dbus.Error {
+	seek_current(m.ctx, int(offset/int64(time.Second/time.Microsecond)))
+	m.seeked()
+	return nil
+}
+
+/**
+ * @param track the track the position is in, which must be the one
+ * playing
+ * @param position microseconds into it
+ */
+func (m *MprisPlayer) SetPosition(track dbus.ObjectPath, position int64) *dbus.Error {
+	song, elapsed, _, ok := playback.Position()
+	if !ok || track != mpris_track_id(song.ID) {
+		return nil
+	}
+	target := time.Duration(position) * time.Microsecond
+	seek_current(m.ctx, int((target - elapsed).Seconds()))
+	m.seeked()
+	return nil
+}
+
+func (m *MprisPlayer) OpenUri(uri string) *dbus.Error {
+	return dbus.MakeFailedError(fmt.Errorf("opening URIs isn't supported"))
+}
+
+/**
+ * Tells MPRIS clients the position jumped
+ */
+func (m *MprisPlayer) seeked() {
+	if _, elapsed, _, ok := playback.Position(); ok {
+		m.conn.Emit(MPRIS_PATH, MPRIS_PLAYER+".Seeked", elapsed.Microseconds())
+	}
+}
+
+/**
+ * @param id a song ID
+ * @return the MPRIS track ID of the song
+ */
+func mpris_track_id(id int) dbus.ObjectPath {
+	return dbus.ObjectPath(fmt.Sprintf("/org/torero/track/%d", id))
+}
+
+/**
+ * @return what MPRIS shows of the song playing
+ */
+func mpris_metadata() map[string]dbus.Variant {
+	song, _, playing := playback.Current()
+	if !playing {
+		return map[string]dbus.Variant{"mpris:trackid": dbus.MakeVariant(MPRIS_NO_TRACK)}
+	}
+	metadata := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(mpris_track_id(song.ID)),
+		"mpris:length":  dbus.MakeVariant(song.Duration.Microseconds()),
+		"xesam:title":   dbus.MakeVariant(song.Title),
+		"xesam:artist":  dbus.MakeVariant([]string{song.Artist}),
+		"xesam:album":   dbus.MakeVariant(song.Album),
+	}
+	if song.Genre != "" {
+		metadata["xesam:genre"] = dbus.MakeVariant([]string{song.Genre})
+	}
+	return metadata
+}
+
+/**
+ * @return the MPRIS playback status: Playing, Paused or Stopped
+ */
+func mpris_status() string {
+	if _, _, playing := playback.Current(); !playing {
+		return "Stopped"
+	}
+	if playback.Paused() {
+		return "Paused"
+	}
+	return "Playing"
+}
+
+/**
+ * Serves MPRIS on the session bus until ctx is cancelled. Without a
+ * session bus, e.g. on a headless server, it quietly does nothing
+ * @param ctx cancelled when the peer shuts down
+ * @param quit shuts the peer down, for the Quit method
+ */
+func serve_mpris(ctx context.Context, quit func()) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		slog.Debug("no session bus, not serving MPRIS", "err", err)
+		return
+	}
+	defer conn.Close()
+	reply, err := conn.RequestName(MPRIS_NAME, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		slog.Warn("can't take the MPRIS name, another peer may have it", "name", MPRIS_NAME, "err", err)
+		return
+	}
+	player := &MprisPlayer{ctx: ctx, conn: conn}
+	if err = conn.Export(&MprisRoot{quit: quit}, MPRIS_PATH, MPRIS_ROOT); err == nil {
+		err = conn.ExportWithMap(player, map[string]string{"SeekBy": "Seek"}, MPRIS_PATH, MPRIS_PLAYER)
+	}
+	if err != nil {
+		slog.Error("can't export MPRIS", "err", err)
+		return
+	}
+
+	shuffle, repeat := queue.Modes()
+	props, err := prop.Export(conn, MPRIS_PATH, prop.Map{
+		MPRIS_ROOT: {
+			"CanQuit":             {Value: true, Emit: prop.EmitConst},
+			"CanRaise":            {Value: false, Emit: prop.EmitConst},
+			"HasTrackList":        {Value: false, Emit: prop.EmitConst},
+			"Identity":            {Value: "Torero", Emit: prop.EmitConst},
+			"SupportedUriSchemes": {Value: []string{}, Emit: prop.EmitConst},
+			"SupportedMimeTypes":  {Value: []string{}, Emit: prop.EmitConst},
+		},
+		MPRIS_PLAYER: {
+			"PlaybackStatus": {Value: mpris_status(), Emit: prop.EmitTrue},
+			"LoopStatus": {Value: mpris_loops[repeat], Writable: true, Emit: prop.EmitTrue,
+				Callback: func(c *prop.Change) *dbus.Error {
+					for mode, loop := range mpris_loops {
+						if loop == c.Value {
+							queue.SetRepeat(mode)
+						}
+					}
+					return nil
+				}},
+			"Shuffle": {Value: shuffle, Writable: true, Emit: prop.EmitTrue,
+				Callback: func(c *prop.Change) *dbus.Error {
+					if on, ok := c.Value.(bool); ok {
+						queue.SetShuffle(on)
+					}
+					return nil
+				}},
+			"Volume": {Value: float64(get_volume()) / MAX_VOLUME, Writable: true, Emit: prop.EmitTrue,
+				Callback: func(c *prop.Change) *dbus.Error {
+					if v, ok := c.Value.(float64); ok {
+						set_volume(int(v*MAX_VOLUME + 0.5))
+					}
+					return nil
+				}},
+			"Metadata":      {Value: mpris_metadata(), Emit: prop.EmitTrue},
+			"Position":      {Value: int64(0), Emit: prop.EmitFalse},
+			"Rate":          {Value: 1.0, Emit: prop.EmitConst},
+			"MinimumRate":   {Value: 1.0, Emit: prop.EmitConst},
+			"MaximumRate":   {Value: 1.0, Emit: prop.EmitConst},
+			"CanGoNext":     {Value: true, Emit: prop.EmitConst},
+			"CanGoPrevious": {Value: true, Emit: prop.EmitConst},
+			"CanPlay":       {Value: true, Emit: prop.EmitConst},
+			"CanPause":      {Value: true, Emit: prop.EmitConst},
+			"CanSeek":       {Value: true, Emit: prop.EmitConst},
+			"CanControl":    {Value: true, Emit: prop.EmitConst},
+		},
+	})
+	if err != nil {
+		slog.Error("can't export MPRIS properties", "err", err)
+		return
+	}
+
+	// what was last shown, so only changes are signalled
+	status, track, volume_shown := "", dbus.ObjectPath(""), -1
+	ticker := time.NewTicker(MPRIS_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s := mpris_status(); s != status {
+			status = s
+			props.SetMust(MPRIS_PLAYER, "PlaybackStatus", s)
+		}
+		metadata := mpris_metadata()
+		if id := metadata["mpris:trackid"].Value().(dbus.ObjectPath); id != track {
+			track = id
+			props.SetMust(MPRIS_PLAYER, "Metadata", metadata)
+		}
+		if v := get_volume(); v != volume_shown {
+			volume_shown = v
+			props.SetMust(MPRIS_PLAYER, "Volume", float64(v)/MAX_VOLUME)
+		}
+		if on, mode := queue.Modes(); on != shuffle || mode != repeat {
+			shuffle, repeat = on, mode
+			props.SetMust(MPRIS_PLAYER, "Shuffle", on)
+			props.SetMust(MPRIS_PLAYER, "LoopStatus", mpris_loops[mode])
+		}
+		_, elapsed, _, _ := playback.Position()
+		props.SetMust(MPRIS_PLAYER, "Position", elapsed.Microseconds())
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+)
+
+/**
+ * MPRIS is a Linux desktop interface; elsewhere there is nothing to serve
+ */
+func serve_mpris(ctx context.Context, quit func()) {
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Mutual TLS between trusted peers, for closed groups. A peer started with
+ * --mtls (or mtls = true in the config) takes song requests only over TLS
+ * from peers holding a certificate from the tracker's CA, and talks to
+ * other peers only over TLS, checking their certificates the same way and,
+ * where the master list gives a peer's identity key, that its certificate
+ * is for that key. The certificate is for the peer's identity key, which
+ * is its TLS key too, and is issued when it registers or logs in to a
+ * tracker started with --ca, kept with the session. Connections to the
+ * tracker, and the tracker's relays, carry on as before, with TLS running
+ * end to end inside relayed ones
+ */
+
+// how long before its certificate expires a peer warns it needs renewing
+const CERT_RENEW_WARNING = 7 * 24 * time.Hour
+
+var (
+	// the certificate with the identity key, and the tracker's CA, read
+	// from the session the first time they're needed
+	mtls_once sync.Once
+	mtls_cert tls.Certificate
+	mtls_pool *x509.CertPool
+	mtls_err  error
+)
+
+/**
+ * @return the peer's certificate with its key, and the CA peers'
+ * certificates must chain to, or an error if there is no certificate for
+ * the peer's identity
+ */
+func mtls_certs() (tls.Certificate, *x509.CertPool, error) {
+	mtls_once.Do(func() {
+		mtls_cert, mtls_pool, mtls_err = load_mtls_certs()
+	})
+	return mtls_cert, mtls_pool, mtls_err
+}
+
+/**
+ * Reads the certificate kept with the session with the tracker
+ * @return the certificate with the identity key, and a pool holding the
+ * tracker's CA
+ */
+func load_mtls_certs() (tls.Certificate, *x509.CertPool, error) {
+	session, ok := tracker_session(tracker_addr)
+	if !ok || len(session.Cert) == 0 || len(session.CA) == 0 {
+		return tls.Certificate{}, nil, fmt.Errorf("mutual TLS takes a certificate from a tracker started with --ca, log in with `peer login <user>`")
+	}
+	identity, err := peer_identity()
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(session.Cert)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	ca, err := x509.ParseCertificate(session.CA)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	if !bytes.Equal(cert_key(leaf), identity.Public().(ed25519.PublicKey)) {
+		return tls.Certificate{}, nil, fmt.Errorf("the certificate from %s is for another identity, log in again", tracker_addr)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return tls.Certificate{}, nil, fmt.Errorf("the certificate from %s expired on %s, log in again", tracker_addr,
+			leaf.NotAfter.Format("2006-01-02"))
+	}
+	if time.Until(leaf.NotAfter) < CERT_RENEW_WARNING {
+		slog.Warn("the certificate for mutual TLS expires soon, log in again to renew it", "expires", leaf.NotAfter)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	cert := tls.Certificate{Certificate: [][]byte{session.Cert}, PrivateKey: identity, Leaf: leaf}
+	return cert, pool, nil
+}
+
+/**
+ * @param cert a peer's certificate
+ * @return the identity key it is for, nil if it isn't for one
+ */
+func cert_key(cert *x509.Certificate) []byte {
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
+
+/**
+ * @return the TLS settings song requests are taken over, asking for a
+ * certificate from the tracker's CA
+ */
+func server_tls_config() (*tls.Config, error) {
+	cert, pool, err := mtls_certs()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+/**
+ * @param key the identity key the peer dialled must have, nil to take any
+ * peer with a certificate from the tracker's CA
+ * @return the TLS settings other peers are talked to over
+ */
+func client_tls_config(key []byte) (*tls.Config, error) {
+	cert, pool, err := mtls_certs()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// certificates name accounts, not hosts, so the chain is checked
+		// by VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verify_peer_cert(state, pool, key)
+		},
+		MinVersion: tls.VersionTLS13,
+	}, nil
+}
+
+/**
+ * @param state a TLS connection to a peer, once the handshake is done
+ * @param pool the tracker's CA
+ * @param key the identity key the peer must have, nil to take any
+ * @return an error if the peer's certificate doesn't chain to the CA, or
+ * is for another key
+ */
+func verify_peer_cert(state tls.ConnectionState, pool *x509.CertPool, key []byte) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("the peer has no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return err
+	}
+	if key != nil && !bytes.Equal(cert_key(leaf), key) {
+		return fmt.Errorf("%s isn't the peer %s announced", leaf.Subject.CommonName, fingerprint(key))
+	}
+	return nil
+}
+
+/**
+ * Runs the client side of the TLS handshake on a connection to a peer
+ * @param ctx cancelled to give up
+ * @param conn the connection
+ * @param key the identity key the peer must have, nil to take any
+ * @return the TLS connection, or an error if the handshake failed, in
+ * which case conn is closed
+ */
+func client_tls(ctx context.Context, conn net.Conn, key []byte) (net.Conn, error) {
+	tls_config, err := client_tls_config(key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tls_conn := tls.Client(conn, tls_config)
+	if err = tls_conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tls_conn, nil
+}
+
+/**
+ * Connects to another peer, over TLS with mtls on
+ * @param ctx cancelling it gives up
+ * @param addr the peer's serving address
+ * @param key the identity key the peer must have, nil to take any
+ * @return the connection, or the dial or handshake error
+ */
+func dial_peer(ctx context.Context, addr string, key []byte) (net.Conn, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil || !config.MTLS {
+		return conn, err
+	}
+	return client_tls(ctx, conn, key)
+}
+
+/**
+ * Reads a single request from a connected peer and serves it, over TLS
+ * with mtls on, turning away peers without a certificate from the
+ * tracker's CA and blocked ones
+ * @param ctx cancelled to cut the transfer off
+ * @param conn the connection with the requesting peer
+ */
+func receive_peer(ctx context.Context, conn net.Conn) {
+	if !config.MTLS {
+		receive_message(ctx, conn)
+		return
+	}
+	tls_config, err := server_tls_config()
+	if err != nil {
+		slog.Error("can't take requests over mutual TLS", "err", err)
+		conn.Close()
+		return
+	}
+	tls_conn := tls.Server(NewDeadlineConn(conn, io_timeout()), tls_config)
+	if err = tls_conn.HandshakeContext(ctx); err != nil {
+		slog.Info("TLS handshake with a peer failed", "peer", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	state := tls_conn.ConnectionState()
+	if key := cert_key(state.PeerCertificates[0]); is_blocked(key) {
+		slog.Info("turning away a blocked peer", "key", fingerprint(key))
+		tls_conn.Close()
+		return
+	}
+	receive_message(ctx, tls_conn)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	nat "github.com/libp2p/go-nat"
+)
+
+const (
+	// how long to look for a router that maps ports, UPnP IGD or NAT-PMP
+	NAT_DISCOVER_TIMEOUT = 3 * time.Second
+	// how long the router keeps a mapping; it is renewed halfway through
+	NAT_LEASE = 20 * time.Minute
+	// what the mapping is called in the router's admin page
+	NAT_DESCRIPTION = "torero peer"
+)
+
+var (
+	// the router forwarding this peer's port, nil if there is none, and
+	// the local port it forwards to
+	nat_device nat.NAT
+	nat_port   int
+	// this peer's serving address as seen from outside the router, ""
+	// without a mapping
+	external_addr string
+	nat_mutex     sync.Mutex
+)
+
+/**
+ * Asks the router, over UPnP IGD or NAT-PMP, to forward a port to this
+ * peer's serving port, so peers outside the home network can reach it
+ * @param args cl arguments which contain the port
+ * @return an error if no router answered or it refused the mapping
+ */
+func map_port(args []string) error {
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), NAT_DISCOVER_TIMEOUT)
+	defer cancel()
+	device, err := nat.DiscoverGateway(ctx)
+	if err != nil {
+		return err
+	}
+	addr, err := add_port_mapping(ctx, device, port)
+	if err != nil {
+		return err
+	}
+
+	nat_mutex.Lock()
+	nat_device = device
+	nat_port = port
+	external_addr = addr
+	nat_mutex.Unlock()
+	slog.Info("mapped port", "router", device.Type(), "external", addr)
+	return nil
+}
+
+/**
+ * @param ctx cancelled to give up on the router
+ * @param device the router
+ * @param port the local port to forward
+ * @return the external address the router forwards to port
+ */
+func add_port_mapping(ctx context.Context, device nat.NAT, port int) (string, error) {
+	external_port, err := device.AddPortMapping(ctx, "tcp", port, NAT_DESCRIPTION, NAT_LEASE)
+	if err != nil {
+		return "", err
+	}
+	ip, err := device.GetExternalAddress()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(external_port)), nil
+}
+
+/**
+ * Renews the port mapping before its lease runs out. If the router hands
+ * out a different address, the songs are announced again under it
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ */
+func renew_port_mapping(ctx context.Context, args []string) {
+	ticker := time.NewTicker(NAT_LEASE / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		nat_mutex.Lock()
+		device, port, old := nat_device, nat_port, external_addr
+		nat_mutex.Unlock()
+		if device == nil {
+			return
+		}
+
+		renew_ctx, cancel := context.WithTimeout(ctx, NAT_DISCOVER_TIMEOUT)
+		addr, err := add_port_mapping(renew_ctx, device, port)
+		cancel()
+		if err != nil {
+			slog.Warn("can't renew the port mapping", "err", err)
+			continue
+		}
+		if addr == old {
+			continue
+		}
+		slog.Info("external address changed, announcing songs again", "old", old, "new", addr)
+		nat_mutex.Lock()
+		external_addr = addr
+		nat_mutex.Unlock()
+		if tracker_addr != "" {
+			become_discoverable(args)
+		}
+	}
+}
+
+/**
+ * Removes the port mapping, if there is one, on shutdown
+ */
+func unmap_port() {
+	nat_mutex.Lock()
+	device, port := nat_device, nat_port
+	nat_device = nil
+	external_addr = ""
+	nat_mutex.Unlock()
+	if device == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), NAT_DISCOVER_TIMEOUT)
+	defer cancel()
+	if err := device.DeletePortMapping(ctx, "tcp", port); err != nil {
+		slog.Warn("can't remove the port mapping", "err", err)
+	}
+}
+
+/**
+ * @param args cl arguments which contain the port
+ * @return the address other peers should reach this peer's songs on: the
+ * router's forwarded address if a port is mapped, else the local one
+ */
+func announced_addr(args []string) string {
+	nat_mutex.Lock()
+	defer nat_mutex.Unlock()
+	if external_addr != "" {
+		return external_addr
+	}
+	return local_addr(args)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// how often the now playing line is redrawn, and how often with the
+	// visualizer on
+	NOW_PLAYING_INTERVAL = time.Second
+	VIS_INTERVAL         = 100 * time.Millisecond
+	// width of the progress bar, in characters
+	PROGRESS_BAR_WIDTH = 30
+)
+
+/**
+ * Shows the song's cover art, then a now playing line, redrawn every
+ * second, and the visualizer under it if it is on, until the user presses
+ * enter. Typing v and enter switches the visualizer between off,
+ * spectrum and waveform
+ */
+func show_now_playing() {
+	lines := make(chan string)
+	go func() {
+		for {
+			line := read_line()
+			lines <- line
+			if line != "v" {
+				return
+			}
+		}
+	}()
+
+	show_playing_art()
+	fmt.Println("(press enter to return to the menu, v and enter for the visualizer)")
+	ticker := time.NewTicker(now_playing_interval())
+	defer ticker.Stop()
+	// lines the cursor is below the now playing line
+	below := 0
+	for {
+		if below > 0 {
+			fmt.Printf("\033[%dA", below)
+		}
+		fmt.Print("\r\033[J" + now_playing_line())
+		rows := visualizer_rows()
+		for _, row := range rows {
+			fmt.Print("\n" + row)
+		}
+		below = len(rows)
+		select {
+		case line := <-lines:
+			if line != "v" {
+				return
+			}
+			// the enter typed moved the cursor down a line
+			below++
+			next_vis_mode()
+			ticker.Reset(now_playing_interval())
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+ * @return how often to redraw the now playing view
+ */
+func now_playing_interval() time.Duration {
+	if get_vis_mode() != VIS_OFF {
+		return VIS_INTERVAL
+	}
+	return NOW_PLAYING_INTERVAL
+}
+
+/**
+ * @return the title and artist of the current song, its elapsed and total
+ * time and a progress bar
+ */
+func now_playing_line() string {
+	song, elapsed, total, ok := playback.Position()
+	if !ok {
+		return "Nothing playing."
+	}
+	line := fmt.Sprintf("%s - %s  %s / %s", song.Title, song.Artist,
+		format_duration(elapsed), format_duration(total))
+	if total > 0 {
+		line += "  " + progress_bar(float64(elapsed)/float64(total))
+	}
+	if playback.Paused() {
+		line += "  [paused]"
+	}
+	if is_recording() {
+		line += "  [recording]"
+	}
+	if left, ok := sleep_left(); ok {
+		line += "  [sleep " + format_duration(left) + "]"
+	}
+	if votes, needed, ok := party_votes(); ok {
+		line += fmt.Sprintf("  [skip votes %d/%d]", votes, needed)
+	}
+	if shuffle, repeat := queue.Modes(); shuffle || repeat != REPEAT_OFF {
+		line += "  " + format_modes(shuffle, repeat)
+	}
+	return line
+}
+
+/**
+ * @return the queue's modes as shown after the now playing line, e.g.
+ * [shuffle, repeat all]
+ */
+func format_modes(shuffle bool, repeat string) string {
+	var modes []string
+	if shuffle {
+		modes = append(modes, "shuffle")
+	}
+	if repeat != REPEAT_OFF {
+		modes = append(modes, "repeat "+repeat)
+	}
+	if len(modes) == 0 {
+		return "[in order]"
+	}
+	return "[" + strings.Join(modes, ", ") + "]"
+}
+
+/**
+ * @param fraction how much of the song has played, from 0 to 1
+ * @return a text progress bar, e.g. [=========>          ]
+ */
+func progress_bar(fraction float64) string {
+	filled := int(fraction * PROGRESS_BAR_WIDTH)
+	if filled > PROGRESS_BAR_WIDTH {
+		filled = PROGRESS_BAR_WIDTH
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < PROGRESS_BAR_WIDTH {
+		bar += ">" + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled-1)
+	}
+	return "[" + bar + "]"
+}
+
+/**
+ * Blocks until a newline is read from stdin. Reads a byte at a time so
+ * nothing after the newline is taken from the menu prompt
+ * @return the line read, trimmed
+ */
+func read_line() string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if err != nil || (n == 1 && b[0] == '\n') {
+			return strings.TrimSpace(string(line))
+		}
+		line = append(line, b[:n]...)
+	}
+}
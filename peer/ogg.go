@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/jfreymuth/oggvorbis"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	OGG_MAGIC = "OggS"
+	// size of an Ogg page header before its segment table
+	OGG_PAGE_HEADER_LEN = 27
+	// bytes read from the end of a file to find its last page
+	OGG_TAIL_LEN = 64 * 1024
+	// Opus always decodes at 48kHz, whatever the source was
+	OPUS_SAMPLE_RATE = 48000
+	// samples per channel decoded per Read
+	OGG_CHUNK = 4096
+)
+
+var (
+	VORBIS_HEAD = []byte("\x01vorbis")
+	VORBIS_TAGS = []byte("\x03vorbis")
+	OPUS_HEAD   = []byte("OpusHead")
+	OPUS_TAGS   = []byte("OpusTags")
+)
+
+/**
+ * Reads the identification and comment headers of an Ogg Vorbis or Opus
+ * file, and works out its duration from the granule position of the last
+ * page
+ * @param file the song file
+ * @param size the size of the file
+ * @param info filled in with the title, artist, album and duration
+ * @return an error if the file isn't Ogg Vorbis or Opus
+ */
+func read_ogg_info(file io.ReadSeeker, size int64, info *SongInfo) error {
+	packets, err := ogg_packets(file, 2)
+	if err != nil {
+		return err
+	}
+	head, tags := packets[0], packets[1]
+
+	var rate, pre_skip int64
+	switch {
+	case bytes.HasPrefix(head, VORBIS_HEAD) && len(head) >= 16:
+		rate = int64(binary.LittleEndian.Uint32(head[12:16]))
+		tags = bytes.TrimPrefix(tags, VORBIS_TAGS)
+	case bytes.HasPrefix(head, OPUS_HEAD) && len(head) >= 12:
+		rate = OPUS_SAMPLE_RATE
+		pre_skip = int64(binary.LittleEndian.Uint16(head[10:12]))
+		tags = bytes.TrimPrefix(tags, OPUS_TAGS)
+	default:
+		return errors.New("not an Ogg Vorbis or Opus stream")
+	}
+	parse_comments(tags, info)
+
+	if granule := last_granule(file, size); rate > 0 && granule > pre_skip {
+		info.Duration = time.Duration(granule-pre_skip) * time.Second / time.Duration(rate)
+	}
+	return nil
+}
+
+/**
+ * Reads the first n packets of the first logical stream in an Ogg file
+ * @param r the file, positioned at its start
+ * @param n the number of packets to read
+ * @return the packets, or an error if the file ends or isn't Ogg
+ */
+func ogg_packets(r io.Reader, n int) ([][]byte, error) {
+	var packets [][]byte
+	var packet []byte
+	header := make([]byte, OGG_PAGE_HEADER_LEN)
+	for len(packets) < n {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if string(header[:4]) != OGG_MAGIC {
+			return nil, errors.New("missing Ogg page header")
+		}
+		lacing := make([]byte, header[26])
+		if _, err := io.ReadFull(r, lacing); err != nil {
+			return nil, err
+		}
+		for _, seg_len := range lacing {
+			segment := make([]byte, seg_len)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return nil, err
+			}
+			packet = append(packet, segment...)
+			// a segment shorter than 255 bytes ends the packet
+			if seg_len < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	return packets[:n], nil
+}
+
+/**
+ * Parses a Vorbis comment block (shared by Vorbis and Opus), picking out
+ * the title, artist and album
+ * @param data the comment packet without its signature
+ * @param info the metadata to fill in
+ */
+func parse_comments(data []byte, info *SongInfo) {
+	read_field := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, false
+		}
+		field := data[4 : 4+n]
+		data = data[4+n:]
+		return field, true
+	}
+	if _, ok := read_field(); !ok { // vendor
+		return
+	}
+	if len(data) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := read_field()
+		if !ok {
+			return
+		}
+		fields := strings.SplitN(string(comment), "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "TITLE":
+			info.Title = fields[1]
+		case "ARTIST":
+			info.Artist = fields[1]
+		case "ALBUM":
+			info.Album = fields[1]
+		case "GENRE":
+			info.Genre = fields[1]
+		case "DATE":
+			info.Year = fields[1]
+		case "TRACKNUMBER":
+			info.Track = parse_track_number(fields[1])
+		case "DISCNUMBER":
+			info.Disc = parse_track_number(fields[1])
+		case "REPLAYGAIN_TRACK_GAIN":
+			if gain, ok := parse_replaygain(fields[1]); ok {
+				info.Gain = gain
+			}
+		case "R128_TRACK_GAIN":
+			if gain, ok := parse_r128_gain(fields[1]); ok {
+				info.Gain = gain
+			}
+		}
+	}
+}
+
+/**
+ * @param file the song file
+ * @param size the size of the file
+ * @return the granule position (samples so far) of the last Ogg page, 0
+ * if it can't be found
+ */
+func last_granule(file io.ReadSeeker, size int64) int64 {
+	start := size - OGG_TAIL_LEN
+	if start < 0 {
+		start = 0
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return 0
+	}
+	tail, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0
+	}
+	i := bytes.LastIndex(tail, []byte(OGG_MAGIC))
+	if i < 0 || len(tail)-i < 14 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(tail[i+6 : i+14]))
+}
+
+/**
+ * Sniffs whether an Ogg stream carries Vorbis or Opus from the codec
+ * signature in its first page
+ * @param first the first bytes of the stream
+ * @return FORMAT_VORBIS or FORMAT_OPUS, "" if it is neither
+ */
+func ogg_format(first []byte) string {
+	if !bytes.HasPrefix(first, []byte(OGG_MAGIC)) {
+		return ""
+	}
+	if bytes.Contains(first, OPUS_HEAD) {
+		return tsp.FORMAT_OPUS
+	}
+	if bytes.Contains(first, VORBIS_HEAD) {
+		return tsp.FORMAT_VORBIS
+	}
+	return ""
+}
+
+/**
+ * Decodes an Ogg Vorbis stream into 16 bit stereo PCM
+ */
+type VorbisDecoder struct {
+	reader  *oggvorbis.Reader
+	src     io.Closer
+	samples []float32
+	pcm     []byte
+}
+
+/**
+ * @param src the Ogg Vorbis stream
+ * @param closer closed along with the decoder
+ * @return a decoder that has read the stream's headers
+ */
+func NewVorbisDecoder(src io.Reader, closer io.Closer) (*VorbisDecoder, error) {
+	reader, err := oggvorbis.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]float32, OGG_CHUNK*reader.Channels())
+	return &VorbisDecoder{reader: reader, src: closer, samples: samples}, nil
+}
+
+func (d *VorbisDecoder) SampleRate() int {
+	return d.reader.SampleRate()
+}
+
+func (d *VorbisDecoder) Read(p []byte) (int, error) {
+	for len(d.pcm) == 0 {
+		n, err := d.reader.Read(d.samples)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		ints := make([]int16, n)
+		for i, sample := range d.samples[:n] {
+			ints[i] = int16(math.Max(-1, math.Min(1, float64(sample))) * math.MaxInt16)
+		}
+		d.pcm = append(d.pcm[:0], stereo_pcm(ints, d.reader.Channels())...)
+	}
+	n := copy(p, d.pcm)
+	d.pcm = d.pcm[n:]
+	return n, nil
+}
+
+func (d *VorbisDecoder) Close() error {
+	return d.src.Close()
+}
+
+/**
+ * Decodes an Ogg Opus stream into 16 bit stereo PCM at 48kHz
+ */
+type OpusDecoder struct {
+	stream   *opus.Stream
+	src      io.Closer
+	channels int
+	samples  []int16
+	pcm      []byte
+}
+
+/**
+ * @param src the Ogg Opus stream
+ * @param channels the channel count from the stream's OpusHead
+ * @param closer closed along with the decoder
+ * @return a decoder for the stream
+ */
+func NewOpusDecoder(src io.Reader, channels int, closer io.Closer) (*OpusDecoder, error) {
+	stream, err := opus.NewStream(src)
+	if err != nil {
+		return nil, err
+	}
+	if channels < 1 {
+		channels = 2
+	}
+	samples := make([]int16, OGG_CHUNK*channels)
+	return &OpusDecoder{stream: stream, src: closer, channels: channels, samples: samples}, nil
+}
+
+func (d *OpusDecoder) SampleRate() int {
+	return OPUS_SAMPLE_RATE
+}
+
+func (d *OpusDecoder) Read(p []byte) (int, error) {
+	for len(d.pcm) == 0 {
+		n, err := d.stream.Read(d.samples)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		d.pcm = append(d.pcm[:0], stereo_pcm(d.samples[:n*d.channels], d.channels)...)
+	}
+	n := copy(p, d.pcm)
+	d.pcm = d.pcm[n:]
+	return n, nil
+}
+
+func (d *OpusDecoder) Close() error {
+	d.stream.Close()
+	return d.src.Close()
+}
+
+/**
+ * @param first the first bytes of an Ogg Opus stream
+ * @return the channel count from its OpusHead, 0 if it can't be found
+ */
+func opus_channels(first []byte) int {
+	i := bytes.Index(first, OPUS_HEAD)
+	if i < 0 || len(first) < i+10 {
+		return 0
+	}
+	return int(first[i+9])
+}
+
+/**
+ * Turns interleaved samples with any number of channels into 16 bit little
+ * endian stereo: mono is duplicated, channels past the first two dropped
+ * @param samples interleaved samples
+ * @param channels the number of channels in samples
+ * @return the PCM for the player
+ */
+func stereo_pcm(samples []int16, channels int) []byte {
+	if channels < 1 {
+		return nil
+	}
+	pcm := make([]byte, 0, len(samples)/channels*4)
+	for i := 0; i+channels <= len(samples); i += channels {
+		left, right := samples[i], samples[i]
+		if channels > 1 {
+			right = samples[i+1]
+		}
+		pcm = append(pcm, byte(left), byte(left>>8), byte(right), byte(right>>8))
+	}
+	return pcm
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+ * The audio output. One player, a sink of the chosen backend (see
+ * sink.go), is shared by every song rather than opened and closed for
+ * each: a song that ends leaves what it wrote still playing while the
+ * next song's decoder starts, so queued songs play gaplessly. The player
+ * is only opened again when the sample rate changes, and closed once
+ * nothing has played for OUTPUT_IDLE. It also holds the tail of a song
+ * being crossfaded (see crossfade.go)
+ */
+
+// how long the player is kept open with nothing playing
+const OUTPUT_IDLE = 5 * time.Second
+
+/**
+ * The shared player and the sample rate it was opened at
+ */
+type AudioOutput struct {
+	mutex       sync.Mutex
+	player      AudioSink
+	sample_rate int
+	// whether a song holds the player
+	acquired bool
+	// what is left of the tail of the song before, still to be faded
+	// out, and how long it was to start with
+	tail       []byte
+	tail_total int
+	// closes the player once it has been idle for OUTPUT_IDLE
+	idle *time.Timer
+}
+
+var output = &AudioOutput{}
+
+/**
+ * Takes the player for a song, opening it if it isn't open at the song's
+ * sample rate. Release it once the song is over
+ * @param sample_rate the song's sample rate, of stereo 16 bit PCM
+ * @return an error if the audio output can't be opened
+ */
+func (o *AudioOutput) Acquire(sample_rate int) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.idle != nil {
+		o.idle.Stop()
+		o.idle = nil
+	}
+	o.acquired = true
+	if o.player != nil && o.sample_rate == sample_rate {
+		return nil
+	}
+	// a tail at another rate can't be mixed in
+	o.tail = nil
+	o.sample_rate = sample_rate
+	return o.reopen()
+}
+
+/**
+ * Plays a chunk of the song holding the player, mixing in the tail being
+ * faded out, if there is one
+ * @param pcm stereo 16 bit PCM, at the rate the player was acquired at
+ */
+func (o *AudioOutput) Write(pcm []byte) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.mix_tail(pcm)
+	if o.player == nil {
+		// lost along with its device, see Write below
+		if err := o.reopen(); err != nil {
+			return err
+		}
+	}
+	_, err := o.player.Write(pcm)
+	if err != nil {
+		// the device may have gone away: try wherever the default is now
+		if o.reopen() == nil {
+			_, err = o.player.Write(pcm)
+		}
+	}
+	return err
+}
+
+/**
+ * Opens the player again at the same rate, e.g. on another output device,
+ * if it is open
+ */
+func (o *AudioOutput) Reopen() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.player == nil {
+		return
+	}
+	if err := o.reopen(); err != nil {
+		slog.Error("can't reopen audio output", "err", err)
+	}
+}
+
+/**
+ * Closes the player and opens it again. The caller must hold the mutex
+ * @return an error if it can't be opened, leaving it closed
+ */
+func (o *AudioOutput) reopen() error {
+	o.close_player()
+	player, err := open_sink(o.sample_rate)
+	if err != nil {
+		return err
+	}
+	o.player = player
+	return nil
+}
+
+/**
+ * Mixes as much of the tail as pcm is long into it, and drops that much
+ * of the tail. The caller must hold the mutex
+ */
+func (o *AudioOutput) mix_tail(pcm []byte) {
+	if len(o.tail) == 0 {
+		return
+	}
+	mix_pcm(pcm, o.tail, o.tail_total-len(o.tail), o.tail_total)
+	if len(pcm) >= len(o.tail) {
+		o.tail = nil
+	} else {
+		o.tail = o.tail[len(pcm):]
+	}
+}
+
+/**
+ * Hands over the end of the song holding the player, to fade out under
+ * the next song. Call before releasing the player
+ * @param tail the last seconds of the song, stereo 16 bit PCM
+ */
+func (o *AudioOutput) FadeOut(tail []byte) {
+	o.mutex.Lock()
+	o.tail, o.tail_total = tail, len(tail)
+	o.mutex.Unlock()
+}
+
+/**
+ * Drops the tail being faded out, e.g. when playback is stopped
+ */
+func (o *AudioOutput) Cut() {
+	o.mutex.Lock()
+	o.tail = nil
+	o.mutex.Unlock()
+}
+
+/**
+ * Hands the player back once a song is over. It stays open for the next
+ * song for OUTPUT_IDLE, and plays any tail handed over until the next
+ * song starts
+ */
+func (o *AudioOutput) Release() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.acquired = false
+	if len(o.tail) > 0 {
+		go o.play_tail()
+	}
+	if o.idle != nil {
+		o.idle.Stop()
+	}
+	var idle *time.Timer
+	idle = time.AfterFunc(OUTPUT_IDLE, func() {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		if o.idle != idle {
+			return
+		}
+		if len(o.tail) > 0 {
+			idle.Reset(OUTPUT_IDLE)
+			return
+		}
+		o.close_player()
+		o.idle = nil
+	})
+	o.idle = idle
+}
+
+/**
+ * Fades the tail out on its own, a chunk at a time, until it is over or
+ * the next song takes the player and mixes in the rest
+ */
+func (o *AudioOutput) play_tail() {
+	silence := make([]byte, PCM_CHUNK)
+	for {
+		o.mutex.Lock()
+		if o.acquired || len(o.tail) == 0 || o.player == nil {
+			o.mutex.Unlock()
+			return
+		}
+		chunk := silence[:min_int(PCM_CHUNK, len(o.tail))]
+		for i := range chunk {
+			chunk[i] = 0
+		}
+		o.mix_tail(chunk)
+		o.player.Write(chunk)
+		o.mutex.Unlock()
+	}
+}
+
+/**
+ * Closes the player now, e.g. on shutdown
+ */
+func (o *AudioOutput) Close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.idle != nil {
+		o.idle.Stop()
+		o.idle = nil
+	}
+	o.tail = nil
+	o.close_player()
+}
+
+/**
+ * Closes the player, if open. The caller must hold the mutex
+ */
+func (o *AudioOutput) close_player() {
+	if o.player != nil {
+		o.player.Close()
+		o.player = nil
+	}
+}
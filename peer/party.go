@@ -0,0 +1,1085 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Party mode, synchronized listening: a peer hosts a party, announced to
+ * the tracker like a broadcast (see radio.go), and the peers that join it
+ * play what the host plays, in step with it. Each member keeps a
+ * connection open to the host, which sends it a PARTY with the song, how
+ * far into it the host is by its own clock, and whether it is paused,
+ * straight away whenever the host plays, pauses, skips or seeks, and every
+ * few seconds besides. Members set their clocks against the host's with an
+ * NTP style CLOCK exchange, fetch the song from its sources themselves,
+ * and work out where the host is now; a member that drifts more than
+ * PARTY_DRIFT from it skips ahead or holds back with silence, which keeps
+ * every player within about 100 ms of the host. Members vote to skip the
+ * song playing with VOTE_SKIP, and once party_skip_percent of them have,
+ * the host's queue moves on
+ */
+
+const (
+	DEFAULT_PARTY_NAME = "Torero party"
+	// how often the host checks whether what it plays changed
+	PARTY_POLL = 100 * time.Millisecond
+	// how often the host tells members where it is anyway, and how often
+	// members check they are in step
+	PARTY_SYNC  = 2 * time.Second
+	PARTY_CHECK = 500 * time.Millisecond
+	// how far a member may drift from the host before it is moved
+	PARTY_DRIFT = 50 * time.Millisecond
+	// a host that jumps further than this between polls has seeked
+	PARTY_JUMP = time.Second
+	// CLOCK exchanges a member sets its clock with, keeping the one with
+	// the shortest round trip, and how often it sets it again
+	PARTY_CLOCK_SAMPLES = 8
+	PARTY_RESYNC        = time.Minute
+	// states held for a member before it is dropped
+	PARTY_BACKLOG = 16
+	// the percentage of members whose votes skip a song, by default
+	DEFAULT_PARTY_SKIP_PERCENT = 50
+)
+
+/**
+ * The party this peer hosts: the members it keeps in step
+ */
+type PartyHost struct {
+	name    string
+	addr    string
+	started time.Time
+	done    chan struct{}
+	once    sync.Once
+
+	mutex   sync.Mutex
+	members map[chan tsp.PartyState]bool
+	state   tsp.PartyState
+	// the members who voted to skip the song playing, by their tokens,
+	// and the song they voted on
+	votes      map[string]bool
+	voted_song int
+	// signalled once enough members voted to skip
+	skip chan struct{}
+}
+
+/**
+ * The party this peer has joined: the connection to its host, and the
+ * host's clock and last state
+ */
+type PartyGuest struct {
+	host string
+	name string
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+	// who this peer votes as, made up on joining
+	voter string
+
+	mutex sync.Mutex
+	// the host's clock less this peer's
+	offset time.Duration
+	state  tsp.PartyState
+}
+
+var (
+	party_mutex  sync.Mutex
+	hosted_party *PartyHost
+	joined_party *PartyGuest
+)
+
+/**
+ * @param name what the party is called
+ * @param addr the serving address peers join at
+ * @return a party with nobody in it
+ */
+func NewPartyHost(name string, addr string) *PartyHost {
+	return &PartyHost{
+		name:    name,
+		addr:    addr,
+		started: time.Now(),
+		done:    make(chan struct{}),
+		members: make(map[chan tsp.PartyState]bool),
+		votes:   make(map[string]bool),
+		skip:    make(chan struct{}, 1),
+	}
+}
+
+/**
+ * Hosts a party, leaving any this peer has joined
+ * @param ctx cancelled when the peer shuts down
+ * @param name what the party is called, "" for DEFAULT_PARTY_NAME
+ * @return an error if this peer isn't serving or already hosts one
+ */
+func host_party(ctx context.Context, name string) error {
+	if serve_args == nil {
+		return errors.New("a party needs peers to join it, run serve or shell")
+	}
+	leave_party()
+	if name == "" {
+		name = DEFAULT_PARTY_NAME
+	}
+	party_mutex.Lock()
+	if hosted_party != nil {
+		party_mutex.Unlock()
+		return errors.New("already hosting " + hosted_party.name)
+	}
+	host := NewPartyHost(name, announced_addr(serve_args))
+	host.state = host.current()
+	hosted_party = host
+	party_mutex.Unlock()
+	go host.run(ctx)
+	go host.announce(ctx)
+	slog.Info("hosting a party", "name", name, "addr", host.addr)
+	return nil
+}
+
+/**
+ * Ends the party this peer hosts, if it hosts one
+ */
+func end_party() {
+	if host := party_host(); host != nil {
+		host.Stop()
+	}
+}
+
+/**
+ * @return the party this peer hosts, nil if it hosts none
+ */
+func party_host() *PartyHost {
+	party_mutex.Lock()
+	defer party_mutex.Unlock()
+	return hosted_party
+}
+
+/**
+ * @return the party this peer has joined, nil if it is in none
+ */
+func party_guest() *PartyGuest {
+	party_mutex.Lock()
+	defer party_mutex.Unlock()
+	return joined_party
+}
+
+/**
+ * @return the state of the party from what plays here now
+ */
+func (h *PartyHost) current() tsp.PartyState {
+	song, position, ok := playback.Clock()
+	return tsp.PartyState{
+		Name:     h.name,
+		Host:     h.addr,
+		Song:     song,
+		Playing:  ok && !playback.Paused(),
+		Position: position,
+		At:       time.Now(),
+		Started:  h.started,
+		Live:     true,
+	}
+}
+
+/**
+ * Watches what plays, telling the members straight away when the host
+ * plays, pauses, skips or seeks, and every PARTY_SYNC anyway, until the
+ * party ends or ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func (h *PartyHost) run(ctx context.Context) {
+	defer h.Stop()
+	ticker := time.NewTicker(PARTY_POLL)
+	defer ticker.Stop()
+	sent := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.done:
+			return
+		case <-h.skip:
+			h.skip_song(ctx)
+			continue
+		case <-ticker.C:
+		}
+		state := h.current()
+		h.mutex.Lock()
+		last := h.state
+		h.mutex.Unlock()
+		expected := last.Position
+		if last.Playing {
+			expected += state.At.Sub(last.At)
+		}
+		jump := state.Position - expected
+		changed := state.Song.ID != last.Song.ID || state.Playing != last.Playing ||
+			jump > PARTY_JUMP || jump < -PARTY_JUMP
+		if changed || time.Since(sent) >= PARTY_SYNC {
+			h.send(state)
+			sent = time.Now()
+		}
+	}
+}
+
+/**
+ * Sends the party's state to every member, dropping any that has fallen
+ * behind
+ * @param state the state
+ */
+func (h *PartyHost) send(state tsp.PartyState) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.tally(&state)
+	h.state = state
+	for member := range h.members {
+		select {
+		case member <- state:
+		default:
+			slog.Info("party member fell behind, dropping it")
+			delete(h.members, member)
+			close(member)
+		}
+	}
+}
+
+/**
+ * Ends the party, telling every member it is over
+ */
+func (h *PartyHost) Stop() {
+	h.once.Do(func() {
+		party_mutex.Lock()
+		if hosted_party == h {
+			hosted_party = nil
+		}
+		party_mutex.Unlock()
+		close(h.done)
+		h.mutex.Lock()
+		state := h.state
+		state.Live = false
+		for member := range h.members {
+			select {
+			case member <- state:
+			default:
+			}
+			close(member)
+		}
+		h.members = nil
+		h.mutex.Unlock()
+		slog.Info("party over", "name", h.name)
+	})
+}
+
+/**
+ * Lets a peer join
+ * @return the channel its states are sent on, nil if the party is over
+ */
+func (h *PartyHost) join() chan tsp.PartyState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.members == nil {
+		return nil
+	}
+	member := make(chan tsp.PartyState, PARTY_BACKLOG)
+	h.members[member] = true
+	return member
+}
+
+/**
+ * Lets a peer leave, unless it was already dropped
+ * @param member the channel its states are sent on
+ */
+func (h *PartyHost) leave(member chan tsp.PartyState) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.members[member] {
+		delete(h.members, member)
+		close(member)
+	}
+}
+
+/**
+ * @return the party as announced to the tracker
+ */
+func (h *PartyHost) info() tsp.PartyState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	state := h.state
+	h.tally(&state)
+	return state
+}
+
+/**
+ * Counts the members and their votes into a state, forgetting the votes
+ * on another song. Call with the mutex held
+ * @param state the state
+ */
+func (h *PartyHost) tally(state *tsp.PartyState) {
+	if state.Song.ID != h.voted_song {
+		h.votes = make(map[string]bool)
+		h.voted_song = state.Song.ID
+	}
+	state.Members = len(h.members)
+	state.Votes = len(h.votes)
+	// rounded up, and never none
+	state.VotesNeeded = (state.Members*config.PartySkipPercent + 99) / 100
+	if state.VotesNeeded < 1 {
+		state.VotesNeeded = 1
+	}
+}
+
+/**
+ * Counts a member's vote to skip a song, telling every member the new
+ * count, and skips it once enough members have voted
+ * @param voter the member's token; it votes once per song
+ * @param song the ID of the song voted on
+ * @return the party's state with the vote counted, or an error if the
+ * song isn't playing any more
+ */
+func (h *PartyHost) vote(voter string, song int) (tsp.PartyState, error) {
+	state := h.current()
+	if song == 0 || state.Song.ID != song {
+		return tsp.PartyState{}, errors.New("that song isn't playing")
+	}
+	h.mutex.Lock()
+	h.tally(&state)
+	h.votes[voter] = true
+	h.tally(&state)
+	h.mutex.Unlock()
+	h.send(state)
+	slog.Info("vote to skip", "song", song, "votes", state.Votes, "needed", state.VotesNeeded)
+	if state.Votes >= state.VotesNeeded {
+		select {
+		case h.skip <- struct{}{}:
+		default:
+		}
+	}
+	return state, nil
+}
+
+/**
+ * Skips the song playing once the members voted to: plays the next song
+ * in the queue, or ends the song if there is none
+ * @param ctx cancelled when the peer shuts down
+ */
+func (h *PartyHost) skip_song(ctx context.Context) {
+	slog.Info("the party voted to skip the song")
+	if _, next := queue.Peek(); next {
+		play_next(ctx, 1)
+	} else {
+		playback.End()
+	}
+}
+
+/**
+ * Announces the party to the tracker, if there is one, every heartbeat
+ * and whenever the song changes, and that it is over once it ends
+ * @param ctx cancelled when the peer shuts down
+ */
+func (h *PartyHost) announce(ctx context.Context) {
+	if tracker_addr == "" {
+		return
+	}
+	ticker := time.NewTicker(PARTY_POLL)
+	defer ticker.Stop()
+	song := -1
+	sent := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			h.send_announcement(false)
+			return
+		case <-h.done:
+			h.send_announcement(false)
+			return
+		case <-ticker.C:
+		}
+		info := h.info()
+		if info.Song.ID != song || time.Since(sent) >= tsp.HEARTBEAT_INTERVAL {
+			song = info.Song.ID
+			sent = time.Now()
+			h.send_announcement(true)
+		}
+	}
+}
+
+/**
+ * @param live false to announce the party is over
+ */
+func (h *PartyHost) send_announcement(live bool) {
+	info := h.info()
+	info.Live = live
+	content, err := tsp.EncodeParty(info)
+	if err != nil {
+		slog.Error("can't encode the party", "err", err)
+		return
+	}
+	if err = send_to_tracker(tsp.NewMsg(tsp.PARTY, 0, content)); err != nil {
+		slog.Debug("can't announce the party", "err", err)
+	}
+}
+
+/**
+ * Answers a PARTY: lets the peer join the party this peer hosts, sending
+ * it the party's state straight away and then whenever it changes, until
+ * the peer leaves, falls behind or the party ends
+ * @param ctx cancelled to cut the peer off
+ * @param in_msg the request
+ * @param client the peer joining
+ */
+func serve_party(ctx context.Context, in_msg *tsp.Msg, client io.Writer) {
+	host := party_host()
+	var member chan tsp.PartyState
+	if host != nil {
+		member = host.join()
+	}
+	if member == nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, "not hosting a party")
+		return
+	}
+	defer host.leave(member)
+	state := host.info()
+	slog.Info("peer joined the party")
+	for {
+		content, err := tsp.EncodeParty(state)
+		if err != nil {
+			slog.Error("can't encode the party", "err", err)
+			return
+		}
+		if err = tsp.Encode(client, tsp.NewMsg(tsp.PARTY, 0, content)); err != nil {
+			slog.Info("peer left the party", "err", err)
+			return
+		}
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case state, ok = <-member:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * Answers a VOTE_SKIP: counts the member's vote against the song, and
+ * replies with the party's state, the vote counted
+ * @param in_msg the request, carrying the song's ID and the member's
+ * token in the body
+ * @param client the voting member
+ */
+func serve_vote_skip(in_msg *tsp.Msg, client io.Writer) {
+	host := party_host()
+	if host == nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, "not hosting a party")
+		return
+	}
+	if len(in_msg.Msg) == 0 {
+		send_error(in_msg, client, tsp.ERR_DENIED, "a vote needs a voter")
+		return
+	}
+	state, err := host.vote(string(in_msg.Msg), in_msg.Header.Song_id)
+	if err != nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, err.Error())
+		return
+	}
+	content, err := tsp.EncodeParty(state)
+	if err != nil {
+		slog.Error("can't encode the party", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.VOTE_SKIP, in_msg.Header.Song_id, content)); err != nil {
+		slog.Warn("can't reply", "err", err)
+	}
+}
+
+/**
+ * Votes to skip the song the host of the party this peer has joined is
+ * playing
+ * @param ctx cancelled to give up
+ * @return the party's state with the vote counted, or an error if this
+ * peer isn't in a party, nothing is playing or the host can't be reached
+ */
+func vote_skip(ctx context.Context) (tsp.PartyState, error) {
+	guest := party_guest()
+	if guest == nil {
+		return tsp.PartyState{}, errors.New("not in a party")
+	}
+	guest.mutex.Lock()
+	song := guest.state.Song.ID
+	guest.mutex.Unlock()
+	if song == 0 {
+		return tsp.PartyState{}, errors.New("nothing playing")
+	}
+	conn, err := dial_peer(ctx, guest.host, nil)
+	if err != nil {
+		return tsp.PartyState{}, err
+	}
+	defer conn.Close()
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.VOTE_SKIP, song, []byte(guest.voter))); err != nil {
+		return tsp.PartyState{}, err
+	}
+	in_msg, err := tsp.Decode(conn)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return tsp.PartyState{}, err
+	}
+	return tsp.DecodeParty(in_msg.Msg)
+}
+
+/**
+ * @return the votes to skip the song playing in the party this peer
+ * hosts or has joined, how many skip it, and false if it is in none or
+ * nothing is playing
+ */
+func party_votes() (int, int, bool) {
+	var state tsp.PartyState
+	if host := party_host(); host != nil {
+		state = host.info()
+	} else if guest := party_guest(); guest != nil {
+		guest.mutex.Lock()
+		state = guest.state
+		guest.mutex.Unlock()
+	} else {
+		return 0, 0, false
+	}
+	return state.Votes, state.VotesNeeded, state.Song.ID != 0
+}
+
+/**
+ * @return a made up token to vote as, unique to this peer in any party
+ */
+func new_voter() string {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+/**
+ * Answers a CLOCK with when it was received and the reply sent, by this
+ * peer's clock
+ * @param in_msg the request, carrying when it was sent
+ * @param client the asking peer
+ */
+func serve_clock(in_msg *tsp.Msg, client io.Writer) {
+	received := time.Now()
+	clock, err := tsp.DecodeClock(in_msg.Msg)
+	if err != nil {
+		send_error(in_msg, client, tsp.ERR_INTERNAL, "bad clock request")
+		return
+	}
+	clock.Receive = received
+	clock.Transmit = time.Now()
+	content, err := tsp.EncodeClock(clock)
+	if err != nil {
+		slog.Error("can't encode the clock", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.CLOCK, 0, content)); err != nil {
+		slog.Warn("can't reply", "err", err)
+	}
+}
+
+/**
+ * One CLOCK exchange with a peer
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @return the peer's clock less this peer's, and the round trip the
+ * exchange took on the network
+ */
+func clock_sample(ctx context.Context, addr string) (time.Duration, time.Duration, error) {
+	conn, err := dial_peer(ctx, addr, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	sent := time.Now()
+	content, err := tsp.EncodeClock(tsp.ClockSync{Origin: sent})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.CLOCK, 0, content)); err != nil {
+		return 0, 0, err
+	}
+	in_msg, err := tsp.Decode(conn)
+	received := time.Now()
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	clock, err := tsp.DecodeClock(in_msg.Msg)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the peer's times are wall clock only, from the gob; sent and
+	// received here also carry the monotonic clock the round trip is
+	// measured by
+	offset := (clock.Receive.Sub(sent.Round(0)) + clock.Transmit.Sub(received.Round(0))) / 2
+	delay := received.Sub(sent) - clock.Transmit.Sub(clock.Receive)
+	return offset, delay, nil
+}
+
+/**
+ * Sets this peer's clock against a peer's, NTP style: several CLOCK
+ * exchanges, keeping the offset of the one with the shortest round trip
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @return the peer's clock less this peer's
+ */
+func measure_clock(ctx context.Context, addr string) (time.Duration, error) {
+	var best time.Duration
+	shortest := time.Duration(-1)
+	var err error
+	for i := 0; i < PARTY_CLOCK_SAMPLES; i++ {
+		offset, delay, sample_err := clock_sample(ctx, addr)
+		if sample_err != nil {
+			err = sample_err
+			continue
+		}
+		if shortest < 0 || delay < shortest {
+			best, shortest = offset, delay
+		}
+	}
+	if shortest < 0 {
+		return 0, err
+	}
+	slog.Debug("clock set", "peer", addr, "offset", best, "round_trip", shortest)
+	return best, nil
+}
+
+/**
+ * Joins a party, leaving any this peer has joined, and plays along with
+ * its host until the party ends or this peer leaves
+ * @param ctx cancelled when the peer shuts down
+ * @param addr the serving address of the host
+ * @return the party, or an error if the host can't be reached or isn't
+ * hosting one
+ */
+func join_party(ctx context.Context, addr string) (tsp.PartyState, error) {
+	if host := party_host(); host != nil {
+		return tsp.PartyState{}, errors.New("already hosting " + host.name + ", end it first")
+	}
+	leave_party()
+	offset, err := measure_clock(ctx, addr)
+	if err != nil {
+		return tsp.PartyState{}, fmt.Errorf("can't set the clock: %w", err)
+	}
+	conn, err := dial_peer(ctx, addr, nil)
+	if err != nil {
+		return tsp.PartyState{}, err
+	}
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.PARTY, 0, nil)); err != nil {
+		conn.Close()
+		return tsp.PartyState{}, err
+	}
+	in_msg, err := tsp.Decode(conn)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	var state tsp.PartyState
+	if err == nil {
+		state, err = tsp.DecodeParty(in_msg.Msg)
+	}
+	if err != nil {
+		conn.Close()
+		return tsp.PartyState{}, err
+	}
+	guest := &PartyGuest{
+		host:   addr,
+		name:   state.Name,
+		conn:   conn,
+		done:   make(chan struct{}),
+		voter:  new_voter(),
+		offset: offset,
+		state:  state,
+	}
+	party_mutex.Lock()
+	joined_party = guest
+	party_mutex.Unlock()
+	go guest.receive()
+	go guest.run(ctx)
+	slog.Info("joined a party", "name", state.Name, "host", addr, "clock_offset", offset)
+	return state, nil
+}
+
+/**
+ * Leaves the party this peer has joined, if it has joined one. What plays
+ * carries on
+ */
+func leave_party() {
+	if guest := party_guest(); guest != nil {
+		guest.Stop()
+	}
+}
+
+/**
+ * Stops playing along with the host and hangs up on it
+ */
+func (g *PartyGuest) Stop() {
+	g.once.Do(func() {
+		party_mutex.Lock()
+		if joined_party == g {
+			joined_party = nil
+		}
+		party_mutex.Unlock()
+		close(g.done)
+		g.conn.Close()
+		slog.Info("left the party", "name", g.name)
+	})
+}
+
+/**
+ * Takes the host's states as they arrive, until it hangs up or the party
+ * ends
+ */
+func (g *PartyGuest) receive() {
+	defer g.Stop()
+	for {
+		in_msg, err := tsp.Decode(g.conn)
+		if err != nil {
+			select {
+			case <-g.done:
+			default:
+				slog.Info("lost the party's host", "host", g.host, "err", err)
+			}
+			return
+		}
+		state, err := tsp.DecodeParty(in_msg.Msg)
+		if err != nil {
+			slog.Warn("bad party state", "host", g.host, "err", err)
+			continue
+		}
+		if !state.Live {
+			slog.Info("the party is over", "name", g.name)
+			return
+		}
+		g.mutex.Lock()
+		g.state = state
+		g.mutex.Unlock()
+	}
+}
+
+/**
+ * Plays along with the host: the song it plays, paused when it is, and in
+ * step with it, setting the clock again every PARTY_RESYNC
+ * @param ctx cancelled when the peer shuts down
+ */
+func (g *PartyGuest) run(ctx context.Context) {
+	check := time.NewTicker(PARTY_CHECK)
+	defer check.Stop()
+	resync := time.NewTicker(PARTY_RESYNC)
+	defer resync.Stop()
+	for {
+		g.follow(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.done:
+			return
+		case <-resync.C:
+			go func() {
+				if offset, err := measure_clock(ctx, g.host); err == nil {
+					g.mutex.Lock()
+					g.offset = offset
+					g.mutex.Unlock()
+				}
+			}()
+		case <-check.C:
+		}
+	}
+}
+
+/**
+ * Brings what plays here in line with the host's last state
+ * @param ctx cancelled when the peer shuts down
+ */
+func (g *PartyGuest) follow(ctx context.Context) {
+	g.mutex.Lock()
+	state, offset := g.state, g.offset
+	g.mutex.Unlock()
+
+	song, position, ok := playback.Clock()
+	if state.Song.ID == 0 {
+		if ok {
+			playback.End()
+		}
+		return
+	}
+	if !ok || song.ID != state.Song.ID {
+		// from the start, so the PCM played says exactly where it is;
+		// the nudges then catch up with the host
+		if err := start_song(ctx, state.Song, 0, false); err != nil {
+			slog.Warn("can't play the party's song", "song", state.Song.ID, "err", err)
+		}
+		return
+	}
+	if playback.Paused() != !state.Playing {
+		if state.Playing {
+			playback.Resume()
+		} else {
+			playback.Pause()
+		}
+	}
+	if !state.Playing {
+		return
+	}
+	// where the host is now, by its clock
+	expected := state.Position + time.Now().Add(offset).Sub(state.At)
+	drift := expected - position
+	if drift > PARTY_DRIFT || drift < -PARTY_DRIFT {
+		slog.Debug("in step with the party's host", "drift", drift)
+		playback.Nudge(drift)
+	}
+}
+
+/**
+ * @return the party's status line, e.g. "Hosting ... for 5m0s, 2 joined."
+ */
+func format_party() string {
+	if host := party_host(); host != nil {
+		info := host.info()
+		return fmt.Sprintf("Hosting %s at %s for %s, %d joined.", info.Name, info.Host,
+			time.Since(info.Started).Round(time.Second), info.Members)
+	}
+	if guest := party_guest(); guest != nil {
+		guest.mutex.Lock()
+		offset := guest.offset
+		guest.mutex.Unlock()
+		return fmt.Sprintf("In %s at %s, clocks %s apart.", guest.name, guest.host, offset.Round(time.Millisecond))
+	}
+	return "Not in a party."
+}
+
+/**
+ * @param state a party's state
+ * @return its skip votes, e.g. "Skip votes 2/3."
+ */
+func format_votes(state tsp.PartyState) string {
+	return fmt.Sprintf("Skip votes %d/%d.", state.Votes, state.VotesNeeded)
+}
+
+/**
+ * Asks the tracker for the parties going on
+ * @return the parties, the longest running first
+ */
+func fetch_parties() (parties []tsp.PartyState, err error) {
+	if tracker_addr == "" {
+		return nil, fmt.Errorf("listing parties needs a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.PARTY, 0, nil)); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodeParties(in_msg.Msg)
+}
+
+/**
+ * Writes the parties going on, one per line
+ * @param w where they are written
+ * @param parties the parties, numbered from 1 to join by
+ */
+func write_parties(w io.Writer, parties []tsp.PartyState) {
+	if len(parties) == 0 {
+		fmt.Fprintln(w, "No parties going on.")
+	}
+	for i, party := range parties {
+		playing := "nothing playing"
+		if party.Song.ID != 0 {
+			playing = party.Song.Title + ", " + party.Song.Artist
+			if !party.Playing {
+				playing += " (paused)"
+			}
+		}
+		fmt.Fprintf(w, "%3d. %s at %s: %s, %d joined, for %s\n", i+1, party.Name, party.Host,
+			playing, party.Members, time.Since(party.Started).Round(time.Second))
+	}
+}
+
+/**
+ * Handles party: lists the parties going on, hosts or ends one, or joins
+ * or leaves one
+ * @param ctx cancelled when the peer shuts down
+ * @param cmd [], ["host", name...], ["end"], ["join", n or address],
+ * ["leave"] or ["skip"]
+ * @param w where the output is written
+ * @return the exit status
+ */
+func handle_party(ctx context.Context, cmd []string, w io.Writer) int {
+	if len(cmd) == 0 {
+		fmt.Fprintln(w, format_party())
+		parties, err := fetch_parties()
+		if err != nil {
+			fmt.Fprintln(w, "can't list the parties: ", err)
+			return 1
+		}
+		write_parties(w, parties)
+		return 0
+	}
+	switch cmd[0] {
+	case "host":
+		if err := host_party(ctx, strings.Join(cmd[1:], " ")); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+	case "end":
+		end_party()
+	case "join":
+		if len(cmd) != 2 {
+			fmt.Fprintln(w, "usage: party join <n|address>")
+			return 2
+		}
+		addr := cmd[1]
+		if n, err := strconv.Atoi(addr); err == nil {
+			parties, err := fetch_parties()
+			if err != nil {
+				fmt.Fprintln(w, "can't list the parties: ", err)
+				return 1
+			}
+			if n < 1 || n > len(parties) {
+				fmt.Fprintf(w, "no party %d\n", n)
+				return 2
+			}
+			addr = parties[n-1].Host
+		}
+		if _, err := join_party(ctx, addr); err != nil {
+			fmt.Fprintln(w, "can't join: ", err)
+			return 1
+		}
+	case "leave":
+		leave_party()
+	case "skip":
+		if party_host() != nil {
+			fmt.Fprintln(w, "The host skips with next.")
+			return 2
+		}
+		state, err := vote_skip(ctx)
+		if err != nil {
+			fmt.Fprintln(w, "can't vote: ", err)
+			return 1
+		}
+		fmt.Fprintln(w, format_votes(state))
+		return 0
+	default:
+		fmt.Fprintln(w, "usage: party [host [name]|end|join <n|address>|leave|skip]")
+		return 2
+	}
+	fmt.Fprintln(w, format_party())
+	return 0
+}
+
+/**
+ * PARTY from the interactive menu: lists the parties going on, then joins
+ * one, hosts one, or leaves or ends the one this peer is in
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_party_menu(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	fmt.Println(format_party())
+	parties, err := fetch_parties()
+	if err != nil {
+		fmt.Println("can't list the parties: ", err)
+	} else {
+		write_parties(os.Stdout, parties)
+	}
+	actions := []string{"HOST A PARTY", "BACK"}
+	if party_host() != nil {
+		actions = []string{"END THE PARTY", "BACK"}
+	} else if party_guest() != nil {
+		actions = []string{"VOTE TO SKIP", "LEAVE THE PARTY", "BACK"}
+	}
+	if len(parties) > 0 && party_host() == nil {
+		actions = append([]string{"JOIN"}, actions...)
+	}
+	action, _ := ui.Select("Party", actions, &input.Options{
+		Loop: true,
+	})
+	switch action {
+	case "JOIN":
+		arg, _ := ui.Ask(fmt.Sprintf("Party (1-%d)", len(parties)), &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				if n, err := strconv.Atoi(arg); err != nil || n < 1 || n > len(parties) {
+					return fmt.Errorf("pick a party from 1 to %d", len(parties))
+				}
+				return nil
+			},
+		})
+		n, _ := strconv.Atoi(arg)
+		if _, err := join_party(ctx, parties[n-1].Host); err != nil {
+			fmt.Println("can't join: ", err)
+			return
+		}
+	case "HOST A PARTY":
+		name, _ := ui.Ask("Name the party", &input.Options{
+			Default: DEFAULT_PARTY_NAME,
+		})
+		if err := host_party(ctx, name); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "END THE PARTY":
+		end_party()
+	case "VOTE TO SKIP":
+		state, err := vote_skip(ctx)
+		if err != nil {
+			fmt.Println("can't vote: ", err)
+			return
+		}
+		fmt.Println(format_votes(state))
+		return
+	case "LEAVE THE PARTY":
+		leave_party()
+	default:
+		return
+	}
+	fmt.Println(format_party())
+}
+
+/**
+ * party: lists the parties going on. Hosting and joining take a daemon
+ */
+func run_party(args []string) int {
+	if len(args) > 0 {
+		fmt.Println("parties take a daemon, start one with: ", os.Args[0], "serve <port> <filedir>")
+		return 1
+	}
+	parties, err := fetch_parties()
+	if err != nil {
+		fmt.Println("can't list the parties: ", err)
+		return 1
+	}
+	write_parties(os.Stdout, parties)
+	return 0
+}
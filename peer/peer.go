@@ -7,326 +7,540 @@
 package main
 
 import (
-	"encoding/gob"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
-	"github.com/hajimehoshi/go-mp3"
-	"github.com/hajimehoshi/oto"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
 	"github.com/tcnksm/go-input"
 )
 
 const (
-	INIT = iota
-	LIST
-	INFO
-	PLAY
-	STOP
-	QUIT
-
-	// To run, put the tracker's ip address below here
-	TRACKER_IP = "172.17.92.155:"
-	MAX_EVENTS = 64
-	EPOLLET    = 1 << 31
+	// how long to wait for a host to accept a connection, unless
+	// dial_timeout_ms is set
+	DIAL_TIMEOUT = 5 * time.Second
+	// times an interrupted transfer is picked up again before giving up
+	MAX_RESUMES = 3
+	// times to go back to peers that were all busy, and how long to wait
+	BUSY_RETRIES     = 2
+	BUSY_RETRY_DELAY = 3 * time.Second
 )
 
-type TSP_header struct {
-	Type    byte
-	Song_id int
-}
-
-type TSP_msg struct {
-	Header TSP_header
-	Msg    []byte
-}
-
-type Reader struct {
-	read string
-	done bool
-}
-
-var master_list string
-
-func init() {
-	gob.Register(&TSP_header{})
-	gob.Register(&TSP_msg{})
-}
+var (
+	master_list []tsp.SongEntry
+	// this peer's own songs, as announced to the tracker or other peers
+	local_songs  []tsp.SongEntry
+	master_mutex sync.Mutex
+	tracker_addr string
+)
 
 func main() {
-	args := os.Args[:]
-	if len(args) != 3 {
-		fmt.Println("Usage: ", args[0], "<port> <filedir>")
+	add_common_flags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	if err := load_config(); err != nil {
+		fmt.Println("error reading "+config_path()+": ", err)
 		os.Exit(1)
 	}
+	os.Exit(run_command(flag.Args()))
+}
 
-	become_discoverable(args)
-
-	go serve_songs_epoll(args)
+/**
+ * Starts everything a serving peer runs: scans and announces its songs,
+ * then serves them, sends heartbeats and watches the songs directory in
+ * the background
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @return cancel to stop the background goroutines, and a channel closed
+ * once the song server has drained
+ */
+func start_peer(args []string) (context.Context, context.CancelFunc, chan struct{}) {
+	serve_args = args
+	if err := open_library(); err != nil {
+		slog.Warn("can't open the library, scanning every song", "path", library_path(), "err", err)
+	}
+	// read before the songs are scanned, so none is announced public by
+	// mistake
+	refresh_access()
+	if err := load_blocked(); err != nil {
+		slog.Error("can't read the blocklist", "err", err)
+	}
+	if err := load_stats(); err != nil {
+		slog.Error("can't read the transfer stats", "err", err)
+	}
+	if config.PortMapping {
+		if err := map_port(args); err != nil {
+			slog.Warn("can't map a port on the router, peers outside the LAN may not reach this one", "err", err)
+		}
+	}
+	if err := become_discoverable(args); err != nil {
+		slog.Warn("tracker unreachable, falling back to LAN discovery", "tracker", tracker_addr, "err", err)
+		tracker_addr = ""
+	} else if config.DHT {
+		slog.Info("finding songs through the DHT", "node", hex.EncodeToString(dht_id))
+	} else if tracker_addr == "" {
+		slog.Info("no tracker configured, using LAN discovery")
+	}
+	announce_mdns(args)
 
-	play := make(chan bool)
-	stop := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	server_done := make(chan struct{})
+	go func() {
+		start_server(ctx, args)
+		close(server_done)
+	}()
 
-	for {
-		if handle_command(args, play, stop) < 0 {
-			break
+	if tracker_addr != "" {
+		go send_heartbeats(ctx, args)
+		go take_relays(ctx, args)
+		go share_presence(ctx)
+		go follow_shared(ctx)
+	}
+	if config.Mirror > 0 {
+		if tracker_addr != "" {
+			go mirror_popular(ctx, args)
+		} else {
+			slog.Warn("not mirroring popular songs, that takes a tracker")
 		}
 	}
+	if config.QUIC {
+		go serve_quic(ctx, args)
+	}
+	if config.DHT {
+		go dht_maintain(ctx, args)
+	}
+	go exchange_peers(ctx)
+	refresh_list(ctx, args)
+	go watch_songs(ctx, args)
+	go watch_output_device(ctx)
+	go send_scrobbles(ctx)
+	go watch_friends(ctx)
+	go watch_access(ctx)
+	go watch_rates(ctx)
+	if config.PortMapping {
+		go renew_port_mapping(ctx, args)
+	}
+	if http_flag != "" {
+		go serve_gateway(ctx, http_flag, args)
+		if config.DLNA {
+			if _, port, err := net.SplitHostPort(http_flag); err == nil {
+				go advertise_dlna(ctx, port)
+			} else {
+				slog.Error("can't advertise the media server", "http", http_flag, "err", err)
+			}
+		}
+	} else if config.DLNA {
+		slog.Warn("the media server is only advertised with --http")
+	}
+	return ctx, cancel, server_done
+}
+
+var shutdown_once sync.Once
+
+/**
+ * Shuts the peer down cleanly, once, whether from QUIT or a signal: stops
+ * playback and the song server, lets in-flight uploads drain, and
+ * unregisters from the tracker and the LAN
+ * @param cancel cancels the context shared by every goroutine
+ * @param server_done closed once the song server has drained
+ */
+func shutdown(cancel context.CancelFunc, server_done chan struct{}) {
+	shutdown_once.Do(func() {
+		cancel()
+		playback.End()
+		output.Close()
+		discard_prefetch()
+		<-server_done
+		stop_announcing()
+		close_library()
+		unmap_port()
+		if tracker_addr != "" {
+			if err := send_to_tracker(tsp.NewMsg(tsp.QUIT, 0, nil)); err != nil {
+				slog.Warn("can't unregister from the tracker", "err", err)
+			}
+		}
+	})
 }
 
 /*----------------------------SERVER----------------------------*/
 
 /**
- *  @return the host's local IPv4 address
+ *  @return the host's local IPv4 address, or on an IPv6-only network its
+ *  IPv6 address. "" if it has neither
  */
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return ""
 	}
+	var ipv6 string
 	// Check the address type and if it is not a loopback then display it
 	for _, address := range addrs {
 		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				return ipnet.IP.String()
 			}
+			// link-local addresses need a zone other hosts can't use
+			if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+				ipv6 = ipnet.IP.String()
+			}
 		}
 	}
-	return ""
+	return ipv6
 }
 
-func NewReader(toRead string) *Reader {
-	return &Reader{toRead, false}
+/**
+ * @param id the id of the song to access
+ * @return from the master list, the entry of the song specified by the id
+ */
+func find_song(id int) (tsp.SongEntry, bool) {
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	for _, song := range master_list {
+		if song.ID == id {
+			return song, true
+		}
+	}
+	return tsp.SongEntry{}, false
 }
 
-func (r *Reader) Read(p []byte) (n int, err error) {
-	if r.done {
-		return 0, io.EOF
+/*----------------------------CLIENT----------------------------*/
+
+/**
+ * Makes the client 'discoverable' to other peers by scanning the host's
+ * songs, and sending the song list to the tracker server if there is one
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @return an error if the tracker couldn't be reached
+ */
+func become_discoverable(args []string) error {
+	songs := get_local_song_info(args[2])
+	master_mutex.Lock()
+	songs = build_catalog(args[2], songs)
+	for i := range songs {
+		songs[i].Sources[0].PeerAddr = announced_addr(args)
+		songs[i].Sources[0].Caps = local_caps()
+		songs[i].Sources[0].Key = identity_key()
+	}
+	local_songs = songs
+	songs = append(seeding_songs(args), songs...)
+	master_mutex.Unlock()
+	if tracker_addr == "" {
+		return nil
 	}
-	for i, b := range []byte(r.read) {
-		p[i] = b
+
+	content, err := tsp.EncodeSongs(songs)
+	if err != nil {
+		slog.Error("can't encode song list", "err", err)
+		os.Exit(1)
 	}
-	r.done = true
-	return len(r.read), nil
+	return send_to_tracker(tsp.NewMsg(tsp.INIT, 0, content))
 }
 
 /**
- * @param id the id of the string to access
- * @return from the master list, the filename of the song specified by the id
+ * Sends a message to the tracker that expects no reply
+ * @param msg the message to send
+ * @return an error if the tracker couldn't be reached
  */
-func get_song_filename(id string) string {
-	rows := strings.Split(master_list, "\n")
-	for _, r := range rows {
-		if strings.Split(r, ":")[0] == id {
-			r = strings.Replace(r, ", ", "\t", -1)
-			end := strings.Index(r, ">")
-			return r[end+2:]
-		}
+func send_to_tracker(msg *tsp.Msg) (err error) {
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return err
 	}
-	return ""
+	defer tracker.Close()
+	sign_msg(msg, nil)
+	return tsp.Encode(tracker, msg)
 }
 
 /**
- * @param client_fd the file descriptor of the connected client
+ * Tells the tracker, if there is one, about songs added to or removed
+ * from this peer's library since it was announced. With the DHT on, added
+ * songs are stored in it instead; removed ones just expire
+ * @param t tsp.ADD_SONG or tsp.REMOVE_SONG
+ * @param songs the songs, each with its single local source
  */
-func receive_message_epoll(client_fd int) {
-	bytes := make([]byte, 1024)
-	_, _ = syscall.Read(client_fd, bytes)
-
-	M := NewReader(string(bytes))
-
-	decoder := gob.NewDecoder(M)
-	in_msg := new(TSP_msg)
-	decoder.Decode(&in_msg)
-
-	switch in_msg.Header.Type {
-	case PLAY:
-		song_file := get_song_filename(strconv.Itoa(in_msg.Header.Song_id))
-		send_mp3_file(song_file, client_fd)
-	default:
+func update_tracker(t byte, songs []tsp.SongEntry) {
+	if config.DHT && t == tsp.ADD_SONG && len(songs) > 0 {
+		go dht_publish(songs)
+	}
+	if tracker_addr == "" || len(songs) == 0 {
+		return
+	}
+	content, err := tsp.EncodeSongs(songs)
+	if err != nil {
+		slog.Error("can't encode song list", "err", err)
 		return
 	}
+	if err = send_to_tracker(tsp.NewMsg(t, 0, content)); err != nil {
+		slog.Warn("can't update the tracker", "err", err)
+	}
 }
 
 /**
- * @param args
- * Server thread of the host. This function handles sets up epoll for
- * nonblocking, asynchronous I/O. It handles incoming peers, and calls
- * receive_message to handle their requests accordingly
+ * @param args cl arguments which contain the port
+ * @return the address this peer serves songs on
  */
-func serve_songs_epoll(args []string) {
-	// var event syscall.EpollEvent
-	var event syscall.EpollEvent
+func local_addr(args []string) string {
+	return net.JoinHostPort(GetLocalIP(), args[1])
+}
 
-	var events [MAX_EVENTS]syscall.EpollEvent
+/**
+ * Tells the tracker this peer is alive every HEARTBEAT_INTERVAL, and
+ * announces the songs again whenever the tracker has forgotten them
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ */
+func send_heartbeats(ctx context.Context, args []string) {
+	ticker := time.NewTicker(tsp.HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !heartbeat(args) {
+				slog.Info("tracker forgot us, announcing songs again")
+				become_discoverable(args)
+			}
+		}
+	}
+}
 
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+/**
+ * Sends one HEARTBEAT. A tracker that is down is not fatal, the next
+ * heartbeat just tries again
+ * @param args cl arguments which contain the port
+ * @return false if the tracker asked for the songs to be announced again
+ */
+func heartbeat(args []string) bool {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", tracker_addr, tsp.HEARTBEAT_INTERVAL)
+	defer func() { tracker_round_trip(start, err) }()
 	if err != nil {
-		panic(err)
+		return true
 	}
-	defer syscall.Close(fd)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tsp.HEARTBEAT_INTERVAL))
+	tracker := with_session(conn, tracker_addr)
 
-	if err = syscall.SetNonblock(fd, true); err != nil {
-		panic(err)
+	msg := tsp.NewMsg(tsp.HEARTBEAT, 0, []byte(announced_addr(args)))
+	sign_msg(msg, nil)
+	if err = tsp.Encode(tracker, msg); err != nil {
+		return true
 	}
-
-	// Get port and local ip address
-	port, _ := strconv.ParseInt(args[1], 10, 32)
-
-	// sruct for address + port
-	addr := syscall.SockaddrInet4{Port: int(port)}
-
-	// Copy local ip address to addr struct
-	copy(addr.Addr[:], net.ParseIP(GetLocalIP()).To4())
-
-	// bind and listen
-	syscall.Bind(fd, &addr)
-	syscall.Listen(fd, 10)
-
-	epfd, e := syscall.EpollCreate1(0)
-	if e != nil {
-		panic(e)
+	reply, err := tsp.Decode(tracker)
+	if err != nil {
+		return true
 	}
-	defer syscall.Close(epfd)
+	if needs_login(reply.Err()) {
+		slog.Warn("not logged in to the tracker", "tracker", tracker_addr, "err", reply.Err())
+	}
+	return reply.Header.Type != tsp.INIT
+}
 
-	event.Events = syscall.EPOLLIN
-	event.Fd = int32(fd)
-	if e = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); e != nil {
-		panic(e)
+/**
+ * Searches a local directory for mp3, FLAC, Ogg Vorbis and Opus files and
+ * builds their song entries from the library, which only rereads files
+ * that changed since the last scan
+ * @param dir_name directory of the local songs
+ * @return an entry for every local song, without ID or PeerAddr
+ */
+func get_local_song_info(dir_name string) []tsp.SongEntry {
+	files, err := ioutil.ReadDir(dir_name)
+	if err != nil {
+		slog.Error("can't read songs", "dir", dir_name, "err", err)
+		os.Exit(1)
 	}
 
-	for {
-		nevents, e := syscall.EpollWait(epfd, events[:], -1)
-		if e != nil {
-			fmt.Println("epoll_wait: ", e)
-			break
+	songs := make([]tsp.SongEntry, 0, len(files))
+	names := make(map[string]bool)
+	for _, f := range files {
+		if song_format(f.Name()) == "" {
+			continue
 		}
-
-		for ev := 0; ev < nevents; ev++ {
-			if int(events[ev].Fd) == fd {
-				connFd, _, err := syscall.Accept(fd)
-				if err != nil {
-					fmt.Println("accept: ", err)
-					continue
-				}
-				syscall.SetNonblock(fd, true)
-				event.Events = syscall.EPOLLIN | EPOLLET
-				event.Fd = int32(connFd)
-				err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, connFd, &event)
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				go receive_message_epoll(int(events[ev].Fd))
-			}
+		names[f.Name()] = true
+		song, err := library_song(dir_name, f.Name())
+		if err != nil {
+			slog.Warn("can't read song", "file", f.Name(), "err", err)
+			continue
 		}
+		songs = append(songs, song)
 	}
+	prune_library(dir_name, names)
+	return songs
 }
 
 /**
- * sends the mp3 bytes to the client using syscall.Write
- * @param client_fd the client's file descriptor
+ * Reads the metadata of one local file from its tags, applying the
+ * hand-written <song>.mp3.info file ("<title>, <artist> > <filename>")
+ * next to it if it has one
+ * @param dir_name directory of the local songs
+ * @param name the song's filename within it
+ * @return the song's metadata
  */
-func send_mp3_file(song_file string, client int) {
-	defer syscall.Close(client)
-	bytes, err := ioutil.ReadFile("songs/" + song_file)
+func read_local_info(dir_name string, name string) (*SongInfo, error) {
+	song_path := dir_name + "/" + name
+	info, err := read_song_info(song_path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	syscall.Write(client, bytes)
+	info.Filename = name
+	if content, err := ioutil.ReadFile(song_path + ".info"); err == nil {
+		parse_info_file(string(content[:]), info)
+	}
+	return info, nil
 }
 
-/*----------------------------CLIENT----------------------------*/
+/**
+ * Applies a hand-written .info override, "<title>, <artist> > <filename>",
+ * to scanned metadata. Malformed files are ignored
+ * @param content the contents of the .info file
+ * @param info the metadata to override
+ */
+func parse_info_file(content string, info *SongInfo) {
+	line := strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+	end := strings.LastIndex(line, ">")
+	if end < 0 {
+		slog.Warn("ignoring malformed .info file", "file", info.Filename)
+		return
+	}
+	fields := strings.SplitN(line[:end], ",", 2)
+	info.Title = strings.TrimSpace(fields[0])
+	if len(fields) == 2 {
+		info.Artist = strings.TrimSpace(fields[1])
+	}
+}
 
 /**
- * Makes the client 'discoverable' to other peers by sending
- * the host's song lsit to the tracker server
- * @param args cl arguments which contain the port and directory
- * with songs
+ * Builds a registration entry from scanned metadata, filling in anything
+ * the tags lacked
+ * @param info the scanned metadata
+ * @return the entry to register with the tracker
  */
-func become_discoverable(args []string) {
-	songs := get_local_song_info(args[2])
-	msg_content := ""
-	for _, s := range songs {
-		msg_content += s
+func new_song_entry(info *SongInfo) tsp.SongEntry {
+	title := info.Title
+	if title == "" {
+		title = strings.Replace(strings.TrimSuffix(info.Filename, path.Ext(info.Filename)), "_", " ", -1)
+	}
+	artist := info.Artist
+	if artist == "" {
+		artist = "Unknown Artist"
+	}
+	return tsp.SongEntry{
+		Title:    title,
+		Artist:   artist,
+		Duration: info.Duration,
+		Album:    info.Album,
+		Genre:    info.Genre,
+		Track:    info.Track,
+		Disc:     info.Disc,
+		Sources: []tsp.SongSource{{
+			Filename: info.Filename,
+			Size:     info.Size,
+			Hash:     info.Hash,
+			Format:   info.Format,
+			Gain:     info.Gain,
+		}},
 	}
-	msg := prepare_msg(INIT, 0, []byte(msg_content))
-	tracker := send(*msg, TRACKER_IP+args[1])
-	defer tracker.Close()
 }
 
-/*
- * Populates a struct to send using TSP protocol
- * @param t Song Type
- * @param id Song ID
- * @param contennt content of the message
+/**
+ * prints master list received from tracker
+ * Prints the list of songs from tracker
+ * @aram list the master list received from tracker
  */
-func prepare_msg(t byte, id int, content []byte) *TSP_msg {
-	return &TSP_msg{TSP_header{t, id}, content}
+func print_master_list(list []tsp.SongEntry) {
+	write_master_list(os.Stdout, list)
 }
 
 /**
- * Sends a TSP message
- * @param msg the message to send
- * @param dest_ip the destination ip address
- * @return conn the net.Conn of the destination host
+ * Writes the list of songs, one per line
+ * @param w where the list is written
+ * @param list the songs to write
  */
-func send(msg TSP_msg, dest_ip string) (conn net.Conn) {
-	conn, err := net.Dial("tcp", dest_ip)
-	if err != nil {
-		fmt.Println("error connecting to " + dest_ip)
-		os.Exit(1)
-	}
-	encoder := gob.NewEncoder(conn)
-	encoder.Encode(msg)
-	return
+func write_master_list(w io.Writer, list []tsp.SongEntry) {
+	write_songs(w, list, nil)
 }
 
 /**
- * Searches a local directory for song information in a format
- * specified by the TSP protocol
- * @param dir_name directory of the local songs and their info
- * @return a bye slice of the song information stored locally
+ * Writes the list of songs, one per line, noting how many other encodes
+ * of each are hidden
+ * @param w where the list is written
+ * @param list the songs to write
+ * @param encodes how many near-duplicates each song stands for, by ID
  */
-func get_local_song_info(dir_name string) []string {
-	info_files, err := ioutil.ReadDir(dir_name)
-	if err != nil {
-		fmt.Println("cant read songs")
-		os.Exit(1)
+func write_songs(w io.Writer, list []tsp.SongEntry, encodes map[int]int) {
+	ratings := song_ratings()
+	for _, song := range list {
+		fmt.Fprintf(w, "%d: %s, %s (%s)", song.ID, song.Title, song.Artist, format_duration(song.Duration))
+		if len(song.Sources) > 1 {
+			fmt.Fprintf(w, " [%d peers]", len(song.Sources))
+		}
+		if ids := source_fingerprints(song.Sources); ids != "" {
+			fmt.Fprintf(w, " [%s]", ids)
+		}
+		if n := encodes[song.ID]; n > 0 {
+			fmt.Fprintf(w, " [+%d encodes]", n)
+		}
+		fmt.Fprint(w, format_rating(ratings[song.ID]))
+		if len(song.Sources) > 0 && song.Sources[0].Format != "" && song.Sources[0].Format != tsp.FORMAT_MP3 {
+			fmt.Fprintf(w, " [%s]", song.Sources[0].Format)
+		}
+		fmt.Fprintln(w)
 	}
+	fmt.Fprintln(w, " ")
+}
 
-	song_info := make([]string, len(info_files))
-	for i := 0; i < len(info_files); i++ {
-		if path.Ext(info_files[i].Name()) != ".info" {
+/**
+ * @param sources the peers serving a song
+ * @return the fingerprints of the first few with an identity key, and how
+ * many more there are
+ */
+func source_fingerprints(sources []tsp.SongSource) string {
+	var ids []string
+	more := 0
+	for _, source := range sources {
+		if len(source.Key) == 0 {
+			continue
+		}
+		if len(ids) == 3 {
+			more++
 			continue
 		}
-		content, _ := ioutil.ReadFile(dir_name + "/" + info_files[i].Name())
-		song_info = append(song_info, string(content[:]))
+		ids = append(ids, fingerprint(source.Key))
 	}
-	return song_info
+	if more > 0 {
+		ids = append(ids, fmt.Sprintf("+%d", more))
+	}
+	return strings.Join(ids, ", ")
 }
 
 /**
- * prints master list received from tracker
- * Prints the list of songs from tracker
- * @aram list the master list received from tracker
+ * @return the duration as m:ss, or ?:?? if it is unknown
  */
-func print_master_list(list string) {
-	rows := strings.Split(list, "\n")
-	for _, r := range rows {
-		song_id := strings.Split(r, ":")[0]
-		song_name := strings.Split(r, ",")[1]
-		song_artist := strings.Split(r, ",")[2]
-		end := strings.Index(song_artist, ">")
-		fmt.Println(song_id + ":" + song_name + "," + song_artist[:end])
-	}
-	fmt.Println(" ")
+func format_duration(d time.Duration) string {
+	if d <= 0 {
+		return "?:??"
+	}
+	secs := int(d.Seconds())
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
 }
 
 /**
@@ -338,150 +552,536 @@ func get_cmd() string {
 		Reader: os.Stdin,
 	}
 	query := "Select option"
-	cmd, _ := ui.Select(query, []string{"LIST", "INFO", "PLAY", "STOP", "QUIT"}, &input.Options{
+	if playback.Paused() {
+		query += " [paused]"
+	}
+	cmd, _ := ui.Select(query, []string{"LIST", "SEARCH", "BROWSE", "CHARTS", "WHO", "FRIENDS", "HISTORY", "MOST PLAYED", "STATS", "INFO", "PLAY", "PLAYALBUM", "NOWPLAYING", "LYRICS", "QUEUE", "PLAYLIST", "SHARED", "RATE", "FAVORITES",
+		"NEXT", "PREV", "SHUFFLE", "REPEAT", "DOWNLOAD", "RECORD", "BROADCAST", "RADIO", "PARTY", "PAUSE", "RESUME", "SEEK +30s", "SEEK -30s", "VOLUME", "VOL +", "VOL -", "CROSSFADE", "EQ", "OUTPUT", "CAST", "SLEEP",
+		"STOP", "QUIT"}, &input.Options{
 		Loop: true,
 	})
 	return cmd
 }
 
 /**
- * Prints the song info for the song specified id
+ * Prints the song info for the song specified id: the metadata a peer
+ * serving it reads from the file, or the master list entry if none of
+ * them answers
  * @param id the id of the song that we want to print the
  */
-func get_song_info(id string) {
-	songs := strings.Split(master_list, "\n")
-	for _, s := range songs {
-		song_id := strings.Split(s, ":")[0]
-		if song_id == id {
-			fmt.Println(s + "\n")
-			return
+func get_song_info(id int) {
+	song, ok := find_song(id)
+	if !ok {
+		fmt.Println("Song not found.")
+		return
+	}
+	details, err := fetch_song_details(song)
+	write_song_info(os.Stdout, song, details, err)
+}
+
+/**
+ * Writes a song's info
+ * @param w where it is written
+ * @param song the master list entry of the song
+ * @param details what a peer serving it read from the file
+ * @param err why there are no details, nil if there are
+ */
+func write_song_info(w io.Writer, song tsp.SongEntry, details tsp.SongDetails, err error) {
+	fmt.Fprintln(w, "ID:       ", song.ID)
+	if err != nil {
+		fmt.Fprintln(w, "no peer sent details, showing the master list entry: ", err)
+		fmt.Fprintln(w, "Title:    ", song.Title)
+		fmt.Fprintln(w, "Artist:   ", song.Artist)
+		fmt.Fprintln(w, "Duration: ", format_duration(song.Duration))
+	} else {
+		fmt.Fprintln(w, "Title:    ", details.Title)
+		fmt.Fprintln(w, "Artist:   ", details.Artist)
+		fmt.Fprintln(w, "Album:    ", details.Album)
+		fmt.Fprintln(w, "Year:     ", details.Year)
+		fmt.Fprintln(w, "Duration: ", format_duration(details.Duration))
+		fmt.Fprintln(w, "Codec:    ", details.Codec)
+		fmt.Fprintf(w, "Bitrate:   %d kbps\n", details.Bitrate)
+		fmt.Fprintf(w, "Size:      %.1f MB\n", float64(details.Size)/(1<<20))
+	}
+	for _, source := range song.Sources {
+		fmt.Fprintln(w, "Peer:     ", source.PeerAddr, "("+source.Filename+")")
+	}
+	fmt.Fprintln(w)
+}
+
+/**
+ * Asks the song's sources in turn for its metadata
+ * @param song the song to describe
+ * @return the details from the first source to answer
+ */
+func fetch_song_details(song tsp.SongEntry) (tsp.SongDetails, error) {
+	err := errors.New("no sources")
+	for _, source := range song.Sources {
+		var conn net.Conn
+		conn, _, err = send_to_peer(*tsp.NewMsg(tsp.INFO, song.ID, nil), source)
+		if err != nil {
+			continue
+		}
+		var reply *tsp.Msg
+		reply, err = tsp.Decode(conn)
+		conn.Close()
+		if err == nil {
+			err = reply.Err()
+		}
+		if err == nil {
+			return tsp.DecodeDetails(reply.Msg)
 		}
 	}
-	fmt.Println("Song not found.")
-	return
+	return tsp.SongDetails{}, retryable("the song's peers", err)
 }
 
 /**
  * Prompts and read id selection from the user
- * @return ret the song id
- * @return ip the ip address of the remote peer
+ * @return song the master list entry of the selected song
  */
-func get_song_selection() (int, string) {
-	songs := strings.Split(master_list, "\n")
-	var ip string
+func get_song_selection() tsp.SongEntry {
+	var song tsp.SongEntry
 
 	ui := &input.UI{
 		Writer: os.Stdout,
 		Reader: os.Stdin,
 	}
 	query := "Select a song"
-	id, _ := ui.Ask(query, &input.Options{
+	ui.Ask(query, &input.Options{
 		ValidateFunc: func(id string) error {
-			for _, s := range songs {
-				song_id := strings.Split(s, ":")[0]
-				if song_id == id {
-					ip = strings.SplitN(s, ":", 3)[1][1:]
-					return nil
-				}
+			n, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return fmt.Errorf("song id must be a number")
+			}
+			var ok bool
+			if song, ok = find_song(n); !ok {
+				return fmt.Errorf("song id not here")
 			}
-			return fmt.Errorf("song id not here")
+			return nil
 		},
 		Loop: true,
 	})
-	ret, _ := strconv.ParseInt(id, 10, 32)
-	return int(ret), ip + ":"
+	return song
 }
 
 /**
-* receives master list from tracker
-* prints master list received from tracker
+ * Sends a TSP message to the first reachable peer serving a song, trying
+ * its sources in order. PLAY, SEEK and INFO ask each peer for the FileID
+ * its source advertised, so peers that number songs differently still
+ * find it. PLAY and SEEK are
+ * answered with a header before the song data, whose format is passed
+ * back in the source. If the only peers that answered were busy, they are
+ * all tried again after BUSY_RETRY_DELAY
+ * @param msg the message to send
+ * @param song the song whose sources to try
+ * @return the connection to the peer that answered, and its source entry
  */
-func receive_master_list(tracker net.Conn) {
-	defer tracker.Close()
-	decoder := gob.NewDecoder(tracker)
-	in_msg := new(TSP_msg)
-	decoder.Decode(&in_msg)
+func send_to_source(msg tsp.Msg, song tsp.SongEntry) (net.Conn, tsp.SongSource, error) {
+	var timeout error
+	for attempt := 0; ; attempt++ {
+		busy := false
+		for _, source := range song.Sources {
+			if source.Partial || is_blocked(source.Key) {
+				// only serves the pieces it has, to a swarm, or is blocked
+				continue
+			}
+			conn, source, err := send_to_peer(msg, source)
+			if reply, ok := err.(*tsp.Error); ok {
+				slog.Info("peer turned the request away, trying next", "peer", source.PeerAddr, "err", reply)
+				busy = busy || reply.Code == tsp.ERR_BUSY
+				continue
+			}
+			if err != nil {
+				slog.Warn("peer unreachable, trying next", "peer", source.PeerAddr, "err", err)
+				if is_timeout(err) {
+					timeout = err
+				}
+				continue
+			}
+			return conn, source, nil
+		}
+		if !busy || attempt == BUSY_RETRIES {
+			break
+		}
+		slog.Info("every peer serving the song is busy, retrying", "song", song.Title, "delay", BUSY_RETRY_DELAY)
+		time.Sleep(BUSY_RETRY_DELAY)
+	}
+	if timeout != nil {
+		return nil, tsp.SongSource{}, &TimeoutError{Who: fmt.Sprintf("the peers serving %q", song.Title), Err: timeout}
+	}
+	return nil, tsp.SongSource{}, fmt.Errorf("no peer serving %q is reachable", song.Title)
+}
+
+/**
+ * Sends a TSP message to one source of a song, reading the reply header
+ * of a PLAY or SEEK
+ * @param msg the message to send
+ * @param source the peer to send it to
+ * @return the connection, and the source with the format the peer
+ * replied with; a *tsp.Error if the peer turned the request away. A
+ * source with a hash or format that isn't one is refused, as the song is
+ * cached under them
+ */
+func send_to_peer(msg tsp.Msg, source tsp.SongSource) (net.Conn, tsp.SongSource, error) {
+	if is_blocked(source.Key) {
+		return nil, source, fmt.Errorf("%s is blocked", fingerprint(source.Key))
+	}
+	if (source.Hash != "" && !tsp.ValidHash(source.Hash)) || !tsp.ValidFormat(source.Format) {
+		return nil, source, fmt.Errorf("%s announced a bad hash or format", source.PeerAddr)
+	}
+	var conn net.Conn
+	var err error
+	streaming := msg.Header.Type == tsp.PLAY || msg.Header.Type == tsp.SEEK
+	if streaming && config.QUIC && source.Caps&tsp.CAP_QUIC != 0 {
+		if conn, err = dial_quic(context.Background(), source.PeerAddr); err != nil {
+			slog.Info("QUIC dial failed, falling back to TCP", "peer", source.PeerAddr, "err", err)
+		}
+	}
+	if conn == nil {
+		conn, err = dial_peer(context.Background(), source.PeerAddr, source.Key)
+	}
+	if err != nil && is_timeout(err) && tracker_addr != "" {
+		slog.Info("peer unreachable, relaying through the tracker", "peer", source.PeerAddr)
+		conn, err = dial_relay(context.Background(), source.PeerAddr)
+		if err == nil && config.MTLS {
+			conn, err = client_tls(context.Background(), conn, source.Key)
+		}
+	}
+	if err != nil {
+		return nil, source, err
+	}
+	// with the song's master list ID, for the stats
+	transfer_msg := msg
+	switch msg.Header.Type {
+	case tsp.PLAY, tsp.SEEK, tsp.INFO, tsp.ART, tsp.PIECES, tsp.HAVE:
+		msg.Header.Song_id = source.FileID
+	}
+	// a peer listed with an identity key has to sign its reply, along with
+	// a challenge, so nobody else at its address can serve in its place
+	var challenge []byte
+	if streaming && len(source.Key) > 0 {
+		challenge = make([]byte, CHALLENGE_LEN)
+		if _, err = rand.Read(challenge); err != nil {
+			conn.Close()
+			return nil, source, err
+		}
+		msg.Msg = challenge
+	}
+	// signed, so a peer serving a restricted song knows who is asking
+	sign_msg(&msg, nil)
+	if err = tsp.Encode(conn, &msg); err != nil {
+		conn.Close()
+		return nil, source, err
+	}
+	if !streaming {
+		return conn, source, nil
+	}
+
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, source, err
+	}
+	if challenge != nil && (!tsp.Verify(reply, challenge) || !bytes.Equal(reply.Header.Key, source.Key)) {
+		conn.Close()
+		return nil, source, fmt.Errorf("%s isn't the peer %s announced", source.PeerAddr, fingerprint(source.Key))
+	}
+	if !tsp.ValidFormat(reply.Header.Format) {
+		conn.Close()
+		return nil, source, fmt.Errorf("%s replied with an unknown format %q", source.PeerAddr, reply.Header.Format)
+	}
+	if reply.Header.Format != "" {
+		source.Format = reply.Header.Format
+	}
+	return NewCountingConn(conn, download_transfer(transfer_msg, source)), source, nil
+}
 
-	master_list = string(in_msg.Msg[:])
-	print_master_list(master_list)
+/**
+ * Picks the sources an interrupted transfer can be resumed from: the peer
+ * it was coming from, then any other peer serving an identical file
+ * @param song the song being transferred
+ * @param source the peer the transfer started on
+ * @return the song with only those sources, same peer first
+ */
+func resume_sources(song tsp.SongEntry, source tsp.SongSource) tsp.SongEntry {
+	sources := []tsp.SongSource{source}
+	for _, s := range song.Sources {
+		if s.PeerAddr != source.PeerAddr && source.Hash != "" && s.Hash == source.Hash {
+			sources = append(sources, s)
+		}
+	}
+	song.Sources = sources
+	return song
+}
+
+/**
+ * Fetches the master list from the tracker, or builds it from the peers
+ * on the LAN if there is no tracker, and keeps it as the master list, on
+ * disk too. If the tracker can't be reached, it is built from the peers
+ * known through peer exchange instead
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @return the new master list
+ */
+func load_master_list(ctx context.Context, args []string) ([]tsp.SongEntry, error) {
+	var songs []tsp.SongEntry
+	from_tracker := false
+	if tracker_addr == "" {
+		songs = discover_master_list(ctx, args)
+	} else {
+		var err error
+		if songs, err = fetch_tracker_list(); err == nil {
+			pex_learn_songs(songs)
+			from_tracker = true
+		} else if peers := pex_peers(MAX_PEX_PEERS); len(peers) > 0 {
+			slog.Warn("tracker unreachable, asking known peers for their songs", "peers", len(peers), "err", err)
+			songs = query_master_list(peers, local_addr(args))
+		} else {
+			return nil, retryable("the tracker", err)
+		}
+	}
+	master_mutex.Lock()
+	master_list = songs
+	master_list_time = time.Now()
+	master_mutex.Unlock()
+	save_list_cache(songs, from_tracker)
+	return songs, nil
+}
+
+/**
+ * Asks the tracker for the master list: only the changes since the copy
+ * kept from last time, or the whole list from trackers that predate
+ * LIST_SINCE
+ * @return the songs the tracker knows
+ */
+func fetch_tracker_list() (songs []tsp.SongEntry, err error) {
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	if songs, err = fetch_list_delta(); err == nil {
+		return songs, nil
+	}
+	slog.Debug("no list delta from the tracker, fetching the whole list", "err", err)
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	request := tsp.NewMsg(tsp.LIST, 0, nil)
+	// signed, so the list has the songs only some peers may see
+	sign_msg(request, nil)
+	if err = tsp.Encode(tracker, request); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err != nil {
+		return nil, err
+	}
+	if err = in_msg.Err(); err != nil {
+		return nil, err
+	}
+	return tsp.DecodeSongs(in_msg.Msg)
 }
 
 /**
  * handle input command from the user
+ * @param ctx cancelled when the peer shuts down
  * @param args
- * @param play the channel to send play requests to goroutines
- * @param stop the channel to send stop requests to goroutines
  * LIST - get song list from peers
+ * SEARCH <query> - find songs by title or artist, and play one
+ * BROWSE - go through the songs by artist, album or genre, and play one
+ * CHARTS - the songs played most over the last day or week
+ * WHO - the peers online and what they are listening to
+ * FRIENDS - the peers followed, and their libraries; follow or unfollow one
+ * HISTORY / MOST PLAYED - the latest plays, or the songs played most, here
+ * RATE - rate a song, and make it a favorite or not
+ * FAVORITES - replace the queue with the favorites and play them
  * PLAY <song id> - play song
+ * QUEUE <song id> - add song to the play queue
+ * PLAYLIST - create, edit, list and play playlists
+ * SHARED - the playlists kept by the tracker that every peer can add to
+ * NEXT / PREV - play the next or previous song in the queue
+ * SHUFFLE - shuffle the queue or not, or play the whole master list shuffled
+ * REPEAT - repeat the queue's song, the whole queue, or neither
+ * DOWNLOAD <song id> - save song to the downloads directory
+ * RECORD - record the songs that play into the songs directory, or stop
+ * BROADCAST - broadcast what plays to an Icecast mount, or stop
+ * RADIO - list the live broadcasts between peers, go on the air or tune in
+ * PARTY - list the listening parties, host, join or leave one, or vote to skip
  * PAUSE - pauses playing of song (buffering continues)
+ * RESUME - resumes a paused song
+ * SEEK +30s / -30s - jump forward or back in the current song
+ * VOLUME <0-100|+|->, VOL +, VOL - - set the playback volume
+ * CROSSFADE <0-10> - set the seconds queued songs fade into each other over
+ * EQ - set the equalizer to a preset, or one band's gain
+ * OUTPUT - choose the audio output device
+ * CAST - cast a song to a Chromecast, or pause, play or stop the cast
+ * SLEEP <minutes> - fade out and stop playback after a while, 0 cancels
  * STOP - stop streaming song
  * QUIT - <--
  */
-func handle_command(args []string, play chan bool, stop chan bool) int {
+func handle_command(ctx context.Context, args []string) int {
 	cmd := get_cmd()
 
 	switch cmd {
 	case "LIST":
-		msg := prepare_msg(LIST, 0, nil)
-		tracker := send(*msg, TRACKER_IP+args[1])
-		receive_master_list(tracker)
+		songs, age, err := current_list(ctx, args)
+		if err != nil {
+			fmt.Println("error receiving list: ", err)
+			break
+		}
+		write_list_age(os.Stdout, age)
+		page_through(songs)
 	case "PLAY":
-		id, peer_ip := get_song_selection()
-		msg := prepare_msg(PLAY, id, nil)
-		peer := send(*msg, peer_ip+args[1])
-		go receive_mp3(peer, play, stop)
-		play <- true
+		song := get_song_selection()
+		if _, err := play_song(ctx, song, !ask_resume(song)); err != nil {
+			fmt.Println(err)
+		}
+	case "SEARCH":
+		handle_search(ctx)
+	case "BROWSE":
+		handle_browse(ctx, args)
+	case "PLAYALBUM":
+		handle_play_album(ctx, args)
+	case "CHARTS":
+		handle_charts()
+	case "WHO":
+		handle_who(ctx)
+	case "FRIENDS":
+		handle_friends(ctx)
+	case "RATE":
+		handle_rate()
+	case "FAVORITES":
+		if err := play_favorites(ctx); err != nil {
+			fmt.Println(err)
+		}
+	case "HISTORY":
+		handle_history(false)
+	case "MOST PLAYED":
+		handle_history(true)
+	case "STATS":
+		handle_stats(nil, true, os.Stdout)
+	case "QUEUE":
+		song := get_song_selection()
+		fmt.Printf("Queued at position %d.\n", queue.Add(song))
+		queue.Print()
+	case "PLAYLIST":
+		handle_playlist_command(ctx)
+	case "SHARED":
+		handle_shared_menu(ctx)
+	case "SHUFFLE", "REPEAT":
+		handle_modes(ctx, args, cmd)
+	case "NEXT":
+		play_next(ctx, 1)
+	case "PREV":
+		play_next(ctx, -1)
+	case "DOWNLOAD":
+		song := get_song_selection()
+		if err := download_song(song); err != nil {
+			fmt.Println("download failed: ", err)
+		}
 	case "INFO":
-		id, _ := get_song_selection()
-		get_song_info(strconv.Itoa(id))
+		song := get_song_selection()
+		get_song_info(song.ID)
+	case "VOLUME":
+		ui := &input.UI{
+			Writer: os.Stdout,
+			Reader: os.Stdin,
+		}
+		arg, _ := ui.Ask(fmt.Sprintf("Volume (0-100, + or -, now %d)", get_volume()), &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				_, err := parse_volume(arg)
+				return err
+			},
+		})
+		v, _ := parse_volume(arg)
+		fmt.Printf("Volume %d.\n", set_volume(v))
+	case "CROSSFADE":
+		ui := &input.UI{
+			Writer: os.Stdout,
+			Reader: os.Stdin,
+		}
+		arg, _ := ui.Ask(fmt.Sprintf("Crossfade (0-%d seconds, now %d)", MAX_CROSSFADE, get_crossfade()), &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				_, err := parse_crossfade(arg)
+				return err
+			},
+		})
+		secs, _ := parse_crossfade(arg)
+		fmt.Printf("Crossfade %ds.\n", set_crossfade(secs))
+	case "EQ":
+		handle_eq()
+	case "RECORD":
+		status, err := toggle_recording("")
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		fmt.Println(status)
+	case "BROADCAST":
+		arg := "on"
+		if icecast_mount() != nil {
+			arg = "off"
+		}
+		status, err := handle_broadcast(ctx, arg)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		fmt.Println(status)
+	case "RADIO":
+		handle_radio_menu(ctx)
+	case "PARTY":
+		handle_party_menu(ctx)
+	case "OUTPUT":
+		handle_output_menu()
+	case "CAST":
+		handle_cast_menu(ctx, args)
+	case "SLEEP":
+		ui := &input.UI{
+			Writer: os.Stdout,
+			Reader: os.Stdin,
+		}
+		fmt.Println(format_sleep())
+		arg, _ := ui.Ask("Stop playback in how many minutes (0 cancels)", &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				_, err := parse_sleep(arg)
+				return err
+			},
+		})
+		minutes, _ := parse_sleep(arg)
+		set_sleep(minutes)
+		fmt.Println(format_sleep())
+	case "VOL +":
+		fmt.Printf("Volume %d.\n", set_volume(get_volume()+VOLUME_STEP))
+	case "VOL -":
+		fmt.Printf("Volume %d.\n", set_volume(get_volume()-VOLUME_STEP))
+	case "NOWPLAYING":
+		show_now_playing()
+		fmt.Println()
+	case "LYRICS":
+		show_lyrics()
+	case "PAUSE":
+		playback.Pause()
+		fmt.Println("Paused.")
+	case "RESUME":
+		playback.Resume()
+		fmt.Println("Resumed.")
+	case "SEEK +30s":
+		seek_current(ctx, SEEK_STEP)
+	case "SEEK -30s":
+		seek_current(ctx, -SEEK_STEP)
 	case "STOP":
-		stop <- true
+		playback.End()
 	case "QUIT":
-		msg := prepare_msg(QUIT, 0, nil)
-		_ = send(*msg, TRACKER_IP+args[1])
 		return -1
 	default:
 		fmt.Println("invalid command")
 	}
 	return 0
 }
-
-/**
- * Receives the mp3 bytes from the peer. Spawns off a goroutine to actually
- * play the music. This function will continue to play music until the song is
- * done or a stop message is received
- *
- * @param serrver the generic and stream-oriented connection with a peer
- * @param play channel to receive play messages
- * @param stop channel to receive stop messages
- */
-func receive_mp3(server net.Conn, play chan bool, stop chan bool) {
-	defer server.Close()
-	for {
-		select {
-		case <-stop:
-			return
-		case <-play:
-			decoder, err := mp3.NewDecoder(server)
-			if err != nil && err == io.EOF {
-				return
-			}
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			defer decoder.Close()
-			player, err := oto.NewPlayer(decoder.SampleRate(), 2, 2, 8192)
-			if err != nil && err == io.EOF {
-				return
-			}
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			defer player.Close()
-
-			go func() {
-				_, _ = io.Copy(player, decoder)
-			}()
-		}
-	}
-}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Peer exchange. A serving peer keeps the addresses of the other peers it
+ * has heard of, from the master list, LAN discovery, the DHT and other
+ * peers, and every PEX_INTERVAL swaps them with a few of those peers. If
+ * the tracker can't be reached, the master list is built by asking the
+ * known peers for their songs instead, so the swarm carries on while the
+ * tracker is down
+ */
+
+const (
+	// how often a serving peer swaps known peers with others
+	PEX_INTERVAL = time.Minute
+	// how many peers it swaps with each time
+	PEX_FANOUT = 3
+	// most addresses a PEX message carries
+	MAX_PEX_PEERS = 50
+	// most peers kept, and how long one is kept without being heard of
+	MAX_KNOWN_PEERS = 500
+	PEX_TTL         = 30 * time.Minute
+)
+
+var (
+	pex_mutex sync.Mutex
+	// the serving address of every peer heard of, and when it last was
+	known_peers = make(map[string]time.Time)
+)
+
+/**
+ * Records peers just heard of. Once MAX_KNOWN_PEERS are known, the one
+ * heard of longest ago makes way for each new one
+ * @param addrs their serving addresses
+ */
+func pex_learn(addrs []string) {
+	self := ""
+	if serve_args != nil {
+		self = announced_addr(serve_args)
+	}
+	pex_mutex.Lock()
+	defer pex_mutex.Unlock()
+	now := time.Now()
+	for _, addr := range addrs {
+		if addr == "" || addr == self {
+			continue
+		}
+		if _, ok := known_peers[addr]; !ok && len(known_peers) >= MAX_KNOWN_PEERS {
+			oldest := ""
+			for known, seen := range known_peers {
+				if oldest == "" || seen.Before(known_peers[oldest]) {
+					oldest = known
+				}
+			}
+			delete(known_peers, oldest)
+		}
+		known_peers[addr] = now
+	}
+}
+
+/**
+ * Forgets a peer that couldn't be reached, so it isn't passed on
+ * @param addr its serving address
+ */
+func pex_forget(addr string) {
+	pex_mutex.Lock()
+	delete(known_peers, addr)
+	pex_mutex.Unlock()
+}
+
+/**
+ * Records every peer serving a song in a list
+ * @param songs a master list
+ */
+func pex_learn_songs(songs []tsp.SongEntry) {
+	var addrs []string
+	for _, song := range songs {
+		for _, source := range song.Sources {
+			addrs = append(addrs, source.PeerAddr)
+		}
+	}
+	pex_learn(addrs)
+}
+
+/**
+ * @param n how many peers to return
+ * @return the n peers heard of most recently, forgetting any not heard of
+ * for PEX_TTL
+ */
+func pex_peers(n int) []string {
+	pex_mutex.Lock()
+	defer pex_mutex.Unlock()
+	addrs := make([]string, 0, len(known_peers))
+	for addr, seen := range known_peers {
+		if time.Since(seen) > PEX_TTL {
+			delete(known_peers, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return known_peers[addrs[i]].After(known_peers[addrs[j]])
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+/**
+ * @return the addresses to hand another peer: this peer's own, if it
+ * serves, and the ones it heard of most recently
+ */
+func pex_offer() []string {
+	addrs := pex_peers(MAX_PEX_PEERS - 1)
+	if serve_args != nil {
+		addrs = append([]string{announced_addr(serve_args)}, addrs...)
+	}
+	return addrs
+}
+
+/**
+ * Swaps known peers with a few of them every PEX_INTERVAL
+ * @param ctx cancelled when the peer shuts down
+ */
+func exchange_peers(ctx context.Context) {
+	ticker := time.NewTicker(PEX_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if len(pex_peers(1)) == 0 && tracker_addr != "" {
+			if songs, err := fetch_tracker_list(); err == nil {
+				pex_learn_songs(songs)
+			}
+		}
+		peers := pex_peers(MAX_KNOWN_PEERS)
+		rand.Shuffle(len(peers), func(i, j int) {
+			peers[i], peers[j] = peers[j], peers[i]
+		})
+		for i := 0; i < len(peers) && i < PEX_FANOUT; i++ {
+			if err := swap_peers(peers[i]); err != nil {
+				slog.Debug("peer exchange failed", "peer", peers[i], "err", err)
+				pex_forget(peers[i])
+			}
+		}
+	}
+}
+
+/**
+ * Sends a peer the peers this one knows, and learns the ones it knows
+ * @param addr the peer's serving address
+ * @return an error if the peer couldn't be reached
+ */
+func swap_peers(addr string) error {
+	content, err := tsp.EncodePeers(pex_offer())
+	if err != nil {
+		return err
+	}
+	conn, err := dial_peer(context.Background(), addr, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.PEX, 0, content)); err != nil {
+		return err
+	}
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		return err
+	}
+	addrs, err := tsp.DecodePeers(reply.Msg)
+	if err != nil {
+		return err
+	}
+	if len(addrs) > MAX_PEX_PEERS {
+		addrs = addrs[:MAX_PEX_PEERS]
+	}
+	pex_learn(append(addrs, addr))
+	return nil
+}
+
+/**
+ * Answers a PEX: learns the peers it carries, and replies with the ones
+ * this peer knows
+ * @param in_msg the request
+ * @param client the requesting peer
+ */
+func serve_pex(in_msg *tsp.Msg, client io.Writer) {
+	addrs, err := tsp.DecodePeers(in_msg.Msg)
+	if err != nil {
+		slog.Warn("bad peer exchange", "err", err)
+		return
+	}
+	if len(addrs) > MAX_PEX_PEERS {
+		addrs = addrs[:MAX_PEX_PEERS]
+	}
+	content, err := tsp.EncodePeers(pex_offer())
+	if err != nil {
+		slog.Error("can't encode known peers", "err", err)
+		return
+	}
+	pex_learn(addrs)
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.PEX, 0, content)); err != nil {
+		slog.Warn("can't send known peers", "err", err)
+	}
+}
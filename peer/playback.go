@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// seconds skipped by a single SEEK command
+	SEEK_STEP = 30
+	// assumed byte rate (128 kbps) until enough audio has played to measure it
+	DEFAULT_BYTE_RATE = 128000 / 8
+	// bytes of PCM handed to the player per write
+	PCM_CHUNK = 8192
+)
+
+/**
+ * One song being streamed: the connection it arrives on, buffered, and
+ * whether it has been told to stop
+ */
+type Stream struct {
+	buffer *StreamBuffer
+	// set under playback.mutex once Stop is called
+	stopped bool
+	// closed once the player goroutine has torn everything down
+	done chan struct{}
+}
+
+/**
+ * The playback controller. It owns the stream and decoder of the current
+ * song: a single goroutine feeds the shared player (see output.go),
+ * checking for a stop before every write, and is the only one to close
+ * the decoder and release the player
+ */
+type Playback struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	paused      bool
+	song        tsp.SongEntry
+	source      tsp.SongSource
+	offset      int64
+	stream      *Stream
+	sample_rate int
+	pcm_bytes   int64
+	// PCM decoded ahead of what has played, for a crossfade
+	ahead_bytes int64
+	// the play not yet recorded in the history: when it started, and how
+	// long has been listened to so far, across seeks
+	play_open bool
+	played_at time.Time
+	listened  time.Duration
+	// PCM bytes still to skip, or while negative to hold back with
+	// silence, to keep in step with a party's host, see party.go
+	nudge int64
+}
+
+var playback = NewPlayback()
+
+func NewPlayback() *Playback {
+	p := &Playback{}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+/**
+ * Suspends audio output. The stream keeps buffering in the background
+ */
+func (p *Playback) Pause() {
+	p.mutex.Lock()
+	p.paused = true
+	p.mutex.Unlock()
+	output.Cut()
+}
+
+/**
+ * Resumes audio output where it was paused
+ */
+func (p *Playback) Resume() {
+	p.mutex.Lock()
+	p.paused = false
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+}
+
+/**
+ * @return whether audio output is currently paused
+ */
+func (p *Playback) Paused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused
+}
+
+/**
+ * Stops whatever is playing and starts playing a buffered song stream
+ * @param ctx cancelled when the peer shuts down
+ * @param buffer the song's mp3 bytes, arriving from the serving peer
+ * @param song the master list entry of the song
+ * @param source the peer streaming it
+ * @param offset the byte offset in the file the stream starts at
+ * @param on_end called if the song plays through to the end
+ */
+func (p *Playback) Play(ctx context.Context, buffer *StreamBuffer, song tsp.SongEntry, source tsp.SongSource, offset int64, on_end func()) {
+	p.Stop()
+	s := &Stream{buffer: buffer, done: make(chan struct{})}
+	buffer.SetResume(func(received int64) (io.ReadCloser, error) {
+		return p.resume(s, received)
+	})
+	buffer.Unthrottle()
+
+	p.mutex.Lock()
+	// a seek carries on the play it interrupted, anything else starts one
+	var ended *HistoryEntry
+	started := offset == 0 || !p.play_open || p.song.ID != song.ID
+	if started {
+		ended = p.take_play(false)
+		p.play_open = true
+		p.played_at = time.Now()
+		p.listened = 0
+	}
+	p.stream = s
+	p.song = song
+	p.source = source
+	p.offset = offset
+	p.pcm_bytes = 0
+	p.ahead_bytes = 0
+	p.nudge = 0
+	p.paused = false
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+	if ended != nil {
+		record_history(*ended)
+	}
+	if started {
+		run_hook(HOOK_TRACK_START, song_env(song, source.PeerAddr))
+	}
+
+	go p.run(ctx, s, on_end)
+	if bookmarkable(song, source) {
+		go p.keep_bookmark(s)
+	}
+}
+
+/**
+ * Stops the current song, if any, and waits until its connection and
+ * decoder have been closed and the player released
+ */
+func (p *Playback) Stop() {
+	p.mutex.Lock()
+	s := p.stream
+	if s != nil {
+		s.stopped = true
+		p.cond.Broadcast()
+	}
+	p.mutex.Unlock()
+	if s == nil {
+		return
+	}
+	// wakes up a decoder blocked waiting on the network
+	s.buffer.Close()
+	<-s.done
+}
+
+/**
+ * Stops the current song, if any, like Stop, and records the play in the
+ * history. Stop alone leaves it open, for a seek to carry on
+ */
+func (p *Playback) End() {
+	p.Stop()
+	output.Cut()
+	p.mutex.Lock()
+	ended := p.take_play(false)
+	p.mutex.Unlock()
+	if ended != nil {
+		record_history(*ended)
+	}
+}
+
+/**
+ * Closes the open play. Call with the mutex held
+ * @param completed whether the song played through to the end
+ * @return the play to record in the history, nil if none was open or too
+ * little of it was listened to
+ */
+func (p *Playback) take_play(completed bool) *HistoryEntry {
+	if !p.play_open {
+		return nil
+	}
+	p.play_open = false
+	completed_env := "TORERO_COMPLETED=0"
+	if completed {
+		completed_env = "TORERO_COMPLETED=1"
+	}
+	run_hook(HOOK_TRACK_END, append(song_env(p.song, p.source.PeerAddr),
+		fmt.Sprintf("TORERO_LISTENED=%d", int(p.listened.Seconds())), completed_env))
+	if !completed && p.listened < MIN_LISTEN {
+		return nil
+	}
+	return &HistoryEntry{
+		Song:      p.song,
+		Peer:      p.source.PeerAddr,
+		PlayedAt:  p.played_at,
+		Listened:  p.listened,
+		Completed: completed,
+	}
+}
+
+/**
+ * Waits until the current song, if any, has stopped playing
+ */
+func (p *Playback) Wait() {
+	p.mutex.Lock()
+	s := p.stream
+	p.mutex.Unlock()
+	if s != nil {
+		<-s.done
+	}
+}
+
+/**
+ * @return the song being streamed, and false if nothing is
+ */
+func (p *Playback) Current() (tsp.SongEntry, tsp.SongSource, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.song, p.source, p.stream != nil
+}
+
+/**
+ * Player goroutine for one stream
+ */
+func (p *Playback) run(ctx context.Context, s *Stream, on_end func()) {
+	completed := p.play_stream(ctx, s, on_end != nil)
+
+	p.mutex.Lock()
+	song, mark, bookmarked := p.bookmark(s)
+	if p.stream == s {
+		p.stream = nil
+	}
+	completed = completed && !s.stopped
+	source, offset := p.source, p.offset
+	if p.sample_rate > 0 {
+		p.listened += time.Duration(p.pcm_bytes) * time.Second / time.Duration(p.sample_rate*4)
+	}
+	var ended *HistoryEntry
+	if completed {
+		ended = p.take_play(true)
+	}
+	p.mutex.Unlock()
+	close(s.done)
+	if ended != nil {
+		record_history(*ended)
+	}
+	if bookmarked && completed {
+		clear_bookmark(mark.Hash)
+	} else if bookmarked {
+		save_bookmark(song, mark)
+	}
+	// the next song starts while the end of this one is still playing
+	if completed && on_end != nil {
+		on_end()
+	}
+
+	verified := false
+	if completed && offset == 0 {
+		err := s.buffer.Verify(source)
+		if err != nil {
+			slog.Warn("stream failed verification", "err", err)
+		}
+		verified = err == nil
+	}
+	s.buffer.FinishCache(verified)
+	s.buffer.FinishRecording(verified)
+}
+
+/**
+ * Decodes the stream and feeds the PCM to the shared player a chunk at a
+ * time, holding off while paused and giving up as soon as the stream is
+ * stopped or ctx is cancelled. Closes the decoder and connection and
+ * releases the player on return
+ * @param queued whether the song plays from the queue, and so may be
+ * crossfaded into the next one
+ * @return true if the song played through to the end
+ */
+func (p *Playback) play_stream(ctx context.Context, s *Stream, queued bool) bool {
+	defer s.buffer.Close()
+	p.mutex.Lock()
+	format := p.source.Format
+	// normalizes the song's loudness, see replaygain.go
+	gain := gain_factor(p.source.Gain)
+	p.mutex.Unlock()
+	decoder, err := new_decoder(format, s.buffer)
+	if err != nil {
+		if err != io.EOF && !p.is_stopped(s) {
+			slog.Error("can't decode stream", "err", err)
+			atomic.AddInt64(&metrics.PlaybackErrors, 1)
+		}
+		return false
+	}
+	defer decoder.Close()
+	if err = output.Acquire(decoder.SampleRate()); err != nil {
+		slog.Error("can't open audio output", "err", err)
+		atomic.AddInt64(&metrics.PlaybackErrors, 1)
+		return false
+	}
+	defer output.Release()
+
+	p.mutex.Lock()
+	p.sample_rate = decoder.SampleRate()
+	p.mutex.Unlock()
+	eq := NewEQFilter(decoder.SampleRate())
+
+	// decoded PCM not played yet: with a crossfade, the song is decoded
+	// that far ahead, so its last seconds are at hand once it ends
+	lookahead := 0
+	if queued {
+		lookahead = get_crossfade() * decoder.SampleRate() * 4
+	}
+	var pending []byte
+	start := 0
+	play := func(end int) bool {
+		for start < end {
+			chunk := pending[start:min_int(end, start+PCM_CHUNK)]
+			if !p.wait_while_paused(s) || ctx.Err() != nil || p.is_stopped(s) {
+				return false
+			}
+			if nudge := p.take_nudge(len(chunk)); nudge > 0 {
+				start += nudge
+				p.add_pcm(nudge, len(pending)-start)
+				continue
+			} else if nudge < 0 {
+				if output.Write(make([]byte, -nudge)) != nil {
+					return false
+				}
+				continue
+			}
+			gain_pcm(chunk, gain)
+			eq.Process(chunk)
+			broadcast_pcm(chunk, decoder.SampleRate())
+			scale_pcm(chunk, playback_volume())
+			scope.Feed(chunk, decoder.SampleRate())
+			if output.Write(chunk) != nil {
+				return false
+			}
+			start += len(chunk)
+			p.add_pcm(len(chunk), len(pending)-start)
+		}
+		return true
+	}
+
+	buf := make([]byte, PCM_CHUNK)
+	for {
+		if !p.wait_while_paused(s) || ctx.Err() != nil {
+			return false
+		}
+		n, err := decoder.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if !play(len(pending) - lookahead) {
+			return false
+		}
+		if start > 0 && start >= len(pending)/2 {
+			pending = append(pending[:0], pending[start:]...)
+			start = 0
+		}
+		if err == io.EOF {
+			if _, next := queue.Peek(); !next || start == len(pending) {
+				return play(len(pending))
+			}
+			tail := pending[start:]
+			gain_pcm(tail, gain)
+			eq.Process(tail)
+			scale_pcm(tail, playback_volume())
+			output.FadeOut(tail)
+			return true
+		}
+		if err != nil {
+			if !p.is_stopped(s) {
+				atomic.AddInt64(&metrics.PlaybackErrors, 1)
+			}
+			return false
+		}
+	}
+}
+
+/**
+ * Reconnects a stream that dropped before the end of the song, carrying
+ * on from the byte it got to. A stream that started at byte zero resumes
+ * exactly with a PLAY; one started by a SEEK only knows roughly where it
+ * is, so it resumes with another SEEK
+ * @param s the stream that dropped
+ * @param received bytes of the stream received so far
+ * @return the new connection, or an error if the song is complete, the
+ * stream was stopped, or no peer with the same file is reachable
+ */
+func (p *Playback) resume(s *Stream, received int64) (io.ReadCloser, error) {
+	p.mutex.Lock()
+	song, source, offset := p.song, p.source, p.offset
+	stopped := s.stopped || p.stream != s
+	p.mutex.Unlock()
+	if stopped {
+		return nil, io.EOF
+	}
+	pos := offset + received
+	if source.Size <= 0 || pos >= source.Size {
+		return nil, io.EOF
+	}
+
+	msg := tsp.NewMsg(tsp.PLAY, song.ID, nil)
+	if offset > 0 {
+		msg.Header.Type = tsp.SEEK
+	}
+	msg.Header.Offset = pos
+	slog.Warn("stream dropped, resuming", "peer", source.PeerAddr, "offset", pos)
+	conn, next, err := send_to_source(*msg, resume_sources(song, source))
+	if err != nil {
+		slog.Error("can't resume stream", "err", err)
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	if p.stream == s {
+		p.source = next
+	}
+	p.mutex.Unlock()
+	return conn, nil
+}
+
+/**
+ * @return whether Stop has been called on the stream
+ */
+func (p *Playback) is_stopped(s *Stream) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return s.stopped
+}
+
+/**
+ * Blocks the caller for as long as playback is paused
+ * @param s the stream the caller is playing
+ * @return false if the stream was stopped while waiting
+ */
+func (p *Playback) wait_while_paused(s *Stream) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.paused && !s.stopped {
+		p.cond.Wait()
+	}
+	return !s.stopped
+}
+
+/**
+ * Works out the byte offset into the song file that is delta seconds
+ * away from what is playing now, using the byte rate measured so far
+ * @param delta seconds to move, negative to go back
+ * @return the byte offset, and false if nothing is playing
+ */
+func (p *Playback) seek_offset(delta int) (int64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stream == nil {
+		return 0, false
+	}
+	consumed := p.heard(p.stream)
+	byte_rate := int64(DEFAULT_BYTE_RATE)
+	if p.sample_rate > 0 {
+		// stereo 16 bit PCM: 4 bytes per sample
+		elapsed := p.pcm_bytes / int64(p.sample_rate*4)
+		if elapsed > 0 {
+			byte_rate = consumed / elapsed
+		}
+	}
+	offset := p.offset + consumed + int64(delta)*byte_rate
+	if offset < 0 {
+		offset = 0
+	}
+	return offset, true
+}
+
+/**
+ * Works out how far into the current song playback is: in proportion to
+ * the bytes of the file the decoder has consumed when the size and
+ * duration are known, otherwise from the PCM played so far
+ * @return the song, the elapsed and total time, and false if nothing is
+ * playing
+ */
+func (p *Playback) Position() (tsp.SongEntry, time.Duration, time.Duration, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stream == nil {
+		return tsp.SongEntry{}, 0, 0, false
+	}
+	return p.song, p.elapsed(p.stream), p.song.Duration, true
+}
+
+/**
+ * Works out how far into the current song playback is from the PCM
+ * played, exactly for a song streamed from its start, and estimated from
+ * the byte offset for one started by a SEEK
+ * @return the song, how far into it playback is, and false if nothing is
+ * playing
+ */
+func (p *Playback) Clock() (tsp.SongEntry, time.Duration, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stream == nil {
+		return tsp.SongEntry{}, 0, false
+	}
+	var played time.Duration
+	if p.sample_rate > 0 {
+		played = time.Duration(p.pcm_bytes) * time.Second / time.Duration(p.sample_rate*4)
+	}
+	if p.offset > 0 && p.source.Size > 0 {
+		played += time.Duration(float64(p.song.Duration) * float64(p.offset) / float64(p.source.Size))
+	}
+	return p.song, played, true
+}
+
+/**
+ * Moves playback of the current song by a little, without restarting
+ * it: forward by skipping PCM, back by playing silence
+ * @param delta how far to move, replacing any move not made yet
+ */
+func (p *Playback) Nudge(delta time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stream == nil || p.sample_rate == 0 {
+		return
+	}
+	// stereo 16 bit PCM: 4 bytes per sample
+	p.nudge = int64(delta.Seconds()*float64(p.sample_rate)) * 4
+}
+
+/**
+ * Takes the next step of a Nudge
+ * @param n bytes of PCM about to play
+ * @return bytes of them to skip, or while negative, bytes of silence to
+ * play first; 0 to play them
+ */
+func (p *Playback) take_nudge(n int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	step := p.nudge
+	if step > int64(n) {
+		step = int64(n)
+	} else if step < -PCM_CHUNK {
+		step = -PCM_CHUNK
+	}
+	p.nudge -= step
+	return int(step)
+}
+
+/**
+ * @param s the stream playing
+ * @return how far into the song it has played. Call with the mutex held
+ */
+func (p *Playback) elapsed(s *Stream) time.Duration {
+	total := p.song.Duration
+	read := p.offset + p.heard(s)
+	var elapsed time.Duration
+	if p.source.Size > 0 && total > 0 {
+		elapsed = time.Duration(float64(total) * float64(read) / float64(p.source.Size))
+	} else if p.sample_rate > 0 {
+		elapsed = time.Duration(p.pcm_bytes) * time.Second / time.Duration(p.sample_rate*4)
+	}
+	if total > 0 && elapsed > total {
+		elapsed = total
+	}
+	return elapsed
+}
+
+/**
+ * @param s the stream playing
+ * @return how much of the stream the decoder has consumed for the audio
+ * played so far, leaving out what it decoded ahead. Call with the mutex
+ * held
+ */
+func (p *Playback) heard(s *Stream) int64 {
+	consumed := s.buffer.Consumed()
+	if p.ahead_bytes > 0 {
+		consumed = consumed * p.pcm_bytes / (p.pcm_bytes + p.ahead_bytes)
+	}
+	return consumed
+}
+
+/**
+ * Counts PCM played
+ * @param n bytes of it just played
+ * @param ahead bytes decoded and not played yet
+ */
+func (p *Playback) add_pcm(n int, ahead int) {
+	p.mutex.Lock()
+	p.pcm_bytes += int64(n)
+	p.ahead_bytes = int64(ahead)
+	p.mutex.Unlock()
+}
+
+/**
+ * Stops whatever is playing and starts streaming a song from the cache,
+ * from what was prefetched of it, or else from the first reachable peer
+ * serving it
+ * @param ctx cancelled when the peer shuts down
+ * @param song the master list entry of the song
+ * @param offset byte offset to start from, sent as a SEEK when non-zero
+ * @param from_queue whether the next queued song plays once this one ends,
+ * and is prefetched while this one plays
+ * @return an error if no peer serving the song could be reached
+ */
+func start_song(ctx context.Context, song tsp.SongEntry, offset int64, from_queue bool) error {
+	playback.Stop()
+
+	song = dht_sources(song)
+	buffer, source, err := open_song(song, offset)
+	if err != nil {
+		atomic.AddInt64(&metrics.PlaybackErrors, 1)
+		return err
+	}
+
+	if offset == 0 {
+		report_play(song)
+		buffer.Record(new_recording(song, source))
+	}
+	var on_end func()
+	if from_queue {
+		on_end = func() { advance_queue(ctx) }
+	}
+	playback.Play(ctx, buffer, song, source, offset, on_end)
+	if from_queue {
+		prefetch_next()
+	}
+	return nil
+}
+
+/**
+ * Opens a song's stream, trying the cache, then the prefetched stream,
+ * then the peers serving it. Streams from peers that start at byte zero
+ * are cached as they arrive
+ * @param song the master list entry of the song
+ * @param offset byte offset to start from
+ * @return the buffered stream and where it comes from
+ */
+func open_song(song tsp.SongEntry, offset int64) (*StreamBuffer, tsp.SongSource, error) {
+	if source, ok := find_cached(song); ok {
+		if src, err := open_cached(source, offset); err == nil {
+			return NewStreamBuffer(src, nil, 0, 0), source, nil
+		}
+	}
+
+	buffer, source, ok := take_prefetched(song)
+	if ok && offset == 0 {
+		return buffer, source, nil
+	}
+	if ok {
+		buffer.Discard()
+	}
+
+	msg := tsp.NewMsg(tsp.PLAY, song.ID, nil)
+	if offset > 0 {
+		msg = tsp.NewMsg(tsp.SEEK, song.ID, nil)
+		msg.Header.Offset = offset
+	}
+	peer, source, err := send_to_source(*msg, song)
+	if err != nil {
+		return nil, source, err
+	}
+	var cache *CacheEntry
+	if offset == 0 {
+		cache = new_cache_entry(source)
+	}
+	return NewStreamBuffer(peer, cache, 0, 0), source, nil
+}
+
+/**
+ * Restarts the current song delta seconds away from the current position,
+ * asking the serving peer to SEEK rather than resend from byte zero
+ * @param ctx cancelled when the peer shuts down
+ * @param delta seconds to move, negative to go back
+ */
+func seek_current(ctx context.Context, delta int) {
+	offset, ok := playback.seek_offset(delta)
+	if !ok {
+		fmt.Println("Nothing playing.")
+		return
+	}
+	song, source, _ := playback.Current()
+	if source.Format != "" && source.Format != tsp.FORMAT_MP3 {
+		// only mp3 can be decoded from any frame, the others need the
+		// headers at the start of the stream
+		fmt.Println("Seeking is only supported for mp3 songs.")
+		return
+	}
+
+	// same peer first, so the offset lines up with the same file
+	sources := []tsp.SongSource{source}
+	for _, s := range song.Sources {
+		if s.PeerAddr != source.PeerAddr {
+			sources = append(sources, s)
+		}
+	}
+	song.Sources = sources
+	if err := start_song(ctx, song, offset, queue.Playing(song.ID)); err != nil {
+		fmt.Println(err)
+	}
+}
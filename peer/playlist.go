@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/**
+ * A song in a playlist: its id, plus enough to find it again if the
+ * tracker has handed out new ids since it was added
+ */
+type PlaylistEntry struct {
+	ID     int
+	Title  string
+	Artist string
+	// peers that served the song when it was added
+	Peers []string
+}
+
+/**
+ * A named list of songs, stored as ~/.torero/playlists/<name>.json
+ */
+type Playlist struct {
+	Name  string
+	Songs []PlaylistEntry
+	// for a smart playlist, the rule its songs are picked by (see
+	// smart.go), empty for one whose songs are added by hand
+	Rule string `json:",omitempty"`
+}
+
+/**
+ * @return the directory playlists are stored in
+ */
+func playlists_dir() string {
+	return filepath.Join(torero_dir(), "playlists")
+}
+
+/**
+ * @param name the playlist name
+ * @return the path of the playlist, or an error for names that aren't a
+ * plain file name
+ */
+func playlist_path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid playlist name %q", name)
+	}
+	return filepath.Join(playlists_dir(), name+".json"), nil
+}
+
+/**
+ * @param name the playlist name
+ * @return the stored playlist
+ */
+func load_playlist(name string) (*Playlist, error) {
+	file, err := playlist_path(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no playlist named %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := &Playlist{}
+	err = json.Unmarshal(content, list)
+	return list, err
+}
+
+/**
+ * Writes the playlist to disk, replacing any earlier version
+ */
+func (list *Playlist) save() error {
+	file, err := playlist_path(list.Name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(playlists_dir(), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+/**
+ * @return the names of every stored playlist
+ */
+func list_playlists() []string {
+	files, _ := ioutil.ReadDir(playlists_dir())
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".json" {
+			names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	return names
+}
+
+/**
+ * @param song the master list entry to add
+ * @return the playlist entry for the song
+ */
+func new_playlist_entry(song tsp.SongEntry) PlaylistEntry {
+	entry := PlaylistEntry{ID: song.ID, Title: song.Title, Artist: song.Artist}
+	for _, source := range song.Sources {
+		entry.Peers = append(entry.Peers, source.PeerAddr)
+	}
+	return entry
+}
+
+/**
+ * Finds the song a playlist entry refers to: by id in the master list,
+ * then by title and artist, and failing that from the stored peer hints
+ * @param entry the playlist entry
+ * @return the song to play
+ */
+func resolve_entry(entry PlaylistEntry) tsp.SongEntry {
+	if song, ok := find_song(entry.ID); ok && song.Title == entry.Title {
+		return song
+	}
+	master_mutex.Lock()
+	for _, song := range master_list {
+		if strings.EqualFold(song.Title, entry.Title) && strings.EqualFold(song.Artist, entry.Artist) {
+			master_mutex.Unlock()
+			return song
+		}
+	}
+	master_mutex.Unlock()
+
+	song := tsp.SongEntry{ID: entry.ID, Title: entry.Title, Artist: entry.Artist}
+	for _, peer := range entry.Peers {
+		song.Sources = append(song.Sources, tsp.SongSource{PeerAddr: peer})
+	}
+	return song
+}
+
+/**
+ * Prints a playlist, numbered for REMOVE
+ */
+func (list *Playlist) Print() {
+	fmt.Println(list.Name + ":")
+	if list.Rule != "" {
+		fmt.Println("  rule: " + list.Rule)
+	}
+	if len(list.Songs) == 0 {
+		fmt.Println("  (empty)")
+	}
+	for i, entry := range list.Songs {
+		fmt.Printf("  %d. %s, %s\n", i+1, entry.Title, entry.Artist)
+	}
+	fmt.Println()
+}
+
+/**
+ * Prompts for the name of a playlist
+ */
+func ask_playlist_name(ui *input.UI) string {
+	name, _ := ui.Ask("Playlist name", &input.Options{
+		Required: true,
+		Loop:     true,
+		ValidateFunc: func(name string) error {
+			_, err := playlist_path(strings.TrimSpace(name))
+			return err
+		},
+	})
+	return strings.TrimSpace(name)
+}
+
+/**
+ * Prompts for the rule of a smart playlist
+ */
+func ask_playlist_rule(ui *input.UI) string {
+	rule, _ := ui.Ask("Rule (e.g. artist contains X and not played in 30 days, top 25 most played)", &input.Options{
+		Required: true,
+		Loop:     true,
+		ValidateFunc: func(rule string) error {
+			_, err := parse_rule(rule)
+			return err
+		},
+	})
+	return strings.TrimSpace(rule)
+}
+
+/**
+ * Handles the PLAYLIST submenu: create, add to, remove from, show, list
+ * and play playlists, and create smart playlists, whose songs are picked
+ * again by their rule whenever they are shown or played. Playing a
+ * playlist replaces the queue with it
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_playlist_command(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	cmd, _ := ui.Select("Playlist option", []string{"LIST", "SHOW", "CREATE", "SMART", "ADD", "REMOVE", "PLAY", "BACK"},
+		&input.Options{Loop: true})
+
+	switch cmd {
+	case "LIST":
+		names := list_playlists()
+		if len(names) == 0 {
+			fmt.Println("No playlists.")
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		fmt.Println()
+	case "CREATE", "SMART":
+		name := ask_playlist_name(ui)
+		if _, err := load_playlist(name); err == nil {
+			fmt.Println("Playlist " + name + " already exists.")
+			return
+		}
+		list := &Playlist{Name: name}
+		if cmd == "SMART" {
+			list.Rule = ask_playlist_rule(ui)
+			if err := list.refresh(); err != nil {
+				fmt.Println("error picking the playlist's songs: ", err)
+				return
+			}
+			list.Print()
+		}
+		if err := list.save(); err != nil {
+			fmt.Println("error saving playlist: ", err)
+		}
+	case "SHOW", "ADD", "REMOVE", "PLAY":
+		list, err := load_playlist(ask_playlist_name(ui))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if list.Rule != "" && (cmd == "ADD" || cmd == "REMOVE") {
+			fmt.Println("Playlist " + list.Name + " is picked by its rule: " + list.Rule)
+			return
+		}
+		if err = list.refresh(); err != nil {
+			fmt.Println("error picking the playlist's songs: ", err)
+			return
+		}
+		switch cmd {
+		case "SHOW":
+			list.Print()
+		case "ADD":
+			list.Songs = append(list.Songs, new_playlist_entry(get_song_selection()))
+			if err = list.save(); err != nil {
+				fmt.Println("error saving playlist: ", err)
+			}
+		case "REMOVE":
+			list.Print()
+			n, _ := ui.Ask("Number to remove", &input.Options{
+				Loop: true,
+				ValidateFunc: func(s string) error {
+					if i, err := strconv.Atoi(strings.TrimSpace(s)); err != nil || i < 1 || i > len(list.Songs) {
+						return fmt.Errorf("pick a number from the list")
+					}
+					return nil
+				},
+			})
+			i, _ := strconv.Atoi(strings.TrimSpace(n))
+			list.Songs = append(list.Songs[:i-1], list.Songs[i:]...)
+			if err = list.save(); err != nil {
+				fmt.Println("error saving playlist: ", err)
+			}
+		case "PLAY":
+			list.Play(ctx)
+		}
+	}
+}
+
+/**
+ * Replaces the queue with the playlist's songs and plays the first. A
+ * smart playlist should be refreshed first
+ * @param ctx cancelled when the peer shuts down
+ */
+func (list *Playlist) Play(ctx context.Context) {
+	songs := make([]tsp.SongEntry, 0, len(list.Songs))
+	for _, entry := range list.Songs {
+		songs = append(songs, resolve_entry(entry))
+	}
+	queue.Replace(songs)
+	play_next(ctx, 1)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	DEFAULT_PREFETCH_MB   = 8
+	DEFAULT_PREFETCH_KBPS = 256
+)
+
+/**
+ * The next queued song, being fetched while the current one plays
+ */
+type Prefetch struct {
+	song   tsp.SongEntry
+	source tsp.SongSource
+	buffer *StreamBuffer
+}
+
+var (
+	prefetched     *Prefetch
+	prefetch_mutex sync.Mutex
+)
+
+/**
+ * Starts fetching the next song in the queue, within the configured size
+ * and rate caps, dropping any prefetch of a different song. Connecting
+ * happens in the background so a slow peer doesn't hold up the caller
+ */
+func prefetch_next() {
+	if config.PrefetchMB <= 0 {
+		return
+	}
+	song, ok := queue.Peek()
+	if !ok {
+		discard_prefetch()
+		return
+	}
+	if fresh, found := find_song(song.ID); found {
+		song = fresh
+	}
+	if _, cached := find_cached(song); cached {
+		return
+	}
+
+	prefetch_mutex.Lock()
+	if prefetched != nil && prefetched.song.ID == song.ID {
+		prefetch_mutex.Unlock()
+		return
+	}
+	old := prefetched
+	next := &Prefetch{song: song}
+	prefetched = next
+	prefetch_mutex.Unlock()
+	if old != nil && old.buffer != nil {
+		old.buffer.Discard()
+	}
+
+	go func() {
+		msg := tsp.NewMsg(tsp.PLAY, song.ID, nil)
+		peer, source, err := send_to_source(*msg, song)
+		if err != nil {
+			return
+		}
+		buffer := NewStreamBuffer(peer, new_cache_entry(source), config.PrefetchMB<<20, config.PrefetchKBps<<10)
+
+		prefetch_mutex.Lock()
+		defer prefetch_mutex.Unlock()
+		if prefetched != next {
+			buffer.Discard()
+			return
+		}
+		next.source = source
+		next.buffer = buffer
+	}()
+}
+
+/**
+ * Hands over the prefetched stream of a song, if that is the song being
+ * prefetched and it has connected
+ * @param song the song about to play
+ * @return the buffered stream and the peer it comes from, and false if
+ * there is nothing prefetched for the song
+ */
+func take_prefetched(song tsp.SongEntry) (*StreamBuffer, tsp.SongSource, bool) {
+	prefetch_mutex.Lock()
+	defer prefetch_mutex.Unlock()
+	p := prefetched
+	if p == nil || p.buffer == nil || p.song.ID != song.ID {
+		return nil, tsp.SongSource{}, false
+	}
+	prefetched = nil
+	return p.buffer, p.source, true
+}
+
+/**
+ * Drops whatever is being prefetched, e.g. on shutdown
+ */
+func discard_prefetch() {
+	prefetch_mutex.Lock()
+	p := prefetched
+	prefetched = nil
+	prefetch_mutex.Unlock()
+	if p != nil && p.buffer != nil {
+		p.buffer.Discard()
+	}
+}
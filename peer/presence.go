@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Presence: a serving peer tells the tracker its identity key, so its
+ * friends can find it, see friends.go, and with presence on in the config
+ * file, what it is listening to, whenever that changes and every
+ * heartbeat, under its nickname. who lists the peers online and what
+ * those sharing it are listening to, so music can be found through
+ * people. Only the key is shared with presence off; the peer is still
+ * listed as online, as every registered peer is
+ */
+
+const (
+	// how often what plays is checked for a change to share
+	PRESENCE_POLL = time.Second
+)
+
+/**
+ * @return what this peer is listening to, as shared with the tracker
+ */
+func current_presence() tsp.Presence {
+	presence := tsp.Presence{Key: identity_key()}
+	if serve_args != nil {
+		presence.Addr = announced_addr(serve_args)
+	}
+	if !config.Presence {
+		return presence
+	}
+	presence.Name = config.Nickname
+	song, _, ok := playback.Current()
+	if !ok {
+		return presence
+	}
+	// only what names the song; others play it from the master list
+	presence.Song = tsp.SongEntry{ID: song.ID, Title: song.Title, Artist: song.Artist,
+		Album: song.Album, Duration: song.Duration}
+	presence.Paused = playback.Paused()
+	return presence
+}
+
+/**
+ * Shares what this peer is listening to with the tracker, whenever it
+ * changes and every heartbeat, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func share_presence(ctx context.Context) {
+	ticker := time.NewTicker(PRESENCE_POLL)
+	defer ticker.Stop()
+	var last tsp.Presence
+	sent := time.Time{}
+	for {
+		presence := current_presence()
+		if presence.Song.ID != last.Song.ID || presence.Paused != last.Paused ||
+			time.Since(sent) >= tsp.HEARTBEAT_INTERVAL {
+			if presence.Song.ID != last.Song.ID {
+				presence.Since = time.Now()
+			} else {
+				presence.Since = last.Since
+			}
+			if err := send_presence(presence); err != nil {
+				slog.Debug("can't share presence", "err", err)
+			}
+			last, sent = presence, time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+ * @param presence what this peer is listening to
+ * @return an error if the tracker can't be reached
+ */
+func send_presence(presence tsp.Presence) error {
+	content, err := tsp.EncodePresence(presence)
+	if err != nil {
+		return err
+	}
+	return send_to_tracker(tsp.NewMsg(tsp.PRESENCE, 0, content))
+}
+
+/**
+ * Asks the tracker who is online
+ * @return the peers online, those listening to something first
+ */
+func fetch_who() (online []tsp.Presence, err error) {
+	if tracker_addr == "" {
+		return nil, fmt.Errorf("who is online takes a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.PRESENCE, 0, nil)); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodePresences(in_msg.Msg)
+}
+
+/**
+ * Writes who is online, one peer per line, with what it is listening to
+ * @param w where the list is written
+ * @param online the peers online, numbered from 1
+ */
+func write_who(w io.Writer, online []tsp.Presence) {
+	if len(online) == 0 {
+		fmt.Fprintln(w, "Nobody online.")
+	}
+	for i, presence := range online {
+		who := presence.Addr
+		if len(presence.Key) > 0 {
+			who += ", key " + fingerprint(presence.Key)
+		}
+		if presence.Name != "" {
+			who = presence.Name + " (" + who + ")"
+		}
+		if presence.Song.ID == 0 {
+			fmt.Fprintf(w, "%3d. %s\n", i+1, who)
+			continue
+		}
+		song := presence.Song
+		listening := fmt.Sprintf("%s, %s [id %d]", song.Title, song.Artist, song.ID)
+		if presence.Paused {
+			listening += " (paused)"
+		} else if !presence.Since.IsZero() {
+			listening += " for " + format_duration(time.Since(presence.Since))
+		}
+		fmt.Fprintf(w, "%3d. %s: %s\n", i+1, who, listening)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * who: prints the peers online and what they are listening to
+ */
+func run_who(args []string) int {
+	online, err := fetch_who()
+	if err != nil {
+		fmt.Println("can't ask who is online: ", err)
+		return 1
+	}
+	write_who(os.Stdout, online)
+	return 0
+}
+
+/**
+ * WHO from the interactive menu: prints the peers online and what they
+ * are listening to, and plays one of their songs if asked
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_who(ctx context.Context) {
+	online, err := fetch_who()
+	if err != nil {
+		fmt.Println("can't ask who is online: ", err)
+		return
+	}
+	write_who(os.Stdout, online)
+	listening := 0
+	for _, presence := range online {
+		if presence.Song.ID != 0 {
+			listening++
+		}
+	}
+	if listening == 0 {
+		return
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	arg, _ := ui.Ask("Play what someone is listening to (number, blank for none)", &input.Options{
+		Loop: true,
+		ValidateFunc: func(arg string) error {
+			if arg == "" {
+				return nil
+			}
+			if n, err := strconv.Atoi(arg); err != nil || n < 1 || n > len(online) || online[n-1].Song.ID == 0 {
+				return fmt.Errorf("pick someone listening to something, from 1 to %d", len(online))
+			}
+			return nil
+		},
+	})
+	if arg == "" {
+		return
+	}
+	n, _ := strconv.Atoi(arg)
+	song, found := find_song(online[n-1].Song.ID)
+	if !found {
+		fmt.Println("That song isn't in the master list, try LIST first.")
+		return
+	}
+	if err := start_song(ctx, song, 0, false); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Now playing: " + song.Title + ", " + song.Artist)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+// What happens once the queue's song ends
+const (
+	// the next song plays, and the queue stops at its end
+	REPEAT_OFF = "off"
+	// the same song plays again
+	REPEAT_ONE = "one"
+	// the next song plays, and the queue starts over at its end
+	REPEAT_ALL = "all"
+)
+
+var repeat_modes = []string{REPEAT_OFF, REPEAT_ONE, REPEAT_ALL}
+
+/**
+ * The play queue. Persisted to ~/.torero/queue.json after every change so
+ * it survives restarts
+ */
+type Queue struct {
+	mutex sync.Mutex
+	// in the order they play in
+	Songs []tsp.SongEntry
+	// index of the song playing from the queue, -1 before the first
+	Pos int
+	// whether the songs still to play are in random order, and the queue
+	// in the order the songs were added, to go back to
+	Shuffle    bool
+	Unshuffled []tsp.SongEntry `json:",omitempty"`
+	// one of the REPEAT_ modes, "" for REPEAT_OFF
+	Repeat string `json:",omitempty"`
+}
+
+var queue = &Queue{Pos: -1}
+
+/**
+ * @return the path of the persisted queue
+ */
+func queue_path() string {
+	return filepath.Join(torero_dir(), "queue.json")
+}
+
+/**
+ * Loads the queue saved by a previous run. A missing file is an empty queue
+ */
+func load_queue() error {
+	content, err := ioutil.ReadFile(queue_path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return json.Unmarshal(content, queue)
+}
+
+/**
+ * Writes the queue to disk. The caller must hold queue.mutex
+ */
+func (q *Queue) save() {
+	content, err := json.MarshalIndent(q, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(torero_dir(), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(queue_path(), content, 0644)
+	}
+	if err != nil {
+		slog.Warn("can't save the queue", "path", queue_path(), "err", err)
+	}
+}
+
+/**
+ * Appends a song to the end of the queue
+ * @return the song's position in the queue, counting from 1
+ */
+func (q *Queue) Add(song tsp.SongEntry) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.Shuffle {
+		q.Songs = append(q.Songs, song)
+		q.save()
+		return len(q.Songs)
+	}
+	// anywhere among the songs still to play
+	q.Unshuffled = append(q.Unshuffled, song)
+	pos := q.Pos + 1 + rand.Intn(len(q.Songs)-q.Pos)
+	q.Songs = append(q.Songs[:pos], append([]tsp.SongEntry{song}, q.Songs[pos:]...)...)
+	q.save()
+	return pos + 1
+}
+
+/**
+ * Replaces the whole queue, e.g. with a playlist, ready to start from the
+ * first song
+ */
+func (q *Queue) Replace(songs []tsp.SongEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.Songs = songs
+	q.Pos = -1
+	if q.Shuffle {
+		q.Unshuffled = append([]tsp.SongEntry(nil), songs...)
+		q.Songs = append([]tsp.SongEntry(nil), songs...)
+		q.shuffle_rest()
+	}
+	q.save()
+}
+
+/**
+ * Puts the songs after the current one in random order. The caller must
+ * hold queue.mutex
+ */
+func (q *Queue) shuffle_rest() {
+	rest := q.Songs[q.Pos+1:]
+	rand.Shuffle(len(rest), func(i, j int) {
+		rest[i], rest[j] = rest[j], rest[i]
+	})
+}
+
+/**
+ * Turns shuffle on, putting the songs still to play in random order, or
+ * off, putting the queue back in the order the songs were added and
+ * carrying on from the current song
+ */
+func (q *Queue) SetShuffle(on bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if on == q.Shuffle {
+		return
+	}
+	q.Shuffle = on
+	if on {
+		q.Unshuffled = append([]tsp.SongEntry(nil), q.Songs...)
+		q.shuffle_rest()
+	} else {
+		current := -1
+		if q.Pos >= 0 && q.Pos < len(q.Songs) {
+			current = q.Songs[q.Pos].ID
+		}
+		q.Songs, q.Unshuffled = q.Unshuffled, nil
+		q.Pos = -1
+		for i, song := range q.Songs {
+			if song.ID == current {
+				q.Pos = i
+				break
+			}
+		}
+	}
+	q.save()
+}
+
+/**
+ * @param mode one of the REPEAT_ modes
+ * @return an error if it isn't one
+ */
+func (q *Queue) SetRepeat(mode string) error {
+	for _, known := range repeat_modes {
+		if mode == known {
+			q.mutex.Lock()
+			q.Repeat = mode
+			q.save()
+			q.mutex.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("repeat is one of %v, not %q", repeat_modes, mode)
+}
+
+/**
+ * @param mode one of the REPEAT_ modes
+ * @return the mode after it, going off, all, one and back to off
+ */
+func next_repeat(mode string) string {
+	switch mode {
+	case REPEAT_OFF:
+		return REPEAT_ALL
+	case REPEAT_ALL:
+		return REPEAT_ONE
+	}
+	return REPEAT_OFF
+}
+
+/**
+ * @return whether the queue is shuffled, and its REPEAT_ mode
+ */
+func (q *Queue) Modes() (bool, string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.Repeat == "" {
+		return q.Shuffle, REPEAT_OFF
+	}
+	return q.Shuffle, q.Repeat
+}
+
+/**
+ * Moves delta songs through the queue
+ * @param delta 1 for the next song, -1 for the previous one
+ * @return the song now at the current position, and false at either end
+ */
+func (q *Queue) Move(delta int) (tsp.SongEntry, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pos := q.Pos + delta
+	if (pos < 0 || pos >= len(q.Songs)) && q.Repeat == REPEAT_ALL && len(q.Songs) > 0 {
+		// round again, in a new order if shuffled
+		if pos < 0 {
+			pos = len(q.Songs) - 1
+		} else {
+			pos = 0
+			if q.Shuffle {
+				q.Pos = -1
+				q.shuffle_rest()
+			}
+		}
+	}
+	if pos < 0 || pos >= len(q.Songs) {
+		return tsp.SongEntry{}, false
+	}
+	q.Pos = pos
+	q.save()
+	return q.Songs[pos], true
+}
+
+/**
+ * @return the song to play once the current one ends, and false at the
+ * end of the queue
+ */
+func (q *Queue) Peek() (tsp.SongEntry, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pos := q.Pos + 1
+	if q.Repeat == REPEAT_ONE && q.Pos >= 0 {
+		pos = q.Pos
+	} else if pos == len(q.Songs) && q.Repeat == REPEAT_ALL {
+		pos = 0
+	}
+	if pos < 0 || pos >= len(q.Songs) {
+		return tsp.SongEntry{}, false
+	}
+	return q.Songs[pos], true
+}
+
+/**
+ * @return whether the song with this id is the one the queue is on
+ */
+func (q *Queue) Playing(id int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.Pos >= 0 && q.Pos < len(q.Songs) && q.Songs[q.Pos].ID == id
+}
+
+/**
+ * Prints the queue, marking the current song
+ */
+func (q *Queue) Print() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.Songs) == 0 {
+		fmt.Println("Queue is empty.")
+		return
+	}
+	for i, song := range q.Songs {
+		mark := "  "
+		if i == q.Pos {
+			mark = "> "
+		}
+		fmt.Printf("%s%d. %s, %s\n", mark, i+1, song.Title, song.Artist)
+	}
+	fmt.Println()
+}
+
+/**
+ * @return the songs in the queue, in the order they play in, and the
+ * index of the one it is on, -1 before the first
+ */
+func (q *Queue) List() ([]tsp.SongEntry, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]tsp.SongEntry(nil), q.Songs...), q.Pos
+}
+
+/**
+ * @return the song the queue is on, and false before the first
+ */
+func (q *Queue) Current() (tsp.SongEntry, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.Pos < 0 || q.Pos >= len(q.Songs) {
+		return tsp.SongEntry{}, false
+	}
+	return q.Songs[q.Pos], true
+}
+
+/**
+ * Plays what comes after a queued song that ended: the same song again
+ * with repeat one, otherwise the next song
+ * @param ctx cancelled when the peer shuts down
+ */
+func advance_queue(ctx context.Context) {
+	if _, repeat := queue.Modes(); repeat == REPEAT_ONE {
+		if song, ok := queue.Current(); ok {
+			if fresh, found := find_song(song.ID); found {
+				song = fresh
+			}
+			err := start_song(ctx, song, 0, true)
+			if err == nil {
+				return
+			}
+			fmt.Println(err)
+		}
+	}
+	play_next(ctx, 1)
+}
+
+/**
+ * Replaces the queue with the whole master list, less near-duplicates,
+ * shuffled, and starts playing it
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @return an error if there is no master list
+ */
+func shuffle_all(ctx context.Context, args []string) error {
+	songs, _, err := current_list(ctx, args)
+	if err != nil {
+		return err
+	}
+	songs, _ = hide_duplicates(songs)
+	if len(songs) == 0 {
+		return fmt.Errorf("the master list is empty")
+	}
+	queue.SetShuffle(true)
+	queue.Replace(songs)
+	play_next(ctx, 1)
+	return nil
+}
+
+/**
+ * SHUFFLE and REPEAT from the interactive menu: asks for the mode
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @param cmd SHUFFLE or REPEAT
+ */
+func handle_modes(ctx context.Context, args []string, cmd string) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	shuffle, repeat := queue.Modes()
+	if cmd == "SHUFFLE" {
+		current := map[bool]string{true: "on", false: "off"}[shuffle]
+		mode, _ := ui.Select("Shuffle (now "+current+")", []string{"on", "off", "all"}, &input.Options{
+			Default: current,
+			Loop:    true,
+		})
+		if mode == "all" {
+			if err := shuffle_all(ctx, args); err != nil {
+				fmt.Println(err)
+			}
+		} else {
+			queue.SetShuffle(mode == "on")
+		}
+	} else {
+		mode, _ := ui.Select("Repeat (now "+repeat+")", repeat_modes, &input.Options{
+			Default: repeat,
+			Loop:    true,
+		})
+		queue.SetRepeat(mode)
+	}
+	fmt.Println("Queue " + format_modes(queue.Modes()) + ".")
+}
+
+/**
+ * Plays the song delta places away in the queue. Songs whose peers have
+ * all gone away are skipped
+ * @param ctx cancelled when the peer shuts down
+ * @param delta 1 for the next song, -1 for the previous one
+ */
+func play_next(ctx context.Context, delta int) {
+	for ctx.Err() == nil {
+		song, ok := queue.Move(delta)
+		if !ok {
+			fmt.Println("End of queue.")
+			return
+		}
+		// prefer the current master list entry, its sources are fresher
+		if fresh, found := find_song(song.ID); found {
+			song = fresh
+		}
+		err := start_song(ctx, song, 0, true)
+		if err == nil {
+			fmt.Println("Now playing: " + song.Title + ", " + song.Artist)
+			return
+		}
+		fmt.Println(err)
+	}
+}
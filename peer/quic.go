@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/quic-go/quic-go"
+)
+
+/*
+ * The QUIC transport. With quic on, a peer also serves songs over QUIC on
+ * the UDP port matching its TCP port, and says so in the Caps of the
+ * sources it announces. A client with quic on streams PLAY and SEEK from
+ * such peers over QUIC, one stream per request on a single connection per
+ * peer, and falls back to TCP if the QUIC dial fails. Everything else
+ * still goes over TCP. With mtls on, QUIC's TLS checks certificates like
+ * mutual TLS over TCP does
+ */
+
+// the ALPN protocol peers speak over QUIC
+const QUIC_PROTOCOL = "torero"
+
+var (
+	quic_mutex sync.Mutex
+	// open QUIC connections to other peers, by serving address
+	quic_conns = make(map[string]quic.Connection)
+)
+
+/**
+ * A QUIC stream standing in for a TCP connection, so requests over it are
+ * served and read exactly like ones over TCP
+ */
+type QuicConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c QuicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c QuicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+/**
+ * Closes both directions of the stream, leaving the connection open for
+ * other streams
+ */
+func (c QuicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+/**
+ * @return the transports this peer takes song requests over, besides TCP,
+ * as tsp.CAP_ flags
+ */
+func local_caps() byte {
+	if config.QUIC {
+		return tsp.CAP_QUIC
+	}
+	return 0
+}
+
+func quic_config() *quic.Config {
+	return &quic.Config{MaxIdleTimeout: io_timeout(), KeepAlivePeriod: io_timeout() / 3}
+}
+
+/**
+ * Makes a throwaway self-signed certificate for the QUIC listener. QUIC
+ * can't run without TLS, but without mtls peers don't check each other's
+ * identity over it any more than over TCP
+ * @return the certificate and its key
+ */
+func self_signed_cert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: QUIC_PROTOCOL},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+/**
+ * Serves song requests over QUIC until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func serve_quic(ctx context.Context, args []string) {
+	cert, err := self_signed_cert()
+	if err != nil {
+		slog.Error("can't serve over QUIC", "err", err)
+		return
+	}
+	tls_config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.MTLS {
+		if tls_config, err = server_tls_config(); err != nil {
+			slog.Error("can't serve over QUIC", "err", err)
+			return
+		}
+	}
+	tls_config.NextProtos = []string{QUIC_PROTOCOL}
+	ln, err := quic.ListenAddr(net.JoinHostPort(GetLocalIP(), args[1]), tls_config, quic_config())
+	if err != nil {
+		slog.Error("can't serve over QUIC", "err", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("QUIC accept failed", "err", err)
+			continue
+		}
+		go serve_quic_conn(ctx, conn)
+	}
+}
+
+/**
+ * Serves every stream a peer opens on a QUIC connection, each carrying
+ * one request
+ * @param ctx cancelled when the peer shuts down
+ * @param conn the connection with the requesting peer
+ */
+func serve_quic_conn(ctx context.Context, conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		transfers.Add(1)
+		go func() {
+			defer transfers.Done()
+			receive_message(ctx, QuicConn{stream, conn})
+		}()
+	}
+}
+
+/**
+ * Opens a stream to a peer over QUIC, reusing the connection to it if
+ * there is one
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @return the stream, each read and write on it limited to io_timeout()
+ */
+func dial_quic(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := quic_connection(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// the connection went bad, forget it so the next dial starts over
+		quic_mutex.Lock()
+		if quic_conns[addr] == conn {
+			delete(quic_conns, addr)
+		}
+		quic_mutex.Unlock()
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return NewDeadlineConn(QuicConn{stream, conn}, io_timeout()), nil
+}
+
+/**
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @return the open QUIC connection to the peer, dialled if there is none
+ */
+func quic_connection(ctx context.Context, addr string) (quic.Connection, error) {
+	quic_mutex.Lock()
+	conn, ok := quic_conns[addr]
+	quic_mutex.Unlock()
+	if ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	dial_ctx, cancel := context.WithTimeout(ctx, dial_timeout())
+	defer cancel()
+	tls_config := &tls.Config{InsecureSkipVerify: true}
+	if config.MTLS {
+		var err error
+		if tls_config, err = client_tls_config(nil); err != nil {
+			return nil, err
+		}
+	}
+	tls_config.NextProtos = []string{QUIC_PROTOCOL}
+	conn, err := quic.DialAddr(dial_ctx, addr, tls_config, quic_config())
+	if err != nil {
+		return nil, err
+	}
+	quic_mutex.Lock()
+	quic_conns[addr] = conn
+	quic_mutex.Unlock()
+	return conn, nil
+}
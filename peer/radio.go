@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Live radio between peers, DJ mode: a peer on the air streams what it
+ * plays, encoded to MP3 by the broadcast (see broadcast.go), to every peer
+ * tuned in to it, answering each BROADCAST with a header and then the
+ * stream for as long as the listener stays. It announces the broadcast to
+ * the tracker every heartbeat and whenever the song changes, and the
+ * tracker lists the broadcasts going on. Peers tune in and out whenever
+ * they like, each starting at the next MP3 frame; one that can't keep up
+ * is dropped rather than holding up the rest
+ */
+
+const (
+	// MP3 chunks held for a listener before it is dropped
+	RADIO_BACKLOG      = 64
+	DEFAULT_RADIO_NAME = "Torero radio"
+)
+
+/**
+ * A peer tuned in to this one
+ */
+type RadioListener struct {
+	mp3 chan []byte
+	// whether it has been sent the start of a frame yet
+	synced bool
+}
+
+/**
+ * This peer's radio on the air: the outlet of the broadcast that fans the
+ * MP3 stream out to the peers tuned in
+ */
+type RadioHub struct {
+	name    string
+	addr    string
+	started time.Time
+	done    chan struct{}
+	once    sync.Once
+	// signalled when the song changes, so it is announced straight away
+	changed chan struct{}
+
+	mutex     sync.Mutex
+	listeners map[*RadioListener]bool
+	title     string
+}
+
+/**
+ * @param name what the broadcast is called
+ * @param addr the serving address peers tune in at
+ * @return a radio with nobody tuned in
+ */
+func NewRadioHub(name string, addr string) *RadioHub {
+	return &RadioHub{
+		name:      name,
+		addr:      addr,
+		started:   time.Now(),
+		done:      make(chan struct{}),
+		changed:   make(chan struct{}, 1),
+		listeners: make(map[*RadioListener]bool),
+	}
+}
+
+/**
+ * Puts this peer's radio on the air
+ * @param ctx cancelled when the peer shuts down
+ * @param name what the broadcast is called, "" for the [broadcast] name
+ * in the config file
+ * @return an error if this peer isn't serving or ffmpeg isn't installed
+ */
+func start_radio(ctx context.Context, name string) error {
+	if serve_args == nil {
+		return errors.New("the radio needs peers to tune in, run serve or shell")
+	}
+	if err := check_encoder(); err != nil {
+		return err
+	}
+	if name == "" {
+		name = config.Broadcast.Name
+	}
+	if name == "" {
+		name = DEFAULT_RADIO_NAME
+	}
+	hub := NewRadioHub(name, announced_addr(serve_args))
+	attach_outlet(ctx, RADIO_OUTLET, hub)
+	go hub.announce(ctx)
+	slog.Info("radio on the air", "name", name, "addr", hub.addr)
+	return nil
+}
+
+/**
+ * Takes this peer's radio off the air, if it is on it
+ */
+func stop_radio() {
+	detach_outlet(RADIO_OUTLET)
+}
+
+/**
+ * @return this peer's radio, nil if it isn't on the air
+ */
+func radio_hub() *RadioHub {
+	hub, _ := find_outlet(RADIO_OUTLET).(*RadioHub)
+	return hub
+}
+
+/**
+ * Sends MP3 to every listener, starting a new one at the first frame in
+ * it. Never blocks: a listener whose backlog is full is dropped
+ * @param mp3 the MP3 frames, as they are encoded
+ * @return len(mp3), and never an error
+ */
+func (h *RadioHub) Write(mp3 []byte) (int, error) {
+	chunk := append([]byte(nil), mp3...)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for listener := range h.listeners {
+		data := chunk
+		if !listener.synced {
+			start := mp3_frame_start(chunk)
+			if start < 0 {
+				continue
+			}
+			data = chunk[start:]
+			listener.synced = true
+		}
+		select {
+		case listener.mp3 <- data:
+		default:
+			slog.Info("radio listener can't keep up, dropping it")
+			delete(h.listeners, listener)
+			close(listener.mp3)
+		}
+	}
+	return len(mp3), nil
+}
+
+/**
+ * Announces what is playing to the tracker, in the background
+ * @param title e.g. "Artist - Title"
+ */
+func (h *RadioHub) SetTitle(title string) {
+	h.mutex.Lock()
+	h.title = title
+	h.mutex.Unlock()
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * Goes off the air, cutting every listener off
+ */
+func (h *RadioHub) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		h.mutex.Lock()
+		for listener := range h.listeners {
+			close(listener.mp3)
+		}
+		h.listeners = nil
+		h.mutex.Unlock()
+		slog.Info("radio off the air", "name", h.name)
+	})
+	return nil
+}
+
+/**
+ * Tunes a peer in
+ * @return the listener the stream is sent to, nil if the radio is off
+ * the air
+ */
+func (h *RadioHub) join() *RadioListener {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.listeners == nil {
+		return nil
+	}
+	listener := &RadioListener{mp3: make(chan []byte, RADIO_BACKLOG)}
+	h.listeners[listener] = true
+	return listener
+}
+
+/**
+ * Tunes a peer out, unless it was already dropped
+ * @param listener the peer's listener
+ */
+func (h *RadioHub) leave(listener *RadioListener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.listeners[listener] {
+		delete(h.listeners, listener)
+		close(listener.mp3)
+	}
+}
+
+/**
+ * @return the broadcast, as announced to the tracker and the peers tuning
+ * in
+ */
+func (h *RadioHub) info() tsp.BroadcastInfo {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return tsp.BroadcastInfo{
+		Name:      h.name,
+		Addr:      h.addr,
+		Song:      h.title,
+		Listeners: len(h.listeners),
+		Started:   h.started,
+		Live:      true,
+	}
+}
+
+/**
+ * Announces the broadcast to the tracker, if there is one, every
+ * heartbeat and whenever the song changes, and that it is over once it
+ * goes off the air
+ * @param ctx cancelled when the peer shuts down
+ */
+func (h *RadioHub) announce(ctx context.Context) {
+	if tracker_addr == "" {
+		return
+	}
+	ticker := time.NewTicker(tsp.HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		h.send_announcement(true)
+		select {
+		case <-ctx.Done():
+			h.send_announcement(false)
+			return
+		case <-h.done:
+			h.send_announcement(false)
+			return
+		case <-ticker.C:
+		case <-h.changed:
+		}
+	}
+}
+
+/**
+ * @param live false to announce the broadcast is over
+ */
+func (h *RadioHub) send_announcement(live bool) {
+	info := h.info()
+	info.Live = live
+	content, err := tsp.EncodeBroadcast(info)
+	if err != nil {
+		slog.Error("can't encode the broadcast", "err", err)
+		return
+	}
+	if err = send_to_tracker(tsp.NewMsg(tsp.BROADCAST, 0, content)); err != nil {
+		slog.Debug("can't announce the broadcast", "err", err)
+	}
+}
+
+/**
+ * Answers a BROADCAST: tunes the peer in to this peer's radio, sending a
+ * header carrying the broadcast and then the stream, until the peer goes,
+ * is dropped or the radio goes off the air
+ * @param ctx cancelled to cut the stream off
+ * @param in_msg the request
+ * @param client the peer tuning in
+ */
+func serve_radio(ctx context.Context, in_msg *tsp.Msg, client io.Writer) {
+	hub := radio_hub()
+	if hub == nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, "not on the air")
+		return
+	}
+	if !take_upload_slot() {
+		slog.Info("all upload slots in use, turning a listener away")
+		send_error(in_msg, client, tsp.ERR_BUSY, "all upload slots in use")
+		return
+	}
+	defer release_upload_slot()
+	atomic.AddInt64(&metrics.ActiveUploads, 1)
+	defer atomic.AddInt64(&metrics.ActiveUploads, -1)
+
+	listener := hub.join()
+	if listener == nil {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, "not on the air")
+		return
+	}
+	defer hub.leave(listener)
+	content, err := tsp.EncodeBroadcast(hub.info())
+	if err != nil {
+		slog.Error("can't encode the broadcast", "err", err)
+		send_error(in_msg, client, tsp.ERR_INTERNAL, "can't describe the broadcast")
+		return
+	}
+	reply := tsp.NewMsg(tsp.BROADCAST, 0, content)
+	reply.Header.Format = tsp.FORMAT_MP3
+	if err = tsp.Encode(client, reply); err != nil {
+		slog.Warn("can't reply", "err", err)
+		return
+	}
+	slog.Info("peer tuned in to the radio")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case mp3, ok := <-listener.mp3:
+			if !ok {
+				return
+			}
+			n, err := client.Write(mp3)
+			atomic.AddInt64(&metrics.BytesServed, int64(n))
+			if err != nil {
+				slog.Info("peer tuned out of the radio", "err", err)
+				return
+			}
+		}
+	}
+}
+
+/**
+ * @param data MP3 frames, starting anywhere
+ * @return the offset of the first frame header in data, -1 if there is
+ * none
+ */
+func mp3_frame_start(data []byte) int {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0xFF || data[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version := (data[i+1] >> 3) & 3
+		layer := (data[i+1] >> 1) & 3
+		bitrate := data[i+2] >> 4
+		rate := (data[i+2] >> 2) & 3
+		if version != 1 && layer != 0 && bitrate != 0 && bitrate != 15 && rate != 3 {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * Asks the tracker for the broadcasts going on
+ * @return the broadcasts, the longest running first
+ */
+func fetch_broadcasts() (broadcasts []tsp.BroadcastInfo, err error) {
+	if tracker_addr == "" {
+		return nil, fmt.Errorf("listing broadcasts needs a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.BROADCAST, 0, nil)); err != nil {
+		return nil, err
+	}
+	in_msg, err := tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodeBroadcasts(in_msg.Msg)
+}
+
+/**
+ * Stops whatever is playing and tunes in to a peer's radio, playing it
+ * until it goes off the air or something else is played
+ * @param ctx cancelled when the peer shuts down
+ * @param addr the serving address of the peer on the air
+ * @return the broadcast, or an error if the peer can't be reached or
+ * isn't on the air
+ */
+func tune_radio(ctx context.Context, addr string) (tsp.BroadcastInfo, error) {
+	if hub := radio_hub(); hub != nil && hub.addr == addr {
+		return tsp.BroadcastInfo{}, errors.New("can't tune in to this peer's own radio")
+	}
+	conn, err := dial_peer(ctx, addr, nil)
+	if err != nil {
+		return tsp.BroadcastInfo{}, err
+	}
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.BROADCAST, 0, nil)); err != nil {
+		conn.Close()
+		return tsp.BroadcastInfo{}, err
+	}
+	in_msg, err := tsp.Decode(conn)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	var info tsp.BroadcastInfo
+	if err == nil {
+		info, err = tsp.DecodeBroadcast(in_msg.Msg)
+	}
+	if err != nil {
+		conn.Close()
+		return tsp.BroadcastInfo{}, err
+	}
+	// ID 0: a live stream isn't a song of the master list, and so isn't
+	// recorded in the history
+	song := tsp.SongEntry{Title: info.Name + " (live)", Artist: addr}
+	source := tsp.SongSource{PeerAddr: addr, Format: in_msg.Header.Format}
+	playback.Play(ctx, NewStreamBuffer(conn, nil, 0, 0), song, source, 0, nil)
+	return info, nil
+}
+
+/**
+ * Writes the broadcasts going on, one per line
+ * @param w where they are written
+ * @param broadcasts the broadcasts, numbered from 1 to tune in by
+ */
+func write_broadcasts(w io.Writer, broadcasts []tsp.BroadcastInfo) {
+	if len(broadcasts) == 0 {
+		fmt.Fprintln(w, "No broadcasts on the air.")
+	}
+	for i, info := range broadcasts {
+		playing := info.Song
+		if playing == "" {
+			playing = "nothing playing"
+		}
+		fmt.Fprintf(w, "%3d. %s at %s: %s, %d listening, on the air %s\n", i+1, info.Name, info.Addr,
+			playing, info.Listeners, time.Since(info.Started).Round(time.Second))
+	}
+}
+
+/**
+ * @return the radio's status line, e.g. "On the air as ... for 5m0s, 2
+ * listening."
+ */
+func format_radio() string {
+	hub := radio_hub()
+	if hub == nil {
+		return "Radio off the air."
+	}
+	info := hub.info()
+	return fmt.Sprintf("On the air as %s at %s for %s, %d listening.", info.Name, info.Addr,
+		time.Since(info.Started).Round(time.Second), info.Listeners)
+}
+
+/**
+ * Handles radio: lists the broadcasts going on, puts this peer's radio on
+ * or off the air, or tunes in to a broadcast
+ * @param ctx cancelled when the peer shuts down
+ * @param cmd [], ["on", name...], ["off"] or ["tune", n or address]
+ * @param w where the output is written
+ * @return the exit status
+ */
+func handle_radio(ctx context.Context, cmd []string, w io.Writer) int {
+	if len(cmd) == 0 {
+		fmt.Fprintln(w, format_radio())
+		broadcasts, err := fetch_broadcasts()
+		if err != nil {
+			fmt.Fprintln(w, "can't list the broadcasts: ", err)
+			return 1
+		}
+		write_broadcasts(w, broadcasts)
+		return 0
+	}
+	switch cmd[0] {
+	case "on":
+		if err := start_radio(ctx, strings.Join(cmd[1:], " ")); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		fmt.Fprintln(w, format_radio())
+	case "off":
+		stop_radio()
+		fmt.Fprintln(w, format_radio())
+	case "tune":
+		if len(cmd) != 2 {
+			fmt.Fprintln(w, "usage: radio tune <n|address>")
+			return 2
+		}
+		addr := cmd[1]
+		if n, err := strconv.Atoi(addr); err == nil {
+			broadcasts, err := fetch_broadcasts()
+			if err != nil {
+				fmt.Fprintln(w, "can't list the broadcasts: ", err)
+				return 1
+			}
+			if n < 1 || n > len(broadcasts) {
+				fmt.Fprintf(w, "no broadcast %d\n", n)
+				return 2
+			}
+			addr = broadcasts[n-1].Addr
+		}
+		info, err := tune_radio(ctx, addr)
+		if err != nil {
+			fmt.Fprintln(w, "can't tune in: ", err)
+			return 1
+		}
+		fmt.Fprintf(w, "Tuned in to %s at %s.\n", info.Name, info.Addr)
+	default:
+		fmt.Fprintln(w, "usage: radio [on [name]|off|tune <n|address>]")
+		return 2
+	}
+	return 0
+}
+
+/**
+ * RADIO from the interactive menu: lists the broadcasts going on, then
+ * tunes in to one or puts this peer's radio on or off the air
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_radio_menu(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	fmt.Println(format_radio())
+	broadcasts, err := fetch_broadcasts()
+	if err != nil {
+		fmt.Println("can't list the broadcasts: ", err)
+	} else {
+		write_broadcasts(os.Stdout, broadcasts)
+	}
+	air := "GO ON THE AIR"
+	if radio_hub() != nil {
+		air = "GO OFF THE AIR"
+	}
+	actions := []string{air, "BACK"}
+	if len(broadcasts) > 0 {
+		actions = append([]string{"TUNE IN"}, actions...)
+	}
+	action, _ := ui.Select("Radio", actions, &input.Options{
+		Loop: true,
+	})
+	switch action {
+	case "TUNE IN":
+		arg, _ := ui.Ask(fmt.Sprintf("Broadcast (1-%d)", len(broadcasts)), &input.Options{
+			Loop: true,
+			ValidateFunc: func(arg string) error {
+				if n, err := strconv.Atoi(arg); err != nil || n < 1 || n > len(broadcasts) {
+					return fmt.Errorf("pick a broadcast from 1 to %d", len(broadcasts))
+				}
+				return nil
+			},
+		})
+		n, _ := strconv.Atoi(arg)
+		info, err := tune_radio(ctx, broadcasts[n-1].Addr)
+		if err != nil {
+			fmt.Println("can't tune in: ", err)
+			return
+		}
+		fmt.Printf("Tuned in to %s at %s.\n", info.Name, info.Addr)
+	case "GO ON THE AIR":
+		name := config.Broadcast.Name
+		if name == "" {
+			name = DEFAULT_RADIO_NAME
+		}
+		name, _ = ui.Ask("Name the broadcast", &input.Options{
+			Default: name,
+		})
+		if err := start_radio(ctx, name); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(format_radio())
+	case "GO OFF THE AIR":
+		stop_radio()
+		fmt.Println(format_radio())
+	}
+}
+
+/**
+ * radio: lists the broadcasts going on. Going on the air and tuning in
+ * take a daemon
+ */
+func run_radio(args []string) int {
+	if len(args) > 0 {
+		fmt.Println("the radio takes a daemon, start one with: ", os.Args[0], "serve <port> <filedir>")
+		return 1
+	}
+	broadcasts, err := fetch_broadcasts()
+	if err != nil {
+		fmt.Println("can't list the broadcasts: ", err)
+		return 1
+	}
+	write_broadcasts(os.Stdout, broadcasts)
+	return 0
+}
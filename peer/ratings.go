@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Ratings and favorites. The user can rate a song from 1 to 5 stars and
+ * mark it a favorite; both are kept in the library database by song ID,
+ * along with the title and artist so the song can be found again if it
+ * leaves the master list. LIST and SEARCH show them, and the favorites can
+ * replace the queue
+ */
+
+// most stars a song can be given
+const MAX_STARS = 5
+
+/**
+ * What the user thinks of a song
+ */
+type Rating struct {
+	// 1 to MAX_STARS, 0 if unrated
+	Stars    int
+	Favorite bool
+}
+
+/**
+ * Rates a song
+ * @param song the master list entry of the song
+ * @param stars 1 to MAX_STARS, or 0 to clear its rating
+ * @return an error if the rating can't be saved
+ */
+func set_rating(song tsp.SongEntry, stars int) error {
+	if stars < 0 || stars > MAX_STARS {
+		return fmt.Errorf("a rating is 1 to %d stars, or 0 to clear it", MAX_STARS)
+	}
+	if library == nil {
+		return fmt.Errorf("ratings need the library")
+	}
+	_, err := library.Exec(`INSERT INTO ratings (song_id, title, artist, stars) VALUES (?, ?, ?, ?)
+		ON CONFLICT (song_id) DO UPDATE SET title = excluded.title, artist = excluded.artist, stars = excluded.stars`,
+		song.ID, song.Title, song.Artist, stars)
+	return err
+}
+
+/**
+ * Marks a song a favorite or not
+ * @param song the master list entry of the song
+ * @param favorite whether it is one
+ * @return an error if the change can't be saved
+ */
+func set_favorite(song tsp.SongEntry, favorite bool) error {
+	if library == nil {
+		return fmt.Errorf("favorites need the library")
+	}
+	_, err := library.Exec(`INSERT INTO ratings (song_id, title, artist, favorite) VALUES (?, ?, ?, ?)
+		ON CONFLICT (song_id) DO UPDATE SET title = excluded.title, artist = excluded.artist, favorite = excluded.favorite`,
+		song.ID, song.Title, song.Artist, favorite)
+	return err
+}
+
+/**
+ * @return the rating of every rated or favorite song, by ID; empty
+ * without a library
+ */
+func song_ratings() map[int]Rating {
+	ratings := make(map[int]Rating)
+	if library == nil {
+		return ratings
+	}
+	rows, err := library.Query("SELECT song_id, stars, favorite FROM ratings")
+	if err != nil {
+		slog.Error("can't read the ratings", "err", err)
+		return ratings
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var rating Rating
+		if rows.Scan(&id, &rating.Stars, &rating.Favorite) == nil {
+			ratings[id] = rating
+		}
+	}
+	return ratings
+}
+
+/**
+ * @return the favorite songs, by artist and title, as found in the master
+ * list (see resolve_entry)
+ */
+func favorite_songs() ([]tsp.SongEntry, error) {
+	if library == nil {
+		return nil, fmt.Errorf("favorites need the library")
+	}
+	rows, err := library.Query("SELECT song_id, title, artist FROM ratings WHERE favorite ORDER BY artist, title")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var songs []tsp.SongEntry
+	for rows.Next() {
+		var entry PlaylistEntry
+		if err = rows.Scan(&entry.ID, &entry.Title, &entry.Artist); err != nil {
+			return nil, err
+		}
+		songs = append(songs, resolve_entry(entry))
+	}
+	return songs, rows.Err()
+}
+
+/**
+ * @return how a rating is shown after a song in a list, "" for none
+ */
+func format_rating(rating Rating) string {
+	marks := ""
+	if rating.Stars > 0 {
+		marks += " [" + strings.Repeat("*", rating.Stars) + strings.Repeat("-", MAX_STARS-rating.Stars) + "]"
+	}
+	if rating.Favorite {
+		marks += " [favorite]"
+	}
+	return marks
+}
+
+/**
+ * @param arg the rating as typed
+ * @return the number of stars, or an error if it isn't 0 to MAX_STARS
+ */
+func parse_stars(arg string) (int, error) {
+	stars, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || stars < 0 || stars > MAX_STARS {
+		return 0, fmt.Errorf("a rating is 1 to %d stars, or 0 to clear it", MAX_STARS)
+	}
+	return stars, nil
+}
+
+/**
+ * Replaces the queue with the favorites and starts playing them
+ * @param ctx cancelled when the peer shuts down
+ * @return an error if there are none or they can't be read
+ */
+func play_favorites(ctx context.Context) error {
+	songs, err := favorite_songs()
+	if err != nil {
+		return err
+	}
+	if len(songs) == 0 {
+		return fmt.Errorf("no favorites yet")
+	}
+	queue.Replace(songs)
+	play_next(ctx, 1)
+	return nil
+}
+
+/**
+ * Writes the favorite songs
+ * @param w where they are written
+ * @return an error if they can't be read
+ */
+func write_favorites(w io.Writer) error {
+	songs, err := favorite_songs()
+	if err != nil {
+		return err
+	}
+	if len(songs) == 0 {
+		fmt.Fprintln(w, "No favorites yet.")
+		return nil
+	}
+	write_master_list(w, songs)
+	return nil
+}
+
+/**
+ * rate <song id> <0-5>: rates a song, 0 clears its rating
+ */
+func run_rate(args []string) int {
+	stars, err := parse_stars(args[1])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	return with_library_song(args[0], func(song tsp.SongEntry) error {
+		return set_rating(song, stars)
+	})
+}
+
+/**
+ * favorite <song id>: adds a song to the favorites
+ */
+func run_favorite(args []string) int {
+	return with_library_song(args[0], func(song tsp.SongEntry) error {
+		return set_favorite(song, true)
+	})
+}
+
+/**
+ * unfavorite <song id>: takes a song out of the favorites
+ */
+func run_unfavorite(args []string) int {
+	return with_library_song(args[0], func(song tsp.SongEntry) error {
+		return set_favorite(song, false)
+	})
+}
+
+/**
+ * Looks a song up by ID and changes what the library says of it
+ * @param arg the song id as typed
+ * @param change the change to make
+ * @return the exit status
+ */
+func with_library_song(arg string, change func(song tsp.SongEntry) error) int {
+	ctx, cancel := signal_context()
+	defer cancel()
+	song, ok := song_for_command(ctx, arg)
+	if !ok {
+		return 1
+	}
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	if err = change(song); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+/**
+ * favorites [play]: prints the favorite songs. Playing them needs a daemon
+ */
+func run_favorites(args []string) int {
+	if len(args) > 0 {
+		if args[0] == "play" && len(args) == 1 {
+			return run_daemon_only(args)
+		}
+		fmt.Println("Usage: ", os.Args[0], "favorites [play]")
+		return 2
+	}
+	done, err := use_library()
+	if err != nil {
+		fmt.Println("can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	ctx, cancel := signal_context()
+	defer cancel()
+	load_list_for_command(ctx)
+	if err = write_favorites(os.Stdout); err != nil {
+		fmt.Println("can't read the favorites: ", err)
+		return 1
+	}
+	return 0
+}
+
+/**
+ * RATE from the interactive menu: asks for a song, its rating and whether
+ * it is a favorite
+ */
+func handle_rate() {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	song := get_song_selection()
+	rating := song_ratings()[song.ID]
+	arg, _ := ui.Ask(fmt.Sprintf("Stars (1-%d, 0 for none, now %d)", MAX_STARS, rating.Stars), &input.Options{
+		Default:     strconv.Itoa(rating.Stars),
+		HideDefault: true,
+		Loop:        true,
+		ValidateFunc: func(arg string) error {
+			_, err := parse_stars(arg)
+			return err
+		},
+	})
+	stars, _ := parse_stars(arg)
+	if err := set_rating(song, stars); err != nil {
+		fmt.Println("can't save the rating: ", err)
+		return
+	}
+	answer, _ := ui.Ask("Favorite? (y/n)", &input.Options{
+		Default:     map[bool]string{true: "y", false: "n"}[rating.Favorite],
+		HideDefault: true,
+	})
+	favorite := strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+	if err := set_favorite(song, favorite); err != nil {
+		fmt.Println("can't save the favorite: ", err)
+	}
+}
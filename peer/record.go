@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Recording while playing. With RECORD on, every song that starts playing
+ * from the beginning is written to the songs directory as its bytes
+ * arrive, to "<artist> - <title>.<format>.part", and renamed into place
+ * once it has arrived whole and matched its hash. The songs directory is
+ * watched (see watch.go), so the song is then registered with the tracker
+ * like any other added to it. Songs this peer already serves, and songs
+ * whose file is already there, are not recorded
+ */
+
+// 1 while songs are recorded as they play
+var recording int32
+
+/**
+ * A song being written to the songs directory as it streams in
+ */
+type Recording struct {
+	file *os.File
+	dest string
+}
+
+/**
+ * Turns recording on or off, from the next song that starts
+ * @param on whether to record
+ * @return an error if this peer has no songs directory to record to
+ */
+func set_recording(on bool) error {
+	if on && serve_args == nil {
+		return fmt.Errorf("recording needs a songs directory, run serve or shell")
+	}
+	value := int32(0)
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&recording, value)
+	return nil
+}
+
+/**
+ * @return whether songs are being recorded
+ */
+func is_recording() bool {
+	return atomic.LoadInt32(&recording) == 1
+}
+
+/**
+ * Handles RECORD: turns recording on or off
+ * @param arg "on" or "off", "" to toggle it
+ * @return what recording is now, e.g. "Recording on.", or an error if arg
+ * is neither or it can't be turned on
+ */
+func toggle_recording(arg string) (string, error) {
+	on := !is_recording()
+	switch arg {
+	case "":
+	case "on", "off":
+		on = arg == "on"
+	default:
+		return "", fmt.Errorf("usage: record [on|off]")
+	}
+	if err := set_recording(on); err != nil {
+		return "", err
+	}
+	if on {
+		return "Recording on, from the next song.", nil
+	}
+	return "Recording off.", nil
+}
+
+/**
+ * @param song the song to name a file for
+ * @param source the source it is recorded from
+ * @return "<artist> - <title>.<format>", safe to use as a filename
+ */
+func recording_name(song tsp.SongEntry, source tsp.SongSource) string {
+	format := source.Format
+	if format == "" {
+		format = tsp.FORMAT_MP3
+	}
+	return song_file_name(song) + "." + format
+}
+
+/**
+ * @param song the song to name a file for
+ * @return "<artist> - <title>", safe to use as a filename
+ */
+func song_file_name(song tsp.SongEntry) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, song.Artist+" - "+song.Title)
+	return strings.TrimSpace(name)
+}
+
+/**
+ * Starts recording a song, if recording is on and it should be
+ * @param song the master list entry of the song
+ * @param source where it streams from
+ * @return the recording to write the stream to, nil if it isn't recorded
+ */
+func new_recording(song tsp.SongEntry, source tsp.SongSource) *Recording {
+	if !is_recording() || serve_args == nil {
+		return nil
+	}
+	master_mutex.Lock()
+	own := local_songs
+	master_mutex.Unlock()
+	if _, ok := local_song(own, song); ok {
+		return nil
+	}
+	dest := filepath.Join(serve_args[2], recording_name(song, source))
+	if _, err := os.Lstat(dest); err == nil {
+		return nil
+	}
+	file, err := os.Create(dest + ".part")
+	if err != nil {
+		slog.Error("can't record song", "file", dest, "err", err)
+		return nil
+	}
+	fmt.Println("Recording " + song.Title)
+	return &Recording{file: file, dest: dest}
+}
+
+func (r *Recording) Write(b []byte) (int, error) {
+	return r.file.Write(b)
+}
+
+/**
+ * Finishes writing a recorded song
+ * @param keep whether the song arrived whole and verified; if not it is
+ * thrown away
+ */
+func (r *Recording) Finish(keep bool) {
+	err := r.file.Close()
+	if keep && err == nil {
+		if err = os.Rename(r.file.Name(), r.dest); err == nil {
+			slog.Info("recorded song", "file", r.dest)
+			return
+		}
+		slog.Error("can't save recorded song", "file", r.dest, "err", err)
+	}
+	os.Remove(r.file.Name())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// wait before registering for relays again after losing the tracker,
+	// doubled for each failure up to MAX_RELAY_RETRY
+	RELAY_RETRY     = time.Second
+	MAX_RELAY_RETRY = time.Minute
+)
+
+/**
+ * Keeps this peer registered with the tracker for relays, so peers that
+ * can't dial it can still stream from it through the tracker. Every
+ * session the tracker passes down is answered with a data leg served like
+ * any other connection
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func take_relays(ctx context.Context, args []string) {
+	wait := RELAY_RETRY
+	for ctx.Err() == nil {
+		registered, err := register_for_relays(ctx, args)
+		if registered {
+			wait = RELAY_RETRY
+		}
+		slog.Debug("lost the relay registration, retrying", "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > MAX_RELAY_RETRY {
+			wait = MAX_RELAY_RETRY
+		}
+	}
+}
+
+/**
+ * Registers for relays on one connection to the tracker, and answers the
+ * sessions it passes down until it drops
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ * @return whether the registration went through, and why the connection
+ * ended
+ */
+func register_for_relays(ctx context.Context, args []string) (bool, error) {
+	// no deadlines, the connection sits idle until a session comes in
+	dialer := net.Dialer{Timeout: dial_timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", tracker_addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	defer close_on_cancel(ctx, conn)()
+	tracker := with_session(conn, tracker_addr)
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.RELAY_DATA, 0, []byte(announced_addr(args)))); err != nil {
+		return false, err
+	}
+	for {
+		msg, err := tsp.Decode(conn)
+		if err != nil {
+			return true, err
+		}
+		if err = msg.Err(); err != nil {
+			return false, err
+		}
+		if msg.Header.Type == tsp.RELAY_REQUEST {
+			go open_relay(ctx, msg.Header.Song_id)
+		}
+	}
+}
+
+/**
+ * Opens the data leg of a relay session and serves the request that comes
+ * down it
+ * @param ctx cancelled when the peer shuts down
+ * @param session the session the tracker passed down
+ */
+func open_relay(ctx context.Context, session int) {
+	conn, err := dial(ctx, tracker_addr)
+	if err != nil {
+		slog.Warn("can't open relay", "session", session, "err", err)
+		return
+	}
+	// the connection carries on to another peer, so only the first
+	// message has the session token
+	open := tsp.NewMsg(tsp.RELAY_DATA, session, nil)
+	open.Header.Token = session_token(tracker_addr)
+	if err = tsp.Encode(conn, open); err != nil {
+		slog.Warn("can't open relay", "session", session, "err", err)
+		conn.Close()
+		return
+	}
+	slog.Info("serving through the tracker", "session", session)
+	transfers.Add(1)
+	defer transfers.Done()
+	receive_peer(ctx, conn)
+}
+
+/**
+ * Reaches a peer through the tracker's relay, for when it can't be
+ * dialled directly
+ * @param ctx cancelled to give up
+ * @param addr the peer's serving address
+ * @return a connection that carries on to the peer as if dialled directly;
+ * a *tsp.Error if the tracker can't relay to it
+ */
+func dial_relay(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	// the connection carries on to the peer, so only the request has
+	// the session token
+	request := tsp.NewMsg(tsp.RELAY_REQUEST, 0, []byte(addr))
+	request.Header.Token = session_token(tracker_addr)
+	if err = tsp.Encode(conn, request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
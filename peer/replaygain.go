@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Volume normalization. Each song's track gain, in dB, is read from its
+ * ReplayGain tags (REPLAYGAIN_TRACK_GAIN in ID3 TXXX frames and Vorbis
+ * comments, R128_TRACK_GAIN in Opus) when it is scanned, or else measured
+ * by decoding it, and stored in the library. It goes out with the song as
+ * part of each source, and the player scales the song's PCM by it, so
+ * songs from different peers and encoders play at about the same
+ * loudness. replay_gain = false in the config file turns it off
+ */
+
+const (
+	// loudness songs are brought to, in dBFS RMS: the ReplayGain
+	// reference level of 89 dB SPL
+	REPLAYGAIN_REFERENCE = -18.0
+	// most a measured gain may raise or lower a song, in dB
+	MAX_MEASURED_GAIN = 15.0
+	// the block a measurement takes the loudness of, and the share of
+	// blocks quieter than the one taken as the song's loudness
+	LOUDNESS_BLOCK      = 50 // ms
+	LOUDNESS_PERCENTILE = 0.95
+	// R128_TRACK_GAIN is relative to -23 LUFS, 5 dB below the ReplayGain
+	// reference
+	R128_OFFSET = 5.0
+)
+
+/**
+ * @param value a REPLAYGAIN_TRACK_GAIN tag, e.g. "-7.89 dB"
+ * @return the gain in dB, and false if the tag can't be read
+ */
+func parse_replaygain(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(value, "dB"), "DB"))
+	gain, err := strconv.ParseFloat(value, 64)
+	return gain, err == nil && !math.IsNaN(gain) && !math.IsInf(gain, 0)
+}
+
+/**
+ * @param value an R128_TRACK_GAIN tag: Q7.8 fixed point dB relative to
+ * -23 LUFS
+ * @return the gain in dB relative to the ReplayGain reference, and false
+ * if the tag can't be read
+ */
+func parse_r128_gain(value string) (float64, bool) {
+	q, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return float64(q)/256 + R128_OFFSET, true
+}
+
+/**
+ * Measures how loud a song is by decoding it: the RMS of each
+ * LOUDNESS_BLOCK, taking the one LOUDNESS_PERCENTILE of the way up from
+ * the quietest
+ * @param file_path path of the song file
+ * @param format its tsp.FORMAT_
+ * @return the gain that brings it to REPLAYGAIN_REFERENCE, in dB, or an
+ * error if it can't be decoded
+ */
+func measure_gain(file_path string, format string) (float64, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return 0, err
+	}
+	decoder, err := new_decoder(format, file)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	defer decoder.Close()
+
+	// stereo 16 bit PCM: 4 bytes per sample
+	block := make([]byte, decoder.SampleRate()*LOUDNESS_BLOCK/1000*4)
+	var blocks []float64
+	for {
+		n, err := io.ReadFull(decoder, block)
+		if n >= 4 {
+			var sum float64
+			for i := 0; i+1 < n; i += 2 {
+				sample := float64(int16(binary.LittleEndian.Uint16(block[i:])))
+				sum += sample * sample
+			}
+			blocks = append(blocks, sum/float64(n/2))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+	sort.Float64s(blocks)
+	mean_square := blocks[int(float64(len(blocks)-1)*LOUDNESS_PERCENTILE)]
+	if mean_square <= 0 {
+		return 0, nil
+	}
+	loudness := 10 * math.Log10(mean_square/(32768*32768))
+	gain := REPLAYGAIN_REFERENCE - loudness
+	return math.Max(-MAX_MEASURED_GAIN, math.Min(MAX_MEASURED_GAIN, gain)), nil
+}
+
+/**
+ * @param gain a track gain in dB
+ * @return the factor samples are scaled by for it, 1 with normalization
+ * off
+ */
+func gain_factor(gain float64) float64 {
+	if !config.ReplayGain {
+		return 1
+	}
+	return math.Pow(10, gain/20)
+}
+
+/**
+ * Scales 16 bit little-endian PCM samples in place, clipping any that
+ * overflow
+ * @param pcm the decoded audio
+ * @param factor what to scale it by
+ */
+func gain_pcm(pcm []byte, factor float64) {
+	if factor == 1 {
+		return
+	}
+	for i := 0; i+1 < len(pcm); i += 2 {
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[i:]))) * factor
+		sample = math.Max(math.MinInt16, math.Min(math.MaxInt16, sample))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(sample)))
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Scrobbling. A play that got through at least half of its song is
+ * queued in the library's scrobbles table for each service set up under
+ * [scrobble] in the config file, Last.fm and ListenBrainz, and sent from
+ * there in batches by a serving peer. Scrobbles that can't be sent, e.g.
+ * while offline or with a bad key, stay queued and are tried again every
+ * SCROBBLE_RETRY; ones a service rejects outright are dropped.
+ *
+ * Last.fm takes an API key and secret (from last.fm/api/account/create)
+ * and a session key, which "peer lastfm <username>" gets and saves.
+ * ListenBrainz takes the user token from listenbrainz.org/settings
+ */
+
+const (
+	SCROBBLE_LASTFM       = "lastfm"
+	SCROBBLE_LISTENBRAINZ = "listenbrainz"
+	LASTFM_API            = "https://ws.audioscrobbler.com/2.0/"
+	LISTENBRAINZ_API      = "https://api.listenbrainz.org/1/submit-listens"
+	// how often queued scrobbles are tried again, and how many go at once
+	SCROBBLE_RETRY = 5 * time.Minute
+	SCROBBLE_BATCH = 50
+	// how long a service has to answer
+	SCROBBLE_TIMEOUT = 15 * time.Second
+)
+
+/**
+ * Credentials for the services scrobbled to. A service is left out unless
+ * all of its are set
+ */
+type ScrobbleConfig struct {
+	LastfmKey     string `toml:"lastfm_api_key"`
+	LastfmSecret  string `toml:"lastfm_api_secret"`
+	LastfmSession string `toml:"lastfm_session_key"`
+	ListenBrainz  string `toml:"listenbrainz_token"`
+}
+
+/**
+ * One play to scrobble, as queued in the library
+ */
+type Scrobble struct {
+	ID       int64
+	Title    string
+	Artist   string
+	Album    string
+	Duration time.Duration
+	PlayedAt time.Time
+}
+
+/**
+ * A service plays are scrobbled to
+ */
+type Scrobbler interface {
+	Name() string
+	// sends the scrobbles, returning a *RejectedError if the service
+	// refused them and they shouldn't be sent again
+	Submit(scrobbles []Scrobble) error
+}
+
+/**
+ * A service refusing scrobbles, e.g. for a bad key; sending them again
+ * won't help
+ */
+type RejectedError struct {
+	Service string
+	Reason  string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Service + " rejected the scrobbles: " + e.Reason
+}
+
+// wakes send_scrobbles when a scrobble is queued
+var scrobble_wake = make(chan struct{}, 1)
+
+var scrobble_client = &http.Client{Timeout: SCROBBLE_TIMEOUT}
+
+/**
+ * @return the services set up in the config file
+ */
+func scrobblers() []Scrobbler {
+	var services []Scrobbler
+	c := config.Scrobble
+	if c.LastfmKey != "" && c.LastfmSecret != "" && c.LastfmSession != "" {
+		services = append(services, &Lastfm{c.LastfmKey, c.LastfmSecret, c.LastfmSession})
+	}
+	if c.ListenBrainz != "" {
+		services = append(services, &ListenBrainz{c.ListenBrainz})
+	}
+	return services
+}
+
+/**
+ * Queues a play for every service set up, if at least half of the song
+ * was heard
+ * @param entry the play, as recorded in the history
+ */
+func queue_scrobble(entry HistoryEntry) {
+	song := entry.Song
+	if library == nil || song.Duration <= 0 || (!entry.Completed && entry.Listened < song.Duration/2) {
+		return
+	}
+	services := scrobblers()
+	for _, service := range services {
+		_, err := library.Exec(`INSERT INTO scrobbles (service, played_at, title, artist, album, duration)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			service.Name(), entry.PlayedAt.Unix(), song.Title, song.Artist, song.Album, int64(song.Duration))
+		if err != nil {
+			slog.Error("can't queue scrobble", "service", service.Name(), "song", song.Title, "err", err)
+		}
+	}
+	if len(services) > 0 {
+		select {
+		case scrobble_wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/**
+ * Sends queued scrobbles as they are queued, and tries those that
+ * couldn't be sent again every SCROBBLE_RETRY, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func send_scrobbles(ctx context.Context) {
+	services := scrobblers()
+	if len(services) == 0 || library == nil {
+		return
+	}
+	ticker := time.NewTicker(SCROBBLE_RETRY)
+	defer ticker.Stop()
+	for {
+		for _, service := range services {
+			flush_scrobbles(service)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-scrobble_wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+ * Sends a service its queued scrobbles, a batch at a time, until they
+ * are all sent or it can't be reached
+ * @param service the service
+ */
+func flush_scrobbles(service Scrobbler) {
+	for {
+		scrobbles, err := queued_scrobbles(service.Name())
+		if err != nil {
+			slog.Error("can't read queued scrobbles", "err", err)
+			return
+		}
+		if len(scrobbles) == 0 {
+			return
+		}
+		err = service.Submit(scrobbles)
+		if _, rejected := err.(*RejectedError); err != nil && !rejected {
+			slog.Info("can't scrobble, trying again later", "service", service.Name(), "queued", len(scrobbles), "err", err)
+			return
+		}
+		if err != nil {
+			slog.Warn("dropping scrobbles", "err", err)
+		}
+		for _, scrobble := range scrobbles {
+			if _, err = library.Exec("DELETE FROM scrobbles WHERE id = ?", scrobble.ID); err != nil {
+				slog.Error("can't clear sent scrobble", "err", err)
+				return
+			}
+		}
+	}
+}
+
+/**
+ * @param service the name of a service
+ * @return up to SCROBBLE_BATCH of the scrobbles queued for it, oldest
+ * first
+ */
+func queued_scrobbles(service string) ([]Scrobble, error) {
+	rows, err := library.Query(`SELECT id, title, artist, album, duration, played_at FROM scrobbles
+		WHERE service = ? ORDER BY played_at LIMIT ?`, service, SCROBBLE_BATCH)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var scrobbles []Scrobble
+	for rows.Next() {
+		var s Scrobble
+		var duration, played_at int64
+		if err = rows.Scan(&s.ID, &s.Title, &s.Artist, &s.Album, &duration, &played_at); err != nil {
+			return nil, err
+		}
+		s.Duration = time.Duration(duration)
+		s.PlayedAt = time.Unix(played_at, 0)
+		scrobbles = append(scrobbles, s)
+	}
+	return scrobbles, rows.Err()
+}
+
+/**
+ * Last.fm's scrobbling API
+ */
+type Lastfm struct {
+	key     string
+	secret  string
+	session string
+}
+
+func (l *Lastfm) Name() string {
+	return SCROBBLE_LASTFM
+}
+
+/**
+ * Sends scrobbles with track.scrobble, which takes up to 50 at once
+ */
+func (l *Lastfm) Submit(scrobbles []Scrobble) error {
+	params := url.Values{"method": {"track.scrobble"}, "sk": {l.session}}
+	for i, s := range scrobbles {
+		n := "[" + strconv.Itoa(i) + "]"
+		params.Set("artist"+n, s.Artist)
+		params.Set("track"+n, s.Title)
+		params.Set("timestamp"+n, strconv.FormatInt(s.PlayedAt.Unix(), 10))
+		params.Set("duration"+n, strconv.Itoa(int(s.Duration.Seconds())))
+		if s.Album != "" {
+			params.Set("album"+n, s.Album)
+		}
+	}
+	_, err := l.call(params)
+	return err
+}
+
+/**
+ * Calls a Last.fm API method, signed
+ * @param params the method and its parameters; the API key and signature
+ * are added
+ * @return the JSON response; a *RejectedError if Last.fm refused the
+ * call, or another error if it couldn't be reached or is unavailable
+ */
+func (l *Lastfm) call(params url.Values) ([]byte, error) {
+	params.Set("api_key", l.key)
+	params.Set("api_sig", lastfm_signature(params, l.secret))
+	params.Set("format", "json")
+	resp, err := scrobble_client.PostForm(LASTFM_API, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if err = json.Unmarshal(body, &reply); err != nil {
+		return nil, fmt.Errorf("last.fm answered %s", resp.Status)
+	}
+	switch reply.Error {
+	case 0:
+		return body, nil
+	// authentication failed, bad session or API key, suspended key: kept
+	// for once the config is fixed. Operation failed, service offline,
+	// temporarily unavailable, rate limited: worth trying again
+	case 4, 9, 10, 26, 8, 11, 16, 29:
+		return nil, fmt.Errorf("last.fm: %s", reply.Message)
+	}
+	return nil, &RejectedError{Service: SCROBBLE_LASTFM, Reason: reply.Message}
+}
+
+/**
+ * Signs a Last.fm API call: the md5 of every parameter, sorted by name,
+ * names and values run together, then the secret
+ * @param params the call's parameters
+ * @param secret the API secret
+ * @return the signature, in hex
+ */
+func lastfm_signature(params url.Values, secret string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "format" && name != "callback" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var sig strings.Builder
+	for _, name := range names {
+		sig.WriteString(name + params.Get(name))
+	}
+	sig.WriteString(secret)
+	sum := md5.Sum([]byte(sig.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * ListenBrainz's listen submission API
+ */
+type ListenBrainz struct {
+	token string
+}
+
+func (b *ListenBrainz) Name() string {
+	return SCROBBLE_LISTENBRAINZ
+}
+
+/**
+ * Sends scrobbles as listens, imported in one request
+ */
+func (b *ListenBrainz) Submit(scrobbles []Scrobble) error {
+	type TrackMetadata struct {
+		Artist     string                 `json:"artist_name"`
+		Track      string                 `json:"track_name"`
+		Release    string                 `json:"release_name,omitempty"`
+		Additional map[string]interface{} `json:"additional_info"`
+	}
+	type Listen struct {
+		ListenedAt int64         `json:"listened_at"`
+		Metadata   TrackMetadata `json:"track_metadata"`
+	}
+	listen_type := "single"
+	if len(scrobbles) > 1 {
+		listen_type = "import"
+	}
+	payload := make([]Listen, 0, len(scrobbles))
+	for _, s := range scrobbles {
+		payload = append(payload, Listen{s.PlayedAt.Unix(), TrackMetadata{
+			Artist:  s.Artist,
+			Track:   s.Title,
+			Release: s.Album,
+			Additional: map[string]interface{}{
+				"duration_ms":  s.Duration.Milliseconds(),
+				"media_player": "Torero",
+			},
+		}})
+	}
+	body, err := json.Marshal(map[string]interface{}{"listen_type": listen_type, "payload": payload})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, LISTENBRAINZ_API, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+b.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := scrobble_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("listenbrainz answered %s", resp.Status)
+	}
+	return &RejectedError{Service: SCROBBLE_LISTENBRAINZ, Reason: resp.Status + " " + strings.TrimSpace(string(reply))}
+}
+
+/**
+ * lastfm <username>: asks for the Last.fm password and saves the
+ * session key it gets to the config file, for scrobbling
+ */
+func run_lastfm(args []string) int {
+	c := config.Scrobble
+	if c.LastfmKey == "" || c.LastfmSecret == "" {
+		fmt.Println("set lastfm_api_key and lastfm_api_secret under [scrobble] in " + config_path() + " first")
+		return 2
+	}
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	password, err := ui.Ask("Last.fm password for "+args[0], &input.Options{
+		Required:  true,
+		Mask:      true,
+		HideOrder: true,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	lastfm := &Lastfm{key: c.LastfmKey, secret: c.LastfmSecret}
+	body, err := lastfm.call(url.Values{
+		"method":   {"auth.getMobileSession"},
+		"username": {args[0]},
+		"password": {password},
+	})
+	if err != nil {
+		fmt.Println("can't log in to last.fm: ", err)
+		return 1
+	}
+	var reply struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}
+	if err = json.Unmarshal(body, &reply); err != nil || reply.Session.Key == "" {
+		fmt.Println("last.fm sent no session key")
+		return 1
+	}
+	config.Scrobble.LastfmSession = reply.Session.Key
+	if err = save_config(); err != nil {
+		fmt.Println("can't save the session key: ", err)
+		return 1
+	}
+	fmt.Println("Logged in, plays will be scrobbled to last.fm.")
+	return 0
+}
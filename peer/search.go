@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/**
+ * A song matching a search, and how well it matched (higher is better)
+ */
+type SearchResult struct {
+	Song  tsp.SongEntry
+	Score int
+}
+
+/**
+ * Filters the master list by a query against title and artist. Exact
+ * substrings rank first, then fuzzy matches: every query character
+ * appearing in order, or words within a couple of typos
+ * @param query what the user typed
+ * @return matching songs, best first
+ */
+func search_songs(query string) []tsp.SongEntry {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+	master_mutex.Lock()
+	results := make([]SearchResult, 0)
+	for _, song := range master_list {
+		if score := match_score(query, song); score > 0 {
+			results = append(results, SearchResult{song, score})
+		}
+	}
+	master_mutex.Unlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	songs := make([]tsp.SongEntry, len(results))
+	for i, r := range results {
+		songs[i] = r.Song
+	}
+	return songs
+}
+
+/**
+ * @param query the lower-cased query
+ * @param song the song to match against
+ * @return how well the song matches, 0 for no match
+ */
+func match_score(query string, song tsp.SongEntry) int {
+	title := strings.ToLower(song.Title)
+	artist := strings.ToLower(song.Artist)
+	both := title + " " + artist
+	switch {
+	case title == query || artist == query:
+		return 100
+	case strings.HasPrefix(title, query) || strings.HasPrefix(artist, query):
+		return 90
+	case strings.Contains(both, query) || strings.Contains(artist+" "+title, query):
+		return 80
+	}
+
+	// every query word close to some word of the song
+	words := strings.Fields(both)
+	matched := 0
+	for _, q := range strings.Fields(query) {
+		for _, w := range words {
+			if strings.HasPrefix(w, q) || edit_distance(q, w) <= max_typos(q) {
+				matched++
+				break
+			}
+		}
+	}
+	if matched > 0 && matched == len(strings.Fields(query)) {
+		return 60
+	}
+	if is_subsequence(query, both) {
+		return 40
+	}
+	return 0
+}
+
+/**
+ * @return how many typos a query word of this length may contain
+ */
+func max_typos(word string) int {
+	switch {
+	case len(word) <= 3:
+		return 0
+	case len(word) <= 6:
+		return 1
+	}
+	return 2
+}
+
+/**
+ * @return whether every character of needle appears in haystack, in order
+ */
+func is_subsequence(needle string, haystack string) bool {
+	i := 0
+	for _, c := range haystack {
+		if i < len(needle) && rune(needle[i]) == c {
+			i++
+		}
+	}
+	return i == len(needle)
+}
+
+/**
+ * @return the Levenshtein distance between a and b
+ */
+func edit_distance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min_int(prev[j]+1, min_int(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min_int(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/**
+ * Prompts for a query, prints the numbered matches and offers to play one
+ * of them straight away
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_search(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	query, _ := ui.Ask("Search title or artist", &input.Options{Required: true, Loop: true})
+	results := search_songs(query)
+	if len(results) == 0 {
+		fmt.Println("No matches. Try LIST to refresh the song list.")
+		return
+	}
+	pick_and_play(ctx, results)
+}
+
+/**
+ * Prints songs numbered and offers to play one of them straight away
+ * @param ctx cancelled when the peer shuts down
+ * @param results the songs to pick from
+ */
+func pick_and_play(ctx context.Context, results []tsp.SongEntry) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	for i, song := range results {
+		fmt.Printf("%d. %s, %s (%s) [id %d]\n", i+1, song.Title, song.Artist,
+			format_duration(song.Duration), song.ID)
+	}
+	fmt.Println()
+
+	choice, _ := ui.Ask("Number to play (enter to skip)", &input.Options{
+		Loop: true,
+		ValidateFunc: func(s string) error {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				return nil
+			}
+			if n, err := strconv.Atoi(s); err != nil || n < 1 || n > len(results) {
+				return fmt.Errorf("pick a number from the results")
+			}
+			return nil
+		},
+	})
+	n, err := strconv.Atoi(strings.TrimSpace(choice))
+	if err != nil {
+		return
+	}
+	if err = start_song(ctx, results[n-1], 0, false); err != nil {
+		fmt.Println(err)
+	}
+}
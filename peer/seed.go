@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Seeding. While a song is being downloaded in pieces, the peer announces
+ * itself as a Partial source of it and serves the pieces it already has
+ * straight from the .part file, so a popular song spreads between peers
+ * without waiting for complete copies. Other peers ask it with HAVE which
+ * pieces it has, and fetch only those. The partial source is withdrawn
+ * once the download ends, whichever way
+ */
+
+var (
+	// downloads whose pieces are being seeded, by the FileID they are
+	// announced under, guarded by master_mutex
+	seeding = make(map[int]*Swarm)
+	// the cl arguments of the song server, nil if this process doesn't
+	// serve songs and so can't seed
+	serve_args []string
+)
+
+/**
+ * Starts seeding a download, if this process serves songs
+ * @param s the download
+ */
+func start_seeding(s *Swarm) {
+	if serve_args == nil {
+		return
+	}
+	master_mutex.Lock()
+	s.file_id = next_file_id
+	next_file_id++
+	seeding[s.file_id] = s
+	entry := s.seed_entry(serve_args)
+	master_mutex.Unlock()
+	update_tracker(tsp.ADD_SONG, []tsp.SongEntry{entry})
+}
+
+/**
+ * Stops seeding a download, if it was being seeded
+ * @param s the download
+ */
+func stop_seeding(s *Swarm) {
+	if s.file_id == 0 {
+		return
+	}
+	master_mutex.Lock()
+	delete(seeding, s.file_id)
+	entry := s.seed_entry(serve_args)
+	master_mutex.Unlock()
+	update_tracker(tsp.REMOVE_SONG, []tsp.SongEntry{entry})
+}
+
+/**
+ * @param args cl arguments which contain the port
+ * @return the song entry the download is announced as, with this peer as
+ * its single, partial source
+ */
+func (s *Swarm) seed_entry(args []string) tsp.SongEntry {
+	source := s.source
+	source.PeerAddr = announced_addr(args)
+	source.FileID = s.file_id
+	source.Caps = local_caps()
+	source.Key = identity_key()
+	source.Partial = true
+	return tsp.SongEntry{Title: s.song.Title, Artist: s.song.Artist, Duration: s.song.Duration,
+		Sources: []tsp.SongSource{source}}
+}
+
+/**
+ * The caller must hold master_mutex
+ * @param args cl arguments which contain the port
+ * @return an entry for every download being seeded
+ */
+func seeding_songs(args []string) []tsp.SongEntry {
+	songs := make([]tsp.SongEntry, 0, len(seeding))
+	for _, s := range seeding {
+		songs = append(songs, s.seed_entry(args))
+	}
+	return songs
+}
+
+/**
+ * @param id a FileID from a request
+ * @return the download seeded under it, nil if none is
+ */
+func seeded(id int) *Swarm {
+	master_mutex.Lock()
+	defer master_mutex.Unlock()
+	return seeding[id]
+}
+
+/**
+ * @return the pieces the download has, see tsp.HasPiece
+ */
+func (s *Swarm) have() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	have := make([]byte, (len(s.pieces)+7)/8)
+	for index, state := range s.pieces {
+		if state == PIECE_DONE {
+			tsp.SetPiece(have, index)
+		}
+	}
+	return have
+}
+
+/**
+ * @param offset where a range of the song starts
+ * @param length how long it is
+ * @return whether every piece the range touches has arrived
+ */
+func (s *Swarm) has_range(offset int64, length int64) bool {
+	if length <= 0 || offset < 0 || offset+length > s.size {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index := int(offset / tsp.PIECE_SIZE); int64(index)*tsp.PIECE_SIZE < offset+length; index++ {
+		if s.pieces[index] != PIECE_DONE {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * @param in_msg a PLAY request, carrying a FileID
+ * @return the .part file of the download seeded under the FileID, if it
+ * has every piece the request asks for; "" otherwise
+ */
+func seeded_file(in_msg *tsp.Msg) string {
+	s := seeded(in_msg.Header.Song_id)
+	if s == nil || in_msg.Header.Type != tsp.PLAY || !s.has_range(in_msg.Header.Offset, in_msg.Header.Length) {
+		return ""
+	}
+	return s.part
+}
+
+/**
+ * Answers a HAVE with the pieces of the requested song this peer has:
+ * every piece of a song in the catalog, the ones downloaded so far of a
+ * song being seeded
+ * @param in_msg the request, carrying a FileID
+ * @param client the requesting peer
+ */
+func send_have(in_msg *tsp.Msg, client io.Writer) {
+	var have []byte
+	if s := seeded(in_msg.Header.Song_id); s != nil {
+		have = s.have()
+	} else if song_file := requested_file(in_msg); song_file != "" {
+		stat, err := os.Stat(song_file)
+		if err != nil {
+			slog.Error("can't read song", "file", song_file, "err", err)
+			send_error(in_msg, client, tsp.ERR_INTERNAL, "can't read the song")
+			return
+		}
+		pieces := piece_count(stat.Size())
+		have = make([]byte, (pieces+7)/8)
+		for index := 0; index < pieces; index++ {
+			tsp.SetPiece(have, index)
+		}
+	} else {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+		return
+	}
+	if err := tsp.Encode(client, tsp.NewMsg(tsp.HAVE, in_msg.Header.Song_id, have)); err != nil {
+		slog.Warn("can't send pieces had", "err", err)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// how long in-flight uploads get to finish once the peer is shutting down
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+	// songs streamed to other peers at once, unless configured otherwise
+	DEFAULT_MAX_UPLOADS = 8
+)
+
+// in-flight uploads, drained on shutdown
+var transfers sync.WaitGroup
+
+var (
+	// PLAY and SEEK streams being served right now
+	uploads      int
+	upload_mutex sync.Mutex
+)
+
+/**
+ * @param ctx cancelled when the peer shuts down
+ * @param args
+ * Server thread of the host. Listens with the portable net package and
+ * hands every accepted peer off to its own goroutine, so this works on
+ * any platform Go supports. Returns once ctx is cancelled and in-flight
+ * uploads have drained
+ */
+func serve_songs(ctx context.Context, args []string) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(GetLocalIP(), args[1]))
+	if err != nil {
+		slog.Error("can't serve songs", "err", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	transfer_ctx, force_stop := context.WithCancel(context.Background())
+	defer force_stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Warn("accept failed", "err", err)
+			continue
+		}
+		transfers.Add(1)
+		go func() {
+			defer transfers.Done()
+			receive_peer(transfer_ctx, conn)
+		}()
+	}
+	drain_transfers(force_stop)
+}
+
+/**
+ * Waits for in-flight uploads to finish, cutting them off once
+ * SHUTDOWN_TIMEOUT has passed
+ * @param force_stop cancels the context every upload runs under
+ */
+func drain_transfers(force_stop context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		transfers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		slog.Info("closing unfinished uploads")
+		force_stop()
+		<-done
+	}
+}
+
+/**
+ * Closes conn if ctx is cancelled before release is called, so a blocked
+ * read or write on it returns
+ * @param ctx the context the transfer runs under
+ * @param conn the connection to close
+ * @return release to call once the transfer is over
+ */
+func close_on_cancel(ctx context.Context, conn io.Closer) (release func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+/**
+ * Reads a single request from a connected peer and serves it
+ * @param ctx cancelled to cut the transfer off
+ * @param conn the connection with the requesting peer
+ */
+func receive_message(ctx context.Context, conn net.Conn) {
+	conn = NewDeadlineConn(conn, io_timeout())
+	defer conn.Close()
+	defer close_on_cancel(ctx, conn)()
+	in_msg, err := tsp.Decode(conn)
+	if err != nil {
+		slog.Warn("bad message", "peer", conn.RemoteAddr(), "err", err)
+		return
+	}
+	serve_request(ctx, in_msg, conn)
+}
+
+/**
+ * Dispatches a request received by either server implementation
+ * @param ctx cancelled to cut the transfer off
+ * @param in_msg the request from the remote peer
+ * @param client where any reply or song data is written
+ */
+func serve_request(ctx context.Context, in_msg *tsp.Msg, client io.Writer) {
+	slog.Debug("request", "type", in_msg.Header.Type, "song", in_msg.Header.Song_id,
+		"offset", in_msg.Header.Offset, "version", in_msg.Header.Version)
+	if !fresh_request(in_msg) {
+		slog.Info("turning away a stale or replayed request", "key", fingerprint(in_msg.Header.Key))
+		send_error(in_msg, client, tsp.ERR_DENIED, "stale or replayed signature, check the clock")
+		return
+	}
+	if key := requester_key(in_msg); is_blocked(key) {
+		slog.Info("turning away a blocked peer", "key", fingerprint(key))
+		send_error(in_msg, client, tsp.ERR_DENIED, "blocked")
+		return
+	}
+	switch in_msg.Header.Type {
+	case tsp.PLAY, tsp.SEEK:
+		if !take_upload_slot() {
+			slog.Info("all upload slots in use, turning a request away")
+			send_error(in_msg, client, tsp.ERR_BUSY, "all upload slots in use")
+			return
+		}
+		defer release_upload_slot()
+		atomic.AddInt64(&metrics.ActiveUploads, 1)
+		defer atomic.AddInt64(&metrics.ActiveUploads, -1)
+
+		song_file := requested_file(in_msg)
+		if song_file == "" {
+			song_file = seeded_file(in_msg)
+		}
+		if song_file == "" {
+			slog.Info("request for a song not in the catalog", "file_id", in_msg.Header.Song_id)
+			send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+			return
+		}
+		align := in_msg.Header.Type == tsp.SEEK
+		song, err := open_song_file(song_file, in_msg.Header.Offset, align)
+		if os.IsNotExist(err) {
+			slog.Info("request for a song not served here", "err", err)
+			send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+			return
+		}
+		if err != nil {
+			slog.Error("can't open song", "file", song_file, "err", err)
+			send_error(in_msg, client, tsp.ERR_INTERNAL, "can't read the song")
+			return
+		}
+		defer song.Close()
+		var data io.Reader = song
+		if in_msg.Header.Length > 0 {
+			data = io.LimitReader(song, in_msg.Header.Length)
+		}
+		if send_play_reply(in_msg, song_file, client) {
+			if in_msg.Header.Type == tsp.PLAY {
+				hook_peer_connect(in_msg.Header.Song_id, song_file, client)
+			}
+			start := time.Now()
+			sent := send_mp3_file(ctx, data, client)
+			record_upload(in_msg, song_file, client, sent, start)
+		}
+	case tsp.INFO:
+		send_song_details(in_msg, client)
+	case tsp.ART:
+		send_song_art(in_msg, client)
+	case tsp.BROADCAST:
+		serve_radio(ctx, in_msg, client)
+	case tsp.PARTY:
+		serve_party(ctx, in_msg, client)
+	case tsp.CLOCK:
+		serve_clock(in_msg, client)
+	case tsp.VOTE_SKIP:
+		serve_vote_skip(in_msg, client)
+	case tsp.PIECES:
+		send_piece_hashes(in_msg, client)
+	case tsp.HAVE:
+		send_have(in_msg, client)
+	case tsp.DHT_FIND_NODE, tsp.DHT_FIND_VALUE, tsp.DHT_STORE:
+		serve_dht(in_msg, client)
+	case tsp.PEX:
+		serve_pex(in_msg, client)
+	case tsp.LIST:
+		send_local_songs(in_msg, client)
+	case tsp.LIBRARY:
+		serve_library(in_msg, client)
+	default:
+		return
+	}
+}
+
+/**
+ * Claims one of the config.MaxUploads upload slots, without waiting
+ * @return false if every slot is in use
+ */
+func take_upload_slot() bool {
+	if config.MaxUploads <= 0 {
+		return true
+	}
+	upload_mutex.Lock()
+	defer upload_mutex.Unlock()
+	if uploads >= config.MaxUploads {
+		return false
+	}
+	uploads++
+	return true
+}
+
+func release_upload_slot() {
+	if config.MaxUploads <= 0 {
+		return
+	}
+	upload_mutex.Lock()
+	uploads--
+	upload_mutex.Unlock()
+}
+
+/**
+ * Tells a peer its request couldn't be served. Peers older than version 2
+ * don't expect a reply, they just see the connection close
+ * @param in_msg the request being turned away
+ * @param client the requesting peer
+ * @param code one of the tsp.ERR_ codes
+ * @param text a human readable description
+ */
+func send_error(in_msg *tsp.Msg, client io.Writer, code byte, text string) {
+	if in_msg.Common() < 2 {
+		return
+	}
+	if err := tsp.Encode(client, tsp.NewError(code, text)); err != nil {
+		slog.Warn("can't send error reply", "err", err)
+	}
+}
+
+/**
+ * @param in_msg a PLAY, SEEK or INFO request
+ * @return the catalog path of the file the request is for, "" if it
+ * names none or one the requester may not fetch. Peers older than
+ * version 3 ask by master list ID, which means nothing here, so they are
+ * never served
+ */
+func requested_file(in_msg *tsp.Msg) string {
+	if in_msg.Common() < 3 {
+		return ""
+	}
+	return catalog_path(in_msg.Header.Song_id, requester_key(in_msg))
+}
+
+/**
+ * Answers a PLAY or SEEK with a header carrying the song's format, for
+ * peers new enough to expect one. Older peers just get the song data
+ * @param in_msg the request
+ * @param song_file the local file being sent
+ * @param client the requesting peer
+ * @return false if the reply couldn't be sent
+ */
+func send_play_reply(in_msg *tsp.Msg, song_file string, client io.Writer) bool {
+	if in_msg.Common() < 2 {
+		return true
+	}
+	reply := tsp.NewMsg(in_msg.Header.Type, in_msg.Header.Song_id, nil)
+	reply.Header.Offset = in_msg.Header.Offset
+	reply.Header.Format = song_format(song_file)
+	// signed along with the challenge the client sent in the request
+	sign_msg(reply, in_msg.Msg)
+	if err := tsp.Encode(client, reply); err != nil {
+		slog.Warn("can't reply", "file", song_file, "err", err)
+		return false
+	}
+	return true
+}
+
+/**
+ * Answers an INFO with the metadata of the requested song, read from the
+ * file itself
+ * @param in_msg the request, carrying a FileID
+ * @param client the requesting peer
+ */
+func send_song_details(in_msg *tsp.Msg, client io.Writer) {
+	song_file := requested_file(in_msg)
+	if song_file == "" {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+		return
+	}
+	info, err := read_song_tags(song_file)
+	if err != nil {
+		slog.Error("can't read song", "file", song_file, "err", err)
+		send_error(in_msg, client, tsp.ERR_INTERNAL, "can't read the song")
+		return
+	}
+	content, err := tsp.EncodeDetails(tsp.SongDetails{
+		Title:    info.Title,
+		Artist:   info.Artist,
+		Album:    info.Album,
+		Year:     info.Year,
+		Codec:    codec_name(info.Format),
+		Bitrate:  info.Bitrate,
+		Duration: info.Duration,
+		Size:     info.Size,
+	})
+	if err != nil {
+		slog.Error("can't encode song details", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.INFO, in_msg.Header.Song_id, content)); err != nil {
+		slog.Warn("can't send song details", "err", err)
+	}
+}
+
+/**
+ * Answers a PIECES with the hash of every piece of the requested song,
+ * whether in the catalog or being seeded
+ * @param in_msg the request, carrying a FileID
+ * @param client the requesting peer
+ */
+func send_piece_hashes(in_msg *tsp.Msg, client io.Writer) {
+	var hashes []string
+	if s := seeded(in_msg.Header.Song_id); s != nil {
+		hashes = s.hashes
+	} else if song_file := requested_file(in_msg); song_file != "" {
+		var err error
+		if hashes, err = piece_hashes(song_file); err != nil {
+			slog.Error("can't read song", "file", song_file, "err", err)
+			send_error(in_msg, client, tsp.ERR_INTERNAL, "can't read the song")
+			return
+		}
+	} else {
+		send_error(in_msg, client, tsp.ERR_NOT_FOUND, fmt.Sprintf("no song %d here", in_msg.Header.Song_id))
+		return
+	}
+	content, err := tsp.EncodePieces(hashes)
+	if err != nil {
+		slog.Error("can't encode piece hashes", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.PIECES, in_msg.Header.Song_id, content)); err != nil {
+		slog.Warn("can't send piece hashes", "err", err)
+	}
+}
+
+/**
+ * Answers a LIST from a peer discovering songs without a tracker, with
+ * the songs it may see
+ * @param in_msg the request
+ * @param client the requesting peer
+ */
+func send_local_songs(in_msg *tsp.Msg, client io.Writer) {
+	master_mutex.Lock()
+	songs := append(seeding_songs(serve_args), local_songs...)
+	master_mutex.Unlock()
+	content, err := tsp.EncodeSongs(tsp.VisibleSongs(songs, requester_key(in_msg)))
+	if err != nil {
+		slog.Error("can't encode song list", "err", err)
+		return
+	}
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.LIST, 0, content)); err != nil {
+		slog.Warn("can't send song list", "err", err)
+	}
+}
+
+/**
+ * Opens a song to send, positioned at offset. A PLAY resuming an
+ * interrupted transfer starts at exactly that byte, a SEEK at the first
+ * frame at or after it
+ * @param song_file the song's path, from the catalog
+ * @param offset byte offset in the file to start from
+ * @param align whether to skip ahead to a frame boundary
+ * @return the song's bytes from offset on; an error satisfying
+ * os.IsNotExist if there is no such song
+ */
+func open_song_file(song_file string, offset int64, align bool) (io.ReadCloser, error) {
+	file, err := os.Open(song_file)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	reader := bufio.NewReader(file)
+	if offset > 0 && align {
+		skip_to_frame(reader)
+	}
+	return BufferedStream{reader, file}, nil
+}
+
+/**
+ * sends the song's bytes to the client, throttled to the upload limits
+ * @param ctx cancelled to cut the transfer off
+ * @param song the opened song
+ * @param client the client connection
+ * @return the number of bytes sent
+ */
+func send_mp3_file(ctx context.Context, song io.Reader, client io.Writer) int64 {
+	out := throttle(ctx, client, upload_bucket, NewTokenBucket(conn_upload_rate))
+	sent := copy_ctx(ctx, out, song)
+	atomic.AddInt64(&metrics.BytesServed, sent)
+	return sent
+}
+
+/**
+ * @param client the connection to a requesting peer
+ * @return the peer's IP address, empty if the connection doesn't say
+ */
+func client_host(client io.Writer) string {
+	conn, ok := client.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+/**
+ * io.Copy that gives up between chunks once ctx is cancelled
+ * @return the number of bytes copied
+ */
+func copy_ctx(ctx context.Context, dst io.Writer, src io.Reader) int64 {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for ctx.Err() == nil {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w, werr := dst.Write(buf[:n])
+			total += int64(w)
+			if werr != nil {
+				return total
+			}
+		}
+		if err != nil {
+			return total
+		}
+	}
+	return total
+}
+
+/**
+ * Discards bytes until the next mp3 frame sync word, so a stream started
+ * from the middle of a file begins on a frame boundary
+ * @param reader the file positioned somewhere inside the song
+ */
+func skip_to_frame(reader *bufio.Reader) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if b != 0xFF {
+			continue
+		}
+		next, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if next[0]&0xE0 == 0xE0 {
+			reader.UnreadByte()
+			return
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux && epoll)
+
+package main
+
+import "context"
+
+/**
+ * Starts the portable song server. Build with -tags epoll on Linux to use
+ * the epoll server instead
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func start_server(ctx context.Context, args []string) {
+	serve_songs(ctx, args)
+}
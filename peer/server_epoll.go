@@ -0,0 +1,236 @@
+//go:build linux && epoll
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	MAX_EVENTS = 64
+	EPOLLET    = 1 << 31
+	// how often epoll_wait wakes up to check for shutdown
+	EPOLL_TIMEOUT_MS = 500
+)
+
+/**
+ * io.ReadWriter over a raw socket file descriptor, so framed messages can
+ * be read straight off an accepted epoll connection
+ */
+type FdConn struct {
+	fd   int
+	once sync.Once
+}
+
+func NewFdConn(fd int) *FdConn {
+	return &FdConn{fd: fd}
+}
+
+/**
+ * Closes the fd. Safe to call more than once
+ */
+func (c *FdConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = syscall.Close(c.fd)
+	})
+	return err
+}
+
+/**
+ * Makes reads and writes that block for longer than timeout fail with
+ * os.ErrDeadlineExceeded
+ * @param timeout how long one read or write may block
+ */
+func (c *FdConn) SetTimeout(timeout time.Duration) error {
+	tv := syscall.NsecToTimeval(int64(timeout))
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+	return syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+}
+
+func (c *FdConn) Read(p []byte) (n int, err error) {
+	n, err = syscall.Read(c.fd, p)
+	if err == syscall.EAGAIN {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *FdConn) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		w, err := syscall.Write(c.fd, p[n:])
+		if err == syscall.EAGAIN {
+			return n, os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			return n, err
+		}
+		n += w
+	}
+	return n, nil
+}
+
+/**
+ * Starts the epoll song server, the Linux fast path selected by the epoll
+ * build tag
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func start_server(ctx context.Context, args []string) {
+	if config.MTLS {
+		slog.Info("serving songs over mutual TLS, which the epoll server can't")
+		serve_songs(ctx, args)
+		return
+	}
+	serve_songs_epoll(ctx, args)
+}
+
+/**
+ * @param ctx cancelled to cut the transfer off
+ * @param client_fd the file descriptor of the connected client
+ */
+func receive_message_epoll(ctx context.Context, client_fd int) {
+	conn := NewFdConn(client_fd)
+	defer conn.Close()
+	defer close_on_cancel(ctx, conn)()
+	if err := conn.SetTimeout(io_timeout()); err != nil {
+		slog.Warn("can't set socket timeouts", "fd", client_fd, "err", err)
+	}
+	in_msg, err := tsp.Decode(conn)
+	if err != nil {
+		slog.Warn("bad message", "fd", client_fd, "err", err)
+		return
+	}
+	serve_request(ctx, in_msg, conn)
+}
+
+/**
+ * @param ip the local address to serve on, nil for every IPv4 address
+ * @param port the port to serve on
+ * @return the socket domain and address to bind, IPv6 if ip is IPv6
+ */
+func listen_sockaddr(ip net.IP, port int) (int, syscall.Sockaddr) {
+	if ip != nil && ip.To4() == nil {
+		addr := &syscall.SockaddrInet6{Port: port}
+		copy(addr.Addr[:], ip.To16())
+		return syscall.AF_INET6, addr
+	}
+	// sruct for address + port
+	addr := &syscall.SockaddrInet4{Port: port}
+	// Copy local ip address to addr struct
+	copy(addr.Addr[:], ip.To4())
+	return syscall.AF_INET, addr
+}
+
+/**
+ * @param ctx cancelled when the peer shuts down
+ * @param args
+ * Server thread of the host. This function handles sets up epoll for
+ * nonblocking, asynchronous I/O. It handles incoming peers, and calls
+ * receive_message to handle their requests accordingly. Returns once ctx
+ * is cancelled and in-flight uploads have drained
+ */
+func serve_songs_epoll(ctx context.Context, args []string) {
+	// var event syscall.EpollEvent
+	var event syscall.EpollEvent
+
+	var events [MAX_EVENTS]syscall.EpollEvent
+
+	// Get port and local ip address
+	port, _ := strconv.ParseInt(args[1], 10, 32)
+	domain, addr := listen_sockaddr(net.ParseIP(GetLocalIP()), int(port))
+
+	fd, err := syscall.Socket(domain, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+	if err != nil {
+		slog.Error("can't serve songs", "call", "socket", "err", err)
+		return
+	}
+	defer syscall.Close(fd)
+
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		slog.Error("can't serve songs", "err", err)
+		return
+	}
+
+	// bind and listen
+	if err = syscall.Bind(fd, addr); err != nil {
+		slog.Error("can't serve songs", "call", "bind", "err", err)
+		return
+	}
+	if err = syscall.Listen(fd, 10); err != nil {
+		slog.Error("can't serve songs", "call", "listen", "err", err)
+		return
+	}
+
+	epfd, e := syscall.EpollCreate1(0)
+	if e != nil {
+		slog.Error("can't serve songs", "call", "epoll_create", "err", e)
+		return
+	}
+	defer syscall.Close(epfd)
+
+	event.Events = syscall.EPOLLIN
+	event.Fd = int32(fd)
+	if e = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); e != nil {
+		slog.Error("can't serve songs", "call", "epoll_ctl", "err", e)
+		return
+	}
+
+	transfer_ctx, force_stop := context.WithCancel(context.Background())
+	defer force_stop()
+	for ctx.Err() == nil {
+		nevents, e := syscall.EpollWait(epfd, events[:], EPOLL_TIMEOUT_MS)
+		if e == syscall.EINTR {
+			continue
+		}
+		if e != nil {
+			slog.Error("epoll_wait failed", "err", e)
+			break
+		}
+
+		for ev := 0; ev < nevents; ev++ {
+			if int(events[ev].Fd) == fd {
+				connFd, _, err := syscall.Accept(fd)
+				if err != nil {
+					slog.Warn("accept failed", "err", err)
+					continue
+				}
+				syscall.SetNonblock(fd, true)
+				event.Events = syscall.EPOLLIN | EPOLLET
+				event.Fd = int32(connFd)
+				err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, connFd, &event)
+				if err != nil {
+					// drop this peer, the server carries on
+					slog.Warn("epoll_ctl failed, dropping peer", "fd", connFd, "err", err)
+					syscall.Close(connFd)
+				}
+			} else {
+				client_fd := int(events[ev].Fd)
+				transfers.Add(1)
+				go func() {
+					defer transfers.Done()
+					receive_message_epoll(transfer_ctx, client_fd)
+				}()
+			}
+		}
+	}
+	drain_transfers(force_stop)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	input "github.com/tcnksm/go-input"
+)
+
+/*
+ * Tracker accounts: `peer register` and `peer login` trade a name and
+ * password for a session token, kept in ~/.torero by tracker address, and
+ * every message sent to that tracker after carries it in its header, which
+ * a tracker started with --locked asks for. The token only goes on
+ * connections to the tracker, never on relay connections that carry on to
+ * another peer
+ */
+
+var (
+	// the sessions by tracker address, read the first time one is needed
+	session_mutex  sync.Mutex
+	tracker_logins map[string]tsp.AuthSession
+)
+
+/**
+ * A connection to the tracker, whose messages carry the session token
+ */
+type TrackerConn struct {
+	net.Conn
+	token string
+}
+
+/**
+ * @return the session token the messages carry
+ */
+func (c *TrackerConn) SessionToken() string {
+	return c.token
+}
+
+/**
+ * @return the path of the file the sessions are kept in
+ */
+func session_path() string {
+	return filepath.Join(torero_dir(), "session.json")
+}
+
+/**
+ * Called with session_mutex held
+ * @return the sessions, by tracker address
+ */
+func load_sessions() map[string]tsp.AuthSession {
+	if tracker_logins != nil {
+		return tracker_logins
+	}
+	tracker_logins = make(map[string]tsp.AuthSession)
+	if content, err := os.ReadFile(session_path()); err == nil {
+		json.Unmarshal(content, &tracker_logins)
+	}
+	return tracker_logins
+}
+
+/**
+ * Saves the sessions. Called with session_mutex held
+ * @return an error if they can't be written
+ */
+func save_sessions() error {
+	content, err := json.MarshalIndent(tracker_logins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(torero_dir(), 0755); err != nil {
+		return err
+	}
+	// only the owner may read it: whoever has a token is logged in
+	return os.WriteFile(session_path(), content, 0600)
+}
+
+/**
+ * @param addr a tracker's address
+ * @return the session with it, and whether there is one. Each use keeps a
+ * session alive on the tracker, so it is sent even past the expiry it was
+ * issued with
+ */
+func tracker_session(addr string) (tsp.AuthSession, bool) {
+	session_mutex.Lock()
+	defer session_mutex.Unlock()
+	session, ok := load_sessions()[addr]
+	return session, ok
+}
+
+/**
+ * Keeps the session with a tracker, or forgets it
+ * @param addr the tracker's address
+ * @param session the session, or nil to log out
+ * @return an error if the sessions can't be saved
+ */
+func set_tracker_session(addr string, session *tsp.AuthSession) error {
+	session_mutex.Lock()
+	defer session_mutex.Unlock()
+	sessions := load_sessions()
+	if session == nil {
+		delete(sessions, addr)
+	} else {
+		sessions[addr] = *session
+	}
+	return save_sessions()
+}
+
+/**
+ * @param conn a connection to a tracker
+ * @param addr the tracker's address
+ * @return the connection, with the session token on the messages sent on it
+ */
+func with_session(conn net.Conn, addr string) net.Conn {
+	session, _ := tracker_session(addr)
+	return &TrackerConn{Conn: conn, token: session.Token}
+}
+
+/**
+ * Connects to a tracker like dial, with the session token on the messages
+ * sent on the connection
+ * @param ctx cancelling it gives up on the retries
+ * @param addr the tracker's address
+ * @return the connection, or the last dial error
+ */
+func dial_tracker(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return with_session(conn, addr), nil
+}
+
+/**
+ * @param addr a tracker's address
+ * @return the session token to stamp on the first message of a
+ * connection that carries on to another peer
+ */
+func session_token(addr string) string {
+	session, _ := tracker_session(addr)
+	return session.Token
+}
+
+/**
+ * Sends the tracker an AUTH
+ * @param request the registration, login or logout
+ * @return the session the tracker answered with
+ */
+func auth_round_trip(request tsp.AuthRequest) (tsp.AuthSession, error) {
+	content, err := tsp.EncodeAuth(request)
+	if err != nil {
+		return tsp.AuthSession{}, err
+	}
+	start := time.Now()
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	defer func() { tracker_round_trip(start, err) }()
+	if err != nil {
+		return tsp.AuthSession{}, err
+	}
+	defer tracker.Close()
+	msg := tsp.NewMsg(tsp.AUTH, 0, content)
+	// signed, so a tracker acting as a CA knows which key to certify
+	sign_msg(msg, nil)
+	if err = tsp.Encode(tracker, msg); err != nil {
+		return tsp.AuthSession{}, err
+	}
+	reply, err := tsp.Decode(tracker)
+	if err != nil {
+		return tsp.AuthSession{}, err
+	}
+	if err = reply.Err(); err != nil {
+		return tsp.AuthSession{}, err
+	}
+	return tsp.DecodeSession(reply.Msg)
+}
+
+/**
+ * Asks for a password, without echoing it
+ * @param query what to ask
+ * @return the password
+ */
+func ask_password(query string) (string, error) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	return ui.Ask(query, &input.Options{
+		Required:  true,
+		Mask:      true,
+		HideOrder: true,
+	})
+}
+
+/**
+ * Registers or logs in to an account, and keeps the session
+ * @param op tsp.AUTH_REGISTER or tsp.AUTH_LOGIN
+ * @param user the account's name
+ * @param invite the invite registering takes on an invite-only tracker
+ * @return the exit status
+ */
+func start_session(op int, user string, invite string) int {
+	password, err := ask_password("Password for " + user + " on " + tracker_addr)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	session, err := auth_round_trip(tsp.AuthRequest{Op: op, User: user, Password: password, Invite: invite})
+	if err != nil {
+		fmt.Println("can't log in: ", err)
+		return 1
+	}
+	if err = set_tracker_session(tracker_addr, &session); err != nil {
+		fmt.Println("can't save the session: ", err)
+		return 1
+	}
+	fmt.Printf("Logged in to %s as %s until %s.\n", tracker_addr, session.User, session.Expires.Format("2006-01-02"))
+	if len(session.Cert) > 0 {
+		fmt.Println("The tracker issued a certificate for mutual TLS with --mtls; restart a running daemon to use it.")
+	}
+	return 0
+}
+
+/**
+ * register <user> [invite]: makes an account on the tracker and logs in
+ * to it
+ */
+func run_register(args []string) int {
+	if tracker_addr == "" {
+		fmt.Println("no tracker to log in to")
+		return 2
+	}
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Println("usage: register <user> [invite]")
+		return 2
+	}
+	invite := ""
+	if len(args) == 2 {
+		invite = args[1]
+	}
+	return start_session(tsp.AUTH_REGISTER, args[0], invite)
+}
+
+/**
+ * login [user]: logs in to an account on the tracker, or prints who is
+ * logged in
+ */
+func run_login(args []string) int {
+	if tracker_addr == "" {
+		fmt.Println("no tracker to log in to")
+		return 2
+	}
+	if len(args) == 1 {
+		return start_session(tsp.AUTH_LOGIN, args[0], "")
+	}
+	if len(args) != 0 {
+		fmt.Println("usage: login [user]")
+		return 2
+	}
+	session, ok := tracker_session(tracker_addr)
+	if !ok {
+		fmt.Println("Not logged in to " + tracker_addr + ".")
+		return 1
+	}
+	fmt.Printf("Logged in to %s as %s.\n", tracker_addr, session.User)
+	return 0
+}
+
+/**
+ * logout: ends the session with the tracker and forgets it
+ */
+func run_logout(args []string) int {
+	if tracker_addr == "" {
+		fmt.Println("no tracker to log out of")
+		return 2
+	}
+	if _, ok := tracker_session(tracker_addr); !ok {
+		fmt.Println("Not logged in to " + tracker_addr + ".")
+		return 1
+	}
+	// forgotten even if the tracker can't be told, it expires there in time
+	_, err := auth_round_trip(tsp.AuthRequest{Op: tsp.AUTH_LOGOUT})
+	if err != nil {
+		fmt.Println("can't tell the tracker: ", err)
+	}
+	if err = set_tracker_session(tracker_addr, nil); err != nil {
+		fmt.Println("can't forget the session: ", err)
+		return 1
+	}
+	fmt.Println("Logged out of " + tracker_addr + ".")
+	return 0
+}
+
+/**
+ * @param err an error from the tracker
+ * @return whether it turned the request away for want of an account
+ */
+func needs_login(err error) bool {
+	var tsp_err *tsp.Error
+	return errors.As(err, &tsp_err) && tsp_err.Code == tsp.ERR_AUTH
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/tcnksm/go-input"
+)
+
+/*
+ * Shared playlists: playlists kept by the tracker that any peer can add
+ * songs to, each noting who added it, so a group can build a party queue
+ * over time. A peer subscribed to one keeps a copy in ~/.torero/shared,
+ * which a serving peer brings up to date every SHARED_POLL, telling of the
+ * songs added; one playing a shared playlist also adds them to the end of
+ * its queue as they come, until it stops following it
+ */
+
+const (
+	// how often a serving peer fetches the songs added to the shared
+	// playlists it is subscribed to
+	SHARED_POLL = tsp.HEARTBEAT_INTERVAL
+)
+
+var (
+	shared_mutex sync.Mutex
+	// the shared playlist whose new songs are added to the queue, empty
+	// for none
+	shared_queue string
+)
+
+/**
+ * @return the directory copies of subscribed shared playlists are kept in
+ */
+func shared_dir() string {
+	return filepath.Join(torero_dir(), "shared")
+}
+
+/**
+ * @param name a shared playlist's name
+ * @return the path of its copy, or an error for names that aren't a
+ * plain file name
+ */
+func shared_path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid playlist name %q", name)
+	}
+	return filepath.Join(shared_dir(), name+".json"), nil
+}
+
+/**
+ * Sends the tracker a SHARED_PLAYLIST
+ * @param request what is asked of it
+ * @return the tracker's reply, or an error if it couldn't be reached or
+ * turned the request down
+ */
+func shared_round_trip(request tsp.SharedRequest) (in_msg *tsp.Msg, err error) {
+	if tracker_addr == "" {
+		return nil, fmt.Errorf("shared playlists take a tracker")
+	}
+	start := time.Now()
+	defer func() { tracker_round_trip(start, err) }()
+	content, err := tsp.EncodeSharedRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	tracker, err := dial_tracker(context.Background(), tracker_addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	if err = tsp.Encode(tracker, tsp.NewMsg(tsp.SHARED_PLAYLIST, 0, content)); err != nil {
+		return nil, err
+	}
+	in_msg, err = tsp.Decode(tracker)
+	if err == nil {
+		err = in_msg.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return in_msg, nil
+}
+
+/**
+ * @return the shared playlists, without their songs, the latest made first
+ */
+func fetch_shared_list() ([]tsp.SharedPlaylist, error) {
+	in_msg, err := shared_round_trip(tsp.SharedRequest{Op: tsp.SHARED_LIST})
+	if err != nil {
+		return nil, err
+	}
+	return tsp.DecodeSharedPlaylists(in_msg.Msg)
+}
+
+/**
+ * Asks the tracker for a shared playlist, made or changed as asked
+ * @param request what is asked of it: SHARED_CREATE, SHARED_ADD or
+ * SHARED_GET
+ * @return the playlist, with the songs the tracker sends for the request
+ */
+func fetch_shared(request tsp.SharedRequest) (tsp.SharedPlaylist, error) {
+	request.By = config.Nickname
+	in_msg, err := shared_round_trip(request)
+	if err != nil {
+		return tsp.SharedPlaylist{}, err
+	}
+	return tsp.DecodeSharedPlaylist(in_msg.Msg)
+}
+
+/**
+ * @param name a shared playlist's name
+ * @return the subscribed copy of it, or an error if not subscribed
+ */
+func load_shared(name string) (*tsp.SharedPlaylist, error) {
+	file, err := shared_path(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("not subscribed to %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	playlist := &tsp.SharedPlaylist{}
+	err = json.Unmarshal(content, playlist)
+	return playlist, err
+}
+
+/**
+ * Writes the copy of a subscribed shared playlist, replacing the last
+ * @param playlist the playlist
+ */
+func save_shared(playlist *tsp.SharedPlaylist) error {
+	file, err := shared_path(playlist.Name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(shared_dir(), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(playlist, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+/**
+ * @return the names of the shared playlists subscribed to
+ */
+func subscribed_shared() []string {
+	files, _ := ioutil.ReadDir(shared_dir())
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".json" {
+			names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	return names
+}
+
+/**
+ * Brings the copy of a subscribed shared playlist up to date, or makes
+ * one if there is none
+ * @param name the playlist's name
+ * @return the playlist, and the songs added since the copy was last
+ * brought up to date
+ */
+func sync_shared(name string) (*tsp.SharedPlaylist, []tsp.SharedEntry, error) {
+	playlist, err := load_shared(name)
+	if err != nil {
+		playlist = &tsp.SharedPlaylist{Name: name}
+	}
+	update, err := fetch_shared(tsp.SharedRequest{Op: tsp.SHARED_GET, Name: name, Since: playlist.Version})
+	if err != nil {
+		return nil, nil, err
+	}
+	if update.Version-len(update.Entries) != len(playlist.Entries) {
+		// the copy isn't what the tracker has, e.g. the playlist was
+		// deleted and made again, so the tracker sent every song
+		playlist.Entries = nil
+	}
+	playlist.Entries = append(playlist.Entries, update.Entries...)
+	playlist.CreatedBy, playlist.Created, playlist.Version = update.CreatedBy, update.Created, update.Version
+	if len(update.Entries) > 0 {
+		if err = save_shared(playlist); err != nil {
+			return nil, nil, err
+		}
+	}
+	return playlist, update.Entries, nil
+}
+
+/**
+ * Subscribes to a shared playlist, fetching every song in it
+ * @param name the playlist's name
+ * @return the playlist
+ */
+func subscribe_shared(name string) (*tsp.SharedPlaylist, error) {
+	if _, err := shared_path(name); err != nil {
+		return nil, err
+	}
+	playlist, _, err := sync_shared(name)
+	if err != nil {
+		return nil, err
+	}
+	return playlist, save_shared(playlist)
+}
+
+/**
+ * Unsubscribes from a shared playlist, and stops adding its songs to the
+ * queue
+ * @param name the playlist's name
+ */
+func unsubscribe_shared(name string) error {
+	file, err := shared_path(name)
+	if err != nil {
+		return err
+	}
+	shared_mutex.Lock()
+	if shared_queue == name {
+		shared_queue = ""
+	}
+	shared_mutex.Unlock()
+	if err = os.Remove(file); os.IsNotExist(err) {
+		return fmt.Errorf("not subscribed to %q", name)
+	}
+	return err
+}
+
+/**
+ * Brings every subscribed shared playlist up to date every SHARED_POLL,
+ * telling of the songs added and queueing them if the playlist is being
+ * played, until ctx is cancelled
+ * @param ctx cancelled when the peer shuts down
+ */
+func follow_shared(ctx context.Context) {
+	ticker := time.NewTicker(SHARED_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, name := range subscribed_shared() {
+			_, added, err := sync_shared(name)
+			if err != nil {
+				slog.Debug("can't bring a shared playlist up to date", "name", name, "err", err)
+				continue
+			}
+			shared_mutex.Lock()
+			queueing := shared_queue == name
+			shared_mutex.Unlock()
+			for _, entry := range added {
+				fmt.Println(added_by(entry) + " added " + entry.Song.Title + ", " + entry.Song.Artist + " to " + name)
+				if queueing {
+					queue.Add(resolve_entry(new_playlist_entry(entry.Song)))
+				}
+			}
+		}
+	}
+}
+
+/**
+ * Replaces the queue with a shared playlist, subscribing to it, plays
+ * the first song, and adds the songs added to it to the queue as they come
+ * @param ctx cancelled when the peer shuts down
+ * @param name the playlist's name
+ * @return the playlist
+ */
+func play_shared(ctx context.Context, name string) (*tsp.SharedPlaylist, error) {
+	playlist, err := subscribe_shared(name)
+	if err != nil {
+		return nil, err
+	}
+	songs := make([]tsp.SongEntry, 0, len(playlist.Entries))
+	for _, entry := range playlist.Entries {
+		songs = append(songs, resolve_entry(new_playlist_entry(entry.Song)))
+	}
+	shared_mutex.Lock()
+	shared_queue = name
+	shared_mutex.Unlock()
+	queue.Replace(songs)
+	if len(songs) > 0 {
+		play_next(ctx, 1)
+	}
+	return playlist, nil
+}
+
+/**
+ * @param entry a song in a shared playlist
+ * @return who added it: its nickname, or the host it was added from
+ */
+func added_by(entry tsp.SharedEntry) string {
+	if entry.AddedBy != "" {
+		return entry.AddedBy
+	}
+	return entry.Addr
+}
+
+/**
+ * Writes the shared playlists, one per line, marking those subscribed to
+ * @param w where the list is written
+ * @param playlists the playlists, numbered from 1
+ */
+func write_shared_list(w io.Writer, playlists []tsp.SharedPlaylist) {
+	if len(playlists) == 0 {
+		fmt.Fprintln(w, "No shared playlists.")
+	}
+	subscribed := make(map[string]bool)
+	for _, name := range subscribed_shared() {
+		subscribed[name] = true
+	}
+	shared_mutex.Lock()
+	playing := shared_queue
+	shared_mutex.Unlock()
+	for i, playlist := range playlists {
+		line := fmt.Sprintf("%3d. %s: %d songs", i+1, playlist.Name, playlist.Version)
+		if playlist.CreatedBy != "" {
+			line += ", made by " + playlist.CreatedBy
+		}
+		if playlist.Name == playing {
+			line += " [playing]"
+		} else if subscribed[playlist.Name] {
+			line += " [subscribed]"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * Writes a shared playlist, one song per line with who added it and when
+ * @param w where the playlist is written
+ * @param playlist the playlist, with its songs
+ */
+func write_shared(w io.Writer, playlist tsp.SharedPlaylist) {
+	fmt.Fprintln(w, playlist.Name+":")
+	if len(playlist.Entries) == 0 {
+		fmt.Fprintln(w, "  (empty)")
+	}
+	for i, entry := range playlist.Entries {
+		fmt.Fprintf(w, "%3d. %s, %s [id %d], added by %s %s\n", i+1, entry.Song.Title, entry.Song.Artist,
+			entry.Song.ID, added_by(entry), entry.Added.Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * shared [create <name>|add <name> <song id>|subscribe <name>|
+ * unsubscribe <name>|play <name>|stop|<name>]: lists the shared
+ * playlists, makes one, adds a song to one, subscribes to one or prints
+ * one. Playing one takes a daemon
+ * @param ctx cancelled when the peer shuts down
+ * @param cmd the command's arguments
+ * @param daemon whether it runs in the daemon, which can play
+ * @param w where the output goes
+ * @return the exit status
+ */
+func handle_shared(ctx context.Context, cmd []string, daemon bool, w io.Writer) int {
+	if len(cmd) == 0 {
+		playlists, err := fetch_shared_list()
+		if err != nil {
+			fmt.Fprintln(w, "can't list the shared playlists: ", err)
+			return 1
+		}
+		write_shared_list(w, playlists)
+		return 0
+	}
+	var playlist tsp.SharedPlaylist
+	var err error
+	switch {
+	case cmd[0] == "create" && len(cmd) >= 2:
+		name := strings.Join(cmd[1:], " ")
+		if _, err = shared_path(name); err == nil {
+			playlist, err = fetch_shared(tsp.SharedRequest{Op: tsp.SHARED_CREATE, Name: name})
+		}
+		if err == nil {
+			_, err = subscribe_shared(name)
+		}
+	case cmd[0] == "add" && len(cmd) >= 3:
+		id, err := strconv.Atoi(cmd[len(cmd)-1])
+		if err != nil {
+			fmt.Fprintln(w, "expected a song id, got ", cmd[len(cmd)-1])
+			return 2
+		}
+		name := strings.Join(cmd[1:len(cmd)-1], " ")
+		added, err := fetch_shared(tsp.SharedRequest{Op: tsp.SHARED_ADD, Name: name, Song: id})
+		if err != nil {
+			fmt.Fprintln(w, "can't add the song: ", err)
+			return 1
+		}
+		for _, entry := range added.Entries {
+			fmt.Fprintf(w, "Added %s, %s to %s, now %d songs\n", entry.Song.Title, entry.Song.Artist,
+				name, added.Version)
+		}
+		return 0
+	case cmd[0] == "subscribe" && len(cmd) >= 2:
+		var subscribed *tsp.SharedPlaylist
+		if subscribed, err = subscribe_shared(strings.Join(cmd[1:], " ")); err == nil {
+			playlist = *subscribed
+		}
+	case cmd[0] == "unsubscribe" && len(cmd) >= 2:
+		if err = unsubscribe_shared(strings.Join(cmd[1:], " ")); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		return 0
+	case cmd[0] == "play" && len(cmd) >= 2, cmd[0] == "stop" && len(cmd) == 1:
+		if !daemon {
+			fmt.Fprintln(w, "playing a shared playlist takes a daemon, start one with: ", os.Args[0], "serve <port> <filedir>")
+			return 1
+		}
+		if cmd[0] == "stop" {
+			shared_mutex.Lock()
+			shared_queue = ""
+			shared_mutex.Unlock()
+			fmt.Fprintln(w, "Not adding a shared playlist's songs to the queue any more.")
+			return 0
+		}
+		var playing *tsp.SharedPlaylist
+		if playing, err = play_shared(ctx, strings.Join(cmd[1:], " ")); err == nil {
+			playlist = *playing
+		}
+	default:
+		name := strings.Join(cmd, " ")
+		if _, err = load_shared(name); err == nil {
+			var subscribed *tsp.SharedPlaylist
+			if subscribed, _, err = sync_shared(name); err == nil {
+				playlist = *subscribed
+			}
+		} else {
+			playlist, err = fetch_shared(tsp.SharedRequest{Op: tsp.SHARED_GET, Name: name})
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	write_shared(w, playlist)
+	return 0
+}
+
+/**
+ * shared: see handle_shared
+ */
+func run_shared(args []string) int {
+	return handle_shared(context.Background(), args, false, os.Stdout)
+}
+
+/**
+ * SHARED from the interactive menu: lists the shared playlists, then
+ * shows, makes, adds a song to, subscribes to or plays one
+ * @param ctx cancelled when the peer shuts down
+ */
+func handle_shared_menu(ctx context.Context) {
+	ui := &input.UI{
+		Writer: os.Stdout,
+		Reader: os.Stdin,
+	}
+	playlists, err := fetch_shared_list()
+	if err != nil {
+		fmt.Println("can't list the shared playlists: ", err)
+		return
+	}
+	write_shared_list(os.Stdout, playlists)
+	actions := []string{"CREATE", "BACK"}
+	if len(playlists) > 0 {
+		actions = []string{"SHOW", "ADD", "PLAY", "SUBSCRIBE", "UNSUBSCRIBE", "CREATE", "BACK"}
+	}
+	action, _ := ui.Select("Shared playlists", actions, &input.Options{
+		Loop: true,
+	})
+	if action == "BACK" {
+		return
+	}
+	name := ""
+	if action == "CREATE" {
+		name = ask_playlist_name(ui)
+	} else {
+		names := make([]string, 0, len(playlists))
+		for _, playlist := range playlists {
+			names = append(names, playlist.Name)
+		}
+		sort.Strings(names)
+		name, _ = ui.Select("Playlist", names, &input.Options{
+			Loop: true,
+		})
+	}
+	var cmd []string
+	switch action {
+	case "ADD":
+		song := get_song_selection()
+		cmd = []string{"add", name, strconv.Itoa(song.ID)}
+	case "SHOW":
+		cmd = []string{name}
+	default:
+		cmd = []string{strings.ToLower(action), name}
+	}
+	handle_shared(ctx, cmd, true, os.Stdout)
+}
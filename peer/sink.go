@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Audio backends. The audio output plays through an AudioSink, opened by
+ * whichever backend the config file or -audio flag names, so playback
+ * isn't tied to one library. Each backend registers itself from its own
+ * file, and can be left out of a build with a build tag (see sink_oto.go)
+ */
+
+// the backends tried in turn when none is named, best first
+var preferred_backends = []string{"oto", "pulse", "alsa", "null"}
+
+/**
+ * Somewhere stereo 16 bit little-endian PCM is played. Write blocks
+ * roughly as long as the audio takes to play, like a sound card does
+ */
+type AudioSink interface {
+	Write(pcm []byte) (int, error)
+	Close() error
+}
+
+/**
+ * Opens a sink of one backend
+ * @param sample_rate the rate of the PCM that will be written to it
+ */
+type SinkOpener func(sample_rate int) (AudioSink, error)
+
+// the backends built in, by name
+var audio_backends = map[string]SinkOpener{}
+
+/**
+ * Makes a backend available. Called from the init of its file
+ * @param name what it is chosen by
+ * @param open opens one of its sinks
+ */
+func register_backend(name string, open SinkOpener) {
+	audio_backends[name] = open
+}
+
+/**
+ * @return the names of the backends built in, sorted
+ */
+func backend_names() []string {
+	names := make([]string, 0, len(audio_backends))
+	for name := range audio_backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+ * @param name a backend as named in the config file or -audio flag
+ * @return an error if it isn't built in
+ */
+func check_backend(name string) error {
+	if _, ok := audio_backends[name]; !ok && name != "" {
+		return fmt.Errorf("no audio backend %q, try %s", name, strings.Join(backend_names(), ", "))
+	}
+	return nil
+}
+
+/**
+ * Opens a sink of the chosen backend, or of the first preferred one built
+ * in that opens
+ * @param sample_rate the rate of the PCM that will be written to it
+ * @return the sink, or the error of the last backend tried
+ */
+func open_sink(sample_rate int) (AudioSink, error) {
+	if config.AudioBackend != "" {
+		if err := check_backend(config.AudioBackend); err != nil {
+			return nil, err
+		}
+		return audio_backends[config.AudioBackend](sample_rate)
+	}
+	err := fmt.Errorf("no audio backend built in")
+	for _, name := range preferred_backends {
+		open, ok := audio_backends[name]
+		if !ok {
+			continue
+		}
+		var sink AudioSink
+		if sink, err = open(sample_rate); err == nil {
+			return sink, nil
+		}
+	}
+	return nil, err
+}
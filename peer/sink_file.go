@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Backends that play to nowhere: null discards the audio, at the pace it
+ * would have played, e.g. for tests or a headless peer; wav records it to
+ * wav_path in the config file (~/.torero/output.wav by default) as fast
+ * as it is decoded, starting the file over each time the output opens
+ */
+
+// the header of a WAV file of 16 bit PCM, before its data
+const WAV_HEADER = 44
+
+func init() {
+	register_backend("null", func(sample_rate int) (AudioSink, error) {
+		return &NullSink{byte_rate: sample_rate * 4, start: time.Now()}, nil
+	})
+	register_backend("wav", open_wav_sink)
+}
+
+/**
+ * Discards the audio, blocking as long as it would take to play
+ */
+type NullSink struct {
+	byte_rate int
+	// when it opened, and how much audio has been written since
+	start   time.Time
+	written int64
+}
+
+func (s *NullSink) Write(pcm []byte) (int, error) {
+	s.written += int64(len(pcm))
+	due := s.start.Add(time.Duration(s.written) * time.Second / time.Duration(s.byte_rate))
+	time.Sleep(time.Until(due))
+	return len(pcm), nil
+}
+
+func (s *NullSink) Close() error {
+	return nil
+}
+
+/**
+ * Records the audio to a WAV file
+ */
+type WavSink struct {
+	file        *os.File
+	sample_rate int
+	written     int64
+}
+
+/**
+ * Creates the WAV file, with a header to fill in once its length is known
+ * @param sample_rate the rate of the PCM that will be written to it
+ * @return the sink, or an error if the file can't be created
+ */
+func open_wav_sink(sample_rate int) (AudioSink, error) {
+	path := config.WavPath
+	if path == "" {
+		path = filepath.Join(torero_dir(), "output.wav")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &WavSink{file: file, sample_rate: sample_rate}
+	if _, err = file.Write(s.header()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+/**
+ * @return the WAV header for the audio written so far
+ */
+func (s *WavSink) header() []byte {
+	h := make([]byte, WAV_HEADER)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(WAV_HEADER-8+s.written))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 2) // channels
+	binary.LittleEndian.PutUint32(h[24:], uint32(s.sample_rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(s.sample_rate*4))
+	binary.LittleEndian.PutUint16(h[32:], 4)  // bytes per frame
+	binary.LittleEndian.PutUint16(h[34:], 16) // bits per sample
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(s.written))
+	return h
+}
+
+func (s *WavSink) Write(pcm []byte) (int, error) {
+	n, err := s.file.Write(pcm)
+	s.written += int64(n)
+	return n, err
+}
+
+/**
+ * Fills in the header and closes the file
+ */
+func (s *WavSink) Close() error {
+	if _, err := s.file.WriteAt(s.header(), 0); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
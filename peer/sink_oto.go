@@ -0,0 +1,18 @@
+//go:build !nooto
+
+package main
+
+import (
+	"github.com/hajimehoshi/oto"
+)
+
+/*
+ * The oto backend, the default: plays through the system's audio API.
+ * Build with -tags nooto to leave it out, e.g. to build without cgo
+ */
+
+func init() {
+	register_backend("oto", func(sample_rate int) (AudioSink, error) {
+		return oto.NewPlayer(sample_rate, 2, 2, PCM_CHUNK)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"strconv"
+)
+
+/*
+ * Backends that pipe PCM to a command line player: pacat for PulseAudio
+ * and PipeWire, aplay for ALSA. They play through the device chosen with
+ * OUTPUT too, since the player inherits the environment it is chosen by
+ */
+
+func init() {
+	register_backend("pulse", func(sample_rate int) (AudioSink, error) {
+		return open_pipe_sink("pacat", "--playback", "--raw", "--format=s16le", "--channels=2",
+			"--rate="+strconv.Itoa(sample_rate))
+	})
+	register_backend("alsa", func(sample_rate int) (AudioSink, error) {
+		return open_pipe_sink("aplay", "-q", "-t", "raw", "-f", "S16_LE", "-c", "2",
+			"-r", strconv.Itoa(sample_rate))
+	})
+}
+
+/**
+ * A player command, fed PCM on its standard input
+ */
+type PipeSink struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+/**
+ * Starts a player command
+ * @param name the command
+ * @param args its arguments, which set it to read raw PCM from stdin
+ * @return the sink, or an error if the command can't be started
+ */
+func open_pipe_sink(name string, args ...string) (AudioSink, error) {
+	cmd := exec.Command(name, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &PipeSink{cmd: cmd, stdin: stdin}, nil
+}
+
+func (s *PipeSink) Write(pcm []byte) (int, error) {
+	return s.stdin.Write(pcm)
+}
+
+/**
+ * Closes the player's input, letting it play what it has, and waits for
+ * it to exit
+ */
+func (s *PipeSink) Close() error {
+	s.stdin.Close()
+	return s.cmd.Wait()
+}
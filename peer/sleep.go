@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The sleep timer. SLEEP <minutes> stops playback once the time is up:
+ * over the last SLEEP_FADE the volume fades down to nothing, then the
+ * song stops and its connection to the serving peer, and any prefetch,
+ * are closed. The volume the user set is left as it was for next time.
+ * SLEEP 0 or SLEEP off cancels the timer
+ */
+
+const (
+	// longest sleep timer, in minutes
+	MAX_SLEEP = 24 * 60
+	// how long the volume takes to fade out before playback stops
+	SLEEP_FADE = 30 * time.Second
+	// how often the fade steps down
+	SLEEP_FADE_STEP = 250 * time.Millisecond
+	// sleep_fade with no fade applied
+	FADE_UNITY = 1000
+)
+
+var (
+	sleep_mutex sync.Mutex
+	// fires when the fade starts, nil with no timer set
+	sleep_timer *time.Timer
+	// when playback will stop
+	sleep_at time.Time
+	// closed to stop a fade in progress
+	sleep_cancel chan struct{}
+	// the volume is scaled by sleep_fade / FADE_UNITY while fading out
+	sleep_fade int32 = FADE_UNITY
+)
+
+/**
+ * @return the volume to play at: the user's, faded out by the sleep
+ * timer
+ */
+func playback_volume() int {
+	return get_volume() * int(atomic.LoadInt32(&sleep_fade)) / FADE_UNITY
+}
+
+/**
+ * Sets the sleep timer, replacing any set before
+ * @param minutes how long until playback stops, 0 to cancel the timer
+ */
+func set_sleep(minutes int) {
+	sleep_mutex.Lock()
+	defer sleep_mutex.Unlock()
+	cancel_sleep()
+	if minutes <= 0 {
+		return
+	}
+	wait := time.Duration(minutes) * time.Minute
+	sleep_at = time.Now().Add(wait)
+	cancel := make(chan struct{})
+	sleep_cancel = cancel
+	fade_in := wait - SLEEP_FADE
+	if fade_in < 0 {
+		fade_in = 0
+	}
+	sleep_timer = time.AfterFunc(fade_in, func() {
+		fade_to_sleep(cancel, wait-fade_in)
+	})
+}
+
+/**
+ * Stops the timer and any fade in progress, and restores the volume. The
+ * caller must hold sleep_mutex
+ */
+func cancel_sleep() {
+	if sleep_timer != nil {
+		sleep_timer.Stop()
+		sleep_timer = nil
+	}
+	if sleep_cancel != nil {
+		close(sleep_cancel)
+		sleep_cancel = nil
+	}
+	atomic.StoreInt32(&sleep_fade, FADE_UNITY)
+}
+
+/**
+ * Fades the volume out, then stops playback, unless the timer is
+ * cancelled first
+ * @param cancel closed if the timer is cancelled or replaced
+ * @param fade how long to fade out over
+ */
+func fade_to_sleep(cancel chan struct{}, fade time.Duration) {
+	ticker := time.NewTicker(SLEEP_FADE_STEP)
+	defer ticker.Stop()
+	start := time.Now()
+	for time.Since(start) < fade {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+		left := fade - time.Since(start)
+		if left < 0 {
+			left = 0
+		}
+		atomic.StoreInt32(&sleep_fade, int32(int64(FADE_UNITY)*int64(left)/int64(fade)))
+	}
+
+	sleep_mutex.Lock()
+	if sleep_cancel != cancel {
+		sleep_mutex.Unlock()
+		return
+	}
+	sleep_timer = nil
+	sleep_cancel = nil
+	sleep_mutex.Unlock()
+	slog.Info("sleep timer up, stopping playback")
+	playback.End()
+	discard_prefetch()
+	atomic.StoreInt32(&sleep_fade, FADE_UNITY)
+}
+
+/**
+ * @return how long until the sleep timer stops playback, and false if
+ * none is set
+ */
+func sleep_left() (time.Duration, bool) {
+	sleep_mutex.Lock()
+	defer sleep_mutex.Unlock()
+	if sleep_cancel == nil {
+		return 0, false
+	}
+	return time.Until(sleep_at), true
+}
+
+/**
+ * Parses a SLEEP argument
+ * @param arg minutes, or "off"
+ * @return the minutes, 0 for off, or an error if arg is neither
+ */
+func parse_sleep(arg string) (int, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "off" {
+		return 0, nil
+	}
+	minutes, err := strconv.Atoi(arg)
+	if err != nil || minutes < 0 || minutes > MAX_SLEEP {
+		return 0, fmt.Errorf("sleep takes 0-%d minutes, or off", MAX_SLEEP)
+	}
+	return minutes, nil
+}
+
+/**
+ * @return the state of the sleep timer, as shown to the user
+ */
+func format_sleep() string {
+	left, ok := sleep_left()
+	if !ok {
+		return "Sleep timer off."
+	}
+	return "Stopping in " + format_duration(left.Round(time.Second)) + "."
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Smart playlists. A playlist with a Rule has its songs picked by the rule
+ * from the library: the songs this peer serves and every song in its play
+ * history. The songs are picked again whenever the playlist is shown or
+ * played. A rule is
+ *
+ *	[top <n> <most played|least played|recently played|random>] [where] [condition]
+ *
+ * where a condition compares a song's title, artist, album or genre
+ * (contains, is, isn't), its plays, year or rating (=, !=, <, >, <=, >=),
+ * or is "played in <n> days" or "favorite", and conditions combine with
+ * AND, OR, NOT and parentheses. Words are matched without regard to case,
+ * and a value runs to the next AND, OR or closing parenthesis unless it is
+ * quoted:
+ *
+ *	artist contains pink floyd AND not played in 30 days
+ *	top 25 most played
+ *	top 10 random where genre is "rock" and year < 1980
+ */
+
+// How the songs matching a rule are ordered before the top n are kept
+const (
+	ORDER_MOST_PLAYED     = "most played"
+	ORDER_LEAST_PLAYED    = "least played"
+	ORDER_RECENTLY_PLAYED = "recently played"
+	ORDER_RANDOM          = "random"
+)
+
+var smart_orders = []string{ORDER_MOST_PLAYED, ORDER_LEAST_PLAYED, ORDER_RECENTLY_PLAYED, ORDER_RANDOM}
+
+/**
+ * A song a rule is checked against, with what the history says of it
+ */
+type SmartSong struct {
+	Song       tsp.SongEntry
+	Year       string
+	Plays      int
+	LastPlayed time.Time
+	Rating     Rating
+}
+
+// a condition of a rule
+type Condition func(song *SmartSong) bool
+
+/**
+ * A parsed rule
+ */
+type Rule struct {
+	// nil if every song matches
+	Match Condition
+	// songs kept, 0 for every one
+	Top   int
+	Order string
+}
+
+/**
+ * Splits a rule into words, quoted strings and parentheses
+ * @param text the rule
+ * @return its tokens, quoted strings without the quotes but marked with a
+ * leading quote so they are never taken for keywords
+ */
+func rule_tokens(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in rule")
+			}
+			tokens = append(tokens, text[i:i+1+end])
+			i += end + 2
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t()\"", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+/**
+ * Reads a rule's tokens
+ */
+type RuleParser struct {
+	tokens []string
+	pos    int
+}
+
+/**
+ * @return the next token, lower-cased unless quoted, or "" at the end
+ */
+func (p *RuleParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	if strings.HasPrefix(p.tokens[p.pos], "\"") {
+		return p.tokens[p.pos]
+	}
+	return strings.ToLower(p.tokens[p.pos])
+}
+
+/**
+ * @return the next token, as peek, moving past it
+ */
+func (p *RuleParser) next() string {
+	token := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return token
+}
+
+/**
+ * Moves past the next tokens if they are the given words
+ * @return whether they were
+ */
+func (p *RuleParser) accept(words ...string) bool {
+	for i, word := range words {
+		if p.pos+i >= len(p.tokens) || !strings.EqualFold(p.tokens[p.pos+i], word) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+/**
+ * @return the next token as a number, or an error naming what it is for
+ */
+func (p *RuleParser) number(what string) (int, error) {
+	token := p.next()
+	n, err := strconv.Atoi(token)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected %s, got %q", what, token)
+	}
+	return n, nil
+}
+
+/**
+ * Parses a rule
+ * @param text the rule, as described at the top of this file
+ * @return the rule, or an error saying what is wrong with it
+ */
+func parse_rule(text string) (*Rule, error) {
+	tokens, err := rule_tokens(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &RuleParser{tokens: tokens}
+	rule := &Rule{}
+	if p.accept("top") {
+		if rule.Top, err = p.number("how many songs to keep"); err != nil {
+			return nil, err
+		}
+		for _, order := range smart_orders {
+			if p.accept(strings.Fields(order)...) {
+				rule.Order = order
+			}
+		}
+		if rule.Order == "" {
+			return nil, fmt.Errorf("expected one of %s after top %d", strings.Join(smart_orders, ", "), rule.Top)
+		}
+	}
+	p.accept("where")
+	if p.peek() != "" {
+		if rule.Match, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if token := p.peek(); token != "" {
+		return nil, fmt.Errorf("unexpected %q in rule", token)
+	}
+	if rule.Match == nil && rule.Top == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return rule, nil
+}
+
+func (p *RuleParser) or() (Condition, error) {
+	left, err := p.and()
+	for err == nil && p.accept("or") {
+		var right Condition
+		if right, err = p.and(); err == nil {
+			l, r := left, right
+			left = func(song *SmartSong) bool { return l(song) || r(song) }
+		}
+	}
+	return left, err
+}
+
+func (p *RuleParser) and() (Condition, error) {
+	left, err := p.not()
+	for err == nil && p.accept("and") {
+		var right Condition
+		if right, err = p.not(); err == nil {
+			l, r := left, right
+			left = func(song *SmartSong) bool { return l(song) && r(song) }
+		}
+	}
+	return left, err
+}
+
+func (p *RuleParser) not() (Condition, error) {
+	if p.accept("not") {
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(song *SmartSong) bool { return !inner(song) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ) in rule")
+		}
+		return inner, nil
+	}
+	return p.condition()
+}
+
+/**
+ * Parses a single condition
+ */
+func (p *RuleParser) condition() (Condition, error) {
+	if p.accept("favorite") {
+		return func(song *SmartSong) bool { return song.Rating.Favorite }, nil
+	}
+	if p.accept("played", "in") {
+		days, err := p.number("a number of days")
+		if err != nil {
+			return nil, err
+		}
+		p.accept("days")
+		since := time.Now().AddDate(0, 0, -days)
+		return func(song *SmartSong) bool { return song.LastPlayed.After(since) }, nil
+	}
+
+	field := p.next()
+	switch field {
+	case "title", "artist", "album", "genre":
+		op := p.next()
+		if op == "is" && p.accept("not") {
+			op = "isn't"
+		}
+		value := strings.ToLower(p.value())
+		if value == "" {
+			return nil, fmt.Errorf("expected a value after %s %s", field, op)
+		}
+		text := func(song *SmartSong) string {
+			switch field {
+			case "title":
+				return strings.ToLower(song.Song.Title)
+			case "artist":
+				return strings.ToLower(song.Song.Artist)
+			case "album":
+				return strings.ToLower(song.Song.Album)
+			}
+			return strings.ToLower(song.Song.Genre)
+		}
+		switch op {
+		case "contains":
+			return func(song *SmartSong) bool { return strings.Contains(text(song), value) }, nil
+		case "is", "=":
+			return func(song *SmartSong) bool { return text(song) == value }, nil
+		case "isn't", "!=":
+			return func(song *SmartSong) bool { return text(song) != value }, nil
+		}
+		return nil, fmt.Errorf("expected contains, is or isn't after %s, got %q", field, op)
+	case "plays", "year", "rating":
+		op := p.next()
+		n, err := p.number("a number after " + field + " " + op)
+		if err != nil {
+			return nil, err
+		}
+		number := func(song *SmartSong) int {
+			switch field {
+			case "plays":
+				return song.Plays
+			case "rating":
+				return song.Rating.Stars
+			}
+			year, _ := strconv.Atoi(song.Year)
+			return year
+		}
+		switch op {
+		case "=":
+			return func(song *SmartSong) bool { return number(song) == n }, nil
+		case "!=":
+			return func(song *SmartSong) bool { return number(song) != n }, nil
+		case "<":
+			return func(song *SmartSong) bool { return number(song) < n }, nil
+		case ">":
+			return func(song *SmartSong) bool { return number(song) > n }, nil
+		case "<=":
+			return func(song *SmartSong) bool { return number(song) <= n }, nil
+		case ">=":
+			return func(song *SmartSong) bool { return number(song) >= n }, nil
+		}
+		return nil, fmt.Errorf("expected =, !=, <, >, <= or >= after %s, got %q", field, op)
+	}
+	return nil, fmt.Errorf("expected title, artist, album, genre, plays, year, rating, favorite or played in, got %q", field)
+}
+
+/**
+ * @return the value of a condition: a quoted string, or the words up to
+ * the next AND, OR or closing parenthesis
+ */
+func (p *RuleParser) value() string {
+	if token := p.peek(); strings.HasPrefix(token, "\"") {
+		p.pos++
+		return token[1:]
+	}
+	var words []string
+	for p.pos < len(p.tokens) {
+		token := p.peek()
+		if token == "and" || token == "or" || token == ")" || token == "(" {
+			break
+		}
+		words = append(words, p.tokens[p.pos])
+		p.pos++
+	}
+	return strings.Join(words, " ")
+}
+
+/**
+ * @return every song a rule can pick from: the ones in the library, and
+ * the ones in the play history, with their plays
+ */
+func smart_candidates() ([]*SmartSong, error) {
+	if library == nil {
+		return nil, fmt.Errorf("smart playlists need the library")
+	}
+	var songs []*SmartSong
+	by_id := make(map[int]*SmartSong)
+	rows, err := library.Query(`SELECT filename, title, artist, album, genre, year, duration, size, hash, format FROM songs`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		info := &SongInfo{}
+		var duration int64
+		if err = rows.Scan(&info.Filename, &info.Title, &info.Artist, &info.Album, &info.Genre, &info.Year,
+			&duration, &info.Size, &info.Hash, &info.Format); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.Duration = time.Duration(duration)
+		song := new_song_entry(info)
+		song.ID = tsp.SongID(song, song.Sources[0])
+		if by_id[song.ID] == nil {
+			by_id[song.ID] = &SmartSong{Song: song, Year: info.Year}
+			songs = append(songs, by_id[song.ID])
+		}
+	}
+	rows.Close()
+
+	rows, err = library.Query(`SELECT song_id, MAX(title), MAX(artist), MAX(album), MAX(duration), COUNT(*), MAX(played_at)
+		FROM history GROUP BY song_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var song tsp.SongEntry
+		var duration, last int64
+		var plays int
+		if err = rows.Scan(&song.ID, &song.Title, &song.Artist, &song.Album, &duration, &plays, &last); err != nil {
+			return nil, err
+		}
+		song.Duration = time.Duration(duration)
+		smart, ok := by_id[song.ID]
+		if !ok {
+			smart = &SmartSong{Song: song}
+			by_id[song.ID] = smart
+			songs = append(songs, smart)
+		}
+		smart.Plays = plays
+		smart.LastPlayed = time.Unix(last, 0)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for id, rating := range song_ratings() {
+		if smart, ok := by_id[id]; ok {
+			smart.Rating = rating
+		}
+	}
+	return songs, nil
+}
+
+/**
+ * Picks the songs matching a rule
+ * @param rule the parsed rule
+ * @return the songs, in the rule's order, or by artist and title if it
+ * has none
+ */
+func apply_rule(rule *Rule) ([]tsp.SongEntry, error) {
+	candidates, err := smart_candidates()
+	if err != nil {
+		return nil, err
+	}
+	var matched []*SmartSong
+	for _, song := range candidates {
+		if rule.Match == nil || rule.Match(song) {
+			matched = append(matched, song)
+		}
+	}
+	switch rule.Order {
+	case ORDER_MOST_PLAYED:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Plays > matched[j].Plays })
+	case ORDER_LEAST_PLAYED:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Plays < matched[j].Plays })
+	case ORDER_RECENTLY_PLAYED:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].LastPlayed.After(matched[j].LastPlayed) })
+	case ORDER_RANDOM:
+		rand.Shuffle(len(matched), func(i, j int) { matched[i], matched[j] = matched[j], matched[i] })
+	default:
+		sort.SliceStable(matched, func(i, j int) bool {
+			if matched[i].Song.Artist != matched[j].Song.Artist {
+				return matched[i].Song.Artist < matched[j].Song.Artist
+			}
+			return matched[i].Song.Title < matched[j].Song.Title
+		})
+	}
+	if rule.Top > 0 && len(matched) > rule.Top {
+		matched = matched[:rule.Top]
+	}
+	songs := make([]tsp.SongEntry, 0, len(matched))
+	for _, song := range matched {
+		songs = append(songs, song.Song)
+	}
+	return songs, nil
+}
+
+/**
+ * Picks a smart playlist's songs again by its rule, and saves it. Does
+ * nothing to other playlists
+ * @return an error if the rule is bad or the library can't be read
+ */
+func (list *Playlist) refresh() error {
+	if list.Rule == "" {
+		return nil
+	}
+	rule, err := parse_rule(list.Rule)
+	if err != nil {
+		return err
+	}
+	songs, err := apply_rule(rule)
+	if err != nil {
+		return err
+	}
+	list.Songs = make([]PlaylistEntry, 0, len(songs))
+	for _, song := range songs {
+		list.Songs = append(list.Songs, new_playlist_entry(song))
+	}
+	return list.save()
+}
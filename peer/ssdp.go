@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+/*
+ * SSDP, how UPnP devices find each other: the media server (see dlna.go)
+ * announces itself to the LAN's multicast group when it starts, again
+ * every SSDP_NOTIFY_INTERVAL and leaving when it stops, and answers the
+ * M-SEARCHes TVs and apps send looking for one
+ */
+
+const (
+	SSDP_ADDR = "239.255.255.250:1900"
+	// how long others may remember the announcement, and how often it is
+	// made again, well within that
+	SSDP_MAX_AGE         = 1800
+	SSDP_NOTIFY_INTERVAL = 10 * time.Minute
+	// the longest an M-SEARCH answer is held back, whatever MX asks for
+	SSDP_MAX_DELAY = 3
+)
+
+// what the media server announces itself as, besides its UUID
+var ssdp_types = []string{
+	"upnp:rootdevice",
+	DLNA_DEVICE_TYPE,
+	DLNA_CONTENT_DIRECTORY,
+	DLNA_CONNECTION_MANAGER,
+}
+
+/**
+ * Announces the media server on the LAN and answers searches for it until
+ * ctx is cancelled, then says it is leaving
+ * @param ctx cancelled when the peer shuts down
+ * @param port the port the HTTP gateway serves the media server on
+ */
+func advertise_dlna(ctx context.Context, port string) {
+	group, err := net.ResolveUDPAddr("udp4", SSDP_ADDR)
+	if err != nil {
+		slog.Error("can't advertise the media server", "err", err)
+		return
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		slog.Error("can't advertise the media server", "err", err)
+		return
+	}
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		listener.Close()
+		slog.Error("can't advertise the media server", "err", err)
+		return
+	}
+	defer sender.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(SSDP_NOTIFY_INTERVAL)
+		defer ticker.Stop()
+		for {
+			ssdp_notify(sender, group, port, "ssdp:alive")
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	slog.Info("advertising the media server", "location", dlna_location(GetLocalIP(), port))
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		go ssdp_answer(sender, from, req, port)
+	}
+	ssdp_notify(sender, group, port, "ssdp:byebye")
+}
+
+/**
+ * @param ip an address of this host the searcher can reach
+ * @param port the HTTP gateway's port
+ * @return the URL of the media server's device description
+ */
+func dlna_location(ip string, port string) string {
+	return "http://" + net.JoinHostPort(ip, port) + "/dlna/device.xml"
+}
+
+/**
+ * @param search_type an ST or NT: a device or service type, the root
+ * device, or the media server's UUID
+ * @return the USN the media server answers or announces it with
+ */
+func ssdp_usn(search_type string) string {
+	udn := "uuid:" + dlna_uuid()
+	if search_type == udn {
+		return udn
+	}
+	return udn + "::" + search_type
+}
+
+/**
+ * @return what the media server says it runs on
+ */
+func ssdp_server() string {
+	return runtime.GOOS + "/1.0 UPnP/1.0 Torero/1.0"
+}
+
+/**
+ * Announces the media server, or says it is leaving, once for each type
+ * it is found by
+ * @param sender the socket sent from
+ * @param group the SSDP multicast group
+ * @param port the HTTP gateway's port
+ * @param nts ssdp:alive or ssdp:byebye
+ */
+func ssdp_notify(sender *net.UDPConn, group *net.UDPAddr, port string, nts string) {
+	location := dlna_location(GetLocalIP(), port)
+	for _, nt := range append([]string{"uuid:" + dlna_uuid()}, ssdp_types...) {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + SSDP_ADDR + "\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", SSDP_MAX_AGE) +
+			"LOCATION: " + location + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"SERVER: " + ssdp_server() + "\r\n" +
+			"USN: " + ssdp_usn(nt) + "\r\n\r\n"
+		if _, err := sender.WriteToUDP([]byte(msg), group); err != nil {
+			slog.Debug("can't announce the media server", "err", err)
+			return
+		}
+	}
+}
+
+/**
+ * Answers an M-SEARCH for anything the media server is, after the random
+ * delay up to MX seconds searchers expect
+ * @param sender the socket answered from
+ * @param from the searcher
+ * @param req the M-SEARCH
+ * @param port the HTTP gateway's port
+ */
+func ssdp_answer(sender *net.UDPConn, from *net.UDPAddr, req *http.Request, port string) {
+	st := req.Header.Get("ST")
+	var matches []string
+	for _, t := range append([]string{"uuid:" + dlna_uuid()}, ssdp_types...) {
+		if st == "ssdp:all" || st == t {
+			matches = append(matches, t)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	mx, err := strconv.Atoi(req.Header.Get("MX"))
+	if err != nil || mx < 1 {
+		mx = 1
+	}
+	if mx > SSDP_MAX_DELAY {
+		mx = SSDP_MAX_DELAY
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(mx) * int64(time.Second))))
+
+	location := dlna_location(local_ip_for(from), port)
+	for _, t := range matches {
+		msg := "HTTP/1.1 200 OK\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", SSDP_MAX_AGE) +
+			"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"SERVER: " + ssdp_server() + "\r\n" +
+			"ST: " + t + "\r\n" +
+			"USN: " + ssdp_usn(t) + "\r\n\r\n"
+		if _, err := sender.WriteToUDP([]byte(msg), from); err != nil {
+			slog.Debug("can't answer a search for the media server", "err", err)
+			return
+		}
+	}
+}
+
+/**
+ * @param remote a host on the LAN
+ * @return the address of this host on the interface facing it
+ */
+func local_ip_for(remote *net.UDPAddr) string {
+	conn, err := net.DialUDP("udp4", nil, remote)
+	if err != nil {
+		return GetLocalIP()
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
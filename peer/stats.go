@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Transfer statistics. Every song sent to or fetched from another peer is
+ * recorded in the library once the transfer ends: the song, the peer, how
+ * many bytes and how long it took. A transfer starting at the song's first
+ * byte counts as a transfer of the song; ones resuming, seeking or
+ * fetching a swarm piece further in only add their bytes. The totals
+ * across runs, and the rates song data is moving at now, sampled over
+ * RATE_WINDOW, are exported on /metrics as well. `stats` prints the
+ * totals and the songs and peers transferred most, `stats peer <peer>` the
+ * latest transfers with one peer. Live radio only counts toward the rates
+ */
+
+const (
+	// how often the rates are sampled, and over how many samples
+	RATE_SAMPLE = time.Second
+	RATE_WINDOW = 10
+	// songs and peers stats lists, unless told otherwise
+	DEFAULT_STATS = 5
+)
+
+/**
+ * One song sent to or fetched from another peer
+ */
+type Transfer struct {
+	Upload bool
+	// the song as the master list or the catalog had it
+	Song tsp.SongEntry
+	Hash string
+	// the serving address of the peer fetched from, or the IP address of
+	// the one that fetched from here
+	Peer string
+	// its identity key in hex, empty if unknown
+	Key       string
+	Bytes     int64
+	Started   time.Time
+	Took      time.Duration
+	FromStart bool
+}
+
+/**
+ * Bytes and songs transferred. Every field is updated atomically
+ */
+type TransferTotals struct {
+	Uploaded   int64
+	Downloaded int64
+	Uploads    int64
+	Downloads  int64
+}
+
+/**
+ * A song and how often it was transferred
+ */
+type SongTransfers struct {
+	Song      tsp.SongEntry
+	Uploads   int
+	Downloads int
+	Bytes     int64
+}
+
+/**
+ * A peer and what was transferred with it
+ */
+type PeerTransfers struct {
+	Peer       string
+	Key        string
+	Uploaded   int64
+	Downloaded int64
+	Transfers  int
+	Last       time.Time
+}
+
+var (
+	// the totals across runs, read from the library when the peer starts
+	// and added to as transfers end
+	lifetime TransferTotals
+	// bytes a second of song data going out and coming in, over the last
+	// RATE_WINDOW samples; updated atomically
+	upload_rate   int64
+	download_rate int64
+)
+
+/**
+ * Counts a transfer that has ended and saves it to the library. Without a
+ * library it only counts toward the totals of this run
+ * @param transfer the transfer, with its bytes and how long it took
+ */
+func record_transfer(transfer Transfer) {
+	if transfer.Bytes == 0 {
+		return
+	}
+	if transfer.Upload {
+		atomic.AddInt64(&lifetime.Uploaded, transfer.Bytes)
+	} else {
+		atomic.AddInt64(&lifetime.Downloaded, transfer.Bytes)
+	}
+	if transfer.FromStart && transfer.Upload {
+		atomic.AddInt64(&lifetime.Uploads, 1)
+	} else if transfer.FromStart {
+		atomic.AddInt64(&lifetime.Downloads, 1)
+	}
+	if library == nil {
+		return
+	}
+	song := transfer.Song
+	_, err := library.Exec(`INSERT INTO transfers
+		(started_at, upload, title, artist, hash, peer, key, bytes, took, from_start)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		transfer.Started.Unix(), transfer.Upload, song.Title, song.Artist, transfer.Hash, transfer.Peer,
+		transfer.Key, transfer.Bytes, int64(transfer.Took), transfer.FromStart)
+	if err != nil {
+		slog.Error("can't save a transfer to the stats", "song", song.Title, "err", err)
+	}
+}
+
+/**
+ * Records a song sent to a peer
+ * @param in_msg the PLAY or SEEK it was sent for
+ * @param song_file the file it was sent from
+ * @param client the requesting peer
+ * @param sent how many bytes were sent
+ * @param start when the transfer started
+ */
+func record_upload(in_msg *tsp.Msg, song_file string, client io.Writer, sent int64, start time.Time) {
+	song := served_song(in_msg.Header.Song_id)
+	if song.Title == "" {
+		// seeded, not in the catalog
+		song.Title = filepath.Base(song_file)
+	}
+	transfer := Transfer{Upload: true, Song: song, Peer: client_host(client), Bytes: sent, Started: start,
+		Took: time.Since(start), FromStart: in_msg.Header.Offset == 0}
+	if len(song.Sources) > 0 {
+		transfer.Hash = song.Sources[0].Hash
+	}
+	if key := requester_key(in_msg); key != nil {
+		transfer.Key = format_key(key)
+	}
+	record_transfer(transfer)
+}
+
+/**
+ * @param msg a PLAY or SEEK for a song, carrying its master list ID
+ * @param source the peer it is fetched from
+ * @return the transfer to record once the song data has been read
+ */
+func download_transfer(msg tsp.Msg, source tsp.SongSource) Transfer {
+	song, _ := find_song(msg.Header.Song_id)
+	transfer := Transfer{Song: song, Hash: source.Hash, Peer: source.PeerAddr, Started: time.Now(),
+		FromStart: msg.Header.Offset == 0}
+	if len(source.Key) > 0 {
+		transfer.Key = format_key(source.Key)
+	}
+	return transfer
+}
+
+/**
+ * Reads the totals across runs from the library, so /metrics carries on
+ * from them
+ * @return an error if they can't be read
+ */
+func load_stats() error {
+	if library == nil {
+		return nil
+	}
+	totals, _, err := transfer_totals()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&lifetime.Uploaded, totals.Uploaded)
+	atomic.AddInt64(&lifetime.Downloaded, totals.Downloaded)
+	atomic.AddInt64(&lifetime.Uploads, totals.Uploads)
+	atomic.AddInt64(&lifetime.Downloads, totals.Downloads)
+	return nil
+}
+
+/**
+ * @return what the library has recorded, and when the first transfer
+ * was, zero if there was none
+ */
+func transfer_totals() (TransferTotals, time.Time, error) {
+	var totals TransferTotals
+	var first int64
+	err := library.QueryRow(`SELECT
+		COALESCE(SUM(CASE WHEN upload THEN bytes ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN upload THEN 0 ELSE bytes END), 0),
+		COALESCE(SUM(upload AND from_start), 0),
+		COALESCE(SUM(NOT upload AND from_start), 0),
+		COALESCE(MIN(started_at), 0)
+		FROM transfers`).Scan(&totals.Uploaded, &totals.Downloaded, &totals.Uploads, &totals.Downloads, &first)
+	if err != nil || first == 0 {
+		return totals, time.Time{}, err
+	}
+	return totals, time.Unix(first, 0), nil
+}
+
+/**
+ * @param n how many songs to return
+ * @return the n songs transferred most, then by the most bytes
+ */
+func most_transferred(n int) ([]SongTransfers, error) {
+	rows, err := library.Query(`SELECT title, artist,
+		SUM(upload AND from_start) AS uploads, SUM(NOT upload AND from_start) AS downloads, SUM(bytes) AS total
+		FROM transfers GROUP BY hash, title, artist ORDER BY uploads + downloads DESC, total DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []SongTransfers
+	for rows.Next() {
+		var count SongTransfers
+		if err = rows.Scan(&count.Song.Title, &count.Song.Artist, &count.Uploads, &count.Downloads,
+			&count.Bytes); err != nil {
+			return nil, err
+		}
+		list = append(list, count)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * Peers are told apart by identity key, or by address if they have none
+ * @param n how many peers to return
+ * @return the n peers the most bytes were transferred with
+ */
+func top_peers(n int) ([]PeerTransfers, error) {
+	rows, err := library.Query(`SELECT MAX(peer), key,
+		SUM(CASE WHEN upload THEN bytes ELSE 0 END), SUM(CASE WHEN upload THEN 0 ELSE bytes END),
+		COUNT(*), MAX(started_at)
+		FROM transfers GROUP BY CASE WHEN key != '' THEN key ELSE peer END, key
+		ORDER BY SUM(bytes) DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []PeerTransfers
+	for rows.Next() {
+		var peer PeerTransfers
+		var last int64
+		if err = rows.Scan(&peer.Peer, &peer.Key, &peer.Uploaded, &peer.Downloaded, &peer.Transfers,
+			&last); err != nil {
+			return nil, err
+		}
+		peer.Last = time.Unix(last, 0)
+		list = append(list, peer)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * @param who a peer's address, IP address or the first digits of its
+ * identity key
+ * @param n how many transfers to return
+ * @return the latest n transfers with the peer, newest first
+ */
+func peer_history(who string, n int) ([]Transfer, error) {
+	rows, err := library.Query(`SELECT started_at, upload, title, artist, hash, peer, key, bytes, took, from_start
+		FROM transfers WHERE (key != '' AND key LIKE ?) OR peer = ? OR peer LIKE ?
+		ORDER BY started_at DESC, rowid DESC LIMIT ?`, who+"%", who, who+":%", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Transfer
+	for rows.Next() {
+		var transfer Transfer
+		var started, took int64
+		if err = rows.Scan(&started, &transfer.Upload, &transfer.Song.Title, &transfer.Song.Artist,
+			&transfer.Hash, &transfer.Peer, &transfer.Key, &transfer.Bytes, &took, &transfer.FromStart); err != nil {
+			return nil, err
+		}
+		transfer.Started = time.Unix(started, 0)
+		transfer.Took = time.Duration(took)
+		list = append(list, transfer)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * Samples the bytes served and received every RATE_SAMPLE, keeping the
+ * rates over the last RATE_WINDOW samples, until the peer shuts down
+ * @param ctx cancelled when the peer shuts down
+ */
+func watch_rates(ctx context.Context) {
+	type sample struct {
+		at       time.Time
+		served   int64
+		received int64
+	}
+	samples := []sample{{time.Now(), atomic.LoadInt64(&metrics.BytesServed), atomic.LoadInt64(&metrics.BytesReceived)}}
+	ticker := time.NewTicker(RATE_SAMPLE)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := sample{time.Now(), atomic.LoadInt64(&metrics.BytesServed), atomic.LoadInt64(&metrics.BytesReceived)}
+		samples = append(samples, now)
+		if len(samples) > RATE_WINDOW+1 {
+			samples = samples[1:]
+		}
+		oldest := samples[0]
+		secs := now.at.Sub(oldest.at).Seconds()
+		atomic.StoreInt64(&upload_rate, int64(float64(now.served-oldest.served)/secs))
+		atomic.StoreInt64(&download_rate, int64(float64(now.received-oldest.received)/secs))
+	}
+}
+
+/**
+ * @param n a number of bytes
+ * @return it in B, KB, MB or GB, whichever reads best
+ */
+func format_bytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+}
+
+/**
+ * @param addr a peer's address, as recorded
+ * @param key its identity key in hex, empty if unknown
+ * @return how the peer is shown: its address, and its fingerprint if known
+ */
+func peer_label(addr string, key string) string {
+	if key == "" {
+		return addr
+	}
+	return addr + " " + short_key(key)
+}
+
+/**
+ * Writes the totals, the rates if the peer is serving, and the songs and
+ * peers transferred most
+ * @param w where they are written
+ * @param n how many songs and peers to list
+ * @param live whether this is the serving peer, whose rates are known
+ * @return an error if the library can't be read
+ */
+func write_stats(w io.Writer, n int, live bool) error {
+	totals, since, err := transfer_totals()
+	if err != nil {
+		return err
+	}
+	songs, err := most_transferred(n)
+	if err != nil {
+		return err
+	}
+	peers, err := top_peers(n)
+	if err != nil {
+		return err
+	}
+	if since.IsZero() {
+		fmt.Fprintln(w, "Nothing transferred yet.")
+	} else {
+		fmt.Fprintf(w, "Since %s:\n", since.Format("2006-01-02"))
+	}
+	fmt.Fprintf(w, "Uploaded   %s, %d songs", format_bytes(totals.Uploaded), totals.Uploads)
+	if live {
+		fmt.Fprintf(w, ", now %s/s", format_bytes(atomic.LoadInt64(&upload_rate)))
+	}
+	fmt.Fprintf(w, "\nDownloaded %s, %d songs", format_bytes(totals.Downloaded), totals.Downloads)
+	if live {
+		fmt.Fprintf(w, ", now %s/s", format_bytes(atomic.LoadInt64(&download_rate)))
+	}
+	fmt.Fprintln(w)
+	if len(songs) > 0 {
+		fmt.Fprintln(w, "\nSongs transferred most:")
+	}
+	for i, count := range songs {
+		fmt.Fprintf(w, "%3d. %s, %s  %d up, %d down, %s\n", i+1, count.Song.Title, count.Song.Artist,
+			count.Uploads, count.Downloads, format_bytes(count.Bytes))
+	}
+	if len(peers) > 0 {
+		fmt.Fprintln(w, "\nPeers transferred with most:")
+	}
+	for i, peer := range peers {
+		fmt.Fprintf(w, "%3d. %s  %s up, %s down in %d transfers, last %s\n", i+1, peer_label(peer.Peer, peer.Key),
+			format_bytes(peer.Uploaded), format_bytes(peer.Downloaded), peer.Transfers,
+			peer.Last.Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintln(w, " ")
+	return nil
+}
+
+/**
+ * Writes transfers, one per line
+ * @param w where they are written
+ * @param list the transfers, newest first
+ */
+func write_transfers(w io.Writer, list []Transfer) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "Nothing transferred with that peer.")
+	}
+	for _, transfer := range list {
+		direction := "from"
+		if transfer.Upload {
+			direction = "to"
+		}
+		rate := ""
+		if secs := transfer.Took.Seconds(); secs > 0 {
+			rate = fmt.Sprintf(" at %s/s", format_bytes(int64(float64(transfer.Bytes)/secs)))
+		}
+		fmt.Fprintf(w, "%s  %s, %s: %s %s %s%s\n", transfer.Started.Format("2006-01-02 15:04"),
+			transfer.Song.Title, transfer.Song.Artist, format_bytes(transfer.Bytes), direction,
+			peer_label(transfer.Peer, transfer.Key), rate)
+	}
+	fmt.Fprintln(w, " ")
+}
+
+/**
+ * stats [n] and stats peer <peer> [n], from the command line, a control
+ * connection or the interactive menu
+ * @param args what followed the command
+ * @param live whether this is the serving peer, whose rates are known
+ * @param w where output is written
+ * @return the exit status
+ */
+func handle_stats(args []string, live bool, w io.Writer) int {
+	peer := ""
+	if len(args) > 0 && args[0] == "peer" {
+		if len(args) < 2 {
+			fmt.Fprintln(w, "Usage: ", os.Args[0], "stats [n] | stats peer <address|key> [n]")
+			return 2
+		}
+		peer, args = args[1], args[2:]
+	}
+	n, err := history_count(args)
+	if err != nil {
+		fmt.Fprintln(w, "Usage: ", os.Args[0], "stats [n] | stats peer <address|key> [n]")
+		return 2
+	}
+	if len(args) == 0 && peer == "" {
+		n = DEFAULT_STATS
+	}
+	done, err := use_library()
+	if err != nil {
+		fmt.Fprintln(w, "can't open the library: ", err)
+		return 1
+	}
+	defer done()
+	if peer == "" {
+		err = write_stats(w, n, live)
+	} else {
+		var list []Transfer
+		if list, err = peer_history(peer, n); err == nil {
+			write_transfers(w, list)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(w, "can't read the stats: ", err)
+		return 1
+	}
+	return 0
+}
+
+/**
+ * stats [n] | stats peer <address|key> [n]: prints what was transferred
+ * with other peers
+ */
+func run_stats(args []string) int {
+	return handle_stats(args, false, os.Stdout)
+}
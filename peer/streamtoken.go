@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Stream tokens: the HTTP gateway only streams a song to a /stream URL
+ * carrying a token for it, so opening the gateway's port to the internet
+ * doesn't give everyone the swarm's songs. A token names the song and
+ * when it expires, signed with an HMAC-SHA256 key made the first time one
+ * is needed and kept in ~/.torero. The web UI, the JSON lists and the
+ * media server hand them out, but only to clients on the local network,
+ * and `peer streamurl` prints a URL with one to give to anyone else
+ */
+
+const (
+	// how long a stream URL works for
+	STREAM_TOKEN_TTL = 6 * time.Hour
+	// size in bytes of the key tokens are signed with, and of a signature
+	STREAM_KEY_LEN = 32
+	STREAM_MAC_LEN = 16
+)
+
+var (
+	stream_key_once sync.Once
+	stream_key      []byte
+	stream_key_err  error
+)
+
+/**
+ * @return the path of the file the key stream tokens are signed with is
+ * kept in
+ */
+func stream_key_path() string {
+	return filepath.Join(torero_dir(), "gateway.key")
+}
+
+/**
+ * @return the key stream tokens are signed with, made and saved the first
+ * time, or an error if it can't be read or saved
+ */
+func gateway_key() ([]byte, error) {
+	stream_key_once.Do(func() {
+		stream_key, stream_key_err = load_stream_key(stream_key_path())
+	})
+	return stream_key, stream_key_err
+}
+
+/**
+ * Reads the key kept in a file, making one and saving it there if there
+ * is none yet
+ * @param path the file, holding the key in hex
+ * @return the key
+ */
+func load_stream_key(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != STREAM_KEY_LEN {
+			return nil, fmt.Errorf("%s isn't a gateway key", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, STREAM_KEY_LEN)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// only the owner may read it: whoever has it can make stream URLs
+	if err = os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/**
+ * @param key the key tokens are signed with
+ * @param id a song's master list ID
+ * @param expires when the token expires, in Unix seconds
+ * @return the token's signature
+ */
+func stream_mac(key []byte, id int, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "stream %d %d", id, expires)
+	return mac.Sum(nil)[:STREAM_MAC_LEN]
+}
+
+/**
+ * @param id a song's master list ID
+ * @return a token for streaming the song for the next STREAM_TOKEN_TTL,
+ * "" if there is no key to sign it with
+ */
+func stream_token(id int) string {
+	key, err := gateway_key()
+	if err != nil {
+		return ""
+	}
+	expires := time.Now().Add(STREAM_TOKEN_TTL).Unix()
+	return strconv.FormatInt(expires, 10) + "-" + hex.EncodeToString(stream_mac(key, id, expires))
+}
+
+/**
+ * @param id a song's master list ID
+ * @param ext the file extension to end the path with, e.g. "mp3", or ""
+ * @return the gateway path the song streams from, with a token
+ */
+func stream_path(id int, ext string) string {
+	name := strconv.Itoa(id)
+	if ext != "" {
+		name += "." + ext
+	}
+	return "/stream/" + name + "?token=" + stream_token(id)
+}
+
+/**
+ * @param id the master list ID of the song asked for
+ * @param token the token in the URL
+ * @return whether the token is for the song and hasn't expired
+ */
+func valid_stream_token(id int, token string) bool {
+	expires_text, mac_text, ok := strings.Cut(token, "-")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expires_text, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	mac, err := hex.DecodeString(mac_text)
+	if err != nil {
+		return false
+	}
+	key, err := gateway_key()
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, stream_mac(key, id, expires))
+}
+
+/**
+ * @param r a request to the gateway
+ * @return whether it comes from this host or the local network, and may
+ * be handed stream tokens
+ */
+func local_client(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+/**
+ * Turns away a client that isn't on the local network
+ * @return whether the client may go on
+ */
+func allow_local(w http.ResponseWriter, r *http.Request) bool {
+	if local_client(r) {
+		return true
+	}
+	http.Error(w, "only open to the local network, ask for a stream URL", http.StatusForbidden)
+	return false
+}
+
+/**
+ * @return the gateway's address as peers on the LAN reach it, "" if it
+ * isn't served
+ */
+func gateway_base() string {
+	if http_flag == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(http_flag)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = GetLocalIP()
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+/**
+ * streamurl <song id>: prints a URL the song streams from, for the next
+ * STREAM_TOKEN_TTL. Only the daemon serving the gateway knows its address
+ */
+func run_streamurl(args []string) int {
+	fmt.Println("stream URLs take a daemon serving the HTTP gateway, start one with: ", os.Args[0], "serve <port> <filedir> --http :8000")
+	return 1
+}
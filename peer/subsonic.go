@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * A subset of the Subsonic REST API, on the HTTP gateway under /rest, so
+ * Subsonic apps can browse and stream the master list: ping, getLicense,
+ * getMusicFolders, getIndexes, getMusicDirectory, search2, search3,
+ * stream, download and getCoverArt. The library is one music folder of
+ * artist directories, holding album directories, holding the tracks.
+ * Answers are XML, or JSON with f=json. With user and password set under
+ * [subsonic] in the config file, requests must log in as that user, with
+ * the password or a salted token; without, anyone on the LAN can, as with
+ * the rest of the gateway, and nobody else
+ */
+
+const (
+	// the Subsonic API version answered with
+	SUBSONIC_VERSION = "1.16.1"
+	SUBSONIC_XMLNS   = "http://subsonic.org/restapi"
+	// the one music folder
+	SUBSONIC_FOLDER = 1
+	// results of each kind search2 and search3 return, unless asked for
+	// more
+	SUBSONIC_SEARCH_COUNT = 20
+)
+
+// Subsonic error codes
+const (
+	SUBSONIC_ERR_GENERIC   = 0
+	SUBSONIC_ERR_MISSING   = 10
+	SUBSONIC_ERR_AUTH      = 40
+	SUBSONIC_ERR_NOT_FOUND = 70
+)
+
+/**
+ * The login the Subsonic API takes, under [subsonic] in the config file
+ */
+type SubsonicConfig struct {
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+/**
+ * The body of every Subsonic answer, holding one of the fields after
+ * Version
+ */
+type SubsonicResponse struct {
+	XMLName       xml.Name               `xml:"subsonic-response" json:"-"`
+	Xmlns         string                 `xml:"xmlns,attr" json:"-"`
+	Status        string                 `xml:"status,attr" json:"status"`
+	Version       string                 `xml:"version,attr" json:"version"`
+	Error         *SubsonicError         `xml:"error,omitempty" json:"error,omitempty"`
+	License       *SubsonicLicense       `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *SubsonicMusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes       *SubsonicIndexes       `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory     *SubsonicDirectory     `xml:"directory,omitempty" json:"directory,omitempty"`
+	SearchResult2 *SubsonicSearchResult2 `xml:"searchResult2,omitempty" json:"searchResult2,omitempty"`
+	SearchResult3 *SubsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type SubsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type SubsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type SubsonicMusicFolders struct {
+	Folders []SubsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type SubsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+/**
+ * The artists, under the letter they start with
+ */
+type SubsonicIndexes struct {
+	// ms since the epoch
+	LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []SubsonicIndex `xml:"index" json:"index,omitempty"`
+}
+
+type SubsonicIndex struct {
+	Name    string           `xml:"name,attr" json:"name"`
+	Artists []SubsonicArtist `xml:"artist" json:"artist,omitempty"`
+}
+
+type SubsonicArtist struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Name       string `xml:"name,attr" json:"name"`
+	AlbumCount int    `xml:"albumCount,attr,omitempty" json:"albumCount,omitempty"`
+}
+
+/**
+ * An artist's albums, or an album's tracks
+ */
+type SubsonicDirectory struct {
+	ID       string          `xml:"id,attr" json:"id"`
+	Parent   string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name     string          `xml:"name,attr" json:"name"`
+	Children []SubsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+/**
+ * An album directory, or a track
+ */
+type SubsonicChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	// in seconds
+	Duration int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	Type     string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	AlbumID  string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+}
+
+/**
+ * An album as search3 lists it
+ */
+type SubsonicAlbum struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Artist    string `xml:"artist,attr" json:"artist"`
+	ArtistID  string `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Duration  int    `xml:"duration,attr" json:"duration"`
+}
+
+type SubsonicSearchResult2 struct {
+	Artists []SubsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Albums  []SubsonicChild  `xml:"album" json:"album,omitempty"`
+	Songs   []SubsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+type SubsonicSearchResult3 struct {
+	Artists []SubsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Albums  []SubsonicAlbum  `xml:"album" json:"album,omitempty"`
+	Songs   []SubsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+/**
+ * An album of the master list, by one artist
+ */
+type SubsonicAlbumGroup struct {
+	ID     string
+	Name   string
+	Artist SongGroup
+	Songs  []tsp.SongEntry
+}
+
+/**
+ * Answers a request to /rest/<method>, or /rest/<method>.view
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port
+ */
+func serve_subsonic(ctx context.Context, args []string, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	query := r.Form
+	method := strings.TrimSuffix(path.Base(r.URL.Path), ".view")
+	if !subsonic_login(query, r) {
+		write_subsonic_error(w, query, SUBSONIC_ERR_AUTH, "wrong username or password")
+		return
+	}
+	if method == "ping" {
+		write_subsonic(w, query, &SubsonicResponse{})
+		return
+	}
+	if method == "getLicense" {
+		write_subsonic(w, query, &SubsonicResponse{License: &SubsonicLicense{Valid: true}})
+		return
+	}
+	if method == "getMusicFolders" {
+		write_subsonic(w, query, &SubsonicResponse{MusicFolders: &SubsonicMusicFolders{
+			Folders: []SubsonicMusicFolder{{SUBSONIC_FOLDER, "Torero"}},
+		}})
+		return
+	}
+
+	songs, _, err := current_list(ctx, args)
+	if err != nil {
+		write_subsonic_error(w, query, SUBSONIC_ERR_GENERIC, "can't get the song list: "+err.Error())
+		return
+	}
+	songs, _ = hide_duplicates(songs)
+	switch method {
+	case "getIndexes":
+		write_subsonic(w, query, &SubsonicResponse{Indexes: subsonic_indexes(songs)})
+	case "getMusicDirectory":
+		directory, ok := subsonic_directory(songs, query.Get("id"))
+		if !ok {
+			write_subsonic_error(w, query, SUBSONIC_ERR_NOT_FOUND, "no directory "+query.Get("id"))
+			return
+		}
+		write_subsonic(w, query, &SubsonicResponse{Directory: directory})
+	case "search2", "search3":
+		subsonic_search(w, query, method, songs)
+	case "stream", "download":
+		id, err := strconv.Atoi(query.Get("id"))
+		if err != nil {
+			write_subsonic_error(w, query, SUBSONIC_ERR_MISSING, "id must be a song")
+			return
+		}
+		stream_song(ctx, args, id, w, r)
+	case "getCoverArt":
+		subsonic_cover_art(w, query)
+	default:
+		write_subsonic_error(w, query, SUBSONIC_ERR_NOT_FOUND, method+" isn't supported")
+	}
+}
+
+/**
+ * @param query the request's parameters: u, and either p, the password in
+ * the clear or as "enc:" and its hex, or t, the MD5 of the password and
+ * the salt s
+ * @param r the request
+ * @return whether they log in as config.Subsonic.User, or there is no
+ * user to log in as and the client is on the local network
+ */
+func subsonic_login(query url.Values, r *http.Request) bool {
+	if config.Subsonic.User == "" {
+		return local_client(r)
+	}
+	if query.Get("u") != config.Subsonic.User {
+		return false
+	}
+	if token := query.Get("t"); token != "" {
+		sum := md5.Sum([]byte(config.Subsonic.Password + query.Get("s")))
+		return strings.EqualFold(token, hex.EncodeToString(sum[:]))
+	}
+	password := query.Get("p")
+	if strings.HasPrefix(password, "enc:") {
+		decoded, err := hex.DecodeString(password[len("enc:"):])
+		if err != nil {
+			return false
+		}
+		password = string(decoded)
+	}
+	return password == config.Subsonic.Password
+}
+
+/**
+ * Writes a Subsonic answer, as JSON with f=json, otherwise XML
+ * @param w the response
+ * @param query the request's parameters
+ * @param resp the answer, its status and version filled in here
+ */
+func write_subsonic(w http.ResponseWriter, query url.Values, resp *SubsonicResponse) {
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	resp.Version = SUBSONIC_VERSION
+	resp.Xmlns = SUBSONIC_XMLNS
+	if query.Get("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*SubsonicResponse{"subsonic-response": resp})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+/**
+ * Writes a Subsonic error. Like Subsonic, with status 200
+ * @param w the response
+ * @param query the request's parameters
+ * @param code one of the SUBSONIC_ERR_ codes
+ * @param message what went wrong
+ */
+func write_subsonic_error(w http.ResponseWriter, query url.Values, code int, message string) {
+	write_subsonic(w, query, &SubsonicResponse{Status: "failed", Error: &SubsonicError{code, message}})
+}
+
+/**
+ * @param kind "ar" for an artist, "al" for an album
+ * @param names the artist, and the album's name
+ * @return the ID of the artist's or album's directory
+ */
+func subsonic_id(kind string, names ...string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(strings.ToLower(strings.Join(names, "\x00"))))
+	return kind + "-" + strconv.FormatUint(hash.Sum64(), 36)
+}
+
+/**
+ * @param songs the master list, less near-duplicates
+ * @return every album of every artist, with its tracks in order
+ */
+func subsonic_albums(songs []tsp.SongEntry) []SubsonicAlbumGroup {
+	var albums []SubsonicAlbumGroup
+	for _, artist := range group_songs(songs, artist_name) {
+		for _, album := range group_songs(artist.Songs, album_name) {
+			albums = append(albums, SubsonicAlbumGroup{
+				ID:     subsonic_id("al", artist.Name, album.Name),
+				Name:   album.Name,
+				Artist: artist,
+				Songs:  sort_tracks(album.Songs),
+			})
+		}
+	}
+	return albums
+}
+
+/**
+ * @param songs the master list, less near-duplicates
+ * @return the artists, under the letter they start with
+ */
+func subsonic_indexes(songs []tsp.SongEntry) *SubsonicIndexes {
+	indexes := &SubsonicIndexes{LastModified: time.Now().UnixMilli()}
+	for _, artist := range group_songs(songs, artist_name) {
+		letter := "#"
+		if first := []rune(artist.Name); len(first) > 0 && unicode.IsLetter(first[0]) {
+			letter = string(unicode.ToUpper(first[0]))
+		}
+		if n := len(indexes.Index); n == 0 || indexes.Index[n-1].Name != letter {
+			indexes.Index = append(indexes.Index, SubsonicIndex{Name: letter})
+		}
+		index := &indexes.Index[len(indexes.Index)-1]
+		index.Artists = append(index.Artists, subsonic_artist(artist))
+	}
+	return indexes
+}
+
+/**
+ * @param artist an artist's songs
+ * @return the artist as getIndexes and search list it
+ */
+func subsonic_artist(artist SongGroup) SubsonicArtist {
+	return SubsonicArtist{
+		ID:         subsonic_id("ar", artist.Name),
+		Name:       artist.Name,
+		AlbumCount: len(group_songs(artist.Songs, album_name)),
+	}
+}
+
+/**
+ * @param songs the master list, less near-duplicates
+ * @param id an artist's or album's directory
+ * @return the artist's albums, or the album's tracks, and false if there
+ * is no such directory
+ */
+func subsonic_directory(songs []tsp.SongEntry, id string) (*SubsonicDirectory, bool) {
+	for _, artist := range group_songs(songs, artist_name) {
+		if subsonic_id("ar", artist.Name) != id {
+			continue
+		}
+		directory := &SubsonicDirectory{ID: id, Parent: strconv.Itoa(SUBSONIC_FOLDER), Name: artist.Name}
+		for _, album := range subsonic_albums(artist.Songs) {
+			directory.Children = append(directory.Children, subsonic_album_dir(album))
+		}
+		return directory, true
+	}
+	for _, album := range subsonic_albums(songs) {
+		if album.ID != id {
+			continue
+		}
+		directory := &SubsonicDirectory{ID: id, Parent: subsonic_id("ar", album.Artist.Name), Name: album.Name}
+		for _, song := range album.Songs {
+			directory.Children = append(directory.Children, subsonic_song(song))
+		}
+		return directory, true
+	}
+	return nil, false
+}
+
+/**
+ * @param album an album
+ * @return its directory, as its artist's directory and search2 list it
+ */
+func subsonic_album_dir(album SubsonicAlbumGroup) SubsonicChild {
+	return SubsonicChild{
+		ID:       album.ID,
+		Parent:   subsonic_id("ar", album.Artist.Name),
+		IsDir:    true,
+		Title:    album.Name,
+		Album:    album.Name,
+		Artist:   album.Artist.Name,
+		CoverArt: strconv.Itoa(album.Songs[0].ID),
+	}
+}
+
+/**
+ * @param song a master list entry
+ * @return the song as directories and searches list it
+ */
+func subsonic_song(song tsp.SongEntry) SubsonicChild {
+	format := tsp.FORMAT_MP3
+	var size int64
+	if len(song.Sources) > 0 {
+		size = song.Sources[0].Size
+		if song.Sources[0].Format != "" {
+			format = song.Sources[0].Format
+		}
+	}
+	return SubsonicChild{
+		ID:          strconv.Itoa(song.ID),
+		Parent:      subsonic_id("al", song.Artist, album_name(song)),
+		Title:       song.Title,
+		Album:       album_name(song),
+		Artist:      song.Artist,
+		Track:       song.Track,
+		DiscNumber:  song.Disc,
+		Genre:       song.Genre,
+		CoverArt:    strconv.Itoa(song.ID),
+		Size:        size,
+		ContentType: mime_type(format),
+		Suffix:      format,
+		Duration:    int(song.Duration.Seconds()),
+		Type:        "music",
+		AlbumID:     subsonic_id("al", song.Artist, album_name(song)),
+		ArtistID:    subsonic_id("ar", song.Artist),
+	}
+}
+
+/**
+ * Answers search2 or search3: the artists and albums whose names contain
+ * the query, and the songs matching it as search does. An empty query, or
+ * "", matches everything, which apps use to fetch the whole library
+ * @param w the response
+ * @param query the request's parameters
+ * @param method search2 or search3
+ * @param songs the master list, less near-duplicates
+ */
+func subsonic_search(w http.ResponseWriter, query url.Values, method string, songs []tsp.SongEntry) {
+	text := strings.ToLower(strings.Trim(strings.TrimSpace(query.Get("query")), `"`))
+	matches := func(name string) bool {
+		return text == "" || strings.Contains(strings.ToLower(name), text)
+	}
+
+	var artists []SongGroup
+	for _, artist := range group_songs(songs, artist_name) {
+		if matches(artist.Name) {
+			artists = append(artists, artist)
+		}
+	}
+	var albums []SubsonicAlbumGroup
+	for _, album := range subsonic_albums(songs) {
+		if matches(album.Name) {
+			albums = append(albums, album)
+		}
+	}
+	found := songs
+	if text != "" {
+		found = search_songs(text)
+	}
+	start, end := subsonic_page(len(artists), query, "artist")
+	artists = artists[start:end]
+	start, end = subsonic_page(len(albums), query, "album")
+	albums = albums[start:end]
+	start, end = subsonic_page(len(found), query, "song")
+	found = found[start:end]
+
+	var result_artists []SubsonicArtist
+	for _, artist := range artists {
+		result_artists = append(result_artists, subsonic_artist(artist))
+	}
+	var result_songs []SubsonicChild
+	for _, song := range found {
+		result_songs = append(result_songs, subsonic_song(song))
+	}
+	if method == "search2" {
+		result := &SubsonicSearchResult2{Artists: result_artists, Songs: result_songs}
+		for _, album := range albums {
+			result.Albums = append(result.Albums, subsonic_album_dir(album))
+		}
+		write_subsonic(w, query, &SubsonicResponse{SearchResult2: result})
+		return
+	}
+	result := &SubsonicSearchResult3{Artists: result_artists, Songs: result_songs}
+	for _, album := range albums {
+		var length time.Duration
+		for _, song := range album.Songs {
+			length += song.Duration
+		}
+		result.Albums = append(result.Albums, SubsonicAlbum{
+			ID:        album.ID,
+			Name:      album.Name,
+			Artist:    album.Artist.Name,
+			ArtistID:  subsonic_id("ar", album.Artist.Name),
+			CoverArt:  strconv.Itoa(album.Songs[0].ID),
+			SongCount: len(album.Songs),
+			Duration:  int(length.Seconds()),
+		})
+	}
+	write_subsonic(w, query, &SubsonicResponse{SearchResult3: result})
+}
+
+/**
+ * @param n how many search results of one kind there are
+ * @param query the request's parameters, with <kind>Count and
+ * <kind>Offset
+ * @param kind artist, album or song
+ * @return the start and end of the results asked for
+ */
+func subsonic_page(n int, query url.Values, kind string) (int, int) {
+	count, err := strconv.Atoi(query.Get(kind + "Count"))
+	if err != nil || count < 0 {
+		count = SUBSONIC_SEARCH_COUNT
+	}
+	offset, err := strconv.Atoi(query.Get(kind + "Offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	if offset > n {
+		offset = n
+	}
+	if offset+count > n {
+		count = n - offset
+	}
+	return offset, offset + count
+}
+
+/**
+ * Answers getCoverArt with the art of a song, or of an album's first
+ * track, fetched from a peer serving it
+ * @param w the response
+ * @param query the request's parameters
+ */
+func subsonic_cover_art(w http.ResponseWriter, query url.Values) {
+	id, err := strconv.Atoi(query.Get("id"))
+	if err != nil {
+		write_subsonic_error(w, query, SUBSONIC_ERR_MISSING, "id must be a song")
+		return
+	}
+	song, ok := find_song(id)
+	if !ok {
+		write_subsonic_error(w, query, SUBSONIC_ERR_NOT_FOUND, "no song "+query.Get("id"))
+		return
+	}
+	art, _, err := song_art(song)
+	if err != nil {
+		write_subsonic_error(w, query, SUBSONIC_ERR_NOT_FOUND, "no cover art: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", art.MIME)
+	w.Write(art.Data)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// most peers a song is downloaded from at once
+	MAX_SWARM_PEERS = 8
+	// pieces in a row a peer can fail before it is dropped from a download
+	MAX_PIECE_FAILURES = 3
+	// how often a peer with no piece left to fetch looks again, and asks a
+	// partial source what it has got since
+	PIECE_POLL = time.Second
+	// how long a partial source can go without a piece to offer before it
+	// is dropped from a download
+	PARTIAL_WAIT = 30 * time.Second
+)
+
+// what a download has of each piece
+const (
+	PIECE_MISSING = iota
+	PIECE_FETCHING
+	PIECE_DONE
+)
+
+/**
+ * A download split into tsp.PIECE_SIZE pieces, fetched from several
+ * peers serving identical files at once. Each peer takes the next missing
+ * piece it has; a piece that fails or doesn't match its hash goes back to
+ * missing for any peer to pick up. While it runs, the pieces already
+ * fetched are seeded to other peers, see seed.go
+ */
+type Swarm struct {
+	song   tsp.SongEntry
+	source tsp.SongSource
+	hashes []string
+	size   int64
+	file   *os.File
+	part   string
+	// the PIECE_ state of every piece, and how many aren't PIECE_DONE
+	pieces    []byte
+	remaining int
+	mutex     sync.Mutex
+	progress  *Progress
+	// the FileID the download is seeded under, 0 if it isn't
+	file_id int
+}
+
+/**
+ * @param size the song's size in bytes
+ * @return how many pieces the song is split into
+ */
+func piece_count(size int64) int {
+	return int((size + tsp.PIECE_SIZE - 1) / tsp.PIECE_SIZE)
+}
+
+/**
+ * @param index a piece of a song
+ * @param size the song's size in bytes
+ * @return where the piece starts in the file, and how long it is
+ */
+func piece_range(index int, size int64) (int64, int64) {
+	offset := int64(index) * tsp.PIECE_SIZE
+	length := size - offset
+	if length > tsp.PIECE_SIZE {
+		length = tsp.PIECE_SIZE
+	}
+	return offset, length
+}
+
+/**
+ * Hashes a local song piece by piece, to answer a PIECES
+ * @param song_file the song's path
+ * @return the hex SHA-256 of each piece, in order
+ */
+func piece_hashes(song_file string) ([]string, error) {
+	file, err := os.Open(song_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var hashes []string
+	buf := make([]byte, tsp.PIECE_SIZE)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			hashes = append(hashes, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/**
+ * Picks the sources a song can be swarmed from: the largest group serving
+ * identical files, going by hash, peers with the whole file first
+ * @param song the master list entry of the song
+ * @return the sources, nil if no file is served by more than one peer
+ */
+func swarm_sources(song tsp.SongEntry) []tsp.SongSource {
+	self := ""
+	if serve_args != nil {
+		self = announced_addr(serve_args)
+	}
+	groups := make(map[string][]tsp.SongSource)
+	var best []tsp.SongSource
+	for _, source := range song.Sources {
+		if source.Hash == "" || source.Size <= 0 || source.PeerAddr == self {
+			continue
+		}
+		groups[source.Hash] = append(groups[source.Hash], source)
+		if len(groups[source.Hash]) > len(best) {
+			best = groups[source.Hash]
+		}
+	}
+	if len(best) < 2 {
+		return nil
+	}
+	sort.SliceStable(best, func(i, j int) bool {
+		return !best[i].Partial && best[j].Partial
+	})
+	if len(best) > MAX_SWARM_PEERS {
+		best = best[:MAX_SWARM_PEERS]
+	}
+	return best
+}
+
+/**
+ * Asks the sources in turn for the song's piece hashes
+ * @param song the song being downloaded
+ * @param sources peers serving identical files
+ * @return the piece hashes from the first source to answer
+ */
+func fetch_piece_hashes(song tsp.SongEntry, sources []tsp.SongSource) ([]string, error) {
+	err := errors.New("no sources")
+	for _, source := range sources {
+		var conn io.ReadCloser
+		conn, _, err = send_to_peer(*tsp.NewMsg(tsp.PIECES, song.ID, nil), source)
+		if err != nil {
+			continue
+		}
+		var reply *tsp.Msg
+		reply, err = tsp.Decode(conn)
+		conn.Close()
+		if err == nil {
+			err = reply.Err()
+		}
+		if err != nil {
+			continue
+		}
+		var hashes []string
+		if hashes, err = tsp.DecodePieces(reply.Msg); err == nil && len(hashes) == piece_count(source.Size) {
+			return hashes, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s sent %d piece hashes for %d pieces", source.PeerAddr, len(hashes), piece_count(source.Size))
+		}
+	}
+	return nil, err
+}
+
+/**
+ * Downloads a song piece by piece from several peers at once into a
+ * directory, seeding the pieces it has as it goes. Pieces
+ * already in a .part file from an earlier attempt are kept if they match
+ * their hash
+ * @param song the master list entry of the song
+ * @param sources peers serving identical files
+ * @param hashes the hash of every piece
+ * @param dir the directory to save it in
+ * @return the saved file; an error if some pieces couldn't be fetched
+ * from any peer, or the file doesn't match its hash
+ */
+func download_swarm(song tsp.SongEntry, sources []tsp.SongSource, hashes []string, dir string) (string, error) {
+	size := sources[0].Size
+	dest := filepath.Join(dir, download_name(song, sources[0]))
+	part := dest + ".part"
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	s := &Swarm{song: song, source: sources[0], hashes: hashes, size: size, file: file, part: part}
+	s.check_pieces()
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return "", err
+	}
+	var written int64
+	for index, state := range s.pieces {
+		if state == PIECE_DONE {
+			_, length := piece_range(index, size)
+			written += length
+		}
+	}
+	s.progress = &Progress{label: fmt.Sprintf("Downloading %s from %d peers", song.Title, len(sources)), total: size, written: written}
+	start_seeding(s)
+
+	var workers sync.WaitGroup
+	for _, source := range sources {
+		workers.Add(1)
+		go func(source tsp.SongSource) {
+			defer workers.Done()
+			s.worker(source)
+		}(source)
+	}
+	workers.Wait()
+	// stop before the file moves, so the finished song can be announced
+	// whole in its place
+	stop_seeding(s)
+	s.progress.draw()
+	fmt.Println()
+
+	if left := s.remaining; left > 0 {
+		file.Close()
+		// keep the pieces that did arrive for the next attempt
+		return "", fmt.Errorf("%d of %d pieces couldn't be fetched from any peer", left, len(hashes))
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, io.NewSectionReader(file, 0, size))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sources[0].Hash {
+		os.Remove(part)
+		return "", fmt.Errorf("the downloaded file doesn't match its hash")
+	}
+	dest = free_path(dest)
+	if err = os.Rename(part, dest); err != nil {
+		return "", err
+	}
+	fmt.Println("Saved to " + dest)
+	return dest, nil
+}
+
+/**
+ * Marks the pieces already in the .part file, checked against their
+ * hashes, as done and the rest as missing
+ */
+func (s *Swarm) check_pieces() {
+	s.pieces = make([]byte, len(s.hashes))
+	buf := make([]byte, tsp.PIECE_SIZE)
+	for index := range s.hashes {
+		offset, length := piece_range(index, s.size)
+		if _, err := s.file.ReadAt(buf[:length], offset); err == nil {
+			sum := sha256.Sum256(buf[:length])
+			if hex.EncodeToString(sum[:]) == s.hashes[index] {
+				s.pieces[index] = PIECE_DONE
+				continue
+			}
+		}
+		s.pieces[index] = PIECE_MISSING
+		s.remaining++
+	}
+}
+
+/**
+ * Claims the next missing piece a peer can serve
+ * @param have the pieces the peer has, see tsp.HasPiece; nil if it has
+ * the whole file
+ * @return the piece, or -1 if there is none for now; false once every
+ * piece has arrived
+ */
+func (s *Swarm) take(have []byte) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.remaining == 0 {
+		return -1, false
+	}
+	for index, state := range s.pieces {
+		if state == PIECE_MISSING && (have == nil || tsp.HasPiece(have, index)) {
+			s.pieces[index] = PIECE_FETCHING
+			return index, true
+		}
+	}
+	return -1, true
+}
+
+/**
+ * Settles a piece claimed with take
+ * @param index the piece
+ * @param ok whether it arrived; if not it goes back to missing
+ */
+func (s *Swarm) settle(index int, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !ok {
+		s.pieces[index] = PIECE_MISSING
+		return
+	}
+	s.pieces[index] = PIECE_DONE
+	s.remaining--
+}
+
+/**
+ * Fetches pieces from one peer until every piece has arrived or the peer
+ * has failed MAX_PIECE_FAILURES times in a row. A partial source is asked
+ * which pieces it has every PIECE_POLL it has none to offer, and dropped
+ * after PARTIAL_WAIT of that
+ * @param source the peer to fetch from
+ */
+func (s *Swarm) worker(source tsp.SongSource) {
+	var have []byte
+	var err error
+	if source.Partial {
+		if have, err = fetch_have(s.song, source); err != nil {
+			slog.Info("partial source unreachable", "peer", source.PeerAddr, "err", err)
+			return
+		}
+	}
+	failures := 0
+	idle := time.Now()
+	for {
+		index, more := s.take(have)
+		if !more {
+			return
+		}
+		if index < 0 {
+			if source.Partial && time.Since(idle) >= PARTIAL_WAIT {
+				return
+			}
+			time.Sleep(PIECE_POLL)
+			if source.Partial {
+				if have, err = fetch_have(s.song, source); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		idle = time.Now()
+
+		err = s.fetch(source, index)
+		s.settle(index, err == nil)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		slog.Warn("piece failed", "peer", source.PeerAddr, "piece", index, "err", err)
+		if failures++; failures == MAX_PIECE_FAILURES {
+			return
+		}
+		if reply, ok := err.(*tsp.Error); ok && reply.Code == tsp.ERR_BUSY {
+			time.Sleep(BUSY_RETRY_DELAY)
+		}
+	}
+}
+
+/**
+ * Asks a partial source which pieces of the song it has
+ * @param song the song being downloaded
+ * @param source the partial source
+ * @return the pieces, see tsp.HasPiece
+ */
+func fetch_have(song tsp.SongEntry, source tsp.SongSource) ([]byte, error) {
+	conn, _, err := send_to_peer(*tsp.NewMsg(tsp.HAVE, song.ID, nil), source)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply.Msg, nil
+}
+
+/**
+ * Fetches one piece from a peer, checks it against its hash and writes
+ * it into place
+ * @param source the peer to fetch from
+ * @param index the piece
+ * @return an error if the piece didn't arrive whole and intact
+ */
+func (s *Swarm) fetch(source tsp.SongSource, index int) error {
+	offset, length := piece_range(index, s.size)
+	msg := tsp.NewMsg(tsp.PLAY, s.song.ID, nil)
+	msg.Header.Offset = offset
+	msg.Header.Length = length
+	conn, _, err := send_to_peer(*msg, source)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf)
+	if hex.EncodeToString(sum[:]) != s.hashes[index] {
+		return fmt.Errorf("piece doesn't match its hash")
+	}
+	if _, err = s.file.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.progress.Write(buf)
+	s.mutex.Unlock()
+	return nil
+}
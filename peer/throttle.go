@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// shared by every upload, nil for no limit
+	upload_bucket *TokenBucket
+	// bytes/s each upload is held to on its own, 0 for no limit
+	conn_upload_rate int
+)
+
+/**
+ * A token bucket: tokens (bytes) refill at rate per second up to a burst
+ * of one second's worth. Callers wanting more than are available borrow
+ * against future refills and sleep until they are paid off
+ */
+type TokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+/**
+ * @param rate bytes per second
+ * @return a full bucket, or nil if rate is 0 (no limit)
+ */
+func NewTokenBucket(rate int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &TokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+/**
+ * Takes n tokens, sleeping until the bucket can afford them
+ * @param ctx cancelled to give up waiting
+ * @return ctx's error if it was cancelled while waiting
+ */
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mutex.Unlock()
+	if debt >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+/**
+ * A writer that holds writes to the rate of every bucket it is given
+ */
+type ThrottledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*TokenBucket
+}
+
+/**
+ * @param ctx cancelled to give up waiting on a bucket
+ * @param w the writer to throttle
+ * @param buckets the limits to keep to; nil buckets are ignored
+ * @return w itself if there are no limits
+ */
+func throttle(ctx context.Context, w io.Writer, buckets ...*TokenBucket) io.Writer {
+	t := &ThrottledWriter{ctx: ctx, w: w}
+	for _, b := range buckets {
+		if b != nil {
+			t.buckets = append(t.buckets, b)
+		}
+	}
+	if len(t.buckets) == 0 {
+		return w
+	}
+	return t
+}
+
+func (t *ThrottledWriter) Write(p []byte) (int, error) {
+	for _, b := range t.buckets {
+		if err := b.Wait(t.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return t.w.Write(p)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/jamesponwith/Torero-Streaming-Service/logging"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"github.com/rivo/tview"
+)
+
+/*
+ * The full-screen shell, run by "peer shell" on a terminal in place of the
+ * line-by-line menu (-plain keeps the menu). The master list fills the
+ * left, filtered by the search box above it, the queue is on the right
+ * and the song playing, with its progress bar and the visualizer, below
+ * them. Anything the rest of the peer prints or logs ends up in the
+ * messages pane at the bottom instead of over the screen.
+ *
+ * Keys, outside the search box:
+ *   enter       play the song selected (in the queue, jump to it)
+ *   a           queue the song selected
+ *   space       pause or resume
+ *   left/right  seek back or forward SEEK_STEP seconds
+ *   + / -       volume up or down VOLUME_STEP
+ *   n / p       next or previous song in the queue
+ *   s           stop
+ *   v           switch the visualizer between off, spectrum and waveform
+ *   l           show or hide the lyrics of the song playing
+ *   r           fetch the master list again
+ *   /           search, enter or esc to leave the search box
+ *   tab         move between the list, the queue and the search box
+ *   q           quit
+ */
+
+const (
+	// lines kept in the messages pane, and how many of them show
+	TUI_MESSAGES       = 200
+	TUI_MESSAGE_HEIGHT = 4
+	TUI_HELP           = "enter play  a queue  space pause  ←/→ seek  +/- volume  n/p next/prev  s stop  v visualizer  l lyrics  / search  r reload  q quit"
+)
+
+/**
+ * The full-screen shell's panes, and what they show
+ */
+type TUI struct {
+	ctx      context.Context
+	args     []string
+	app      *tview.Application
+	layout   *tview.Flex
+	search   *tview.InputField
+	songs    *tview.Table
+	queued   *tview.List
+	playing  *tview.TextView
+	messages *tview.TextView
+	// the songs in the list, in the order shown
+	shown []tsp.SongEntry
+	// the queue as last drawn, so it is only rebuilt when it changes
+	queue_drawn string
+	// whether the lyrics show under the song playing, the ID of the song
+	// they were looked up for, and what was found
+	lyrics_on  bool
+	lyrics_for int
+	lyrics     Lyrics
+	lyrics_err error
+	// closed once the shell has stopped
+	done chan struct{}
+}
+
+/**
+ * @return whether stdin and stdout are both a terminal the full-screen
+ * shell can take over
+ */
+func is_terminal() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		info, err := f.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Lays out the full-screen shell
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory with
+ * songs
+ */
+func NewTUI(ctx context.Context, args []string) *TUI {
+	t := &TUI{
+		ctx:      ctx,
+		args:     args,
+		app:      tview.NewApplication(),
+		search:   tview.NewInputField(),
+		songs:    tview.NewTable(),
+		queued:   tview.NewList(),
+		playing:  tview.NewTextView(),
+		messages: tview.NewTextView(),
+		done:     make(chan struct{}),
+	}
+	// no song's lyrics have been looked up yet
+	t.lyrics_for = -1
+
+	t.search.SetLabel("Search: ")
+	t.search.SetChangedFunc(func(query string) {
+		t.show_songs()
+	})
+	t.search.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			t.search.SetText("")
+		}
+		t.app.SetFocus(t.songs)
+	})
+
+	t.songs.SetSelectable(true, false)
+	t.songs.SetFixed(1, 0)
+	t.songs.SetBorder(true).SetTitle(" Songs ")
+	t.songs.SetSelectedFunc(func(row, column int) {
+		if song, ok := t.selected(); ok {
+			go t.play(song)
+		}
+	})
+
+	t.queued.ShowSecondaryText(false)
+	t.queued.SetBorder(true).SetTitle(" Queue ")
+	t.queued.SetSelectedFunc(func(index int, main string, secondary string, shortcut rune) {
+		_, pos := queue.List()
+		go play_next(t.ctx, index-pos)
+	})
+
+	t.playing.SetBorder(true).SetTitle(" Now playing ")
+	t.messages.SetMaxLines(TUI_MESSAGES)
+	t.messages.SetBorder(true).SetTitle(" Messages ")
+
+	lists := tview.NewFlex().
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(t.search, 1, 0, false).
+			AddItem(t.songs, 0, 1, true), 0, 2, true).
+		AddItem(t.queued, 0, 1, false)
+	t.layout = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(lists, 0, 1, true).
+		AddItem(t.playing, t.playing_height(), 0, false).
+		AddItem(t.messages, TUI_MESSAGE_HEIGHT+2, 0, false).
+		AddItem(tview.NewTextView().SetText(TUI_HELP), 1, 0, false)
+
+	t.app.SetRoot(t.layout, true).SetFocus(t.songs)
+	t.app.SetInputCapture(t.handle_key)
+	return t
+}
+
+/**
+ * Runs the shell until the user quits or Stop is called. What is printed
+ * to stdout or logged to stderr meanwhile goes to the messages pane
+ * @return an error if the terminal couldn't be taken over
+ */
+func (t *TUI) Run() error {
+	defer close(t.done)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	logging.SetupOutput(log_options, w)
+	defer func() {
+		os.Stdout = stdout
+		logging.Setup(log_options)
+		w.Close()
+	}()
+	go t.show_messages(r)
+	go t.refresh_loop()
+	go t.load_songs(false)
+	return t.app.Run()
+}
+
+/**
+ * Stops the shell, e.g. on SIGINT or SIGTERM
+ */
+func (t *TUI) Stop() {
+	t.app.Stop()
+}
+
+/**
+ * Handles the shortcut keys, leaving the rest to the pane with the focus
+ * @param event the key pressed
+ * @return the event for the pane to handle, nil if it was a shortcut
+ */
+func (t *TUI) handle_key(event *tcell.EventKey) *tcell.EventKey {
+	if event.Key() == tcell.KeyTab {
+		t.cycle_focus()
+		return nil
+	}
+	if t.app.GetFocus() == t.search {
+		return event
+	}
+	switch event.Key() {
+	case tcell.KeyLeft:
+		go seek_current(t.ctx, -SEEK_STEP)
+		return nil
+	case tcell.KeyRight:
+		go seek_current(t.ctx, SEEK_STEP)
+		return nil
+	case tcell.KeyRune:
+	default:
+		return event
+	}
+	switch event.Rune() {
+	case ' ':
+		if playback.Paused() {
+			playback.Resume()
+		} else {
+			playback.Pause()
+		}
+	case '+', '=':
+		set_volume(get_volume() + VOLUME_STEP)
+	case '-':
+		set_volume(get_volume() - VOLUME_STEP)
+	case 'a':
+		if song, ok := t.selected(); ok {
+			fmt.Printf("Queued %s at position %d.\n", song.Title, queue.Add(song))
+		}
+	case 'n':
+		go play_next(t.ctx, 1)
+	case 'p':
+		go play_next(t.ctx, -1)
+	case 's':
+		playback.End()
+	case 'v':
+		next_vis_mode()
+		t.layout.ResizeItem(t.playing, t.playing_height(), 0)
+	case 'l':
+		t.lyrics_on = !t.lyrics_on
+		t.layout.ResizeItem(t.playing, t.playing_height(), 0)
+	case 'r':
+		go t.load_songs(true)
+	case '/':
+		t.app.SetFocus(t.search)
+	case 'q':
+		t.app.Stop()
+	default:
+		return event
+	}
+	t.refresh()
+	return nil
+}
+
+/**
+ * Moves the focus on from the list to the queue to the search box
+ */
+func (t *TUI) cycle_focus() {
+	switch t.app.GetFocus() {
+	case t.songs:
+		t.app.SetFocus(t.queued)
+	case t.queued:
+		t.app.SetFocus(t.search)
+	default:
+		t.app.SetFocus(t.songs)
+	}
+}
+
+/**
+ * Plays a song, from its bookmark if it has one
+ * @param song the song
+ */
+func (t *TUI) play(song tsp.SongEntry) {
+	from, err := play_song(t.ctx, song, false)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Now playing: " + song.Title + ", " + song.Artist)
+	write_resumed(os.Stdout, song, from)
+}
+
+/**
+ * Gets the master list, then shows it
+ * @param fetch whether to fetch it from the tracker even if the cached
+ * one is fresh
+ */
+func (t *TUI) load_songs(fetch bool) {
+	var err error
+	if fetch {
+		_, err = load_master_list(t.ctx, t.args)
+	} else {
+		_, _, err = current_list(t.ctx, t.args)
+	}
+	if err != nil {
+		fmt.Println("error receiving list: ", err)
+		return
+	}
+	t.app.QueueUpdateDraw(t.show_songs)
+}
+
+/**
+ * Fills the list with the master list, or the songs matching the search
+ */
+func (t *TUI) show_songs() {
+	if query := t.search.GetText(); strings.TrimSpace(query) != "" {
+		t.shown = search_songs(query)
+	} else {
+		master_mutex.Lock()
+		songs, _ := hide_duplicates(master_list)
+		master_mutex.Unlock()
+		t.shown = sort_songs(songs, config.ListSort)
+	}
+
+	t.songs.Clear()
+	for column, heading := range []string{"ID", "Title", "Artist", "Album", "Length"} {
+		t.songs.SetCell(0, column, tview.NewTableCell(heading).
+			SetSelectable(false).SetAttributes(tcell.AttrBold))
+	}
+	for i, song := range t.shown {
+		cells := []string{strconv.Itoa(song.ID), song.Title, song.Artist, song.Album, format_duration(song.Duration)}
+		for column, text := range cells {
+			cell := tview.NewTableCell(tview.Escape(text))
+			if column == 1 || column == 2 || column == 3 {
+				cell.SetExpansion(1).SetMaxWidth(40)
+			}
+			t.songs.SetCell(i+1, column, cell)
+		}
+	}
+	t.songs.Select(1, 0)
+	t.songs.ScrollToBeginning()
+}
+
+/**
+ * @return the song selected in the list, and false if there is none
+ */
+func (t *TUI) selected() (tsp.SongEntry, bool) {
+	row, _ := t.songs.GetSelection()
+	if row < 1 || row > len(t.shown) {
+		return tsp.SongEntry{}, false
+	}
+	return t.shown[row-1], true
+}
+
+/**
+ * @return the height of the now playing pane: the now playing line and
+ * the volume, the visualizer and the lyrics if they are on, and the border
+ */
+func (t *TUI) playing_height() int {
+	height := 4
+	if get_vis_mode() != VIS_OFF {
+		height += VIS_HEIGHT
+	}
+	if t.lyrics_on {
+		height += LYRICS_WINDOW
+	}
+	return height
+}
+
+/**
+ * Redraws the song playing and the queue, as often as the now playing
+ * view would, until the shell stops
+ */
+func (t *TUI) refresh_loop() {
+	interval := now_playing_interval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.app.QueueUpdateDraw(t.refresh)
+		if next := now_playing_interval(); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+	}
+}
+
+/**
+ * Redraws the song playing and the queue. Call from the UI goroutine
+ */
+func (t *TUI) refresh() {
+	text := now_playing_line() + "\n" + fmt.Sprintf("Volume %d", get_volume())
+	for _, row := range visualizer_rows() {
+		text += "\n" + row
+	}
+	if t.lyrics_on {
+		for _, line := range t.lyric_lines() {
+			text += "\n" + line
+		}
+	}
+	t.playing.SetText(text)
+
+	songs, pos := queue.List()
+	lines := make([]string, len(songs))
+	for i, song := range songs {
+		mark := "  "
+		if i == pos {
+			mark = "> "
+		}
+		lines[i] = fmt.Sprintf("%s%d. %s, %s", mark, i+1, song.Title, song.Artist)
+	}
+	if drawn := strings.Join(lines, "\n"); drawn != t.queue_drawn {
+		t.queue_drawn = drawn
+		current := t.queued.GetCurrentItem()
+		t.queued.Clear()
+		for _, line := range lines {
+			t.queued.AddItem(tview.Escape(line), "", 0, nil)
+		}
+		t.queued.SetCurrentItem(current)
+	}
+}
+
+/**
+ * Looks up the lyrics of the song playing the first time it is drawn, in
+ * the background, then follows them as it plays. Call from the UI
+ * goroutine
+ * @return the lines of lyrics to show
+ */
+func (t *TUI) lyric_lines() []string {
+	song, elapsed, length, ok := playback.Position()
+	if !ok {
+		return nil
+	}
+	if song.ID != t.lyrics_for {
+		t.lyrics_for, t.lyrics, t.lyrics_err = song.ID, Lyrics{}, nil
+		go func() {
+			_, lyrics, err := current_lyrics()
+			t.app.QueueUpdateDraw(func() {
+				if t.lyrics_for == song.ID {
+					t.lyrics, t.lyrics_err = lyrics, err
+				}
+			})
+		}()
+	}
+	switch {
+	case t.lyrics_err != nil:
+		return []string{t.lyrics_err.Error()}
+	case len(t.lyrics.Lines) == 0:
+		return []string{"Looking for lyrics..."}
+	case t.lyrics.Synced:
+		return lyric_window(t.lyrics, elapsed, LYRICS_WINDOW)
+	}
+	// plain lyrics scroll through the pane as the song plays
+	start := 0
+	if over := len(t.lyrics.Lines) - LYRICS_WINDOW; over > 0 && length > 0 {
+		start = int(float64(over) * elapsed.Seconds() / length.Seconds())
+		if start > over {
+			start = over
+		}
+	}
+	var lines []string
+	for i := start; i < len(t.lyrics.Lines) && i < start+LYRICS_WINDOW; i++ {
+		lines = append(lines, "  "+t.lyrics.Lines[i].Text)
+	}
+	return lines
+}
+
+/**
+ * Copies lines printed or logged into the messages pane, until the pipe
+ * they come through is closed
+ * @param r the read end of the pipe
+ */
+func (t *TUI) show_messages(r *os.File) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		select {
+		case <-t.done:
+			continue
+		default:
+		}
+		t.app.QueueUpdateDraw(func() {
+			fmt.Fprintln(t.messages, line)
+			t.messages.ScrollToEnd()
+		})
+	}
+}
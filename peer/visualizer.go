@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"math/cmplx"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * The visualizer, drawn under the now playing line: a spectrum, from an
+ * FFT over the last VIS_SAMPLES of audio played, or the waveform of them.
+ * The player hands every chunk it plays to the scope while the visualizer
+ * is on; typing v in the now playing view switches between off, spectrum
+ * and waveform
+ */
+
+const (
+	VIS_OFF      = "off"
+	VIS_SPECTRUM = "spectrum"
+	VIS_WAVEFORM = "waveform"
+	// samples of audio the visualizer is drawn from, a power of two for
+	// the FFT
+	VIS_SAMPLES = 2048
+	// columns and rows it takes in the terminal
+	VIS_WIDTH  = 64
+	VIS_HEIGHT = 8
+	// the lowest frequency shown, and the range of levels from silent to
+	// full, in dB
+	VIS_MIN_FREQ = 40.0
+	VIS_RANGE    = 60.0
+)
+
+// the modes in the order v steps through them
+var vis_modes = []string{VIS_OFF, VIS_SPECTRUM, VIS_WAVEFORM}
+
+// eighths of a character cell, from empty to full
+var vis_blocks = []rune(" ▁▂▃▄▅▆▇█")
+
+// index of the visualizer's mode in vis_modes
+var vis_mode int32
+
+/**
+ * The last VIS_SAMPLES of audio played, mixed down to mono, in a ring
+ */
+type Scope struct {
+	mutex       sync.Mutex
+	samples     [VIS_SAMPLES]float64
+	next        int
+	sample_rate int
+}
+
+var scope = &Scope{}
+
+/**
+ * @return the visualizer's mode, one of the VIS_ constants
+ */
+func get_vis_mode() string {
+	return vis_modes[atomic.LoadInt32(&vis_mode)]
+}
+
+/**
+ * Sets the visualizer's mode from the config file
+ */
+func load_visualizer() {
+	for i, m := range vis_modes {
+		if m == config.Visualizer {
+			atomic.StoreInt32(&vis_mode, int32(i))
+			return
+		}
+	}
+	if config.Visualizer != "" {
+		slog.Warn("unknown visualizer in the config file", "visualizer", config.Visualizer)
+	}
+}
+
+/**
+ * Sets the visualizer's mode and remembers it in the config file
+ * @param mode one of the VIS_ constants; anything else turns it off
+ */
+func set_vis_mode(mode string) {
+	index := 0
+	for i, m := range vis_modes {
+		if m == mode {
+			index = i
+		}
+	}
+	atomic.StoreInt32(&vis_mode, int32(index))
+	config.Visualizer = vis_modes[index]
+	if err := save_config(); err != nil {
+		slog.Error("can't save visualizer", "err", err)
+	}
+}
+
+/**
+ * Steps the visualizer on to its next mode
+ */
+func next_vis_mode() {
+	set_vis_mode(vis_modes[(int(atomic.LoadInt32(&vis_mode))+1)%len(vis_modes)])
+}
+
+/**
+ * Takes in a chunk of audio as it plays, if the visualizer is on
+ * @param pcm stereo 16 bit little-endian PCM
+ * @param sample_rate its sample rate
+ */
+func (s *Scope) Feed(pcm []byte, sample_rate int) {
+	if atomic.LoadInt32(&vis_mode) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sample_rate = sample_rate
+	for i := 0; i+3 < len(pcm); i += 4 {
+		left := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		right := float64(int16(binary.LittleEndian.Uint16(pcm[i+2:])))
+		s.samples[s.next] = (left + right) / 2 / 32768
+		s.next = (s.next + 1) % VIS_SAMPLES
+	}
+}
+
+/**
+ * @return the samples held, oldest first, and their sample rate
+ */
+func (s *Scope) Snapshot() ([]float64, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	samples := make([]float64, VIS_SAMPLES)
+	copy(samples, s.samples[s.next:])
+	copy(samples[VIS_SAMPLES-s.next:], s.samples[:s.next])
+	return samples, s.sample_rate
+}
+
+/**
+ * An in-place radix-2 FFT
+ * @param x the signal, its length a power of two; replaced by its spectrum
+ */
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+/**
+ * @param samples the audio, VIS_SAMPLES of it
+ * @param sample_rate its sample rate
+ * @return the level of each of VIS_WIDTH bands, spaced evenly in pitch,
+ * from 0 for silent to 1 for full
+ */
+func spectrum_levels(samples []float64, sample_rate int) []float64 {
+	x := make([]complex128, len(samples))
+	for i, sample := range samples {
+		// a Hann window, so the edges of the block don't smear the spectrum
+		window := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(samples)-1))
+		x[i] = complex(sample*window, 0)
+	}
+	fft(x)
+
+	levels := make([]float64, VIS_WIDTH)
+	if sample_rate <= 0 {
+		return levels
+	}
+	bin_hz := float64(sample_rate) / float64(len(x))
+	max_freq := float64(sample_rate) / 2
+	for band := range levels {
+		low := VIS_MIN_FREQ * math.Pow(max_freq/VIS_MIN_FREQ, float64(band)/VIS_WIDTH)
+		high := VIS_MIN_FREQ * math.Pow(max_freq/VIS_MIN_FREQ, float64(band+1)/VIS_WIDTH)
+		first, last := int(low/bin_hz), int(high/bin_hz)
+		if last <= first {
+			last = first + 1
+		}
+		var peak float64
+		for bin := first; bin < last && bin < len(x)/2; bin++ {
+			peak = math.Max(peak, cmplx.Abs(x[bin]))
+		}
+		// a full scale sine peaks at a quarter of the samples, windowed
+		db := 20 * math.Log10(peak/(float64(len(x))/4)+1e-12)
+		levels[band] = math.Max(0, math.Min(1, 1+db/VIS_RANGE))
+	}
+	return levels
+}
+
+/**
+ * @param samples the audio, VIS_SAMPLES of it
+ * @return the loudest sample in each of VIS_WIDTH slices of it, from 0 to
+ * 1
+ */
+func waveform_levels(samples []float64) []float64 {
+	levels := make([]float64, VIS_WIDTH)
+	per := len(samples) / VIS_WIDTH
+	for column := range levels {
+		for _, sample := range samples[column*per : (column+1)*per] {
+			levels[column] = math.Max(levels[column], math.Abs(sample))
+		}
+	}
+	return levels
+}
+
+/**
+ * Draws levels as bars VIS_HEIGHT rows high, a column each
+ * @param levels from 0 to 1
+ * @return the rows, top first
+ */
+func draw_bars(levels []float64) []string {
+	rows := make([]string, VIS_HEIGHT)
+	for row := range rows {
+		var line strings.Builder
+		// the eighths of a cell filled below the top of this row
+		floor := (VIS_HEIGHT - 1 - row) * 8
+		for _, level := range levels {
+			eighths := int(level*VIS_HEIGHT*8) - floor
+			if eighths < 0 {
+				eighths = 0
+			}
+			if eighths > 8 {
+				eighths = 8
+			}
+			line.WriteRune(vis_blocks[eighths])
+		}
+		rows[row] = line.String()
+	}
+	return rows
+}
+
+/**
+ * @return the visualizer's rows as it should be drawn now, none if it is
+ * off
+ */
+func visualizer_rows() []string {
+	mode := get_vis_mode()
+	if mode == VIS_OFF {
+		return nil
+	}
+	samples, sample_rate := scope.Snapshot()
+	if mode == VIS_SPECTRUM {
+		return draw_bars(spectrum_levels(samples, sample_rate))
+	}
+	return draw_bars(waveform_levels(samples))
+}
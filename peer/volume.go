@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	MAX_VOLUME = 100
+	// how far VOL + and VOL - move the volume
+	VOLUME_STEP = 10
+)
+
+// current volume, 0 to MAX_VOLUME, read by the player for every chunk
+var volume int32 = MAX_VOLUME
+
+/**
+ * Sets the volume, clamped to 0..MAX_VOLUME, and remembers it in the
+ * config file
+ * @param v the new volume
+ * @return the volume actually set
+ */
+func set_volume(v int) int {
+	if v < 0 {
+		v = 0
+	}
+	if v > MAX_VOLUME {
+		v = MAX_VOLUME
+	}
+	atomic.StoreInt32(&volume, int32(v))
+	config.Volume = v
+	if err := save_config(); err != nil {
+		slog.Error("can't save volume", "err", err)
+	}
+	return v
+}
+
+/**
+ * @return the current volume
+ */
+func get_volume() int {
+	return int(atomic.LoadInt32(&volume))
+}
+
+/**
+ * Parses a VOLUME argument: a level from 0 to 100, or + / - to step it
+ * @param arg what the user typed
+ * @return the new volume, or an error if arg is none of those
+ */
+func parse_volume(arg string) (int, error) {
+	arg = strings.TrimSpace(arg)
+	switch arg {
+	case "+":
+		return get_volume() + VOLUME_STEP, nil
+	case "-":
+		return get_volume() - VOLUME_STEP, nil
+	}
+	v, err := strconv.Atoi(arg)
+	if err != nil || v < 0 || v > MAX_VOLUME {
+		return 0, fmt.Errorf("volume must be 0-100, + or -")
+	}
+	return v, nil
+}
+
+/**
+ * Scales 16 bit little-endian PCM samples in place by the volume. The
+ * gain follows the square of the volume, which sounds closer to even
+ * steps than a linear gain does
+ * @param pcm the decoded audio
+ * @param v the volume to apply
+ */
+func scale_pcm(pcm []byte, v int) {
+	if v >= MAX_VOLUME {
+		return
+	}
+	gain := v * v
+	const unity = MAX_VOLUME * MAX_VOLUME
+	for i := 0; i+1 < len(pcm); i += 2 {
+		sample := int(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(sample*gain/unity)))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+// how long the songs directory has to stay quiet before changes are picked
+// up, so a song still being copied in is only read once it's whole
+const WATCH_SETTLE = time.Second
+
+/**
+ * Watches the songs directory, keeping this peer's songs, its catalog and
+ * the tracker up to date as songs (or their .info files) are added,
+ * changed or deleted
+ * @param ctx cancelled when the peer shuts down
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ */
+func watch_songs(ctx context.Context, args []string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("can't watch for new songs", "err", err)
+		return
+	}
+	defer watcher.Close()
+	if err = watcher.Add(args[2]); err != nil {
+		slog.Warn("can't watch for new songs", "err", err)
+		return
+	}
+
+	pending := make(map[string]bool)
+	settle := time.NewTimer(WATCH_SETTLE)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := strings.TrimSuffix(filepath.Base(event.Name), ".info")
+			if event.Op == fsnotify.Chmod || song_format(name) == "" {
+				continue
+			}
+			pending[name] = true
+			settle.Reset(WATCH_SETTLE)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("error watching songs", "err", err)
+		case <-settle.C:
+			update_library(args, pending)
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+/**
+ * Rereads changed songs, replacing their old entries, and tells the
+ * tracker what was removed and added. A song that changed in place is
+ * removed and added again
+ * @param args cl arguments which contain the port and directory
+ * with songs
+ * @param names the filenames of the songs that changed
+ */
+func update_library(args []string, names map[string]bool) {
+	scanned := make(map[string]tsp.SongEntry)
+	for name := range names {
+		song, err := library_song(args[2], name)
+		if err == nil {
+			scanned[name] = song
+		} else if !os.IsNotExist(err) {
+			slog.Warn("can't read song", "file", name, "err", err)
+		}
+	}
+
+	var added, removed []tsp.SongEntry
+	master_mutex.Lock()
+	kept := make([]tsp.SongEntry, 0, len(local_songs))
+	for _, song := range local_songs {
+		if names[song.Sources[0].Filename] {
+			remove_from_catalog(song.Sources[0].FileID)
+			removed = append(removed, song)
+		} else {
+			kept = append(kept, song)
+		}
+	}
+	for _, song := range scanned {
+		song, err := add_to_catalog(args[2], song)
+		if err != nil {
+			slog.Warn("not serving a song", "err", err)
+			continue
+		}
+		song.Sources[0].PeerAddr = announced_addr(args)
+		song.Sources[0].Caps = local_caps()
+		song.Sources[0].Key = identity_key()
+		kept = append(kept, song)
+		added = append(added, song)
+	}
+	local_songs = kept
+	master_mutex.Unlock()
+
+	if len(added) > 0 || len(removed) > 0 {
+		slog.Info("songs directory changed", "added", len(added), "removed", len(removed))
+	}
+	update_tracker(tsp.REMOVE_SONG, removed)
+	update_tracker(tsp.ADD_SONG, added)
+}
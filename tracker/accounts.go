@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * Accounts: peers can register an account with a name and password, with
+ * an invite handed out by `tracker admin invite` if the tracker is started
+ * with --invite-only, and log in to it for a session token, which they
+ * send in the header of every request after. A tracker started with
+ * --locked turns away every request but AUTH (and ADMIN, only taken from
+ * its own host) without a live token with ERR_AUTH, and the REST API
+ * without one in an Authorization: Bearer header. Accounts, sessions and
+ * invites are kept in the registry, passwords only as bcrypt hashes. A
+ * tracker started with --ca also issues certificates, see ca.go.
+ *
+ * Connections to the tracker aren't encrypted, so passwords and tokens
+ * cross the network in the clear. Registering and logging in are only
+ * taken from the tracker's own host or network unless it is started with
+ * --insecure-auth; put it behind a VPN or TLS-terminating tunnel first
+ */
+
+const (
+	// how long a session lasts since it was last used
+	SESSION_TTL = 30 * 24 * time.Hour
+	// shortest password an account takes
+	MIN_PASSWORD = 8
+)
+
+/**
+ * An account, as kept in the registry
+ */
+type Account struct {
+	User    string
+	Hash    []byte
+	Created time.Time
+}
+
+/**
+ * A session, by its token, as kept in the registry
+ */
+type Session struct {
+	User    string
+	Expires time.Time
+}
+
+var (
+	// whether every request needs a session token, and whether an
+	// account can only be made with an invite
+	locked      bool
+	invite_only bool
+	// whether passwords are taken in the clear from beyond the local network
+	insecure_auth bool
+	// the accounts by name, the live sessions by token, and the invites
+	// not yet used with when each was made
+	accounts = make(map[string]Account)
+	sessions = make(map[string]Session)
+	invites  = make(map[string]time.Time)
+	// what an account's name can be
+	USER_NAME = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+	// one registration or login at a time, so guessing passwords is slow
+	auth_mutex sync.Mutex
+)
+
+/**
+ * Called with the master list locked
+ * @param token the session token in a request's header
+ * @return whether the request may be taken: the tracker isn't locked,
+ * or the token is of a live session, which it keeps alive
+ */
+func authorized(token string) bool {
+	if !locked {
+		return true
+	}
+	session, ok := sessions[token]
+	if !ok || token == "" {
+		return false
+	}
+	if time.Now().After(session.Expires) {
+		delete(sessions, token)
+		return false
+	}
+	session.Expires = time.Now().Add(SESSION_TTL)
+	sessions[token] = session
+	return true
+}
+
+/**
+ * handles an AUTH: registers an account and logs in to it, logs in or
+ * logs out, replying with the session or ERR_DENIED. Password hashes are
+ * worked out without the master list locked
+ * @param peer the Peer connection
+ * @param in_msg the request
+ * @param mutex Mutex for locking master song list
+ */
+func handle_auth(peer net.Conn, in_msg *tsp.Msg, mutex *sync.Mutex) {
+	request, err := tsp.DecodeAuth(in_msg.Msg)
+	if err != nil {
+		slog.Warn("bad auth request", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+	if request.Op != tsp.AUTH_LOGOUT && !insecure_auth && !on_local_network(remote_host(peer)) {
+		slog.Warn("turning away a password sent in the clear", "peer", peer.RemoteAddr(), "user", request.User)
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED,
+			"the tracker only takes passwords from its own network, as they aren't encrypted"))
+		return
+	}
+	key, signed := signer_key(in_msg)
+	if !signed {
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED, "bad or stale signature, check the clock"))
+		return
+	}
+	var session tsp.AuthSession
+	switch request.Op {
+	case tsp.AUTH_REGISTER:
+		session, err = register(request, mutex)
+	case tsp.AUTH_LOGIN:
+		session, err = login(request, mutex)
+	case tsp.AUTH_LOGOUT:
+		mutex.Lock()
+		delete(sessions, in_msg.Header.Token)
+		persist()
+		mutex.Unlock()
+	default:
+		err = fmt.Errorf("no such request %d", request.Op)
+	}
+	if err != nil {
+		slog.Info("auth turned down", "peer", peer.RemoteAddr(), "user", request.User, "err", err)
+		// so guessing passwords gets an address banned for a while
+		mutex.Lock()
+		strike(remote_host(peer))
+		mutex.Unlock()
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED, err.Error()))
+		return
+	}
+	if request.Op != tsp.AUTH_LOGOUT {
+		if err = issue_cert(&session, key); err != nil {
+			slog.Error("can't issue a certificate", "user", session.User, "err", err)
+		}
+	}
+	content, err := tsp.EncodeSession(session)
+	if err != nil {
+		slog.Error("can't encode a session", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.AUTH, 0, content)); err != nil {
+		slog.Warn("can't send a session", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
+
+/**
+ * Makes an account, using up its invite, and logs in to it
+ * @param request the account's name, password and invite
+ * @param mutex Mutex for locking master song list
+ * @return the new session
+ */
+func register(request tsp.AuthRequest, mutex *sync.Mutex) (tsp.AuthSession, error) {
+	if !USER_NAME.MatchString(request.User) {
+		return tsp.AuthSession{}, fmt.Errorf("a name takes 1 to 32 letters, digits, '_', '.' or '-'")
+	}
+	if len(request.Password) < MIN_PASSWORD {
+		return tsp.AuthSession{}, fmt.Errorf("a password takes at least %d characters", MIN_PASSWORD)
+	}
+	auth_mutex.Lock()
+	defer auth_mutex.Unlock()
+	hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return tsp.AuthSession{}, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, taken := accounts[request.User]; taken {
+		return tsp.AuthSession{}, fmt.Errorf("%s is taken", request.User)
+	}
+	if invite_only {
+		if _, ok := invites[request.Invite]; !ok || request.Invite == "" {
+			return tsp.AuthSession{}, fmt.Errorf("making an account takes an invite")
+		}
+		delete(invites, request.Invite)
+	}
+	accounts[request.User] = Account{User: request.User, Hash: hash, Created: time.Now()}
+	slog.Info("account registered", "user", request.User)
+	session := new_session(request.User)
+	persist()
+	return session, nil
+}
+
+/**
+ * Logs in to an account
+ * @param request the account's name and password
+ * @param mutex Mutex for locking master song list
+ * @return the new session
+ */
+func login(request tsp.AuthRequest, mutex *sync.Mutex) (tsp.AuthSession, error) {
+	auth_mutex.Lock()
+	defer auth_mutex.Unlock()
+	mutex.Lock()
+	account, ok := accounts[request.User]
+	mutex.Unlock()
+	if !ok {
+		// as slow as a wrong password, so names can't be told apart
+		bcrypt.CompareHashAndPassword(unknown_user_hash, []byte(request.Password))
+		return tsp.AuthSession{}, fmt.Errorf("wrong name or password")
+	}
+	if bcrypt.CompareHashAndPassword(account.Hash, []byte(request.Password)) != nil {
+		return tsp.AuthSession{}, fmt.Errorf("wrong name or password")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	session := new_session(request.User)
+	persist()
+	return session, nil
+}
+
+// compared against for names with no account
+var unknown_user_hash, _ = bcrypt.GenerateFromPassword([]byte("no such account"), bcrypt.DefaultCost)
+
+/**
+ * Called with the master list locked
+ * @param user the account
+ * @return a new session for it
+ */
+func new_session(user string) tsp.AuthSession {
+	token := random_token()
+	expires := time.Now().Add(SESSION_TTL)
+	sessions[token] = Session{User: user, Expires: expires}
+	return tsp.AuthSession{User: user, Token: token, Expires: expires}
+}
+
+/**
+ * @return 32 random bytes in hex, for a session token or an invite
+ */
+func random_token() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+/**
+ * Called with the master list locked
+ * @return a new invite, good for making one account
+ */
+func new_invite() string {
+	invite := random_token()
+	invites[invite] = time.Now()
+	return invite
+}
+
+/**
+ * Deletes an account and ends its sessions. Called with the master list
+ * locked
+ * @param user the account
+ * @return an error if there is no such account
+ */
+func delete_account(user string) error {
+	if _, ok := accounts[user]; !ok {
+		return fmt.Errorf("no account %s", user)
+	}
+	delete(accounts, user)
+	for token, session := range sessions {
+		if session.User == user {
+			delete(sessions, token)
+		}
+	}
+	return nil
+}
+
+/**
+ * Called with the master list locked
+ * @return the accounts, by name
+ */
+func account_list() []Account {
+	list := make([]Account, 0, len(accounts))
+	for _, account := range accounts {
+		list = append(list, account)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].User < list[j].User
+	})
+	return list
+}
+
+/**
+ * Called with the master list locked
+ * @param user an account
+ * @return how many live sessions it has
+ */
+func live_sessions(user string) int {
+	n := 0
+	now := time.Now()
+	for _, session := range sessions {
+		if session.User == user && now.Before(session.Expires) {
+			n++
+		}
+	}
+	return n
+}
+
+/**
+ * forgets the sessions that expired. Called with the master list locked
+ * @return whether any had
+ */
+func reap_sessions() bool {
+	now := time.Now()
+	reaped := false
+	for token, session := range sessions {
+		if now.After(session.Expires) {
+			delete(sessions, token)
+			reaped = true
+		}
+	}
+	return reaped
+}
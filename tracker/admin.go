@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Registry management. `tracker admin <host:port> <command>` sends the
+ * running tracker an ADMIN message, which it only takes from its own host,
+ * so bad entries can be cleaned up without restarting it. Banned addresses
+ * are kept in the registry, and every message from them is turned away
+ * with ERR_DENIED
+ */
+
+const ADMIN_USAGE = `commands:
+  peers           list the registered peers
+  remove <addr>   drop a peer (host:port) and its songs
+  ban <addr>      drop every peer at an IP address or CIDR range, and turn
+                  away anything they send from now on
+  unban <addr>    lift a ban, or a ban for going over the limits
+  bans            list the banned addresses, and those banned for a while
+                  for going over the limits
+  unshare <name>  delete a shared playlist
+  reports         list the songs peers reported corrupted or mislabeled,
+                  with the peers that served them
+  dismiss <id>    delete a report once it is dealt with
+  users           list the accounts
+  invite          make an invite, good for making one account
+  deluser <user>  delete an account and log it out
+  dump            print the registry as JSON
+  restore [file]  replace the registry with a dump, read from stdin if no
+                  file is given`
+
+// banned IP addresses and CIDR ranges
+var bans = make(map[string]bool)
+
+/**
+ * The whole registry, as dump prints it and restore takes it
+ */
+type RegistryDump struct {
+	Songs []tsp.SongEntry `json:"songs"`
+	Plays map[int]int     `json:"plays"`
+	// plays by hour since the epoch, then by song ID
+	HourlyPlays map[int64]map[int]int `json:"hourly_plays"`
+	Peers       map[string]time.Time  `json:"peers"`
+	Bans        []string              `json:"bans"`
+	// the shared playlists, with their songs
+	SharedPlaylists []tsp.SharedPlaylist `json:"shared_playlists"`
+	// the identity key each serving address is bound to
+	PeerKeys map[string][]byte `json:"peer_keys"`
+	// the songs reported, for the operator to review
+	Reports []FiledReport `json:"reports"`
+}
+
+/**
+ * Called with the master list locked
+ * @param host an IP address
+ * @return whether it is banned
+ */
+func is_banned(host string) bool {
+	if bans[host] {
+		return true
+	}
+	ip := net.ParseIP(host)
+	for ban := range bans {
+		if _, network, err := net.ParseCIDR(ban); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @param host an IP address
+ * @return whether it belongs to the machine the tracker runs on
+ */
+func is_local(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addrs {
+		if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @param host an IP address
+ * @return whether it is the tracker's own machine or on a private or
+ * link-local network, like the tracker's LAN
+ */
+func on_local_network(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast() || is_local(host))
+}
+
+// admin commands that only print, after which the registry isn't saved
+var admin_queries = map[string]bool{"peers": true, "bans": true, "reports": true, "users": true, "dump": true}
+
+/**
+ * Handles an ADMIN from the tracker's own host, replying with the
+ * command's output or an ERROR. Called with the master list locked
+ * @param peer the admin tool's connection
+ * @param content the body of the ADMIN
+ * @return whether a command changing the registry ran, and it needs saving
+ */
+func handle_admin(peer net.Conn, content []byte) bool {
+	var reply *tsp.Msg
+	changed := false
+	if !is_local(remote_host(peer)) {
+		slog.Warn("ADMIN from another host", "peer", peer.RemoteAddr())
+		reply = tsp.NewError(tsp.ERR_DENIED, "admin commands are only taken from the tracker's host")
+	} else if request, err := tsp.DecodeAdmin(content); err != nil {
+		reply = tsp.NewError(tsp.ERR_INTERNAL, "bad admin request: "+err.Error())
+	} else {
+		slog.Info("ADMIN", "command", request.Command, "args", request.Args)
+		output, err := run_admin_command(request)
+		if err != nil {
+			reply = tsp.NewError(tsp.ERR_INTERNAL, err.Error())
+		} else if body, err := tsp.EncodeAdmin(tsp.AdminMsg{Command: request.Command, Body: output}); err != nil {
+			reply = tsp.NewError(tsp.ERR_INTERNAL, err.Error())
+		} else {
+			reply = tsp.NewMsg(tsp.ADMIN, 0, body)
+		}
+		changed = err == nil && !admin_queries[request.Command]
+	}
+	if err := tsp.Encode(peer, reply); err != nil {
+		slog.Warn("can't reply to admin", "peer", peer.RemoteAddr(), "err", err)
+	}
+	return changed
+}
+
+/**
+ * Called with the master list locked
+ * @param request the command and its arguments
+ * @return what to print, or an error if the command failed
+ */
+func run_admin_command(request tsp.AdminMsg) ([]byte, error) {
+	var out bytes.Buffer
+	args := request.Args
+	switch request.Command {
+	case "peers":
+		for _, p := range api_peers() {
+			fmt.Fprintf(&out, "%-28s %3d songs  last seen %s ago\n", p.Addr, p.Songs, time.Since(p.LastSeen).Round(time.Second))
+		}
+	case "remove":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: remove <addr>")
+		}
+		if _, ok := last_seen[args[0]]; !ok {
+			return nil, fmt.Errorf("no peer %s", args[0])
+		}
+		drop_peer(args[0])
+		fmt.Fprintf(&out, "removed %s\n", args[0])
+	case "ban":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: ban <addr>")
+		}
+		ban, err := ban_key(args[0])
+		if err != nil {
+			return nil, err
+		}
+		bans[ban] = true
+		for addr := range last_seen {
+			if host, _, _ := net.SplitHostPort(addr); is_banned(host) {
+				drop_peer(addr)
+				fmt.Fprintf(&out, "removed %s\n", addr)
+			}
+		}
+		remove_sources(func(s tsp.SongSource) bool {
+			host, _, _ := net.SplitHostPort(s.PeerAddr)
+			return is_banned(host)
+		})
+		for addr := range dht_nodes {
+			if host, _, _ := net.SplitHostPort(addr); is_banned(host) {
+				delete(dht_nodes, addr)
+			}
+		}
+		drop_banned_relays()
+		fmt.Fprintf(&out, "banned %s\n", ban)
+	case "unban":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: unban <addr>")
+		}
+		ban, err := ban_key(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := temp_bans[ban]; !ok && !bans[ban] {
+			return nil, fmt.Errorf("%s isn't banned", ban)
+		}
+		delete(bans, ban)
+		delete(temp_bans, ban)
+		fmt.Fprintf(&out, "unbanned %s\n", ban)
+	case "bans":
+		for _, ban := range ban_list() {
+			fmt.Fprintln(&out, ban)
+		}
+		for _, host := range temp_ban_list() {
+			fmt.Fprintf(&out, "%s until %s\n", host, temp_bans[host].Format("15:04:05"))
+		}
+	case "unshare":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: unshare <name>")
+		}
+		if _, ok := shared_playlists[args[0]]; !ok {
+			return nil, fmt.Errorf("no shared playlist named %q", args[0])
+		}
+		delete(shared_playlists, args[0])
+		fmt.Fprintf(&out, "deleted %s\n", args[0])
+	case "reports":
+		write_reports(&out)
+	case "dismiss":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: dismiss <id>")
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+		if _, ok := reports[id]; err != nil || !ok {
+			return nil, fmt.Errorf("no report %s", args[0])
+		}
+		delete(reports, id)
+		fmt.Fprintf(&out, "dismissed #%d\n", id)
+	case "users":
+		for _, account := range account_list() {
+			fmt.Fprintf(&out, "%-32s registered %s  %d sessions\n", account.User,
+				account.Created.Format("2006-01-02"), live_sessions(account.User))
+		}
+	case "invite":
+		fmt.Fprintln(&out, new_invite())
+	case "deluser":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: deluser <user>")
+		}
+		if err := delete_account(args[0]); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&out, "deleted %s\n", args[0])
+	case "dump":
+		dump := RegistryDump{Songs: info, Plays: plays, HourlyPlays: hourly_plays, Peers: last_seen, Bans: ban_list(),
+			PeerKeys: peer_keys, Reports: report_list()}
+		for _, playlist := range shared_playlists {
+			dump.SharedPlaylists = append(dump.SharedPlaylists, *playlist)
+		}
+		encoder := json.NewEncoder(&out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(dump); err != nil {
+			return nil, err
+		}
+	case "restore":
+		var dump RegistryDump
+		if err := json.Unmarshal(request.Body, &dump); err != nil {
+			return nil, fmt.Errorf("bad dump: %v", err)
+		}
+		restore_registry(dump)
+		fmt.Fprintf(&out, "restored %d songs, %d peers, %d bans\n", len(info), len(last_seen), len(bans))
+	default:
+		return nil, fmt.Errorf("unknown command %q\n%s", request.Command, ADMIN_USAGE)
+	}
+	return out.Bytes(), nil
+}
+
+/**
+ * @param addr an IP address, host:port or CIDR range
+ * @return what to ban it under: the IP address, or the range
+ */
+func ban_key(addr string) (string, error) {
+	if _, network, err := net.ParseCIDR(addr); err == nil {
+		return network.String(), nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("%s isn't an IP address or CIDR range", addr)
+	}
+	return ip.String(), nil
+}
+
+/**
+ * Called with the master list locked
+ * @return the banned addresses, sorted
+ */
+func ban_list() []string {
+	list := make([]string, 0, len(bans))
+	for ban := range bans {
+		list = append(list, ban)
+	}
+	sort.Strings(list)
+	return list
+}
+
+/**
+ * Called with the master list locked
+ * @return the addresses banned for a while, sorted
+ */
+func temp_ban_list() []string {
+	list := make([]string, 0, len(temp_bans))
+	for host := range temp_bans {
+		list = append(list, host)
+	}
+	sort.Strings(list)
+	return list
+}
+
+/**
+ * Hangs up on banned peers registered for relays. Called with the master
+ * list locked
+ */
+func drop_banned_relays() {
+	relay_mutex.Lock()
+	defer relay_mutex.Unlock()
+	for addr, conn := range relay_peers {
+		if host, _, _ := net.SplitHostPort(addr); is_banned(host) {
+			conn.Close()
+		}
+	}
+}
+
+/**
+ * Replaces the registry with a dump. Called with the master list locked
+ * @param dump the registry to restore
+ */
+func restore_registry(dump RegistryDump) {
+	info = dump.Songs
+	if info == nil {
+		info = make([]tsp.SongEntry, 0)
+	}
+	plays = make(map[int]int)
+	for id, n := range dump.Plays {
+		plays[id] = n
+	}
+	hourly_plays = make(map[int64]map[int]int)
+	for hour, songs := range dump.HourlyPlays {
+		hourly_plays[hour] = make(map[int]int)
+		for id, n := range songs {
+			hourly_plays[hour][id] = n
+		}
+	}
+	last_seen = make(map[string]time.Time)
+	for addr, seen := range dump.Peers {
+		last_seen[addr] = seen
+	}
+	peer_keys = make(map[string][]byte)
+	for addr, key := range dump.PeerKeys {
+		peer_keys[addr] = key
+	}
+	bans = make(map[string]bool)
+	for _, ban := range dump.Bans {
+		if key, err := ban_key(ban); err == nil {
+			bans[key] = true
+		}
+	}
+	shared_playlists = make(map[string]*tsp.SharedPlaylist)
+	for i := range dump.SharedPlaylists {
+		playlist := dump.SharedPlaylists[i]
+		shared_playlists[playlist.Name] = &playlist
+	}
+	set_reports(dump.Reports)
+	rekey_songs()
+}
+
+/**
+ * Runs `tracker admin`: sends a command to a running tracker and prints
+ * what it answers
+ * @param args the tracker's address, the command and its arguments
+ * @return the exit status
+ */
+func admin(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: tracker admin <host:port> <command> [args]")
+		fmt.Fprintln(os.Stderr, ADMIN_USAGE)
+		return 1
+	}
+	request := tsp.AdminMsg{Command: args[1], Args: args[2:]}
+	if request.Command == "restore" {
+		var err error
+		if len(request.Args) > 0 {
+			request.Body, err = os.ReadFile(request.Args[0])
+		} else {
+			request.Body, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "can't read the dump:", err)
+			return 1
+		}
+		request.Args = nil
+	}
+	content, err := tsp.EncodeAdmin(request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	conn, err := net.DialTimeout("tcp", args[0], io_timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't reach the tracker:", err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(io_timeout))
+	if err = tsp.Encode(conn, tsp.NewMsg(tsp.ADMIN, 0, content)); err != nil {
+		fmt.Fprintln(os.Stderr, "can't send the command:", err)
+		return 1
+	}
+	reply, err := tsp.Decode(conn)
+	if err == nil {
+		err = reply.Err()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(err.Error()))
+		return 1
+	}
+	answer, err := tsp.DecodeAdmin(reply.Msg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad reply:", err)
+		return 1
+	}
+	os.Stdout.Write(answer.Body)
+	return 0
+}
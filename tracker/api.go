@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+// largest POST /announce body read
+const MAX_ANNOUNCE_BYTES = 1 << 20
+
+/**
+ * A song as the REST API lists it
+ */
+type ApiSong struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Genre  string `json:"genre"`
+	// in seconds, 0 if unknown
+	Duration float64 `json:"duration"`
+	Plays    int     `json:"plays"`
+	// the song shown in place of this one, another encode of it
+	DuplicateOf int         `json:"duplicate_of,omitempty"`
+	Sources     []ApiSource `json:"sources"`
+}
+
+/**
+ * A song in the charts, as the REST API lists it
+ */
+type ApiChartEntry struct {
+	// plays over the period asked for
+	Plays int     `json:"plays"`
+	Song  ApiSong `json:"song"`
+}
+
+/**
+ * A peer serving a song, as the REST API lists it
+ */
+type ApiSource struct {
+	Peer     string `json:"peer"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+	Format   string `json:"format"`
+	FileID   int    `json:"file_id"`
+	QUIC     bool   `json:"quic,omitempty"`
+	Partial  bool   `json:"partial,omitempty"`
+}
+
+/**
+ * A registered peer, as the REST API lists it
+ */
+type ApiPeer struct {
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+	Songs    int       `json:"songs"`
+}
+
+/**
+ * A live broadcast, as the REST API lists it
+ */
+type ApiBroadcast struct {
+	Name      string    `json:"name"`
+	Peer      string    `json:"peer"`
+	Song      string    `json:"song"`
+	Listeners int       `json:"listeners"`
+	Started   time.Time `json:"started"`
+}
+
+/**
+ * A listening party, as the REST API lists it
+ */
+type ApiParty struct {
+	Name    string    `json:"name"`
+	Host    string    `json:"host"`
+	Song    string    `json:"song"`
+	Playing bool      `json:"playing"`
+	Members int       `json:"members"`
+	Started time.Time `json:"started"`
+}
+
+/**
+ * A shared playlist, as the REST API lists it, with its songs only when
+ * asked for by name
+ */
+type ApiSharedPlaylist struct {
+	Name      string           `json:"name"`
+	CreatedBy string           `json:"created_by"`
+	Created   time.Time        `json:"created"`
+	Songs     int              `json:"songs"`
+	Entries   []ApiSharedEntry `json:"entries,omitempty"`
+}
+
+/**
+ * A song in a shared playlist, as the REST API lists it
+ */
+type ApiSharedEntry struct {
+	ID      int       `json:"id"`
+	Title   string    `json:"title"`
+	Artist  string    `json:"artist"`
+	AddedBy string    `json:"added_by"`
+	Added   time.Time `json:"added"`
+}
+
+/**
+ * The body of a POST /announce: the peer's serving address, of which
+ * only the port is trusted, and its songs, each with the peer's source
+ */
+type Announcement struct {
+	Addr  string `json:"addr"`
+	Songs []struct {
+		Title    string  `json:"title"`
+		Artist   string  `json:"artist"`
+		Album    string  `json:"album"`
+		Genre    string  `json:"genre"`
+		Duration float64 `json:"duration"`
+		ApiSource
+	} `json:"songs"`
+}
+
+/**
+ * Serves the registry over HTTP as JSON, for clients that don't speak
+ * TSP:
+ *   GET /songs       the master list
+ *   GET /songs/{id}  one song
+ *   GET /charts?period=day|week
+ *                    the songs played most over the last day or week
+ *   GET /peers       the registered peers
+ *   GET /broadcasts  the live broadcasts going on between peers
+ *   GET /parties     the listening parties going on between peers
+ *   GET /playlists   the shared playlists
+ *   GET /playlists/<name>
+ *                    a shared playlist and its songs, with who added them
+ *   POST /announce   registers songs like an INIT, and counts as a
+ *                    heartbeat
+ * A tracker started with --locked answers 401 to requests without a
+ * session token in an Authorization: Bearer header
+ * @param addr the address to listen on, e.g. ":8090"
+ * @param mutex Mutex for locking master song list
+ */
+func serve_api(addr string, mutex *sync.Mutex) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/songs", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		songs := api_songs(info)
+		mutex.Unlock()
+		write_json(w, http.StatusOK, songs)
+	})
+	mux.HandleFunc("/songs/", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/songs/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		mutex.Lock()
+		var songs []ApiSong
+		for _, song := range info {
+			if song.ID == id {
+				songs = api_songs([]tsp.SongEntry{song})
+			}
+		}
+		mutex.Unlock()
+		if len(songs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		write_json(w, http.StatusOK, songs[0])
+	})
+	mux.HandleFunc("/charts", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = tsp.CHART_WEEK
+		}
+		mutex.Lock()
+		entries, ok := chart(period, nil)
+		list := make([]ApiChartEntry, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, ApiChartEntry{Plays: entry.Plays, Song: api_songs([]tsp.SongEntry{entry.Song})[0]})
+		}
+		mutex.Unlock()
+		if !ok {
+			http.Error(w, "period must be day or week", http.StatusBadRequest)
+			return
+		}
+		write_json(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		peers := api_peers()
+		mutex.Unlock()
+		write_json(w, http.StatusOK, peers)
+	})
+	mux.HandleFunc("/broadcasts", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		live := live_broadcasts()
+		mutex.Unlock()
+		list := make([]ApiBroadcast, 0, len(live))
+		for _, broadcast := range live {
+			list = append(list, ApiBroadcast{broadcast.Name, broadcast.Addr, broadcast.Song, broadcast.Listeners, broadcast.Started})
+		}
+		write_json(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/parties", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		live := live_parties()
+		mutex.Unlock()
+		list := make([]ApiParty, 0, len(live))
+		for _, party := range live {
+			song := ""
+			if party.Song.ID != 0 {
+				song = party.Song.Artist + " - " + party.Song.Title
+			}
+			list = append(list, ApiParty{party.Name, party.Host, song, party.Playing, party.Members, party.Started})
+		}
+		write_json(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/playlists", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		shared := list_shared()
+		mutex.Unlock()
+		list := make([]ApiSharedPlaylist, 0, len(shared))
+		for _, playlist := range shared {
+			list = append(list, ApiSharedPlaylist{playlist.Name, playlist.CreatedBy, playlist.Created, playlist.Version, nil})
+		}
+		write_json(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/playlists/", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodGet) {
+			return
+		}
+		mutex.Lock()
+		playlist, ok := shared_playlists[strings.TrimPrefix(r.URL.Path, "/playlists/")]
+		var list ApiSharedPlaylist
+		if ok {
+			list = ApiSharedPlaylist{playlist.Name, playlist.CreatedBy, playlist.Created, playlist.Version,
+				make([]ApiSharedEntry, 0, len(playlist.Entries))}
+			for _, entry := range playlist.Entries {
+				list.Entries = append(list.Entries, ApiSharedEntry{entry.Song.ID, entry.Song.Title, entry.Song.Artist,
+					entry.AddedBy, entry.Added})
+			}
+		}
+		mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write_json(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		if !allow_method(w, r, http.MethodPost) {
+			return
+		}
+		announce(w, r, mutex)
+	})
+	server := &http.Server{Addr: addr, Handler: rate_limit(require_session(mux, mutex), mutex), ReadHeaderTimeout: io_timeout, WriteTimeout: io_timeout}
+	slog.Info("REST API listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil {
+		slog.Error("can't serve the REST API", "addr", addr, "err", err)
+	}
+}
+
+/**
+ * Turns away requests without a live session token, if the tracker is
+ * locked
+ * @param next the API
+ * @param mutex Mutex for locking master song list
+ * @return the API behind the check
+ */
+func require_session(next http.Handler, mutex *sync.Mutex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		mutex.Lock()
+		ok := authorized(strings.TrimSpace(token))
+		mutex.Unlock()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Turns away requests from banned addresses, by the operator or for a
+ * while, and announcements
+ * and song lists over their address's limits, see limits.go
+ * @param next the API
+ * @param mutex Mutex for locking master song list
+ * @return the API behind the check
+ */
+func rate_limit(next http.Handler, mutex *sync.Mutex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		// counted as the TSP request it stands in for, if any
+		var t byte
+		counted := true
+		switch {
+		case r.URL.Path == "/announce":
+			t = tsp.ADD_SONG
+		case r.URL.Path == "/songs" || strings.HasPrefix(r.URL.Path, "/songs/") || r.URL.Path == "/charts":
+			t = tsp.LIST
+		default:
+			counted = false
+		}
+		mutex.Lock()
+		banned := is_banned(host) || temp_banned(host)
+		limited := !banned && counted && over_limit(host, t)
+		mutex.Unlock()
+		if banned {
+			http.Error(w, "banned", http.StatusForbidden)
+			return
+		}
+		if limited {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Turns away requests with the wrong method
+ * @return whether the request has the method
+ */
+func allow_method(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+/**
+ * Answers with a value as JSON
+ * @param w the response
+ * @param status the HTTP status
+ * @param value what to encode
+ */
+func write_json(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Warn("can't write API response", "err", err)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @param songs songs from the master list
+ * @return them as the API lists them, without the sources only some
+ * peers may see
+ */
+func api_songs(songs []tsp.SongEntry) []ApiSong {
+	list := make([]ApiSong, 0, len(songs))
+	for _, song := range tsp.VisibleSongs(songs, nil) {
+		entry := ApiSong{
+			ID:          song.ID,
+			Title:       song.Title,
+			Artist:      song.Artist,
+			Album:       song.Album,
+			Genre:       song.Genre,
+			Duration:    song.Duration.Seconds(),
+			Plays:       plays[song.ID],
+			DuplicateOf: song.DuplicateOf,
+			Sources:     make([]ApiSource, 0, len(song.Sources)),
+		}
+		for _, s := range song.Sources {
+			entry.Sources = append(entry.Sources, ApiSource{
+				Peer:     s.PeerAddr,
+				Filename: s.Filename,
+				Size:     s.Size,
+				Hash:     s.Hash,
+				Format:   s.Format,
+				FileID:   s.FileID,
+				QUIC:     s.Caps&tsp.CAP_QUIC != 0,
+				Partial:  s.Partial,
+			})
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+/**
+ * Called with the master list locked
+ * @return every registered peer, by address, with how many songs it serves
+ */
+func api_peers() []ApiPeer {
+	songs := make(map[string]int)
+	for _, song := range info {
+		for _, s := range song.Sources {
+			songs[s.PeerAddr]++
+		}
+	}
+	peers := make([]ApiPeer, 0, len(last_seen))
+	for addr, seen := range last_seen {
+		peers = append(peers, ApiPeer{Addr: addr, LastSeen: seen, Songs: songs[addr]})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+	return peers
+}
+
+/**
+ * Handles a POST /announce: registers the songs under the port the peer
+ * claims, at the address the request came from, and answers with them as
+ * they now are in the master list
+ * @param mutex Mutex for locking master song list
+ */
+func announce(w http.ResponseWriter, r *http.Request, mutex *sync.Mutex) {
+	var body Announcement
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_ANNOUNCE_BYTES))
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "bad announcement: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(body.Addr); err != nil {
+		http.Error(w, "addr must be host:port or :port", http.StatusBadRequest)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr := serving_addr(host, body.Addr)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if is_banned(host) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+	// can't be signed, so it can't be for a peer with an identity key
+	if !key_matches(addr, nil) {
+		http.Error(w, addr+" is another peer's", http.StatusForbidden)
+		return
+	}
+	last_seen[addr] = time.Now()
+	added := make(map[int]bool)
+	changed := false
+	served := songs_served(addr)
+	over := 0
+	for _, s := range body.Songs {
+		if s.Title == "" {
+			continue
+		}
+		song := tsp.SongEntry{
+			Title:    s.Title,
+			Artist:   s.Artist,
+			Album:    s.Album,
+			Genre:    s.Genre,
+			Duration: time.Duration(s.Duration * float64(time.Second)),
+		}
+		source := tsp.SongSource{
+			PeerAddr: addr,
+			Filename: s.Filename,
+			Size:     s.Size,
+			Hash:     s.Hash,
+			Format:   s.Format,
+			FileID:   s.FileID,
+			Partial:  s.Partial,
+		}
+		if s.QUIC {
+			source.Caps |= tsp.CAP_QUIC
+		}
+		if !within_quota(served, tsp.SongID(song, source)) {
+			over++
+			continue
+		}
+		id, song_changed := add_source(song, source)
+		added[id] = true
+		changed = changed || song_changed
+	}
+	if over > 0 {
+		slog.Warn("songs over the peer's quota left out", "peer", addr, "songs", over, "quota", max_songs)
+		strike(host)
+	}
+	if changed {
+		persist()
+	}
+	slog.Info("announce over HTTP", "peer", addr, "songs", len(added))
+
+	var registered []tsp.SongEntry
+	for _, song := range info {
+		if added[song.ID] {
+			registered = append(registered, song)
+		}
+	}
+	write_json(w, http.StatusOK, api_songs(registered))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The live broadcasts going on between peers. A peer on the air announces
+ * its broadcast with a BROADCAST every heartbeat and whenever the song
+ * changes, and once more when it goes off the air; peers ask for the list
+ * with an empty BROADCAST. Broadcasts are only kept in memory: one not
+ * announced for MISSED_HEARTBEATS heartbeats, or whose peer is dropped, is
+ * over
+ */
+
+var (
+	// the broadcasts going on, by the serving address of the peer on the
+	// air, and when each was last announced
+	broadcasts     = make(map[string]tsp.BroadcastInfo)
+	broadcast_seen = make(map[string]time.Time)
+)
+
+/**
+ * handles a BROADCAST: records or ends the peer's broadcast, or with no
+ * body, replies with the broadcasts going on
+ * @param peer the Peer connection
+ * @param content the body of the BROADCAST
+ */
+func handle_broadcast(peer net.Conn, content []byte) {
+	if len(content) == 0 {
+		send_broadcasts(peer)
+		return
+	}
+	broadcast, err := tsp.DecodeBroadcast(content)
+	if err != nil {
+		slog.Warn("bad broadcast announcement", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+	broadcast.Addr = peer_addr(peer, broadcast.Addr)
+	if !broadcast.Live {
+		if _, ok := broadcasts[broadcast.Addr]; ok {
+			slog.Info("broadcast over", "peer", broadcast.Addr, "name", broadcast.Name)
+		}
+		end_broadcast(broadcast.Addr)
+		return
+	}
+	if _, ok := broadcasts[broadcast.Addr]; !ok {
+		slog.Info("broadcast on the air", "peer", broadcast.Addr, "name", broadcast.Name)
+	}
+	broadcasts[broadcast.Addr] = broadcast
+	broadcast_seen[broadcast.Addr] = time.Now()
+}
+
+/**
+ * sends the peer the broadcasts going on, the longest running first
+ * @param peer the Peer connection
+ */
+func send_broadcasts(peer net.Conn) {
+	content, err := tsp.EncodeBroadcasts(live_broadcasts())
+	if err != nil {
+		slog.Error("can't encode broadcasts", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.BROADCAST, 0, content)); err != nil {
+		slog.Warn("can't send broadcasts", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @return the broadcasts going on, the longest running first
+ */
+func live_broadcasts() []tsp.BroadcastInfo {
+	list := make([]tsp.BroadcastInfo, 0, len(broadcasts))
+	for _, broadcast := range broadcasts {
+		list = append(list, broadcast)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+/**
+ * forgets the broadcast of a peer, if it has one
+ * @param addr the peer's serving address
+ */
+func end_broadcast(addr string) {
+	delete(broadcasts, addr)
+	delete(broadcast_seen, addr)
+}
+
+/**
+ * ends the broadcasts not announced since deadline
+ * @param deadline when the last announcement must have been after
+ */
+func reap_broadcasts(deadline time.Time) {
+	for addr, seen := range broadcast_seen {
+		if seen.Before(deadline) {
+			slog.Info("broadcast went quiet", "peer", addr)
+			end_broadcast(addr)
+		}
+	}
+}
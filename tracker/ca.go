@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The tracker as a certificate authority, for closed groups whose peers
+ * stream to each other over mutual TLS. Started with --ca <file>, which
+ * takes --invite-only so only accounts the operator invited are let in,
+ * the tracker keeps a CA key and certificate in the file, made the first
+ * time, and answers every registration or login signed with a peer's
+ * identity key with a certificate for that key, naming the account and
+ * good for SESSION_TTL. Peers started with --mtls only take connections from, and
+ * only connect to, peers holding a certificate it issued. Deleting an
+ * account doesn't take back its certificate, which works until it expires
+ */
+
+const (
+	// how long the CA certificate made for a new file is good for
+	CA_TTL = 10 * 365 * 24 * time.Hour
+	// PEM block types in the CA file
+	PEM_CERT = "CERTIFICATE"
+	PEM_KEY  = "PRIVATE KEY"
+)
+
+var (
+	// the CA's certificate and key, nil if the tracker isn't a CA
+	ca_cert *x509.Certificate
+	ca_key  ed25519.PrivateKey
+)
+
+/**
+ * Reads the CA kept in a file, making one and saving it there if there is
+ * none yet
+ * @param path the file, holding the certificate and the key in PEM
+ * @return an error if it can't be read or saved
+ */
+func load_ca(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		content, err = make_ca(path)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		var block *pem.Block
+		if block, content = pem.Decode(content); block == nil {
+			break
+		}
+		switch block.Type {
+		case PEM_CERT:
+			if ca_cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return err
+			}
+		case PEM_KEY:
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			ed_key, ok := key.(ed25519.PrivateKey)
+			if !ok {
+				return fmt.Errorf("%s doesn't hold an ed25519 key", path)
+			}
+			ca_key = ed_key
+		}
+	}
+	if ca_cert == nil || ca_key == nil {
+		return fmt.Errorf("%s doesn't hold a CA certificate and key", path)
+	}
+	slog.Info("issuing peer certificates", "ca", path, "until", ca_cert.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+/**
+ * Makes a CA key and a self-signed certificate for it, and saves them
+ * @param path the file to save them in, only readable by the owner
+ * @return the file's content
+ */
+func make_ca(path string) ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := cert_serial()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Torero tracker CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CA_TTL),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: PEM_CERT, Bytes: der})
+	content = append(content, pem.EncodeToMemory(&pem.Block{Type: PEM_KEY, Bytes: pkcs8})...)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// whoever has the key can let anyone in to the group
+	if err = os.WriteFile(path, content, 0600); err != nil {
+		return nil, err
+	}
+	slog.Info("made a CA for peer certificates", "path", path)
+	return content, nil
+}
+
+/**
+ * @return a random serial number for a certificate
+ */
+func cert_serial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+/**
+ * Issues a certificate to a peer logged in to an account, if the tracker
+ * is a CA and the AUTH was signed
+ * @param session the session the AUTH started, which the certificate and
+ * the CA's are added to
+ * @param key the identity key the AUTH is signed with, nil if unsigned
+ * @return an error if the certificate can't be made
+ */
+func issue_cert(session *tsp.AuthSession, key []byte) error {
+	if ca_cert == nil || len(key) != ed25519.PublicKeySize {
+		return nil
+	}
+	serial, err := cert_serial()
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: session.User},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(SESSION_TTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca_cert, ed25519.PublicKey(key), ca_key)
+	if err != nil {
+		return err
+	}
+	session.Cert, session.CA = der, ca_cert.Raw
+	slog.Info("certificate issued", "user", session.User, "until", template.NotAfter.Format("2006-01-02"))
+	return nil
+}
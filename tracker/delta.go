@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"log/slog"
+	"net"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Delta lists. Every change to the master list bumps the registry's
+ * version, and the version each song last changed at is kept, along with
+ * the songs dropped. A peer holding the list as of some version sends
+ * LIST_SINCE with it and gets back only what changed, rather than the
+ * whole list. The epoch names the registry the versions belong to, so a
+ * version from a tracker whose database was replaced gets the full list
+ */
+
+// most dropped songs remembered, older ones make LIST_SINCE from before
+// them answer with the full list
+const MAX_REMOVED = 10000
+
+// all guarded by the master list mutex
+var (
+	registry_epoch   string
+	registry_version int64
+	// the oldest version LIST_SINCE can answer with a delta
+	oldest_delta int64
+	// the version each song in the master list last changed at, by ID
+	song_versions = make(map[int]int64)
+	// each song as it was at that version, gob encoded, to tell changes by
+	song_snapshots = make(map[int][]byte)
+	// the version each dropped song was dropped at, by ID
+	removed_songs = make(map[int]int64)
+)
+
+/**
+ * @return a new random epoch
+ */
+func new_epoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/**
+ * Takes the loaded master list as the registry's current version, with no
+ * changes known before it
+ */
+func start_versions() {
+	if registry_epoch == "" {
+		registry_epoch = new_epoch()
+	}
+	oldest_delta = registry_version
+	for _, song := range info {
+		song_versions[song.ID] = registry_version
+		song_snapshots[song.ID] = snapshot(song)
+	}
+}
+
+/**
+ * @return the song gob encoded, empty if it can't be
+ */
+func snapshot(song tsp.SongEntry) []byte {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(song)
+	return buf.Bytes()
+}
+
+/**
+ * Bumps the registry's version if the master list changed since the last
+ * call, recording which songs changed or were dropped. Called with the
+ * master list locked, after every change
+ */
+func note_changes() {
+	version := registry_version + 1
+	changed := false
+	current := make(map[int]bool, len(info))
+	for _, song := range info {
+		current[song.ID] = true
+		snap := snapshot(song)
+		if old, ok := song_snapshots[song.ID]; ok && bytes.Equal(old, snap) {
+			continue
+		}
+		song_snapshots[song.ID] = snap
+		song_versions[song.ID] = version
+		delete(removed_songs, song.ID)
+		changed = true
+	}
+	for id := range song_versions {
+		if !current[id] {
+			delete(song_versions, id)
+			delete(song_snapshots, id)
+			removed_songs[id] = version
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	registry_version = version
+	for len(removed_songs) > MAX_REMOVED {
+		oldest := 0
+		for id, v := range removed_songs {
+			if oldest == 0 || v < removed_songs[oldest] {
+				oldest = id
+			}
+		}
+		if removed_songs[oldest] > oldest_delta {
+			oldest_delta = removed_songs[oldest]
+		}
+		delete(removed_songs, oldest)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @param epoch the registry the peer's version belongs to
+ * @param since the version of the master list the peer has
+ * @return what changed since, or the whole list if that can't be told
+ */
+func list_delta(epoch string, since int64) tsp.ListDelta {
+	delta := tsp.ListDelta{Epoch: registry_epoch, Version: registry_version, Songs: make([]tsp.SongEntry, 0)}
+	if epoch != registry_epoch || since < oldest_delta || since > registry_version {
+		delta.Full = true
+		delta.Songs = info
+		return delta
+	}
+	for _, song := range info {
+		if song_versions[song.ID] > since {
+			delta.Songs = append(delta.Songs, song)
+		}
+	}
+	for id, v := range removed_songs {
+		if v > since {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	return delta
+}
+
+/**
+ * @param delta the changes to the master list
+ * @param key the identity key of the peer asking, nil if unknown
+ * @return the changes with only the sources that peer may see, songs it
+ * may see none of counted as dropped
+ */
+func visible_delta(delta tsp.ListDelta, key []byte) tsp.ListDelta {
+	songs := make([]tsp.SongEntry, 0, len(delta.Songs))
+	for _, song := range delta.Songs {
+		if visible, ok := tsp.VisibleSong(song, key); ok {
+			songs = append(songs, visible)
+		} else if !delta.Full {
+			delta.Removed = append(delta.Removed, song.ID)
+		}
+	}
+	delta.Songs = songs
+	return delta
+}
+
+/**
+ * sends the peer the changes to the master list since the version it has
+ * @param peer the Peer connection
+ * @param in_msg the LIST_SINCE, carrying the version as its offset and the
+ * epoch as its body
+ * @param key the identity key the request is signed with, nil if unsigned
+ */
+func send_list_delta(peer net.Conn, in_msg *tsp.Msg, key []byte) {
+	delta := visible_delta(list_delta(string(in_msg.Msg), in_msg.Header.Offset), key)
+	content, err := tsp.EncodeDelta(delta)
+	if err != nil {
+		slog.Error("can't encode list delta", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.LIST_SINCE, 0, content)); err != nil {
+		slog.Warn("can't send list delta", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
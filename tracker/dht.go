@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// most nodes a DHT_BOOTSTRAP reply lists
+	BOOTSTRAP_NODES = 16
+	// how long a DHT node is handed out after it last asked for nodes
+	DHT_NODE_TTL = time.Hour
+)
+
+/**
+ * A peer taking part in the DHT, as last heard from
+ */
+type DHTNode struct {
+	node tsp.DHTNode
+	seen time.Time
+}
+
+// the DHT nodes that asked for bootstrap nodes, by serving address,
+// guarded by the master list mutex. The tracker takes no other part in
+// the DHT
+var dht_nodes = make(map[string]DHTNode)
+
+/**
+ * records a DHT_BOOTSTRAP from a peer, and sends it the nodes heard from
+ * most recently to join the DHT through
+ * @param peer the Peer connection
+ * @param content the request, carrying the peer's node
+ */
+func dht_bootstrap(peer net.Conn, content []byte) {
+	request, err := tsp.DecodeDHT(content)
+	if err != nil {
+		slog.Warn("bad DHT request", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+	var self string
+	if request.From.Addr != "" {
+		self = peer_addr(peer, request.From.Addr)
+		dht_nodes[self] = DHTNode{tsp.DHTNode{ID: request.From.ID, Addr: self}, time.Now()}
+	}
+
+	known := make([]DHTNode, 0, len(dht_nodes))
+	for addr, node := range dht_nodes {
+		if time.Since(node.seen) > DHT_NODE_TTL {
+			delete(dht_nodes, addr)
+		} else if addr != self {
+			known = append(known, node)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].seen.After(known[j].seen)
+	})
+	var reply tsp.DHTMsg
+	for i := 0; i < len(known) && i < BOOTSTRAP_NODES; i++ {
+		reply.Nodes = append(reply.Nodes, known[i].node)
+	}
+	content, err = tsp.EncodeDHT(reply)
+	if err != nil {
+		slog.Error("can't encode DHT nodes", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.DHT_BOOTSTRAP, 0, content)); err != nil {
+		slog.Warn("can't send DHT nodes", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
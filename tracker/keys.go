@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Peer identities: version 20 peers sign their announcements (INIT,
+ * ADD_SONG, REMOVE_SONG, HEARTBEAT, QUIT and PRESENCE) with their identity
+ * key. The first signed announcement for a serving address binds the key
+ * to it until the peer is dropped, and from then on announcements for that
+ * address signed with another key, or not signed at all, are ignored, so
+ * a peer can't pass for another one behind the same IP address. The key
+ * goes on the peer's sources in the master list, for clients to check its
+ * replies to PLAY against. Signatures carry when they were made, and are
+ * only taken within tsp.MAX_SIGNATURE_AGE and once, so a captured
+ * announcement can't be sent again to claim the key's address
+ */
+
+var (
+	// the identity key each serving address is bound to, in the registry
+	peer_keys = make(map[string][]byte)
+	// the signatures taken lately, so none can be sent again
+	signature_guard = tsp.NewReplayGuard()
+)
+
+/**
+ * @param in_msg a message from a peer
+ * @return the identity key the message is signed with, nil if it isn't
+ * signed or is signed by a peer before version 24, which could be a
+ * replay; and false if the signature is bad, stale or was seen before
+ */
+func signer_key(in_msg *tsp.Msg) ([]byte, bool) {
+	if len(in_msg.Header.Signature) == 0 {
+		return nil, true
+	}
+	if !tsp.Verify(in_msg, nil) {
+		return nil, false
+	}
+	if in_msg.Header.Signed == 0 {
+		return nil, true
+	}
+	if !signature_guard.Take(in_msg) {
+		slog.Warn("stale or replayed signature", "key", hex.EncodeToString(in_msg.Header.Key),
+			"signed", time.Unix(0, in_msg.Header.Signed))
+		return nil, false
+	}
+	return in_msg.Header.Key, true
+}
+
+/**
+ * Binds a serving address to the key an announcement for it is signed
+ * with, if it isn't bound yet. Called with the master list locked
+ * @param addr the serving address
+ * @param key the key the announcement is signed with, nil if unsigned
+ * @return whether the announcement may be taken: the address is free, or
+ * bound to the key
+ */
+func claim_addr(addr string, key []byte) bool {
+	if !key_matches(addr, key) {
+		slog.Warn("announcement for a peer not signed with its key", "peer", addr,
+			"key", hex.EncodeToString(peer_keys[addr]))
+		return false
+	}
+	if _, bound := peer_keys[addr]; !bound && key != nil {
+		peer_keys[addr] = key
+	}
+	return true
+}
+
+/**
+ * Called with the master list locked
+ * @param addr a serving address
+ * @param key the key an announcement for it is signed with, nil if
+ * unsigned
+ * @return whether the address is free or bound to the key
+ */
+func key_matches(addr string, key []byte) bool {
+	bound, ok := peer_keys[addr]
+	return !ok || bytes.Equal(bound, key)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Abuse limits, so one misbehaving client can't take the tracker down for
+ * everyone: each IP address may send so many announcements (INIT,
+ * ADD_SONG and REMOVE_SONG), reports and AUTHs a minute and so many
+ * requests for the master list (LIST, LIST_SINCE, POPULAR and CHARTS) a
+ * second, over TCP and the REST API alike, and each peer may serve so many
+ * songs. A request over a limit is turned away with ERR_BUSY and counts as
+ * a strike, as do an announcement over the song quota and an AUTH turned
+ * down, so passwords can't be guessed for long; an address with
+ * MAX_STRIKES strikes within STRIKE_WINDOW is banned for --ban-for. The
+ * tracker's own host is never limited. Counts and these bans only live in
+ * memory
+ */
+
+const (
+	// strikes within STRIKE_WINDOW that get an address banned for a while
+	MAX_STRIKES   = 10
+	STRIKE_WINDOW = time.Minute
+)
+
+/**
+ * How many requests of a kind an address sent since Start
+ */
+type RateWindow struct {
+	Start time.Time
+	Count int
+}
+
+var (
+	// announcements a minute and master list requests a second an address
+	// may send, and songs a peer may serve; 0 for no limit
+	max_announces = 60
+	max_lists     = 10
+	max_songs     = 10000
+	// how long an address with too many strikes is banned for, 0 to never
+	// ban
+	ban_for = 10 * time.Minute
+	// requests and strikes by address, guarded by the master list mutex
+	announce_counts = make(map[string]*RateWindow)
+	list_counts     = make(map[string]*RateWindow)
+	strikes         = make(map[string]*RateWindow)
+	// when each address banned for a while may come back
+	temp_bans = make(map[string]time.Time)
+)
+
+/**
+ * Counts a request. Called with the master list locked
+ * @param counts the requests of its kind, by address
+ * @param host the address it came from
+ * @param window how long a count lasts
+ * @return how many of the kind the address sent in the current window
+ */
+func count_request(counts map[string]*RateWindow, host string, window time.Duration) int {
+	now := time.Now()
+	w, ok := counts[host]
+	if !ok || now.Sub(w.Start) >= window {
+		w = &RateWindow{Start: now}
+		counts[host] = w
+	}
+	w.Count++
+	return w.Count
+}
+
+/**
+ * Counts a request against its address's limit, with a strike if it is
+ * over. Called with the master list locked
+ * @param host the address it came from
+ * @param t the request's type
+ * @return whether it is over the limit, and should be turned away
+ */
+func over_limit(host string, t byte) bool {
+	if is_local(host) {
+		return false
+	}
+	over := false
+	switch t {
+	case tsp.INIT, tsp.ADD_SONG, tsp.REMOVE_SONG, tsp.REPORT, tsp.AUTH:
+		over = max_announces > 0 && count_request(announce_counts, host, time.Minute) > max_announces
+	case tsp.LIST, tsp.LIST_SINCE, tsp.POPULAR, tsp.CHARTS:
+		over = max_lists > 0 && count_request(list_counts, host, time.Second) > max_lists
+	}
+	if over {
+		slog.Debug("request over the limit", "host", host, "type", t)
+		strike(host)
+	}
+	return over
+}
+
+/**
+ * Counts a strike against an address, banning it for ban_for once it has
+ * MAX_STRIKES. Called with the master list locked
+ * @param host the address
+ */
+func strike(host string) {
+	if ban_for <= 0 || is_local(host) || count_request(strikes, host, STRIKE_WINDOW) < MAX_STRIKES {
+		return
+	}
+	delete(strikes, host)
+	temp_bans[host] = time.Now().Add(ban_for)
+	slog.Warn("banning an address for a while", "host", host, "for", ban_for)
+}
+
+/**
+ * Called with the master list locked
+ * @param host an IP address
+ * @return whether it is banned for a while
+ */
+func temp_banned(host string) bool {
+	until, ok := temp_bans[host]
+	if ok && time.Now().After(until) {
+		delete(temp_bans, host)
+		return false
+	}
+	return ok
+}
+
+/**
+ * Called with the master list locked
+ * @param addr a serving address
+ * @return the IDs of the songs it serves
+ */
+func songs_served(addr string) map[int]bool {
+	served := make(map[int]bool)
+	for _, song := range info {
+		for _, s := range song.Sources {
+			if s.PeerAddr == addr {
+				served[song.ID] = true
+			}
+		}
+	}
+	return served
+}
+
+/**
+ * Counts a song a peer announces against its quota. Called with the master
+ * list locked
+ * @param served the IDs of the songs the peer serves, see songs_served,
+ * which the song is added to if it is taken
+ * @param id the song's ID
+ * @return whether the song may be taken: the peer serves it already, or
+ * is under its quota
+ */
+func within_quota(served map[int]bool, id int) bool {
+	if served[id] {
+		return true
+	}
+	if max_songs > 0 && len(served) >= max_songs {
+		return false
+	}
+	served[id] = true
+	return true
+}
+
+/**
+ * forgets counts that ran out, and bans that are over. Called with the
+ * master list locked
+ */
+func reap_limits() {
+	now := time.Now()
+	for _, reap := range []struct {
+		counts map[string]*RateWindow
+		window time.Duration
+	}{{announce_counts, time.Minute}, {list_counts, time.Second}, {strikes, STRIKE_WINDOW}} {
+		for host, w := range reap.counts {
+			if now.Sub(w.Start) >= reap.window {
+				delete(reap.counts, host)
+			}
+		}
+	}
+	for host, until := range temp_bans {
+		if now.After(until) {
+			delete(temp_bans, host)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * The listening parties going on between peers. A peer hosting a party
+ * announces it with a PARTY every heartbeat and whenever the song changes,
+ * and once more when it ends; peers ask for the list with an empty PARTY
+ * and join a party at its host. Like broadcasts, parties are only kept in
+ * memory, and one not announced for MISSED_HEARTBEATS heartbeats, or whose
+ * host is dropped, is over
+ */
+
+var (
+	// the parties going on, by the serving address of their host, and
+	// when each was last announced
+	parties    = make(map[string]tsp.PartyState)
+	party_seen = make(map[string]time.Time)
+)
+
+/**
+ * handles a PARTY: records or ends the peer's party, or with no body,
+ * replies with the parties going on
+ * @param peer the Peer connection
+ * @param content the body of the PARTY
+ */
+func handle_party(peer net.Conn, content []byte) {
+	if len(content) == 0 {
+		send_parties(peer)
+		return
+	}
+	party, err := tsp.DecodeParty(content)
+	if err != nil {
+		slog.Warn("bad party announcement", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+	party.Host = peer_addr(peer, party.Host)
+	if !party.Live {
+		if _, ok := parties[party.Host]; ok {
+			slog.Info("party over", "peer", party.Host, "name", party.Name)
+		}
+		end_party(party.Host)
+		return
+	}
+	if _, ok := parties[party.Host]; !ok {
+		slog.Info("party started", "peer", party.Host, "name", party.Name)
+	}
+	parties[party.Host] = party
+	party_seen[party.Host] = time.Now()
+}
+
+/**
+ * sends the peer the parties going on, the longest running first
+ * @param peer the Peer connection
+ */
+func send_parties(peer net.Conn) {
+	content, err := tsp.EncodeParties(live_parties())
+	if err != nil {
+		slog.Error("can't encode parties", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.PARTY, 0, content)); err != nil {
+		slog.Warn("can't send parties", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @return the parties going on, the longest running first
+ */
+func live_parties() []tsp.PartyState {
+	list := make([]tsp.PartyState, 0, len(parties))
+	for _, party := range parties {
+		list = append(list, party)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+/**
+ * forgets the party a peer hosts, if it hosts one
+ * @param addr the peer's serving address
+ */
+func end_party(addr string) {
+	delete(parties, addr)
+	delete(party_seen, addr)
+}
+
+/**
+ * ends the parties not announced since deadline
+ * @param deadline when the last announcement must have been after
+ */
+func reap_parties(deadline time.Time) {
+	for addr, seen := range party_seen {
+		if seen.Before(deadline) {
+			slog.Info("party went quiet", "peer", addr)
+			end_party(addr)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+const (
+	// most songs a POPULAR or CHARTS reply lists
+	MAX_POPULAR = 100
+	// how long plays count towards the charts
+	CHART_HOURS = 7 * 24
+)
+
+var (
+	// how many times each song, by ID, was played or downloaded, guarded by
+	// the master list mutex
+	plays = make(map[int]int)
+	// the same, for each hour (since the epoch) of the last CHART_HOURS
+	hourly_plays = make(map[int64]map[int]int)
+)
+
+/**
+ * records a PLAYED from a peer. A song whose ID doesn't carry the file
+ * played (e.g. the registry was restored since the peer listed it) is
+ * looked up by the file's hash instead
+ * @param id the master list ID of the song played or downloaded
+ * @param hash the hex SHA-256 of the file, empty from older peers
+ * @return whether the play was counted
+ */
+func count_play(id int, hash string) bool {
+	found := false
+	for _, song := range info {
+		if song.ID == id && (hash == "" || serves_hash(song, hash)) {
+			found = true
+			break
+		}
+	}
+	if !found && hash != "" {
+		for _, song := range info {
+			if serves_hash(song, hash) {
+				id, found = song.ID, true
+				break
+			}
+		}
+	}
+	if !found {
+		return false
+	}
+	plays[id]++
+	hour := time.Now().Unix() / 3600
+	if hourly_plays[hour] == nil {
+		hourly_plays[hour] = make(map[int]int)
+	}
+	hourly_plays[hour][id]++
+	for h := range hourly_plays {
+		if h <= hour-CHART_HOURS {
+			delete(hourly_plays, h)
+		}
+	}
+	return true
+}
+
+/**
+ * @return whether a source of the song serves the file with the hash
+ */
+func serves_hash(song tsp.SongEntry, hash string) bool {
+	for _, s := range song.Sources {
+		if s.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * sends the peer the songs played or downloaded most, most first, in the
+ * same format as the master list. Songs never played aren't listed
+ * @param peer the Peer connection
+ * @param key the identity key the request is signed with, nil if unsigned
+ */
+func send_popular(peer net.Conn, key []byte) {
+	popular := make([]tsp.SongEntry, 0)
+	for _, song := range tsp.VisibleSongs(info, key) {
+		if plays[song.ID] > 0 {
+			popular = append(popular, song)
+		}
+	}
+	sort.SliceStable(popular, func(i, j int) bool {
+		return plays[popular[i].ID] > plays[popular[j].ID]
+	})
+	if len(popular) > MAX_POPULAR {
+		popular = popular[:MAX_POPULAR]
+	}
+	content, err := tsp.EncodeSongs(popular)
+	if err != nil {
+		slog.Error("can't encode list", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.POPULAR, 0, content)); err != nil {
+		slog.Warn("can't send popular songs", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @param period tsp.CHART_DAY or tsp.CHART_WEEK
+ * @param key the identity key of the peer asking, nil if unknown
+ * @return the songs played or downloaded most over the period that peer
+ * may see, most first, and whether the period is known
+ */
+func chart(period string, key []byte) ([]tsp.ChartEntry, bool) {
+	var hours int64
+	switch period {
+	case tsp.CHART_DAY:
+		hours = 24
+	case tsp.CHART_WEEK:
+		hours = CHART_HOURS
+	default:
+		return nil, false
+	}
+	now := time.Now().Unix() / 3600
+	counts := make(map[int]int)
+	for hour, songs := range hourly_plays {
+		if hour > now-hours {
+			for id, n := range songs {
+				counts[id] += n
+			}
+		}
+	}
+	entries := make([]tsp.ChartEntry, 0)
+	for _, song := range tsp.VisibleSongs(info, key) {
+		if counts[song.ID] > 0 {
+			entries = append(entries, tsp.ChartEntry{Song: song, Plays: counts[song.ID]})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Plays > entries[j].Plays
+	})
+	if len(entries) > MAX_POPULAR {
+		entries = entries[:MAX_POPULAR]
+	}
+	return entries, true
+}
+
+/**
+ * sends the peer the songs played or downloaded most over the period it
+ * asks for
+ * @param peer the Peer connection
+ * @param period the body of the CHARTS, tsp.CHART_DAY or tsp.CHART_WEEK
+ * @param key the identity key the request is signed with, nil if unsigned
+ */
+func send_charts(peer net.Conn, period string, key []byte) {
+	entries, ok := chart(period, key)
+	if !ok {
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_NOT_FOUND, "no chart for "+period))
+		return
+	}
+	content, err := tsp.EncodeCharts(entries)
+	if err != nil {
+		slog.Error("can't encode chart", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.CHARTS, 0, content)); err != nil {
+		slog.Warn("can't send chart", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Who is online and what they are listening to. Every registered peer is
+ * online; a peer that shares what it listens to sends a PRESENCE whenever
+ * that changes and every heartbeat, and peers ask who is online with an
+ * empty PRESENCE. Presence is only kept in memory, and goes with the peer
+ */
+
+var (
+	// what the peers sharing it are listening to, by serving address
+	presences = make(map[string]tsp.Presence)
+)
+
+/**
+ * handles a PRESENCE: records what the peer is listening to, or with no
+ * body, replies with who is online
+ * @param peer the Peer connection
+ * @param content the body of the PRESENCE
+ * @param key the identity key the PRESENCE is signed with, nil if
+ * unsigned, which is the only key listed for the peer
+ */
+func handle_presence(peer net.Conn, content []byte, key []byte) {
+	if len(content) == 0 {
+		send_presences(peer)
+		return
+	}
+	presence, err := tsp.DecodePresence(content)
+	if err != nil {
+		slog.Warn("bad presence", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+	presence.Addr = peer_addr(peer, presence.Addr)
+	if !claim_addr(presence.Addr, key) {
+		return
+	}
+	presence.Key = key
+	presence.Seen = time.Now()
+	presences[presence.Addr] = presence
+}
+
+/**
+ * sends the peer who is online, those listening to something first
+ * @param peer the Peer connection
+ */
+func send_presences(peer net.Conn) {
+	content, err := tsp.EncodePresences(online_peers())
+	if err != nil {
+		slog.Error("can't encode presences", "err", err)
+		return
+	}
+	if err = tsp.Encode(peer, tsp.NewMsg(tsp.PRESENCE, 0, content)); err != nil {
+		slog.Warn("can't send presences", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
+
+/**
+ * Called with the master list locked
+ * @return every registered peer, with what it is listening to if it
+ * shares it, those listening to something first, then by name and address
+ */
+func online_peers() []tsp.Presence {
+	online := make([]tsp.Presence, 0, len(last_seen))
+	for addr, seen := range last_seen {
+		presence, ok := presences[addr]
+		if !ok {
+			presence = tsp.Presence{Addr: addr}
+		}
+		if seen.After(presence.Seen) {
+			presence.Seen = seen
+		}
+		online = append(online, presence)
+	}
+	sort.Slice(online, func(i, j int) bool {
+		a, b := online[i], online[j]
+		if (a.Song.ID != 0) != (b.Song.ID != 0) {
+			return a.Song.ID != 0
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Addr < b.Addr
+	})
+	return online
+}
+
+/**
+ * forgets what a peer is listening to
+ * @param addr the peer's serving address
+ */
+func forget_presence(addr string) {
+	delete(presences, addr)
+}
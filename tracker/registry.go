@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"strconv"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+	bolt "go.etcd.io/bbolt"
+)
+
+// how long to wait for another tracker holding the database to let go
+const DB_OPEN_TIMEOUT = time.Second
+
+var (
+	SONGS_BUCKET = []byte("songs")
+	PEERS_BUCKET = []byte("peers")
+	PLAYS_BUCKET = []byte("plays")
+	// plays by hour, keyed by the hour followed by the song ID
+	HOURLY_BUCKET = []byte("hourly_plays")
+	BANS_BUCKET   = []byte("bans")
+	SHARED_BUCKET = []byte("shared_playlists")
+	// reports by ID, for the operator to review
+	REPORTS_BUCKET = []byte("reports")
+	// the identity key each serving address is bound to
+	KEYS_BUCKET = []byte("peer_keys")
+	// accounts by name, sessions by token and invites
+	ACCOUNTS_BUCKET = []byte("accounts")
+	SESSIONS_BUCKET = []byte("sessions")
+	INVITES_BUCKET  = []byte("invites")
+	META_BUCKET     = []byte("meta")
+	EPOCH           = []byte("epoch")
+	LIST_VERSION    = []byte("version")
+)
+
+// the registry database, nil if the tracker runs without one
+var db *bolt.DB
+
+/**
+ * Opens the registry database and loads the songs, play counts, bans,
+ * shared playlists, reports, accounts, peers and their keys it holds,
+ * dropping peers that missed too many heartbeats while the tracker was
+ * down
+ * @param path the database file, created if missing
+ * @return an error if the database can't be opened or read
+ */
+func open_registry(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: DB_OPEN_TIMEOUT})
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(META_BUCKET); meta != nil {
+			registry_epoch = string(meta.Get(EPOCH))
+			if n, err := strconv.ParseInt(string(meta.Get(LIST_VERSION)), 10, 64); err == nil {
+				registry_version = n
+			}
+		}
+		if songs := tx.Bucket(SONGS_BUCKET); songs != nil {
+			err := songs.ForEach(func(k, v []byte) error {
+				var song tsp.SongEntry
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&song); err != nil {
+					return err
+				}
+				info = append(info, song)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if counts := tx.Bucket(PLAYS_BUCKET); counts != nil {
+			err := counts.ForEach(func(k, v []byte) error {
+				n, err := strconv.Atoi(string(v))
+				if err != nil {
+					return err
+				}
+				plays[int(binary.BigEndian.Uint64(k))] = n
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if hourly := tx.Bucket(HOURLY_BUCKET); hourly != nil {
+			err := hourly.ForEach(func(k, v []byte) error {
+				n, err := strconv.Atoi(string(v))
+				if err != nil {
+					return err
+				}
+				hour, id := int64(binary.BigEndian.Uint64(k)), int(binary.BigEndian.Uint64(k[8:]))
+				if hourly_plays[hour] == nil {
+					hourly_plays[hour] = make(map[int]int)
+				}
+				hourly_plays[hour][id] = n
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if banned := tx.Bucket(BANS_BUCKET); banned != nil {
+			banned.ForEach(func(k, v []byte) error {
+				bans[string(k)] = true
+				return nil
+			})
+		}
+		if shared := tx.Bucket(SHARED_BUCKET); shared != nil {
+			err := shared.ForEach(func(k, v []byte) error {
+				playlist := &tsp.SharedPlaylist{}
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(playlist); err != nil {
+					return err
+				}
+				shared_playlists[playlist.Name] = playlist
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if filed := tx.Bucket(REPORTS_BUCKET); filed != nil {
+			var list []FiledReport
+			err := filed.ForEach(func(k, v []byte) error {
+				var report FiledReport
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&report); err != nil {
+					return err
+				}
+				list = append(list, report)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			set_reports(list)
+		}
+		if err := load_accounts(tx); err != nil {
+			return err
+		}
+		if keys := tx.Bucket(KEYS_BUCKET); keys != nil {
+			keys.ForEach(func(k, v []byte) error {
+				peer_keys[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+		}
+		if peers := tx.Bucket(PEERS_BUCKET); peers != nil {
+			return peers.ForEach(func(k, v []byte) error {
+				var seen time.Time
+				if err := seen.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				last_seen[string(k)] = seen
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if rekey_songs() {
+		// the IDs peers hold are gone, so their versions mean nothing
+		registry_epoch = ""
+	}
+	start_versions()
+	deadline := time.Now().Add(-MISSED_HEARTBEATS * tsp.HEARTBEAT_INTERVAL)
+	for addr, seen := range last_seen {
+		if seen.Before(deadline) {
+			drop_peer(addr)
+		}
+	}
+	note_changes()
+	return save_registry()
+}
+
+/**
+ * Writes the songs, play counts, peers and their keys, bans, shared
+ * playlists, reports, accounts and list version to the database,
+ * replacing what was there. Called with the master list locked, after
+ * every change but heartbeats, see save_peer
+ * @return an error if the database couldn't be written
+ */
+func save_registry() error {
+	if db == nil {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{SONGS_BUCKET, PLAYS_BUCKET, HOURLY_BUCKET, PEERS_BUCKET, BANS_BUCKET, SHARED_BUCKET,
+			REPORTS_BUCKET, KEYS_BUCKET, ACCOUNTS_BUCKET, SESSIONS_BUCKET, INVITES_BUCKET} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		songs, err := tx.CreateBucketIfNotExists(SONGS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for _, song := range info {
+			var buf bytes.Buffer
+			if err = gob.NewEncoder(&buf).Encode(song); err != nil {
+				return err
+			}
+			if err = songs.Put(song_key(song.ID), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		counts, err := tx.CreateBucketIfNotExists(PLAYS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for id, n := range plays {
+			if err = counts.Put(song_key(id), []byte(strconv.Itoa(n))); err != nil {
+				return err
+			}
+		}
+
+		hourly, err := tx.CreateBucketIfNotExists(HOURLY_BUCKET)
+		if err != nil {
+			return err
+		}
+		for hour, songs := range hourly_plays {
+			for id, n := range songs {
+				key := append(song_key(int(hour)), song_key(id)...)
+				if err = hourly.Put(key, []byte(strconv.Itoa(n))); err != nil {
+					return err
+				}
+			}
+		}
+
+		peers, err := tx.CreateBucketIfNotExists(PEERS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for addr, seen := range last_seen {
+			value, err := seen.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err = peers.Put([]byte(addr), value); err != nil {
+				return err
+			}
+		}
+
+		keys, err := tx.CreateBucketIfNotExists(KEYS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for addr, key := range peer_keys {
+			if err = keys.Put([]byte(addr), key); err != nil {
+				return err
+			}
+		}
+
+		banned, err := tx.CreateBucketIfNotExists(BANS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for ban := range bans {
+			if err = banned.Put([]byte(ban), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		shared, err := tx.CreateBucketIfNotExists(SHARED_BUCKET)
+		if err != nil {
+			return err
+		}
+		for name, playlist := range shared_playlists {
+			var buf bytes.Buffer
+			if err = gob.NewEncoder(&buf).Encode(playlist); err != nil {
+				return err
+			}
+			if err = shared.Put([]byte(name), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		filed, err := tx.CreateBucketIfNotExists(REPORTS_BUCKET)
+		if err != nil {
+			return err
+		}
+		for id, report := range reports {
+			var buf bytes.Buffer
+			if err = gob.NewEncoder(&buf).Encode(report); err != nil {
+				return err
+			}
+			if err = filed.Put(song_key(id), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err = save_accounts(tx); err != nil {
+			return err
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(META_BUCKET)
+		if err != nil {
+			return err
+		}
+		if err = meta.Put(EPOCH, []byte(registry_epoch)); err != nil {
+			return err
+		}
+		return meta.Put(LIST_VERSION, []byte(strconv.FormatInt(registry_version, 10)))
+	})
+}
+
+/**
+ * Writes when a peer was last seen, and the key its address is bound to,
+ * leaving the rest of the registry as it is. Called with the master list
+ * locked, on every heartbeat
+ * @param addr the peer's serving address
+ * @return an error if the database couldn't be written
+ */
+func save_peer(addr string) error {
+	if db == nil {
+		return nil
+	}
+	seen, err := last_seen[addr].MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		peers, err := tx.CreateBucketIfNotExists(PEERS_BUCKET)
+		if err != nil {
+			return err
+		}
+		if err = peers.Put([]byte(addr), seen); err != nil {
+			return err
+		}
+		key, bound := peer_keys[addr]
+		if !bound {
+			return nil
+		}
+		keys, err := tx.CreateBucketIfNotExists(KEYS_BUCKET)
+		if err != nil {
+			return err
+		}
+		return keys.Put([]byte(addr), key)
+	})
+}
+
+/**
+ * Loads the accounts, sessions and invites
+ * @param tx the transaction reading the database
+ * @return an error if one can't be read
+ */
+func load_accounts(tx *bolt.Tx) error {
+	if bucket := tx.Bucket(ACCOUNTS_BUCKET); bucket != nil {
+		err := bucket.ForEach(func(k, v []byte) error {
+			var account Account
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&account); err != nil {
+				return err
+			}
+			accounts[account.User] = account
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if bucket := tx.Bucket(SESSIONS_BUCKET); bucket != nil {
+		err := bucket.ForEach(func(k, v []byte) error {
+			var session Session
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&session); err != nil {
+				return err
+			}
+			sessions[string(k)] = session
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if bucket := tx.Bucket(INVITES_BUCKET); bucket != nil {
+		return bucket.ForEach(func(k, v []byte) error {
+			var created time.Time
+			if err := created.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			invites[string(k)] = created
+			return nil
+		})
+	}
+	return nil
+}
+
+/**
+ * Writes the accounts, sessions and invites into freshly emptied buckets
+ * @param tx the transaction writing the database
+ * @return an error if one can't be written
+ */
+func save_accounts(tx *bolt.Tx) error {
+	bucket, err := tx.CreateBucketIfNotExists(ACCOUNTS_BUCKET)
+	if err != nil {
+		return err
+	}
+	for name, account := range accounts {
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(account); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(name), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	bucket, err = tx.CreateBucketIfNotExists(SESSIONS_BUCKET)
+	if err != nil {
+		return err
+	}
+	for token, session := range sessions {
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(session); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(token), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	bucket, err = tx.CreateBucketIfNotExists(INVITES_BUCKET)
+	if err != nil {
+		return err
+	}
+	for invite, created := range invites {
+		value, err := created.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(invite), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * @return the database key of a song, ordered by ID
+ */
+func song_key(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
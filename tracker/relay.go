@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Relaying. Every peer keeps a connection open to the tracker, registered
+ * with a RELAY_DATA for session 0 carrying its serving address. A client
+ * that can't reach a peer sends the tracker a RELAY_REQUEST carrying that
+ * address; the tracker passes a new session number down the peer's
+ * registered connection in a RELAY_REQUEST, the peer dials back with a
+ * RELAY_DATA for the session, the tracker answers the client with a
+ * RELAY_REQUEST, and from then on copies bytes between the two legs,
+ * capped at relay_rate. The client then talks to the peer as if it had
+ * dialled it
+ */
+
+const RELAY_CHUNK = 32 * 1024
+
+var (
+	// KB/s each relayed stream is held to, 0 for no limit
+	relay_rate = 512
+	// streams relayed at once, 0 turns relaying off
+	max_relays = 4
+)
+
+/**
+ * A data leg handed from the serving peer to the waiting client
+ */
+type RelayLeg struct {
+	conn net.Conn
+	// closed once the relay is over, so the leg's handler can return
+	done chan struct{}
+}
+
+var (
+	relay_mutex sync.Mutex
+	// the registered connection of each peer taking relays, by serving
+	// address
+	relay_peers = make(map[string]net.Conn)
+	// clients waiting for the serving peer's data leg, by session
+	relay_sessions = make(map[int]chan RelayLeg)
+	next_session   = 1
+	relays         int
+)
+
+/**
+ * Keeps a peer's registered connection until the peer hangs up
+ * @param peer the connection to pass sessions down
+ * @param claimed the serving address the peer says it has
+ */
+func register_relay_peer(peer net.Conn, claimed string) {
+	addr := peer_addr(peer, claimed)
+	peer.SetDeadline(time.Time{})
+	relay_mutex.Lock()
+	if old, ok := relay_peers[addr]; ok {
+		old.Close()
+	}
+	relay_peers[addr] = peer
+	relay_mutex.Unlock()
+	slog.Info("peer takes relays", "peer", addr)
+
+	// nothing is expected from the peer, a read returning means it's gone
+	io.Copy(io.Discard, peer)
+
+	relay_mutex.Lock()
+	if relay_peers[addr] == peer {
+		delete(relay_peers, addr)
+	}
+	relay_mutex.Unlock()
+	slog.Info("peer stopped taking relays", "peer", addr)
+}
+
+/**
+ * Relays a client's stream to a peer it can't reach
+ * @param client the client's connection
+ * @param target the serving address of the peer to relay to
+ */
+func relay_stream(client net.Conn, target string) {
+	relay_mutex.Lock()
+	control, ok := relay_peers[target]
+	if !ok {
+		relay_mutex.Unlock()
+		tsp.Encode(client, tsp.NewError(tsp.ERR_NOT_FOUND, target+" doesn't take relays"))
+		return
+	}
+	if relays >= max_relays {
+		relay_mutex.Unlock()
+		tsp.Encode(client, tsp.NewError(tsp.ERR_BUSY, "every relay is in use"))
+		return
+	}
+	relays++
+	session := next_session
+	next_session++
+	legs := make(chan RelayLeg, 1)
+	relay_sessions[session] = legs
+	control.SetWriteDeadline(time.Now().Add(io_timeout))
+	err := tsp.Encode(control, tsp.NewMsg(tsp.RELAY_REQUEST, session, nil))
+	relay_mutex.Unlock()
+
+	defer func() {
+		relay_mutex.Lock()
+		delete(relay_sessions, session)
+		relays--
+		relay_mutex.Unlock()
+		// a leg that arrived too late
+		select {
+		case late := <-legs:
+			close(late.done)
+		default:
+		}
+	}()
+	if err != nil {
+		slog.Warn("can't reach peer to relay to", "peer", target, "err", err)
+		tsp.Encode(client, tsp.NewError(tsp.ERR_NOT_FOUND, target+" can't be reached"))
+		return
+	}
+
+	var leg RelayLeg
+	select {
+	case leg = <-legs:
+	case <-time.After(io_timeout):
+		slog.Warn("peer didn't open the relay", "peer", target)
+		tsp.Encode(client, tsp.NewError(tsp.ERR_BUSY, target+" didn't answer"))
+		return
+	}
+	defer close(leg.done)
+	client.SetWriteDeadline(time.Now().Add(io_timeout))
+	if err = tsp.Encode(client, tsp.NewMsg(tsp.RELAY_REQUEST, session, nil)); err != nil {
+		return
+	}
+
+	slog.Info("relaying", "client", client.RemoteAddr(), "peer", target, "session", session)
+	// no deadlines from here on: the client goes quiet once it has sent
+	// its request, and either end hanging up closes both legs
+	client.SetDeadline(time.Time{})
+	leg.conn.SetDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		relay_copy(leg.conn, client)
+		leg.conn.Close()
+		client.Close()
+		close(done)
+	}()
+	relay_copy(client, leg.conn)
+	client.Close()
+	leg.conn.Close()
+	<-done
+	slog.Info("relay over", "session", session)
+}
+
+/**
+ * Handles a RELAY_DATA: registers the peer for relays for session 0,
+ * otherwise hands the peer's data leg to the client waiting on the
+ * session, and holds the connection until the relay is over
+ * @param peer the serving peer's connection
+ * @param in_msg the RELAY_DATA, carrying the session and, for session 0,
+ * the peer's serving address
+ */
+func handle_relay_data(peer net.Conn, in_msg *tsp.Msg) {
+	session := in_msg.Header.Song_id
+	if session == 0 {
+		register_relay_peer(peer, string(in_msg.Msg))
+		return
+	}
+	done := make(chan struct{})
+	relay_mutex.Lock()
+	legs, ok := relay_sessions[session]
+	if ok {
+		select {
+		case legs <- RelayLeg{peer, done}:
+		default:
+			ok = false
+		}
+	}
+	relay_mutex.Unlock()
+	if !ok {
+		slog.Warn("data leg for an unknown relay", "peer", peer.RemoteAddr(), "session", session)
+		return
+	}
+	<-done
+}
+
+/**
+ * Copies src to dst, no faster than relay_rate, until either side closes
+ * @param dst where the bytes go
+ * @param src where they come from
+ */
+func relay_copy(dst net.Conn, src net.Conn) {
+	buf := make([]byte, RELAY_CHUNK)
+	start := time.Now()
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			total += int64(n)
+			if relay_rate > 0 {
+				due := start.Add(time.Duration(total * int64(time.Second) / int64(relay_rate<<10)))
+				time.Sleep(time.Until(due))
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
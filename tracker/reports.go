@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Reports: a peer that fetched a corrupted or mislabeled file reports the
+ * song with a REPORT, and the tracker keeps it in the registry, along with
+ * the sources the song had then, for its operator to review with
+ * `tracker admin <host:port> reports` and ban the peers sharing bad files.
+ * A reporter, by identity key or IP address if the REPORT isn't signed,
+ * only counts once per song and reason
+ */
+
+const (
+	// most reports kept, the oldest dropped first
+	MAX_REPORTS = 1000
+	// longest note a report keeps
+	MAX_REPORT_NOTE = 200
+)
+
+/**
+ * A source of a reported song, as it was when the report came in
+ */
+type ReportedSource struct {
+	Addr string `json:"addr"`
+	Hash string `json:"hash"`
+	// the serving peer's identity key, empty if its announcement was
+	// unsigned
+	Key []byte `json:"key"`
+}
+
+/**
+ * A report kept for the operator to review
+ */
+type FiledReport struct {
+	ID     int    `json:"id"`
+	Song   int    `json:"song"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+	// the IP address it came from, and the key it is signed with, empty if
+	// unsigned
+	From    string           `json:"from"`
+	FromKey []byte           `json:"from_key"`
+	Sources []ReportedSource `json:"sources"`
+	At      time.Time        `json:"at"`
+}
+
+var (
+	// the reports by ID, and the ID the next one gets
+	reports     = make(map[int]FiledReport)
+	next_report = 1
+)
+
+/**
+ * handles a REPORT, replying with an empty REPORT once it is kept
+ * @param peer the Peer connection
+ * @param content the body of the REPORT
+ * @param key the identity key the REPORT is signed with, nil if unsigned
+ * @return whether a report was kept, and the registry needs saving
+ */
+func handle_report(peer net.Conn, content []byte, key []byte) bool {
+	report, err := tsp.DecodeReport(content)
+	if err != nil {
+		slog.Warn("bad report", "peer", peer.RemoteAddr(), "err", err)
+		return false
+	}
+	filed, code, err := file_report(remote_host(peer), key, report)
+	if err != nil {
+		send_report_reply(peer, tsp.NewError(code, err.Error()))
+		return false
+	}
+	send_report_reply(peer, tsp.NewMsg(tsp.REPORT, 0, nil))
+	return filed
+}
+
+/**
+ * Keeps a report, unless the reporter made it already. Called with the
+ * master list locked
+ * @param host the IP address it came from
+ * @param key the identity key it is signed with, nil if unsigned
+ * @param report the song reported and why
+ * @return whether it was kept, and an error with its ERR_ code if it can't
+ * be taken
+ */
+func file_report(host string, key []byte, report tsp.Report) (bool, byte, error) {
+	if report.Reason != tsp.REPORT_CORRUPT && report.Reason != tsp.REPORT_MISLABELED {
+		return false, tsp.ERR_DENIED, fmt.Errorf("a song is reported %s or %s, not %q",
+			tsp.REPORT_CORRUPT, tsp.REPORT_MISLABELED, report.Reason)
+	}
+	song, found := master_song(report.Song)
+	if !found {
+		return false, tsp.ERR_NOT_FOUND, fmt.Errorf("no song %d", report.Song)
+	}
+	for _, filed := range reports {
+		if filed.Song == song.ID && filed.Reason == report.Reason && same_reporter(filed, host, key) {
+			return false, 0, nil
+		}
+	}
+	note := strings.TrimSpace(report.Note)
+	if len(note) > MAX_REPORT_NOTE {
+		note = note[:MAX_REPORT_NOTE]
+	}
+	filed := FiledReport{ID: next_report, Song: song.ID, Title: song.Title, Artist: song.Artist,
+		Reason: report.Reason, Note: note, From: host, FromKey: key, At: time.Now()}
+	for _, s := range song.Sources {
+		filed.Sources = append(filed.Sources, ReportedSource{Addr: s.PeerAddr, Hash: s.Hash, Key: s.Key})
+	}
+	reports[filed.ID] = filed
+	next_report++
+	for len(reports) > MAX_REPORTS {
+		delete(reports, report_list()[0].ID)
+	}
+	slog.Info("song reported", "song", song.ID, "reason", report.Reason, "from", host)
+	return true, 0, nil
+}
+
+/**
+ * @param filed a report kept
+ * @param host the IP address a new report came from
+ * @param key the identity key it is signed with, nil if unsigned
+ * @return whether the same peer made both
+ */
+func same_reporter(filed FiledReport, host string, key []byte) bool {
+	if key != nil || filed.FromKey != nil {
+		return bytes.Equal(filed.FromKey, key)
+	}
+	return filed.From == host
+}
+
+/**
+ * Called with the master list locked
+ * @return the reports, the oldest first
+ */
+func report_list() []FiledReport {
+	list := make([]FiledReport, 0, len(reports))
+	for _, report := range reports {
+		list = append(list, report)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+/**
+ * Replaces the reports. Called with the master list locked
+ * @param list the reports to keep
+ */
+func set_reports(list []FiledReport) {
+	reports = make(map[int]FiledReport)
+	next_report = 1
+	for _, report := range list {
+		reports[report.ID] = report
+		if report.ID >= next_report {
+			next_report = report.ID + 1
+		}
+	}
+}
+
+/**
+ * Writes the reports for the operator, each with the sources the song had
+ * @param w where the reports are written
+ */
+func write_reports(w io.Writer) {
+	for _, report := range report_list() {
+		fmt.Fprintf(w, "#%-4d %s  %-10s song %d %q by %s, from %s %s\n", report.ID,
+			report.At.Format("2006-01-02 15:04"), report.Reason, report.Song, report.Title, report.Artist,
+			report.From, key_fingerprint(report.FromKey))
+		if report.Note != "" {
+			fmt.Fprintf(w, "      %s\n", report.Note)
+		}
+		for _, s := range report.Sources {
+			fmt.Fprintf(w, "      served by %-24s %s  %s\n", s.Addr, key_fingerprint(s.Key), s.Hash)
+		}
+	}
+}
+
+/**
+ * @param key an identity key, nil if unknown
+ * @return the first digits of the key in hex, as peers show it, or
+ * "unsigned"
+ */
+func key_fingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "unsigned"
+	}
+	text := hex.EncodeToString(key)
+	if len(text) > 12 {
+		text = text[:12]
+	}
+	return text
+}
+
+/**
+ * @param peer the Peer connection
+ * @param msg the reply
+ */
+func send_report_reply(peer net.Conn, msg *tsp.Msg) {
+	if err := tsp.Encode(peer, msg); err != nil {
+		slog.Warn("can't reply to a report", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
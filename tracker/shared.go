@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
+
+/*
+ * Shared playlists: playlists the tracker keeps in the registry, which
+ * any peer can append songs from the master list to, each song noting who
+ * added it and when. Songs are only appended, so a playlist's version is
+ * how many songs it has, and peers following one fetch the songs added
+ * since the version they have
+ */
+
+const (
+	// longest name a shared playlist can have
+	MAX_SHARED_NAME = 64
+	// most songs a shared playlist holds
+	MAX_SHARED_ENTRIES = 1000
+)
+
+var (
+	// the shared playlists, by name
+	shared_playlists = make(map[string]*tsp.SharedPlaylist)
+)
+
+/**
+ * handles a SHARED_PLAYLIST, replying with the playlists, the playlist
+ * made or added to, or the songs asked for
+ * @param peer the Peer connection
+ * @param content the body of the SHARED_PLAYLIST
+ * @return whether a playlist changed, and the registry needs saving
+ */
+func handle_shared(peer net.Conn, content []byte) bool {
+	request, err := tsp.DecodeSharedRequest(content)
+	if err != nil {
+		slog.Warn("bad shared playlist request", "peer", peer.RemoteAddr(), "err", err)
+		return false
+	}
+	if request.Op == tsp.SHARED_LIST {
+		reply, err := tsp.EncodeSharedPlaylists(list_shared())
+		if err != nil {
+			slog.Error("can't encode shared playlists", "err", err)
+			return false
+		}
+		send_shared_reply(peer, tsp.NewMsg(tsp.SHARED_PLAYLIST, 0, reply))
+		return false
+	}
+	playlist, changed, code, err := shared_request(peer, request)
+	if err != nil {
+		send_shared_reply(peer, tsp.NewError(code, err.Error()))
+		return false
+	}
+	reply, err := tsp.EncodeSharedPlaylist(playlist)
+	if err != nil {
+		slog.Error("can't encode a shared playlist", "err", err)
+		return changed
+	}
+	send_shared_reply(peer, tsp.NewMsg(tsp.SHARED_PLAYLIST, 0, reply))
+	return changed
+}
+
+/**
+ * Carries out a request to create, add to or get a shared playlist
+ * @param peer the Peer connection
+ * @param request what is asked
+ * @return the playlist with the songs to send, whether it changed, and
+ * an error with its ERR_ code if the request can't be carried out
+ */
+func shared_request(peer net.Conn, request tsp.SharedRequest) (tsp.SharedPlaylist, bool, byte, error) {
+	name := strings.TrimSpace(request.Name)
+	playlist, ok := shared_playlists[name]
+	switch request.Op {
+	case tsp.SHARED_CREATE:
+		if name == "" || len(name) > MAX_SHARED_NAME {
+			return tsp.SharedPlaylist{}, false, tsp.ERR_DENIED,
+				fmt.Errorf("a playlist's name takes 1 to %d characters", MAX_SHARED_NAME)
+		}
+		// peers keep copies under the name
+		if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			return tsp.SharedPlaylist{}, false, tsp.ERR_DENIED, fmt.Errorf("%q can't name a playlist", name)
+		}
+		if ok {
+			return tsp.SharedPlaylist{}, false, tsp.ERR_DENIED, fmt.Errorf("there is a playlist named %q already", name)
+		}
+		playlist = &tsp.SharedPlaylist{Name: name, CreatedBy: request.By, Created: time.Now()}
+		shared_playlists[name] = playlist
+		slog.Info("shared playlist created", "name", name, "peer", peer.RemoteAddr())
+		return *playlist, true, 0, nil
+	case tsp.SHARED_ADD, tsp.SHARED_GET:
+	default:
+		return tsp.SharedPlaylist{}, false, tsp.ERR_DENIED, fmt.Errorf("no such request %d", request.Op)
+	}
+	if !ok {
+		return tsp.SharedPlaylist{}, false, tsp.ERR_NOT_FOUND, fmt.Errorf("no playlist named %q", name)
+	}
+	if request.Op == tsp.SHARED_GET {
+		since := request.Since
+		if since < 0 || since > playlist.Version {
+			since = 0
+		}
+		reply := *playlist
+		reply.Entries = playlist.Entries[since:]
+		return reply, false, 0, nil
+	}
+	if len(playlist.Entries) >= MAX_SHARED_ENTRIES {
+		return tsp.SharedPlaylist{}, false, tsp.ERR_DENIED, fmt.Errorf("%q is full", name)
+	}
+	song, found := master_song(request.Song)
+	if !found {
+		return tsp.SharedPlaylist{}, false, tsp.ERR_NOT_FOUND, fmt.Errorf("no song %d", request.Song)
+	}
+	entry := tsp.SharedEntry{Song: song, AddedBy: request.By, Addr: remote_host(peer), Added: time.Now()}
+	playlist.Entries = append(playlist.Entries, entry)
+	playlist.Version = len(playlist.Entries)
+	slog.Info("song added to shared playlist", "name", name, "song", song.ID, "peer", peer.RemoteAddr())
+	reply := *playlist
+	reply.Entries = playlist.Entries[playlist.Version-1:]
+	return reply, true, 0, nil
+}
+
+/**
+ * @param id a song's ID
+ * @return its entry in the master list, with only the sources anyone may
+ * see, and whether there is one
+ */
+func master_song(id int) (tsp.SongEntry, bool) {
+	for _, song := range info {
+		if song.ID == id {
+			return tsp.VisibleSong(song, nil)
+		}
+	}
+	return tsp.SongEntry{}, false
+}
+
+/**
+ * Called with the master list locked
+ * @return the shared playlists without their songs, the latest made first
+ */
+func list_shared() []tsp.SharedPlaylist {
+	list := make([]tsp.SharedPlaylist, 0, len(shared_playlists))
+	for _, playlist := range shared_playlists {
+		summary := *playlist
+		summary.Entries = nil
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	return list
+}
+
+/**
+ * @param peer the Peer connection
+ * @param msg the reply
+ */
+func send_shared_reply(peer net.Conn, msg *tsp.Msg) {
+	if err := tsp.Encode(peer, msg); err != nil {
+		slog.Warn("can't reply to a shared playlist request", "peer", peer.RemoteAddr(), "err", err)
+	}
+}
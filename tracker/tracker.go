@@ -1,51 +1,36 @@
 package main
 
 import (
-	"encoding/gob"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
-	"strconv"
-	"strings"
+	"reflect"
 	"sync"
-)
-
-type TSP_header struct {
-	Type    byte
-	Song_id int
-}
+	"time"
 
-type TSP_msg struct {
-	Header TSP_header
-	Msg    []byte
-}
+	"github.com/jamesponwith/Torero-Streaming-Service/logging"
+	"github.com/jamesponwith/Torero-Streaming-Service/tsp"
+)
 
 const (
-	INIT = iota
-	LIST
-	INFO
-	PLAY
-	STOP
-	QUIT
-
-	MAX_SONGS = 1000
+	// heartbeats a peer can miss before its songs are dropped
+	MISSED_HEARTBEATS = 3
 )
 
 var (
-	id_counter int = 10
-	info           = make([]string, 0)
+	info = make([]tsp.SongEntry, 0)
+	// when each peer (by serving address) was last heard from
+	last_seen = make(map[string]time.Time)
+	// how long a peer gets to send its request and read the reply, so a
+	// hung peer can't hold the master list lock
+	io_timeout = 10 * time.Second
 )
 
 /*
- * Allows data to be sent using Gob
- */
-func init() {
-	gob.Register(&TSP_header{})
-	gob.Register(&TSP_msg{})
-}
-
-/*
- * Return the tracker server's IP address.
+ * Return the tracker server's IP address: IPv4 if it has one, otherwise
+ * IPv6.
  *
  * @return the IP address in string form
  */
@@ -56,40 +41,91 @@ func GetLocalIP() string {
 		return ""
 	}
 
+	var ipv6 string
 	for _, address := range addrs {
 		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				return ipnet.IP.String()
 			}
+			// link-local addresses need a zone other hosts can't use
+			if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+				ipv6 = ipnet.IP.String()
+			}
 		}
 	}
-	return ""
+	return ipv6
 }
 
 func main() {
-	args := os.Args[:]
+	db_path := flag.String("db", "tracker.db", "file the registry of peers and songs is kept in")
+	flag.DurationVar(&io_timeout, "timeout", io_timeout, "how long a peer gets to send a request and read the reply")
+	flag.IntVar(&relay_rate, "relay-rate", relay_rate, "KB/s each stream relayed between peers is held to, 0 for no limit")
+	flag.IntVar(&max_relays, "max-relays", max_relays, "streams relayed between peers at once, 0 turns relaying off")
+	http_addr := flag.String("http", "", "address to serve the REST API on, e.g. :8090")
+	flag.BoolVar(&locked, "locked", false, "turn away requests from peers not logged in to an account")
+	flag.BoolVar(&invite_only, "invite-only", false, "only make accounts for peers with an invite")
+	flag.BoolVar(&insecure_auth, "insecure-auth", false, "take registrations and logins, with their passwords in the clear, from beyond the local network")
+	ca_path := flag.String("ca", "", "file the CA issuing certificates for mutual TLS between peers is kept in, made if missing")
+	flag.IntVar(&max_announces, "max-announces", max_announces, "announcements an IP address may send a minute, 0 for no limit")
+	flag.IntVar(&max_lists, "max-lists", max_lists, "master list requests an IP address may send a second, 0 for no limit")
+	flag.IntVar(&max_songs, "max-songs", max_songs, "songs a peer may serve, 0 for no limit")
+	flag.DurationVar(&ban_for, "ban-for", ban_for, "how long an address going over the limits again and again is banned for, 0 to never ban")
+	var log_options logging.Options
+	logging.AddFlags(flag.CommandLine, &log_options)
+	flag.Parse()
+	args := append([]string{os.Args[0]}, flag.Args()...)
+	if len(args) > 1 && args[1] == "admin" {
+		os.Exit(admin(args[2:]))
+	}
 	if len(args) != 2 {
-		fmt.Println("Usage: ", args[0], "<port>")
+		fmt.Println("Usage: ", args[0], "[--db file] [--timeout duration] [--relay-rate KB/s] [--max-relays n] [--http addr] [--locked] [--invite-only] [--insecure-auth] [--ca file] [--max-announces n] [--max-lists n] [--max-songs n] [--ban-for duration] [--log-level level] [--log-file file] [--log-json] <port>")
+		fmt.Println("       ", args[0], "admin <host:port> <command> [args]")
+		os.Exit(1)
+	}
+	if err := logging.Setup(log_options); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// anyone able to make an account would be let into the group
+	if *ca_path != "" && !invite_only {
+		fmt.Println("--ca takes --invite-only, so only peers the operator invited get a certificate")
+		os.Exit(1)
+	}
+
+	if err := open_registry(*db_path); err != nil {
+		slog.Error("can't open registry", "path", *db_path, "err", err)
 		os.Exit(1)
 	}
-	fmt.Println(GetLocalIP())
+	defer db.Close()
+	if *ca_path != "" {
+		if err := load_ca(*ca_path); err != nil {
+			slog.Error("can't load the CA", "path", *ca_path, "err", err)
+			os.Exit(1)
+		}
+	}
 
 	// Setup server socket
-	ln, err := net.Listen("tcp", GetLocalIP()+":"+args[1])
+	ln, err := net.Listen("tcp", net.JoinHostPort(GetLocalIP(), args[1]))
 	// ln, err := net.Listen("tcp", "localhost:"+args[1])
 	if err != nil {
-		panic(err)
+		slog.Error("can't listen", "port", args[1], "err", err)
+		os.Exit(1)
 	}
 	defer ln.Close()
+	slog.Info("tracker listening", "addr", ln.Addr())
 
 	var mutex = &sync.Mutex{}
+	go reap_dead_peers(mutex)
+	if *http_addr != "" {
+		go serve_api(*http_addr, mutex)
+	}
 	for {
 		peer, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Error accepting conn")
+			slog.Warn("accept failed", "err", err)
 			continue
 		}
-		fmt.Println("handle_connection")
+		slog.Debug("connection", "peer", peer.RemoteAddr())
 		go handleConnection(peer, mutex)
 	}
 }
@@ -104,23 +140,115 @@ func main() {
  */
 func handleConnection(peer net.Conn, mutex *sync.Mutex) {
 	defer peer.Close()
-	decoder := gob.NewDecoder(peer)
-	in_msg := new(TSP_msg)
-	decoder.Decode(&in_msg)
+	peer.SetDeadline(time.Now().Add(io_timeout))
+	in_msg, err := tsp.Decode(peer)
+	if err != nil {
+		slog.Warn("bad message", "peer", peer.RemoteAddr(), "err", err)
+		return
+	}
+
+	mutex.Lock()
+	host := remote_host(peer)
+	banned := is_banned(host) || temp_banned(host)
+	// admin requests are only taken from the tracker's own host
+	allowed := in_msg.Header.Type == tsp.AUTH || in_msg.Header.Type == tsp.ADMIN ||
+		authorized(in_msg.Header.Token)
+	limited := !banned && allowed && over_limit(host, in_msg.Header.Type)
+	mutex.Unlock()
+	if banned {
+		slog.Debug("turning away banned peer", "peer", peer.RemoteAddr())
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED, "banned"))
+		return
+	}
+	if !allowed {
+		slog.Debug("turning away peer not logged in", "peer", peer.RemoteAddr(), "type", in_msg.Header.Type)
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_AUTH, "this tracker takes an account, log in with `peer login <user>`"))
+		return
+	}
+	if limited {
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_BUSY, "too many requests, try again later"))
+		return
+	}
+
+	// relays last as long as the stream, and password hashes take a while,
+	// so they don't hold the lock
+	switch in_msg.Header.Type {
+	case tsp.AUTH:
+		slog.Debug("AUTH", "peer", peer.RemoteAddr())
+		handle_auth(peer, in_msg, mutex)
+		return
+	case tsp.RELAY_REQUEST:
+		relay_stream(peer, string(in_msg.Msg))
+		return
+	case tsp.RELAY_DATA:
+		handle_relay_data(peer, in_msg)
+		return
+	}
+
+	key, signed := signer_key(in_msg)
+	if !signed {
+		slog.Warn("bad signature", "peer", peer.RemoteAddr(), "type", in_msg.Header.Type)
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED, "bad or stale signature, check the clock"))
+		return
+	}
 
 	mutex.Lock()
+	// whether the registry needs saving
+	changed := false
 	switch in_msg.Header.Type {
-	case INIT:
-		fmt.Println("INIT")
-		get_info_from_peer(peer, in_msg.Msg)
-	case LIST:
-		fmt.Println("INFO")
-		send_info_file(peer)
-	case QUIT:
-		fmt.Println("QUIT")
-		remove_songs(peer)
+	case tsp.INIT:
+		slog.Info("INIT", "peer", peer.RemoteAddr())
+		changed = get_info_from_peer(peer, in_msg.Msg, key)
+	case tsp.LIST:
+		slog.Debug("LIST", "peer", peer.RemoteAddr())
+		send_info_file(peer, key)
+	case tsp.LIST_SINCE:
+		slog.Debug("LIST_SINCE", "peer", peer.RemoteAddr(), "since", in_msg.Header.Offset)
+		send_list_delta(peer, in_msg, key)
+	case tsp.ADD_SONG:
+		slog.Info("ADD_SONG", "peer", peer.RemoteAddr())
+		changed = get_info_from_peer(peer, in_msg.Msg, key)
+	case tsp.REMOVE_SONG:
+		slog.Info("REMOVE_SONG", "peer", peer.RemoteAddr())
+		changed = remove_peer_songs(peer, in_msg.Msg, key)
+	case tsp.HEARTBEAT:
+		heartbeat(peer, string(in_msg.Msg), key)
+	case tsp.QUIT:
+		slog.Info("QUIT", "peer", peer.RemoteAddr())
+		changed = remove_songs(peer, key)
+	case tsp.PLAYED:
+		changed = count_play(in_msg.Header.Song_id, string(in_msg.Msg))
+	case tsp.POPULAR:
+		slog.Debug("POPULAR", "peer", peer.RemoteAddr())
+		send_popular(peer, key)
+	case tsp.CHARTS:
+		slog.Debug("CHARTS", "peer", peer.RemoteAddr())
+		send_charts(peer, string(in_msg.Msg), key)
+	case tsp.DHT_BOOTSTRAP:
+		slog.Debug("DHT_BOOTSTRAP", "peer", peer.RemoteAddr())
+		dht_bootstrap(peer, in_msg.Msg)
+	case tsp.ADMIN:
+		changed = handle_admin(peer, in_msg.Msg)
+	case tsp.BROADCAST:
+		slog.Debug("BROADCAST", "peer", peer.RemoteAddr())
+		handle_broadcast(peer, in_msg.Msg)
+	case tsp.PARTY:
+		slog.Debug("PARTY", "peer", peer.RemoteAddr())
+		handle_party(peer, in_msg.Msg)
+	case tsp.PRESENCE:
+		slog.Debug("PRESENCE", "peer", peer.RemoteAddr())
+		handle_presence(peer, in_msg.Msg, key)
+	case tsp.SHARED_PLAYLIST:
+		slog.Debug("SHARED_PLAYLIST", "peer", peer.RemoteAddr())
+		changed = handle_shared(peer, in_msg.Msg)
+	case tsp.REPORT:
+		slog.Debug("REPORT", "peer", peer.RemoteAddr())
+		changed = handle_report(peer, in_msg.Msg, key)
 	default:
-		fmt.Println("Bad Msg Header")
+		slog.Warn("bad message type", "peer", peer.RemoteAddr(), "type", in_msg.Header.Type)
+	}
+	if changed {
+		persist()
 	}
 	mutex.Unlock()
 }
@@ -128,48 +256,372 @@ func handleConnection(peer net.Conn, mutex *sync.Mutex) {
 /**
  * takes new peer's song list, and adds their songs
  * to the info file, with the peers IP addess, and
- * assigns ID's to the new songs
+ * assigns ID's to the new songs, up to the peer's quota
  * @param peer Peer connectoin
  * @param song_bytes the bytes containing song info
+ * @param key the identity key the announcement is signed with, nil if
+ * unsigned
+ * @return whether the master list changed
  */
-func get_info_from_peer(peer net.Conn, song_bytes []byte) {
-	song_strs := strings.Split(string(song_bytes[:]), "\n")
-	ip := peer.RemoteAddr().String() + ", "
-	for i, _ := range song_strs {
-		if song_strs[i] == "" {
+func get_info_from_peer(peer net.Conn, song_bytes []byte, key []byte) bool {
+	songs, err := tsp.DecodeSongs(song_bytes)
+	if err != nil {
+		slog.Warn("bad song list", "peer", peer.RemoteAddr(), "err", err)
+		return false
+	}
+	changed := false
+	// the songs each serving address has, read when first needed
+	served := make(map[string]map[int]bool)
+	over := 0
+	for _, song := range songs {
+		if len(song.Sources) == 0 {
 			continue
 		}
-		info = append(info, strconv.Itoa(id_counter)+": "+ip+song_strs[i])
-		id_counter++
+		source := song.Sources[0]
+		source.PeerAddr = peer_addr(peer, source.PeerAddr)
+		if !claim_addr(source.PeerAddr, key) {
+			continue
+		}
+		if served[source.PeerAddr] == nil {
+			served[source.PeerAddr] = songs_served(source.PeerAddr)
+		}
+		if !within_quota(served[source.PeerAddr], tsp.SongID(song, source)) {
+			over++
+			continue
+		}
+		source.Key = key
+		last_seen[source.PeerAddr] = time.Now()
+		if _, added := add_source(song, source); added {
+			changed = true
+		}
+	}
+	if over > 0 {
+		slog.Warn("songs over the peer's quota left out", "peer", peer.RemoteAddr(), "songs", over, "quota", max_songs)
+		strike(remote_host(peer))
 	}
-	fmt.Println(info)
+	slog.Debug("master list", "songs", len(info))
+	return changed
 }
 
 /**
- * takes new peer's song list, and adds their songs
- * to the info file, with the peers IP addess, and
- * assigns ID's to the new songs
+ * adds a peer as a source of a song. A song already in the info file
+ * (same ID, so the same file) gains another source, or has the peer's
+ * source replaced, anything else is added under its ID
+ * @param song the song the peer registered
+ * @param source the peer serving it
+ * @return the song's ID, and whether the info file changed, false if the
+ * peer announced the song just as it was
+ */
+func add_source(song tsp.SongEntry, source tsp.SongSource) (int, bool) {
+	id := tsp.SongID(song, source)
+	for i := range info {
+		if info[i].ID != id {
+			continue
+		}
+		changed := false
+		if info[i].Album == "" && song.Album != "" {
+			info[i].Album, changed = song.Album, true
+		}
+		if info[i].Genre == "" && song.Genre != "" {
+			info[i].Genre, changed = song.Genre, true
+		}
+		if info[i].Track == 0 && song.Track != 0 {
+			info[i].Track, info[i].Disc, changed = song.Track, song.Disc, true
+		}
+		// announced again, e.g. with who may see it changed
+		for j, s := range info[i].Sources {
+			if s.PeerAddr == source.PeerAddr {
+				if !reflect.DeepEqual(s, source) {
+					info[i].Sources[j], changed = source, true
+				}
+				return id, changed
+			}
+		}
+		info[i].Sources = append(info[i].Sources, source)
+		return id, true
+	}
+	song.ID = id
+	song.Sources = []tsp.SongSource{source}
+	info = append(info, song)
+	return id, true
+}
+
+/**
+ * gives every song the ID its sources' files get it (see tsp.SongID),
+ * e.g. songs stored by a tracker that numbered them, splitting entries
+ * whose sources serve different files. Play counts go with each entry's
+ * first source
+ * @return whether any song's ID changed
+ */
+func rekey_songs() bool {
+	old := info
+	info = make([]tsp.SongEntry, 0, len(old))
+	ids := make(map[int]int)
+	moved := false
+	for _, song := range old {
+		for i, source := range song.Sources {
+			id, _ := add_source(song, source)
+			if i == 0 {
+				ids[song.ID] = id
+			}
+			if id != song.ID {
+				moved = true
+			}
+		}
+	}
+	if !moved {
+		return false
+	}
+	old_plays := plays
+	plays = make(map[int]int)
+	for id, n := range old_plays {
+		if new_id, ok := ids[id]; ok {
+			plays[new_id] += n
+		}
+	}
+	for hour, songs := range hourly_plays {
+		counts := make(map[int]int)
+		for id, n := range songs {
+			if new_id, ok := ids[id]; ok {
+				counts[new_id] += n
+			}
+		}
+		hourly_plays[hour] = counts
+	}
+	tsp.MarkDuplicates(info)
+	return true
+}
+
+/**
+ * removes the sources matching a predicate from every song, dropping
+ * songs no peer serves any more
+ * @param gone reports whether a source should be removed
+ * @return whether any source was
+ */
+func remove_sources(gone func(tsp.SongSource) bool) bool {
+	removed := false
+	kept := info[:0]
+	for _, song := range info {
+		sources := make([]tsp.SongSource, 0, len(song.Sources))
+		for _, s := range song.Sources {
+			if !gone(s) {
+				sources = append(sources, s)
+			} else {
+				removed = true
+			}
+		}
+		if len(sources) > 0 {
+			song.Sources = sources
+			kept = append(kept, song)
+		} else {
+			delete(plays, song.ID)
+			for _, songs := range hourly_plays {
+				delete(songs, song.ID)
+			}
+		}
+	}
+	info = kept
+	return removed
+}
+
+/**
+ * removes songs a peer no longer hosts from the info file
+ * @param peer Peer connection
+ * @param song_bytes the bytes containing the removed songs, each with the
+ * peer's source
+ * @param key the identity key the announcement is signed with, nil if
+ * unsigned
+ * @return whether any song was removed
+ */
+func remove_peer_songs(peer net.Conn, song_bytes []byte, key []byte) bool {
+	songs, err := tsp.DecodeSongs(song_bytes)
+	if err != nil {
+		slog.Warn("bad song list", "peer", peer.RemoteAddr(), "err", err)
+		return false
+	}
+	changed := false
+	for _, song := range songs {
+		if len(song.Sources) == 0 {
+			continue
+		}
+		removed := song.Sources[0]
+		addr := peer_addr(peer, removed.PeerAddr)
+		if !claim_addr(addr, key) {
+			continue
+		}
+		if remove_sources(func(s tsp.SongSource) bool {
+			return s.PeerAddr == addr && s.FileID == removed.FileID
+		}) {
+			changed = true
+		}
+	}
+	slog.Debug("master list", "songs", len(info))
+	return changed
+}
+
+/**
+ * removes every song hosted by the peer from the info file, but for those
+ * of peers on the same host bound to another identity key
+ * @param peer the Peer connection
+ * @param key the identity key the QUIT is signed with, nil if unsigned
+ * @return whether any song or peer was removed
+ */
+func remove_songs(peer net.Conn, key []byte) bool {
+	host := remote_host(peer)
+	changed := remove_sources(func(s tsp.SongSource) bool {
+		source_host, _, _ := net.SplitHostPort(s.PeerAddr)
+		return source_host == host && key_matches(s.PeerAddr, key)
+	})
+	for addr := range last_seen {
+		if addr_host, _, _ := net.SplitHostPort(addr); addr_host == host && key_matches(addr, key) {
+			delete(last_seen, addr)
+			delete(peer_keys, addr)
+			forget_presence(addr)
+			changed = true
+		}
+	}
+	slog.Debug("master list", "songs", len(info))
+	return changed
+}
+
+/**
+ * @param peer the Peer connection
+ * @param claimed the serving address the peer says it has
+ * @return the peer's serving address: the port it claims, at the address
+ * it actually connected from
+ */
+func peer_addr(peer net.Conn, claimed string) string {
+	if _, _, err := net.SplitHostPort(claimed); err != nil {
+		claimed = peer.RemoteAddr().String()
+	}
+	return serving_addr(remote_host(peer), claimed)
+}
+
+/**
+ * @param host the address a peer connected from
+ * @param claimed the serving address the peer says it has
+ * @return the port it claims, at host
+ */
+func serving_addr(host string, claimed string) string {
+	_, port, _ := net.SplitHostPort(claimed)
+	return net.JoinHostPort(host, port)
+}
+
+/**
+ * records a HEARTBEAT from a peer, saving only when it was seen, not the
+ * whole registry. Replies with HEARTBEAT, or with INIT if the tracker
+ * doesn't know the peer (e.g. it was reaped or the tracker restarted),
+ * asking it to announce its songs again
  * @param peer the Peer connection
+ * @param claimed the serving address the peer says it has
+ * @param key the identity key the heartbeat is signed with, nil if
+ * unsigned
+ */
+func heartbeat(peer net.Conn, claimed string, key []byte) {
+	addr := peer_addr(peer, claimed)
+	if !claim_addr(addr, key) {
+		tsp.Encode(peer, tsp.NewError(tsp.ERR_DENIED, addr+" is another peer's"))
+		return
+	}
+	reply := byte(tsp.HEARTBEAT)
+	if _, known := last_seen[addr]; !known {
+		slog.Info("unknown peer, asking it to re-announce", "peer", addr)
+		reply = tsp.INIT
+	}
+	last_seen[addr] = time.Now()
+	if err := save_peer(addr); err != nil {
+		slog.Error("can't save registry", "err", err)
+	}
+	err := tsp.Encode(peer, tsp.NewMsg(reply, 0, nil))
+	if err != nil {
+		slog.Warn("can't reply to heartbeat", "peer", addr, "err", err)
+	}
+}
+
+/**
+ * periodically drops the songs of peers that have missed
+ * MISSED_HEARTBEATS heartbeats in a row
+ * @param mutex Mutex for locking master song list
  */
-func remove_songs(peer net.Conn) {
-	ip := peer.RemoteAddr().String()
-	ip_slice := strings.Split(ip, ":")
-	for i := 0; i < len(info); i++ {
-		if strings.Contains(info[i], ip_slice[0]) {
-			info = append(info[:i], info[i+1:]...)
-			i--
+func reap_dead_peers(mutex *sync.Mutex) {
+	for range time.Tick(tsp.HEARTBEAT_INTERVAL) {
+		mutex.Lock()
+		deadline := time.Now().Add(-MISSED_HEARTBEATS * tsp.HEARTBEAT_INTERVAL)
+		changed := false
+		for addr, seen := range last_seen {
+			if seen.Before(deadline) {
+				slog.Info("dropping dead peer", "peer", addr)
+				drop_peer(addr)
+				changed = true
+			}
 		}
+		reap_broadcasts(deadline)
+		reap_parties(deadline)
+		if reap_sessions() {
+			changed = true
+		}
+		reap_limits()
+		if changed {
+			persist()
+		}
+		mutex.Unlock()
+	}
+}
+
+/**
+ * flags near-duplicate songs, records the changes to the master list for
+ * LIST_SINCE, and saves the registry, so it survives a tracker restart. A
+ * failed write is reported but not fatal, the next change tries again
+ */
+func persist() {
+	tsp.MarkDuplicates(info)
+	note_changes()
+	if err := save_registry(); err != nil {
+		slog.Error("can't save registry", "err", err)
+	}
+}
+
+/**
+ * removes every song served from addr, and forgets the peer
+ * @param addr the peer's serving address
+ */
+func drop_peer(addr string) {
+	remove_sources(func(s tsp.SongSource) bool {
+		return s.PeerAddr == addr
+	})
+	delete(last_seen, addr)
+	delete(peer_keys, addr)
+	end_broadcast(addr)
+	end_party(addr)
+	forget_presence(addr)
+}
+
+/**
+ * @param peer the Peer connection
+ * @return the peer's IP address without the port
+ */
+func remote_host(peer net.Conn) string {
+	host, _, err := net.SplitHostPort(peer.RemoteAddr().String())
+	if err != nil {
+		return peer.RemoteAddr().String()
 	}
-	fmt.Println(info)
+	return host
 }
 
 /**
  * send the master song info file to the peer
- * that requested it
+ * that requested it, without the sources it may not see
  * @param peer the Peer connection
+ * @param key the identity key the request is signed with, nil if unsigned
  */
-func send_info_file(peer net.Conn) {
-	info_msg := strings.Join(info, "\n")
-	encoder := gob.NewEncoder(peer)
-	encoder.Encode(&TSP_msg{TSP_header{Type: 1}, []byte(info_msg)})
+func send_info_file(peer net.Conn, key []byte) {
+	info_msg, err := tsp.EncodeSongs(tsp.VisibleSongs(info, key))
+	if err != nil {
+		slog.Error("can't encode list", "err", err)
+		return
+	}
+	err = tsp.Encode(peer, tsp.NewMsg(tsp.LIST, 0, info_msg))
+	if err != nil {
+		slog.Warn("can't send list", "peer", peer.RemoteAddr(), "err", err)
+	}
 }
@@ -0,0 +1,1377 @@
+/**
+ * Package tsp implements the Torero Streaming Protocol shared by the peer
+ * and tracker: the message types, opcodes, and length-prefixed gob framing
+ * described in protocol.markdown.
+ */
+package tsp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types
+const (
+	INIT = iota
+	LIST
+	INFO
+	PLAY
+	STOP
+	QUIT
+	SEEK
+	HEARTBEAT
+	// reply to a request that couldn't be served, see the ERR_ codes
+	ERROR
+	// sent by a peer whose library changed, with the songs added or removed
+	ADD_SONG
+	REMOVE_SONG
+	// relaying streams through the tracker between peers that can't reach
+	// each other: a client asks for a relay to a peer, and that peer
+	// answers by connecting back to the tracker with the data leg
+	RELAY_REQUEST
+	RELAY_DATA
+	// asks a peer for the hashes of a song's pieces, see PIECE_SIZE
+	PIECES
+	// asks a peer which pieces of a song it has, see HasPiece
+	HAVE
+	// tells the tracker a song was played or downloaded, with the hash of
+	// the file in the body, and asks it for the songs played or downloaded
+	// most
+	PLAYED
+	POPULAR
+	// the DHT peers find sources by content hash through without a
+	// tracker, see DHTMsg; DHT_BOOTSTRAP asks the tracker for nodes to
+	// join it through
+	DHT_FIND_NODE
+	DHT_FIND_VALUE
+	DHT_STORE
+	DHT_BOOTSTRAP
+	// peer exchange: peers swap the serving addresses of other peers they
+	// know, gob encoded as a list of strings
+	PEX
+	// manages the tracker's registry, see AdminMsg. Only taken from the
+	// tracker's own host
+	ADMIN
+	// asks the tracker for the songs played most over a CHART_ period,
+	// see ChartEntry
+	CHARTS
+	// asks the tracker for the changes to the master list since a version
+	// of it, see ListDelta
+	LIST_SINCE
+	// asks a peer for the cover art embedded in a song's tags, see SongArt
+	ART
+	// live broadcasts between peers, see BroadcastInfo: a peer on the air
+	// announces its broadcast to the tracker, which lists the broadcasts
+	// going on, and streams it to any peer that tunes in
+	BROADCAST
+	// synchronized listening, see PartyState: a peer hosting a party
+	// announces it to the tracker, which lists the parties going on, and
+	// keeps the peers that join it playing in step, their clocks set
+	// against its own with CLOCK, see ClockSync
+	PARTY
+	CLOCK
+	// a member's vote to skip the song a party's host is playing, by its
+	// Song_id; the host skips it once enough members vote
+	VOTE_SKIP
+	// a peer tells the tracker what it is listening to, see Presence; with
+	// no body, asks the tracker who is online
+	PRESENCE
+	// asks a peer for its whole library, with a random challenge in the
+	// body for it to sign with its identity key, see PeerLibrary
+	LIBRARY
+	// collaborative playlists kept by the tracker, see SharedRequest:
+	// peers list and create them, append songs to them, and fetch the
+	// songs added since the version they have
+	SHARED_PLAYLIST
+	// registers an account with the tracker, logs in or out, see
+	// AuthRequest; a tracker that requires accounts turns away every other
+	// request without the session token it issued with ERR_AUTH
+	AUTH
+	// reports a song whose file is corrupted or mislabeled to the
+	// tracker, see Report, for its operator to review
+	REPORT
+)
+
+// Error codes, carried in the Code field of an ERROR reply
+const (
+	// the requested song isn't served here
+	ERR_NOT_FOUND = iota + 1
+	// every upload slot is in use, try another peer or come back later
+	ERR_BUSY
+	// something went wrong on the serving side
+	ERR_INTERNAL
+	// the request isn't allowed from the sender, e.g. it is banned
+	ERR_DENIED
+	// the tracker requires accounts, and the request has no session
+	// token, or one that expired: log in with AUTH
+	ERR_AUTH
+)
+
+const (
+	// protocol version stamped on every message sent. Messages from before
+	// versioning arrive as version 0 and are treated as version 1. Version 2
+	// peers answer PLAY and SEEK with a header carrying the song's format.
+	// Version 3 peers ask each other for songs by FileID. Version 4 peers
+	// answer PIECES and stop a PLAY after Length bytes. Version 5 peers
+	// answer HAVE and announce songs they are still downloading as Partial.
+	// Version 6 trackers count PLAYED and answer POPULAR. Version 7 peers
+	// take part in the DHT and trackers answer DHT_BOOTSTRAP. Version 8
+	// peers answer PEX. Version 9 trackers answer ADMIN and turn away
+	// banned peers with ERR_DENIED. Version 10 trackers answer CHARTS and
+	// peers send the song's hash with PLAYED. Version 11 trackers answer
+	// LIST_SINCE. Version 12 peers answer ART. Version 13 peers stream
+	// and trackers list BROADCASTs. Version 14 peers host PARTYs and
+	// answer CLOCK, and trackers list PARTYs. Version 15 peers count
+	// VOTE_SKIPs. Version 16 trackers answer PRESENCE. Version 17 peers
+	// answer LIBRARY and send their identity key with PRESENCE. Version 18
+	// trackers keep SHARED_PLAYLISTs. Version 19 trackers answer AUTH and
+	// take the session token in the header. Version 20 peers sign their
+	// announcements to the tracker and their replies to PLAY and SEEK.
+	// Version 21 peers sign their requests, and peers and trackers only
+	// list Restricted sources to the peers in their Allow. Version 22
+	// trackers take REPORT, and version 23 trackers acting as a CA issue a
+	// certificate with the AuthSession. Version 24 peers put when they
+	// signed a message in it, and peers and trackers turn away signed
+	// requests and announcements that are stale or were seen before
+	VERSION = 24
+
+	// size in bytes of the length prefix in front of every TSP message
+	FRAME_HEADER_LEN = 4
+	// largest gob payload we are willing to accept in a single frame
+	MAX_FRAME_LEN = 64 << 20
+
+	// how often peers tell the tracker they are still alive
+	HEARTBEAT_INTERVAL = 10 * time.Second
+
+	// how far from the receiver's clock a signed request or announcement
+	// may have been signed, either way
+	MAX_SIGNATURE_AGE = 5 * time.Minute
+
+	// size in bytes of the pieces a song is downloaded in from several
+	// peers at once; the last piece is whatever is left
+	PIECE_SIZE = 256 << 10
+
+	// hex digits of a hash a song ID is taken from: 48 bits, few enough
+	// that IDs survive JSON in a browser
+	SONG_ID_DIGITS = 12
+)
+
+type Header struct {
+	Type    byte
+	Song_id int
+	// byte offset into the song file a PLAY or SEEK starts from
+	Offset int64
+	// bytes a PLAY asks for from Offset, 0 for the rest of the song
+	Length  int64
+	Version byte
+	// audio format of the song that follows a PLAY or SEEK reply
+	Format string
+	// what went wrong, in an ERROR reply
+	Code byte
+	// the session token the tracker issued with AUTH, on requests to a
+	// tracker; empty when not logged in, and on anything sent to peers
+	Token string
+	// the sender's ed25519 identity key, and its signature of the message
+	// (see Sign), on announcements to the tracker, requests, and replies
+	// to PLAY and SEEK; empty from peers before version 20
+	Key       []byte
+	Signature []byte
+	// when the message was signed, in Unix nanoseconds, covered by the
+	// signature; 0 from peers before version 24
+	Signed int64
+}
+
+type Msg struct {
+	Header Header
+	Msg    []byte
+}
+
+// Capabilities a peer advertises in the Caps of its sources
+const (
+	// serves PLAY and SEEK over QUIC on the UDP port matching its TCP port
+	CAP_QUIC = 1 << iota
+)
+
+// Periods a CHARTS request counts plays over, carried in its body
+const (
+	CHART_DAY  = "day"
+	CHART_WEEK = "week"
+)
+
+// What a SHARED_PLAYLIST asks the tracker for, in the Op of its
+// SharedRequest
+const (
+	// the shared playlists, without their songs
+	SHARED_LIST = iota
+	SHARED_CREATE
+	SHARED_ADD
+	// the songs added to a playlist since a version of it
+	SHARED_GET
+)
+
+// What an AUTH asks the tracker for, in the Op of its AuthRequest
+const (
+	// makes an account, with an invite if the tracker takes them only
+	// with one, and logs in to it
+	AUTH_REGISTER = iota
+	AUTH_LOGIN
+	// ends the session whose token is in the header
+	AUTH_LOGOUT
+)
+
+// Why a REPORT reports a song, in the Reason of its Report
+const (
+	// the file doesn't play, or doesn't match its hash
+	REPORT_CORRUPT = "corrupt"
+	// the file isn't the song its title and artist say
+	REPORT_MISLABELED = "mislabeled"
+)
+
+// Audio formats a song can be served in. Sources from peers that predate
+// formats leave it empty, meaning mp3
+const (
+	FORMAT_MP3    = "mp3"
+	FORMAT_FLAC   = "flac"
+	FORMAT_VORBIS = "ogg"
+	FORMAT_OPUS   = "opus"
+)
+
+/**
+ * A peer serving a song, and the name, size, SHA-256 (hex) and audio
+ * format of the file it serves it from. FileID is what the peer serves
+ * the file under: PLAY and SEEK sent to it carry FileID as their song ID
+ */
+type SongSource struct {
+	PeerAddr string
+	Filename string
+	Size     int64
+	Hash     string
+	Format   string
+	FileID   int
+	// transports besides TCP the peer takes PLAY and SEEK over, as CAP_
+	// flags
+	Caps byte
+	// the peer is still downloading the file, and only serves the pieces
+	// it already has, see HAVE
+	Partial bool
+	// the file's ReplayGain track gain in dB, read from its tags or
+	// measured by the peer, 0 if unknown. Players scale the audio by it so
+	// songs play at about the same loudness
+	Gain float64
+	// the serving peer's identity key, which its replies to PLAY and SEEK
+	// must be signed with. Set by the tracker from the peer's signed
+	// announcement, empty if it was unsigned
+	Key []byte
+	// only the peers whose identity keys are in Allow may see the source
+	// and fetch the file. Allow is only sent to the tracker, which lists
+	// the source without it
+	Restricted bool
+	Allow      [][]byte
+}
+
+/**
+ * A song's metadata as read from the file by the peer serving it, the body
+ * of the reply to an INFO. Bitrate is the average in kbps
+ */
+type SongDetails struct {
+	Title    string
+	Artist   string
+	Album    string
+	Year     string
+	Codec    string
+	Bitrate  int
+	Duration time.Duration
+	Size     int64
+}
+
+/**
+ * A song's cover art, the body of the reply to an ART: the image as it is
+ * embedded in the file's tags, and its MIME type, e.g. image/jpeg
+ */
+type SongArt struct {
+	MIME string
+	Data []byte
+}
+
+/**
+ * A live broadcast: the body of the BROADCAST a peer announces it to the
+ * tracker with, and of the reply to a BROADCAST tuning in to it. The
+ * tracker lists the broadcasts going on as a list of them
+ */
+type BroadcastInfo struct {
+	// what the peer on the air calls the broadcast
+	Name string
+	// the serving address of the peer on the air, where it is tuned in to
+	Addr string
+	// what is playing, e.g. "Artist - Title", empty between songs
+	Song      string
+	Listeners int
+	Started   time.Time
+	// false in the announcement that the broadcast is over
+	Live bool
+}
+
+/**
+ * A party: the body of the PARTY a peer hosting one announces it to the
+ * tracker with, and of each PARTY it sends the peers that joined it,
+ * whenever what it plays changes and every few seconds. The tracker lists
+ * the parties going on as a list of them
+ */
+type PartyState struct {
+	// what the host calls the party
+	Name string
+	// the serving address of the host, where the party is joined
+	Host string
+	// the song playing, ID 0 if none is
+	Song    SongEntry
+	Playing bool
+	// how far into the song the host was at At, by its own clock
+	Position time.Duration
+	At       time.Time
+	Members  int
+	Started  time.Time
+	// false once the party is over
+	Live bool
+	// members' votes to skip the song playing, and how many skip it
+	Votes       int
+	VotesNeeded int
+}
+
+/**
+ * The body of a CLOCK and its reply, an NTP style exchange a peer sets
+ * its clock against another's with: when the request was sent by the
+ * asker's clock, and when it was received and the reply sent by the
+ * answerer's
+ */
+type ClockSync struct {
+	Origin   time.Time
+	Receive  time.Time
+	Transmit time.Time
+}
+
+/**
+ * A peer online: the body of the PRESENCE a peer sharing what it listens
+ * to sends the tracker, and what the tracker lists for each peer online
+ */
+type Presence struct {
+	// what the peer goes by, empty if it doesn't say
+	Name string
+	// its serving address
+	Addr string
+	// its ed25519 identity key, empty from peers before version 17. The
+	// tracker only lists the key the PRESENCE was signed with
+	Key []byte
+	// the song it is listening to, ID 0 if none or it doesn't share it,
+	// whether it is paused, and since when it has played
+	Song   SongEntry
+	Paused bool
+	Since  time.Time
+	// when the tracker last heard from the peer, set by the tracker
+	Seen time.Time
+}
+
+/**
+ * A peer's library: the body of its reply to a LIBRARY. Signature is the
+ * challenge in the request signed with the private half of Key, so the
+ * asker knows it reached the peer it follows and not whoever holds its
+ * address now
+ */
+type PeerLibrary struct {
+	Key       []byte
+	Name      string
+	Signature []byte
+	// every song the peer serves, in the same format as LIST
+	Songs []SongEntry
+}
+
+/**
+ * The body of a SHARED_PLAYLIST: what is asked of the tracker, see
+ * SHARED_LIST
+ */
+type SharedRequest struct {
+	Op   int
+	Name string
+	// for SHARED_CREATE and SHARED_ADD, the nickname of the asking peer,
+	// empty if it has none
+	By string
+	// for SHARED_ADD, the ID of the song to append, from the master list
+	Song int
+	// for SHARED_GET, the version of the playlist the asker has
+	Since int
+}
+
+/**
+ * A playlist the tracker keeps, which any peer can append to. Songs are
+ * only ever appended, so its version is how many it has; the tracker
+ * replies to SHARED_GET with the songs after the version asked for, and
+ * to SHARED_LIST with every playlist and none of its songs
+ */
+type SharedPlaylist struct {
+	Name      string
+	CreatedBy string
+	Created   time.Time
+	Version   int
+	Entries   []SharedEntry
+}
+
+/**
+ * A song in a shared playlist, with who added it and when
+ */
+type SharedEntry struct {
+	// the song's master list entry when it was added
+	Song SongEntry
+	// the nickname of the peer that added it, empty if it had none, and
+	// the host it was added from, set by the tracker
+	AddedBy string
+	Addr    string
+	Added   time.Time
+}
+
+/**
+ * The body of an AUTH: an account's name and password, and for
+ * AUTH_REGISTER, the invite the tracker handed out, if it needs one
+ */
+type AuthRequest struct {
+	Op       int
+	User     string
+	Password string
+	Invite   string
+}
+
+/**
+ * The body of the tracker's reply to an AUTH registering or logging in:
+ * the session token to send in the header of every request from then on,
+ * and when it expires if unused. A tracker acting as a CA for mutual TLS
+ * also issues a certificate for the identity key the AUTH is signed with
+ */
+type AuthSession struct {
+	User    string
+	Token   string
+	Expires time.Time
+	// the certificate issued, and the tracker's CA certificate it chains
+	// to, both DER encoded; empty if none was issued
+	Cert []byte
+	CA   []byte
+}
+
+/**
+ * The body of a REPORT: the master list ID of the song reported, one of
+ * the REPORT_ reasons, and a note for the tracker's operator
+ */
+type Report struct {
+	Song   int
+	Reason string
+	Note   string
+}
+
+/**
+ * A writer, e.g. a connection to the tracker, whose messages carry a
+ * session token: Encode stamps it on every message that has none
+ */
+type SessionWriter interface {
+	io.Writer
+	SessionToken() string
+}
+
+/**
+ * A node of the DHT: its 256 bit ID and the address it serves on
+ */
+type DHTNode struct {
+	ID   []byte
+	Addr string
+}
+
+/**
+ * The body of every DHT message. Requests carry the sender, so the
+ * receiver can add it to its routing table, and the key looked up or
+ * stored under: a node ID, or the SHA-256 of a song file. Replies carry
+ * the nodes closest to the key the receiver knows of, and for a
+ * DHT_FIND_VALUE the songs stored under it. A DHT_STORE carries the
+ * sender's own song, with itself as the single source
+ */
+type DHTMsg struct {
+	// Addr is empty if the sender doesn't serve, and so can't be added
+	From  DHTNode
+	Key   []byte
+	Nodes []DHTNode
+	Songs []SongEntry
+}
+
+/**
+ * A song in a CHARTS reply, with how often it was played or downloaded
+ * over the period asked for
+ */
+type ChartEntry struct {
+	Song  SongEntry
+	Plays int
+}
+
+/**
+ * The reply to a LIST_SINCE: the songs added or changed since the version
+ * asked for, in full, and the IDs of the songs dropped. Full is set when
+ * the tracker can't tell what changed (e.g. the version is from another
+ * registry, or older than the changes it keeps), and Songs is then the
+ * whole master list
+ */
+type ListDelta struct {
+	// the registry the versions count changes to
+	Epoch   string
+	Version int64
+	Full    bool
+	Songs   []SongEntry
+	Removed []int
+}
+
+/**
+ * The body of an ADMIN request and its reply. A request carries the
+ * command, its arguments and, for a restore, the registry to restore; the
+ * reply carries the command's output in Body
+ */
+type AdminMsg struct {
+	Command string
+	Args    []string
+	Body    []byte
+}
+
+/**
+ * One song in the master list, with every peer that serves it. Peers
+ * register their songs with ID left for the tracker to fill in, and a
+ * single source. The ID is derived from the file's hash (see SongID), so
+ * every source of an entry serves the same file
+ */
+type SongEntry struct {
+	ID       int
+	Title    string
+	Artist   string
+	Duration time.Duration
+	Sources  []SongSource
+	// from the song's tags, empty if it has none or comes from a peer
+	// that predates them
+	Album string
+	Genre string
+	// the song's place on its album, from its tags, 0 if unknown
+	Track int
+	Disc  int
+	// the ID of another entry with the same title and artist but a
+	// different file (e.g. another encode), which lists show in its place;
+	// 0 if there is none, or this is the one shown. See MarkDuplicates
+	DuplicateOf int
+}
+
+/*
+ * Allows data to be sent using Gob
+ */
+func init() {
+	gob.Register(&Header{})
+	gob.Register(&Msg{})
+	gob.Register(&SongEntry{})
+	gob.Register(&SongSource{})
+	gob.Register(&SongDetails{})
+	gob.Register(&SongArt{})
+	gob.Register(&DHTMsg{})
+	gob.Register(&AdminMsg{})
+	gob.Register(&ChartEntry{})
+	gob.Register(&ListDelta{})
+}
+
+/**
+ * Populates a message to send
+ * @param t message type
+ * @param id song ID
+ * @param content content of the message
+ */
+func NewMsg(t byte, id int, content []byte) *Msg {
+	return &Msg{Header{Type: t, Song_id: id, Version: VERSION}, content}
+}
+
+/**
+ * An ERROR reply received from a peer
+ */
+type Error struct {
+	Code byte
+	Text string
+}
+
+func (e *Error) Error() string {
+	switch e.Code {
+	case ERR_NOT_FOUND:
+		return "song not found: " + e.Text
+	case ERR_BUSY:
+		return "peer busy: " + e.Text
+	case ERR_INTERNAL:
+		return "peer error: " + e.Text
+	case ERR_DENIED:
+		return "denied: " + e.Text
+	case ERR_AUTH:
+		return "not logged in: " + e.Text
+	}
+	return fmt.Sprintf("error %d: %s", e.Code, e.Text)
+}
+
+/**
+ * @param code one of the ERR_ codes
+ * @param text a human readable description
+ * @return an ERROR message
+ */
+func NewError(code byte, text string) *Msg {
+	msg := NewMsg(ERROR, 0, []byte(text))
+	msg.Header.Code = code
+	return msg
+}
+
+/**
+ * @return the error an ERROR message carries, nil for any other message
+ */
+func (m *Msg) Err() error {
+	if m.Header.Type != ERROR {
+		return nil
+	}
+	return &Error{Code: m.Header.Code, Text: string(m.Msg)}
+}
+
+/**
+ * Writes a TSP message as a single frame: a 4 byte big-endian length
+ * followed by the gob encoded message, with the session token of a
+ * SessionWriter
+ * @param w the writer to send the frame on
+ * @param msg the message to send
+ * @return an error if encoding or writing failed
+ */
+func Encode(w io.Writer, msg *Msg) error {
+	if msg.Header.Version == 0 {
+		msg.Header.Version = VERSION
+	}
+	if session, ok := w.(SessionWriter); ok && msg.Header.Token == "" {
+		msg.Header.Token = session.SessionToken()
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(msg); err != nil {
+		return err
+	}
+	if payload.Len() > MAX_FRAME_LEN {
+		return fmt.Errorf("tsp: message of %d bytes exceeds frame limit", payload.Len())
+	}
+
+	frame := make([]byte, FRAME_HEADER_LEN+payload.Len())
+	binary.BigEndian.PutUint32(frame, uint32(payload.Len()))
+	copy(frame[FRAME_HEADER_LEN:], payload.Bytes())
+	_, err := w.Write(frame)
+	return err
+}
+
+/**
+ * @param msg a message
+ * @param challenge what the receiver asked to have signed along with it,
+ * nil for none
+ * @return the bytes a signature of the message covers: its type, song ID,
+ * offset, length and format, its body and the challenge, each of the
+ * variable length ones after its length, then when it was signed, if it
+ * says
+ */
+func signed_bytes(msg *Msg, challenge []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(msg.Header.Type)
+	binary.Write(&buf, binary.BigEndian, int64(msg.Header.Song_id))
+	binary.Write(&buf, binary.BigEndian, msg.Header.Offset)
+	binary.Write(&buf, binary.BigEndian, msg.Header.Length)
+	for _, field := range [][]byte{[]byte(msg.Header.Format), msg.Msg, challenge} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	// left out when unset, so signatures from older peers still check out
+	if msg.Header.Signed != 0 {
+		binary.Write(&buf, binary.BigEndian, msg.Header.Signed)
+	}
+	return buf.Bytes()
+}
+
+/**
+ * Signs a message, setting its Key and Signature. Sign it last, changing
+ * what the signature covers afterwards invalidates it
+ * @param msg the message
+ * @param key the sender's identity
+ * @param challenge what the receiver asked to have signed along with it,
+ * nil for none
+ */
+func Sign(msg *Msg, key ed25519.PrivateKey, challenge []byte) {
+	msg.Header.Key = key.Public().(ed25519.PublicKey)
+	msg.Header.Signed = time.Now().UnixNano()
+	msg.Header.Signature = ed25519.Sign(key, signed_bytes(msg, challenge))
+}
+
+/**
+ * @param msg a message
+ * @param challenge what the receiver asked to have signed along with it,
+ * nil for none
+ * @return whether the message is signed, and signed by the private half
+ * of its Key
+ */
+func Verify(msg *Msg, challenge []byte) bool {
+	if len(msg.Header.Key) != ed25519.PublicKeySize || len(msg.Header.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(msg.Header.Key, signed_bytes(msg, challenge), msg.Header.Signature)
+}
+
+/**
+ * A signed request or announcement answers no challenge, so whoever sees
+ * one go by, e.g. a tracker relaying it, could send it again. Receivers
+ * only take those signed within MAX_SIGNATURE_AGE, and each only once
+ */
+type ReplayGuard struct {
+	mutex sync.Mutex
+	// the signatures taken, and when they were signed
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func NewReplayGuard() *ReplayGuard {
+	return &ReplayGuard{seen: make(map[string]time.Time)}
+}
+
+/**
+ * Takes a signed message, unless it is stale or was taken before. Check
+ * its signature with Verify first
+ * @param msg the message
+ * @return whether it was signed within MAX_SIGNATURE_AGE and is the first
+ * with its signature
+ */
+func (g *ReplayGuard) Take(msg *Msg) bool {
+	signed := time.Unix(0, msg.Header.Signed)
+	age := time.Since(signed)
+	if msg.Header.Signed == 0 || age > MAX_SIGNATURE_AGE || age < -MAX_SIGNATURE_AGE {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if time.Since(g.pruned) > MAX_SIGNATURE_AGE {
+		// anything older is stale anyway
+		for signature, at := range g.seen {
+			if time.Since(at) > MAX_SIGNATURE_AGE {
+				delete(g.seen, signature)
+			}
+		}
+		g.pruned = time.Now()
+	}
+	if _, ok := g.seen[string(msg.Header.Signature)]; ok {
+		return false
+	}
+	g.seen[string(msg.Header.Signature)] = signed
+	return true
+}
+
+/**
+ * Reads exactly one frame and decodes the TSP message it carries. Never
+ * reads past the end of the frame, so anything following it (e.g. mp3
+ * data) is left on the reader.
+ * @param r the reader to receive the frame from
+ * @return the decoded message, or an error on a short or oversized frame.
+ * Messages from newer protocol versions are taken, gob leaving out the
+ * fields this version doesn't know; see Common
+ */
+func Decode(r io.Reader) (*Msg, error) {
+	var hdr [FRAME_HEADER_LEN]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MAX_FRAME_LEN {
+		return nil, fmt.Errorf("tsp: frame of %d bytes exceeds frame limit", n)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	msg := new(Msg)
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Header.Version == 0 {
+		msg.Header.Version = 1
+	}
+	return msg, nil
+}
+
+/**
+ * @return the protocol version both the sender of the message and this
+ * end speak, the lower of its Version and VERSION. Gate features on it,
+ * so each end only uses what the other knows
+ */
+func (m *Msg) Common() byte {
+	if m.Header.Version < VERSION {
+		return m.Header.Version
+	}
+	return VERSION
+}
+
+/**
+ * @param value what a message carries
+ * @return it gob encoded, for the body of a TSP message
+ */
+func encode_gob[T any](value T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/**
+ * @param content the gob encoded body of a TSP message
+ * @return what it carries
+ */
+func decode_gob[T any](content []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(content)).Decode(&value)
+	return value, err
+}
+
+/**
+ * @param content the gob encoded body of a TSP message carrying a list
+ * @return the list; an empty body is an empty list
+ */
+func decode_list[T any](content []byte) ([]T, error) {
+	list := make([]T, 0)
+	if len(content) == 0 {
+		return list, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(content)).Decode(&list)
+	return list, err
+}
+
+/**
+ * @param songs the song entries to send
+ * @return the gob encoded entries, for the body of a TSP message
+ */
+func EncodeSongs(songs []SongEntry) ([]byte, error) {
+	return encode_gob(songs)
+}
+
+/**
+ * @param content the body of a TSP message carrying song entries
+ * @return the decoded entries; an empty body is an empty list
+ */
+func DecodeSongs(content []byte) ([]SongEntry, error) {
+	return decode_list[SongEntry](content)
+}
+
+/**
+ * @param details the metadata to send
+ * @return the body of an INFO reply
+ */
+func EncodeDetails(details SongDetails) ([]byte, error) {
+	return encode_gob(details)
+}
+
+/**
+ * @param content the body of an INFO reply
+ * @return the metadata it carries
+ */
+func DecodeDetails(content []byte) (SongDetails, error) {
+	return decode_gob[SongDetails](content)
+}
+
+/**
+ * @param art the cover art to send
+ * @return the body of an ART reply
+ */
+func EncodeArt(art SongArt) ([]byte, error) {
+	return encode_gob(art)
+}
+
+/**
+ * @param content the body of an ART reply
+ * @return the cover art it carries
+ */
+func DecodeArt(content []byte) (SongArt, error) {
+	return decode_gob[SongArt](content)
+}
+
+/**
+ * @param info a broadcast
+ * @return the body of a BROADCAST announcing it or tuned in to
+ */
+func EncodeBroadcast(info BroadcastInfo) ([]byte, error) {
+	return encode_gob(info)
+}
+
+/**
+ * @param content the body of a BROADCAST announcing a broadcast or tuned
+ * in to
+ * @return the broadcast
+ */
+func DecodeBroadcast(content []byte) (BroadcastInfo, error) {
+	return decode_gob[BroadcastInfo](content)
+}
+
+/**
+ * @param broadcasts the broadcasts going on
+ * @return the body of the tracker's reply to a BROADCAST asking for them
+ */
+func EncodeBroadcasts(broadcasts []BroadcastInfo) ([]byte, error) {
+	return encode_gob(broadcasts)
+}
+
+/**
+ * @param content the body of the tracker's reply to a BROADCAST asking for
+ * the broadcasts going on
+ * @return the broadcasts
+ */
+func DecodeBroadcasts(content []byte) ([]BroadcastInfo, error) {
+	return decode_gob[[]BroadcastInfo](content)
+}
+
+/**
+ * @param state a party
+ * @return the body of a PARTY announcing it or sent to its members
+ */
+func EncodeParty(state PartyState) ([]byte, error) {
+	return encode_gob(state)
+}
+
+/**
+ * @param content the body of a PARTY announcing a party or sent to its
+ * members
+ * @return the party
+ */
+func DecodeParty(content []byte) (PartyState, error) {
+	return decode_gob[PartyState](content)
+}
+
+/**
+ * @param parties the parties going on
+ * @return the body of the tracker's reply to a PARTY asking for them
+ */
+func EncodeParties(parties []PartyState) ([]byte, error) {
+	return encode_gob(parties)
+}
+
+/**
+ * @param content the body of the tracker's reply to a PARTY asking for the
+ * parties going on
+ * @return the parties
+ */
+func DecodeParties(content []byte) ([]PartyState, error) {
+	return decode_gob[[]PartyState](content)
+}
+
+/**
+ * @param presence what a peer is listening to
+ * @return the body of a PRESENCE sharing it
+ */
+func EncodePresence(presence Presence) ([]byte, error) {
+	return encode_gob(presence)
+}
+
+/**
+ * @param content the body of a PRESENCE sharing what a peer is listening
+ * to
+ * @return what it is listening to
+ */
+func DecodePresence(content []byte) (Presence, error) {
+	return decode_gob[Presence](content)
+}
+
+/**
+ * @param online the peers online
+ * @return the body of the tracker's reply to a PRESENCE asking for them
+ */
+func EncodePresences(online []Presence) ([]byte, error) {
+	return encode_gob(online)
+}
+
+/**
+ * @param content the body of the tracker's reply to a PRESENCE asking who
+ * is online
+ * @return the peers online
+ */
+func DecodePresences(content []byte) ([]Presence, error) {
+	return decode_gob[[]Presence](content)
+}
+
+/**
+ * @param library a peer's library and its signed challenge
+ * @return the body of the reply to a LIBRARY
+ */
+func EncodeLibrary(library PeerLibrary) ([]byte, error) {
+	return encode_gob(library)
+}
+
+/**
+ * @param content the body of the reply to a LIBRARY
+ * @return the peer's library and its signed challenge
+ */
+func DecodeLibrary(content []byte) (PeerLibrary, error) {
+	return decode_gob[PeerLibrary](content)
+}
+
+/**
+ * @param request what is asked of the tracker
+ * @return the body of a SHARED_PLAYLIST
+ */
+func EncodeSharedRequest(request SharedRequest) ([]byte, error) {
+	return encode_gob(request)
+}
+
+/**
+ * @param content the body of a SHARED_PLAYLIST
+ * @return what is asked of the tracker
+ */
+func DecodeSharedRequest(content []byte) (SharedRequest, error) {
+	return decode_gob[SharedRequest](content)
+}
+
+/**
+ * @param playlist a shared playlist, with the songs asked for
+ * @return the body of the tracker's reply to a SHARED_PLAYLIST
+ * creating, adding to or getting it
+ */
+func EncodeSharedPlaylist(playlist SharedPlaylist) ([]byte, error) {
+	return encode_gob(playlist)
+}
+
+/**
+ * @param content the body of the tracker's reply to a SHARED_PLAYLIST
+ * creating, adding to or getting a playlist
+ * @return the playlist, with the songs asked for
+ */
+func DecodeSharedPlaylist(content []byte) (SharedPlaylist, error) {
+	return decode_gob[SharedPlaylist](content)
+}
+
+/**
+ * @param playlists the shared playlists, without their songs
+ * @return the body of the tracker's reply to a SHARED_LIST
+ */
+func EncodeSharedPlaylists(playlists []SharedPlaylist) ([]byte, error) {
+	return encode_gob(playlists)
+}
+
+/**
+ * @param content the body of the tracker's reply to a SHARED_LIST
+ * @return the shared playlists, without their songs
+ */
+func DecodeSharedPlaylists(content []byte) ([]SharedPlaylist, error) {
+	return decode_gob[[]SharedPlaylist](content)
+}
+
+/**
+ * @param request an account's name and password
+ * @return the body of an AUTH
+ */
+func EncodeAuth(request AuthRequest) ([]byte, error) {
+	return encode_gob(request)
+}
+
+/**
+ * @param content the body of an AUTH
+ * @return the account's name and password
+ */
+func DecodeAuth(content []byte) (AuthRequest, error) {
+	return decode_gob[AuthRequest](content)
+}
+
+/**
+ * @param session the session the tracker issued
+ * @return the body of the tracker's reply to an AUTH
+ */
+func EncodeSession(session AuthSession) ([]byte, error) {
+	return encode_gob(session)
+}
+
+/**
+ * @param content the body of the tracker's reply to an AUTH
+ * @return the session it issued
+ */
+func DecodeSession(content []byte) (AuthSession, error) {
+	return decode_gob[AuthSession](content)
+}
+
+/**
+ * @param report the song reported and why
+ * @return the body of a REPORT
+ */
+func EncodeReport(report Report) ([]byte, error) {
+	return encode_gob(report)
+}
+
+/**
+ * @param content the body of a REPORT
+ * @return the song reported and why
+ */
+func DecodeReport(content []byte) (Report, error) {
+	return decode_gob[Report](content)
+}
+
+/**
+ * @param sync the times of a clock exchange so far
+ * @return the body of a CLOCK or its reply
+ */
+func EncodeClock(sync ClockSync) ([]byte, error) {
+	return encode_gob(sync)
+}
+
+/**
+ * @param content the body of a CLOCK or its reply
+ * @return the times of the clock exchange
+ */
+func DecodeClock(content []byte) (ClockSync, error) {
+	return decode_gob[ClockSync](content)
+}
+
+/**
+ * @param hashes the hex SHA-256 of each piece of a song, in order
+ * @return the body of a PIECES reply
+ */
+func EncodePieces(hashes []string) ([]byte, error) {
+	return encode_gob(hashes)
+}
+
+/**
+ * @param content the body of a PIECES reply
+ * @return the piece hashes it carries
+ */
+func DecodePieces(content []byte) ([]string, error) {
+	return decode_gob[[]string](content)
+}
+
+/**
+ * @param have the body of a HAVE reply, one bit per piece, first piece in
+ * the high bit of the first byte
+ * @param index a piece of the song
+ * @return whether the peer has the piece
+ */
+func HasPiece(have []byte, index int) bool {
+	return index/8 < len(have) && have[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+/**
+ * Marks a piece as had, for the body of a HAVE reply
+ * @param have one bit per piece, see HasPiece
+ * @param index a piece of the song
+ */
+func SetPiece(have []byte, index int) {
+	have[index/8] |= 0x80 >> uint(index%8)
+}
+
+/**
+ * @param msg a DHT request or reply
+ * @return the body of the TSP message carrying it
+ */
+func EncodeDHT(msg DHTMsg) ([]byte, error) {
+	return encode_gob(msg)
+}
+
+/**
+ * @param content the body of a DHT message
+ * @return the request or reply it carries
+ */
+func DecodeDHT(content []byte) (DHTMsg, error) {
+	return decode_gob[DHTMsg](content)
+}
+
+/**
+ * @param addrs the serving addresses of peers
+ * @return the body of a PEX message
+ */
+func EncodePeers(addrs []string) ([]byte, error) {
+	return encode_gob(addrs)
+}
+
+/**
+ * @param content the body of a PEX message
+ * @return the addresses it carries; an empty body is an empty list
+ */
+func DecodePeers(content []byte) ([]string, error) {
+	return decode_list[string](content)
+}
+
+/**
+ * @param delta the changes to the master list
+ * @return the body of a LIST_SINCE reply
+ */
+func EncodeDelta(delta ListDelta) ([]byte, error) {
+	return encode_gob(delta)
+}
+
+/**
+ * @param content the body of a LIST_SINCE reply
+ * @return the changes it carries
+ */
+func DecodeDelta(content []byte) (ListDelta, error) {
+	return decode_gob[ListDelta](content)
+}
+
+/**
+ * @param msg an ADMIN request or reply
+ * @return the body of the TSP message carrying it
+ */
+func EncodeAdmin(msg AdminMsg) ([]byte, error) {
+	return encode_gob(msg)
+}
+
+/**
+ * @param content the body of an ADMIN message
+ * @return the request or reply it carries
+ */
+func DecodeAdmin(content []byte) (AdminMsg, error) {
+	return decode_gob[AdminMsg](content)
+}
+
+/**
+ * @param chart the songs played most, most first
+ * @return the body of a CHARTS reply
+ */
+func EncodeCharts(chart []ChartEntry) ([]byte, error) {
+	return encode_gob(chart)
+}
+
+/**
+ * @param content the body of a CHARTS reply
+ * @return the songs it carries; an empty body is an empty chart
+ */
+func DecodeCharts(content []byte) ([]ChartEntry, error) {
+	return decode_list[ChartEntry](content)
+}
+
+/**
+ * @param hash a source's Hash, as announced by a peer
+ * @return whether it is a SHA-256 in hex, and so safe to name a file after
+ */
+func ValidHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+/**
+ * @param format a source's Format, as announced or replied by a peer
+ * @return whether it is one of the FORMAT_ constants, or empty (mp3)
+ */
+func ValidFormat(format string) bool {
+	switch format {
+	case "", FORMAT_MP3, FORMAT_FLAC, FORMAT_VORBIS, FORMAT_OPUS:
+		return true
+	}
+	return false
+}
+
+/**
+ * @param song a song entry
+ * @param source a peer serving it
+ * @return the ID of the song the source serves: the first 48 bits of the
+ * file's hash, so every peer serving the same file gets the same ID from
+ * any tracker, across restarts. Sources without a hash (from peers that
+ * predate hashes) get one from the hash of the song's title and artist
+ */
+func SongID(song SongEntry, source SongSource) int {
+	key := source.Hash
+	if _, err := hex.DecodeString(key); err != nil || len(key) < SONG_ID_DIGITS {
+		sum := sha256.Sum256([]byte(strings.ToLower(song.Title) + "\x00" + strings.ToLower(song.Artist)))
+		key = hex.EncodeToString(sum[:])
+	}
+	id, _ := strconv.ParseInt(key[:SONG_ID_DIGITS], 16, 64)
+	return int(id)
+}
+
+/**
+ * @param source a peer serving a song
+ * @param key the identity key of the peer asking, nil if unknown
+ * @return whether that peer may see the source
+ */
+func MaySee(source SongSource, key []byte) bool {
+	if !source.Restricted {
+		return true
+	}
+	for _, allowed := range source.Allow {
+		if len(key) > 0 && bytes.Equal(allowed, key) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @param song a song entry
+ * @param key the identity key of the peer asking, nil if unknown
+ * @return the song with only the sources that peer may see, without their
+ * Allow, and false if it may see none
+ */
+func VisibleSong(song SongEntry, key []byte) (SongEntry, bool) {
+	sources := make([]SongSource, 0, len(song.Sources))
+	for _, source := range song.Sources {
+		if MaySee(source, key) {
+			source.Allow = nil
+			sources = append(sources, source)
+		}
+	}
+	song.Sources = sources
+	return song, len(sources) > 0
+}
+
+/**
+ * @param songs a list of songs
+ * @param key the identity key of the peer asking, nil if unknown
+ * @return the songs that peer may see, each with only the sources it may
+ * see, see VisibleSong
+ */
+func VisibleSongs(songs []SongEntry, key []byte) []SongEntry {
+	visible := make([]SongEntry, 0, len(songs))
+	for _, song := range songs {
+		if song, ok := VisibleSong(song, key); ok {
+			visible = append(visible, song)
+		}
+	}
+	return visible
+}
+
+/**
+ * Flags near-duplicates: entries with the same title and artist serving
+ * different files. Of each such set, the entry with the most sources (the
+ * lowest ID if that ties) is left unflagged, and the others get its ID as
+ * their DuplicateOf
+ * @param songs the master list, flagged in place
+ */
+func MarkDuplicates(songs []SongEntry) {
+	primary := make(map[string]int)
+	for i, song := range songs {
+		key := strings.ToLower(song.Title) + "\x00" + strings.ToLower(song.Artist)
+		j, ok := primary[key]
+		if !ok {
+			primary[key] = i
+			continue
+		}
+		other := songs[j]
+		if len(song.Sources) > len(other.Sources) || (len(song.Sources) == len(other.Sources) && song.ID < other.ID) {
+			primary[key] = i
+		}
+	}
+	for i, song := range songs {
+		key := strings.ToLower(song.Title) + "\x00" + strings.ToLower(song.Artist)
+		songs[i].DuplicateOf = 0
+		if j := primary[key]; j != i {
+			songs[i].DuplicateOf = songs[j].ID
+		}
+	}
+}
+
+/**
+ * @return whether two entries are the same song: same title and artist,
+ * ignoring case
+ */
+func SameSong(a SongEntry, b SongEntry) bool {
+	return strings.EqualFold(a.Title, b.Title) && strings.EqualFold(a.Artist, b.Artist)
+}